@@ -6,6 +6,18 @@
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 CREATE EXTENSION IF NOT EXISTS "pg_trgm";
 CREATE EXTENSION IF NOT EXISTS "btree_gin";
+CREATE EXTENSION IF NOT EXISTS "unaccent";
+
+-- Search functions (used by src/internal/search)
+-- unaccent() is only STABLE, so it is wrapped to be usable in index expressions
+CREATE OR REPLACE FUNCTION melodee_unaccent(text) RETURNS text AS $$
+    SELECT public.unaccent('public.unaccent'::regdictionary, $1)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT;
+
+CREATE OR REPLACE FUNCTION melodee_search_vector(name text, alternate_names text[]) RETURNS tsvector AS $$
+    SELECT setweight(to_tsvector('simple', melodee_unaccent(coalesce(name, ''))), 'A') ||
+           setweight(to_tsvector('simple', melodee_unaccent(coalesce(array_to_string(alternate_names, ' '), ''))), 'B')
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
 
 -- Users Table
 CREATE TABLE IF NOT EXISTS users (
@@ -15,6 +27,8 @@ CREATE TABLE IF NOT EXISTS users (
     email VARCHAR(255),
     password_hash VARCHAR(255) NOT NULL,
     is_admin BOOLEAN DEFAULT FALSE,
+    jukebox_role BOOLEAN DEFAULT FALSE,
+    consolidate_editions BOOLEAN DEFAULT FALSE,
     failed_login_attempts INTEGER DEFAULT 0,
     locked_until TIMESTAMP,
     password_reset_token VARCHAR(255),
@@ -24,13 +38,25 @@ CREATE TABLE IF NOT EXISTS users (
 );
 CREATE INDEX IF NOT EXISTS idx_users_api_key ON users (api_key);
 
+-- Subsonic App Passwords Table (secrets encrypted with the server key for token auth)
+CREATE TABLE IF NOT EXISTS subsonic_passwords (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    encrypted_secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subsonic_passwords_user_id ON subsonic_passwords (user_id);
+
 -- Libraries Table
 CREATE TABLE IF NOT EXISTS libraries (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
     path TEXT NOT NULL,
-    type VARCHAR(50) NOT NULL CHECK (type IN ('inbound', 'staging', 'production')),
+    type VARCHAR(50) NOT NULL CHECK (type IN ('inbound', 'staging', 'production', 'podcast')),
     is_locked BOOLEAN DEFAULT FALSE,
+    is_watched BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     track_count INTEGER DEFAULT 0,
     album_count INTEGER DEFAULT 0,
@@ -96,12 +122,39 @@ CREATE TABLE IF NOT EXISTS artists (
     track_count INTEGER DEFAULT 0,
     album_count INTEGER DEFAULT 0,
     duration BIGINT DEFAULT 0,
+    musicbrainz_id UUID,
+    spotify_id VARCHAR(255),
+    discogs_id VARCHAR(255),
+    wikidata_id VARCHAR(255),
+    biography TEXT,
+    image_url VARCHAR(1024),
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 CREATE INDEX IF NOT EXISTS idx_artists_name_normalized ON artists USING gin(name_normalized gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_artists_search_vector ON artists USING gin(melodee_search_vector(name_normalized, alternate_names));
+CREATE INDEX IF NOT EXISTS idx_artists_search_trgm ON artists USING gin(melodee_unaccent(name_normalized) gin_trgm_ops);
 CREATE INDEX IF NOT EXISTS idx_artists_directory_code ON artists (directory_code);
 
+-- Release Groups Table (editions of the same album, MusicBrainz style)
+CREATE TABLE IF NOT EXISTS release_groups (
+    id BIGSERIAL PRIMARY KEY,
+    api_key UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+    artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    name_normalized VARCHAR(255) NOT NULL,
+    primary_album_id BIGINT,
+    musicbrainz_id UUID,
+    release_count INTEGER DEFAULT 0,
+    track_count_cached INTEGER DEFAULT 0,
+    duration_cached BIGINT DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(artist_id, name_normalized)
+);
+CREATE INDEX IF NOT EXISTS idx_release_groups_artist_id ON release_groups (artist_id);
+CREATE INDEX IF NOT EXISTS idx_release_groups_primary_album_id ON release_groups (primary_album_id);
+
 -- Albums Table (simplified)
 CREATE TABLE IF NOT EXISTS albums (
     id BIGSERIAL PRIMARY KEY,
@@ -113,14 +166,28 @@ CREATE TABLE IF NOT EXISTS albums (
     name_normalized VARCHAR(255) NOT NULL,
     directory VARCHAR(500),
     album_type VARCHAR(50),
+    release_group_id BIGINT REFERENCES release_groups(id) ON DELETE SET NULL,
+    edition_type VARCHAR(50),
     track_count INTEGER DEFAULT 0,
     duration BIGINT DEFAULT 0,
+    release_date TIMESTAMP,
+    original_release_date TIMESTAMP,
+    genres TEXT[],
+    description TEXT,
+    musicbrainz_id UUID,
+    spotify_id VARCHAR(255),
+    discogs_id VARCHAR(255),
+    wikidata_id VARCHAR(255),
+    image_url VARCHAR(1024),
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 CREATE INDEX IF NOT EXISTS idx_albums_artist_id ON albums (artist_id);
 CREATE INDEX IF NOT EXISTS idx_albums_library_id ON albums (library_id);
+CREATE INDEX IF NOT EXISTS idx_albums_release_group_id ON albums (release_group_id);
 CREATE INDEX IF NOT EXISTS idx_albums_name_normalized ON albums USING gin(name_normalized gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_albums_search_vector ON albums USING gin(melodee_search_vector(name_normalized, alternate_names));
+CREATE INDEX IF NOT EXISTS idx_albums_search_trgm ON albums USING gin(melodee_unaccent(name_normalized) gin_trgm_ops);
 
 -- Tracks Table (simplified)
 CREATE TABLE IF NOT EXISTS tracks (
@@ -130,8 +197,8 @@ CREATE TABLE IF NOT EXISTS tracks (
     artist_id BIGINT REFERENCES artists(id) ON DELETE CASCADE,
     library_id INTEGER REFERENCES libraries(id) ON DELETE CASCADE,
     is_locked BOOLEAN DEFAULT FALSE,
-    title VARCHAR(255) NOT NULL,
-    title_normalized VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    name_normalized VARCHAR(255) NOT NULL,
     relative_path TEXT,
     file_name VARCHAR(500),
     duration BIGINT DEFAULT 0,
@@ -139,13 +206,44 @@ CREATE TABLE IF NOT EXISTS tracks (
     sample_rate INTEGER,
     channels INTEGER,
     file_size BIGINT,
+    fingerprint TEXT,
+    duplicate_of_id BIGINT REFERENCES tracks(id) ON DELETE SET NULL,
+    start_offset BIGINT NOT NULL DEFAULT 0,
+    end_offset BIGINT NOT NULL DEFAULT 0,
+    replaygain_track_gain DOUBLE PRECISION,
+    replaygain_track_peak DOUBLE PRECISION,
+    replaygain_album_gain DOUBLE PRECISION,
+    replaygain_album_peak DOUBLE PRECISION,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 CREATE INDEX IF NOT EXISTS idx_tracks_album_id ON tracks (album_id);
+CREATE INDEX IF NOT EXISTS idx_tracks_duplicate_of_id ON tracks (duplicate_of_id);
 CREATE INDEX IF NOT EXISTS idx_tracks_artist_id ON tracks (artist_id);
 CREATE INDEX IF NOT EXISTS idx_tracks_library_id ON tracks (library_id);
-CREATE INDEX IF NOT EXISTS idx_tracks_title_normalized ON tracks USING gin(title_normalized gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_tracks_name_normalized ON tracks USING gin(name_normalized gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_tracks_search_vector ON tracks USING gin(melodee_search_vector(name_normalized, NULL::text[]));
+CREATE INDEX IF NOT EXISTS idx_tracks_search_trgm ON tracks USING gin(melodee_unaccent(name_normalized) gin_trgm_ops);
+
+-- Contributors table: composers, performers, featured artists and the like
+CREATE TABLE IF NOT EXISTS contributors (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(100) NOT NULL,
+    sort_name VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(name, type)
+);
+
+-- Track contributors table
+CREATE TABLE IF NOT EXISTS track_contributors (
+    track_id BIGINT REFERENCES tracks(id) ON DELETE CASCADE,
+    contributor_id INTEGER REFERENCES contributors(id) ON DELETE CASCADE,
+    PRIMARY KEY (track_id, contributor_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_track_contributors_contributor_id ON track_contributors (contributor_id);
 
 -- Playlists Table
 CREATE TABLE IF NOT EXISTS playlists (
@@ -159,7 +257,9 @@ CREATE TABLE IF NOT EXISTS playlists (
     changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     duration BIGINT DEFAULT 0,
     track_count INTEGER DEFAULT 0,
-    cover_art_id INTEGER
+    cover_art_id INTEGER,
+    rules JSONB,
+    refreshed_at TIMESTAMP
 );
 CREATE INDEX IF NOT EXISTS idx_playlists_user_id ON playlists (user_id);
 CREATE INDEX IF NOT EXISTS idx_playlists_api_key ON playlists (api_key);
@@ -177,20 +277,376 @@ CREATE TABLE IF NOT EXISTS playlist_tracks (
 CREATE INDEX IF NOT EXISTS idx_playlist_tracks_playlist_id ON playlist_tracks (playlist_id);
 CREATE INDEX IF NOT EXISTS idx_playlist_tracks_track_id ON playlist_tracks (track_id);
 
+-- User Tracks (per-user play counts, stars, ratings; used by smart playlist rules)
+CREATE TABLE IF NOT EXISTS user_tracks (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    played_count INTEGER DEFAULT 0,
+    last_played_at TIMESTAMP,
+    is_starred BOOLEAN DEFAULT FALSE,
+    is_hated BOOLEAN DEFAULT FALSE,
+    starred_at TIMESTAMP,
+    rating SMALLINT DEFAULT 0 CHECK (rating >= 0 AND rating <= 5),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, track_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_tracks_track_id ON user_tracks (track_id);
+
+-- User Albums (per-user album stars, ratings and hates)
+CREATE TABLE IF NOT EXISTS user_albums (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    album_id BIGINT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    played_count INTEGER DEFAULT 0,
+    last_played_at TIMESTAMP,
+    is_starred BOOLEAN DEFAULT FALSE,
+    is_hated BOOLEAN DEFAULT FALSE,
+    starred_at TIMESTAMP,
+    rating SMALLINT DEFAULT 0 CHECK (rating >= 0 AND rating <= 5),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, album_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_albums_album_id ON user_albums (album_id);
+
+-- User Artists (per-user artist stars, ratings and hates)
+CREATE TABLE IF NOT EXISTS user_artists (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    is_starred BOOLEAN DEFAULT FALSE,
+    is_hated BOOLEAN DEFAULT FALSE,
+    starred_at TIMESTAMP,
+    rating SMALLINT DEFAULT 0 CHECK (rating >= 0 AND rating <= 5),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, artist_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_artists_artist_id ON user_artists (artist_id);
+
+-- Artist Relations (members, collaborators, influences; edges for similar artists)
+CREATE TABLE IF NOT EXISTS artist_relations (
+    id SERIAL PRIMARY KEY,
+    api_key UUID UNIQUE NOT NULL DEFAULT gen_random_uuid(),
+    from_artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    to_artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    relation_type VARCHAR(100) NOT NULL,
+    relation_start TIMESTAMP,
+    relation_end TIMESTAMP,
+    is_locked BOOLEAN DEFAULT FALSE,
+    sort_order INTEGER DEFAULT 0,
+    tags JSONB,
+    notes TEXT,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(from_artist_id, to_artist_id, relation_type)
+);
+CREATE INDEX IF NOT EXISTS idx_artist_relations_to_artist_id ON artist_relations (to_artist_id);
+
+-- Players Table (clients seen by the OpenSubsonic API)
+CREATE TABLE IF NOT EXISTS players (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    user_agent TEXT,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client VARCHAR(500) NOT NULL,
+    ip_address VARCHAR(45),
+    last_seen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    max_bitrate INTEGER DEFAULT 0,
+    scrobble_enabled BOOLEAN DEFAULT TRUE,
+    transcoding_id VARCHAR(255),
+    hostname VARCHAR(500),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, client)
+);
+
+-- Play Events (completed plays, partitioned by month; used by src/internal/playhistory)
+CREATE TABLE IF NOT EXISTS play_events (
+    id BIGSERIAL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    player_id INTEGER REFERENCES players(id) ON DELETE SET NULL,
+    client VARCHAR(500),
+    played_at TIMESTAMP NOT NULL,
+    duration_played BIGINT NOT NULL DEFAULT 0,
+    source VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id, played_at)
+) PARTITION BY RANGE (played_at);
+CREATE TABLE IF NOT EXISTS play_events_default PARTITION OF play_events DEFAULT;
+CREATE INDEX IF NOT EXISTS idx_play_events_id ON play_events (id);
+CREATE INDEX IF NOT EXISTS idx_play_events_user_played_at ON play_events (user_id, played_at);
+
+-- Creates the monthly play_events partitions (play_events_y2024m01, ...) from
+-- the current month up to months_ahead months later
+CREATE OR REPLACE FUNCTION melodee_ensure_play_event_partitions(months_ahead integer) RETURNS void AS $$
+DECLARE
+    month_start date := date_trunc('month', CURRENT_DATE)::date;
+    partition_start date;
+BEGIN
+    FOR i IN 0..months_ahead LOOP
+        partition_start := (month_start + make_interval(months => i))::date;
+        EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF play_events FOR VALUES FROM (%L) TO (%L)',
+            'play_events_' || to_char(partition_start, '"y"YYYY"m"MM'),
+            partition_start,
+            (partition_start + interval '1 month')::date);
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+SELECT melodee_ensure_play_event_partitions(1);
+
+-- Track Play Stats (daily per-user roll-up of play_events)
+CREATE TABLE IF NOT EXISTS track_play_stats (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    play_count INTEGER NOT NULL DEFAULT 0,
+    duration_played BIGINT NOT NULL DEFAULT 0,
+    last_played_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, track_id, day)
+);
+CREATE INDEX IF NOT EXISTS idx_track_play_stats_track_id ON track_play_stats (track_id);
+CREATE INDEX IF NOT EXISTS idx_track_play_stats_user_day ON track_play_stats (user_id, day);
+
+-- Play Stats Progress (last play event rolled up into track_play_stats; a single row)
+CREATE TABLE IF NOT EXISTS play_stats_progress (
+    id INTEGER PRIMARY KEY,
+    last_event_id BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Now Playing (one row per user and client, expires when the track should have ended)
+CREATE TABLE IF NOT EXISTS now_playing (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    player_id INTEGER REFERENCES players(id) ON DELETE SET NULL,
+    client VARCHAR(500) NOT NULL,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    started_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE(user_id, client)
+);
+CREATE INDEX IF NOT EXISTS idx_now_playing_expires_at ON now_playing (expires_at);
+
+-- Scrobbler Accounts (Last.fm / ListenBrainz links; sessions encrypted with the server key)
+CREATE TABLE IF NOT EXISTS scrobbler_accounts (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    service VARCHAR(50) NOT NULL,
+    username VARCHAR(255),
+    encrypted_session TEXT NOT NULL,
+    enabled BOOLEAN DEFAULT TRUE,
+    last_error TEXT,
+    last_submitted_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, service)
+);
+
+-- Scrobble Queue (plays waiting to be submitted to a scrobbler account, oldest first)
+CREATE TABLE IF NOT EXISTS scrobble_queue (
+    id BIGSERIAL PRIMARY KEY,
+    account_id BIGINT NOT NULL REFERENCES scrobbler_accounts(id) ON DELETE CASCADE,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    played_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_scrobble_queue_account_played_at ON scrobble_queue (account_id, played_at);
+
+-- Similar Artists (precomputed neighbors, rebuilt by the similarity job)
+CREATE TABLE IF NOT EXISTS similar_artists (
+    artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    similar_artist_id BIGINT NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (artist_id, similar_artist_id)
+);
+CREATE INDEX IF NOT EXISTS idx_similar_artists_artist_score ON similar_artists (artist_id, score DESC);
+
+-- Similar Tracks (precomputed neighbors, rebuilt by the similarity job)
+CREATE TABLE IF NOT EXISTS similar_tracks (
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    similar_track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (track_id, similar_track_id)
+);
+CREATE INDEX IF NOT EXISTS idx_similar_tracks_track_score ON similar_tracks (track_id, score DESC);
+
+-- Fingerprint Hashes (top 20 bits of each sub-fingerprint of tracks.fingerprint, for fuzzy matching)
+CREATE TABLE IF NOT EXISTS fingerprint_hashes (
+    hash INTEGER NOT NULL,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    PRIMARY KEY (hash, track_id)
+);
+CREATE INDEX IF NOT EXISTS idx_fingerprint_hashes_track_id ON fingerprint_hashes (track_id);
+
+-- Lyrics (embedded, sidecar .lrc/.txt or entered by hand; one synced and one unsynced set per language)
+CREATE TABLE IF NOT EXISTS lyrics (
+    id BIGSERIAL PRIMARY KEY,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE,
+    lang VARCHAR(16) NOT NULL DEFAULT 'xxx',
+    synced BOOLEAN NOT NULL DEFAULT FALSE,
+    "offset" BIGINT DEFAULT 0,
+    display_artist VARCHAR(255),
+    display_title VARCHAR(255),
+    lines JSONB NOT NULL DEFAULT '[]',
+    source VARCHAR(20) NOT NULL CHECK (source IN ('embedded', 'sidecar', 'manual')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(track_id, lang, synced)
+);
+
+-- Images (album images in the album directory, artist images in the artist directory)
+CREATE TABLE IF NOT EXISTS images (
+    id BIGSERIAL PRIMARY KEY,
+    album_id BIGINT REFERENCES albums(id) ON DELETE CASCADE,
+    artist_id BIGINT REFERENCES artists(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('front', 'back', 'disc', 'artist')),
+    source VARCHAR(20) NOT NULL CHECK (source IN ('folder', 'embedded', 'upload')),
+    file_name VARCHAR(255) NOT NULL,
+    width INTEGER DEFAULT 0,
+    height INTEGER DEFAULT 0,
+    file_size BIGINT DEFAULT 0,
+    checksum VARCHAR(64) NOT NULL,
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((album_id IS NULL) <> (artist_id IS NULL))
+);
+CREATE INDEX IF NOT EXISTS idx_images_album_id ON images (album_id);
+CREATE INDEX IF NOT EXISTS idx_images_artist_id ON images (artist_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_album_primary ON images (album_id) WHERE is_primary AND album_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_artist_primary ON images (artist_id) WHERE is_primary AND artist_id IS NOT NULL;
+
+-- Metadata Provenance (which provider set each enriched artist and album field)
+CREATE TABLE IF NOT EXISTS metadata_provenance (
+    id BIGSERIAL PRIMARY KEY,
+    entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('artist', 'album')),
+    entity_id BIGINT NOT NULL,
+    field VARCHAR(50) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    value TEXT,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(entity_type, entity_id, field)
+);
+
+-- Metadata Cache (metadata provider responses, including lookups that found nothing)
+CREATE TABLE IF NOT EXISTS metadata_cache (
+    provider VARCHAR(50) NOT NULL,
+    key VARCHAR(64) NOT NULL,
+    status INTEGER NOT NULL,
+    body TEXT,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, key)
+);
+CREATE INDEX IF NOT EXISTS idx_metadata_cache_expires_at ON metadata_cache (expires_at);
+
+-- Jukebox Queue (server-side playback, shared by all jukebox users)
+CREATE TABLE IF NOT EXISTS jukebox_entries (
+    id BIGSERIAL PRIMARY KEY,
+    position INTEGER NOT NULL,
+    track_id BIGINT NOT NULL REFERENCES tracks(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_jukebox_entries_position ON jukebox_entries (position);
+
+-- Jukebox State (a single row)
+CREATE TABLE IF NOT EXISTS jukebox_states (
+    id INTEGER PRIMARY KEY,
+    current_index INTEGER DEFAULT 0,
+    position INTEGER DEFAULT 0,
+    gain REAL DEFAULT 0.5,
+    playing BOOLEAN DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Podcast Channels Table
+CREATE TABLE IF NOT EXISTS podcast_channels (
+    id SERIAL PRIMARY KEY,
+    api_key UUID UNIQUE DEFAULT gen_random_uuid(),
+    url TEXT NOT NULL UNIQUE,
+    title VARCHAR(255),
+    description TEXT,
+    image_url TEXT,
+    status VARCHAR(50) DEFAULT 'new',
+    error_message TEXT,
+    keep_episodes INTEGER DEFAULT 0,
+    refreshed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Podcast Episodes Table
+CREATE TABLE IF NOT EXISTS podcast_episodes (
+    id BIGSERIAL PRIMARY KEY,
+    api_key UUID UNIQUE DEFAULT gen_random_uuid(),
+    channel_id INTEGER NOT NULL REFERENCES podcast_channels(id) ON DELETE CASCADE,
+    guid VARCHAR(512) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT,
+    publish_date TIMESTAMP,
+    duration INTEGER DEFAULT 0,
+    status VARCHAR(50) DEFAULT 'new',
+    error_message TEXT,
+    enclosure_url TEXT,
+    file_name TEXT,
+    file_size BIGINT DEFAULT 0,
+    checksum VARCHAR(64),
+    content_type VARCHAR(100),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(channel_id, guid)
+);
+CREATE INDEX IF NOT EXISTS idx_podcast_episodes_channel_id ON podcast_episodes (channel_id);
+CREATE INDEX IF NOT EXISTS idx_podcast_episodes_publish_date ON podcast_episodes (publish_date DESC);
+
 -- Shares Table
 CREATE TABLE IF NOT EXISTS shares (
     id SERIAL PRIMARY KEY,
-    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
-    resource_type VARCHAR(50) NOT NULL,
-    resource_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    name VARCHAR(255),
     description TEXT,
     expires_at TIMESTAMP,
-    visit_count INTEGER DEFAULT 0,
+    max_streaming_minutes INTEGER NOT NULL DEFAULT 0,
+    max_streaming_count INTEGER NOT NULL DEFAULT 0,
+    allow_streaming BOOLEAN NOT NULL DEFAULT TRUE,
+    allow_download BOOLEAN NOT NULL DEFAULT FALSE,
+    visit_count INTEGER NOT NULL DEFAULT 0,
+    last_visited_at TIMESTAMP,
+    stream_count INTEGER NOT NULL DEFAULT 0,
+    streamed_seconds BIGINT NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 CREATE INDEX IF NOT EXISTS idx_shares_user_id ON shares (user_id);
 
+-- Share Items (tracks, albums and playlists in a share)
+CREATE TABLE IF NOT EXISTS share_items (
+    id BIGSERIAL PRIMARY KEY,
+    share_id INTEGER NOT NULL REFERENCES shares(id) ON DELETE CASCADE,
+    item_type VARCHAR(20) NOT NULL CHECK (item_type IN ('track', 'album', 'playlist')),
+    item_id BIGINT NOT NULL,
+    position INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_share_items_share_id ON share_items (share_id, position);
+
+-- Share Activity (visits, streams and downloads of shares)
+CREATE TABLE IF NOT EXISTS share_activities (
+    id SERIAL PRIMARY KEY,
+    share_id INTEGER NOT NULL REFERENCES shares(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(20) NOT NULL,
+    track_id BIGINT REFERENCES tracks(id) ON DELETE SET NULL,
+    ip_address VARCHAR(45),
+    accessed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_agent TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_share_activities_share_id ON share_activities (share_id, accessed_at);
+
 -- Capacity Status Table  
 CREATE TABLE IF NOT EXISTS capacity_statuses (
     id SERIAL PRIMARY KEY,
@@ -238,6 +694,7 @@ CREATE TABLE IF NOT EXISTS staging_items (
     reviewed_at TIMESTAMP,
     notes TEXT,
     checksum TEXT NOT NULL,
+    duplicate_count INTEGER DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -245,6 +702,74 @@ CREATE INDEX IF NOT EXISTS idx_staging_status ON staging_items(status);
 CREATE INDEX IF NOT EXISTS idx_staging_scan_id ON staging_items(scan_id);
 CREATE INDEX IF NOT EXISTS idx_staging_artist_album ON staging_items(artist_name, album_name);
 
+CREATE TABLE IF NOT EXISTS metadata_rules (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    field VARCHAR(20) NOT NULL CHECK (field IN ('title', 'artist', 'album_artist', 'album', 'genre')),
+    pattern TEXT,
+    action VARCHAR(30) NOT NULL CHECK (action IN ('replace', 'move_featuring', 'strip_bonus', 'normalize_remaster', 'title_case')),
+    replacement TEXT,
+    library_id INTEGER REFERENCES libraries(id) ON DELETE CASCADE,
+    artist_name VARCHAR(255),
+    position INTEGER NOT NULL DEFAULT 0,
+    enabled BOOLEAN DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_metadata_rules_position ON metadata_rules(position, id) WHERE enabled;
+
+CREATE TABLE IF NOT EXISTS staging_item_changes (
+    id BIGSERIAL PRIMARY KEY,
+    staging_item_id BIGINT NOT NULL REFERENCES staging_items(id) ON DELETE CASCADE,
+    editor_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    field VARCHAR(100) NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_staging_item_changes_item ON staging_item_changes(staging_item_id, changed_at);
+
+-- Promotion of approved staging items to production, with a journal of the
+-- files each promotion moves so interrupted promotions can be finished
+CREATE TABLE IF NOT EXISTS promotion_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    batch_id VARCHAR(36) NOT NULL,
+    staging_item_id BIGINT NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'copying', 'committed', 'completed', 'failed')),
+    library_id INTEGER REFERENCES libraries(id) ON DELETE SET NULL,
+    album_id BIGINT REFERENCES albums(id) ON DELETE SET NULL,
+    staging_path TEXT,
+    production_path TEXT,
+    files_total INTEGER DEFAULT 0,
+    files_copied INTEGER DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_promotion_jobs_batch_id ON promotion_jobs(batch_id);
+CREATE INDEX IF NOT EXISTS idx_promotion_jobs_staging_item_id ON promotion_jobs(staging_item_id);
+-- A staging item has at most one unfinished promotion
+CREATE UNIQUE INDEX IF NOT EXISTS idx_promotion_jobs_unfinished ON promotion_jobs(staging_item_id)
+    WHERE status IN ('pending', 'copying', 'committed');
+CREATE INDEX IF NOT EXISTS idx_promotion_jobs_status ON promotion_jobs(status);
+
+CREATE TABLE IF NOT EXISTS promotion_moves (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT NOT NULL REFERENCES promotion_jobs(id) ON DELETE CASCADE,
+    source_path TEXT NOT NULL,
+    target_path TEXT NOT NULL,
+    checksum VARCHAR(64),
+    size BIGINT DEFAULT 0,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('planned', 'copied', 'deleted')),
+    created BOOLEAN DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_promotion_moves_job_id ON promotion_moves(job_id);
+
 -- Grant all privileges on tables and sequences to melodee_user
 GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA public TO melodee_user;
 GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA public TO melodee_user;
@@ -20,6 +20,7 @@ import (
 	"melodee/internal/media"
 	"melodee/internal/middleware"
 	"melodee/internal/services"
+	"melodee/internal/share"
 )
 
 // APIServer represents the API server
@@ -41,7 +42,7 @@ func NewAPIServer(cfg *config.AppConfig, dbManager *database.DatabaseManager) *A
 		db:          db,
 		dbManager:   dbManager,
 		repo:        services.NewRepository(db),
-		authService: services.NewAuthService(db, cfg.JWT.Secret),
+		authService: services.NewAuthService(db, cfg.JWT.Secret).WithSecretKey(cfg.SecretKey()),
 	}
 
 	// Initialize Fiber app
@@ -82,7 +83,7 @@ func (s *APIServer) setupRoutes() {
 	searchHandler := handlers.NewSearchHandler(s.repo)      // Add search handler
 	healthHandler := handlers.NewHealthHandler(s.dbManager) // Pass the dbManager
 	settingsHandler := handlers.NewSettingsHandler(s.repo)
-	sharesHandler := handlers.NewSharesHandler(s.repo)
+	sharesHandler := handlers.NewSharesHandler(s.repo).WithShares(share.NewService(s.repo.GetDB(), s.cfg.Server.ExternalURL))
 	dlqHandler := handlers.NewDLQHandler(asynqInspector, asynqClient)
 	capacityHandler := handlers.NewCapacityHandler(s.db)
 
@@ -147,6 +148,9 @@ func (s *APIServer) setupRoutes() {
 	users.Get("/:id", userHandler.GetUser)
 	users.Put("/:id", userHandler.UpdateUser)
 	users.Delete("/:id", middleware.NewAuthMiddleware(s.authService).AdminOnly(), userHandler.DeleteUser)
+	users.Get("/:id/subsonic-passwords", userHandler.GetSubsonicPasswords)
+	users.Post("/:id/subsonic-passwords", userHandler.CreateSubsonicPassword)
+	users.Delete("/:id/subsonic-passwords/:passwordId", userHandler.DeleteSubsonicPassword)
 
 	// Playlist routes
 	playlists := protected.Group("/playlists")
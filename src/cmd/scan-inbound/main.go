@@ -13,10 +13,11 @@ func main() {
 	inboundPath := flag.String("path", "", "Path to inbound directory to scan")
 	scanDBPath := flag.String("output", "/tmp", "Directory to store scan database")
 	workers := flag.Int("workers", 4, "Number of worker goroutines")
+	incremental := flag.Bool("incremental", false, "Skip unchanged files using the file index in the output directory")
 	flag.Parse()
 
 	if *inboundPath == "" {
-		fmt.Println("Usage: scan-inbound -path <inbound-directory> [-output <scan-db-directory>] [-workers <num>]")
+		fmt.Println("Usage: scan-inbound -path <inbound-directory> [-output <scan-db-directory>] [-workers <num>] [-incremental]")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -42,6 +43,16 @@ func main() {
 
 	// Create file scanner
 	fileScanner := scanner.NewFileScanner(scanDB, *workers)
+	if *incremental {
+		fileIndex, err := scanner.OpenFileIndex(*scanDBPath)
+		if err != nil {
+			fmt.Printf("Error opening file index: %v\n", err)
+			os.Exit(1)
+		}
+		defer fileIndex.Close()
+		fmt.Printf("File index: %s\n", fileIndex.GetPath())
+		fileScanner = scanner.NewIncrementalFileScanner(scanDB, fileIndex, *workers)
+	}
 
 	// Scan the directory
 	fmt.Printf("Scanning %s with %d workers...\n", *inboundPath, *workers)
@@ -70,6 +81,11 @@ func main() {
 	fmt.Printf("Valid files: %d\n", stats.ValidFiles)
 	fmt.Printf("Invalid files: %d\n", stats.InvalidFiles)
 	fmt.Printf("Albums found: %d\n", stats.AlbumsFound)
+	fmt.Printf("Tagged files: %d (filename fallback: %d)\n", stats.TaggedFiles, stats.FallbackFiles)
+	if *incremental {
+		fmt.Printf("New: %d, Changed: %d, Unchanged: %d, Renamed: %d, Removed: %d\n",
+			stats.NewFiles, stats.ChangedFiles, stats.UnchangedFiles, stats.RenamedFiles, stats.RemovedFiles)
+	}
 	fmt.Printf("Duration: %v\n", stats.Duration)
 	fmt.Printf("Files/sec: %.2f\n", stats.FilesPerSecond)
 	fmt.Println()
@@ -0,0 +1,152 @@
+// Package artwork finds, stores and serves album and artist images. Images
+// are found next to inbound audio files or embedded in them, one front image
+// becomes the album's primary image, and resized variants are made on demand
+// and cached under the checksum of the image they were made from.
+package artwork
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // JPEG and PNG are the formats images are stored in
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"melodee/internal/models"
+)
+
+// ErrUnsupportedImage is returned for images that aren't JPEG or PNG
+var ErrUnsupportedImage = errors.New("image is not a JPEG or PNG")
+
+var (
+	// "cover.jpg", "folder.jpg", "Front Cover.png", "AlbumArtLarge.jpg"
+	frontPattern = regexp.MustCompile(`^(?:cover|folder|front|front[\s_-]*cover|cover[\s_-]*(?:art|front)|albumart(?:large)?)$`)
+	// "back.jpg", "Back Cover.jpg", "rear.png"
+	backPattern = regexp.MustCompile(`^(?:back|rear|back[\s_-]*cover|cover[\s_-]*back)$`)
+	// "disc.jpg", "CD2.jpg", "disc 1.png", and disc directories such as "CD1"
+	discPattern = regexp.MustCompile(`^(?:cd|disc|disk)(?:[\s_-]*(\d+))?$`)
+	// "artist.jpg", "Artist Photo.png"
+	artistPattern = regexp.MustCompile(`^artist(?:[\s_-]*photo)?$`)
+)
+
+// Info describes an image
+type Info struct {
+	Format   string `json:"format"` // jpeg or png
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // SHA-256
+}
+
+// Inspect reads the format and dimensions of a JPEG or PNG image
+func Inspect(data []byte) (Info, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+	if format != "jpeg" && format != "png" {
+		return Info{}, fmt.Errorf("%w: it is %s", ErrUnsupportedImage, format)
+	}
+	sum := sha256.Sum256(data)
+	return Info{
+		Format:   format,
+		Width:    config.Width,
+		Height:   config.Height,
+		Size:     int64(len(data)),
+		Checksum: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// InspectFile reads the format and dimensions of a JPEG or PNG image file
+func InspectFile(path string) (Info, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, err
+	}
+	return Inspect(data)
+}
+
+// Ext returns the file extension images of a format are stored with
+func Ext(format string) string {
+	if format == "png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// ContentType returns the MIME type of an image format
+func ContentType(format string) string {
+	switch format {
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// FormatOf returns the format of an image file from its extension
+func FormatOf(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".png":
+		return "png"
+	case ".webp":
+		return "webp"
+	default:
+		return "jpeg"
+	}
+}
+
+// FileName returns the name an image of a type is stored under in an album
+// or artist directory. Disc images are numbered when disc is above 0.
+func FileName(imageType string, disc int, format string) string {
+	name := imageType
+	switch imageType {
+	case models.ImageTypeFront:
+		name = "cover"
+	case models.ImageTypeDisc:
+		if disc > 0 {
+			name += strconv.Itoa(disc)
+		}
+	}
+	return name + Ext(format)
+}
+
+// Classify returns what an image file shows from its name: a front, back,
+// disc or artist image, and the number of a disc image, 0 when it has none.
+// ok is false for files that aren't JPEG or PNG or whose names don't say.
+func Classify(name string) (imageType string, disc int, ok bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return "", 0, false
+	}
+	base := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(name, filepath.Ext(name))))
+
+	switch {
+	case frontPattern.MatchString(base):
+		return models.ImageTypeFront, 0, true
+	case backPattern.MatchString(base):
+		return models.ImageTypeBack, 0, true
+	case artistPattern.MatchString(base):
+		return models.ImageTypeArtist, 0, true
+	}
+	if match := discPattern.FindStringSubmatch(base); match != nil {
+		disc, _ := strconv.Atoi(match[1])
+		return models.ImageTypeDisc, disc, true
+	}
+	return "", 0, false
+}
+
+// IsDiscDirectory reports whether a directory is named after a disc of an
+// album, such as "CD1" or "Disc 2"
+func IsDiscDirectory(name string) bool {
+	return discPattern.MatchString(strings.ToLower(strings.TrimSpace(name)))
+}
@@ -0,0 +1,347 @@
+package artwork
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, nil))
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+	return buf.Bytes()
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		imageType string
+		disc      int
+		ok        bool
+	}{
+		{"cover.jpg", models.ImageTypeFront, 0, true},
+		{"Folder.JPG", models.ImageTypeFront, 0, true},
+		{"Front Cover.png", models.ImageTypeFront, 0, true},
+		{"AlbumArtLarge.jpg", models.ImageTypeFront, 0, true},
+		{"back.jpeg", models.ImageTypeBack, 0, true},
+		{"Rear.jpg", models.ImageTypeBack, 0, true},
+		{"disc.jpg", models.ImageTypeDisc, 0, true},
+		{"CD2.jpg", models.ImageTypeDisc, 2, true},
+		{"disc 1.png", models.ImageTypeDisc, 1, true},
+		{"artist.jpg", models.ImageTypeArtist, 0, true},
+		{"scan01.jpg", "", 0, false},
+		{"cover.gif", "", 0, false},
+		{"cover.txt", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageType, disc, ok := Classify(tt.name)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.imageType, imageType)
+			assert.Equal(t, tt.disc, disc)
+		})
+	}
+
+	assert.True(t, IsDiscDirectory("CD1"))
+	assert.True(t, IsDiscDirectory("Disc 2"))
+	assert.False(t, IsDiscDirectory("Bonus"))
+}
+
+func TestFileName(t *testing.T) {
+	assert.Equal(t, "cover.jpg", FileName(models.ImageTypeFront, 0, "jpeg"))
+	assert.Equal(t, "back.png", FileName(models.ImageTypeBack, 0, "png"))
+	assert.Equal(t, "disc2.jpg", FileName(models.ImageTypeDisc, 2, "jpeg"))
+	assert.Equal(t, "disc.jpg", FileName(models.ImageTypeDisc, 0, "jpeg"))
+	assert.Equal(t, "artist.jpg", FileName(models.ImageTypeArtist, 0, "jpeg"))
+}
+
+func TestInspect(t *testing.T) {
+	info, err := Inspect(encodePNG(t, 40, 30))
+	require.NoError(t, err)
+	assert.Equal(t, "png", info.Format)
+	assert.Equal(t, 40, info.Width)
+	assert.Equal(t, 30, info.Height)
+	assert.Len(t, info.Checksum, 64)
+
+	_, err = Inspect([]byte("not an image"))
+	assert.True(t, errors.Is(err, ErrUnsupportedImage))
+}
+
+func TestAlbumDirectories(t *testing.T) {
+	dirs := AlbumDirectories([]string{
+		"/in/Album/CD1/01.flac",
+		"/in/Album/CD1/02.flac",
+		"/in/Album/CD2/01.flac",
+	})
+	assert.Equal(t, []string{"/in/Album/CD1", "/in/Album", "/in/Album/CD2"}, dirs)
+}
+
+func TestFindFolderImages(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "folder.jpg"), encodeJPEG(t, 500, 500), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "back.png"), encodePNG(t, 300, 300), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte("broken"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.jpg"), encodeJPEG(t, 10, 10), 0644))
+
+	candidates, errs := FindFolderImages([]string{dir})
+	assert.Len(t, errs, 1)
+	require.Len(t, candidates, 2)
+	for _, candidate := range candidates {
+		assert.Equal(t, models.ImageSourceFolder, candidate.Source)
+		assert.NotEmpty(t, candidate.Data)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	front := func(source string, size int) Candidate {
+		return Candidate{Type: models.ImageTypeFront, Source: source, Info: Info{Width: size, Height: size}}
+	}
+
+	// A large enough image beats a larger embedded one only when it is a folder image
+	candidates := []Candidate{
+		front(models.ImageSourceEmbedded, 1000),
+		front(models.ImageSourceFolder, 200),
+		front(models.ImageSourceFolder, 600),
+		{Type: models.ImageTypeBack, Info: Info{Width: 100, Height: 100}},
+		{Type: models.ImageTypeBack, Info: Info{Width: 400, Height: 400}},
+		{Type: models.ImageTypeDisc, Disc: 2, Info: Info{Width: 300, Height: 300}},
+		{Type: models.ImageTypeDisc, Disc: 1, Info: Info{Width: 300, Height: 300}},
+	}
+	assert.Equal(t, 2, ChoosePrimary(candidates, 300))
+
+	selected, hasPrimary := Select(candidates, 300)
+	assert.True(t, hasPrimary)
+	require.Len(t, selected, 4)
+	assert.Equal(t, 600, selected[0].Width)
+	assert.Equal(t, models.ImageTypeBack, selected[1].Type)
+	assert.Equal(t, 400, selected[1].Width)
+	assert.Equal(t, 1, selected[2].Disc)
+	assert.Equal(t, 2, selected[3].Disc)
+
+	// Images below the minimum size only win when nothing else is large enough
+	assert.Equal(t, 0, ChoosePrimary([]Candidate{front(models.ImageSourceEmbedded, 1000), front(models.ImageSourceFolder, 200)}, 300))
+	assert.Equal(t, 1, ChoosePrimary([]Candidate{front(models.ImageSourceEmbedded, 100), front(models.ImageSourceFolder, 200)}, 300))
+
+	_, hasPrimary = Select(candidates[3:], 300)
+	assert.False(t, hasPrimary)
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	assert.Equal(t, image.Rect(0, 0, 100, 50), Resize(src, 100).Bounds())
+
+	tall := image.NewRGBA(image.Rect(0, 0, 200, 400))
+	assert.Equal(t, image.Rect(0, 0, 50, 100), Resize(tall, 100).Bounds())
+
+	assert.Same(t, src, Resize(src, 500))
+}
+
+type fakeResizer struct {
+	calls int
+	err   error
+}
+
+func (r *fakeResizer) ProcessArtwork(inputPath, outputPath string, maxWidth, maxHeight int, quality int) error {
+	r.calls++
+	if r.err != nil {
+		return r.err
+	}
+	return os.WriteFile(outputPath, []byte("webp"), 0644)
+}
+
+func TestCache_Variant(t *testing.T) {
+	dir := t.TempDir()
+	data := encodeJPEG(t, 600, 400)
+	path := filepath.Join(dir, "cover.jpg")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	info, err := Inspect(data)
+	require.NoError(t, err)
+
+	cfg := config.ArtworkConfig{CacheDir: filepath.Join(dir, "cache"), MaxSize: 2048, Quality: 85, WebP: true}
+
+	t.Run("original", func(t *testing.T) {
+		cache := NewCache(cfg, nil)
+		for _, size := range []int{0, 600, 1500} {
+			variant, err := cache.Variant(path, info, size, false)
+			require.NoError(t, err)
+			assert.Equal(t, path, variant.Path)
+			assert.Equal(t, "image/jpeg", variant.ContentType)
+			assert.Equal(t, `"`+info.Checksum+`"`, variant.ETag)
+		}
+	})
+
+	t.Run("jpeg", func(t *testing.T) {
+		cache := NewCache(cfg, nil)
+		variant, err := cache.Variant(path, info, 100, true)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(cfg.CacheDir, info.Checksum[:2], info.Checksum+"-128.jpg"), variant.Path)
+		assert.Equal(t, "image/jpeg", variant.ContentType)
+
+		resized, err := InspectFile(variant.Path)
+		require.NoError(t, err)
+		assert.Equal(t, 128, resized.Width)
+		assert.Equal(t, 85, resized.Height)
+
+		again, err := cache.Variant(path, info, 128, false)
+		require.NoError(t, err)
+		assert.Equal(t, variant, again)
+	})
+
+	t.Run("webp", func(t *testing.T) {
+		resizer := &fakeResizer{}
+		cache := NewCache(cfg, resizer)
+		variant, err := cache.Variant(path, info, 256, true)
+		require.NoError(t, err)
+		assert.Equal(t, "image/webp", variant.ContentType)
+		assert.Equal(t, ".webp", filepath.Ext(variant.Path))
+
+		_, err = cache.Variant(path, info, 256, true)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resizer.calls, "cached variants are not made again")
+	})
+
+	t.Run("webp unavailable", func(t *testing.T) {
+		resizer := &fakeResizer{err: errors.New("unknown encoder 'libwebp'")}
+		cache := NewCache(cfg, resizer)
+		variant, err := cache.Variant(path, info, 512, true)
+		require.NoError(t, err)
+		assert.Equal(t, "image/jpeg", variant.ContentType)
+
+		_, err = cache.Variant(path, info, 64, true)
+		require.NoError(t, err)
+		assert.Equal(t, 1, resizer.calls, "WebP is not tried again once it failed")
+	})
+}
+
+func setupArtworkTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT,
+		is_locked BOOLEAN DEFAULT 0,
+		created_at DATETIME,
+		track_count INTEGER DEFAULT 0,
+		album_count INTEGER DEFAULT 0,
+		duration INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		library_id INTEGER,
+		artist_id INTEGER,
+		directory TEXT,
+		image_count INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		type TEXT NOT NULL,
+		source TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		file_size INTEGER,
+		checksum TEXT,
+		is_primary BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`).Error)
+	return db
+}
+
+func TestService_SaveAlbumImage(t *testing.T) {
+	ctx := context.Background()
+	db := setupArtworkTestDB(t)
+	root := t.TempDir()
+	require.NoError(t, db.Exec(`INSERT INTO libraries (name, path, type) VALUES ('Production', ?, 'production')`, root).Error)
+	require.NoError(t, db.Exec(`INSERT INTO albums (artist_id, directory) VALUES (1, 'Artist/Album')`).Error)
+	album := &models.Album{ID: 1, ArtistID: 1, Directory: "Artist/Album"}
+	albumDir := filepath.Join(root, "Artist", "Album")
+
+	service := NewService(db, NewCache(config.ArtworkConfig{CacheDir: t.TempDir()}, nil))
+
+	_, _, err := service.AlbumImage(ctx, album)
+	assert.ErrorIs(t, err, ErrNoImage)
+
+	// A PNG cover, then a JPEG replacing it
+	image, err := service.SaveAlbumImage(ctx, album, models.ImageTypeFront, 0, encodePNG(t, 500, 500))
+	require.NoError(t, err)
+	assert.Equal(t, "cover.png", image.FileName)
+	assert.True(t, image.IsPrimary)
+	assert.FileExists(t, filepath.Join(albumDir, "cover.png"))
+
+	data := encodeJPEG(t, 700, 700)
+	image, err = service.SaveAlbumImage(ctx, album, models.ImageTypeFront, 0, data)
+	require.NoError(t, err)
+	assert.Equal(t, "cover.jpg", image.FileName)
+	assert.Equal(t, models.ImageSourceUpload, image.Source)
+	assert.NoFileExists(t, filepath.Join(albumDir, "cover.png"))
+
+	path, info, err := service.AlbumImage(ctx, album)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(albumDir, "cover.jpg"), path)
+	assert.Equal(t, 700, info.Width)
+	assert.Equal(t, "jpeg", info.Format)
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, written)
+
+	// Disc images only replace the image of the same disc
+	_, err = service.SaveAlbumImage(ctx, album, models.ImageTypeDisc, 1, encodeJPEG(t, 300, 300))
+	require.NoError(t, err)
+	_, err = service.SaveAlbumImage(ctx, album, models.ImageTypeDisc, 2, encodeJPEG(t, 300, 300))
+	require.NoError(t, err)
+	disc, err := service.SaveAlbumImage(ctx, album, models.ImageTypeDisc, 1, encodeJPEG(t, 400, 400))
+	require.NoError(t, err)
+	assert.False(t, disc.IsPrimary)
+
+	var images []models.Image
+	require.NoError(t, db.Order("file_name").Find(&images).Error)
+	require.Len(t, images, 3)
+	assert.Equal(t, "cover.jpg", images[0].FileName)
+	assert.Equal(t, "disc1.jpg", images[1].FileName)
+	assert.Equal(t, int32(400), images[1].Width)
+	assert.Equal(t, "disc2.jpg", images[2].FileName)
+
+	var imageCount int
+	require.NoError(t, db.Raw(`SELECT image_count FROM albums WHERE id = 1`).Scan(&imageCount).Error)
+	assert.Equal(t, 3, imageCount)
+
+	_, err = service.SaveAlbumImage(ctx, album, models.ImageTypeFront, 0, []byte("GIF89a"))
+	assert.ErrorIs(t, err, ErrUnsupportedImage)
+	_, err = service.SaveAlbumImage(ctx, album, models.ImageTypeArtist, 0, data)
+	assert.ErrorIs(t, err, ErrUnsupportedImage)
+}
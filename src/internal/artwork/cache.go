@@ -0,0 +1,157 @@
+package artwork
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"melodee/internal/config"
+)
+
+// variantSizes are the sizes variants are made in. Requested sizes are
+// rounded up to one of them, so clients asking for slightly different sizes
+// share cached files.
+var variantSizes = []int{32, 64, 128, 256, 512, 1024, 2048}
+
+// Resizer resizes an image file into the format of outputPath's extension.
+// *media.FFmpegProcessor is one.
+type Resizer interface {
+	ProcessArtwork(inputPath, outputPath string, maxWidth, maxHeight int, quality int) error
+}
+
+// Variant is an image file to serve
+type Variant struct {
+	Path        string
+	ContentType string
+	ETag        string
+}
+
+// Cache makes resized variants of images and keeps them on disk, named
+// after the checksum of the image they were made from, so a replaced image
+// never gets the variants of the image it replaced
+type Cache struct {
+	cfg     config.ArtworkConfig
+	resizer Resizer // makes WebP variants; nil when there is none
+
+	webpFailed atomic.Bool // set when the resizer couldn't make a WebP variant
+}
+
+// NewCache creates a variant cache. WebP variants are made with resizer,
+// when it is set and the config allows them.
+func NewCache(cfg config.ArtworkConfig, resizer Resizer) *Cache {
+	return &Cache{cfg: cfg, resizer: resizer}
+}
+
+// Variant returns an image file of at most size pixels wide and high, in
+// WebP when webp is set and WebP variants can be made, JPEG otherwise. A
+// size of 0, or at least the image's, returns the image itself.
+func (c *Cache) Variant(path string, info Info, size int, webp bool) (Variant, error) {
+	size = c.variantSize(size, info)
+	if size == 0 {
+		return Variant{
+			Path:        path,
+			ContentType: ContentType(info.Format),
+			ETag:        strconv.Quote(info.Checksum),
+		}, nil
+	}
+
+	if webp && c.cfg.WebP && c.resizer != nil && !c.webpFailed.Load() {
+		variant, err := c.variant(info, size, "webp", func(outputPath string) error {
+			// ffmpeg's libwebp quality runs from 0 to 100, like JPEG's
+			return c.resizer.ProcessArtwork(path, outputPath, size, size, c.cfg.Quality)
+		})
+		if err == nil {
+			return variant, nil
+		}
+		// Most likely ffmpeg was built without libwebp; don't try again
+		log.Printf("WARN: Failed to make WebP image variant, serving JPEG from now on: %v", err)
+		c.webpFailed.Store(true)
+	}
+
+	return c.variant(info, size, "jpeg", func(outputPath string) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		img, _, err := image.Decode(file)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+		}
+
+		out, err := os.Create(outputPath)
+		if err != nil {
+			return err
+		}
+		if err := jpeg.Encode(out, Resize(img, size), &jpeg.Options{Quality: c.cfg.Quality}); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// variant returns the cached variant of an image, making it with write first
+// when it isn't cached
+func (c *Cache) variant(info Info, size int, format string, write func(outputPath string) error) (Variant, error) {
+	ext := ".jpg"
+	if format == "webp" {
+		ext = ".webp"
+	}
+	name := fmt.Sprintf("%s-%d%s", info.Checksum, size, ext)
+	variant := Variant{
+		Path:        filepath.Join(c.cfg.CacheDir, info.Checksum[:2], name),
+		ContentType: ContentType(format),
+		ETag:        strconv.Quote(name),
+	}
+	if _, err := os.Stat(variant.Path); err == nil {
+		return variant, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(variant.Path), 0755); err != nil {
+		return Variant{}, fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+	// Made next to the variant and renamed over it, so it is never served
+	// half written; the extension tells ffmpeg the format
+	tmp, err := os.CreateTemp(filepath.Dir(variant.Path), info.Checksum+"-*"+ext)
+	if err != nil {
+		return Variant{}, fmt.Errorf("failed to create image variant: %w", err)
+	}
+	tmp.Close()
+	if err := write(tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return Variant{}, fmt.Errorf("failed to resize image: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), variant.Path); err != nil {
+		os.Remove(tmp.Name())
+		return Variant{}, fmt.Errorf("failed to cache image variant: %w", err)
+	}
+	return variant, nil
+}
+
+// variantSize returns the size of the variant to serve for a requested size,
+// or 0 when the image itself fits
+func (c *Cache) variantSize(size int, info Info) int {
+	if size <= 0 || len(info.Checksum) < 2 {
+		return 0
+	}
+	rounded := variantSizes[len(variantSizes)-1]
+	for _, s := range variantSizes {
+		if s >= size {
+			rounded = s
+			break
+		}
+	}
+	if c.cfg.MaxSize > 0 && rounded > c.cfg.MaxSize {
+		rounded = c.cfg.MaxSize
+	}
+	if rounded >= max(info.Width, info.Height) {
+		return 0
+	}
+	return rounded
+}
@@ -0,0 +1,193 @@
+package artwork
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"melodee/internal/models"
+)
+
+// Candidate is an image found for an album
+type Candidate struct {
+	Path   string // the image file, or the audio file it is embedded in
+	Type   string
+	Source string
+	Disc   int // number of a disc image, 0 when it has none
+	Info
+	Data []byte
+}
+
+// Extractor extracts the image embedded in an audio file to artworkPath.
+// *media.FFmpegProcessor is one.
+type Extractor interface {
+	ExtractArtwork(audioPath, artworkPath string) error
+}
+
+// AlbumDirectories returns the directories holding an album's audio files,
+// and the parents of those named after a disc, where the images of
+// multi-disc albums are usually kept
+func AlbumDirectories(audioPaths []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, path := range audioPaths {
+		dir := filepath.Dir(path)
+		add(dir)
+		if IsDiscDirectory(filepath.Base(dir)) {
+			add(filepath.Dir(dir))
+		}
+	}
+	return dirs
+}
+
+// FindFolderImages returns the images in dirs whose names say what they
+// show. Images that can't be read are returned as errors instead.
+func FindFolderImages(dirs []string) ([]Candidate, []error) {
+	var candidates []Candidate
+	var errs []error
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			imageType, disc, ok := Classify(entry.Name())
+			if !ok {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			info, err := Inspect(data)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+				continue
+			}
+			candidates = append(candidates, Candidate{
+				Path:   path,
+				Type:   imageType,
+				Source: models.ImageSourceFolder,
+				Disc:   disc,
+				Info:   info,
+				Data:   data,
+			})
+		}
+	}
+	return candidates, errs
+}
+
+// ExtractEmbedded returns the front image embedded in an audio file
+func ExtractEmbedded(extractor Extractor, audioPath string) (Candidate, error) {
+	tmp, err := os.CreateTemp("", "melodee-artwork-*.jpg")
+	if err != nil {
+		return Candidate{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// The picture is copied as it is, so a PNG stays a PNG whatever the name
+	if err := extractor.ExtractArtwork(audioPath, tmp.Name()); err != nil {
+		return Candidate{}, err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return Candidate{}, err
+	}
+	info, err := Inspect(data)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("embedded image of %s: %w", filepath.Base(audioPath), err)
+	}
+	return Candidate{
+		Path:   audioPath,
+		Type:   models.ImageTypeFront,
+		Source: models.ImageSourceEmbedded,
+		Info:   info,
+		Data:   data,
+	}, nil
+}
+
+// ChoosePrimary returns the index of the front image to make the album's
+// primary image, or -1 when there is none. Images at least minSize pixels
+// wide and high come first, then folder images, which are usually better
+// scans than embedded ones, then the largest.
+func ChoosePrimary(candidates []Candidate, minSize int) int {
+	best := -1
+	for i := range candidates {
+		if candidates[i].Type != models.ImageTypeFront {
+			continue
+		}
+		if best < 0 || better(&candidates[i], &candidates[best], minSize) {
+			best = i
+		}
+	}
+	return best
+}
+
+func better(a, b *Candidate, minSize int) bool {
+	if aLarge, bLarge := a.large(minSize), b.large(minSize); aLarge != bLarge {
+		return aLarge
+	}
+	if aFolder, bFolder := a.Source == models.ImageSourceFolder, b.Source == models.ImageSourceFolder; aFolder != bFolder {
+		return aFolder
+	}
+	return a.Width*a.Height > b.Width*b.Height
+}
+
+func (c *Candidate) large(minSize int) bool {
+	return c.Width >= minSize && c.Height >= minSize
+}
+
+// Select returns the images to keep with an album: the primary image and the
+// largest back image, image of each disc and artist image. The primary image,
+// if any, comes first.
+func Select(candidates []Candidate, minSize int) (selected []Candidate, hasPrimary bool) {
+	primary := ChoosePrimary(candidates, minSize)
+	if primary >= 0 {
+		selected = append(selected, candidates[primary])
+	}
+
+	type key struct {
+		imageType string
+		disc      int
+	}
+	best := make(map[key]int)
+	var keys []key
+	for i, candidate := range candidates {
+		if candidate.Type == models.ImageTypeFront {
+			continue
+		}
+		k := key{candidate.Type, candidate.Disc}
+		j, ok := best[k]
+		if !ok {
+			keys = append(keys, k)
+		}
+		if !ok || candidate.Width*candidate.Height > candidates[j].Width*candidates[j].Height {
+			best[k] = i
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].imageType != keys[j].imageType {
+			return keys[i].imageType < keys[j].imageType
+		}
+		return keys[i].disc < keys[j].disc
+	})
+	for _, k := range keys {
+		selected = append(selected, candidates[best[k]])
+	}
+	return selected, primary >= 0
+}
@@ -0,0 +1,192 @@
+package artwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/directory"
+	"melodee/internal/models"
+)
+
+// ErrNoImage is returned for albums and artists without a primary image
+var ErrNoImage = errors.New("no image")
+
+// Service finds the images of albums and artists, serves their variants and
+// stores uploaded images
+type Service struct {
+	db    *gorm.DB
+	paths *directory.LibraryPathResolver
+	cache *Cache
+}
+
+// NewService creates a new artwork service serving variants from cache
+func NewService(db *gorm.DB, cache *Cache) *Service {
+	return &Service{
+		db:    db,
+		paths: directory.NewLibraryPathResolver(db, nil),
+		cache: cache,
+	}
+}
+
+// AlbumImage returns the file of an album's primary image and what it is
+func (s *Service) AlbumImage(ctx context.Context, album *models.Album) (string, Info, error) {
+	var image models.Image
+	if err := s.db.WithContext(ctx).Where("album_id = ? AND is_primary = ?", album.ID, true).First(&image).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", Info{}, ErrNoImage
+		}
+		return "", Info{}, fmt.Errorf("failed to load album image: %w", err)
+	}
+	dir, err := s.paths.AlbumDirectory(album)
+	if err != nil {
+		return "", Info{}, err
+	}
+	return filepath.Join(dir, image.FileName), infoOf(&image), nil
+}
+
+// ArtistImage returns the file of an artist's primary image and what it is
+func (s *Service) ArtistImage(ctx context.Context, artist *models.Artist) (string, Info, error) {
+	var image models.Image
+	if err := s.db.WithContext(ctx).Where("artist_id = ? AND is_primary = ?", artist.ID, true).First(&image).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", Info{}, ErrNoImage
+		}
+		return "", Info{}, fmt.Errorf("failed to load artist image: %w", err)
+	}
+	dir, err := s.paths.ArtistDirectory(artist)
+	if err != nil {
+		return "", Info{}, err
+	}
+	return filepath.Join(dir, image.FileName), infoOf(&image), nil
+}
+
+// Variant returns the variant of an image file to serve; see Cache.Variant
+func (s *Service) Variant(path string, info Info, size int, webp bool) (Variant, error) {
+	return s.cache.Variant(path, info, size, webp)
+}
+
+// SaveAlbumImage stores an uploaded front, back or disc image of an album,
+// replacing its image of the same type, or of the same disc. A front image
+// becomes the album's primary image.
+func (s *Service) SaveAlbumImage(ctx context.Context, album *models.Album, imageType string, disc int, data []byte) (*models.Image, error) {
+	switch imageType {
+	case models.ImageTypeFront, models.ImageTypeBack, models.ImageTypeDisc:
+	default:
+		return nil, fmt.Errorf("%w: albums have no %q images", ErrUnsupportedImage, imageType)
+	}
+	dir, err := s.paths.AlbumDirectory(album)
+	if err != nil {
+		return nil, err
+	}
+	image := models.Image{AlbumID: &album.ID, Type: imageType}
+	return s.save(ctx, dir, image, disc, data)
+}
+
+// SaveArtistImage stores an uploaded artist image, replacing the artist's
+// primary image
+func (s *Service) SaveArtistImage(ctx context.Context, artist *models.Artist, data []byte) (*models.Image, error) {
+	dir, err := s.paths.ArtistDirectory(artist)
+	if err != nil {
+		return nil, err
+	}
+	image := models.Image{ArtistID: &artist.ID, Type: models.ImageTypeArtist}
+	return s.save(ctx, dir, image, 0, data)
+}
+
+// save writes an uploaded image into dir and records it in place of the
+// images it replaces
+func (s *Service) save(ctx context.Context, dir string, image models.Image, disc int, data []byte) (*models.Image, error) {
+	info, err := Inspect(data)
+	if err != nil {
+		return nil, err
+	}
+	image.Source = models.ImageSourceUpload
+	image.FileName = FileName(image.Type, disc, info.Format)
+	image.Width = int32(info.Width)
+	image.Height = int32(info.Height)
+	image.FileSize = info.Size
+	image.Checksum = info.Checksum
+	image.IsPrimary = image.Type == models.ImageTypeFront || image.Type == models.ImageTypeArtist
+
+	var existing []models.Image
+	query := s.db.WithContext(ctx).Where("type = ?", image.Type)
+	if image.AlbumID != nil {
+		query = query.Where("album_id = ?", *image.AlbumID)
+	} else {
+		query = query.Where("artist_id = ?", *image.ArtistID)
+	}
+	if err := query.Find(&existing).Error; err != nil {
+		return nil, fmt.Errorf("failed to load images: %w", err)
+	}
+	var replaced []models.Image
+	for _, old := range existing {
+		// Disc images only replace the image of the same disc
+		if image.Type != models.ImageTypeDisc || trimExt(old.FileName) == trimExt(image.FileName) {
+			replaced = append(replaced, old)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image directory: %w", err)
+	}
+	// Written next to the image and renamed over it once it is recorded, so
+	// the file and its record change together
+	path := filepath.Join(dir, image.FileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write image: %w", err)
+	}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range replaced {
+			if err := tx.Delete(&replaced[i]).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&image).Error; err != nil {
+			return err
+		}
+		if image.AlbumID != nil {
+			var count int64
+			if err := tx.Model(&models.Image{}).Where("album_id = ?", *image.AlbumID).Count(&count).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&models.Album{}).Where("id = ?", *image.AlbumID).Update("image_count", count).Error; err != nil {
+				return err
+			}
+		}
+		return os.Rename(tmpPath, path)
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+
+	// A replaced image stored under another name, such as a PNG replaced by a
+	// JPEG, is no longer needed
+	for _, old := range replaced {
+		if old.FileName != image.FileName {
+			os.Remove(filepath.Join(dir, old.FileName))
+		}
+	}
+	return &image, nil
+}
+
+func infoOf(image *models.Image) Info {
+	return Info{
+		Format:   FormatOf(image.FileName),
+		Width:    int(image.Width),
+		Height:   int(image.Height),
+		Size:     image.FileSize,
+		Checksum: image.Checksum,
+	}
+}
+
+func trimExt(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"melodee/internal/utils"
 
 	"github.com/spf13/viper"
+	"golang.org/x/text/encoding/htmlindex"
 	"gorm.io/gorm"
 )
 
@@ -20,11 +22,24 @@ type AppConfig struct {
 	Database    DatabaseConfig    `mapstructure:"database"`
 	Redis       RedisConfig       `mapstructure:"redis"`
 	JWT         JWTConfig         `mapstructure:"jwt"`
+	Auth        AuthConfig        `mapstructure:"auth"`
 	Processing  ProcessingConfig  `mapstructure:"processing"`
 	Capacity    CapacityConfig    `mapstructure:"capacity"`
 	Logging     LoggingConfig     `mapstructure:"logging"`
 	Security    SecurityConfig    `mapstructure:"security"`
 	StagingScan StagingScanConfig `mapstructure:"staging_scan"`
+	Jukebox     JukeboxConfig     `mapstructure:"jukebox"`
+	Podcast     PodcastConfig     `mapstructure:"podcast"`
+	FileWatch   FileWatchConfig   `mapstructure:"file_watch"`
+
+	SmartPlaylists SmartPlaylistConfig `mapstructure:"smart_playlists"`
+	PlayHistory    PlayHistoryConfig   `mapstructure:"play_history"`
+	Scrobble       ScrobbleConfig      `mapstructure:"scrobble"`
+	Similarity     SimilarityConfig    `mapstructure:"similarity"`
+	Metadata       MetadataConfig      `mapstructure:"metadata"`
+	Fingerprint    FingerprintConfig   `mapstructure:"fingerprint"`
+	Loudness       LoudnessConfig      `mapstructure:"loudness"`
+	Artwork        ArtworkConfig       `mapstructure:"artwork"`
 }
 
 // ServerConfig holds server-specific configuration
@@ -36,6 +51,7 @@ type ServerConfig struct {
 	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
 	TLS          TLSConfig     `mapstructure:"tls"`
 	CORS         CORSConfig    `mapstructure:"cors"`
+	ExternalURL  string        `mapstructure:"external_url"` // base of links handed out, such as share URLs; empty uses the request's host
 }
 
 // TLSConfig holds TLS/HTTPS configuration
@@ -75,6 +91,21 @@ type JWTConfig struct {
 	RefreshExpiry time.Duration `mapstructure:"refresh_expiry"`
 }
 
+// AuthConfig holds authentication configuration
+type AuthConfig struct {
+	// SecretKey encrypts stored secrets such as Subsonic app passwords, so the
+	// JWT secret can be rotated without losing them. Empty uses the JWT secret.
+	SecretKey string `mapstructure:"secret_key"`
+}
+
+// SecretKey returns the key stored secrets are encrypted with
+func (c *AppConfig) SecretKey() string {
+	if c.Auth.SecretKey != "" {
+		return c.Auth.SecretKey
+	}
+	return c.JWT.Secret
+}
+
 // ProcessingConfig holds media processing configuration
 type ProcessingConfig struct {
 	FFmpegPath     string               `mapstructure:"ffmpeg_path"`
@@ -159,6 +190,133 @@ type StagingScanConfig struct {
 	Workers        int    `mapstructure:"workers"`           // Number of worker goroutines
 	RateLimit      int    `mapstructure:"rate_limit"`        // Rate limit for file operations (0 = unlimited)
 	ScanDBDataPath string `mapstructure:"scan_db_data_path"` // Directory for scan database files
+	Incremental    bool   `mapstructure:"incremental"`       // Reuse the file index to skip unchanged files
+	CueEncoding    string `mapstructure:"cue_encoding"`      // Encoding of cue sheets that aren't UTF-8, e.g. "shift_jis"
+}
+
+// JukeboxConfig holds configuration for server-side jukebox playback
+type JukeboxConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Output  string `mapstructure:"output"` // "ffmpeg" or "null"
+	Format  string `mapstructure:"format"` // ffmpeg output format, e.g. "alsa", or "s16le" to write raw audio to a pipe
+	Device  string `mapstructure:"device"` // ALSA device name, or the file/FIFO path for pipe formats
+}
+
+// PodcastConfig holds configuration for podcast feed refreshes and episode downloads
+type PodcastConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`          // If periodic feed refreshes are scheduled
+	RefreshSchedule string        `mapstructure:"refresh_schedule"` // Cron schedule (e.g. "0 */6 * * *")
+	KeepEpisodes    int           `mapstructure:"keep_episodes"`    // Downloaded episodes kept per channel unless the channel overrides it
+	AutoDownload    bool          `mapstructure:"auto_download"`    // Download new episodes found by a refresh
+	Timeout         time.Duration `mapstructure:"timeout"`          // Timeout for a feed fetch or episode download
+}
+
+// FileWatchConfig holds configuration for the filesystem watcher service
+type FileWatchConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	Debounce        time.Duration `mapstructure:"debounce_time"`    // Quiet period after the last event in a directory
+	StableTime      time.Duration `mapstructure:"stable_time"`      // How long file sizes must stay unchanged before a scan is queued
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"` // How often watched libraries are reloaded from the database
+	IgnorePatterns  []string      `mapstructure:"ignore_patterns"`  // File name globs that never trigger a scan (temp and hidden files)
+	ListenAddr      string        `mapstructure:"listen_addr"`      // Address of the watcher's /healthz and /metrics server
+}
+
+// SmartPlaylistConfig holds configuration for rule-based playlists
+type SmartPlaylistConfig struct {
+	RefreshSchedule string        `mapstructure:"refresh_schedule"` // Cron schedule for refreshing every smart playlist; empty disables it
+	StaleAfter      time.Duration `mapstructure:"stale_after"`      // Smart playlists older than this are refreshed when they are opened
+	MaxTracks       int           `mapstructure:"max_tracks"`       // Upper bound and default for a smart playlist's limit
+}
+
+// PlayHistoryConfig holds configuration for play events and listening statistics
+type PlayHistoryConfig struct {
+	AggregateSchedule string `mapstructure:"aggregate_schedule"` // Cron schedule for rolling play events up into statistics; empty disables it
+	RetentionMonths   int    `mapstructure:"retention_months"`   // Months of raw play events kept; 0 keeps all. Statistics are kept either way
+}
+
+// ScrobbleConfig holds configuration for submitting plays to external scrobbling services
+type ScrobbleConfig struct {
+	RetrySchedule string             `mapstructure:"retry_schedule"` // Cron schedule for resubmitting queued scrobbles; empty disables it
+	Timeout       time.Duration      `mapstructure:"timeout"`        // Timeout of a request to a scrobbling service
+	LastFM        LastFMConfig       `mapstructure:"lastfm"`
+	ListenBrainz  ListenBrainzConfig `mapstructure:"listenbrainz"`
+}
+
+// LastFMConfig holds the Last.fm API account used to sign scrobbles
+type LastFMConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	APIKey    string `mapstructure:"api_key"`
+	APISecret string `mapstructure:"api_secret"`
+	Endpoint  string `mapstructure:"endpoint"` // API root, e.g. "https://ws.audioscrobbler.com/2.0/"
+	AuthURL   string `mapstructure:"auth_url"` // Page where users authorize Melodee, e.g. "https://www.last.fm/api/auth/"
+}
+
+// ListenBrainzConfig holds the ListenBrainz server scrobbles are submitted to
+type ListenBrainzConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Endpoint string `mapstructure:"endpoint"` // API root, e.g. "https://api.listenbrainz.org"
+}
+
+// SimilarityConfig holds configuration for the precomputed similar artists and songs
+type SimilarityConfig struct {
+	Schedule    string            `mapstructure:"schedule"`     // Cron schedule for rebuilding the similarity tables; empty disables it
+	Neighbors   int               `mapstructure:"neighbors"`    // Similar artists and songs kept for each artist and song
+	SessionGap  time.Duration     `mapstructure:"session_gap"`  // Plays further apart than this are not listened to together
+	HistoryDays int               `mapstructure:"history_days"` // Days of play history considered; 0 uses all of it
+	Weights     SimilarityWeights `mapstructure:"weights"`
+}
+
+// SimilarityWeights sets how much each signal counts towards a similarity score
+type SimilarityWeights struct {
+	CoListening float64 `mapstructure:"co_listening"` // Played in the same listening sessions
+	CoStarring  float64 `mapstructure:"co_starring"`  // Starred by the same users
+	Genres      float64 `mapstructure:"genres"`       // Shared album genres
+	Moods       float64 `mapstructure:"moods"`        // Shared album moods
+	Relations   float64 `mapstructure:"relations"`    // Related artists (members, collaborators...)
+	Era         float64 `mapstructure:"era"`          // Released around the same time
+}
+
+// FingerprintConfig holds configuration for the acoustic fingerprints used to find duplicate recordings
+type FingerprintConfig struct {
+	Enabled   bool          `mapstructure:"enabled"`   // Fingerprint inbound files and flag likely duplicates
+	Length    time.Duration `mapstructure:"length"`    // Audio fingerprinted from the start of each file
+	Threshold float64       `mapstructure:"threshold"` // Similarity, 0-1, from which two recordings are duplicates
+}
+
+// LoudnessConfig holds configuration for the EBU R128 loudness analysis behind ReplayGain values
+type LoudnessConfig struct {
+	Schedule      string `mapstructure:"schedule"`       // Cron schedule for analyzing tracks that have no ReplayGain values; empty disables it
+	WriteTags     bool   `mapstructure:"write_tags"`     // Write the analyzed values into the files' ReplayGain tags
+	TranscodeGain string `mapstructure:"transcode_gain"` // Gain applied when transcoding: off, track or album
+}
+
+// ArtworkConfig holds configuration for album and artist images and their resized variants
+type ArtworkConfig struct {
+	CacheDir string `mapstructure:"cache_dir"` // Where resized variants are cached
+	MinSize  int    `mapstructure:"min_size"`  // Width and height, in pixels, an image needs to be preferred as the primary image
+	MaxSize  int    `mapstructure:"max_size"`  // Largest variant served; larger requested sizes get this size
+	Quality  int    `mapstructure:"quality"`   // JPEG and WebP quality of variants, 1-100
+	WebP     bool   `mapstructure:"webp"`      // Serve WebP variants to clients that accept them (ffmpeg needs libwebp)
+}
+
+// MetadataConfig holds configuration for enriching artists and albums from external metadata providers
+type MetadataConfig struct {
+	UserAgent     string                 `mapstructure:"user_agent"`     // Sent to providers; MusicBrainz asks for contact details
+	Timeout       time.Duration          `mapstructure:"timeout"`        // Timeout of a request to a provider
+	CacheTTL      time.Duration          `mapstructure:"cache_ttl"`      // How long provider responses are reused
+	FieldPriority map[string][]string    `mapstructure:"field_priority"` // Providers allowed to set each field, most trusted first
+	MusicBrainz   MetadataProviderConfig `mapstructure:"musicbrainz"`
+	LastFM        MetadataProviderConfig `mapstructure:"lastfm"`
+	Discogs       MetadataProviderConfig `mapstructure:"discogs"`
+	Wikidata      MetadataProviderConfig `mapstructure:"wikidata"`
+}
+
+// MetadataProviderConfig holds the settings of one metadata provider
+type MetadataProviderConfig struct {
+	Enabled   bool    `mapstructure:"enabled"`
+	BaseURL   string  `mapstructure:"base_url"`
+	APIKey    string  `mapstructure:"api_key"`    // Last.fm API key or Discogs personal access token
+	RateLimit float64 `mapstructure:"rate_limit"` // Requests per second
 }
 
 // DefaultAppConfig returns default configuration values
@@ -213,6 +371,7 @@ func DefaultAppConfig() *AppConfig {
 				"transcode_high":        "-c:a libmp3lame -b:a 320k -ar 44100 -ac 2",
 				"transcode_mid":         "-c:a libmp3lame -b:a 192k -ar 44100 -ac 2",
 				"transcode_opus_mobile": "-c:a libopus -b:a 96k -application audio",
+				"transcode_lossless":    "-c:a flac", // cue sheet tracks of lossless images
 			},
 			TranscodeCache: TranscodeCacheConfig{
 				Enabled:  true,
@@ -265,10 +424,129 @@ func DefaultAppConfig() *AppConfig {
 			Workers:        4,
 			RateLimit:      0, // Unlimited
 			ScanDBDataPath: "/tmp/melodee-scans",
+			Incremental:    true,
+			CueEncoding:    "windows-1252",
+		},
+		Jukebox: JukeboxConfig{
+			Enabled: false,
+			Output:  "ffmpeg",
+			Format:  "alsa",
+			Device:  "default",
+		},
+		Podcast: PodcastConfig{
+			Enabled:         false,
+			RefreshSchedule: "0 */6 * * *", // Every six hours
+			KeepEpisodes:    10,
+			AutoDownload:    true,
+			Timeout:         30 * time.Minute,
+		},
+		FileWatch: FileWatchConfig{
+			Enabled:         false,
+			Debounce:        2 * time.Second,
+			StableTime:      10 * time.Second,
+			RefreshInterval: time.Minute,
+			IgnorePatterns:  []string{".*", "*.part", "*.tmp", "*.crdownload", "~$*"},
+			ListenAddr:      ":8081",
+		},
+		SmartPlaylists: SmartPlaylistConfig{
+			RefreshSchedule: "*/30 * * * *", // Every 30 minutes
+			StaleAfter:      5 * time.Minute,
+			MaxTracks:       1000,
+		},
+		PlayHistory: PlayHistoryConfig{
+			AggregateSchedule: "*/5 * * * *", // Every five minutes
+			RetentionMonths:   0,
+		},
+		Scrobble: ScrobbleConfig{
+			RetrySchedule: "*/15 * * * *", // Every 15 minutes
+			Timeout:       10 * time.Second,
+			LastFM: LastFMConfig{
+				Enabled:  false,
+				Endpoint: "https://ws.audioscrobbler.com/2.0/",
+				AuthURL:  "https://www.last.fm/api/auth/",
+			},
+			ListenBrainz: ListenBrainzConfig{
+				Enabled:  false,
+				Endpoint: "https://api.listenbrainz.org",
+			},
+		},
+		Similarity: SimilarityConfig{
+			Schedule:    "0 4 * * *", // Daily at 04:00
+			Neighbors:   50,
+			SessionGap:  30 * time.Minute,
+			HistoryDays: 365,
+			Weights: SimilarityWeights{
+				CoListening: 0.35,
+				CoStarring:  0.2,
+				Genres:      0.2,
+				Moods:       0.1,
+				Relations:   0.1,
+				Era:         0.05,
+			},
+		},
+		Fingerprint: FingerprintConfig{
+			Enabled:   true,
+			Length:    2 * time.Minute,
+			Threshold: 0.85,
+		},
+		Loudness: LoudnessConfig{
+			Schedule:      "0 5 * * *", // Daily at 05:00
+			WriteTags:     false,
+			TranscodeGain: "off",
+		},
+		Artwork: ArtworkConfig{
+			CacheDir: "/tmp/melodee-artwork-cache",
+			MinSize:  300,
+			MaxSize:  2048,
+			Quality:  85,
+			WebP:     true,
+		},
+		Metadata: MetadataConfig{
+			UserAgent:     "Melodee",
+			Timeout:       15 * time.Second,
+			CacheTTL:      30 * 24 * time.Hour,
+			FieldPriority: DefaultMetadataFieldPriority(),
+			MusicBrainz: MetadataProviderConfig{
+				Enabled:   true,
+				BaseURL:   "https://musicbrainz.org/ws/2",
+				RateLimit: 1,
+			},
+			LastFM: MetadataProviderConfig{
+				Enabled:   false,
+				BaseURL:   "https://ws.audioscrobbler.com/2.0/",
+				RateLimit: 5,
+			},
+			Discogs: MetadataProviderConfig{
+				Enabled:   false,
+				BaseURL:   "https://api.discogs.com",
+				RateLimit: 1,
+			},
+			Wikidata: MetadataProviderConfig{
+				Enabled:   true,
+				BaseURL:   "https://www.wikidata.org/w/api.php",
+				RateLimit: 5,
+			},
 		},
 	}
 }
 
+// DefaultMetadataFieldPriority returns which providers may set each enriched
+// field, most trusted first
+func DefaultMetadataFieldPriority() map[string][]string {
+	return map[string][]string{
+		"biography":             {"lastfm", "discogs"},
+		"image":                 {"discogs", "wikidata", "lastfm"},
+		"notes":                 {"lastfm", "discogs"},
+		"musicbrainz_id":        {"musicbrainz", "wikidata"},
+		"spotify_id":            {"wikidata", "musicbrainz"},
+		"discogs_id":            {"musicbrainz", "wikidata", "discogs"},
+		"wikidata_id":           {"musicbrainz"},
+		"release_date":          {"musicbrainz"},
+		"original_release_date": {"musicbrainz", "wikidata", "discogs"},
+		"genres":                {"musicbrainz", "lastfm", "discogs"},
+	}
+}
+
 // LoadConfig loads application configuration from various sources
 func LoadConfig() (*AppConfig, error) {
 	viper.SetConfigName("config")
@@ -353,6 +631,25 @@ func MergeDatabaseSettings(config *AppConfig, db *gorm.DB) error {
 			}
 		case "staging_scan.scan_db_data_path":
 			config.StagingScan.ScanDBDataPath = s.Value
+		case "staging_scan.incremental":
+			if incremental, err := strconv.ParseBool(s.Value); err == nil {
+				config.StagingScan.Incremental = incremental
+			}
+		case "staging_scan.cue_encoding":
+			config.StagingScan.CueEncoding = s.Value
+		case "file_watch.enabled":
+			if enabled, err := strconv.ParseBool(s.Value); err == nil {
+				config.FileWatch.Enabled = enabled
+				log.Printf("Loaded setting from DB: file_watch.enabled = %v", enabled)
+			}
+		case "file_watch.debounce_time":
+			if debounce, err := time.ParseDuration(s.Value); err == nil {
+				config.FileWatch.Debounce = debounce
+			}
+		case "file_watch.stable_time":
+			if stableTime, err := time.ParseDuration(s.Value); err == nil {
+				config.FileWatch.StableTime = stableTime
+			}
 		case "processing.scan_workers":
 			if scanWorkers, err := strconv.Atoi(s.Value); err == nil {
 				config.Processing.ScanWorkers = scanWorkers
@@ -378,6 +675,7 @@ func setDefaults() {
 	viper.SetDefault("server.tls.enabled", false)
 	viper.SetDefault("server.tls.cert_file", "")
 	viper.SetDefault("server.tls.key_file", "")
+	viper.SetDefault("server.external_url", "")
 
 	// Database defaults
 	viper.SetDefault("database.host", "localhost")
@@ -403,6 +701,9 @@ func setDefaults() {
 	viper.SetDefault("jwt.access_expiry", "15m")
 	viper.SetDefault("jwt.refresh_expiry", "24h")
 
+	// Auth defaults
+	viper.SetDefault("auth.secret_key", "")
+
 	// Processing defaults
 	viper.SetDefault("processing.ffmpeg_path", "/usr/bin/ffmpeg")
 	viper.SetDefault("processing.max_concurrent", 4)
@@ -413,6 +714,7 @@ func setDefaults() {
 	viper.SetDefault("processing.profiles.transcode_high", "-c:a libmp3lame -b:a 320k -ar 44100 -ac 2")
 	viper.SetDefault("processing.profiles.transcode_mid", "-c:a libmp3lame -b:a 192k -ar 44100 -ac 2")
 	viper.SetDefault("processing.profiles.transcode_opus_mobile", "-c:a libopus -b:a 96k -application audio")
+	viper.SetDefault("processing.profiles.transcode_lossless", "-c:a flac")
 
 	// Transcode cache defaults
 	viper.SetDefault("processing.transcode_cache.enabled", true)
@@ -458,10 +760,105 @@ func setDefaults() {
 	viper.SetDefault("staging_scan.workers", 4)
 	viper.SetDefault("staging_scan.rate_limit", 0) // Unlimited
 	viper.SetDefault("staging_scan.scan_db_data_path", "/tmp/melodee-scans")
+	viper.SetDefault("staging_scan.incremental", true)
+	viper.SetDefault("staging_scan.cue_encoding", "windows-1252")
+
+	// Jukebox defaults
+	viper.SetDefault("jukebox.enabled", false)
+	viper.SetDefault("jukebox.output", "ffmpeg")
+	viper.SetDefault("jukebox.format", "alsa")
+	viper.SetDefault("jukebox.device", "default")
+
+	// Podcast defaults
+	viper.SetDefault("podcast.enabled", false)
+	viper.SetDefault("podcast.refresh_schedule", "0 */6 * * *") // Every six hours
+	viper.SetDefault("podcast.keep_episodes", 10)
+	viper.SetDefault("podcast.auto_download", true)
+	viper.SetDefault("podcast.timeout", "30m")
+
+	// File watcher defaults
+	viper.SetDefault("file_watch.enabled", false)
+	viper.SetDefault("file_watch.debounce_time", "2s")
+	viper.SetDefault("file_watch.stable_time", "10s")
+	viper.SetDefault("file_watch.refresh_interval", "1m")
+	viper.SetDefault("file_watch.ignore_patterns", []string{".*", "*.part", "*.tmp", "*.crdownload", "~$*"})
+	viper.SetDefault("file_watch.listen_addr", ":8081")
+
+	// Smart playlist defaults
+	viper.SetDefault("smart_playlists.refresh_schedule", "*/30 * * * *") // Every 30 minutes
+	viper.SetDefault("smart_playlists.stale_after", "5m")
+	viper.SetDefault("smart_playlists.max_tracks", 1000)
+
+	// Play history defaults
+	viper.SetDefault("play_history.aggregate_schedule", "*/5 * * * *") // Every five minutes
+	viper.SetDefault("play_history.retention_months", 0)
+
+	// Scrobble defaults
+	viper.SetDefault("scrobble.retry_schedule", "*/15 * * * *") // Every 15 minutes
+	viper.SetDefault("scrobble.timeout", "10s")
+	viper.SetDefault("scrobble.lastfm.enabled", false)
+	viper.SetDefault("scrobble.lastfm.api_key", "")
+	viper.SetDefault("scrobble.lastfm.api_secret", "")
+	viper.SetDefault("scrobble.lastfm.endpoint", "https://ws.audioscrobbler.com/2.0/")
+	viper.SetDefault("scrobble.lastfm.auth_url", "https://www.last.fm/api/auth/")
+	viper.SetDefault("scrobble.listenbrainz.enabled", false)
+	viper.SetDefault("scrobble.listenbrainz.endpoint", "https://api.listenbrainz.org")
+
+	// Similarity defaults
+	viper.SetDefault("similarity.schedule", "0 4 * * *") // Daily at 04:00
+	viper.SetDefault("similarity.neighbors", 50)
+	viper.SetDefault("similarity.session_gap", "30m")
+	viper.SetDefault("similarity.history_days", 365)
+	viper.SetDefault("similarity.weights.co_listening", 0.35)
+	viper.SetDefault("similarity.weights.co_starring", 0.2)
+	viper.SetDefault("similarity.weights.genres", 0.2)
+	viper.SetDefault("similarity.weights.moods", 0.1)
+	viper.SetDefault("similarity.weights.relations", 0.1)
+	viper.SetDefault("similarity.weights.era", 0.05)
+
+	// Fingerprint defaults
+	viper.SetDefault("fingerprint.enabled", true)
+	viper.SetDefault("fingerprint.length", "2m")
+	viper.SetDefault("fingerprint.threshold", 0.85)
+
+	// Loudness defaults
+	viper.SetDefault("loudness.schedule", "0 5 * * *") // Daily at 05:00
+	viper.SetDefault("loudness.write_tags", false)
+	viper.SetDefault("loudness.transcode_gain", "off")
+
+	// Artwork defaults
+	viper.SetDefault("artwork.cache_dir", "/tmp/melodee-artwork-cache")
+	viper.SetDefault("artwork.min_size", 300)
+	viper.SetDefault("artwork.max_size", 2048)
+	viper.SetDefault("artwork.quality", 85)
+	viper.SetDefault("artwork.webp", true)
+
+	// Metadata provider defaults
+	viper.SetDefault("metadata.user_agent", "Melodee")
+	viper.SetDefault("metadata.timeout", "15s")
+	viper.SetDefault("metadata.cache_ttl", "720h") // 30 days
+	viper.SetDefault("metadata.field_priority", DefaultMetadataFieldPriority())
+	viper.SetDefault("metadata.musicbrainz.enabled", true)
+	viper.SetDefault("metadata.musicbrainz.base_url", "https://musicbrainz.org/ws/2")
+	viper.SetDefault("metadata.musicbrainz.rate_limit", 1)
+	viper.SetDefault("metadata.lastfm.enabled", false)
+	viper.SetDefault("metadata.lastfm.base_url", "https://ws.audioscrobbler.com/2.0/")
+	viper.SetDefault("metadata.lastfm.rate_limit", 5)
+	viper.SetDefault("metadata.discogs.enabled", false)
+	viper.SetDefault("metadata.discogs.base_url", "https://api.discogs.com")
+	viper.SetDefault("metadata.discogs.rate_limit", 1)
+	viper.SetDefault("metadata.wikidata.enabled", true)
+	viper.SetDefault("metadata.wikidata.base_url", "https://www.wikidata.org/w/api.php")
+	viper.SetDefault("metadata.wikidata.rate_limit", 5)
 }
 
 // applyEnvironmentOverrides applies configuration overrides from environment variables
 func applyEnvironmentOverrides(config *AppConfig) {
+	// Server overrides
+	if externalURL := getEnv("MELODEE_SERVER_EXTERNAL_URL", ""); externalURL != "" {
+		config.Server.ExternalURL = externalURL
+	}
+
 	// Database overrides
 	if dbHost := getEnv("MELODEE_DATABASE_HOST", ""); dbHost != "" {
 		config.Database.Host = dbHost
@@ -498,6 +895,11 @@ func applyEnvironmentOverrides(config *AppConfig) {
 		config.JWT.Secret = jwtSecret
 	}
 
+	// Auth overrides
+	if secretKey := getEnv("MELODEE_AUTH_SECRET_KEY", ""); secretKey != "" {
+		config.Auth.SecretKey = secretKey
+	}
+
 	// Processing overrides
 	if ffmpegPath := getEnv("FFMPEG_PATH", ""); ffmpegPath != "" {
 		config.Processing.FFmpegPath = ffmpegPath
@@ -535,6 +937,103 @@ func applyEnvironmentOverrides(config *AppConfig) {
 	if stagingScanDBDataPath := getEnv("MELODEE_STAGING_SCAN_DB_DATA_PATH", ""); stagingScanDBDataPath != "" {
 		config.StagingScan.ScanDBDataPath = stagingScanDBDataPath
 	}
+	config.StagingScan.Incremental = getEnvBool("MELODEE_STAGING_SCAN_INCREMENTAL", config.StagingScan.Incremental)
+	if cueEncoding := getEnv("MELODEE_STAGING_SCAN_CUE_ENCODING", ""); cueEncoding != "" {
+		config.StagingScan.CueEncoding = cueEncoding
+	}
+
+	// Jukebox overrides
+	config.Jukebox.Enabled = getEnvBool("MELODEE_JUKEBOX_ENABLED", config.Jukebox.Enabled)
+	if jukeboxDevice := getEnv("MELODEE_JUKEBOX_DEVICE", ""); jukeboxDevice != "" {
+		config.Jukebox.Device = jukeboxDevice
+	}
+
+	// Podcast overrides
+	config.Podcast.Enabled = getEnvBool("MELODEE_PODCAST_ENABLED", config.Podcast.Enabled)
+	if podcastSchedule := getEnv("MELODEE_PODCAST_REFRESH_SCHEDULE", ""); podcastSchedule != "" {
+		config.Podcast.RefreshSchedule = podcastSchedule
+	}
+	if keepEpisodes := getEnvInt("MELODEE_PODCAST_KEEP_EPISODES", config.Podcast.KeepEpisodes); keepEpisodes >= 0 {
+		config.Podcast.KeepEpisodes = keepEpisodes
+	}
+
+	// File watcher overrides
+	config.FileWatch.Enabled = getEnvBool("MELODEE_FILE_WATCH_ENABLED", config.FileWatch.Enabled)
+	config.FileWatch.StableTime = getEnvDuration("MELODEE_FILE_WATCH_STABLE_TIME", config.FileWatch.StableTime)
+	if listenAddr := getEnv("MELODEE_FILE_WATCH_LISTEN_ADDR", ""); listenAddr != "" {
+		config.FileWatch.ListenAddr = listenAddr
+	}
+
+	// Smart playlist overrides
+	if smartSchedule, ok := os.LookupEnv("MELODEE_SMART_PLAYLISTS_REFRESH_SCHEDULE"); ok {
+		config.SmartPlaylists.RefreshSchedule = smartSchedule
+	}
+	config.SmartPlaylists.StaleAfter = getEnvDuration("MELODEE_SMART_PLAYLISTS_STALE_AFTER", config.SmartPlaylists.StaleAfter)
+
+	// Play history overrides
+	if aggregateSchedule, ok := os.LookupEnv("MELODEE_PLAY_HISTORY_AGGREGATE_SCHEDULE"); ok {
+		config.PlayHistory.AggregateSchedule = aggregateSchedule
+	}
+	config.PlayHistory.RetentionMonths = getEnvInt("MELODEE_PLAY_HISTORY_RETENTION_MONTHS", config.PlayHistory.RetentionMonths)
+
+	// Scrobble overrides
+	if retrySchedule, ok := os.LookupEnv("MELODEE_SCROBBLE_RETRY_SCHEDULE"); ok {
+		config.Scrobble.RetrySchedule = retrySchedule
+	}
+	config.Scrobble.LastFM.Enabled = getEnvBool("MELODEE_SCROBBLE_LASTFM_ENABLED", config.Scrobble.LastFM.Enabled)
+	if apiKey := getEnv("MELODEE_SCROBBLE_LASTFM_API_KEY", ""); apiKey != "" {
+		config.Scrobble.LastFM.APIKey = apiKey
+	}
+	if apiSecret := getEnv("MELODEE_SCROBBLE_LASTFM_API_SECRET", ""); apiSecret != "" {
+		config.Scrobble.LastFM.APISecret = apiSecret
+	}
+	if endpoint := getEnv("MELODEE_SCROBBLE_LASTFM_ENDPOINT", ""); endpoint != "" {
+		config.Scrobble.LastFM.Endpoint = endpoint
+	}
+	config.Scrobble.ListenBrainz.Enabled = getEnvBool("MELODEE_SCROBBLE_LISTENBRAINZ_ENABLED", config.Scrobble.ListenBrainz.Enabled)
+	if endpoint := getEnv("MELODEE_SCROBBLE_LISTENBRAINZ_ENDPOINT", ""); endpoint != "" {
+		config.Scrobble.ListenBrainz.Endpoint = endpoint
+	}
+
+	// Similarity overrides
+	if schedule, ok := os.LookupEnv("MELODEE_SIMILARITY_SCHEDULE"); ok {
+		config.Similarity.Schedule = schedule
+	}
+	config.Similarity.Neighbors = getEnvInt("MELODEE_SIMILARITY_NEIGHBORS", config.Similarity.Neighbors)
+	config.Similarity.HistoryDays = getEnvInt("MELODEE_SIMILARITY_HISTORY_DAYS", config.Similarity.HistoryDays)
+
+	// Fingerprint overrides
+	config.Fingerprint.Enabled = getEnvBool("MELODEE_FINGERPRINT_ENABLED", config.Fingerprint.Enabled)
+
+	// Loudness overrides
+	if schedule, ok := os.LookupEnv("MELODEE_LOUDNESS_SCHEDULE"); ok {
+		config.Loudness.Schedule = schedule
+	}
+	config.Loudness.WriteTags = getEnvBool("MELODEE_LOUDNESS_WRITE_TAGS", config.Loudness.WriteTags)
+	if gain := getEnv("MELODEE_LOUDNESS_TRANSCODE_GAIN", ""); gain != "" {
+		config.Loudness.TranscodeGain = gain
+	}
+
+	// Artwork overrides
+	if cacheDir := getEnv("MELODEE_ARTWORK_CACHE_DIR", ""); cacheDir != "" {
+		config.Artwork.CacheDir = cacheDir
+	}
+	config.Artwork.WebP = getEnvBool("MELODEE_ARTWORK_WEBP", config.Artwork.WebP)
+
+	// Metadata provider overrides
+	if userAgent := getEnv("MELODEE_METADATA_USER_AGENT", ""); userAgent != "" {
+		config.Metadata.UserAgent = userAgent
+	}
+	config.Metadata.MusicBrainz.Enabled = getEnvBool("MELODEE_METADATA_MUSICBRAINZ_ENABLED", config.Metadata.MusicBrainz.Enabled)
+	config.Metadata.LastFM.Enabled = getEnvBool("MELODEE_METADATA_LASTFM_ENABLED", config.Metadata.LastFM.Enabled)
+	if apiKey := getEnv("MELODEE_METADATA_LASTFM_API_KEY", ""); apiKey != "" {
+		config.Metadata.LastFM.APIKey = apiKey
+	}
+	config.Metadata.Discogs.Enabled = getEnvBool("MELODEE_METADATA_DISCOGS_ENABLED", config.Metadata.Discogs.Enabled)
+	if token := getEnv("MELODEE_METADATA_DISCOGS_TOKEN", ""); token != "" {
+		config.Metadata.Discogs.APIKey = token
+	}
+	config.Metadata.Wikidata.Enabled = getEnvBool("MELODEE_METADATA_WIKIDATA_ENABLED", config.Metadata.Wikidata.Enabled)
 }
 
 // getEnv gets an environment variable with a default fallback
@@ -589,6 +1088,13 @@ func (c *AppConfig) Validate() error {
 		return fmt.Errorf("database host cannot be empty")
 	}
 
+	if c.Server.ExternalURL != "" {
+		u, err := url.Parse(c.Server.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("server external_url must be an absolute http or https URL")
+		}
+	}
+
 	if c.Redis.Address == "" {
 		return fmt.Errorf("redis address cannot be empty")
 	}
@@ -678,6 +1184,111 @@ func (c *AppConfig) Validate() error {
 	if c.StagingScan.ScanDBDataPath == "" {
 		return fmt.Errorf("staging scan DB data path cannot be empty")
 	}
+	if c.StagingScan.CueEncoding != "" {
+		if _, err := htmlindex.Get(c.StagingScan.CueEncoding); err != nil {
+			return fmt.Errorf("unknown staging scan cue encoding %q", c.StagingScan.CueEncoding)
+		}
+	}
+
+	// Validate jukebox configuration
+	if c.Jukebox.Enabled {
+		if c.Jukebox.Output != "ffmpeg" && c.Jukebox.Output != "null" {
+			return fmt.Errorf("jukebox output must be \"ffmpeg\" or \"null\", got: %s", c.Jukebox.Output)
+		}
+		if c.Jukebox.Output == "ffmpeg" && (c.Jukebox.Format == "" || c.Jukebox.Device == "") {
+			return fmt.Errorf("jukebox ffmpeg output requires a format and a device")
+		}
+	}
+
+	// Validate podcast configuration
+	if c.Podcast.KeepEpisodes < 0 {
+		return fmt.Errorf("podcast keep episodes must be greater than or equal to 0")
+	}
+	if c.Podcast.Enabled && c.Podcast.RefreshSchedule == "" {
+		return fmt.Errorf("podcast refresh schedule cannot be empty when podcasts are enabled")
+	}
+
+	// Validate smart playlist configuration
+	if c.SmartPlaylists.MaxTracks <= 0 {
+		return fmt.Errorf("smart playlist max tracks must be greater than 0")
+	}
+
+	// Validate play history configuration
+	if c.PlayHistory.RetentionMonths < 0 {
+		return fmt.Errorf("play history retention months must be greater than or equal to 0")
+	}
+
+	// Validate scrobble configuration
+	if c.Scrobble.LastFM.Enabled && (c.Scrobble.LastFM.APIKey == "" || c.Scrobble.LastFM.APISecret == "") {
+		return fmt.Errorf("last.fm scrobbling needs an API key and secret")
+	}
+
+	// Validate similarity configuration
+	if c.Similarity.Neighbors <= 0 {
+		return fmt.Errorf("similarity neighbors must be greater than 0")
+	}
+	if c.Similarity.HistoryDays < 0 {
+		return fmt.Errorf("similarity history days must be greater than or equal to 0")
+	}
+	w := c.Similarity.Weights
+	if w.CoListening < 0 || w.CoStarring < 0 || w.Genres < 0 || w.Moods < 0 || w.Relations < 0 || w.Era < 0 {
+		return fmt.Errorf("similarity weights must be greater than or equal to 0")
+	}
+
+	// Validate fingerprint configuration
+	if c.Fingerprint.Enabled && c.Fingerprint.Length <= 0 {
+		return fmt.Errorf("fingerprint length must be greater than 0")
+	}
+	if c.Fingerprint.Threshold <= 0 || c.Fingerprint.Threshold > 1 {
+		return fmt.Errorf("fingerprint threshold must be between 0 and 1")
+	}
+
+	// Validate loudness configuration
+	switch c.Loudness.TranscodeGain {
+	case "", "off", "track", "album":
+	default:
+		return fmt.Errorf("loudness transcode gain must be off, track or album")
+	}
+
+	// Validate artwork configuration
+	if c.Artwork.CacheDir == "" {
+		return fmt.Errorf("artwork cache directory cannot be empty")
+	}
+	if c.Artwork.MinSize < 0 {
+		return fmt.Errorf("artwork min size must be greater than or equal to 0")
+	}
+	if c.Artwork.MaxSize <= 0 {
+		return fmt.Errorf("artwork max size must be greater than 0")
+	}
+	if c.Artwork.Quality < 1 || c.Artwork.Quality > 100 {
+		return fmt.Errorf("artwork quality must be between 1 and 100")
+	}
+
+	// Validate metadata provider configuration
+	providers := map[string]MetadataProviderConfig{
+		"musicbrainz": c.Metadata.MusicBrainz,
+		"lastfm":      c.Metadata.LastFM,
+		"discogs":     c.Metadata.Discogs,
+		"wikidata":    c.Metadata.Wikidata,
+	}
+	for name, provider := range providers {
+		if provider.Enabled && provider.RateLimit <= 0 {
+			return fmt.Errorf("metadata provider %s rate limit must be greater than 0", name)
+		}
+	}
+	if c.Metadata.LastFM.Enabled && c.Metadata.LastFM.APIKey == "" {
+		return fmt.Errorf("the last.fm metadata provider needs an API key")
+	}
+	if c.Metadata.Discogs.Enabled && c.Metadata.Discogs.APIKey == "" {
+		return fmt.Errorf("the discogs metadata provider needs a personal access token")
+	}
+	for field, names := range c.Metadata.FieldPriority {
+		for _, name := range names {
+			if _, ok := providers[name]; !ok {
+				return fmt.Errorf("metadata field %s lists unknown provider %q", field, name)
+			}
+		}
+	}
 
 	return nil
 }
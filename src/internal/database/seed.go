@@ -89,6 +89,34 @@ func SeedDefaultSettings(db *gorm.DB) error {
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
 		},
+		{
+			Key:       "staging_scan.incremental",
+			Value:     "true",
+			Comment:   "Skip unchanged inbound files using the persistent file index (true/false)",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+		{
+			Key:       "file_watch.enabled",
+			Value:     "false",
+			Comment:   "Enable the file watcher service for libraries flagged is_watched (true/false)",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+		{
+			Key:       "file_watch.debounce_time",
+			Value:     "2s",
+			Comment:   "Quiet period after the last file event in a directory before it is checked",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
+		{
+			Key:       "file_watch.stable_time",
+			Value:     "10s",
+			Comment:   "How long file sizes in a directory must stay unchanged before a scan is queued",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		},
 	}
 
 	for _, setting := range defaultSettings {
@@ -0,0 +1,169 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+	"melodee/internal/models"
+)
+
+// ErrNoLibrary is returned when no library can be found for a path
+var ErrNoLibrary = errors.New("no library available")
+
+// LibraryPathResolver maps paths stored relative to a library (Track.RelativePath,
+// Album.Directory) to absolute filesystem paths and back. Rows recorded before
+// albums carried a library resolve against the default production library.
+type LibraryPathResolver struct {
+	db        *gorm.DB
+	templates *PathTemplateResolver
+}
+
+// NewLibraryPathResolver creates a new library path resolver
+func NewLibraryPathResolver(db *gorm.DB, templates *PathTemplateResolver) *LibraryPathResolver {
+	if templates == nil {
+		templates = NewPathTemplateResolver(nil)
+	}
+
+	return &LibraryPathResolver{
+		db:        db,
+		templates: templates,
+	}
+}
+
+// Library loads a library by ID, or the default production library when libraryID is nil
+func (r *LibraryPathResolver) Library(libraryID *int32) (*models.Library, error) {
+	if libraryID == nil {
+		return r.DefaultLibrary()
+	}
+
+	var library models.Library
+	if err := r.db.First(&library, *libraryID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: library %d not found", ErrNoLibrary, *libraryID)
+		}
+		return nil, fmt.Errorf("failed to load library %d: %w", *libraryID, err)
+	}
+	return &library, nil
+}
+
+// DefaultLibrary returns the first production library
+func (r *LibraryPathResolver) DefaultLibrary() (*models.Library, error) {
+	return r.LibraryOfType("production")
+}
+
+// LibraryOfType returns the first library of the given type
+func (r *LibraryPathResolver) LibraryOfType(libraryType string) (*models.Library, error) {
+	var library models.Library
+	if err := r.db.Where("type = ?", libraryType).Order("id").First(&library).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: no %s library configured", ErrNoLibrary, libraryType)
+		}
+		return nil, fmt.Errorf("failed to load %s library: %w", libraryType, err)
+	}
+	return &library, nil
+}
+
+// LibraryByPath returns the production library rooted at path
+func (r *LibraryPathResolver) LibraryByPath(path string) (*models.Library, error) {
+	var libraries []models.Library
+	if err := r.db.Where("type = ?", "production").Order("id").Find(&libraries).Error; err != nil {
+		return nil, fmt.Errorf("failed to load production libraries: %w", err)
+	}
+
+	cleaned := filepath.Clean(path)
+	for i := range libraries {
+		if filepath.Clean(libraries[i].Path) == cleaned {
+			return &libraries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no production library at %s", ErrNoLibrary, path)
+}
+
+// Resolve joins a library relative path onto the library root. The path is
+// cleaned as if rooted first, so ".." segments cannot escape the library.
+func (r *LibraryPathResolver) Resolve(library *models.Library, relativePath string) (string, error) {
+	if library == nil {
+		return "", ErrNoLibrary
+	}
+	return filepath.Join(library.Path, filepath.Clean("/"+relativePath)), nil
+}
+
+// Relative returns absolutePath relative to the library root, as stored on albums and tracks
+func (r *LibraryPathResolver) Relative(library *models.Library, absolutePath string) (string, error) {
+	if library == nil {
+		return "", ErrNoLibrary
+	}
+
+	relativePath, err := filepath.Rel(filepath.Clean(library.Path), filepath.Clean(absolutePath))
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside library %s", absolutePath, library.Name)
+	}
+	return relativePath, nil
+}
+
+// TrackPath returns the absolute path of a track's file. Tracks without a
+// library use their album's library when the album is loaded.
+func (r *LibraryPathResolver) TrackPath(track *models.Track) (string, error) {
+	libraryID := track.LibraryID
+	if libraryID == nil && track.Album != nil {
+		libraryID = track.Album.LibraryID
+	}
+
+	library, err := r.Library(libraryID)
+	if err != nil {
+		return "", err
+	}
+
+	relativePath := track.RelativePath
+	if relativePath == "" {
+		relativePath = filepath.Join(track.Directory, track.FileName)
+	}
+	return r.Resolve(library, relativePath)
+}
+
+// AlbumDirectory returns the absolute directory holding an album's files. Albums
+// without a stored directory fall back to the path template, which needs the
+// album's artist to be loaded.
+func (r *LibraryPathResolver) AlbumDirectory(album *models.Album) (string, error) {
+	library, err := r.Library(album.LibraryID)
+	if err != nil {
+		return "", err
+	}
+
+	directory := album.Directory
+	if directory == "" {
+		if album.Artist == nil {
+			return "", fmt.Errorf("album %d has no directory and no artist to derive one", album.ID)
+		}
+		if directory, err = r.templates.Resolve(album.Artist, album, library); err != nil {
+			return "", err
+		}
+	}
+	return r.Resolve(library, directory)
+}
+
+// ArtistDirectory returns the absolute directory holding an artist's albums,
+// taken from the parent of one of the artist's album directories when possible
+func (r *LibraryPathResolver) ArtistDirectory(artist *models.Artist) (string, error) {
+	var album models.Album
+	err := r.db.Where("artist_id = ? AND directory <> ''", artist.ID).Order("id").First(&album).Error
+	if err == nil {
+		albumDirectory, err := r.AlbumDirectory(&album)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Dir(albumDirectory), nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("failed to load albums for artist %d: %w", artist.ID, err)
+	}
+
+	library, err := r.DefaultLibrary()
+	if err != nil {
+		return "", err
+	}
+	return r.Resolve(library, filepath.Join(artist.DirectoryCode, artist.Name))
+}
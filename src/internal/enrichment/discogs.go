@@ -0,0 +1,179 @@
+package enrichment
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/releasegroup"
+)
+
+// Discogs looks artists and master releases up in the Discogs API. It finds
+// artist profiles and images, and album years, genres and styles.
+type Discogs struct {
+	fetch   *fetcher
+	baseURL string
+	header  http.Header
+}
+
+// NewDiscogs creates a Discogs provider; db caches its responses
+func NewDiscogs(db *gorm.DB, cfg config.MetadataConfig) *Discogs {
+	return &Discogs{
+		fetch:   newFetcher(ProviderDiscogs, db, cfg, cfg.Discogs),
+		baseURL: strings.TrimSuffix(cfg.Discogs.BaseURL, "/"),
+		header:  http.Header{"Authorization": {"Discogs token=" + cfg.Discogs.APIKey}},
+	}
+}
+
+// Name returns the provider name
+func (d *Discogs) Name() string {
+	return ProviderDiscogs
+}
+
+type discogsImage struct {
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+}
+
+type discogsResult struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// Artist looks the artist up by Discogs ID, or by name
+func (d *Discogs) Artist(ctx context.Context, query ArtistQuery) (*ArtistInfo, error) {
+	id := query.IDs.DiscogsID
+	if id == "" {
+		results, err := d.search(ctx, url.Values{"type": {"artist"}, "q": {query.Name}})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if releasegroup.Normalize(discogsName(result.Title)) == releasegroup.Normalize(query.Name) {
+				id = strconv.FormatInt(result.ID, 10)
+				break
+			}
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+
+	var artist struct {
+		ID      int64          `json:"id"`
+		Profile string         `json:"profile"`
+		Images  []discogsImage `json:"images"`
+	}
+	found, err := d.fetch.getJSON(ctx, d.baseURL+"/artists/"+url.PathEscape(id), d.header, &artist)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &ArtistInfo{
+		IDs:       IDs{DiscogsID: strconv.FormatInt(artist.ID, 10)},
+		Biography: discogsText(artist.Profile),
+		ImageURL:  discogsImageURL(artist.Images),
+	}, nil
+}
+
+// Album looks the master release up by Discogs ID, or by name and artist
+func (d *Discogs) Album(ctx context.Context, query AlbumQuery) (*AlbumInfo, error) {
+	id := query.IDs.DiscogsID
+	if id == "" {
+		results, err := d.search(ctx, url.Values{
+			"type":          {"master"},
+			"release_title": {query.Name},
+			"artist":        {query.Artist.Name},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			// Master titles read "Artist - Title"
+			title := result.Title
+			if i := strings.Index(title, " - "); i >= 0 {
+				title = title[i+3:]
+			}
+			if releasegroup.Normalize(title) == releasegroup.Normalize(query.Name) {
+				id = strconv.FormatInt(result.ID, 10)
+				break
+			}
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+
+	var master struct {
+		ID     int64          `json:"id"`
+		Year   int            `json:"year"`
+		Genres []string       `json:"genres"`
+		Styles []string       `json:"styles"`
+		Notes  string         `json:"notes"`
+		Images []discogsImage `json:"images"`
+	}
+	found, err := d.fetch.getJSON(ctx, d.baseURL+"/masters/"+url.PathEscape(id), d.header, &master)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	info := &AlbumInfo{
+		IDs:      IDs{DiscogsID: strconv.FormatInt(master.ID, 10)},
+		Notes:    discogsText(master.Notes),
+		ImageURL: discogsImageURL(master.Images),
+		Genres:   cleanGenres(append(master.Genres, master.Styles...)),
+	}
+	if master.Year > 0 {
+		info.OriginalReleaseDate = parseDate(strconv.Itoa(master.Year))
+	}
+	return info, nil
+}
+
+// search runs a database search and returns the first page of results
+func (d *Discogs) search(ctx context.Context, params url.Values) ([]discogsResult, error) {
+	params.Set("per_page", "5")
+	var response struct {
+		Results []discogsResult `json:"results"`
+	}
+	if _, err := d.fetch.getJSON(ctx, d.baseURL+"/database/search?"+params.Encode(), d.header, &response); err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
+
+var (
+	// discogsNumber is the suffix Discogs gives artists sharing a name: "Nirvana (2)"
+	discogsNumber = regexp.MustCompile(`\s+\(\d+\)$`)
+	// discogsLink is a link to another entity, [a=Name] or [l=Label], shown as its name
+	discogsLink = regexp.MustCompile(`\[[alm]=([^\]]*)\]`)
+	// discogsMarkup is any other markup: [a12345], [b], [/i], [url=...]...
+	discogsMarkup = regexp.MustCompile(`\[[^\]]*\]`)
+)
+
+func discogsName(name string) string {
+	return discogsNumber.ReplaceAllString(name, "")
+}
+
+// discogsText turns Discogs markup into plain text
+func discogsText(text string) string {
+	text = discogsLink.ReplaceAllString(text, "$1")
+	return plainText(discogsMarkup.ReplaceAllString(text, ""))
+}
+
+// discogsImageURL returns the primary image, or else the first one
+func discogsImageURL(images []discogsImage) string {
+	for _, image := range images {
+		if image.Type == "primary" {
+			return image.URI
+		}
+	}
+	if len(images) > 0 {
+		return images[0].URI
+	}
+	return ""
+}
@@ -0,0 +1,129 @@
+package enrichment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+// fetcher makes a provider's requests: no faster than its rate limit, and
+// answered from the metadata_cache table while a cached response is fresh
+type fetcher struct {
+	provider  string
+	client    *http.Client
+	limiter   *rate.Limiter
+	db        *gorm.DB // nil disables caching
+	ttl       time.Duration
+	userAgent string
+	now       func() time.Time
+}
+
+func newFetcher(provider string, db *gorm.DB, cfg config.MetadataConfig, providerCfg config.MetadataProviderConfig) *fetcher {
+	return &fetcher{
+		provider:  provider,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		limiter:   rate.NewLimiter(rate.Limit(providerCfg.RateLimit), 1),
+		db:        db,
+		ttl:       cfg.CacheTTL,
+		userAgent: cfg.UserAgent,
+		now:       time.Now,
+	}
+}
+
+// getJSON fetches url and decodes the JSON response into out. It returns
+// false when the provider has no such resource. header is not part of the
+// cache key, so credentials passed there are not stored.
+func (f *fetcher) getJSON(ctx context.Context, url string, header http.Header, out interface{}) (bool, error) {
+	status, body, err := f.get(ctx, url, header)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return false, fmt.Errorf("%s: invalid response: %w", f.provider, err)
+	}
+	return true, nil
+}
+
+// get returns the status and body of a successful or not found response
+func (f *fetcher) get(ctx context.Context, url string, header http.Header) (int, []byte, error) {
+	sum := sha256.Sum256([]byte(url))
+	key := hex.EncodeToString(sum[:])
+
+	if f.db != nil {
+		var cached []models.MetadataCacheEntry
+		err := f.db.WithContext(ctx).
+			Where("provider = ? AND key = ? AND expires_at > ?", f.provider, key, f.now()).
+			Limit(1).Find(&cached).Error
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: failed to read cache: %w", f.provider, err)
+		}
+		if len(cached) > 0 {
+			return cached[0].Status, []byte(cached[0].Body), nil
+		}
+	}
+
+	if err := f.limiter.Wait(ctx); err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", f.provider, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", f.userAgent)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", f.provider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: failed to read response: %w", f.provider, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		body = nil
+	default:
+		// Rate limits, outages and rejected requests are not cached, so
+		// the next run asks again
+		return 0, nil, fmt.Errorf("%s: unexpected status %d", f.provider, resp.StatusCode)
+	}
+
+	if f.db != nil {
+		entry := models.MetadataCacheEntry{
+			Provider:  f.provider,
+			Key:       key,
+			Status:    resp.StatusCode,
+			Body:      string(body),
+			ExpiresAt: f.now().Add(f.ttl),
+		}
+		err := f.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&entry).Error
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: failed to cache response: %w", f.provider, err)
+		}
+	}
+	return resp.StatusCode, body, nil
+}
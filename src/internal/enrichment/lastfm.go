@@ -0,0 +1,172 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+)
+
+const (
+	// lastFMNotFound is the Last.fm error code for an unknown artist or album
+	lastFMNotFound = 6
+
+	// lastFMPlaceholder is the image Last.fm returns for artists it has no picture of
+	lastFMPlaceholder = "2a96cbd8b46e442fc41c2b86b821562f"
+)
+
+// LastFM looks artists and albums up in the Last.fm web service. It finds
+// biographies, album summaries, images and tags used as genres.
+type LastFM struct {
+	fetch   *fetcher
+	baseURL string
+	apiKey  string
+}
+
+// NewLastFM creates a Last.fm provider; db caches its responses
+func NewLastFM(db *gorm.DB, cfg config.MetadataConfig) *LastFM {
+	return &LastFM{
+		fetch:   newFetcher(ProviderLastFM, db, cfg, cfg.LastFM),
+		baseURL: cfg.LastFM.BaseURL,
+		apiKey:  cfg.LastFM.APIKey,
+	}
+}
+
+// Name returns the provider name
+func (l *LastFM) Name() string {
+	return ProviderLastFM
+}
+
+type lastFMImage struct {
+	URL  string `json:"#text"`
+	Size string `json:"size"`
+}
+
+type lastFMTags struct {
+	Tag []struct {
+		Name string `json:"name"`
+	} `json:"tag"`
+}
+
+type lastFMText struct {
+	Summary string `json:"summary"`
+}
+
+// Artist looks the artist up by MusicBrainz ID or name
+func (l *LastFM) Artist(ctx context.Context, query ArtistQuery) (*ArtistInfo, error) {
+	params := url.Values{"method": {"artist.getinfo"}, "autocorrect": {"1"}}
+	if query.IDs.MusicBrainzID != "" {
+		params.Set("mbid", query.IDs.MusicBrainzID)
+	} else {
+		params.Set("artist", query.Name)
+	}
+
+	var response struct {
+		Artist *struct {
+			MBID  string        `json:"mbid"`
+			Image []lastFMImage `json:"image"`
+			Bio   lastFMText    `json:"bio"`
+		} `json:"artist"`
+	}
+	if found, err := l.call(ctx, params, &response); err != nil || !found || response.Artist == nil {
+		return nil, err
+	}
+	return &ArtistInfo{
+		IDs:       IDs{MusicBrainzID: response.Artist.MBID},
+		Biography: lastFMSummary(response.Artist.Bio.Summary),
+		ImageURL:  lastFMImageURL(response.Artist.Image),
+	}, nil
+}
+
+// Album looks the album up by MusicBrainz ID, or by name and artist
+func (l *LastFM) Album(ctx context.Context, query AlbumQuery) (*AlbumInfo, error) {
+	params := url.Values{"method": {"album.getinfo"}, "autocorrect": {"1"}}
+	if query.IDs.MusicBrainzID != "" {
+		params.Set("mbid", query.IDs.MusicBrainzID)
+	} else {
+		params.Set("album", query.Name)
+		params.Set("artist", query.Artist.Name)
+	}
+
+	var response struct {
+		Album *struct {
+			MBID  string        `json:"mbid"`
+			Image []lastFMImage `json:"image"`
+			Tags  lastFMTags    `json:"tags"`
+			Wiki  lastFMText    `json:"wiki"`
+		} `json:"album"`
+	}
+	if found, err := l.call(ctx, params, &response); err != nil || !found || response.Album == nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(response.Album.Tags.Tag))
+	for _, tag := range response.Album.Tags.Tag {
+		names = append(names, tag.Name)
+	}
+	return &AlbumInfo{
+		IDs:      IDs{MusicBrainzID: response.Album.MBID},
+		Notes:    lastFMSummary(response.Album.Wiki.Summary),
+		ImageURL: lastFMImageURL(response.Album.Image),
+		Genres:   cleanGenres(names),
+	}, nil
+}
+
+// call makes a web service request and decodes the response into out. It
+// returns false for unknown artists and albums.
+func (l *LastFM) call(ctx context.Context, params url.Values, out interface{}) (bool, error) {
+	params.Set("api_key", l.apiKey)
+	params.Set("format", "json")
+
+	status, body, err := l.fetch.get(ctx, l.baseURL+"?"+params.Encode(), nil)
+	if err != nil || status == http.StatusNotFound {
+		return false, err
+	}
+
+	var failure struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &failure); err != nil {
+		return false, fmt.Errorf("lastfm: invalid response: %w", err)
+	}
+	if failure.Error == lastFMNotFound {
+		return false, nil
+	}
+	if failure.Error != 0 {
+		return false, fmt.Errorf("lastfm: error %d: %s", failure.Error, failure.Message)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return false, fmt.Errorf("lastfm: invalid response: %w", err)
+	}
+	return true, nil
+}
+
+// lastFMSummary drops the "Read more on Last.fm" link that ends summaries
+func lastFMSummary(summary string) string {
+	if i := strings.Index(summary, "<a href=\"https://www.last.fm"); i >= 0 {
+		summary = summary[:i]
+	}
+	return plainText(summary)
+}
+
+// lastFMImageURL returns the largest image that isn't the placeholder
+func lastFMImageURL(images []lastFMImage) string {
+	best, bestRank := "", 0
+	ranks := map[string]int{"small": 1, "medium": 2, "large": 3, "extralarge": 4, "mega": 5}
+	for _, image := range images {
+		if image.URL == "" || strings.Contains(image.URL, lastFMPlaceholder) {
+			continue
+		}
+		if rank := ranks[image.Size]; rank > bestRank {
+			best, bestRank = image.URL, rank
+		}
+	}
+	return best
+}
@@ -0,0 +1,203 @@
+package enrichment
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/releasegroup"
+)
+
+const (
+	// mbMinScore is the lowest search score a MusicBrainz match is accepted with
+	mbMinScore = 90
+
+	// maxGenres bounds the genres taken from a provider
+	maxGenres = 5
+)
+
+// MusicBrainz looks artists and albums up in the MusicBrainz web service. It
+// finds the MusicBrainz IDs, the Discogs, Wikidata and Spotify IDs linked from
+// them, release dates and genres.
+type MusicBrainz struct {
+	fetch   *fetcher
+	baseURL string
+}
+
+// NewMusicBrainz creates a MusicBrainz provider; db caches its responses
+func NewMusicBrainz(db *gorm.DB, cfg config.MetadataConfig) *MusicBrainz {
+	return &MusicBrainz{
+		fetch:   newFetcher(ProviderMusicBrainz, db, cfg, cfg.MusicBrainz),
+		baseURL: strings.TrimSuffix(cfg.MusicBrainz.BaseURL, "/"),
+	}
+}
+
+// Name returns the provider name
+func (m *MusicBrainz) Name() string {
+	return ProviderMusicBrainz
+}
+
+type mbRelation struct {
+	Type string `json:"type"`
+	URL  struct {
+		Resource string `json:"resource"`
+	} `json:"url"`
+}
+
+type mbGenre struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Artist finds the artist by MusicBrainz ID, or by name
+func (m *MusicBrainz) Artist(ctx context.Context, query ArtistQuery) (*ArtistInfo, error) {
+	id := query.IDs.MusicBrainzID
+	if id == "" {
+		var search struct {
+			Artists []struct {
+				ID    string `json:"id"`
+				Name  string `json:"name"`
+				Score int    `json:"score"`
+			} `json:"artists"`
+		}
+		params := url.Values{"query": {"artist:" + luceneQuote(query.Name)}, "limit": {"5"}, "fmt": {"json"}}
+		if _, err := m.fetch.getJSON(ctx, m.baseURL+"/artist?"+params.Encode(), nil, &search); err != nil {
+			return nil, err
+		}
+		for _, artist := range search.Artists {
+			if artist.Score >= mbMinScore && releasegroup.Normalize(artist.Name) == releasegroup.Normalize(query.Name) {
+				id = artist.ID
+				break
+			}
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+
+	var artist struct {
+		ID        string       `json:"id"`
+		Relations []mbRelation `json:"relations"`
+	}
+	found, err := m.fetch.getJSON(ctx, m.baseURL+"/artist/"+url.PathEscape(id)+"?inc=url-rels&fmt=json", nil, &artist)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	info := &ArtistInfo{IDs: linkedIDs(artist.Relations)}
+	info.IDs.MusicBrainzID = artist.ID
+	return info, nil
+}
+
+// Album finds the release by MusicBrainz ID, or by name and artist, and its release group
+func (m *MusicBrainz) Album(ctx context.Context, query AlbumQuery) (*AlbumInfo, error) {
+	id := query.IDs.MusicBrainzID
+	if id == "" {
+		var search struct {
+			Releases []struct {
+				ID    string `json:"id"`
+				Title string `json:"title"`
+				Score int    `json:"score"`
+			} `json:"releases"`
+		}
+		q := "release:" + luceneQuote(query.Name)
+		if query.Artist.IDs.MusicBrainzID != "" {
+			q += " AND arid:" + luceneQuote(query.Artist.IDs.MusicBrainzID)
+		} else {
+			q += " AND artist:" + luceneQuote(query.Artist.Name)
+		}
+		params := url.Values{"query": {q}, "limit": {"5"}, "fmt": {"json"}}
+		if _, err := m.fetch.getJSON(ctx, m.baseURL+"/release?"+params.Encode(), nil, &search); err != nil {
+			return nil, err
+		}
+		for _, release := range search.Releases {
+			if release.Score >= mbMinScore && releasegroup.Normalize(release.Title) == releasegroup.Normalize(query.Name) {
+				id = release.ID
+				break
+			}
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+
+	var release struct {
+		ID           string `json:"id"`
+		Date         string `json:"date"`
+		ReleaseGroup struct {
+			ID               string `json:"id"`
+			FirstReleaseDate string `json:"first-release-date"`
+		} `json:"release-group"`
+	}
+	found, err := m.fetch.getJSON(ctx, m.baseURL+"/release/"+url.PathEscape(id)+"?inc=release-groups&fmt=json", nil, &release)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	info := &AlbumInfo{
+		IDs:                 IDs{MusicBrainzID: release.ID},
+		ReleaseDate:         parseDate(release.Date),
+		OriginalReleaseDate: parseDate(release.ReleaseGroup.FirstReleaseDate),
+	}
+	if release.ReleaseGroup.ID == "" {
+		return info, nil
+	}
+
+	// Genres and links are kept on the release group, shared by every edition
+	var group struct {
+		Genres    []mbGenre    `json:"genres"`
+		Relations []mbRelation `json:"relations"`
+	}
+	_, err = m.fetch.getJSON(ctx, m.baseURL+"/release-group/"+url.PathEscape(release.ReleaseGroup.ID)+"?inc=genres+url-rels&fmt=json", nil, &group)
+	if err != nil {
+		return nil, err
+	}
+	links := linkedIDs(group.Relations)
+	links.MusicBrainzID = ""
+	info.IDs = info.IDs.merge(links)
+
+	sort.SliceStable(group.Genres, func(i, j int) bool { return group.Genres[i].Count > group.Genres[j].Count })
+	names := make([]string, 0, len(group.Genres))
+	for _, genre := range group.Genres {
+		names = append(names, genre.Name)
+	}
+	info.Genres = cleanGenres(names)
+	return info, nil
+}
+
+// linkedIDs picks the Discogs, Wikidata and Spotify IDs out of URL relations
+func linkedIDs(relations []mbRelation) IDs {
+	var ids IDs
+	for _, rel := range relations {
+		u, err := url.Parse(rel.URL.Resource)
+		if err != nil {
+			continue
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 2 {
+			continue
+		}
+		host := strings.TrimPrefix(u.Host, "www.")
+		switch {
+		case host == "discogs.com" && (parts[0] == "artist" || parts[0] == "master") && ids.DiscogsID == "":
+			// Discogs URLs may carry a slug: /artist/23755-Miles-Davis
+			ids.DiscogsID = strings.SplitN(parts[1], "-", 2)[0]
+		case host == "wikidata.org" && parts[0] == "wiki" && ids.WikidataID == "":
+			ids.WikidataID = parts[1]
+		case host == "open.spotify.com" && (parts[0] == "artist" || parts[0] == "album") && ids.SpotifyID == "":
+			ids.SpotifyID = parts[1]
+		}
+	}
+	return ids
+}
+
+// luceneQuote quotes a term for a MusicBrainz search query
+func luceneQuote(term string) string {
+	term = strings.ReplaceAll(term, `\`, `\\`)
+	return fmt.Sprintf(`"%s"`, strings.ReplaceAll(term, `"`, `\"`))
+}
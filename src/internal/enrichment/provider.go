@@ -0,0 +1,149 @@
+// Package enrichment fills in artist and album metadata from external
+// providers (MusicBrainz, Last.fm, Discogs and Wikidata): biographies,
+// images, external IDs, release dates and genres. Providers are queried in
+// turn, each seeing the IDs found by the ones before it. Which provider may
+// set a field, and which one wins, follows the configured field priority;
+// values that came from tags or were edited by hand are kept, and locked
+// artists and albums are left alone. Every value set is recorded in the
+// metadata_provenance table.
+package enrichment
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// Provider names, as used in field priorities and provenance records
+const (
+	ProviderMusicBrainz = "musicbrainz"
+	ProviderLastFM      = "lastfm"
+	ProviderDiscogs     = "discogs"
+	ProviderWikidata    = "wikidata"
+)
+
+// Fields that providers fill in
+const (
+	FieldBiography           = "biography"
+	FieldImage               = "image"
+	FieldNotes               = "notes"
+	FieldMusicBrainzID       = "musicbrainz_id"
+	FieldSpotifyID           = "spotify_id"
+	FieldDiscogsID           = "discogs_id"
+	FieldWikidataID          = "wikidata_id"
+	FieldReleaseDate         = "release_date"
+	FieldOriginalReleaseDate = "original_release_date"
+	FieldGenres              = "genres"
+)
+
+const maxResponseSize = 4 << 20
+
+// IDs are an artist's or album's identifiers at the providers
+type IDs struct {
+	MusicBrainzID string
+	SpotifyID     string
+	DiscogsID     string
+	WikidataID    string
+}
+
+// merge fills the IDs that are missing from other
+func (ids IDs) merge(other IDs) IDs {
+	if ids.MusicBrainzID == "" {
+		ids.MusicBrainzID = other.MusicBrainzID
+	}
+	if ids.SpotifyID == "" {
+		ids.SpotifyID = other.SpotifyID
+	}
+	if ids.DiscogsID == "" {
+		ids.DiscogsID = other.DiscogsID
+	}
+	if ids.WikidataID == "" {
+		ids.WikidataID = other.WikidataID
+	}
+	return ids
+}
+
+// ArtistQuery identifies the artist to look up
+type ArtistQuery struct {
+	Name string
+	IDs  IDs
+}
+
+// AlbumQuery identifies the album to look up
+type AlbumQuery struct {
+	Name   string
+	Artist ArtistQuery
+	IDs    IDs
+}
+
+// ArtistInfo is what a provider knows about an artist; empty fields are unknown
+type ArtistInfo struct {
+	IDs       IDs
+	Biography string
+	ImageURL  string
+}
+
+// AlbumInfo is what a provider knows about an album; empty fields are unknown
+type AlbumInfo struct {
+	IDs                 IDs
+	Notes               string
+	ImageURL            string
+	ReleaseDate         *time.Time
+	OriginalReleaseDate *time.Time
+	Genres              []string
+}
+
+// Provider is an external metadata source. Lookups that find nothing return
+// nil without an error.
+type Provider interface {
+	// Name is the provider name used in field priorities
+	Name() string
+	// Artist looks up an artist
+	Artist(ctx context.Context, query ArtistQuery) (*ArtistInfo, error)
+	// Album looks up an album
+	Album(ctx context.Context, query AlbumQuery) (*AlbumInfo, error)
+}
+
+// parseDate parses a full date, or a year and month, or a year
+func parseDate(value string) *time.Time {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// cleanGenres title-cases genre names and drops duplicates, keeping at most maxGenres
+func cleanGenres(names []string) []string {
+	title := cases.Title(language.English)
+	seen := make(map[string]bool)
+	var genres []string
+	for _, name := range names {
+		// Genres are stored comma separated where there are no arrays
+		name = strings.TrimSpace(strings.ReplaceAll(name, ",", " "))
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		genres = append(genres, title.String(name))
+		if len(genres) == maxGenres {
+			break
+		}
+	}
+	return genres
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips HTML tags and surrounding space from a provider's text
+func plainText(value string) string {
+	value = htmlTag.ReplaceAllString(value, "")
+	value = strings.NewReplacer("&amp;", "&", "&quot;", `"`, "&#39;", "'", "&lt;", "<", "&gt;", ">").Replace(value)
+	return strings.TrimSpace(value)
+}
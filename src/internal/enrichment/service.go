@@ -0,0 +1,439 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"melodee/internal/config"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+)
+
+// Entity types recorded in provenance
+const (
+	EntityArtist = "artist"
+	EntityAlbum  = "album"
+)
+
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	uuidField
+	dateField
+	listField
+)
+
+// field is an enriched column. Values are compared and recorded as text:
+// dates as YYYY-MM-DD and lists comma separated.
+type field struct {
+	name   string
+	column string
+	kind   fieldKind
+}
+
+// MusicBrainz IDs are stored in the column the models map them to
+var artistFields = []field{
+	{FieldBiography, "biography", textField},
+	{FieldImage, "image_url", textField},
+	{FieldMusicBrainzID, "music_brainz_id", uuidField},
+	{FieldSpotifyID, "spotify_id", textField},
+	{FieldDiscogsID, "discogs_id", textField},
+	{FieldWikidataID, "wikidata_id", textField},
+}
+
+var albumFields = []field{
+	{FieldNotes, "description", textField},
+	{FieldImage, "image_url", textField},
+	{FieldMusicBrainzID, "music_brainz_id", uuidField},
+	{FieldSpotifyID, "spotify_id", textField},
+	{FieldDiscogsID, "discogs_id", textField},
+	{FieldWikidataID, "wikidata_id", textField},
+	{FieldReleaseDate, "release_date", dateField},
+	{FieldOriginalReleaseDate, "original_release_date", dateField},
+	{FieldGenres, "genres", listField},
+}
+
+// offers holds what each provider found, by field and provider
+type offers map[string]map[string]string
+
+func (o offers) add(provider, field, value string) {
+	if value == "" {
+		return
+	}
+	if o[field] == nil {
+		o[field] = make(map[string]string)
+	}
+	o[field][provider] = value
+}
+
+func (o offers) addIDs(provider string, ids IDs) {
+	o.add(provider, FieldMusicBrainzID, ids.MusicBrainzID)
+	o.add(provider, FieldSpotifyID, ids.SpotifyID)
+	o.add(provider, FieldDiscogsID, ids.DiscogsID)
+	o.add(provider, FieldWikidataID, ids.WikidataID)
+}
+
+// Result lists the fields an enrichment set
+type Result struct {
+	Artist []string `json:"artist"`
+	Album  []string `json:"album"`
+}
+
+// Service enriches artists and albums from the enabled providers
+type Service struct {
+	db        *gorm.DB
+	providers []Provider
+	priority  map[string][]string
+	now       func() time.Time
+}
+
+// NewService creates an enrichment service querying the providers enabled in cfg
+func NewService(db *gorm.DB, cfg config.MetadataConfig) *Service {
+	// MusicBrainz goes first: Wikidata and Discogs use the IDs it links to
+	var providers []Provider
+	if cfg.MusicBrainz.Enabled {
+		providers = append(providers, NewMusicBrainz(db, cfg))
+	}
+	if cfg.Wikidata.Enabled {
+		providers = append(providers, NewWikidata(db, cfg))
+	}
+	if cfg.Discogs.Enabled {
+		providers = append(providers, NewDiscogs(db, cfg))
+	}
+	if cfg.LastFM.Enabled {
+		providers = append(providers, NewLastFM(db, cfg))
+	}
+
+	priority := cfg.FieldPriority
+	if len(priority) == 0 {
+		priority = config.DefaultMetadataFieldPriority()
+	}
+	return &Service{db: db, providers: providers, priority: priority, now: time.Now}
+}
+
+// Providers returns the names of the enabled providers, in the order they are queried
+func (s *Service) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for _, p := range s.providers {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// EnrichArtist looks an artist up with the named providers, or all enabled
+// ones when sources is empty, and returns the fields it set
+func (s *Service) EnrichArtist(ctx context.Context, artistID int64, sources []string) ([]string, error) {
+	var artist models.Artist
+	if err := s.db.WithContext(ctx).First(&artist, artistID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load artist %d: %w", artistID, err)
+	}
+	if artist.IsLocked {
+		logging.Infof("enrichment: artist %d is locked, skipping", artist.ID)
+		return nil, nil
+	}
+
+	query := ArtistQuery{Name: artist.Name, IDs: IDs{
+		SpotifyID:  artist.SpotifyID,
+		DiscogsID:  artist.DiscogsID,
+		WikidataID: artist.WikidataID,
+	}}
+	if artist.MusicBrainzID != nil {
+		query.IDs.MusicBrainzID = artist.MusicBrainzID.String()
+	}
+	current := map[string]string{
+		FieldBiography:     artist.Biography,
+		FieldImage:         artist.ImageURL,
+		FieldMusicBrainzID: query.IDs.MusicBrainzID,
+		FieldSpotifyID:     artist.SpotifyID,
+		FieldDiscogsID:     artist.DiscogsID,
+		FieldWikidataID:    artist.WikidataID,
+	}
+
+	found := offers{}
+	err := s.each(s.selected(sources), func(p Provider) error {
+		info, err := p.Artist(ctx, query)
+		if err != nil || info == nil {
+			return err
+		}
+		query.IDs = query.IDs.merge(info.IDs)
+		found.addIDs(p.Name(), info.IDs)
+		found.add(p.Name(), FieldBiography, info.Biography)
+		found.add(p.Name(), FieldImage, info.ImageURL)
+		return nil
+	})
+
+	set, applyErr := s.apply(ctx, EntityArtist, artist.ID, &models.Artist{}, artistFields, current, found)
+	if applyErr != nil {
+		return nil, applyErr
+	}
+	return set, err
+}
+
+// EnrichAlbum enriches an album's artist, then the album itself, and returns
+// the fields set on each
+func (s *Service) EnrichAlbum(ctx context.Context, albumID int64, sources []string) (Result, error) {
+	db := s.db.WithContext(ctx)
+	var album models.Album
+	if err := db.Omit("genres").First(&album, albumID).Error; err != nil {
+		return Result{}, fmt.Errorf("failed to load album %d: %w", albumID, err)
+	}
+
+	var result Result
+	set, artistErr := s.EnrichArtist(ctx, album.ArtistID, sources)
+	if errors.Is(artistErr, gorm.ErrRecordNotFound) {
+		return result, artistErr
+	}
+	result.Artist = set
+	if album.IsLocked {
+		logging.Infof("enrichment: album %d is locked, skipping", album.ID)
+		return result, artistErr
+	}
+
+	// The artist's IDs, maybe just found, narrow down the album searches
+	var artist models.Artist
+	if err := db.First(&artist, album.ArtistID).Error; err != nil {
+		return result, fmt.Errorf("failed to load artist %d: %w", album.ArtistID, err)
+	}
+	query := AlbumQuery{
+		Name:   album.Name,
+		Artist: ArtistQuery{Name: artist.Name, IDs: IDs{DiscogsID: artist.DiscogsID, WikidataID: artist.WikidataID}},
+		IDs:    IDs{SpotifyID: album.SpotifyID, DiscogsID: album.DiscogsID, WikidataID: album.WikidataID},
+	}
+	if artist.MusicBrainzID != nil {
+		query.Artist.IDs.MusicBrainzID = artist.MusicBrainzID.String()
+	}
+	if album.MusicBrainzID != nil {
+		query.IDs.MusicBrainzID = album.MusicBrainzID.String()
+	}
+
+	genres, err := s.albumGenres(ctx, album.ID)
+	if err != nil {
+		return result, err
+	}
+	current := map[string]string{
+		FieldNotes:               album.Description,
+		FieldImage:               album.ImageURL,
+		FieldMusicBrainzID:       query.IDs.MusicBrainzID,
+		FieldSpotifyID:           album.SpotifyID,
+		FieldDiscogsID:           album.DiscogsID,
+		FieldWikidataID:          album.WikidataID,
+		FieldReleaseDate:         formatDate(album.ReleaseDate),
+		FieldOriginalReleaseDate: formatDate(album.OriginalReleaseDate),
+		FieldGenres:              genres,
+	}
+
+	found := offers{}
+	err = s.each(s.selected(sources), func(p Provider) error {
+		info, err := p.Album(ctx, query)
+		if err != nil || info == nil {
+			return err
+		}
+		query.IDs = query.IDs.merge(info.IDs)
+		found.addIDs(p.Name(), info.IDs)
+		found.add(p.Name(), FieldNotes, info.Notes)
+		found.add(p.Name(), FieldImage, info.ImageURL)
+		found.add(p.Name(), FieldReleaseDate, formatDate(info.ReleaseDate))
+		found.add(p.Name(), FieldOriginalReleaseDate, formatDate(info.OriginalReleaseDate))
+		found.add(p.Name(), FieldGenres, strings.Join(info.Genres, ","))
+		return nil
+	})
+
+	set, applyErr := s.apply(ctx, EntityAlbum, album.ID, &models.Album{}, albumFields, current, found)
+	if applyErr != nil {
+		return result, applyErr
+	}
+	result.Album = set
+	if err == nil {
+		err = artistErr
+	}
+	return result, err
+}
+
+// Provenance returns which provider set each field of an artist or album
+func (s *Service) Provenance(ctx context.Context, entityType string, entityID int64) ([]models.MetadataProvenance, error) {
+	var records []models.MetadataProvenance
+	err := s.db.WithContext(ctx).
+		Where("entity_type = ? AND entity_id = ?", entityType, entityID).
+		Order("field").
+		Find(&records).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata provenance: %w", err)
+	}
+	return records, nil
+}
+
+// selected returns the providers named in sources, or all of them
+func (s *Service) selected(sources []string) []Provider {
+	if len(sources) == 0 {
+		return s.providers
+	}
+	var providers []Provider
+	for _, p := range s.providers {
+		for _, source := range sources {
+			if strings.EqualFold(source, p.Name()) {
+				providers = append(providers, p)
+				break
+			}
+		}
+	}
+	return providers
+}
+
+// each runs lookup with every provider. A provider that fails is skipped;
+// the error is returned only when every provider failed, so the job is retried.
+func (s *Service) each(providers []Provider, lookup func(Provider) error) error {
+	var failed []error
+	for _, p := range providers {
+		if err := lookup(p); err != nil {
+			logging.Warnf("enrichment: %s lookup failed: %v", p.Name(), err)
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 && len(failed) == len(providers) {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// apply stores the winning offers and records their provenance
+func (s *Service) apply(ctx context.Context, entityType string, id int64, model interface{}, fields []field, current map[string]string, found offers) ([]string, error) {
+	var records []models.MetadataProvenance
+	if err := s.db.WithContext(ctx).Where("entity_type = ? AND entity_id = ?", entityType, id).Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to load metadata provenance: %w", err)
+	}
+	setBy := make(map[string]*models.MetadataProvenance, len(records))
+	for i := range records {
+		setBy[records[i].Field] = &records[i]
+	}
+
+	updates := make(map[string]interface{})
+	var set []string
+	var provenance []models.MetadataProvenance
+	for _, f := range fields {
+		provider, value, ok := s.choose(f.name, current[f.name], setBy[f.name], found[f.name])
+		if !ok {
+			continue
+		}
+		column, ok := s.columnValue(f, value)
+		if !ok {
+			continue
+		}
+		updates[f.column] = column
+		set = append(set, f.name)
+		provenance = append(provenance, models.MetadataProvenance{
+			EntityType: entityType,
+			EntityID:   id,
+			Field:      f.name,
+			Provider:   provider,
+			Value:      value,
+			UpdatedAt:  s.now(),
+		})
+	}
+	if len(updates) == 0 {
+		return nil, nil
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(model).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "entity_type"}, {Name: "entity_id"}, {Name: "field"}},
+			DoUpdates: clause.AssignmentColumns([]string{"provider", "value", "updated_at"}),
+		}).Create(&provenance).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s %d: %w", entityType, id, err)
+	}
+	return set, nil
+}
+
+// choose picks the offer from the most trusted provider allowed to set the
+// field. It keeps the current value when it came from tags or was entered by
+// hand, was edited after a provider set it, or was set by a more trusted
+// provider.
+func (s *Service) choose(field, current string, setBy *models.MetadataProvenance, offered map[string]string) (string, string, bool) {
+	priority := s.priority[field]
+	provider, value := "", ""
+	for _, name := range priority {
+		if offered[name] != "" {
+			provider, value = name, offered[name]
+			break
+		}
+	}
+	if provider == "" || value == current {
+		return "", "", false
+	}
+
+	if setBy == nil {
+		return provider, value, current == ""
+	}
+	if setBy.Value != current {
+		return "", "", false
+	}
+	if rank(priority, setBy.Provider) < rank(priority, provider) {
+		return "", "", false
+	}
+	return provider, value, true
+}
+
+func rank(priority []string, provider string) int {
+	for i, name := range priority {
+		if name == provider {
+			return i
+		}
+	}
+	return len(priority)
+}
+
+// columnValue converts a field's text value to what is stored in its column
+func (s *Service) columnValue(f field, value string) (interface{}, bool) {
+	switch f.kind {
+	case uuidField:
+		id, err := uuid.Parse(value)
+		return id, err == nil
+	case dateField:
+		t, err := time.Parse("2006-01-02", value)
+		return t, err == nil
+	case listField:
+		if s.db.Dialector.Name() == "postgres" {
+			return gorm.Expr("string_to_array(?, ',')", value), true
+		}
+		// SQLite, used in tests, stores text[] columns as comma separated text
+		return value, true
+	default:
+		return value, true
+	}
+}
+
+// albumGenres returns an album's genres comma separated
+func (s *Service) albumGenres(ctx context.Context, albumID int64) (string, error) {
+	column := "genres"
+	if s.db.Dialector.Name() == "postgres" {
+		column = "array_to_string(genres, ',')"
+	}
+	var genres *string
+	err := s.db.WithContext(ctx).Model(&models.Album{}).Where("id = ?", albumID).Select(column).Scan(&genres).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to load album genres: %w", err)
+	}
+	if genres == nil {
+		return "", nil
+	}
+	return *genres, nil
+}
+
+func formatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
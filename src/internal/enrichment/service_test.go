@@ -0,0 +1,334 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+const (
+	milesMBID    = "561d854a-6a28-4aa7-8c99-323e6ce46c2a"
+	kindOfBlueID = "8f6d6a8c-0d6e-4f77-8a5b-0ed5a8c0f5a1"
+	kindOfBlueRG = "3a4e1d4c-6c4f-4e0a-9d55-2f5a0d61e1b7"
+)
+
+func setupEnrichmentTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE artists (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, api_key TEXT, is_locked BOOLEAN DEFAULT 0, name TEXT,
+			name_normalized TEXT, directory_code TEXT, sort_name TEXT, alternate_names TEXT,
+			track_count_cached INTEGER DEFAULT 0, album_count_cached INTEGER DEFAULT 0,
+			duration_cached INTEGER DEFAULT 0, created_at DATETIME, last_scanned_at DATETIME, tags BLOB,
+			music_brainz_id TEXT, spotify_id TEXT, last_fm_id TEXT, discogs_id TEXT, i_tunes_id TEXT,
+			amg_id TEXT, wikidata_id TEXT, sort_order INTEGER DEFAULT 0, biography TEXT, image_url TEXT
+		)`,
+		`CREATE TABLE albums (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, api_key TEXT, is_locked BOOLEAN DEFAULT 0, name TEXT,
+			name_normalized TEXT, alternate_names TEXT, artist_id INTEGER, library_id INTEGER,
+			track_count_cached INTEGER DEFAULT 0, duration_cached INTEGER DEFAULT 0, created_at DATETIME,
+			tags BLOB, release_date DATETIME, original_release_date DATETIME, album_type TEXT, directory TEXT,
+			sort_name TEXT, sort_order INTEGER DEFAULT 0, image_count INTEGER DEFAULT 0, comment TEXT,
+			description TEXT, genres TEXT, moods TEXT, notes TEXT, deezer_id TEXT, music_brainz_id TEXT,
+			spotify_id TEXT, last_fm_id TEXT, discogs_id TEXT, i_tunes_id TEXT, amg_id TEXT, wikidata_id TEXT,
+			is_compilation BOOLEAN DEFAULT 0, release_group_id INTEGER, edition_type TEXT, image_url TEXT
+		)`,
+		`CREATE TABLE metadata_provenance (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, entity_type TEXT NOT NULL, entity_id INTEGER NOT NULL,
+			field TEXT NOT NULL, provider TEXT NOT NULL, value TEXT, updated_at DATETIME,
+			UNIQUE(entity_type, entity_id, field)
+		)`,
+		`CREATE TABLE metadata_cache (
+			provider TEXT NOT NULL, key TEXT NOT NULL, status INTEGER NOT NULL, body TEXT,
+			expires_at DATETIME NOT NULL, created_at DATETIME, PRIMARY KEY (provider, key)
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+	return db
+}
+
+func createArtist(t *testing.T, db *gorm.DB, name string) models.Artist {
+	require.NoError(t, db.Exec("INSERT INTO artists (name, name_normalized) VALUES (?, ?)", name, strings.ToLower(name)).Error)
+	var artist models.Artist
+	require.NoError(t, db.Where("name = ?", name).First(&artist).Error)
+	return artist
+}
+
+// providerServer stands in for all four providers and counts the requests it serves
+type providerServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+	failing  map[string]bool
+}
+
+func newProviderServer(t *testing.T) *providerServer {
+	s := &providerServer{requests: map[string]int{}, failing: map[string]bool{}}
+	routes := map[string]func(r *http.Request) interface{}{
+		"/mb/artist": func(r *http.Request) interface{} {
+			return map[string]interface{}{"artists": []map[string]interface{}{
+				{"id": "00000000-0000-0000-0000-000000000000", "name": "Miles Davis Quintet", "score": 100},
+				{"id": milesMBID, "name": "Miles Davis", "score": 100},
+			}}
+		},
+		"/mb/artist/" + milesMBID: func(r *http.Request) interface{} {
+			return map[string]interface{}{"id": milesMBID, "relations": []map[string]interface{}{
+				{"type": "discogs", "url": map[string]string{"resource": "https://www.discogs.com/artist/23755-Miles-Davis"}},
+				{"type": "wikidata", "url": map[string]string{"resource": "https://www.wikidata.org/wiki/Q93341"}},
+			}}
+		},
+		"/mb/release": func(r *http.Request) interface{} {
+			assert.Contains(t, r.URL.Query().Get("query"), `arid:"`+milesMBID+`"`)
+			return map[string]interface{}{"releases": []map[string]interface{}{
+				{"id": kindOfBlueID, "title": "Kind of Blue", "score": 100},
+			}}
+		},
+		"/mb/release/" + kindOfBlueID: func(r *http.Request) interface{} {
+			return map[string]interface{}{"id": kindOfBlueID, "date": "1997-03",
+				"release-group": map[string]string{"id": kindOfBlueRG, "first-release-date": "1959-08-17"}}
+		},
+		"/mb/release-group/" + kindOfBlueRG: func(r *http.Request) interface{} {
+			return map[string]interface{}{
+				"genres": []map[string]interface{}{{"name": "modal jazz", "count": 3}, {"name": "jazz", "count": 9}},
+				"relations": []map[string]interface{}{
+					{"type": "discogs", "url": map[string]string{"resource": "https://www.discogs.com/master/5460-Miles-Davis-Kind-Of-Blue"}},
+				},
+			}
+		},
+		"/wd": func(r *http.Request) interface{} {
+			id := r.URL.Query().Get("ids")
+			if id != "Q93341" {
+				return map[string]interface{}{"entities": map[string]interface{}{id: map[string]string{"id": id, "missing": ""}}}
+			}
+			return map[string]interface{}{"entities": map[string]interface{}{"Q93341": map[string]interface{}{
+				"claims": map[string]interface{}{
+					"P18":   []interface{}{wikidataValue("Miles Davis by Palumbo.jpg", "normal")},
+					"P1902": []interface{}{wikidataValue("old", "deprecated"), wikidataValue("0kbYTNQb4Pb1rPbbaF0pT4", "normal")},
+				},
+			}}}
+		},
+		"/lastfm": func(r *http.Request) interface{} {
+			assert.Equal(t, "lastfm-key", r.URL.Query().Get("api_key"))
+			switch r.URL.Query().Get("method") {
+			case "artist.getinfo":
+				return map[string]interface{}{"artist": map[string]interface{}{
+					"mbid":  milesMBID,
+					"image": []map[string]string{{"#text": "https://lastfm.example/2a96cbd8b46e442fc41c2b86b821562f.png", "size": "mega"}},
+					"bio":   map[string]string{"summary": `Miles Dewey Davis III was an American trumpeter. <a href="https://www.last.fm/music/Miles+Davis">Read more on Last.fm</a>`},
+				}}
+			default:
+				return map[string]interface{}{"error": 6, "message": "Album not found"}
+			}
+		},
+		"/discogs/artists/23755": func(r *http.Request) interface{} {
+			assert.Equal(t, "Discogs token=discogs-token", r.Header.Get("Authorization"))
+			return map[string]interface{}{"id": 23755, "profile": "[b]Trumpeter[/b] who led [a=John Coltrane]'s band.",
+				"images": []map[string]string{{"type": "secondary", "uri": "https://discogs.example/2.jpg"}, {"type": "primary", "uri": "https://discogs.example/1.jpg"}}}
+		},
+		"/discogs/masters/5460": func(r *http.Request) interface{} {
+			return map[string]interface{}{"id": 5460, "year": 1959, "genres": []string{"Jazz"}, "styles": []string{"Modal", "Cool Jazz"},
+				"images": []map[string]string{{"type": "primary", "uri": "https://discogs.example/kob.jpg"}}}
+		},
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		failing := s.failing[r.URL.Path]
+		s.mu.Unlock()
+
+		route, ok := routes[r.URL.Path]
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(route(r))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *providerServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func wikidataValue(value, rank string) map[string]interface{} {
+	return map[string]interface{}{"rank": rank, "mainsnak": map[string]interface{}{"datavalue": map[string]interface{}{"value": value}}}
+}
+
+func testMetadataConfig(server *providerServer) config.MetadataConfig {
+	cfg := config.DefaultAppConfig().Metadata
+	cfg.MusicBrainz.BaseURL = server.URL + "/mb"
+	cfg.MusicBrainz.RateLimit = 1000
+	cfg.Wikidata.BaseURL = server.URL + "/wd"
+	cfg.Wikidata.RateLimit = 1000
+	cfg.LastFM = config.MetadataProviderConfig{Enabled: true, BaseURL: server.URL + "/lastfm", APIKey: "lastfm-key", RateLimit: 1000}
+	cfg.Discogs = config.MetadataProviderConfig{Enabled: true, BaseURL: server.URL + "/discogs", APIKey: "discogs-token", RateLimit: 1000}
+	return cfg
+}
+
+func provenanceOf(t *testing.T, db *gorm.DB, entityType string, id int64) map[string]string {
+	var records []models.MetadataProvenance
+	require.NoError(t, db.Where("entity_type = ? AND entity_id = ?", entityType, id).Find(&records).Error)
+	providers := map[string]string{}
+	for _, r := range records {
+		providers[r.Field] = r.Provider
+	}
+	return providers
+}
+
+func TestService_EnrichAlbumFromProviders(t *testing.T) {
+	db := setupEnrichmentTestDB(t)
+	server := newProviderServer(t)
+	ctx := context.Background()
+
+	artist := createArtist(t, db, "Miles Davis")
+	require.NoError(t, db.Exec(`INSERT INTO albums (name, name_normalized, artist_id, directory, release_date)
+		VALUES ('Kind of Blue', 'kind of blue', ?, 'k', '1999-01-01 00:00:00')`, artist.ID).Error)
+	var albumID int64
+	db.Raw("SELECT id FROM albums").Scan(&albumID)
+
+	service := NewService(db, testMetadataConfig(server))
+	assert.Equal(t, []string{"musicbrainz", "wikidata", "discogs", "lastfm"}, service.Providers())
+
+	result, err := service.EnrichAlbum(ctx, albumID, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{FieldBiography, FieldImage, FieldMusicBrainzID, FieldSpotifyID, FieldDiscogsID, FieldWikidataID}, result.Artist)
+	assert.NotContains(t, result.Album, FieldReleaseDate, "the tagged release date is kept")
+
+	require.NoError(t, db.First(&artist, artist.ID).Error)
+	assert.Equal(t, "Miles Dewey Davis III was an American trumpeter.", artist.Biography)
+	assert.Equal(t, "https://discogs.example/1.jpg", artist.ImageURL)
+	assert.Equal(t, milesMBID, artist.MusicBrainzID.String())
+	assert.Equal(t, "23755", artist.DiscogsID)
+	assert.Equal(t, "Q93341", artist.WikidataID)
+	assert.Equal(t, "0kbYTNQb4Pb1rPbbaF0pT4", artist.SpotifyID)
+	assert.Equal(t, map[string]string{
+		FieldBiography:     ProviderLastFM,
+		FieldImage:         ProviderDiscogs,
+		FieldMusicBrainzID: ProviderMusicBrainz,
+		FieldSpotifyID:     ProviderWikidata,
+		FieldDiscogsID:     ProviderMusicBrainz,
+		FieldWikidataID:    ProviderMusicBrainz,
+	}, provenanceOf(t, db, EntityArtist, artist.ID))
+
+	var album struct {
+		MusicBrainzID       string
+		DiscogsID           string
+		ImageURL            string
+		Genres              string
+		ReleaseDate         string
+		OriginalReleaseDate string
+	}
+	require.NoError(t, db.Raw(`SELECT music_brainz_id, discogs_id, image_url, genres,
+		release_date, original_release_date FROM albums WHERE id = ?`, albumID).Scan(&album).Error)
+	assert.Equal(t, kindOfBlueID, album.MusicBrainzID)
+	assert.Equal(t, "5460", album.DiscogsID)
+	assert.Equal(t, "https://discogs.example/kob.jpg", album.ImageURL)
+	assert.Equal(t, "Jazz,Modal Jazz", album.Genres, "MusicBrainz is trusted over Discogs for genres")
+	assert.Contains(t, album.ReleaseDate, "1999-01-01")
+	assert.Contains(t, album.OriginalReleaseDate, "1959-08-17")
+	assert.Equal(t, ProviderMusicBrainz, provenanceOf(t, db, EntityAlbum, albumID)[FieldGenres])
+
+	// Responses are cached: enriching again makes no requests
+	before := server.count("/mb/artist/" + milesMBID)
+	result, err = service.EnrichAlbum(ctx, albumID, nil)
+	require.NoError(t, err)
+	assert.Empty(t, result.Artist)
+	assert.Empty(t, result.Album)
+	assert.Equal(t, before, server.count("/mb/artist/"+milesMBID))
+	assert.Equal(t, 1, server.count("/mb/artist"))
+}
+
+func TestService_KeepsEditedAndLockedValues(t *testing.T) {
+	db := setupEnrichmentTestDB(t)
+	server := newProviderServer(t)
+	ctx := context.Background()
+	service := NewService(db, testMetadataConfig(server))
+
+	artist := createArtist(t, db, "Miles Davis")
+	_, err := service.EnrichArtist(ctx, artist.ID, []string{"musicbrainz", "discogs"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, server.count("/lastfm"), "only the named sources are asked")
+
+	// Discogs set the biography; Last.fm is trusted more for it and replaces it
+	require.NoError(t, db.First(&artist, artist.ID).Error)
+	assert.Equal(t, "Trumpeter who led John Coltrane's band.", artist.Biography)
+	set, err := service.EnrichArtist(ctx, artist.ID, nil)
+	require.NoError(t, err)
+	assert.Contains(t, set, FieldBiography)
+
+	// A biography edited by hand is kept
+	require.NoError(t, db.Model(&artist).Update("biography", "Edited").Error)
+	db.Where("1 = 1").Delete(&models.MetadataCacheEntry{})
+	set, err = service.EnrichArtist(ctx, artist.ID, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, set, FieldBiography)
+
+	// Locked artists are left alone, without asking any provider
+	require.NoError(t, db.Model(&artist).Updates(map[string]interface{}{"is_locked": true, "image_url": ""}).Error)
+	db.Where("1 = 1").Delete(&models.MetadataCacheEntry{})
+	requests := server.count("/mb/artist/" + milesMBID)
+	set, err = service.EnrichArtist(ctx, artist.ID, nil)
+	require.NoError(t, err)
+	assert.Empty(t, set)
+	assert.Equal(t, requests, server.count("/mb/artist/"+milesMBID))
+	require.NoError(t, db.First(&artist, artist.ID).Error)
+	assert.Equal(t, "Edited", artist.Biography)
+	assert.Empty(t, artist.ImageURL)
+}
+
+func TestService_ProviderFailures(t *testing.T) {
+	db := setupEnrichmentTestDB(t)
+	server := newProviderServer(t)
+	ctx := context.Background()
+	service := NewService(db, testMetadataConfig(server))
+
+	artist := createArtist(t, db, "Miles Davis")
+
+	// Discogs being down doesn't stop the others
+	server.failing["/discogs/artists/23755"] = true
+	set, err := service.EnrichArtist(ctx, artist.ID, nil)
+	require.NoError(t, err)
+	assert.Contains(t, set, FieldBiography)
+	assert.Equal(t, ProviderWikidata, provenanceOf(t, db, EntityArtist, artist.ID)[FieldImage])
+
+	// When every provider fails the error is returned, and failures aren't cached
+	_, err = service.EnrichArtist(ctx, artist.ID, []string{"discogs"})
+	assert.Error(t, err)
+	delete(server.failing, "/discogs/artists/23755")
+	set, err = service.EnrichArtist(ctx, artist.ID, []string{"discogs"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{FieldImage}, set, "Discogs is trusted over Wikidata for images")
+
+	// Unknown names are looked up once; the miss is cached
+	unknown := createArtist(t, db, "Nobody Known")
+	for i := 0; i < 2; i++ {
+		set, err = service.EnrichArtist(ctx, unknown.ID, []string{"discogs"})
+		require.NoError(t, err)
+		assert.Empty(t, set)
+	}
+	assert.Equal(t, 1, server.count("/discogs/database/search"))
+}
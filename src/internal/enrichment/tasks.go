@@ -0,0 +1,80 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+
+	"melodee/internal/logging"
+	"melodee/internal/media"
+)
+
+// EnqueueAlbum creates and enqueues enrichment of an album and its artist
+func EnqueueAlbum(client *asynq.Client, albumID int64, sources []string) error {
+	return enqueue(client, media.MetadataEnhancePayload{AlbumID: albumID, Sources: sources},
+		fmt.Sprintf("metadata.enhance:%d", albumID))
+}
+
+// EnqueueArtist creates and enqueues enrichment of an artist
+func EnqueueArtist(client *asynq.Client, artistID int64, sources []string) error {
+	return enqueue(client, media.MetadataEnhancePayload{ArtistID: artistID, Sources: sources},
+		fmt.Sprintf("metadata.enhance:artist:%d", artistID))
+}
+
+func enqueue(client *asynq.Client, payload media.MetadataEnhancePayload, dedupKey string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata enhance payload: %w", err)
+	}
+
+	// Providers are rate limited, so an enrichment already queued is not repeated
+	_, err = client.Enqueue(asynq.NewTask(media.TypeMetadataEnhance, data),
+		asynq.TaskID(dedupKey),
+		asynq.Timeout(3*time.Minute),
+	)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue metadata enhance: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs metadata enrichment jobs
+type TaskHandler struct {
+	service *Service
+}
+
+// NewTaskHandler creates a new enrichment task handler
+func NewTaskHandler(service *Service) *TaskHandler {
+	return &TaskHandler{service: service}
+}
+
+// HandleEnhance enriches the album, and its artist, or the artist in the payload
+func (h *TaskHandler) HandleEnhance(ctx context.Context, t *asynq.Task) error {
+	var p media.MetadataEnhancePayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal metadata enhance payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	var result Result
+	var err error
+	switch {
+	case p.AlbumID > 0:
+		result, err = h.service.EnrichAlbum(ctx, p.AlbumID, p.Sources)
+	case p.ArtistID > 0:
+		result.Artist, err = h.service.EnrichArtist(ctx, p.ArtistID, p.Sources)
+	default:
+		return fmt.Errorf("metadata enhance payload names no album or artist: %w", asynq.SkipRetry)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+
+	logging.Infof("enrichment: album %d / artist %d: set artist fields %v, album fields %v",
+		p.AlbumID, p.ArtistID, result.Artist, result.Album)
+	return err
+}
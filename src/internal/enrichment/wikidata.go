@@ -0,0 +1,177 @@
+package enrichment
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+)
+
+// Wikidata properties read from entities
+const (
+	wikidataImage            = "P18"
+	wikidataMusicBrainzID    = "P434"
+	wikidataSpotifyArtistID  = "P1902"
+	wikidataSpotifyAlbumID   = "P2205"
+	wikidataDiscogsArtistID  = "P1953"
+	wikidataDiscogsMasterID  = "P1954"
+	wikidataPublicationDate  = "P577"
+	wikidataDayPrecision     = 11
+	wikidataYearPrecision    = 9
+	wikimediaCommonsFilePath = "https://commons.wikimedia.org/wiki/Special:FilePath/"
+)
+
+// Wikidata reads the Wikidata entities of artists and albums whose Wikidata
+// ID another provider found. It finds images on Wikimedia Commons, external
+// IDs and publication dates.
+type Wikidata struct {
+	fetch   *fetcher
+	baseURL string
+}
+
+// NewWikidata creates a Wikidata provider; db caches its responses
+func NewWikidata(db *gorm.DB, cfg config.MetadataConfig) *Wikidata {
+	return &Wikidata{
+		fetch:   newFetcher(ProviderWikidata, db, cfg, cfg.Wikidata),
+		baseURL: cfg.Wikidata.BaseURL,
+	}
+}
+
+// Name returns the provider name
+func (w *Wikidata) Name() string {
+	return ProviderWikidata
+}
+
+type wikidataClaim struct {
+	MainSnak struct {
+		DataValue struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"datavalue"`
+	} `json:"mainsnak"`
+	Rank string `json:"rank"`
+}
+
+type wikidataClaims map[string][]wikidataClaim
+
+// text returns the first string value of a property
+func (c wikidataClaims) text(property string) string {
+	for _, claim := range c.claims(property) {
+		var value string
+		if json.Unmarshal(claim.MainSnak.DataValue.Value, &value) == nil && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// date returns the first time value of a property precise to the year or better
+func (c wikidataClaims) date(property string) string {
+	for _, claim := range c.claims(property) {
+		var value struct {
+			Time      string `json:"time"`
+			Precision int    `json:"precision"`
+		}
+		if json.Unmarshal(claim.MainSnak.DataValue.Value, &value) != nil || value.Precision < wikidataYearPrecision {
+			continue
+		}
+		// "+1959-08-17T00:00:00Z"; less precise dates have zero months and days
+		date := strings.TrimPrefix(value.Time, "+")
+		if len(date) < 10 {
+			continue
+		}
+		if value.Precision < wikidataDayPrecision {
+			return date[:4]
+		}
+		return date[:10]
+	}
+	return ""
+}
+
+// claims returns a property's claims, preferred ones first, without deprecated ones
+func (c wikidataClaims) claims(property string) []wikidataClaim {
+	var preferred, normal []wikidataClaim
+	for _, claim := range c[property] {
+		switch claim.Rank {
+		case "preferred":
+			preferred = append(preferred, claim)
+		case "deprecated":
+		default:
+			normal = append(normal, claim)
+		}
+	}
+	return append(preferred, normal...)
+}
+
+// Artist reads the artist's entity
+func (w *Wikidata) Artist(ctx context.Context, query ArtistQuery) (*ArtistInfo, error) {
+	claims, err := w.entity(ctx, query.IDs.WikidataID)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	return &ArtistInfo{
+		IDs: IDs{
+			MusicBrainzID: claims.text(wikidataMusicBrainzID),
+			SpotifyID:     claims.text(wikidataSpotifyArtistID),
+			DiscogsID:     claims.text(wikidataDiscogsArtistID),
+			WikidataID:    query.IDs.WikidataID,
+		},
+		ImageURL: commonsURL(claims.text(wikidataImage)),
+	}, nil
+}
+
+// Album reads the album's entity
+func (w *Wikidata) Album(ctx context.Context, query AlbumQuery) (*AlbumInfo, error) {
+	claims, err := w.entity(ctx, query.IDs.WikidataID)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	return &AlbumInfo{
+		IDs: IDs{
+			SpotifyID:  claims.text(wikidataSpotifyAlbumID),
+			DiscogsID:  claims.text(wikidataDiscogsMasterID),
+			WikidataID: query.IDs.WikidataID,
+		},
+		ImageURL:            commonsURL(claims.text(wikidataImage)),
+		OriginalReleaseDate: parseDate(claims.date(wikidataPublicationDate)),
+	}, nil
+}
+
+// entity returns the claims of an entity, or nil when there is no such entity
+func (w *Wikidata) entity(ctx context.Context, id string) (wikidataClaims, error) {
+	if id == "" {
+		return nil, nil
+	}
+	params := url.Values{
+		"action": {"wbgetentities"},
+		"ids":    {id},
+		"props":  {"claims"},
+		"format": {"json"},
+	}
+	var response struct {
+		Entities map[string]struct {
+			Missing *string        `json:"missing"`
+			Claims  wikidataClaims `json:"claims"`
+		} `json:"entities"`
+	}
+	found, err := w.fetch.getJSON(ctx, w.baseURL+"?"+params.Encode(), nil, &response)
+	if err != nil || !found {
+		return nil, err
+	}
+	entity, ok := response.Entities[id]
+	if !ok || entity.Missing != nil {
+		return nil, nil
+	}
+	return entity.Claims, nil
+}
+
+// commonsURL links to a Wikimedia Commons file
+func commonsURL(file string) string {
+	if file == "" {
+		return ""
+	}
+	return wikimediaCommonsFilePath + url.PathEscape(strings.ReplaceAll(file, " ", "_"))
+}
@@ -0,0 +1,270 @@
+package fingerprint
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Chromaprint's default (TEST2) configuration
+const (
+	// SampleRate is the rate, in Hz, of the mono audio Calculate expects
+	SampleRate = 11025
+
+	frameSize    = 4096
+	frameOverlap = frameSize - frameSize/3
+	hopSize      = frameSize - frameOverlap
+
+	minFreq  = 28
+	maxFreq  = 3520
+	numBands = 12
+
+	maxFilterWidth = 16
+)
+
+// chromaFilter smooths each chroma band over five frames
+var chromaFilter = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// filter is an area of the chroma image: rows are frames, columns are bands
+type filter struct {
+	kind   int
+	y      int // first band
+	height int // bands
+	width  int // frames
+}
+
+// quantizer splits a filter response into four classes
+type quantizer struct {
+	t0, t1, t2 float64
+}
+
+type classifier struct {
+	filter    filter
+	quantizer quantizer
+}
+
+// classifiers are Chromaprint's trained TEST2 classifiers
+var classifiers = [16]classifier{
+	{filter{0, 4, 3, 15}, quantizer{1.98215, 2.35817, 2.63523}},
+	{filter{4, 4, 6, 15}, quantizer{-1.03809, -0.651211, -0.282167}},
+	{filter{1, 0, 4, 16}, quantizer{-0.298702, 0.119262, 0.558497}},
+	{filter{3, 8, 2, 12}, quantizer{-0.105439, 0.0153946, 0.135898}},
+	{filter{3, 4, 4, 8}, quantizer{-0.142891, 0.0258736, 0.200632}},
+	{filter{4, 0, 3, 5}, quantizer{-0.826319, -0.590612, -0.368214}},
+	{filter{1, 2, 2, 9}, quantizer{-0.557409, -0.233035, 0.0534525}},
+	{filter{2, 7, 3, 4}, quantizer{-0.0646826, 0.00620476, 0.0784847}},
+	{filter{2, 6, 2, 16}, quantizer{-0.192387, -0.029699, 0.215855}},
+	{filter{2, 1, 3, 2}, quantizer{-0.0397818, -0.00568076, 0.0292026}},
+	{filter{5, 10, 1, 15}, quantizer{-0.53823, -0.369934, -0.190235}},
+	{filter{3, 6, 2, 10}, quantizer{-0.124877, 0.0296483, 0.139239}},
+	{filter{2, 1, 1, 14}, quantizer{-0.101475, 0.0225617, 0.231971}},
+	{filter{3, 5, 6, 4}, quantizer{-0.0799915, -0.00729616, 0.063262}},
+	{filter{1, 9, 2, 12}, quantizer{-0.272556, 0.019424, 0.302559}},
+	{filter{3, 4, 2, 14}, quantizer{-0.164292, -0.0321188, 0.08463}},
+}
+
+// grayCode maps a class to the two bits it adds to a sub-fingerprint
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+// Calculate returns the raw fingerprint of mono 16-bit audio at SampleRate.
+// It follows Chromaprint's default algorithm, so fingerprints can be compared
+// with those of fpcalc and AcoustID: the audio is cut into overlapping
+// frames, each frame's spectrum is folded into 12 chroma bands, and 16
+// filters over the chroma image give 2 bits each of a sub-fingerprint.
+func Calculate(samples []int16) []uint32 {
+	image := chromaImage(samples)
+	if len(image) < maxFilterWidth {
+		return nil
+	}
+
+	integral := newIntegralImage(image)
+	raw := make([]uint32, 0, len(image)-maxFilterWidth+1)
+	for offset := 0; offset+maxFilterWidth <= len(image); offset++ {
+		var bits uint32
+		for _, c := range classifiers {
+			bits = bits<<2 | grayCode[c.quantizer.quantize(c.filter.apply(integral, offset))]
+		}
+		raw = append(raw, bits)
+	}
+	return raw
+}
+
+// chromaImage returns the smoothed, normalized chroma of each frame
+func chromaImage(samples []int16) [][numBands]float64 {
+	if len(samples) < frameSize {
+		return nil
+	}
+
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = (0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))) / math.MaxInt16
+	}
+
+	minIndex := max(1, freqToIndex(minFreq))
+	maxIndex := min(frameSize/2, freqToIndex(maxFreq))
+	notes := make([]int, maxIndex)
+	for i := minIndex; i < maxIndex; i++ {
+		octave := math.Log2(float64(i) * SampleRate / frameSize / (440.0 / 16))
+		notes[i] = int(numBands * (octave - math.Floor(octave)))
+	}
+
+	fft := newFFT(frameSize)
+	buf := make([]complex128, frameSize)
+	var chroma [][numBands]float64
+	for start := 0; start+frameSize <= len(samples); start += hopSize {
+		for i := range buf {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft.transform(buf)
+
+		var features [numBands]float64
+		for i := minIndex; i < maxIndex; i++ {
+			power := real(buf[i])*real(buf[i]) + imag(buf[i])*imag(buf[i])
+			features[notes[i]] += power
+		}
+		chroma = append(chroma, features)
+	}
+
+	if len(chroma) < len(chromaFilter) {
+		return nil
+	}
+	image := make([][numBands]float64, 0, len(chroma)-len(chromaFilter)+1)
+	for row := 0; row+len(chromaFilter) <= len(chroma); row++ {
+		var smoothed [numBands]float64
+		for j, coefficient := range chromaFilter {
+			for band := range smoothed {
+				smoothed[band] += coefficient * chroma[row+j][band]
+			}
+		}
+		image = append(image, normalize(smoothed))
+	}
+	return image
+}
+
+// normalize scales a row to unit length; near-silent rows become zero
+func normalize(row [numBands]float64) [numBands]float64 {
+	var sum float64
+	for _, v := range row {
+		sum += v * v
+	}
+	norm := math.Sqrt(sum)
+	if norm < 0.01 {
+		return [numBands]float64{}
+	}
+	for i := range row {
+		row[i] /= norm
+	}
+	return row
+}
+
+func freqToIndex(freq float64) int {
+	return int(math.Round(frameSize * freq / SampleRate))
+}
+
+func (q quantizer) quantize(value float64) int {
+	if value < q.t1 {
+		if value < q.t0 {
+			return 0
+		}
+		return 1
+	}
+	if value < q.t2 {
+		return 2
+	}
+	return 3
+}
+
+// apply compares areas of the image starting at frame x
+func (f filter) apply(image *integralImage, x int) float64 {
+	y, w, h := f.y, f.width, f.height
+	var a, b float64
+	switch f.kind {
+	case 0:
+		a = image.area(x, y, x+w, y+h)
+	case 1:
+		h2 := h / 2
+		a = image.area(x, y+h2, x+w, y+h)
+		b = image.area(x, y, x+w, y+h2)
+	case 2:
+		w2 := w / 2
+		a = image.area(x+w2, y, x+w, y+h)
+		b = image.area(x, y, x+w2, y+h)
+	case 3:
+		w2, h2 := w/2, h/2
+		a = image.area(x, y+h2, x+w2, y+h) + image.area(x+w2, y, x+w, y+h2)
+		b = image.area(x, y, x+w2, y+h2) + image.area(x+w2, y+h2, x+w, y+h)
+	case 4:
+		h3 := h / 3
+		a = image.area(x, y+h3, x+w, y+2*h3)
+		b = image.area(x, y, x+w, y+h3) + image.area(x, y+2*h3, x+w, y+h)
+	case 5:
+		w3 := w / 3
+		a = image.area(x+w3, y, x+2*w3, y+h)
+		b = image.area(x, y, x+w3, y+h) + image.area(x+2*w3, y, x+w, y+h)
+	}
+	return math.Log1p(a) - math.Log1p(b)
+}
+
+// integralImage holds, for each row and band, the sum of every value above
+// and to the left of it, so any rectangle is summed in four lookups
+type integralImage struct {
+	sums [][numBands + 1]float64
+}
+
+func newIntegralImage(image [][numBands]float64) *integralImage {
+	sums := make([][numBands + 1]float64, len(image)+1)
+	for r, row := range image {
+		for c, v := range row {
+			sums[r+1][c+1] = v + sums[r][c+1] + sums[r+1][c] - sums[r][c]
+		}
+	}
+	return &integralImage{sums: sums}
+}
+
+// area sums rows [r1, r2) and bands [c1, c2)
+func (im *integralImage) area(r1, c1, r2, c2 int) float64 {
+	return im.sums[r2][c2] - im.sums[r1][c2] - im.sums[r2][c1] + im.sums[r1][c1]
+}
+
+// fft is an in-place radix-2 FFT of a fixed size
+type fft struct {
+	n       int
+	twiddle []complex128
+	reverse []int
+}
+
+func newFFT(n int) *fft {
+	f := &fft{n: n, twiddle: make([]complex128, n/2), reverse: make([]int, n)}
+	for i := range f.twiddle {
+		f.twiddle[i] = cmplx.Exp(complex(0, -2*math.Pi*float64(i)/float64(n)))
+	}
+	bits := 0
+	for 1<<bits < n {
+		bits++
+	}
+	for i := range f.reverse {
+		r := 0
+		for b := 0; b < bits; b++ {
+			r |= (i >> b & 1) << (bits - 1 - b)
+		}
+		f.reverse[i] = r
+	}
+	return f
+}
+
+func (f *fft) transform(x []complex128) {
+	for i, r := range f.reverse {
+		if i < r {
+			x[i], x[r] = x[r], x[i]
+		}
+	}
+	for size := 2; size <= f.n; size <<= 1 {
+		half, step := size/2, f.n/size
+		for start := 0; start < f.n; start += size {
+			for k := 0; k < half; k++ {
+				t := f.twiddle[k*step] * x[start+k+half]
+				x[start+k+half] = x[start+k] - t
+				x[start+k] += t
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package fingerprint
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// melody returns seconds of chords, a new one every half second, picked
+// from seed, with gain scaling the volume
+func melody(seed int64, seconds float64, gain float64) []int16 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]int16, int(seconds*SampleRate))
+	chordLength := SampleRate / 2
+	var freqs []float64
+	for i := range samples {
+		if i%chordLength == 0 {
+			freqs = freqs[:0]
+			for n := 0; n < 3; n++ {
+				freqs = append(freqs, 110*math.Pow(2, float64(rng.Intn(36))/12))
+			}
+		}
+		t := float64(i) / SampleRate
+		var v float64
+		for _, f := range freqs {
+			v += math.Sin(2 * math.Pi * f * t)
+		}
+		samples[i] = int16(v / 3 * 8000 * gain)
+	}
+	return samples
+}
+
+func TestCalculate(t *testing.T) {
+	samples := melody(1, 30, 1)
+	raw := Calculate(samples)
+
+	frames := 1 + (len(samples)-frameSize)/hopSize
+	require.Len(t, raw, frames-len(chromaFilter)+1-maxFilterWidth+1)
+	assert.InDelta(t, 30, Duration(raw), 3)
+	assert.Equal(t, raw, Calculate(samples))
+
+	// Chroma is normalized, so volume barely matters
+	assert.Greater(t, Similarity(raw, Calculate(melody(1, 30, 0.5))), 0.95)
+
+	// Other music does not match
+	assert.Less(t, Similarity(raw, Calculate(melody(2, 30, 1))), 0.7)
+
+	// Too short for a single sub-fingerprint
+	assert.Empty(t, Calculate(samples[:SampleRate]))
+}
+
+func TestHashes(t *testing.T) {
+	raw := []uint32{0xFFFFF000, 0xFFFFF123, 0x00001000, 0x00000FFF}
+	assert.Equal(t, []int32{0, 1, 0xFFFFF}, Hashes(raw))
+}
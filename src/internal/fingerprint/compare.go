@@ -0,0 +1,99 @@
+// Package fingerprint stores and compares Chromaprint audio fingerprints
+package fingerprint
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Chromaprint produces one 32-bit sub-fingerprint roughly every 0.124 seconds
+const (
+	itemDuration = 0.1238
+
+	// maxOffset is how far two fingerprints are slid against each other, so a
+	// recording with a little more or less lead-in silence still matches
+	maxOffset = 80 // ~10 seconds
+
+	// minOverlap is the shortest overlap that is compared at all
+	minOverlap = 40 // ~5 seconds
+)
+
+// ErrInvalidFingerprint is returned when a stored fingerprint cannot be decoded
+var ErrInvalidFingerprint = errors.New("invalid fingerprint")
+
+// Encode stores a raw fingerprint as base64 of its little-endian sub-fingerprints
+func Encode(raw []uint32) string {
+	buf := make([]byte, 4*len(raw))
+	for i, v := range raw {
+		binary.LittleEndian.PutUint32(buf[4*i:], v)
+	}
+	return base64.RawStdEncoding.EncodeToString(buf)
+}
+
+// Decode reverses Encode
+func Decode(encoded string) ([]uint32, error) {
+	buf, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFingerprint, err)
+	}
+	if len(buf)%4 != 0 {
+		return nil, fmt.Errorf("%w: length %d is not a multiple of 4", ErrInvalidFingerprint, len(buf))
+	}
+
+	raw := make([]uint32, len(buf)/4)
+	for i := range raw {
+		raw[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return raw, nil
+}
+
+// Duration returns the length of audio a raw fingerprint covers, in seconds
+func Duration(raw []uint32) float64 {
+	return float64(len(raw)) * itemDuration
+}
+
+// Similarity compares two raw fingerprints and returns a score between 0 and
+// 1, where 1 means identical. The fingerprints are aligned at the offset with
+// the fewest differing bits; a pair that never overlaps enough scores 0.
+func Similarity(a, b []uint32) float64 {
+	best := 0.0
+	for offset := -maxOffset; offset <= maxOffset; offset++ {
+		ai, bi := 0, 0
+		if offset > 0 {
+			ai = offset
+		} else {
+			bi = -offset
+		}
+
+		overlap := min(len(a)-ai, len(b)-bi)
+		if overlap < minOverlap {
+			continue
+		}
+
+		errorBits := 0
+		for i := 0; i < overlap; i++ {
+			errorBits += bits.OnesCount32(a[ai+i] ^ b[bi+i])
+		}
+		score := 1 - float64(errorBits)/float64(32*overlap)
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// Compare decodes and compares two stored fingerprints
+func Compare(a, b string) (float64, error) {
+	rawA, err := Decode(a)
+	if err != nil {
+		return 0, err
+	}
+	rawB, err := Decode(b)
+	if err != nil {
+		return 0, err
+	}
+	return Similarity(rawA, rawB), nil
+}
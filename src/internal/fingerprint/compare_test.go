@@ -0,0 +1,51 @@
+package fingerprint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sequence(n int, seed uint32) []uint32 {
+	raw := make([]uint32, n)
+	x := seed
+	for i := range raw {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		raw[i] = x
+	}
+	return raw
+}
+
+func TestEncodeDecode(t *testing.T) {
+	raw := sequence(100, 1)
+	decoded, err := Decode(Encode(raw))
+	require.NoError(t, err)
+	assert.Equal(t, raw, decoded)
+
+	_, err = Decode("not base64!")
+	assert.ErrorIs(t, err, ErrInvalidFingerprint)
+	_, err = Decode(Encode(raw)[:5])
+	assert.ErrorIs(t, err, ErrInvalidFingerprint)
+}
+
+func TestSimilarity(t *testing.T) {
+	raw := sequence(300, 7)
+	assert.Equal(t, 1.0, Similarity(raw, raw))
+
+	// Extra lead-in on one copy is found by sliding the fingerprints
+	shifted := append(sequence(20, 99), raw...)
+	assert.Equal(t, 1.0, Similarity(raw, shifted))
+
+	// Unrelated audio differs in about half the bits
+	assert.Less(t, Similarity(raw, sequence(300, 12345)), 0.7)
+
+	// Too short to compare
+	assert.Zero(t, Similarity(raw[:10], raw[:10]))
+
+	score, err := Compare(Encode(raw), Encode(raw))
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, score)
+}
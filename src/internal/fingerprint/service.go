@@ -0,0 +1,450 @@
+package fingerprint
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/directory"
+	"melodee/internal/models"
+)
+
+const (
+	// hashShift keeps the top 20 bits of a sub-fingerprint as its hash: the
+	// first ten classifiers, which survive re-encoding more often than all 32
+	hashShift = 12
+
+	// minHashHits is how many hashes two tracks share before their
+	// fingerprints are compared. Unrelated tracks share about one.
+	minHashHits = 10
+
+	// maxCandidates bounds the tracks a fingerprint is compared with
+	maxCandidates = 20
+
+	// maxHashTracks leaves out hashes shared by more tracks than this, such
+	// as those of silence, when looking for duplicates across the library
+	maxHashTracks = 50
+
+	// backfillBatch is how many tracks are fingerprinted per query
+	backfillBatch = 100
+)
+
+// losslessFormats are the file extensions of lossless audio
+var losslessFormats = map[string]bool{
+	"flac": true, "wav": true, "aif": true, "aiff": true, "ape": true, "wv": true, "dsf": true, "dff": true,
+}
+
+// Match is a stored track that is likely the same recording as a fingerprint
+type Match struct {
+	TrackID    int64   `json:"track_id"`
+	Name       string  `json:"name"`
+	AlbumName  string  `json:"album_name"`
+	ArtistName string  `json:"artist_name"`
+	Similarity float64 `json:"similarity"`
+}
+
+// ClusterTrack is one copy of a recording in a duplicate cluster
+type ClusterTrack struct {
+	TrackID    int64   `json:"track_id"`
+	Name       string  `json:"name"`
+	AlbumID    int64   `json:"album_id"`
+	AlbumName  string  `json:"album_name"`
+	ArtistName string  `json:"artist_name"`
+	LibraryID  *int32  `json:"library_id"`
+	Path       string  `json:"path"`
+	Format     string  `json:"format"`
+	Lossless   bool    `json:"lossless"`
+	BitRate    int32   `json:"bit_rate"`
+	BitDepth   int32   `json:"bit_depth"`
+	SampleRate int32   `json:"sample_rate"`
+	Channels   int32   `json:"channels"`
+	Duration   int64   `json:"duration"`
+	Similarity float64 `json:"similarity"` // to the preferred copy
+}
+
+// Cluster is a set of tracks that are the same recording, best quality first
+type Cluster struct {
+	PreferredTrackID int64          `json:"preferred_track_id"`
+	Tracks           []ClusterTrack `json:"tracks"`
+}
+
+// BackfillResult counts what a backfill did
+type BackfillResult struct {
+	Fingerprinted int `json:"fingerprinted"`
+	Failed        int `json:"failed"`
+}
+
+// Service computes, stores and matches track fingerprints
+type Service struct {
+	db         *gorm.DB
+	ffmpegPath string
+	cfg        config.FingerprintConfig
+	paths      *directory.LibraryPathResolver
+
+	// decode returns a file's audio from start as mono 16-bit samples at
+	// SampleRate, up to end when it is set
+	decode func(ctx context.Context, path string, start, end time.Duration) ([]int16, error)
+}
+
+// NewService creates a new fingerprint service that decodes audio with ffmpeg
+func NewService(db *gorm.DB, ffmpegPath string, cfg config.FingerprintConfig) *Service {
+	s := &Service{
+		db:         db,
+		ffmpegPath: ffmpegPath,
+		cfg:        cfg,
+		paths:      directory.NewLibraryPathResolver(db, nil),
+	}
+	s.decode = s.decodeFFmpeg
+	return s
+}
+
+// Threshold is the similarity at which two fingerprints are the same recording
+func (s *Service) Threshold() float64 {
+	return s.cfg.Threshold
+}
+
+// FingerprintFile returns the raw fingerprint of the start of an audio file
+func (s *Service) FingerprintFile(ctx context.Context, path string) ([]uint32, error) {
+	return s.FingerprintSegment(ctx, path, 0, 0)
+}
+
+// FingerprintSegment returns the raw fingerprint of the start of a segment of
+// an audio file, as a cue sheet track is. An end of zero is the end of the file.
+func (s *Service) FingerprintSegment(ctx context.Context, path string, start, end time.Duration) ([]uint32, error) {
+	samples, err := s.decode(ctx, path, start, end)
+	if err != nil {
+		return nil, err
+	}
+	raw := Calculate(samples)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%s is too short to fingerprint", filepath.Base(path))
+	}
+	return raw, nil
+}
+
+// decodeFFmpeg decodes the first cfg.Length of a file, or of a segment of it, with ffmpeg
+func (s *Service) decodeFFmpeg(ctx context.Context, path string, start, end time.Duration) ([]int16, error) {
+	args := []string{"-v", "error", "-nostdin"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start.Seconds(), 'f', -1, 64))
+	}
+	args = append(args, "-i", path, "-vn", "-ac", "1", "-ar", strconv.Itoa(SampleRate), "-f", "s16le")
+	length := s.cfg.Length
+	if end > 0 && (length <= 0 || end-start < length) {
+		length = end - start
+	}
+	if length > 0 {
+		args = append(args, "-t", strconv.FormatFloat(length.Seconds(), 'f', -1, 64))
+	}
+	args = append(args, "-")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.ffmpegPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v: %s", filepath.Base(path), err, strings.TrimSpace(stderr.String()))
+	}
+
+	samples := make([]int16, stdout.Len()/2)
+	if err := binary.Read(&stdout, binary.LittleEndian, samples); err != nil {
+		return nil, fmt.Errorf("failed to read decoded audio: %w", err)
+	}
+	return samples, nil
+}
+
+// Hashes returns the distinct hashes of a raw fingerprint, in order
+func Hashes(raw []uint32) []int32 {
+	seen := make(map[int32]bool, len(raw))
+	hashes := make([]int32, 0, len(raw))
+	for _, v := range raw {
+		hash := int32(v >> hashShift)
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+// Store saves a track's fingerprint and indexes it, replacing any earlier one
+func Store(ctx context.Context, db *gorm.DB, trackID int64, raw []uint32) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Track{}).Where("id = ?", trackID).Update("fingerprint", Encode(raw)).Error; err != nil {
+			return fmt.Errorf("failed to save fingerprint: %w", err)
+		}
+		if err := tx.Where("track_id = ?", trackID).Delete(&models.FingerprintHash{}).Error; err != nil {
+			return fmt.Errorf("failed to clear fingerprint hashes: %w", err)
+		}
+
+		hashes := Hashes(raw)
+		rows := make([]models.FingerprintHash, len(hashes))
+		for i, hash := range hashes {
+			rows[i] = models.FingerprintHash{Hash: hash, TrackID: trackID}
+		}
+		if len(rows) > 0 {
+			if err := tx.CreateInBatches(rows, 500).Error; err != nil {
+				return fmt.Errorf("failed to index fingerprint: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Match returns the stored tracks that are likely the same recording as a
+// raw fingerprint, most similar first
+func (s *Service) Match(ctx context.Context, raw []uint32) ([]Match, error) {
+	hashes := Hashes(raw)
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	var candidates []int64
+	err := s.db.WithContext(ctx).Model(&models.FingerprintHash{}).
+		Select("track_id").
+		Where("hash IN ?", hashes).
+		Group("track_id").
+		Having("COUNT(*) >= ?", min(minHashHits, len(hashes))).
+		Order("COUNT(*) DESC").
+		Limit(maxCandidates).
+		Pluck("track_id", &candidates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find fingerprint candidates: %w", err)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	var tracks []models.Track
+	err = s.db.WithContext(ctx).Preload("Album").Preload("Artist").Where("id IN ?", candidates).Find(&tracks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fingerprint candidates: %w", err)
+	}
+
+	var matches []Match
+	for _, track := range tracks {
+		stored, err := Decode(track.Fingerprint)
+		if err != nil {
+			continue
+		}
+		similarity := Similarity(raw, stored)
+		if similarity < s.cfg.Threshold {
+			continue
+		}
+		match := Match{TrackID: track.ID, Name: track.Name, Similarity: similarity}
+		if track.Album != nil {
+			match.AlbumName = track.Album.Name
+		}
+		if track.Artist != nil {
+			match.ArtistName = track.Artist.Name
+		}
+		matches = append(matches, match)
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Similarity > matches[j].Similarity })
+	return matches, nil
+}
+
+// Duplicates returns up to limit clusters of stored tracks that are the same
+// recording, the largest first. Each lists its copies best quality first.
+func (s *Service) Duplicates(ctx context.Context, limit int) ([]Cluster, error) {
+	type pair struct {
+		TrackID int64
+		OtherID int64
+	}
+	var pairs []pair
+	err := s.db.WithContext(ctx).Raw(`
+		SELECT a.track_id AS track_id, b.track_id AS other_id
+		FROM fingerprint_hashes a
+		JOIN fingerprint_hashes b ON b.hash = a.hash AND b.track_id > a.track_id
+		WHERE a.hash IN (SELECT hash FROM fingerprint_hashes GROUP BY hash HAVING COUNT(*) <= ?)
+		GROUP BY a.track_id, b.track_id
+		HAVING COUNT(*) >= ?`, maxHashTracks, minHashHits).Scan(&pairs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find duplicate candidates: %w", err)
+	}
+	if len(pairs) == 0 {
+		return []Cluster{}, nil
+	}
+
+	ids := make(map[int64]bool)
+	for _, p := range pairs {
+		ids[p.TrackID] = true
+		ids[p.OtherID] = true
+	}
+	trackIDs := make([]int64, 0, len(ids))
+	for id := range ids {
+		trackIDs = append(trackIDs, id)
+	}
+
+	var tracks []models.Track
+	err = s.db.WithContext(ctx).Preload("Album").Preload("Artist").Where("id IN ?", trackIDs).Find(&tracks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load duplicate candidates: %w", err)
+	}
+	byID := make(map[int64]*models.Track, len(tracks))
+	raws := make(map[int64][]uint32, len(tracks))
+	for i := range tracks {
+		raw, err := Decode(tracks[i].Fingerprint)
+		if err != nil {
+			continue
+		}
+		byID[tracks[i].ID] = &tracks[i]
+		raws[tracks[i].ID] = raw
+	}
+
+	// Group the confirmed pairs into clusters
+	parent := make(map[int64]int64)
+	var find func(int64) int64
+	find = func(id int64) int64 {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		return id
+	}
+	for _, p := range pairs {
+		a, b := raws[p.TrackID], raws[p.OtherID]
+		if a == nil || b == nil || Similarity(a, b) < s.cfg.Threshold {
+			continue
+		}
+		rootA, rootB := find(p.TrackID), find(p.OtherID)
+		if rootA != rootB {
+			parent[rootB] = rootA
+		}
+		parent[rootA] = rootA
+	}
+
+	members := make(map[int64][]*models.Track)
+	for id := range parent {
+		root := find(id)
+		members[root] = append(members[root], byID[id])
+	}
+
+	clusters := make([]Cluster, 0, len(members))
+	for _, group := range members {
+		clusters = append(clusters, s.cluster(group, raws))
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Tracks) != len(clusters[j].Tracks) {
+			return len(clusters[i].Tracks) > len(clusters[j].Tracks)
+		}
+		return clusters[i].PreferredTrackID < clusters[j].PreferredTrackID
+	})
+	if limit > 0 && len(clusters) > limit {
+		clusters = clusters[:limit]
+	}
+	return clusters, nil
+}
+
+// cluster orders copies of a recording best quality first
+func (s *Service) cluster(group []*models.Track, raws map[int64][]uint32) Cluster {
+	tracks := make([]ClusterTrack, len(group))
+	for i, track := range group {
+		format := strings.TrimPrefix(strings.ToLower(filepath.Ext(track.FileName)), ".")
+		tracks[i] = ClusterTrack{
+			TrackID:    track.ID,
+			Name:       track.Name,
+			AlbumID:    track.AlbumID,
+			LibraryID:  track.LibraryID,
+			Format:     format,
+			Lossless:   losslessFormats[format],
+			BitRate:    track.BitRate,
+			BitDepth:   track.BitDepth,
+			SampleRate: track.SampleRate,
+			Channels:   track.Channels,
+			Duration:   track.Duration,
+		}
+		if track.Album != nil {
+			tracks[i].AlbumName = track.Album.Name
+		}
+		if track.Artist != nil {
+			tracks[i].ArtistName = track.Artist.Name
+		}
+		if path, err := s.paths.TrackPath(track); err == nil {
+			tracks[i].Path = path
+		}
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool { return betterQuality(tracks[i], tracks[j]) })
+	preferred := raws[tracks[0].TrackID]
+	for i := range tracks {
+		tracks[i].Similarity = Similarity(preferred, raws[tracks[i].TrackID])
+	}
+	return Cluster{PreferredTrackID: tracks[0].TrackID, Tracks: tracks}
+}
+
+// betterQuality reports whether a is a better copy than b: lossless first,
+// then by bit depth, sample rate, bit rate and channels
+func betterQuality(a, b ClusterTrack) bool {
+	if a.Lossless != b.Lossless {
+		return a.Lossless
+	}
+	if a.BitDepth != b.BitDepth {
+		return a.BitDepth > b.BitDepth
+	}
+	if a.SampleRate != b.SampleRate {
+		return a.SampleRate > b.SampleRate
+	}
+	if a.BitRate != b.BitRate {
+		return a.BitRate > b.BitRate
+	}
+	if a.Channels != b.Channels {
+		return a.Channels > b.Channels
+	}
+	return a.TrackID < b.TrackID
+}
+
+// Backfill fingerprints the stored tracks that have no fingerprint yet.
+// Tracks whose files can't be decoded are counted and skipped.
+func (s *Service) Backfill(ctx context.Context) (BackfillResult, error) {
+	var result BackfillResult
+	var lastID int64
+	for {
+		var tracks []models.Track
+		err := s.db.WithContext(ctx).Preload("Album").
+			Where("id > ? AND (fingerprint IS NULL OR fingerprint = '')", lastID).
+			Order("id").Limit(backfillBatch).Find(&tracks).Error
+		if err != nil {
+			return result, fmt.Errorf("failed to load tracks to fingerprint: %w", err)
+		}
+		if len(tracks) == 0 {
+			return result, nil
+		}
+
+		for i := range tracks {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			lastID = tracks[i].ID
+			if err := s.backfillTrack(ctx, &tracks[i]); err != nil {
+				result.Failed++
+				continue
+			}
+			result.Fingerprinted++
+		}
+	}
+}
+
+func (s *Service) backfillTrack(ctx context.Context, track *models.Track) error {
+	path, err := s.paths.TrackPath(track)
+	if err != nil {
+		return err
+	}
+	raw, err := s.FingerprintSegment(ctx, path,
+		time.Duration(track.StartOffset)*time.Millisecond, time.Duration(track.EndOffset)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	return Store(ctx, s.db, track.ID, raw)
+}
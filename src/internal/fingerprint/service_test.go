@@ -0,0 +1,157 @@
+package fingerprint
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+)
+
+func setupFingerprintTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE libraries (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, path TEXT, type TEXT)`,
+		`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`,
+		`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, library_id INTEGER, directory TEXT)`,
+		`CREATE TABLE tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			album_id INTEGER,
+			artist_id INTEGER,
+			library_id INTEGER,
+			relative_path TEXT,
+			directory TEXT,
+			file_name TEXT,
+			duration INTEGER,
+			start_offset INTEGER DEFAULT 0,
+			end_offset INTEGER DEFAULT 0,
+			bit_rate INTEGER,
+			bit_depth INTEGER,
+			sample_rate INTEGER,
+			channels INTEGER,
+			fingerprint TEXT
+		)`,
+		`CREATE TABLE fingerprint_hashes (
+			hash INTEGER NOT NULL,
+			track_id INTEGER NOT NULL,
+			PRIMARY KEY (hash, track_id)
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO libraries (id, name, path, type) VALUES (1, 'Production', '/music', 'production')`)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Artist')`)
+	db.Exec(`INSERT INTO albums (id, name, library_id) VALUES (1, 'Album', 1), (2, 'Album (Remaster)', 1)`)
+	return db
+}
+
+// addTrack stores a track whose audio is melody(seed)
+func addTrack(t *testing.T, db *gorm.DB, id int64, albumID int64, fileName string, bitRate, bitDepth int, seed int64) {
+	t.Helper()
+	require.NoError(t, db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, library_id, relative_path, file_name, bit_rate, bit_depth, sample_rate, channels)
+		VALUES (?, ?, ?, 1, 1, ?, ?, ?, ?, 44100, 2)`,
+		id, fmt.Sprintf("Song %d", seed), albumID, filepath.Join("a", fileName), fileName, bitRate, bitDepth).Error)
+}
+
+func newTestService(db *gorm.DB) *Service {
+	s := NewService(db, "ffmpeg", config.FingerprintConfig{Enabled: true, Length: 2 * time.Minute, Threshold: 0.85})
+	// Each test file's name picks the melody it plays, e.g. "seed-3.flac"
+	s.decode = func(ctx context.Context, path string, start, end time.Duration) ([]int16, error) {
+		var seed int64
+		if _, err := fmt.Sscanf(filepath.Base(path), "seed-%d", &seed); err != nil {
+			return nil, fmt.Errorf("cannot decode %s", path)
+		}
+		return melody(seed, 20, 1), nil
+	}
+	return s
+}
+
+func TestService_BackfillAndMatch(t *testing.T) {
+	ctx := context.Background()
+	db := setupFingerprintTestDB(t)
+	service := newTestService(db)
+
+	addTrack(t, db, 1, 1, "seed-1.flac", 900, 16, 1)
+	addTrack(t, db, 2, 1, "seed-2.flac", 900, 16, 2)
+	addTrack(t, db, 3, 1, "broken.flac", 900, 16, 3)
+
+	result, err := service.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Fingerprinted: 2, Failed: 1}, result)
+
+	var hashes int64
+	db.Table("fingerprint_hashes").Where("track_id = ?", 1).Count(&hashes)
+	assert.Positive(t, hashes)
+
+	// A quieter copy of the first song matches it and nothing else
+	matches, err := service.Match(ctx, Calculate(melody(1, 20, 0.6)))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, int64(1), matches[0].TrackID)
+	assert.Equal(t, "Album", matches[0].AlbumName)
+	assert.Equal(t, "Artist", matches[0].ArtistName)
+	assert.Greater(t, matches[0].Similarity, 0.85)
+
+	matches, err = service.Match(ctx, Calculate(melody(9, 20, 1)))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	// Already fingerprinted tracks are left alone
+	result, err = service.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Failed: 1}, result)
+}
+
+func TestService_Duplicates(t *testing.T) {
+	ctx := context.Background()
+	db := setupFingerprintTestDB(t)
+	service := newTestService(db)
+
+	addTrack(t, db, 1, 1, "seed-1.mp3", 320, 0, 1)
+	addTrack(t, db, 2, 2, "seed-1.flac", 1000, 16, 1)
+	addTrack(t, db, 3, 2, "seed-1.m4a", 256, 0, 1)
+	addTrack(t, db, 4, 1, "seed-2.mp3", 320, 0, 2)
+	addTrack(t, db, 5, 2, "seed-5.mp3", 320, 0, 5)
+
+	for _, id := range []int64{1, 2, 3, 4, 5} {
+		var fileName string
+		db.Table("tracks").Where("id = ?", id).Pluck("file_name", &fileName)
+		raw, err := service.FingerprintFile(ctx, fileName)
+		require.NoError(t, err)
+		require.NoError(t, Store(ctx, db, id, raw))
+	}
+
+	clusters, err := service.Duplicates(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, clusters, 1)
+
+	cluster := clusters[0]
+	assert.Equal(t, int64(2), cluster.PreferredTrackID)
+	require.Len(t, cluster.Tracks, 3)
+	assert.Equal(t, []int64{2, 1, 3}, []int64{cluster.Tracks[0].TrackID, cluster.Tracks[1].TrackID, cluster.Tracks[2].TrackID})
+	assert.True(t, cluster.Tracks[0].Lossless)
+	assert.Equal(t, "flac", cluster.Tracks[0].Format)
+	assert.Equal(t, "/music/a/seed-1.flac", cluster.Tracks[0].Path)
+	assert.Equal(t, 1.0, cluster.Tracks[0].Similarity)
+	assert.Equal(t, "Album (Remaster)", cluster.Tracks[0].AlbumName)
+
+	// Storing a fingerprint again replaces its hashes
+	raw, err := service.FingerprintFile(ctx, "seed-6.mp3")
+	require.NoError(t, err)
+	require.NoError(t, Store(ctx, db, 3, raw))
+	clusters, err = service.Duplicates(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, clusters, 1)
+	assert.Len(t, clusters[0].Tracks, 2)
+}
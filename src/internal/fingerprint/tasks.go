@@ -0,0 +1,57 @@
+package fingerprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypeFingerprintBackfill = "fingerprint:backfill"
+)
+
+// NewBackfillTask creates a task that fingerprints tracks without a fingerprint
+func NewBackfillTask() *asynq.Task {
+	return asynq.NewTask(TypeFingerprintBackfill, nil)
+}
+
+// EnqueueBackfill creates and enqueues a fingerprint backfill
+func EnqueueBackfill(client *asynq.Client) error {
+	// One backfill at a time: one requested while another is queued or running is dropped
+	_, err := client.Enqueue(NewBackfillTask(),
+		asynq.TaskID("fingerprint.backfill"),
+		asynq.Queue("maintenance"),
+		asynq.Timeout(12*time.Hour),
+	)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue fingerprint backfill: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs fingerprint jobs
+type TaskHandler struct {
+	service *Service
+}
+
+// NewTaskHandler creates a new fingerprint task handler
+func NewTaskHandler(service *Service) *TaskHandler {
+	return &TaskHandler{service: service}
+}
+
+// HandleBackfill fingerprints the tracks that have no fingerprint yet
+func (h *TaskHandler) HandleBackfill(ctx context.Context, t *asynq.Task) error {
+	started := time.Now()
+	result, err := h.service.Backfill(ctx)
+	if err != nil {
+		return err
+	}
+	logging.Infof("fingerprint: fingerprinted %d tracks, %d could not be decoded, in %s",
+		result.Fingerprinted, result.Failed, time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"melodee/internal/models"
 	"melodee/internal/pagination"
 	"melodee/internal/services"
+	"melodee/internal/similarity"
 	"melodee/internal/utils"
 )
 
@@ -242,4 +243,32 @@ func (h *ArtistsV1Handler) GetArtistSongs(c *fiber.Ctx) error {
 		"data":       songs,
 		"meta":       paginationMeta, // Using 'meta' to match OpenAPI spec
 	})
-}
\ No newline at end of file
+}
+// GetInstantMix handles building a mix of tracks by an artist and its similar artists
+func (h *ArtistsV1Handler) GetInstantMix(c *fiber.Ctx) error {
+	// Check authentication
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	artistID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid artist ID")
+	}
+
+	if _, err := h.repo.GetArtistByID(artistID); err != nil {
+		return utils.SendNotFoundError(c, "Artist")
+	}
+
+	count := instantMixCount(c)
+	tracks, err := similarity.NewService(h.repo.GetDB()).ArtistMix(c.Context(), artistID, currentUser.ID, count)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to build instant mix")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": tracks,
+		"meta": pagination.Calculate(int64(len(tracks)), 1, count),
+	})
+}
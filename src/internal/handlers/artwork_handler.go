@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"melodee/internal/artwork"
+	"melodee/internal/models"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// ArtworkHandler lets admins view and replace the images of albums and artists
+type ArtworkHandler struct {
+	repo    *services.Repository
+	service *artwork.Service
+}
+
+// NewArtworkHandler creates a new artwork handler
+func NewArtworkHandler(repo *services.Repository, service *artwork.Service) *ArtworkHandler {
+	return &ArtworkHandler{
+		repo:    repo,
+		service: service,
+	}
+}
+
+// GetAlbumImages returns the images of an album, the primary image first
+// GET /api/admin/albums/:id/images
+func (h *ArtworkHandler) GetAlbumImages(c *fiber.Ctx) error {
+	album, ok := h.loadAlbum(c)
+	if !ok {
+		return nil
+	}
+	return h.sendImages(c, "album_id = ?", album.ID)
+}
+
+// PutAlbumImage stores an uploaded front, back or disc image of an album,
+// replacing the one of the same type, or of the same disc. A front image
+// becomes the album's cover.
+// PUT /api/admin/albums/:id/images/:type
+func (h *ArtworkHandler) PutAlbumImage(c *fiber.Ctx) error {
+	imageType := c.Params("type")
+	switch imageType {
+	case models.ImageTypeFront, models.ImageTypeBack, models.ImageTypeDisc:
+	default:
+		return utils.SendError(c, http.StatusBadRequest, "Image type must be front, back or disc")
+	}
+	disc := 0
+	if value := c.FormValue("disc"); value != "" {
+		var err error
+		if disc, err = strconv.Atoi(value); err != nil || disc < 1 || imageType != models.ImageTypeDisc {
+			return utils.SendError(c, http.StatusBadRequest, "Invalid disc number")
+		}
+	}
+
+	album, ok := h.loadAlbum(c)
+	if !ok {
+		return nil
+	}
+	data, ok := readImageUpload(c)
+	if !ok {
+		return nil
+	}
+
+	image, err := h.service.SaveAlbumImage(c.UserContext(), album, imageType, disc, data)
+	if err != nil {
+		return sendImageSaveError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"data": image,
+	})
+}
+
+// GetArtistImages returns the images of an artist
+// GET /api/admin/artists/:id/images
+func (h *ArtworkHandler) GetArtistImages(c *fiber.Ctx) error {
+	artist, ok := h.loadArtist(c)
+	if !ok {
+		return nil
+	}
+	return h.sendImages(c, "artist_id = ?", artist.ID)
+}
+
+// PutArtistImage stores an uploaded artist image, replacing the artist's
+// primary image
+// PUT /api/admin/artists/:id/image
+func (h *ArtworkHandler) PutArtistImage(c *fiber.Ctx) error {
+	artist, ok := h.loadArtist(c)
+	if !ok {
+		return nil
+	}
+	data, ok := readImageUpload(c)
+	if !ok {
+		return nil
+	}
+
+	image, err := h.service.SaveArtistImage(c.UserContext(), artist, data)
+	if err != nil {
+		return sendImageSaveError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"data": image,
+	})
+}
+
+func (h *ArtworkHandler) sendImages(c *fiber.Ctx, query string, id int64) error {
+	var images []models.Image
+	if err := h.repo.GetDB().Where(query, id).Order("is_primary DESC, type, file_name").Find(&images).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to load images")
+	}
+	return c.JSON(fiber.Map{
+		"data": images,
+	})
+}
+
+// loadAlbum loads the album named in the path, with its artist, sending an
+// error response when it can't
+func (h *ArtworkHandler) loadAlbum(c *fiber.Ctx) (*models.Album, bool) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid album ID")
+		return nil, false
+	}
+
+	var album models.Album
+	if err := h.repo.GetDB().Preload("Artist").First(&album, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.SendNotFoundError(c, "Album")
+		} else {
+			utils.SendInternalServerError(c, "Failed to load album")
+		}
+		return nil, false
+	}
+	return &album, true
+}
+
+// loadArtist loads the artist named in the path, sending an error response
+// when it can't
+func (h *ArtworkHandler) loadArtist(c *fiber.Ctx) (*models.Artist, bool) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid artist ID")
+		return nil, false
+	}
+
+	var artist models.Artist
+	if err := h.repo.GetDB().First(&artist, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.SendNotFoundError(c, "Artist")
+		} else {
+			utils.SendInternalServerError(c, "Failed to load artist")
+		}
+		return nil, false
+	}
+	return &artist, true
+}
+
+// readImageUpload reads the image uploaded as "file", sending an error
+// response when it can't
+func readImageUpload(c *fiber.Ctx) ([]byte, bool) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "No file provided or invalid form data")
+		return nil, false
+	}
+	if file.Size > maxArtworkSize {
+		utils.SendError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File size too large, maximum %d bytes allowed", maxArtworkSize))
+		return nil, false
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		utils.SendInternalServerError(c, "Failed to open uploaded file")
+		return nil, false
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		utils.SendInternalServerError(c, "Failed to read uploaded file")
+		return nil, false
+	}
+	return data, true
+}
+
+func sendImageSaveError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, artwork.ErrUnsupportedImage) {
+		return utils.SendError(c, http.StatusUnsupportedMediaType, err.Error())
+	}
+	return utils.SendInternalServerError(c, "Failed to save image")
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"melodee/internal/config"
+	"melodee/internal/fingerprint"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+)
+
+const (
+	defaultDuplicatesLimit = 50
+	maxDuplicatesLimit     = 500
+)
+
+// FingerprintHandler reports duplicate recordings found by acoustic fingerprint
+type FingerprintHandler struct {
+	service     *fingerprint.Service
+	asynqClient *asynq.Client
+}
+
+// NewFingerprintHandler creates a new fingerprint handler
+func NewFingerprintHandler(repo *services.Repository, ffmpegPath string, cfg config.FingerprintConfig, asynqClient *asynq.Client) *FingerprintHandler {
+	return &FingerprintHandler{
+		service:     fingerprint.NewService(repo.GetDB(), ffmpegPath, cfg),
+		asynqClient: asynqClient,
+	}
+}
+
+// GetDuplicates returns clusters of tracks across the libraries that are the
+// same recording, each listing its copies best quality first
+// GET /api/admin/duplicates
+func (h *FingerprintHandler) GetDuplicates(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", defaultDuplicatesLimit)
+	if limit < 1 {
+		limit = defaultDuplicatesLimit
+	}
+	if limit > maxDuplicatesLimit {
+		limit = maxDuplicatesLimit
+	}
+
+	clusters, err := h.service.Duplicates(c.Context(), limit)
+	if err != nil {
+		log.Printf("ERROR: Failed to find duplicate tracks: %v", err)
+		return utils.SendInternalServerError(c, "Failed to find duplicate tracks")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": clusters,
+	})
+}
+
+// BackfillFingerprints queues fingerprinting of the tracks that have none
+// POST /api/admin/fingerprints/backfill
+func (h *FingerprintHandler) BackfillFingerprints(c *fiber.Ctx) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+
+	if err := fingerprint.EnqueueBackfill(h.asynqClient); err != nil {
+		log.Printf("ERROR: Failed to enqueue fingerprint backfill: %v", err)
+		return utils.SendInternalServerError(c, "Failed to enqueue fingerprint backfill")
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status": "queued",
+	})
+}
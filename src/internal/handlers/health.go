@@ -6,6 +6,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"melodee/internal/database"
+	"melodee/internal/watcher"
 )
 
 // HealthStatus represents the overall health status response
@@ -13,6 +14,8 @@ type HealthStatus struct {
 	Status string                 `json:"status"`
 	DB     DependencyHealthStatus `json:"db"`
 	Redis  DependencyHealthStatus `json:"redis"`
+	// Watcher is only reported by the file watcher service
+	Watcher *watcher.Status `json:"watcher,omitempty"`
 }
 
 // DependencyHealthStatus represents the health status of a dependency
@@ -25,6 +28,7 @@ type DependencyHealthStatus struct {
 // HealthHandler handles health check requests
 type HealthHandler struct {
 	dbManager *database.DatabaseManager
+	watcher   *watcher.Watcher
 }
 
 // NewHealthHandler creates a new health handler
@@ -34,6 +38,12 @@ func NewHealthHandler(dbManager *database.DatabaseManager) *HealthHandler {
 	}
 }
 
+// WithWatcher adds the file watcher's status to the health check
+func (h *HealthHandler) WithWatcher(w *watcher.Watcher) *HealthHandler {
+	h.watcher = w
+	return h
+}
+
 // HealthCheck handles the health check endpoint at /healthz
 func (h *HealthHandler) HealthCheck(c *fiber.Ctx) error {
 	var healthStatus HealthStatus
@@ -59,6 +69,15 @@ func (h *HealthHandler) HealthCheck(c *fiber.Ctx) error {
 	} else {
 		healthStatus.Status = "error"
 	}
+
+	// A watcher that cannot watch a library or queue scans degrades the service
+	if h.watcher != nil {
+		watcherStatus := h.watcher.Status()
+		healthStatus.Watcher = &watcherStatus
+		if healthStatus.Status == "ok" && watcherStatus.Status == watcher.StatusDegraded {
+			healthStatus.Status = "degraded"
+		}
+	}
 	
 	// Set appropriate HTTP status code
 	httpStatus := http.StatusOK
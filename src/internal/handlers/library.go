@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -38,10 +39,11 @@ func NewLibraryHandler(repo *services.Repository, mediaSvc *media.MediaService,
 type LibraryState struct {
 	ID              int32            `json:"id"`
 	Name            string           `json:"name"`
-	Type            string           `json:"type"` // inbound, staging, production
+	Type            string           `json:"type"` // inbound, staging, production, podcast
 	Path            string           `json:"path"`
 	ItemCount       int64            `json:"item_count"`
 	IsLocked        bool             `json:"is_locked"`
+	IsWatched       bool             `json:"is_watched"`
 	InboundCount    int32            `json:"inbound_count"`
 	StagingCount    int32            `json:"staging_count"`
 	ProductionCount int32            `json:"production_count"`
@@ -112,6 +114,7 @@ func (h *LibraryHandler) GetLibraryStates(c *fiber.Ctx) error {
 			Type:            lib.Type,
 			Path:            lib.Path,
 			IsLocked:        lib.IsLocked,
+			IsWatched:       lib.IsWatched,
 			TrackCount:      lib.TrackCount,
 			AlbumCount:      lib.AlbumCount,
 			Duration:        lib.Duration,
@@ -163,6 +166,7 @@ func (h *LibraryHandler) GetLibraryState(c *fiber.Ctx) error {
 		Type:            library.Type,
 		Path:            library.Path,
 		IsLocked:        library.IsLocked,
+		IsWatched:       library.IsWatched,
 		TrackCount:      library.TrackCount,
 		AlbumCount:      library.AlbumCount,
 		Duration:        library.Duration,
@@ -276,28 +280,61 @@ func (h *LibraryHandler) TriggerLibraryProcess(c *fiber.Ctx) error {
 	})
 }
 
-// TriggerLibraryMoveOK handles triggering a library move from staging to production
+// TriggerLibraryMoveOK queues the promotion of every approved staging item to
+// production. Each album goes to the production library selected for its
+// artist, so the library in the path, if any, isn't used.
 func (h *LibraryHandler) TriggerLibraryMoveOK(c *fiber.Ctx) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+	if err := h.mediaSvc.EnqueueLibraryMoveOK(h.asynqClient, nil); err != nil {
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			return c.JSON(fiber.Map{
+				"status":  "already_queued",
+				"message": "Library move OK is already queued or in progress",
+			})
+		}
+		return utils.SendInternalServerError(c, "Failed to enqueue library move OK")
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "queued",
+		"message": "Library move OK processing started",
+	})
+}
+
+// SetLibraryWatched turns file watching on or off for a library. The watcher
+// service picks the change up on its next library refresh.
+// PUT /api/admin/libraries/:id/watch
+func (h *LibraryHandler) SetLibraryWatched(c *fiber.Ctx) error {
 	libraryID, err := c.ParamsInt("id")
 	if err != nil {
 		return utils.SendError(c, http.StatusBadRequest, "Invalid library ID")
 	}
 
-	// Check if library exists
-	var library models.Library
-	if err := h.repo.GetDB().First(&library, libraryID).Error; err != nil {
+	var req struct {
+		IsWatched *bool `json:"is_watched"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.IsWatched == nil {
+		return utils.SendError(c, http.StatusBadRequest, "is_watched is required")
+	}
+
+	library, err := h.repo.GetLibraryByID(int32(libraryID))
+	if err != nil {
 		return utils.SendNotFoundError(c, "Library")
 	}
+	if library.Type == "podcast" && *req.IsWatched {
+		return utils.SendError(c, http.StatusBadRequest, "Podcast libraries cannot be watched")
+	}
 
-	// Note: In a real implementation, this would move all 'OK' status albums from staging to production
-	// For now, we'll just return success as the actual implementation would require
-	// more complex logic to find and move specific albums
-	// The proper way would be to query for albums in staging with 'OK' status and trigger individual moves
+	if err := h.repo.GetDB().Model(&models.Library{}).Where("id = ?", library.ID).
+		Update("is_watched", *req.IsWatched).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to update library")
+	}
 
 	return c.JSON(fiber.Map{
-		"status":     "processed",
-		"library_id": libraryID,
-		"message":    "Library move OK processing started",
+		"library_id": library.ID,
+		"is_watched": *req.IsWatched,
 	})
 }
 
@@ -393,11 +430,11 @@ func (h *LibraryHandler) getLibraryItemCount(libraryID int32, statusType string)
 			count = 0
 		}
 	case "production":
-		// For production libraries: count all albums in production path
+		// For production libraries: count all albums stored in the library
 		// No status field needed - if it's in production, it's ready
 		if statusType == "production" {
 			err = h.repo.GetDB().Model(&models.Album{}).
-				Where("directory LIKE ?", library.Path+"%").
+				Where("library_id = ?", library.ID).
 				Count(&count).Error
 		} else {
 			count = 0
@@ -498,8 +535,8 @@ func (h *LibraryHandler) CreateLibrary(c *fiber.Ctx) error {
 	}
 
 	// Validate library type
-	if req.Type != "inbound" && req.Type != "staging" && req.Type != "production" {
-		return utils.SendError(c, http.StatusBadRequest, "Library type must be 'inbound', 'staging', or 'production'")
+	if req.Type != "inbound" && req.Type != "staging" && req.Type != "production" && req.Type != "podcast" {
+		return utils.SendError(c, http.StatusBadRequest, "Library type must be 'inbound', 'staging', 'production', or 'podcast'")
 	}
 
 	library := &models.Library{
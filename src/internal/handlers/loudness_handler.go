@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"melodee/internal/loudness"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+)
+
+// LoudnessHandler handles loudness analysis administration
+type LoudnessHandler struct {
+	asynqClient *asynq.Client
+}
+
+// NewLoudnessHandler creates a new loudness handler
+func NewLoudnessHandler(asynqClient *asynq.Client) *LoudnessHandler {
+	return &LoudnessHandler{
+		asynqClient: asynqClient,
+	}
+}
+
+// AnalyzeLoudnessRequest is the optional body of an analysis request
+type AnalyzeLoudnessRequest struct {
+	AlbumIDs []int64 `json:"album_ids"`
+}
+
+// AnalyzeLoudness queues loudness analysis of the given albums, or of every
+// track without ReplayGain values when none are given
+// POST /api/admin/loudness/analyze
+func (h *LoudnessHandler) AnalyzeLoudness(c *fiber.Ctx) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+
+	var req AnalyzeLoudnessRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+		}
+	}
+	for _, albumID := range req.AlbumIDs {
+		if albumID <= 0 {
+			return utils.SendError(c, http.StatusBadRequest, "Invalid album ID")
+		}
+	}
+
+	if err := loudness.EnqueueAnalyze(h.asynqClient, req.AlbumIDs); err != nil {
+		log.Printf("ERROR: Failed to enqueue loudness analysis: %v", err)
+		return utils.SendInternalServerError(c, "Failed to enqueue loudness analysis")
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status": "queued",
+	})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"melodee/internal/lyrics"
+	"melodee/internal/models"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// LyricsHandler lets admins view and edit the lyrics of a track
+type LyricsHandler struct {
+	repo    *services.Repository
+	service *lyrics.Service
+}
+
+// NewLyricsHandler creates a new lyrics handler
+func NewLyricsHandler(repo *services.Repository) *LyricsHandler {
+	return &LyricsHandler{
+		repo:    repo,
+		service: lyrics.NewService(repo.GetDB()),
+	}
+}
+
+// LyricsRequest is an edit of a track's lyrics. Text is LRC or plain text;
+// Lang, when set, overrides any [la:] tag in it.
+type LyricsRequest struct {
+	Lang string `json:"lang"`
+	Text string `json:"text"`
+}
+
+// LyricsResponse is a stored set of lyrics with its text for editing
+type LyricsResponse struct {
+	ID            int64         `json:"id"`
+	Lang          string        `json:"lang"`
+	Synced        bool          `json:"synced"`
+	Offset        int64         `json:"offset"`
+	DisplayArtist string        `json:"display_artist,omitempty"`
+	DisplayTitle  string        `json:"display_title,omitempty"`
+	Source        string        `json:"source"`
+	Lines         []lyrics.Line `json:"lines"`
+	Text          string        `json:"text"`
+}
+
+// GetTrackLyrics returns every set of lyrics of a track
+// GET /api/admin/tracks/:id/lyrics
+func (h *LyricsHandler) GetTrackLyrics(c *fiber.Ctx) error {
+	trackID, ok := h.trackID(c)
+	if !ok {
+		return nil
+	}
+
+	records, err := h.service.ForTrack(c.Context(), trackID)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to load lyrics")
+	}
+
+	data := make([]LyricsResponse, 0, len(records))
+	for _, record := range records {
+		response, err := lyricsResponse(record)
+		if err != nil {
+			return utils.SendInternalServerError(c, "Failed to decode lyrics")
+		}
+		data = append(data, response)
+	}
+
+	return c.JSON(fiber.Map{
+		"data": data,
+	})
+}
+
+// PutTrackLyrics stores lyrics for a track from a JSON body or an uploaded
+// .lrc or .txt file, replacing those of the same language and kind
+// PUT /api/admin/tracks/:id/lyrics
+func (h *LyricsHandler) PutTrackLyrics(c *fiber.Ctx) error {
+	trackID, ok := h.trackID(c)
+	if !ok {
+		return nil
+	}
+
+	var req LyricsRequest
+	if file, err := c.FormFile("file"); err == nil {
+		if file.Size > lyrics.MaxSize {
+			return utils.SendError(c, http.StatusRequestEntityTooLarge, "Lyrics file too large")
+		}
+		src, err := file.Open()
+		if err != nil {
+			return utils.SendError(c, http.StatusBadRequest, "Failed to read uploaded file")
+		}
+		defer src.Close()
+
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return utils.SendError(c, http.StatusBadRequest, "Failed to read uploaded file")
+		}
+		req.Text = lyrics.DecodeText(data)
+		req.Lang = c.FormValue("lang")
+	} else if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	parsed := lyrics.Parse(req.Text)
+	if len(parsed.Lines) == 0 {
+		return utils.SendError(c, http.StatusBadRequest, "Lyrics have no lines")
+	}
+	if strings.TrimSpace(req.Lang) != "" {
+		parsed.Lang = lyrics.NormalizeLanguage(req.Lang)
+	}
+
+	record, err := h.service.Save(c.Context(), trackID, parsed, lyrics.SourceManual)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to save lyrics")
+	}
+
+	response, err := lyricsResponse(*record)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to decode lyrics")
+	}
+	return c.JSON(fiber.Map{
+		"data": response,
+	})
+}
+
+// DeleteTrackLyrics removes one set of a track's lyrics
+// DELETE /api/admin/tracks/:id/lyrics/:lyricsId
+func (h *LyricsHandler) DeleteTrackLyrics(c *fiber.Ctx) error {
+	trackID, ok := h.trackID(c)
+	if !ok {
+		return nil
+	}
+
+	lyricsID, err := c.ParamsInt("lyricsId")
+	if err != nil || lyricsID <= 0 {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid lyrics ID")
+	}
+
+	if err := h.service.Delete(c.Context(), trackID, int64(lyricsID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return utils.SendNotFoundError(c, "Lyrics")
+		}
+		return utils.SendInternalServerError(c, "Failed to delete lyrics")
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "deleted",
+	})
+}
+
+// trackID reads the track ID parameter and checks the track exists,
+// sending the error response when it doesn't
+func (h *LyricsHandler) trackID(c *fiber.Ctx) (int64, bool) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		_ = utils.SendError(c, http.StatusBadRequest, "Invalid track ID")
+		return 0, false
+	}
+
+	var count int64
+	if err := h.repo.GetDB().Model(&models.Track{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		_ = utils.SendInternalServerError(c, "Failed to load track")
+		return 0, false
+	}
+	if count == 0 {
+		_ = utils.SendNotFoundError(c, "Track")
+		return 0, false
+	}
+	return int64(id), true
+}
+
+func lyricsResponse(record models.Lyrics) (LyricsResponse, error) {
+	decoded, err := lyrics.Decode(record)
+	if err != nil {
+		return LyricsResponse{}, err
+	}
+	return LyricsResponse{
+		ID:            record.ID,
+		Lang:          record.Lang,
+		Synced:        record.Synced,
+		Offset:        record.Offset,
+		DisplayArtist: record.DisplayArtist,
+		DisplayTitle:  record.DisplayTitle,
+		Source:        record.Source,
+		Lines:         decoded.Lines,
+		Text:          lyrics.Format(decoded),
+	}, nil
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"melodee/internal/config"
+	"melodee/internal/enrichment"
+	"melodee/internal/models"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+)
+
+// MetadataHandler handles enrichment of artists and albums from external providers
+type MetadataHandler struct {
+	repo        *services.Repository
+	service     *enrichment.Service
+	asynqClient *asynq.Client
+}
+
+// NewMetadataHandler creates a new metadata handler
+func NewMetadataHandler(repo *services.Repository, cfg config.MetadataConfig, asynqClient *asynq.Client) *MetadataHandler {
+	return &MetadataHandler{
+		repo:        repo,
+		service:     enrichment.NewService(repo.GetDB(), cfg),
+		asynqClient: asynqClient,
+	}
+}
+
+// EnrichRequest names the providers to ask; all enabled ones when empty
+type EnrichRequest struct {
+	Sources []string `json:"sources"`
+}
+
+// EnrichArtist queues enrichment of an artist
+// POST /api/admin/metadata/artists/:id/enrich
+func (h *MetadataHandler) EnrichArtist(c *fiber.Ctx) error {
+	return h.enrich(c, enrichment.EntityArtist, &models.Artist{}, enrichment.EnqueueArtist)
+}
+
+// EnrichAlbum queues enrichment of an album and its artist
+// POST /api/admin/metadata/albums/:id/enrich
+func (h *MetadataHandler) EnrichAlbum(c *fiber.Ctx) error {
+	return h.enrich(c, enrichment.EntityAlbum, &models.Album{}, enrichment.EnqueueAlbum)
+}
+
+// GetArtistProvenance returns which provider set each field of an artist
+// GET /api/admin/metadata/artists/:id/provenance
+func (h *MetadataHandler) GetArtistProvenance(c *fiber.Ctx) error {
+	return h.provenance(c, enrichment.EntityArtist, &models.Artist{})
+}
+
+// GetAlbumProvenance returns which provider set each field of an album
+// GET /api/admin/metadata/albums/:id/provenance
+func (h *MetadataHandler) GetAlbumProvenance(c *fiber.Ctx) error {
+	return h.provenance(c, enrichment.EntityAlbum, &models.Album{})
+}
+
+func (h *MetadataHandler) enrich(c *fiber.Ctx, entityType string, model interface{}, enqueue func(*asynq.Client, int64, []string) error) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+
+	id, ok := h.entityID(c, entityType, model)
+	if !ok {
+		return nil
+	}
+
+	var req EnrichRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+		}
+	}
+	for _, source := range req.Sources {
+		if !h.enabled(source) {
+			return utils.SendError(c, http.StatusBadRequest, "Unknown or disabled metadata provider: "+source)
+		}
+	}
+
+	if err := enqueue(h.asynqClient, id, req.Sources); err != nil {
+		log.Printf("ERROR: Failed to enqueue metadata enrichment for %s %d: %v", entityType, id, err)
+		return utils.SendInternalServerError(c, "Failed to enqueue metadata enrichment")
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status":  "queued",
+		"id":      id,
+		"sources": req.Sources,
+	})
+}
+
+func (h *MetadataHandler) provenance(c *fiber.Ctx, entityType string, model interface{}) error {
+	id, ok := h.entityID(c, entityType, model)
+	if !ok {
+		return nil
+	}
+
+	records, err := h.service.Provenance(c.Context(), entityType, id)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to load metadata provenance")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": records,
+	})
+}
+
+// entityID reads the ID parameter and checks the artist or album exists,
+// sending the error response when it doesn't
+func (h *MetadataHandler) entityID(c *fiber.Ctx, entityType string, model interface{}) (int64, bool) {
+	name := strings.ToUpper(entityType[:1]) + entityType[1:]
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		_ = utils.SendError(c, http.StatusBadRequest, "Invalid "+entityType+" ID")
+		return 0, false
+	}
+
+	var count int64
+	if err := h.repo.GetDB().Model(model).Where("id = ?", id).Count(&count).Error; err != nil {
+		_ = utils.SendInternalServerError(c, "Failed to load "+entityType)
+		return 0, false
+	}
+	if count == 0 {
+		_ = utils.SendNotFoundError(c, name)
+		return 0, false
+	}
+	return int64(id), true
+}
+
+func (h *MetadataHandler) enabled(source string) bool {
+	for _, name := range h.service.Providers() {
+		if strings.EqualFold(source, name) {
+			return true
+		}
+	}
+	return false
+}
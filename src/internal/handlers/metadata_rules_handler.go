@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"melodee/internal/metadatarules"
+	"melodee/internal/models"
+	"melodee/internal/scanner"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// MetadataRulesHandler lets admins manage the metadata rules applied during
+// inbound processing and try them against a scan
+type MetadataRulesHandler struct {
+	repo           *services.Repository
+	scanDBDataPath string
+}
+
+// NewMetadataRulesHandler creates a new metadata rules handler. Scans are
+// looked up in scanDBDataPath for dry runs.
+func NewMetadataRulesHandler(repo *services.Repository, scanDBDataPath string) *MetadataRulesHandler {
+	return &MetadataRulesHandler{repo: repo, scanDBDataPath: scanDBDataPath}
+}
+
+// MetadataRuleRequest creates or replaces a rule. Enabled defaults to true.
+type MetadataRuleRequest struct {
+	Name        string `json:"name"`
+	Field       string `json:"field"`
+	Pattern     string `json:"pattern"`
+	Action      string `json:"action"`
+	Replacement string `json:"replacement"`
+	LibraryID   *int32 `json:"library_id"`
+	ArtistName  string `json:"artist_name"`
+	Position    int32  `json:"position"`
+	Enabled     *bool  `json:"enabled"`
+}
+
+// DryRunRequest names the scan to try rules against. Rules, when given, are
+// tried instead of the stored ones; LibraryID defaults to the inbound library.
+type DryRunRequest struct {
+	ScanID    string                `json:"scan_id"`
+	LibraryID *int32                `json:"library_id"`
+	Rules     []MetadataRuleRequest `json:"rules"`
+}
+
+// GetMetadataRules returns every rule in the order they run
+// GET /api/admin/metadata-rules
+func (h *MetadataRulesHandler) GetMetadataRules(c *fiber.Ctx) error {
+	var rules []models.MetadataRule
+	if err := h.repo.GetDB().Order("position, id").Find(&rules).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to load metadata rules")
+	}
+	return c.JSON(fiber.Map{
+		"data": rules,
+	})
+}
+
+// CreateMetadataRule adds a rule
+// POST /api/admin/metadata-rules
+func (h *MetadataRulesHandler) CreateMetadataRule(c *fiber.Ctx) error {
+	var req MetadataRuleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	rule := req.rule()
+	if err := metadatarules.Validate(rule); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+	if err := h.repo.GetDB().Create(&rule).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to create metadata rule")
+	}
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"data": rule,
+	})
+}
+
+// UpdateMetadataRule replaces a rule
+// PUT /api/admin/metadata-rules/:id
+func (h *MetadataRulesHandler) UpdateMetadataRule(c *fiber.Ctx) error {
+	existing, ok := h.loadRule(c)
+	if !ok {
+		return nil
+	}
+
+	var req MetadataRuleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	rule := req.rule()
+	rule.ID = existing.ID
+	rule.CreatedAt = existing.CreatedAt
+	if err := metadatarules.Validate(rule); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+	if err := h.repo.GetDB().Save(&rule).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to update metadata rule")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": rule,
+	})
+}
+
+// DeleteMetadataRule removes a rule
+// DELETE /api/admin/metadata-rules/:id
+func (h *MetadataRulesHandler) DeleteMetadataRule(c *fiber.Ctx) error {
+	rule, ok := h.loadRule(c)
+	if !ok {
+		return nil
+	}
+
+	if err := h.repo.GetDB().Delete(rule).Error; err != nil {
+		return utils.SendInternalServerError(c, "Failed to delete metadata rule")
+	}
+	return c.JSON(fiber.Map{
+		"status": "deleted",
+	})
+}
+
+// DryRunMetadataRules returns what the rules would change in the albums of
+// a scan, without changing anything
+// POST /api/admin/metadata-rules/dry-run
+func (h *MetadataRulesHandler) DryRunMetadataRules(c *fiber.Ctx) error {
+	var req DryRunRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	// Scan IDs name files in the scan directory, so they can't be paths
+	if req.ScanID == "" || strings.ContainsAny(req.ScanID, `/\`) || strings.Contains(req.ScanID, "..") {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid scan_id")
+	}
+	scanPath := filepath.Join(h.scanDBDataPath, req.ScanID+".db")
+	if _, err := os.Stat(scanPath); err != nil {
+		return utils.SendNotFoundError(c, "Scan")
+	}
+
+	var engine *metadatarules.Engine
+	var err error
+	if req.Rules != nil {
+		rules := make([]models.MetadataRule, len(req.Rules))
+		for i, ruleReq := range req.Rules {
+			rules[i] = ruleReq.rule()
+		}
+		engine, err = metadatarules.NewEngine(rules)
+	} else {
+		engine, err = metadatarules.Load(c.Context(), h.repo.GetDB())
+	}
+	if err != nil {
+		if errors.Is(err, metadatarules.ErrInvalidRule) {
+			return utils.SendError(c, http.StatusBadRequest, err.Error())
+		}
+		return utils.SendInternalServerError(c, "Failed to load metadata rules")
+	}
+
+	var libraryID int32
+	if req.LibraryID != nil {
+		libraryID = *req.LibraryID
+	} else {
+		var inbound models.Library
+		err := h.repo.GetDB().Where("type = ?", "inbound").Order("id").First(&inbound).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return utils.SendInternalServerError(c, "Failed to find inbound library")
+		}
+		libraryID = inbound.ID
+	}
+
+	scanDB, err := scanner.OpenScanDB(scanPath)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to open scan")
+	}
+	defer scanDB.Close()
+
+	albums, err := engine.DryRun(scanDB, libraryID)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to apply metadata rules to scan")
+	}
+	return c.JSON(fiber.Map{
+		"data": albums,
+	})
+}
+
+// loadRule loads the rule named in the path, sending an error response when
+// it can't
+func (h *MetadataRulesHandler) loadRule(c *fiber.Ctx) (*models.MetadataRule, bool) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		utils.SendError(c, http.StatusBadRequest, "Invalid metadata rule ID")
+		return nil, false
+	}
+
+	var rule models.MetadataRule
+	if err := h.repo.GetDB().First(&rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.SendNotFoundError(c, "Metadata rule")
+		} else {
+			utils.SendInternalServerError(c, "Failed to load metadata rule")
+		}
+		return nil, false
+	}
+	return &rule, true
+}
+
+func (r MetadataRuleRequest) rule() models.MetadataRule {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+	return models.MetadataRule{
+		Name:        strings.TrimSpace(r.Name),
+		Field:       r.Field,
+		Pattern:     r.Pattern,
+		Action:      r.Action,
+		Replacement: r.Replacement,
+		LibraryID:   r.LibraryID,
+		ArtistName:  strings.TrimSpace(r.ArtistName),
+		Position:    r.Position,
+		Enabled:     enabled,
+	}
+}
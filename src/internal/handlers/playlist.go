@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
@@ -9,12 +12,14 @@ import (
 	"melodee/internal/models"
 	"melodee/internal/pagination"
 	"melodee/internal/services"
+	"melodee/internal/smartplaylist"
 	"melodee/internal/utils"
 )
 
 // PlaylistHandler handles playlist-related requests
 type PlaylistHandler struct {
-	repo *services.Repository
+	repo  *services.Repository
+	smart *smartplaylist.Service
 }
 
 // NewPlaylistHandler creates a new playlist handler
@@ -24,6 +29,12 @@ func NewPlaylistHandler(repo *services.Repository) *PlaylistHandler {
 	}
 }
 
+// WithSmartPlaylists enables creating and refreshing rule-based playlists
+func (h *PlaylistHandler) WithSmartPlaylists(smart *smartplaylist.Service) *PlaylistHandler {
+	h.smart = smart
+	return h
+}
+
 // GetPlaylists handles retrieving playlists
 func (h *PlaylistHandler) GetPlaylists(c *fiber.Ctx) error {
 	// Check authentication
@@ -88,6 +99,13 @@ func (h *PlaylistHandler) GetPlaylist(c *fiber.Ctx) error {
 		return utils.SendForbiddenError(c, "Access denied")
 	}
 
+	// Smart playlists are re-evaluated when their tracks are stale
+	if playlist.IsSmart() && h.smart != nil {
+		if err := h.smart.RefreshIfStale(c.Context(), playlist); err != nil {
+			log.Printf("ERROR: failed to refresh smart playlist %d: %v", playlist.ID, err)
+		}
+	}
+
 	return c.JSON(playlist)
 }
 
@@ -100,16 +118,25 @@ func (h *PlaylistHandler) CreatePlaylist(c *fiber.Ctx) error {
 	}
 
 	var req struct {
-		Name     string `json:"name"`
-		Comment  string `json:"comment"`
-		Public   bool   `json:"public"`
-		TrackIDs []int64 `json:"track_ids"`
+		Name     string          `json:"name"`
+		Comment  string          `json:"comment"`
+		Public   bool            `json:"public"`
+		TrackIDs []int64         `json:"track_ids"`
+		Rules    json.RawMessage `json:"rules"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
 		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
 	}
 
+	rules, err := h.validateRules(req.Rules)
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+	if rules != nil && len(req.TrackIDs) > 0 {
+		return utils.SendError(c, http.StatusBadRequest, "A playlist takes either rules or track_ids, not both")
+	}
+
 	// Create playlist
 	playlist := &models.Playlist{
 		UserID:    currentUser.ID,
@@ -118,12 +145,19 @@ func (h *PlaylistHandler) CreatePlaylist(c *fiber.Ctx) error {
 		Public:    req.Public,
 		CreatedAt: time.Now(),
 		ChangedAt: time.Now(),
+		Rules:     rules,
 	}
 
 	if err := h.repo.CreatePlaylist(playlist); err != nil {
 		return utils.SendInternalServerError(c, "Failed to create playlist")
 	}
 
+	if playlist.IsSmart() {
+		if err := h.smart.Refresh(c.Context(), playlist); err != nil {
+			return utils.SendInternalServerError(c, "Failed to evaluate smart playlist")
+		}
+	}
+
 	// Add tracks to the playlist if provided
 	if req.TrackIDs != nil && len(req.TrackIDs) > 0 {
 		for i, trackID := range req.TrackIDs {
@@ -161,10 +195,11 @@ func (h *PlaylistHandler) UpdatePlaylist(c *fiber.Ctx) error {
 	}
 
 	var req struct {
-		Name     *string `json:"name,omitempty"`
-		Comment  *string `json:"comment,omitempty"`
-		Public   *bool   `json:"public,omitempty"`
-		TrackIDs *[]int64 `json:"track_ids,omitempty"`
+		Name     *string         `json:"name,omitempty"`
+		Comment  *string         `json:"comment,omitempty"`
+		Public   *bool           `json:"public,omitempty"`
+		TrackIDs *[]int64        `json:"track_ids,omitempty"`
+		Rules    json.RawMessage `json:"rules,omitempty"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -181,7 +216,20 @@ func (h *PlaylistHandler) UpdatePlaylist(c *fiber.Ctx) error {
 		return utils.SendForbiddenError(c, "Access denied")
 	}
 
+	rules, err := h.validateRules(req.Rules)
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+	if req.TrackIDs != nil && (rules != nil || (playlist.IsSmart() && len(req.Rules) == 0)) {
+		return utils.SendError(c, http.StatusBadRequest, "The tracks of a smart playlist come from its rules")
+	}
+
 	// Update fields if provided
+	if len(req.Rules) > 0 {
+		// "rules": null turns a smart playlist back into a regular one that keeps its current tracks
+		playlist.Rules = rules
+		playlist.RefreshedAt = nil
+	}
 	if req.Name != nil {
 		playlist.Name = *req.Name
 	}
@@ -197,6 +245,12 @@ func (h *PlaylistHandler) UpdatePlaylist(c *fiber.Ctx) error {
 		return utils.SendInternalServerError(c, "Failed to update playlist")
 	}
 
+	if playlist.IsSmart() && playlist.RefreshedAt == nil {
+		if err := h.smart.Refresh(c.Context(), playlist); err != nil {
+			return utils.SendInternalServerError(c, "Failed to evaluate smart playlist")
+		}
+	}
+
 	// Update tracks in the playlist if provided
 	if req.TrackIDs != nil {
 		// First, clear existing tracks
@@ -256,4 +310,23 @@ func (h *PlaylistHandler) DeletePlaylist(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status": "deleted",
 	})
-}
\ No newline at end of file
+}
+
+// validateRules checks smart playlist rules from a request body. It returns
+// nil rules when none (or null) were sent.
+func (h *PlaylistHandler) validateRules(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if h.smart == nil {
+		return nil, errors.New("Smart playlists are not available")
+	}
+	rules, err := h.smart.Validate(raw)
+	if err != nil {
+		if errors.Is(err, smartplaylist.ErrInvalidRules) {
+			return nil, err
+		}
+		return nil, errors.New("Invalid smart playlist rules")
+	}
+	return rules, nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"melodee/internal/models"
+	"melodee/internal/releasegroup"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+)
+
+// ReleaseGroupHandler handles release group administration
+type ReleaseGroupHandler struct {
+	repo        *services.Repository
+	service     *releasegroup.Service
+	asynqClient *asynq.Client
+}
+
+// NewReleaseGroupHandler creates a new release group handler
+func NewReleaseGroupHandler(repo *services.Repository, asynqClient *asynq.Client) *ReleaseGroupHandler {
+	return &ReleaseGroupHandler{
+		repo:        repo,
+		service:     releasegroup.NewService(repo.GetDB()),
+		asynqClient: asynqClient,
+	}
+}
+
+// GetReleaseGroup returns a release group with its editions, primary first
+// GET /api/admin/release-groups/:id
+func (h *ReleaseGroupHandler) GetReleaseGroup(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid release group ID")
+	}
+
+	var group models.ReleaseGroup
+	if err := h.repo.GetDB().First(&group, id).Error; err != nil {
+		return utils.SendNotFoundError(c, "Release group")
+	}
+
+	editions, err := h.service.Editions(group.ID)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to load editions")
+	}
+
+	return c.JSON(fiber.Map{
+		"release_group": group,
+		"editions":      editions,
+	})
+}
+
+// RebuildReleaseGroups queues consolidation of one artist's editions, or of
+// every artist when no artist_id is given
+// POST /api/admin/release-groups/rebuild
+func (h *ReleaseGroupHandler) RebuildReleaseGroups(c *fiber.Ctx) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+
+	artistID := int64(c.QueryInt("artist_id", 0))
+	if artistID < 0 {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid artist ID")
+	}
+
+	if err := releasegroup.EnqueueConsolidate(h.asynqClient, artistID); err != nil {
+		log.Printf("ERROR: Failed to enqueue release group rebuild for artist %d: %v", artistID, err)
+		return utils.SendInternalServerError(c, "Failed to enqueue release group rebuild")
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status":    "queued",
+		"artist_id": artistID,
+	})
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"melodee/internal/config"
+	"melodee/internal/middleware"
+	"melodee/internal/scrobble"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ScrobblerHandler links users' Last.fm and ListenBrainz accounts
+type ScrobblerHandler struct {
+	repo    *services.Repository
+	service *scrobble.Service
+}
+
+// NewScrobblerHandler creates a new scrobbler handler
+func NewScrobblerHandler(repo *services.Repository, cfg config.ScrobbleConfig, serverKey string) *ScrobblerHandler {
+	return &ScrobblerHandler{
+		repo:    repo,
+		service: scrobble.NewService(repo.GetDB(), cfg, serverKey),
+	}
+}
+
+// LinkScrobblerRequest carries the Last.fm token returned to the callback URL
+// or the ListenBrainz user token
+type LinkScrobblerRequest struct {
+	Token string `json:"token"`
+}
+
+// GetScrobblers lists the configured services and the user's linked accounts
+// GET /api/users/:id/scrobblers
+func (h *ScrobblerHandler) GetScrobblers(c *fiber.Ctx) error {
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	// Allow access if user is admin or managing their own accounts
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	accounts, err := h.service.Accounts(c.Context(), int64(userID))
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to load scrobbler accounts")
+	}
+
+	return c.JSON(fiber.Map{
+		"services": h.service.Services(),
+		"data":     accounts,
+	})
+}
+
+// AuthorizeScrobbler returns the page where the user grants access to their
+// Last.fm account, which then redirects to callback with a token
+// GET /api/users/:id/scrobblers/:service/authorize?callback=...
+func (h *ScrobblerHandler) AuthorizeScrobbler(c *fiber.Ctx) error {
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	// Allow access if user is admin or managing their own accounts
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	url, err := h.service.AuthURL(c.Params("service"), c.Query("callback"))
+	if errors.Is(err, scrobble.ErrUnknownService) {
+		return utils.SendNotFoundError(c, "Scrobbling service")
+	}
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(fiber.Map{"url": url})
+}
+
+// LinkScrobbler exchanges a token for a session and links the account
+// PUT /api/users/:id/scrobblers/:service
+func (h *ScrobblerHandler) LinkScrobbler(c *fiber.Ctx) error {
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	// Allow access if user is admin or managing their own accounts
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	var req LinkScrobblerRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+	if req.Token == "" {
+		return utils.SendError(c, http.StatusBadRequest, "Token is required")
+	}
+
+	if _, err := h.repo.GetUserByID(int64(userID)); err != nil {
+		return utils.SendNotFoundError(c, "User")
+	}
+
+	account, err := h.service.Link(c.Context(), int64(userID), c.Params("service"), req.Token)
+	switch {
+	case errors.Is(err, scrobble.ErrUnknownService):
+		return utils.SendNotFoundError(c, "Scrobbling service")
+	case errors.Is(err, scrobble.ErrUnauthorized), errors.Is(err, scrobble.ErrRejected):
+		return utils.SendError(c, http.StatusBadRequest, "The service did not accept the token")
+	case err != nil:
+		return utils.SendError(c, http.StatusBadGateway, "Failed to link scrobbler account")
+	}
+
+	return c.JSON(account)
+}
+
+// UnlinkScrobbler removes a linked account and the plays queued for it
+// DELETE /api/users/:id/scrobblers/:service
+func (h *ScrobblerHandler) UnlinkScrobbler(c *fiber.Ctx) error {
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	// Allow access if user is admin or managing their own accounts
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	err = h.service.Unlink(c.Context(), int64(userID), c.Params("service"))
+	if errors.Is(err, scrobble.ErrNotLinked) {
+		return utils.SendNotFoundError(c, "Scrobbler account")
+	}
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to unlink scrobbler account")
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "deleted",
+		"message": "Scrobbler account unlinked successfully",
+	})
+}
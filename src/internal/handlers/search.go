@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 
 	"melodee/internal/pagination"
+	"melodee/internal/search"
 	"melodee/internal/services"
 	"melodee/internal/utils"
 
@@ -13,17 +15,21 @@ import (
 
 // SearchHandler handles search-related requests
 type SearchHandler struct {
-	repo *services.Repository
+	repo   *services.Repository
+	search *search.Service
 }
 
 // NewSearchHandler creates a new search handler
 func NewSearchHandler(repo *services.Repository) *SearchHandler {
 	return &SearchHandler{
-		repo: repo,
+		repo:   repo,
+		search: search.NewService(repo.GetDB()),
 	}
 }
 
-// Search performs a search across artists, albums, and tracks
+// Search performs a ranked search across artists, albums, and tracks. The
+// query supports quoted phrases and artist:, album:, genre: and year:
+// qualifiers (year:1990..1999), see the search package.
 func (h *SearchHandler) Search(c *fiber.Ctx) error {
 	// Get query parameters
 	entityType := c.Query("type", "any") // artist, album, track, or any
@@ -44,82 +50,49 @@ func (h *SearchHandler) Search(c *fiber.Ctx) error {
 		return utils.SendError(c, http.StatusBadRequest, "Search query is required")
 	}
 
-	// Perform the search based on entity type
-	switch entityType {
-	case "artist", "artists":
-		artists, total, err := h.repo.SearchArtistsPaginated(query, limit, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search artists")
-		}
-
-		// Calculate pagination metadata according to OpenAPI spec
-		paginationMeta := pagination.CalculateWithOffset(total, offset, limit)
-
-		return c.JSON(fiber.Map{
-			"data":       artists,
-			"pagination": paginationMeta,
-		})
-
-	case "album", "albums":
-		albums, total, err := h.repo.SearchAlbumsPaginated(query, limit, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search albums")
-		}
-
-		// Calculate pagination metadata according to OpenAPI spec
-		paginationMeta := pagination.CalculateWithOffset(total, offset, limit)
-
-		return c.JSON(fiber.Map{
-			"data":       albums,
-			"pagination": paginationMeta,
-		})
-
-	case "song", "songs", "track", "tracks":
-		tracks, total, err := h.repo.SearchTracksPaginated(query, limit, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search tracks")
-		}
-
-		// Calculate pagination metadata according to OpenAPI spec
-		paginationMeta := pagination.CalculateWithOffset(total, offset, limit)
-
-		return c.JSON(fiber.Map{
-			"data":       tracks,
-			"pagination": paginationMeta,
-		})
-
-	case "any", "all", "":
-		// Search across all entities - return a combined result
-		// In a real implementation, we might want to create a more sophisticated combined search
-		// For now, we'll just search each type separately and return them organized
-		artists, _, err := h.repo.SearchArtistsPaginated(query, limit/3+1, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search artists")
+	kinds := search.AllKinds
+	if entityType != "any" && entityType != "all" && entityType != "" {
+		kind, ok := search.ParseKind(entityType)
+		if !ok {
+			return utils.SendError(c, http.StatusBadRequest, "Invalid search type. Use 'artist', 'album', 'track', or 'any'")
 		}
+		kinds = []search.Kind{kind}
+	}
 
-		albums, _, err := h.repo.SearchAlbumsPaginated(query, limit/3+1, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search albums")
-		}
+	results, err := h.search.Search(c.Context(), search.Parse(query), kinds, limit, offset)
+	if err != nil {
+		log.Printf("ERROR: Search for %q failed: %v", query, err)
+		return utils.SendInternalServerError(c, "Failed to search")
+	}
 
-		tracks, total, err := h.repo.SearchTracksPaginated(query, limit/3+1, offset)
-		if err != nil {
-			return utils.SendInternalServerError(c, "Failed to search tracks")
+	// Calculate pagination metadata according to OpenAPI spec
+	paginationMeta := pagination.CalculateWithOffset(results.Total, offset, limit)
+
+	if len(kinds) == 1 {
+		var data interface{}
+		switch kinds[0] {
+		case search.KindArtist:
+			data = results.Artists()
+		case search.KindAlbum:
+			data = results.Albums()
+		default:
+			data = results.Tracks()
 		}
-
-		// Calculate pagination metadata according to OpenAPI spec
-		paginationMeta := pagination.CalculateWithOffset(total, offset, limit)
-
 		return c.JSON(fiber.Map{
-			"data": fiber.Map{
-				"artists": artists,
-				"albums":  albums,
-				"songs":   tracks, // keep key for backward compatibility
-			},
+			"data":       data,
 			"pagination": paginationMeta,
 		})
-
-	default:
-		return utils.SendError(c, http.StatusBadRequest, "Invalid search type. Use 'artist', 'album', 'track', or 'any'")
 	}
+
+	// One page ranked across every type; the per-type lists keep that order
+	return c.JSON(fiber.Map{
+		"data": fiber.Map{
+			"artists": results.Artists(),
+			"albums":  results.Albums(),
+			"songs":   results.Tracks(), // keep key for backward compatibility
+			"results": results.Hits,
+			"totals":  results.Totals,
+		},
+		"pagination": paginationMeta,
+	})
 }
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -10,24 +12,38 @@ import (
 	"melodee/internal/models"
 	"melodee/internal/pagination"
 	"melodee/internal/services"
+	"melodee/internal/share"
 	"melodee/internal/utils"
 )
 
 // SharesHandler manages share operations
 type SharesHandler struct {
-	repo *services.Repository
+	repo   *services.Repository
+	shares *share.Service
 }
 
 // NewSharesHandler creates a new shares handler
 func NewSharesHandler(repo *services.Repository) *SharesHandler {
-	return &SharesHandler{
+	h := &SharesHandler{
 		repo: repo,
 	}
+	if repo != nil {
+		h.shares = share.NewService(repo.GetDB(), "")
+	}
+	return h
+}
+
+// WithShares sets the share service, which builds the share URLs
+func (h *SharesHandler) WithShares(shares *share.Service) *SharesHandler {
+	h.shares = shares
+	return h
 }
 
 // Share represents a share
 type Share struct {
 	ID                   string    `json:"id"`
+	Token                string    `json:"token"`
+	URL                  string    `json:"url"`
 	Name                 string    `json:"name"`
 	TrackIDs             []string  `json:"track_ids"`
 	ExpiresAt            time.Time `json:"expires_at"`
@@ -62,7 +78,8 @@ func (h *SharesHandler) GetShares(c *fiber.Ctx) error {
 
 	// Query shares with pagination from the database
 	var shares []models.Share
-	if err := h.repo.GetDB().Offset(offset).Limit(pageSize).Find(&shares).Error; err != nil {
+	if err := h.repo.GetDB().Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Offset(offset).Limit(pageSize).Find(&shares).Error; err != nil {
 		return utils.SendInternalServerError(c, "Failed to retrieve shares")
 	}
 
@@ -74,21 +91,8 @@ func (h *SharesHandler) GetShares(c *fiber.Ctx) error {
 
 	// Convert to response format
 	responseShares := make([]Share, len(shares))
-	for i, share := range shares {
-		var expiresAt time.Time
-		if share.ExpiresAt != nil {
-			expiresAt = *share.ExpiresAt
-		}
-
-		responseShares[i] = Share{
-			ID:                  strconv.Itoa(int(share.ID)),
-			Name:                share.Name,
-			TrackIDs:            []string{}, // In a real implementation, would fetch track IDs from related tables
-			ExpiresAt:           expiresAt,
-			MaxStreamingMinutes: int(share.MaxStreamingMinutes),
-			AllowDownload:       share.AllowDownload,
-			CreatedAt:           share.CreatedAt,
-		}
+	for i := range shares {
+		responseShares[i] = h.toShare(c, &shares[i])
 	}
 
 	// Calculate pagination metadata according to OpenAPI spec
@@ -134,29 +138,21 @@ func (h *SharesHandler) CreateShare(c *fiber.Ctx) error {
 		UpdatedAt:           time.Now(),
 	}
 
-	if err := h.repo.GetDB().Create(&newShare).Error; err != nil {
-		return utils.SendInternalServerError(c, "Failed to create share")
-	}
-
-	// Convert to response format
-	var expiresAt time.Time
-	if newShare.ExpiresAt != nil {
-		expiresAt = *newShare.ExpiresAt
+	items, err := trackItems(req.TrackIDs)
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
 	}
 
-	responseShare := Share{
-		ID:                  strconv.Itoa(int(newShare.ID)),
-		Name:                newShare.Name,
-		TrackIDs:            req.TrackIDs, // Use the provided track IDs
-		ExpiresAt:           expiresAt,
-		MaxStreamingMinutes: int(newShare.MaxStreamingMinutes),
-		AllowDownload:       newShare.AllowDownload,
-		CreatedAt:           newShare.CreatedAt,
+	if err := h.shares.Create(c.Context(), &newShare, items); err != nil {
+		if errors.Is(err, share.ErrNoItems) || errors.Is(err, share.ErrItemNotFound) {
+			return utils.SendError(c, http.StatusBadRequest, err.Error())
+		}
+		return utils.SendInternalServerError(c, "Failed to create share")
 	}
 
 	return c.JSON(fiber.Map{
 		"status": "ok",
-		"share": responseShare,
+		"share": h.toShare(c, &newShare),
 	})
 }
 
@@ -184,15 +180,33 @@ func (h *SharesHandler) UpdateShare(c *fiber.Ctx) error {
 		return utils.SendError(c, http.StatusBadRequest, "Invalid expires_at format, must be RFC3339")
 	}
 
+	// Without track_ids the items of the share are left as they are
+	var items []models.ShareItem
+	if req.TrackIDs != nil {
+		if items, err = trackItems(req.TrackIDs); err != nil {
+			return utils.SendError(c, http.StatusBadRequest, err.Error())
+		}
+	}
+
 	// Fetch the existing share to update
 	var existingShare models.Share
-	if err := h.repo.GetDB().First(&existingShare, shareID).Error; err != nil {
+	if err := h.repo.GetDB().Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		First(&existingShare, shareID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return utils.SendNotFoundError(c, "Share")
 		}
 		return utils.SendInternalServerError(c, "Failed to find share")
 	}
 
+	if req.TrackIDs != nil {
+		if err := h.shares.ReplaceItems(c.Context(), &existingShare, items); err != nil {
+			if errors.Is(err, share.ErrNoItems) || errors.Is(err, share.ErrItemNotFound) {
+				return utils.SendError(c, http.StatusBadRequest, err.Error())
+			}
+			return utils.SendInternalServerError(c, "Failed to update share")
+		}
+	}
+
 	// Update the existing share
 	existingShare.Name = req.Name
 	existingShare.ExpiresAt = &expiryTime
@@ -200,29 +214,13 @@ func (h *SharesHandler) UpdateShare(c *fiber.Ctx) error {
 	existingShare.AllowDownload = req.AllowDownload
 	existingShare.UpdatedAt = time.Now()
 
-	if err := h.repo.GetDB().Save(&existingShare).Error; err != nil {
+	if err := h.repo.GetDB().Omit("Items", "User").Save(&existingShare).Error; err != nil {
 		return utils.SendInternalServerError(c, "Failed to update share")
 	}
 
-	// Convert to response format
-	var expiresAt time.Time
-	if existingShare.ExpiresAt != nil {
-		expiresAt = *existingShare.ExpiresAt
-	}
-
-	updatedShare := Share{
-		ID:                  strconv.Itoa(int(existingShare.ID)),
-		Name:                existingShare.Name,
-		TrackIDs:            req.TrackIDs, // Use the provided track IDs
-		ExpiresAt:           expiresAt,
-		MaxStreamingMinutes: int(existingShare.MaxStreamingMinutes),
-		AllowDownload:       existingShare.AllowDownload,
-		CreatedAt:           existingShare.CreatedAt, // Preserve the original created time
-	}
-
 	return c.JSON(fiber.Map{
 		"status": "ok",
-		"share": updatedShare,
+		"share": h.toShare(c, &existingShare),
 	})
 }
 
@@ -249,4 +247,44 @@ func (h *SharesHandler) DeleteShare(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status": "deleted",
 	})
-}
\ No newline at end of file
+}
+
+// toShare converts a share with its items to the response format
+func (h *SharesHandler) toShare(c *fiber.Ctx, s *models.Share) Share {
+	var expiresAt time.Time
+	if s.ExpiresAt != nil {
+		expiresAt = *s.ExpiresAt
+	}
+
+	trackIDs := []string{}
+	for _, item := range s.Items {
+		if item.ItemType == models.ShareItemTrack {
+			trackIDs = append(trackIDs, strconv.FormatInt(item.ItemID, 10))
+		}
+	}
+
+	return Share{
+		ID:                  strconv.Itoa(int(s.ID)),
+		Token:               s.Token,
+		URL:                 h.shares.URL(s, c.BaseURL()),
+		Name:                s.Name,
+		TrackIDs:            trackIDs,
+		ExpiresAt:           expiresAt,
+		MaxStreamingMinutes: int(s.MaxStreamingMinutes),
+		AllowDownload:       s.AllowDownload,
+		CreatedAt:           s.CreatedAt,
+	}
+}
+
+// trackItems converts track ids to share items
+func trackItems(trackIDs []string) ([]models.ShareItem, error) {
+	items := make([]models.ShareItem, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		trackID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid track id %s", id)
+		}
+		items = append(items, models.ShareItem{ItemType: models.ShareItemTrack, ItemID: trackID})
+	}
+	return items, nil
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"melodee/internal/similarity"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+)
+
+// SimilarityHandler handles similarity administration
+type SimilarityHandler struct {
+	asynqClient *asynq.Client
+}
+
+// NewSimilarityHandler creates a new similarity handler
+func NewSimilarityHandler(asynqClient *asynq.Client) *SimilarityHandler {
+	return &SimilarityHandler{
+		asynqClient: asynqClient,
+	}
+}
+
+// RebuildSimilarity queues a rebuild of the similar artist and track tables
+// POST /api/admin/similarity/rebuild
+func (h *SimilarityHandler) RebuildSimilarity(c *fiber.Ctx) error {
+	if h.asynqClient == nil {
+		return utils.SendInternalServerError(c, "Background job client not initialized")
+	}
+
+	if err := similarity.EnqueueRebuild(h.asynqClient); err != nil {
+		log.Printf("ERROR: Failed to enqueue similarity rebuild: %v", err)
+		return utils.SendInternalServerError(c, "Failed to enqueue similarity rebuild")
+	}
+
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status": "queued",
+	})
+}
@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"melodee/internal/models"
@@ -29,21 +33,22 @@ func NewStagingHandler(db *gorm.DB, stagingRoot string) *StagingHandler {
 
 // StagingItemResponse is the API response for a staging item
 type StagingItemResponse struct {
-	ID           int64   `json:"id"`
-	ScanID       string  `json:"scan_id"`
-	StagingPath  string  `json:"staging_path"`
-	MetadataFile string  `json:"metadata_file"`
-	ArtistName   string  `json:"artist_name"`
-	AlbumName    string  `json:"album_name"`
-	TrackCount   int32   `json:"track_count"`
-	TotalSize    int64   `json:"total_size"`
-	ProcessedAt  string  `json:"processed_at"`
-	Status       string  `json:"status"`
-	ReviewedBy   *int64  `json:"reviewed_by,omitempty"`
-	ReviewedAt   *string `json:"reviewed_at,omitempty"`
-	Notes        string  `json:"notes,omitempty"`
-	Checksum     string  `json:"checksum"`
-	CreatedAt    string  `json:"created_at"`
+	ID             int64   `json:"id"`
+	ScanID         string  `json:"scan_id"`
+	StagingPath    string  `json:"staging_path"`
+	MetadataFile   string  `json:"metadata_file"`
+	ArtistName     string  `json:"artist_name"`
+	AlbumName      string  `json:"album_name"`
+	TrackCount     int32   `json:"track_count"`
+	TotalSize      int64   `json:"total_size"`
+	ProcessedAt    string  `json:"processed_at"`
+	Status         string  `json:"status"`
+	ReviewedBy     *int64  `json:"reviewed_by,omitempty"`
+	ReviewedAt     *string `json:"reviewed_at,omitempty"`
+	Notes          string  `json:"notes,omitempty"`
+	Checksum       string  `json:"checksum"`
+	DuplicateCount int32   `json:"duplicate_count"`
+	CreatedAt      string  `json:"created_at"`
 }
 
 // ListStagingItems returns all staging items with optional filtering
@@ -51,6 +56,7 @@ type StagingItemResponse struct {
 func (h *StagingHandler) ListStagingItems(c *fiber.Ctx) error {
 	status := c.Query("status", "")
 	scanID := c.Query("scan_id", "")
+	hasDuplicates := c.QueryBool("has_duplicates", false)
 
 	var items []models.StagingItem
 	var err error
@@ -65,6 +71,10 @@ func (h *StagingHandler) ListStagingItems(c *fiber.Ctx) error {
 		query = query.Where("scan_id = ?", scanID)
 	}
 
+	if hasDuplicates {
+		query = query.Where("duplicate_count > 0")
+	}
+
 	err = query.Order("created_at DESC").Find(&items).Error
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -271,23 +281,240 @@ func (h *StagingHandler) DeleteStagingItem(c *fiber.Ctx) error {
 	})
 }
 
+// maxArtworkSize is the largest cover image that can be uploaded
+const maxArtworkSize = 10 * 1024 * 1024
+
+// EditStagingItem edits the album, artist and track metadata of a staging
+// item pending review, re-validates it and records the changed fields
+// PATCH /api/v1/staging/:id/metadata
+func (h *StagingHandler) EditStagingItem(c *fiber.Ctx) error {
+	var req struct {
+		processor.MetadataEdit
+		Checksum string `json:"checksum"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	item, metadata, err := h.editableItem(c, req.Checksum)
+	if item == nil {
+		return err
+	}
+
+	changes, err := req.MetadataEdit.Apply(metadata)
+	if err != nil {
+		if errors.Is(err, processor.ErrInvalidEdit) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to apply edit",
+		})
+	}
+
+	return h.saveEdit(c, item, metadata, changes, nil)
+}
+
+// ReplaceStagingArtwork replaces the cover of a staging item pending review
+// with an uploaded JPEG or PNG image
+// PUT /api/v1/staging/:id/artwork
+func (h *StagingHandler) ReplaceStagingArtwork(c *fiber.Ctx) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No file provided or invalid form data",
+		})
+	}
+	if file.Size > maxArtworkSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("File size too large, maximum %d bytes allowed", maxArtworkSize),
+		})
+	}
+
+	item, metadata, err := h.editableItem(c, c.FormValue("checksum"))
+	if item == nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open uploaded file",
+		})
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read uploaded file",
+		})
+	}
+
+	// The cover it replaces is put back when the edit can't be saved
+	coverPath := filepath.Join(item.StagingPath, processor.AlbumCoverFile)
+	previous, readErr := os.ReadFile(coverPath)
+	restore := func() {
+		if readErr == nil {
+			os.WriteFile(coverPath, previous, 0644)
+		} else {
+			os.Remove(coverPath)
+		}
+	}
+
+	oldSum, newSum, err := processor.WriteAlbumCover(item.StagingPath, data)
+	if err != nil {
+		if errors.Is(err, processor.ErrInvalidEdit) {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to write cover",
+		})
+	}
+
+	changes := []processor.FieldChange{{
+		Field:    "album.artwork",
+		OldValue: strconv.Quote(oldSum),
+		NewValue: strconv.Quote(newSum),
+	}}
+	if oldSum == "" {
+		changes[0].OldValue = "null"
+	}
+	if err := processor.RecordAlbumCover(metadata, item.StagingPath); err != nil {
+		restore()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record cover",
+		})
+	}
+
+	return h.saveEdit(c, item, metadata, changes, restore)
+}
+
+// GetStagingItemHistory returns the changes curators made to a staging item,
+// oldest first
+// GET /api/v1/staging/:id/history
+func (h *StagingHandler) GetStagingItemHistory(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid staging item ID",
+		})
+	}
+
+	changes, err := h.repo.GetStagingItemChanges(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch staging item history",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": changes,
+	})
+}
+
+// editableItem loads a staging item that may be edited and its metadata. When
+// checksum is given it must be the item's, so edits made from a stale copy
+// are refused. When the item is nil, an error response has been sent and
+// err is the result of sending it.
+func (h *StagingHandler) editableItem(c *fiber.Ctx, checksum string) (*models.StagingItem, *processor.AlbumMetadata, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid staging item ID",
+		})
+	}
+
+	var item models.StagingItem
+	if err := h.db.First(&item, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Staging item not found",
+			})
+		}
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch staging item",
+		})
+	}
+
+	if item.Status != "pending_review" {
+		return nil, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Can only edit items pending review",
+		})
+	}
+	if checksum != "" && checksum != item.Checksum {
+		return nil, nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": processor.ErrStagingItemChanged.Error(),
+		})
+	}
+
+	metadata, err := processor.ReadAlbumMetadata(item.MetadataFile)
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read metadata file",
+		})
+	}
+
+	return &item, metadata, nil
+}
+
+// saveEdit re-validates an item's edited metadata, saves it and responds
+// with the item, its metadata and the changed fields. undo, when set, puts
+// back what the edit changed outside the sidecar if saving fails.
+func (h *StagingHandler) saveEdit(c *fiber.Ctx, item *models.StagingItem, metadata *processor.AlbumMetadata, changes []processor.FieldChange, undo func()) error {
+	processor.ValidateAlbumMetadata(metadata, item.StagingPath)
+
+	var editorID *int64
+	if userID, ok := c.Locals("user_id").(int64); ok {
+		editorID = &userID
+	}
+
+	if err := h.repo.SaveStagingItemMetadata(item, metadata, changes, editorID); err != nil {
+		if undo != nil {
+			undo()
+		}
+		if errors.Is(err, processor.ErrStagingItemChanged) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save metadata",
+		})
+	}
+
+	if changes == nil {
+		changes = []processor.FieldChange{}
+	}
+	return c.JSON(fiber.Map{
+		"item":     toStagingItemResponse(item),
+		"metadata": metadata,
+		"changes":  changes,
+	})
+}
+
 // toStagingItemResponse converts a model to response format
 func toStagingItemResponse(item *models.StagingItem) StagingItemResponse {
 	resp := StagingItemResponse{
-		ID:           item.ID,
-		ScanID:       item.ScanID,
-		StagingPath:  item.StagingPath,
-		MetadataFile: item.MetadataFile,
-		ArtistName:   item.ArtistName,
-		AlbumName:    item.AlbumName,
-		TrackCount:   item.TrackCount,
-		TotalSize:    item.TotalSize,
-		ProcessedAt:  item.ProcessedAt.Format("2006-01-02T15:04:05Z07:00"),
-		Status:       item.Status,
-		ReviewedBy:   item.ReviewedBy,
-		Notes:        item.Notes,
-		Checksum:     item.Checksum,
-		CreatedAt:    item.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		ID:             item.ID,
+		ScanID:         item.ScanID,
+		StagingPath:    item.StagingPath,
+		MetadataFile:   item.MetadataFile,
+		ArtistName:     item.ArtistName,
+		AlbumName:      item.AlbumName,
+		TrackCount:     item.TrackCount,
+		TotalSize:      item.TotalSize,
+		ProcessedAt:    item.ProcessedAt.Format("2006-01-02T15:04:05Z07:00"),
+		Status:         item.Status,
+		ReviewedBy:     item.ReviewedBy,
+		Notes:          item.Notes,
+		Checksum:       item.Checksum,
+		DuplicateCount: item.DuplicateCount,
+		CreatedAt:      item.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
 	}
 
 	if item.ReviewedAt != nil {
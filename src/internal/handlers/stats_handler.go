@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+
+	"melodee/internal/middleware"
+	"melodee/internal/playhistory"
+	"melodee/internal/services"
+	"melodee/internal/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultStatsLimit = 10
+	maxStatsLimit     = 100
+)
+
+// StatsHandler serves users' listening statistics
+type StatsHandler struct {
+	repo    *services.Repository
+	history *playhistory.Service
+}
+
+// NewStatsHandler creates a new stats handler
+func NewStatsHandler(repo *services.Repository) *StatsHandler {
+	return &StatsHandler{
+		repo:    repo,
+		history: playhistory.NewService(repo.GetDB()),
+	}
+}
+
+// GetUserStats returns a user's play count, listening time and top artists,
+// tracks and genres over a period (week, month, year or all)
+// GET /api/users/:id/stats?period=month&limit=10
+func (h *StatsHandler) GetUserStats(c *fiber.Ctx) error {
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	// Allow access if user is admin or requesting their own statistics
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	period, err := playhistory.ParsePeriod(c.Query("period"))
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, err.Error())
+	}
+
+	limit := c.QueryInt("limit", defaultStatsLimit)
+	if limit < 1 {
+		limit = defaultStatsLimit
+	}
+	if limit > maxStatsLimit {
+		limit = maxStatsLimit
+	}
+
+	if _, err := h.repo.GetUserByID(int64(userID)); err != nil {
+		return utils.SendNotFoundError(c, "User")
+	}
+
+	stats, err := h.history.UserStats(c.Context(), int64(userID), period, limit)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to load listening statistics")
+	}
+
+	return c.JSON(stats)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -8,9 +9,11 @@ import (
 	"melodee/internal/models"
 	"melodee/internal/pagination"
 	"melodee/internal/services"
+	"melodee/internal/similarity"
 	"melodee/internal/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // TracksV1Handler handles v1 track-related requests
@@ -212,3 +215,43 @@ func (h *TracksV1Handler) SetTrackRating(c *fiber.Ctx) error {
 		"user_id":  currentUser.ID,
 	})
 }
+
+// GetInstantMix handles building a mix of tracks similar to a track
+func (h *TracksV1Handler) GetInstantMix(c *fiber.Ctx) error {
+	// Check authentication
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	trackID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid track ID")
+	}
+
+	count := instantMixCount(c)
+	tracks, err := similarity.NewService(h.repo.GetDB()).TrackMix(c.Context(), trackID, currentUser.ID, count)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.SendNotFoundError(c, "Track")
+	}
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to build instant mix")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": tracks,
+		"meta": pagination.Calculate(int64(len(tracks)), 1, count),
+	})
+}
+
+// instantMixCount reads the requested mix length, 50 tracks by default and at most 500
+func instantMixCount(c *fiber.Ctx) int {
+	count := c.QueryInt("count", 50)
+	if count < 1 {
+		count = 1
+	}
+	if count > 500 {
+		count = 500
+	}
+	return count
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"melodee/internal/middleware"
@@ -10,6 +11,7 @@ import (
 	"melodee/internal/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // UserHandler handles user-related requests
@@ -169,10 +171,11 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	}
 
 	var req struct {
-		Username *string `json:"username,omitempty"`
-		Email    *string `json:"email,omitempty"`
-		Password *string `json:"password,omitempty"`
-		IsAdmin  *bool   `json:"is_admin,omitempty"`
+		Username            *string `json:"username,omitempty"`
+		Email               *string `json:"email,omitempty"`
+		Password            *string `json:"password,omitempty"`
+		IsAdmin             *bool   `json:"is_admin,omitempty"`
+		ConsolidateEditions *bool   `json:"consolidate_editions,omitempty"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -199,6 +202,9 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 		}
 		user.IsAdmin = *req.IsAdmin
 	}
+	if req.ConsolidateEditions != nil {
+		user.ConsolidateEditions = *req.ConsolidateEditions
+	}
 	if req.Password != nil {
 		// Validate password if provided
 		if err := utils.ValidatePassword(*req.Password); err != nil {
@@ -218,11 +224,12 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"id":       user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"is_admin": user.IsAdmin,
-		"message":  "User updated successfully",
+		"id":                   user.ID,
+		"username":             user.Username,
+		"email":                user.Email,
+		"is_admin":             user.IsAdmin,
+		"consolidate_editions": user.ConsolidateEditions,
+		"message":              "User updated successfully",
 	})
 }
 
@@ -255,3 +262,110 @@ func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
 		"message": "User deleted successfully",
 	})
 }
+
+// GetSubsonicPasswords lists a user's Subsonic app passwords (secrets are never returned)
+func (h *UserHandler) GetSubsonicPasswords(c *fiber.Ctx) error {
+	// Allow access if user is admin or managing their own passwords
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	passwords, err := h.authService.ListSubsonicPasswords(int64(userID))
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to fetch subsonic passwords")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": passwords,
+	})
+}
+
+// CreateSubsonicPassword issues a new Subsonic app password for token authentication.
+// The secret is only returned in this response.
+func (h *UserHandler) CreateSubsonicPassword(c *fiber.Ctx) error {
+	// Allow access if user is admin or managing their own passwords
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid request body")
+	}
+
+	if req.Name == "" {
+		return utils.SendValidationError(c, "name", "name is required")
+	}
+
+	password, secret, err := h.authService.IssueSubsonicPassword(int64(userID), req.Name)
+	if err != nil {
+		return utils.SendInternalServerError(c, "Failed to issue subsonic password")
+	}
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"id":         password.ID,
+		"user_id":    password.UserID,
+		"name":       password.Name,
+		"password":   secret,
+		"created_at": password.CreatedAt,
+		"message":    "Subsonic password created successfully; it will not be shown again",
+	})
+}
+
+// DeleteSubsonicPassword revokes a Subsonic app password
+func (h *UserHandler) DeleteSubsonicPassword(c *fiber.Ctx) error {
+	// Allow access if user is admin or managing their own passwords
+	currentUser, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		return utils.SendUnauthorizedError(c, "Authentication required")
+	}
+
+	userID, err := c.ParamsInt("id")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if !currentUser.IsAdmin && currentUser.ID != int64(userID) {
+		return utils.SendForbiddenError(c, "Access denied")
+	}
+
+	passwordID, err := c.ParamsInt("passwordId")
+	if err != nil {
+		return utils.SendError(c, http.StatusBadRequest, "Invalid subsonic password ID")
+	}
+
+	if err := h.authService.RevokeSubsonicPassword(int64(userID), int64(passwordID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return utils.SendNotFoundError(c, "Subsonic password")
+		}
+		return utils.SendInternalServerError(c, "Failed to revoke subsonic password")
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "deleted",
+		"message": "Subsonic password revoked successfully",
+	})
+}
@@ -100,7 +100,7 @@ func SetupIntegrationTestSuite() *IntegrationTestSuite {
 	openSubsonicSystemHandler := open_subsonic_handlers.NewSystemHandler(suite.db)
 
 	// Create OpenSubsonic auth middleware
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(suite.db, suite.config.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(suite.db, services.NewAuthService(suite.db, suite.config.JWT.Secret))
 
 	// Define API routes
 	rest := suite.app.Group("/rest")
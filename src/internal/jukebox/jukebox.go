@@ -0,0 +1,482 @@
+package jukebox
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"melodee/internal/config"
+	"melodee/internal/directory"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+)
+
+const (
+	stateID     = 1
+	defaultGain = 0.5
+)
+
+var (
+	// ErrTrackNotFound is returned when a track added to the queue does not exist
+	ErrTrackNotFound = errors.New("track not found")
+	// ErrInvalidIndex is returned when a queue index is out of range
+	ErrInvalidIndex = errors.New("invalid queue index")
+)
+
+// Status describes the current state of the jukebox
+type Status struct {
+	CurrentIndex int
+	Playing      bool
+	Gain         float32
+	Position     int // seconds into the current track
+}
+
+// Service is the server-side jukebox. There is a single queue per server,
+// persisted in the database so it survives restarts, played through an Output.
+type Service struct {
+	db     *gorm.DB
+	output Output
+	paths  *directory.LibraryPathResolver
+
+	mu           sync.Mutex
+	queue        []models.Track
+	currentIndex int
+	offset       time.Duration // position of the current track while stopped
+	gain         float32
+	playback     Playback // nil while stopped
+	generation   int      // bumped on every start/stop so stale completions are ignored
+}
+
+// NewService creates the jukebox and restores the persisted queue, resuming
+// playback if the jukebox was playing when the server stopped
+func NewService(db *gorm.DB, output Output, paths *directory.LibraryPathResolver) (*Service, error) {
+	if paths == nil {
+		paths = directory.NewLibraryPathResolver(db, nil)
+	}
+
+	s := &Service{
+		db:     db,
+		output: output,
+		paths:  paths,
+		gain:   defaultGain,
+	}
+
+	playing, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if playing {
+		s.mu.Lock()
+		if err := s.play(); err != nil {
+			logging.Warnf("jukebox: failed to resume playback: %v", err)
+		}
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// NewFromConfig creates the jukebox described by the application config. It
+// returns nil when the jukebox is disabled.
+func NewFromConfig(db *gorm.DB, cfg *config.AppConfig) (*Service, error) {
+	if cfg == nil || !cfg.Jukebox.Enabled {
+		return nil, nil
+	}
+
+	var output Output
+	switch cfg.Jukebox.Output {
+	case "null":
+		output = NewNullOutput()
+	case "ffmpeg":
+		output = NewFFmpegOutput(cfg.Processing.FFmpegPath, cfg.Jukebox.Format, cfg.Jukebox.Device)
+	default:
+		return nil, fmt.Errorf("unknown jukebox output: %s", cfg.Jukebox.Output)
+	}
+	return NewService(db, output, nil)
+}
+
+// Status returns the current state of the jukebox
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status()
+}
+
+// Playlist returns the current state together with the queued tracks
+func (s *Service) Playlist() (Status, []models.Track) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tracks := make([]models.Track, len(s.queue))
+	copy(tracks, s.queue)
+	return s.status(), tracks
+}
+
+// Set replaces the queue with the given tracks
+func (s *Service) Set(trackIDs []int64) error {
+	tracks, err := s.loadTracks(trackIDs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasPlaying := s.playback != nil
+	s.halt()
+	s.queue = tracks
+	s.currentIndex = 0
+	s.offset = 0
+	if err := s.saveQueue(); err != nil {
+		return err
+	}
+	if wasPlaying && len(s.queue) > 0 {
+		return s.play()
+	}
+	return s.saveState()
+}
+
+// Add appends tracks to the end of the queue
+func (s *Service) Add(trackIDs []int64) error {
+	tracks, err := s.loadTracks(trackIDs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queue = append(s.queue, tracks...)
+	return s.saveQueue()
+}
+
+// Clear stops playback and empties the queue
+func (s *Service) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halt()
+	s.queue = nil
+	s.currentIndex = 0
+	s.offset = 0
+	if err := s.saveQueue(); err != nil {
+		return err
+	}
+	return s.saveState()
+}
+
+// Remove removes the track at index from the queue. Removing the playing track
+// moves on to the track that takes its place.
+func (s *Service) Remove(index int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.queue) {
+		return ErrInvalidIndex
+	}
+
+	removingCurrent := index == s.currentIndex
+	wasPlaying := s.playback != nil
+	if removingCurrent {
+		s.halt()
+		s.offset = 0
+	}
+
+	s.queue = append(s.queue[:index], s.queue[index+1:]...)
+	if index < s.currentIndex {
+		s.currentIndex--
+	}
+	if s.currentIndex >= len(s.queue) {
+		s.currentIndex = 0
+		wasPlaying = false
+	}
+
+	if err := s.saveQueue(); err != nil {
+		return err
+	}
+	if removingCurrent && wasPlaying {
+		return s.play()
+	}
+	return s.saveState()
+}
+
+// Shuffle randomizes the queue. The current track moves to the front so
+// playback is not interrupted.
+func (s *Service) Shuffle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+
+	current := s.queue[s.currentIndex]
+	rest := append(append([]models.Track{}, s.queue[:s.currentIndex]...), s.queue[s.currentIndex+1:]...)
+	rand.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	s.queue = append([]models.Track{current}, rest...)
+	s.currentIndex = 0
+
+	if err := s.saveQueue(); err != nil {
+		return err
+	}
+	return s.saveState()
+}
+
+// Start starts playback of the current track
+func (s *Service) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.playback != nil || len(s.queue) == 0 {
+		return nil
+	}
+	return s.play()
+}
+
+// Stop stops playback, remembering the position in the current track
+func (s *Service) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halt()
+	return s.saveState()
+}
+
+// Skip jumps to the track at index, starting offset seconds into it
+func (s *Service) Skip(index, offset int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.queue) || offset < 0 {
+		return ErrInvalidIndex
+	}
+
+	wasPlaying := s.playback != nil
+	s.halt()
+	s.currentIndex = index
+	s.offset = time.Duration(offset) * time.Second
+	if wasPlaying {
+		return s.play()
+	}
+	return s.saveState()
+}
+
+// SetGain sets the output volume (0.0 - 1.0). Outputs apply the gain when a
+// track starts, so a playing track is restarted from its current position.
+func (s *Service) SetGain(gain float32) error {
+	if gain < 0 || gain > 1 {
+		return fmt.Errorf("gain must be between 0.0 and 1.0, got %v", gain)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gain = gain
+	if s.playback != nil {
+		s.halt()
+		return s.play()
+	}
+	return s.saveState()
+}
+
+// Close stops playback without forgetting that the jukebox was playing, so
+// it resumes when the server starts again
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasPlaying := s.playback != nil
+	s.halt()
+	if !wasPlaying {
+		return nil
+	}
+	return s.persistState(true)
+}
+
+// status must be called with mu held
+func (s *Service) status() Status {
+	position := s.offset
+	if s.playback != nil {
+		position = s.playback.Position()
+	}
+	return Status{
+		CurrentIndex: s.currentIndex,
+		Playing:      s.playback != nil,
+		Gain:         s.gain,
+		Position:     int(position / time.Second),
+	}
+}
+
+// play starts the current track at the stored offset. Must be called with mu held.
+func (s *Service) play() error {
+	if s.currentIndex >= len(s.queue) {
+		s.currentIndex = 0
+		s.offset = 0
+	}
+	if len(s.queue) == 0 {
+		return s.saveState()
+	}
+
+	track := s.queue[s.currentIndex]
+	path, err := s.paths.TrackPath(&track)
+	if err != nil {
+		return fmt.Errorf("failed to resolve track %d: %w", track.ID, err)
+	}
+
+	playback, err := s.output.Play(Item{
+		Path:     path,
+		Duration: time.Duration(track.Duration) * time.Millisecond,
+		Offset:   s.offset,
+		Gain:     s.gain,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.generation++
+	s.playback = playback
+	go s.watch(playback, s.generation)
+	return s.saveState()
+}
+
+// halt stops the output and records the position. Must be called with mu held.
+func (s *Service) halt() {
+	if s.playback == nil {
+		return
+	}
+
+	s.generation++
+	playback := s.playback
+	s.playback = nil
+	s.offset = playback.Position()
+	playback.Stop()
+}
+
+// watch advances to the next track when a playback finishes on its own
+func (s *Service) watch(playback Playback, generation int) {
+	<-playback.Done()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return // stopped or replaced by a newer playback
+	}
+
+	s.playback = nil
+	s.offset = 0
+	s.currentIndex++
+	if s.currentIndex >= len(s.queue) {
+		// End of the queue
+		s.currentIndex = 0
+		if err := s.saveState(); err != nil {
+			logging.Warnf("jukebox: failed to save state: %v", err)
+		}
+		return
+	}
+
+	if err := s.play(); err != nil {
+		logging.Warnf("jukebox: failed to play next track: %v", err)
+	}
+}
+
+// loadTracks loads tracks in the given order
+func (s *Service) loadTracks(trackIDs []int64) ([]models.Track, error) {
+	if len(trackIDs) == 0 {
+		return nil, nil
+	}
+
+	var found []models.Track
+	if err := s.db.Preload("Album").Preload("Artist").Where("id IN ?", trackIDs).Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tracks: %w", err)
+	}
+
+	byID := make(map[int64]models.Track, len(found))
+	for _, track := range found {
+		byID[track.ID] = track
+	}
+
+	tracks := make([]models.Track, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		track, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrTrackNotFound, id)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// load restores the persisted queue and state, returning whether the jukebox was playing
+func (s *Service) load() (bool, error) {
+	var entries []models.JukeboxEntry
+	if err := s.db.Preload("Track.Album").Preload("Track.Artist").Order("position").Find(&entries).Error; err != nil {
+		return false, fmt.Errorf("failed to load jukebox queue: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Track != nil {
+			s.queue = append(s.queue, *entry.Track)
+		}
+	}
+
+	var state models.JukeboxState
+	err := s.db.First(&state, stateID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load jukebox state: %w", err)
+	}
+
+	s.gain = state.Gain
+	s.offset = time.Duration(state.Position) * time.Second
+	if int(state.CurrentIndex) < len(s.queue) {
+		s.currentIndex = int(state.CurrentIndex)
+	} else {
+		s.offset = 0
+	}
+	return state.Playing && len(s.queue) > 0, nil
+}
+
+// saveQueue rewrites the persisted queue. Must be called with mu held.
+func (s *Service) saveQueue() error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&models.JukeboxEntry{}).Error; err != nil {
+			return fmt.Errorf("failed to clear jukebox queue: %w", err)
+		}
+		if len(s.queue) == 0 {
+			return nil
+		}
+
+		entries := make([]models.JukeboxEntry, len(s.queue))
+		for i, track := range s.queue {
+			entries[i] = models.JukeboxEntry{Position: int32(i), TrackID: track.ID}
+		}
+		if err := tx.Create(&entries).Error; err != nil {
+			return fmt.Errorf("failed to save jukebox queue: %w", err)
+		}
+		return nil
+	})
+}
+
+// saveState persists the current state. Must be called with mu held.
+func (s *Service) saveState() error {
+	return s.persistState(s.playback != nil)
+}
+
+func (s *Service) persistState(playing bool) error {
+	status := s.status()
+	state := models.JukeboxState{
+		ID:           stateID,
+		CurrentIndex: int32(status.CurrentIndex),
+		Position:     int32(status.Position),
+		Gain:         status.Gain,
+		Playing:      playing,
+	}
+	if err := s.db.Save(&state).Error; err != nil {
+		return fmt.Errorf("failed to save jukebox state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package jukebox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupJukeboxTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		library_id INTEGER,
+		directory TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		library_id INTEGER,
+		relative_path TEXT,
+		directory TEXT,
+		file_name TEXT,
+		duration INTEGER
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE jukebox_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		position INTEGER NOT NULL,
+		track_id INTEGER NOT NULL
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE jukebox_states (
+		id INTEGER PRIMARY KEY,
+		current_index INTEGER DEFAULT 0,
+		position INTEGER DEFAULT 0,
+		gain REAL DEFAULT 0.5,
+		playing BOOLEAN DEFAULT 0,
+		updated_at DATETIME
+	)`).Error)
+
+	db.Exec(`INSERT INTO libraries (id, name, path, type) VALUES (1, 'Production', '/music', 'production')`)
+	db.Exec(`INSERT INTO tracks (id, name, library_id, relative_path, duration) VALUES
+		(1, 'One', 1, 'a/01.flac', 60000),
+		(2, 'Two', 1, 'a/02.flac', 60000),
+		(3, 'Three', 1, 'a/03.flac', 60000)`)
+	return db
+}
+
+func TestService_QueueIsPersisted(t *testing.T) {
+	db := setupJukeboxTestDB(t)
+
+	service, err := NewService(db, NewNullOutput(), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, service.Set([]int64{3, 1}))
+	require.NoError(t, service.Add([]int64{2}))
+	assert.ErrorIs(t, service.Add([]int64{42}), ErrTrackNotFound)
+	require.NoError(t, service.Skip(1, 0))
+	require.NoError(t, service.SetGain(0.8))
+
+	restored, err := NewService(db, NewNullOutput(), nil)
+	require.NoError(t, err)
+
+	status, tracks := restored.Playlist()
+	assert.Equal(t, 1, status.CurrentIndex)
+	assert.False(t, status.Playing)
+	assert.InDelta(t, 0.8, status.Gain, 0.001)
+	require.Len(t, tracks, 3)
+	assert.Equal(t, []int64{3, 1, 2}, []int64{tracks[0].ID, tracks[1].ID, tracks[2].ID})
+
+	require.NoError(t, restored.Remove(0))
+	status, tracks = restored.Playlist()
+	assert.Equal(t, 0, status.CurrentIndex)
+	assert.Len(t, tracks, 2)
+	assert.ErrorIs(t, restored.Remove(5), ErrInvalidIndex)
+}
+
+func TestService_AdvancesToNextTrack(t *testing.T) {
+	db := setupJukeboxTestDB(t)
+	db.Exec(`UPDATE tracks SET duration = 50`)
+
+	service, err := NewService(db, NewNullOutput(), nil)
+	require.NoError(t, err)
+	require.NoError(t, service.Set([]int64{1, 2}))
+	require.NoError(t, service.Start())
+	assert.True(t, service.Status().Playing)
+
+	// Both 50ms tracks finish and the queue rewinds to the start
+	assert.Eventually(t, func() bool {
+		status := service.Status()
+		return !status.Playing && status.CurrentIndex == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestService_ResumesAfterRestart(t *testing.T) {
+	db := setupJukeboxTestDB(t)
+
+	service, err := NewService(db, NewNullOutput(), nil)
+	require.NoError(t, err)
+	require.NoError(t, service.Set([]int64{1, 2, 3}))
+	require.NoError(t, service.Skip(2, 10))
+	require.NoError(t, service.Start())
+	require.NoError(t, service.Close())
+
+	restored, err := NewService(db, NewNullOutput(), nil)
+	require.NoError(t, err)
+	defer restored.Stop()
+
+	status := restored.Status()
+	assert.True(t, status.Playing)
+	assert.Equal(t, 2, status.CurrentIndex)
+	assert.GreaterOrEqual(t, status.Position, 10)
+}
+
+func TestFFmpegOutput_Args(t *testing.T) {
+	item := Item{Path: "/music/a/01.flac", Offset: 90 * time.Second, Gain: 0.5}
+
+	alsa := NewFFmpegOutput("ffmpeg", "alsa", "hw:1,0")
+	assert.Equal(t, []string{
+		"-v", "error", "-nostdin",
+		"-ss", "90.000",
+		"-i", "/music/a/01.flac",
+		"-vn", "-af", "volume=0.500",
+		"-f", "alsa", "hw:1,0",
+	}, alsa.Args(item))
+
+	pipe := NewFFmpegOutput("ffmpeg", "s16le", "/tmp/snapfifo")
+	assert.Equal(t, []string{
+		"-v", "error", "-nostdin", "-re",
+		"-i", "/music/a/01.flac",
+		"-vn", "-af", "volume=0.500",
+		"-f", "s16le", "-ar", "48000", "-ac", "2", "-y", "/tmp/snapfifo",
+	}, pipe.Args(Item{Path: "/music/a/01.flac", Gain: 0.5}))
+}
@@ -0,0 +1,169 @@
+package jukebox
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Item is a single track handed to an output for playback
+type Item struct {
+	Path     string
+	Duration time.Duration // Full length of the track
+	Offset   time.Duration // Where to start playing
+	Gain     float32       // 0.0 - 1.0
+}
+
+// Output plays audio on the server. Implementations start playback and return
+// immediately; the returned Playback reports when the track has finished.
+type Output interface {
+	Play(item Item) (Playback, error)
+}
+
+// Playback is a track being played by an output
+type Playback interface {
+	// Position returns how far into the track playback is
+	Position() time.Duration
+	// Done is closed when the track has finished or playback was stopped
+	Done() <-chan struct{}
+	// Stop ends playback and waits for the output to release the track
+	Stop()
+}
+
+// NullOutput simulates playback without producing any sound. Tracks "play" in
+// real time for their duration, which makes it useful for tests and for
+// servers without an audio device.
+type NullOutput struct{}
+
+// NewNullOutput creates a new null output
+func NewNullOutput() *NullOutput {
+	return &NullOutput{}
+}
+
+// Play starts simulated playback of an item
+func (o *NullOutput) Play(item Item) (Playback, error) {
+	remaining := item.Duration - item.Offset
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	playback := &nullPlayback{
+		started: time.Now(),
+		offset:  item.Offset,
+		done:    make(chan struct{}),
+	}
+	playback.timer = time.AfterFunc(remaining, playback.finish)
+	return playback, nil
+}
+
+type nullPlayback struct {
+	started time.Time
+	offset  time.Duration
+	timer   *time.Timer
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (p *nullPlayback) Position() time.Duration {
+	return p.offset + time.Since(p.started)
+}
+
+func (p *nullPlayback) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *nullPlayback) Stop() {
+	p.timer.Stop()
+	p.finish()
+}
+
+func (p *nullPlayback) finish() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// FFmpegOutput plays tracks by decoding them with ffmpeg straight to an audio
+// device (format "alsa", device e.g. "default" or "hw:1,0") or to a file or
+// FIFO (e.g. format "s16le" with a FIFO read by a multi-room audio server)
+type FFmpegOutput struct {
+	ffmpegPath string
+	format     string
+	device     string
+}
+
+// NewFFmpegOutput creates a new ffmpeg output
+func NewFFmpegOutput(ffmpegPath, format, device string) *FFmpegOutput {
+	return &FFmpegOutput{
+		ffmpegPath: ffmpegPath,
+		format:     format,
+		device:     device,
+	}
+}
+
+// Args builds the ffmpeg arguments used to play an item
+func (o *FFmpegOutput) Args(item Item) []string {
+	args := []string{"-v", "error", "-nostdin"}
+	if o.format != "alsa" {
+		// Pipes accept data faster than real time; read at the native rate so
+		// the reported position follows what is heard
+		args = append(args, "-re")
+	}
+	if item.Offset > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(item.Offset.Seconds(), 'f', 3, 64))
+	}
+	args = append(args,
+		"-i", item.Path,
+		"-vn",
+		"-af", fmt.Sprintf("volume=%.3f", item.Gain),
+		"-f", o.format,
+	)
+	if o.format != "alsa" {
+		args = append(args, "-ar", "48000", "-ac", "2", "-y")
+	}
+	return append(args, o.device)
+}
+
+// Play starts ffmpeg for an item
+func (o *FFmpegOutput) Play(item Item) (Playback, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, o.ffmpegPath, o.Args(item)...)
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	playback := &ffmpegPlayback{
+		started: time.Now(),
+		offset:  item.Offset,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		cancel()
+		close(playback.done)
+	}()
+	return playback, nil
+}
+
+type ffmpegPlayback struct {
+	started time.Time
+	offset  time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (p *ffmpegPlayback) Position() time.Duration {
+	return p.offset + time.Since(p.started)
+}
+
+func (p *ffmpegPlayback) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *ffmpegPlayback) Stop() {
+	p.cancel()
+	<-p.done
+}
@@ -0,0 +1,138 @@
+package loudness
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"melodee/internal/models"
+)
+
+// ReferenceLoudness is the ReplayGain 2.0 target, in LUFS
+const ReferenceLoudness = -18.0
+
+// Transcode gain modes, see config.LoudnessConfig.TranscodeGain
+const (
+	GainOff   = "off"
+	GainTrack = "track"
+	GainAlbum = "album"
+)
+
+// Measurement is the EBU R128 loudness of a track or album
+type Measurement struct {
+	Loudness float64 // integrated loudness, LUFS
+	Peak     float64 // true peak, 1.0 is full scale
+}
+
+// Gain returns the ReplayGain, in dB, that brings the measured audio to ReferenceLoudness
+func (m Measurement) Gain() float64 {
+	return round(ReferenceLoudness-m.Loudness, 2)
+}
+
+// ParseSummary reads the summary ffmpeg's ebur128 filter logs when it finishes
+//
+//	Integrated loudness:
+//	  I:         -15.2 LUFS
+//	...
+//	True peak:
+//	  Peak:        0.4 dBFS
+func ParseSummary(output string) (Measurement, error) {
+	start := strings.LastIndex(output, "Summary:")
+	if start < 0 {
+		return Measurement{}, fmt.Errorf("no ebur128 summary in ffmpeg output")
+	}
+
+	var m Measurement
+	var haveLoudness bool
+	scanner := bufio.NewScanner(strings.NewReader(output[start:]))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "I:":
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return Measurement{}, fmt.Errorf("invalid integrated loudness %q", fields[1])
+			}
+			m.Loudness, haveLoudness = value, true
+		case "Peak:":
+			// Silence has a peak of -inf dBFS, a linear peak of 0
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return Measurement{}, fmt.Errorf("invalid true peak %q", fields[1])
+			}
+			m.Peak = round(math.Pow(10, value/20), 6)
+		}
+	}
+	if !haveLoudness {
+		return Measurement{}, fmt.Errorf("no integrated loudness in ebur128 summary")
+	}
+	return m, nil
+}
+
+// Combine returns the loudness of tracks played one after another: the mean
+// of their power weighted by duration, and the highest peak. Tracks without a
+// duration count as equally long.
+func Combine(tracks []Measurement, durations []int64) Measurement {
+	var power, total float64
+	var combined Measurement
+	for i, track := range tracks {
+		weight := 1.0
+		if i < len(durations) && durations[i] > 0 {
+			weight = float64(durations[i])
+		}
+		power += weight * math.Pow(10, track.Loudness/10)
+		total += weight
+		combined.Peak = max(combined.Peak, track.Peak)
+	}
+	if total == 0 || power == 0 {
+		combined.Loudness = math.Inf(-1)
+		return combined
+	}
+	combined.Loudness = 10 * math.Log10(power/total)
+	return combined
+}
+
+// PlaybackGain returns the gain, in dB, to apply to a track when transcoding
+// in the given mode. Album gain falls back to track gain, and the gain is
+// lowered so the peak doesn't clip. Tracks that haven't been analyzed get 0.
+func PlaybackGain(track *models.Track, mode string) float64 {
+	gain, peak := track.ReplayGainTrackGain, track.ReplayGainTrackPeak
+	switch mode {
+	case GainAlbum:
+		if track.ReplayGainAlbumGain != nil {
+			gain, peak = track.ReplayGainAlbumGain, track.ReplayGainAlbumPeak
+		}
+	case GainTrack:
+	default:
+		return 0
+	}
+	if gain == nil {
+		return 0
+	}
+
+	applied := *gain
+	if peak != nil && *peak > 0 {
+		applied = min(applied, -20*math.Log10(*peak))
+	}
+	return round(applied, 2)
+}
+
+// FormatGain formats a gain the way ReplayGain tags hold it, e.g. "-6.52 dB"
+func FormatGain(gain float64) string {
+	return strconv.FormatFloat(gain, 'f', 2, 64) + " dB"
+}
+
+// FormatPeak formats a peak the way ReplayGain tags hold it, e.g. "0.988553"
+func FormatPeak(peak float64) string {
+	return strconv.FormatFloat(peak, 'f', 6, 64)
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
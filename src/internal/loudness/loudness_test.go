@@ -0,0 +1,89 @@
+package loudness
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"melodee/internal/models"
+)
+
+const ebur128Output = `Input #0, flac, from 'song.flac':
+  Duration: 00:03:12.45, start: 0.000000, bitrate: 912 kb/s
+  Stream #0:0: Audio: flac, 44100 Hz, stereo, s16
+Stream mapping:
+  Stream #0:0 -> #0:0 (flac (native) -> pcm_s16le (native))
+[Parsed_ebur128_0 @ 0x5581c2f0a040] Summary:
+
+  Integrated loudness:
+    I:         -11.5 LUFS
+    Threshold: -21.7 LUFS
+
+  Loudness range:
+    LRA:         5.8 LU
+    Threshold: -31.8 LUFS
+    LRA low:   -15.4 LUFS
+    LRA high:   -9.6 LUFS
+
+  True peak:
+    Peak:        0.3 dBFS
+`
+
+func TestParseSummary(t *testing.T) {
+	m, err := ParseSummary(ebur128Output)
+	require.NoError(t, err)
+	assert.Equal(t, -11.5, m.Loudness)
+	assert.InDelta(t, 1.035142, m.Peak, 1e-6)
+	assert.Equal(t, -6.5, m.Gain())
+
+	m, err = ParseSummary("Summary:\n  Integrated loudness:\n    I:         -70.0 LUFS\n  True peak:\n    Peak:       -inf dBFS\n")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, m.Peak, "silence")
+
+	_, err = ParseSummary("Stream mapping:\n")
+	assert.Error(t, err)
+}
+
+func TestCombine(t *testing.T) {
+	// Equal loudness stays the same whatever the durations
+	m := Combine([]Measurement{{Loudness: -10, Peak: 0.9}, {Loudness: -10, Peak: 1.1}}, []int64{1000, 3000})
+	assert.InDelta(t, -10, m.Loudness, 1e-9)
+	assert.Equal(t, 1.1, m.Peak)
+
+	// A quiet track pulls the album down by its share of the power
+	m = Combine([]Measurement{{Loudness: -10}, {Loudness: -20}}, []int64{1000, 1000})
+	assert.InDelta(t, 10*math.Log10((0.1+0.01)/2), m.Loudness, 1e-9)
+
+	// Longer tracks weigh more
+	long := Combine([]Measurement{{Loudness: -10}, {Loudness: -20}}, []int64{9000, 1000})
+	assert.Greater(t, long.Loudness, m.Loudness)
+}
+
+func TestPlaybackGain(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	track := &models.Track{
+		ReplayGainTrackGain: f(-6.5),
+		ReplayGainTrackPeak: f(1.03),
+		ReplayGainAlbumGain: f(-7.25),
+		ReplayGainAlbumPeak: f(1.1),
+	}
+	assert.Equal(t, 0.0, PlaybackGain(track, GainOff))
+	assert.Equal(t, 0.0, PlaybackGain(track, ""))
+	assert.Equal(t, -6.5, PlaybackGain(track, GainTrack))
+	assert.Equal(t, -7.25, PlaybackGain(track, GainAlbum))
+
+	// Positive gain is limited by the peak
+	quiet := &models.Track{ReplayGainTrackGain: f(9), ReplayGainTrackPeak: f(0.5)}
+	assert.Equal(t, 6.02, PlaybackGain(quiet, GainTrack))
+	assert.Equal(t, 6.02, PlaybackGain(quiet, GainAlbum), "falls back to track gain")
+
+	assert.Equal(t, 0.0, PlaybackGain(&models.Track{}, GainAlbum), "not analyzed")
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "-6.52 dB", FormatGain(-6.52))
+	assert.Equal(t, "3.00 dB", FormatGain(3))
+	assert.Equal(t, "0.988553", FormatPeak(0.988553))
+}
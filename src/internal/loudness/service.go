@@ -0,0 +1,246 @@
+package loudness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/directory"
+	"melodee/internal/models"
+)
+
+// backfillBatch is how many albums are loaded per query
+const backfillBatch = 100
+
+// AlbumResult is the outcome of analyzing an album
+type AlbumResult struct {
+	Analyzed []int64 // tracks measured
+	Failed   int     // tracks that couldn't be measured
+	Album    *Measurement
+}
+
+// BackfillResult counts what a backfill did
+type BackfillResult struct {
+	Albums   int `json:"albums"`
+	Analyzed int `json:"analyzed"`
+	Failed   int `json:"failed"`
+}
+
+// Service measures track loudness and stores it as ReplayGain values
+type Service struct {
+	db         *gorm.DB
+	ffmpegPath string
+	cfg        config.LoudnessConfig
+	paths      *directory.LibraryPathResolver
+
+	// measure returns the loudness of an audio file from start, up to end
+	// when it is set
+	measure func(ctx context.Context, path string, start, end time.Duration) (Measurement, error)
+}
+
+// NewService creates a new loudness service that measures audio with ffmpeg
+func NewService(db *gorm.DB, ffmpegPath string, cfg config.LoudnessConfig) *Service {
+	s := &Service{
+		db:         db,
+		ffmpegPath: ffmpegPath,
+		cfg:        cfg,
+		paths:      directory.NewLibraryPathResolver(db, nil),
+	}
+	s.measure = s.measureFFmpeg
+	return s
+}
+
+// measureFFmpeg runs a file, or a segment of it, through ffmpeg's ebur128
+// filter. The file is only read; its audio is decoded and discarded.
+func (s *Service) measureFFmpeg(ctx context.Context, path string, start, end time.Duration) (Measurement, error) {
+	args := []string{"-hide_banner", "-nostats", "-nostdin"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start.Seconds(), 'f', -1, 64))
+	}
+	args = append(args, "-i", path, "-vn")
+	if end > start {
+		args = append(args, "-t", strconv.FormatFloat((end-start).Seconds(), 'f', -1, 64))
+	}
+	// framelog=verbose keeps the per-frame lines out of the info level log
+	args = append(args, "-af", "ebur128=peak=true:framelog=verbose", "-f", "null", "-")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+			output = output[i+1:]
+		}
+		return Measurement{}, fmt.Errorf("failed to measure %s: %v: %s", filepath.Base(path), err, output)
+	}
+	return ParseSummary(stderr.String())
+}
+
+// AnalyzeAlbum measures the tracks of an album and stores their track and
+// album ReplayGain values. Unless all is set, only tracks without values are
+// measured; the album values still cover every track measured so far.
+func (s *Service) AnalyzeAlbum(ctx context.Context, albumID int64, all bool) (AlbumResult, error) {
+	var result AlbumResult
+
+	var tracks []models.Track
+	if err := s.db.WithContext(ctx).Preload("Album").Where("album_id = ?", albumID).Order("id").Find(&tracks).Error; err != nil {
+		return result, fmt.Errorf("failed to load album tracks: %w", err)
+	}
+
+	var measured []Measurement
+	var durations []int64
+	var analyzed []*models.Track
+	for i := range tracks {
+		track := &tracks[i]
+		if !all && track.ReplayGainTrackGain != nil {
+			// Measured before: its loudness follows from its gain
+			measured = append(measured, Measurement{Loudness: ReferenceLoudness - *track.ReplayGainTrackGain, Peak: valueOf(track.ReplayGainTrackPeak)})
+			durations = append(durations, track.Duration)
+			analyzed = append(analyzed, track)
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		m, err := s.measureTrack(ctx, track)
+		if err != nil {
+			result.Failed++
+			continue
+		}
+		gain, peak := m.Gain(), m.Peak
+		if err := s.db.WithContext(ctx).Model(&models.Track{}).Where("id = ?", track.ID).Updates(map[string]interface{}{
+			"replaygain_track_gain": gain,
+			"replaygain_track_peak": peak,
+		}).Error; err != nil {
+			return result, fmt.Errorf("failed to save track loudness: %w", err)
+		}
+		track.ReplayGainTrackGain, track.ReplayGainTrackPeak = &gain, &peak
+		measured = append(measured, m)
+		durations = append(durations, track.Duration)
+		analyzed = append(analyzed, track)
+		result.Analyzed = append(result.Analyzed, track.ID)
+	}
+	if len(analyzed) == 0 {
+		return result, nil
+	}
+
+	album := Combine(measured, durations)
+	result.Album = &album
+	albumGain, albumPeak := album.Gain(), album.Peak
+	if math.IsInf(album.Loudness, 0) {
+		albumGain = 0
+	}
+	ids := make([]int64, len(analyzed))
+	for i, track := range analyzed {
+		ids[i] = track.ID
+		track.ReplayGainAlbumGain, track.ReplayGainAlbumPeak = &albumGain, &albumPeak
+	}
+	if err := s.db.WithContext(ctx).Model(&models.Track{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"replaygain_album_gain": albumGain,
+		"replaygain_album_peak": albumPeak,
+	}).Error; err != nil {
+		return result, fmt.Errorf("failed to save album loudness: %w", err)
+	}
+
+	if s.cfg.WriteTags && len(result.Analyzed) > 0 {
+		// The album values changed for every track, so every track is rewritten
+		for _, track := range analyzed {
+			if err := s.storeTagValues(ctx, track); err != nil {
+				return result, err
+			}
+		}
+		result.Analyzed = ids
+	}
+	return result, nil
+}
+
+func (s *Service) measureTrack(ctx context.Context, track *models.Track) (Measurement, error) {
+	path, err := s.paths.TrackPath(track)
+	if err != nil {
+		return Measurement{}, err
+	}
+	return s.measure(ctx, path,
+		time.Duration(track.StartOffset)*time.Millisecond, time.Duration(track.EndOffset)*time.Millisecond)
+}
+
+// storeTagValues copies a track's ReplayGain values into the tags metadata
+// writeback writes to its file
+func (s *Service) storeTagValues(ctx context.Context, track *models.Track) error {
+	values := map[string]interface{}{}
+	if len(track.Tags) > 0 {
+		if err := json.Unmarshal(track.Tags, &values); err != nil {
+			return fmt.Errorf("failed to read tags of track %d: %w", track.ID, err)
+		}
+	}
+	values["replaygain_track_gain"] = FormatGain(*track.ReplayGainTrackGain)
+	values["replaygain_track_peak"] = FormatPeak(valueOf(track.ReplayGainTrackPeak))
+	values["replaygain_album_gain"] = FormatGain(*track.ReplayGainAlbumGain)
+	values["replaygain_album_peak"] = FormatPeak(valueOf(track.ReplayGainAlbumPeak))
+
+	tags, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode tags of track %d: %w", track.ID, err)
+	}
+	if err := s.db.WithContext(ctx).Model(&models.Track{}).Where("id = ?", track.ID).Update("tags", tags).Error; err != nil {
+		return fmt.Errorf("failed to save tags of track %d: %w", track.ID, err)
+	}
+	return nil
+}
+
+// Backfill analyzes the albums that have tracks without ReplayGain values.
+// onAlbum, when set, is called with the result of each album.
+func (s *Service) Backfill(ctx context.Context, onAlbum func(albumID int64, result AlbumResult)) (BackfillResult, error) {
+	var result BackfillResult
+	var lastID int64
+	for {
+		var albumIDs []int64
+		err := s.db.WithContext(ctx).Model(&models.Track{}).
+			Where("album_id > ? AND replaygain_track_gain IS NULL", lastID).
+			Distinct("album_id").Order("album_id").Limit(backfillBatch).
+			Pluck("album_id", &albumIDs).Error
+		if err != nil {
+			return result, fmt.Errorf("failed to load albums to analyze: %w", err)
+		}
+		if len(albumIDs) == 0 {
+			return result, nil
+		}
+
+		for _, albumID := range albumIDs {
+			lastID = albumID
+			album, err := s.AnalyzeAlbum(ctx, albumID, false)
+			if err != nil {
+				return result, err
+			}
+			result.Albums++
+			result.Analyzed += len(album.Analyzed)
+			result.Failed += album.Failed
+			if onAlbum != nil {
+				onAlbum(albumID, album)
+			}
+		}
+	}
+}
+
+// WritesTags reports whether analyzed values are written into the files
+func (s *Service) WritesTags() bool {
+	return s.cfg.WriteTags
+}
+
+func valueOf(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
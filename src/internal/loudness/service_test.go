@@ -0,0 +1,162 @@
+package loudness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func setupLoudnessTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE libraries (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, path TEXT, type TEXT)`,
+		`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, library_id INTEGER, directory TEXT)`,
+		`CREATE TABLE tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			album_id INTEGER,
+			library_id INTEGER,
+			relative_path TEXT,
+			directory TEXT,
+			file_name TEXT,
+			duration INTEGER,
+			start_offset INTEGER DEFAULT 0,
+			end_offset INTEGER DEFAULT 0,
+			tags TEXT,
+			replaygain_track_gain REAL,
+			replaygain_track_peak REAL,
+			replaygain_album_gain REAL,
+			replaygain_album_peak REAL
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO libraries (id, name, path, type) VALUES (1, 'Production', '/music', 'production')`)
+	db.Exec(`INSERT INTO albums (id, name, library_id) VALUES (1, 'Loud', 1), (2, 'Quiet', 1)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, library_id, relative_path, duration, tags) VALUES
+		(1, 'One', 1, 1, 'loud/-10.flac', 200000, '{"genre": "Rock"}'),
+		(2, 'Two', 1, 1, 'loud/-14.flac', 200000, NULL),
+		(3, 'Three', 1, 1, 'loud/broken.flac', 200000, NULL),
+		(4, 'Four', 2, 1, 'quiet/-24.flac', 100000, NULL)`)
+	return db
+}
+
+// newTestService measures each file as the loudness in its name, e.g. "-10.flac"
+func newTestService(db *gorm.DB, cfg config.LoudnessConfig) (*Service, *[]string) {
+	s := NewService(db, "ffmpeg", cfg)
+	var measured []string
+	s.measure = func(ctx context.Context, path string, start, end time.Duration) (Measurement, error) {
+		measured = append(measured, filepath.Base(path))
+		loudness, err := strconv.ParseFloat(strings.TrimSuffix(filepath.Base(path), ".flac"), 64)
+		if err != nil {
+			return Measurement{}, fmt.Errorf("cannot decode %s", path)
+		}
+		return Measurement{Loudness: loudness, Peak: 0.5}, nil
+	}
+	return s, &measured
+}
+
+func loadTrack(t *testing.T, db *gorm.DB, id int64) models.Track {
+	var track models.Track
+	require.NoError(t, db.First(&track, id).Error)
+	return track
+}
+
+func TestService_AnalyzeAlbum(t *testing.T) {
+	ctx := context.Background()
+	db := setupLoudnessTestDB(t)
+	service, measured := newTestService(db, config.LoudnessConfig{})
+
+	result, err := service.AnalyzeAlbum(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, result.Analyzed)
+	assert.Equal(t, 1, result.Failed)
+
+	one := loadTrack(t, db, 1)
+	require.NotNil(t, one.ReplayGainTrackGain)
+	assert.Equal(t, -8.0, *one.ReplayGainTrackGain)
+	assert.Equal(t, 0.5, *one.ReplayGainTrackPeak)
+	two := loadTrack(t, db, 2)
+	assert.Equal(t, -4.0, *two.ReplayGainTrackGain)
+
+	// Both tracks carry the album gain, between their track gains
+	album := Combine([]Measurement{{Loudness: -10}, {Loudness: -14}}, []int64{200000, 200000})
+	assert.Equal(t, Measurement{Loudness: album.Loudness}.Gain(), *one.ReplayGainAlbumGain)
+	assert.Equal(t, *one.ReplayGainAlbumGain, *two.ReplayGainAlbumGain)
+	assert.Less(t, *one.ReplayGainAlbumGain, -4.0)
+	assert.Greater(t, *one.ReplayGainAlbumGain, -8.0)
+	assert.Nil(t, loadTrack(t, db, 3).ReplayGainTrackGain)
+	assert.JSONEq(t, `{"genre": "Rock"}`, string(one.Tags), "tags are left alone")
+
+	// Measured tracks are skipped unless the whole album is asked for
+	*measured = nil
+	result, err = service.AnalyzeAlbum(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Analyzed)
+	assert.Equal(t, []string{"broken.flac"}, *measured)
+
+	*measured = nil
+	result, err = service.AnalyzeAlbum(ctx, 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, result.Analyzed)
+	assert.Len(t, *measured, 3)
+}
+
+func TestService_AnalyzeAlbumWritesTags(t *testing.T) {
+	ctx := context.Background()
+	db := setupLoudnessTestDB(t)
+	service, _ := newTestService(db, config.LoudnessConfig{WriteTags: true})
+
+	result, err := service.AnalyzeAlbum(ctx, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, result.Analyzed)
+
+	var tags map[string]string
+	require.NoError(t, json.Unmarshal(loadTrack(t, db, 1).Tags, &tags))
+	assert.Equal(t, "Rock", tags["genre"])
+	assert.Equal(t, "-8.00 dB", tags["replaygain_track_gain"])
+	assert.Equal(t, "0.500000", tags["replaygain_track_peak"])
+	assert.Equal(t, FormatGain(*loadTrack(t, db, 1).ReplayGainAlbumGain), tags["replaygain_album_gain"])
+	assert.Equal(t, "0.500000", tags["replaygain_album_peak"])
+}
+
+func TestService_Backfill(t *testing.T) {
+	ctx := context.Background()
+	db := setupLoudnessTestDB(t)
+	service, measured := newTestService(db, config.LoudnessConfig{})
+
+	var albums []int64
+	result, err := service.Backfill(ctx, func(albumID int64, album AlbumResult) {
+		albums = append(albums, albumID)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Albums: 2, Analyzed: 3, Failed: 1}, result)
+	assert.Equal(t, []int64{1, 2}, albums)
+
+	four := loadTrack(t, db, 4)
+	assert.Equal(t, 6.0, *four.ReplayGainTrackGain)
+	assert.Equal(t, 6.0, *four.ReplayGainAlbumGain, "a one track album")
+
+	// Only the track that failed is tried again
+	*measured = nil
+	result, err = service.Backfill(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillResult{Albums: 1, Failed: 1}, result)
+	assert.Equal(t, []string{"broken.flac"}, *measured)
+}
@@ -0,0 +1,107 @@
+package loudness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+	"melodee/internal/media"
+)
+
+// Job types for Asynq
+const (
+	TypeLoudnessAnalyze = "loudness:analyze"
+)
+
+// AnalyzePayload represents the payload for loudness analysis jobs
+type AnalyzePayload struct {
+	AlbumIDs []int64 `json:"album_ids,omitempty"` // re-analyze these albums; empty analyzes every track without values
+}
+
+// NewAnalyzeTask creates a task that analyzes albums, or every track without
+// ReplayGain values when no albums are given
+func NewAnalyzeTask(albumIDs []int64) (*asynq.Task, error) {
+	payload, err := json.Marshal(AnalyzePayload{AlbumIDs: albumIDs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal loudness analyze payload: %w", err)
+	}
+	return asynq.NewTask(TypeLoudnessAnalyze, payload), nil
+}
+
+// EnqueueAnalyze creates and enqueues a loudness analysis
+func EnqueueAnalyze(client *asynq.Client, albumIDs []int64) error {
+	task, err := NewAnalyzeTask(albumIDs)
+	if err != nil {
+		return err
+	}
+
+	opts := []asynq.Option{asynq.Queue("maintenance"), asynq.Timeout(12 * time.Hour)}
+	if len(albumIDs) == 0 {
+		// One backfill at a time: one requested while another is queued or running is dropped
+		opts = append(opts, asynq.TaskID("loudness.backfill"))
+	}
+	_, err = client.Enqueue(task, opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue loudness analysis: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs loudness jobs
+type TaskHandler struct {
+	service *Service
+	client  *asynq.Client
+}
+
+// NewTaskHandler creates a new loudness task handler. The client queues the
+// metadata writeback of analyzed tracks when tags are written.
+func NewTaskHandler(service *Service, client *asynq.Client) *TaskHandler {
+	return &TaskHandler{service: service, client: client}
+}
+
+// HandleAnalyze measures the loudness of albums and stores their ReplayGain values
+func (h *TaskHandler) HandleAnalyze(ctx context.Context, t *asynq.Task) error {
+	var p AnalyzePayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal loudness analyze payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	started := time.Now()
+	var result BackfillResult
+	if len(p.AlbumIDs) == 0 {
+		var err error
+		result, err = h.service.Backfill(ctx, h.writeback)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, albumID := range p.AlbumIDs {
+			album, err := h.service.AnalyzeAlbum(ctx, albumID, true)
+			if err != nil {
+				return err
+			}
+			result.Albums++
+			result.Analyzed += len(album.Analyzed)
+			result.Failed += album.Failed
+			h.writeback(albumID, album)
+		}
+	}
+
+	logging.Infof("loudness: analyzed %d tracks of %d albums, %d could not be measured, in %s",
+		result.Analyzed, result.Albums, result.Failed, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// writeback queues the rewrite of an album's tags with its new values
+func (h *TaskHandler) writeback(albumID int64, album AlbumResult) {
+	if !h.service.WritesTags() || h.client == nil || len(album.Analyzed) == 0 {
+		return
+	}
+	if err := media.EnqueueMetadataWriteback(h.client, album.Analyzed); err != nil {
+		logging.Errorf("loudness: failed to queue tag writeback for album %d: %v", albumID, err)
+	}
+}
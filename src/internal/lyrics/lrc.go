@@ -0,0 +1,176 @@
+// Package lyrics stores track lyrics and reads them from embedded tags and
+// from .lrc and .txt sidecar files. Lyrics whose lines carry start times are
+// synced; everything else is kept as plain lines. A track has at most one
+// synced and one unsynced set of lyrics per language.
+package lyrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UnknownLanguage is the ISO 639-2 code for lyrics in an unknown language
+const UnknownLanguage = "xxx"
+
+// Line is a line of lyrics. Start, in milliseconds, is only set when synced.
+type Line struct {
+	Start *int64 `json:"start,omitempty"`
+	Value string `json:"value"`
+}
+
+// Lyrics are a track's lyrics in one language
+type Lyrics struct {
+	Lang   string
+	Synced bool
+	Offset int64 // milliseconds; positive shows lines sooner, as in LRC
+	Artist string
+	Title  string
+	Lines  []Line
+}
+
+var (
+	// lrcTimestamp is a line timestamp: [mm:ss], [mm:ss.xx] or [mm:ss.xxx]
+	lrcTimestamp = regexp.MustCompile(`^\[(\d+):(\d{1,2})(?:[.:](\d{1,3}))?\]`)
+	// lrcTag is an ID tag such as [ar:Artist] or [offset:+250]
+	lrcTag = regexp.MustCompile(`^\[([A-Za-z#]+):(.*)\]$`)
+	// lrcWordTimestamp is an enhanced LRC word timestamp, <mm:ss.xx>
+	lrcWordTimestamp = regexp.MustCompile(`<\d+:\d{1,2}(?:[.:]\d{1,3})?>`)
+)
+
+// lrcTags are the ID tags recognized; other bracketed lines ("[Chorus]",
+// "[Verse: Name]") are part of the lyrics
+var lrcTags = map[string]bool{
+	"ar": true, "al": true, "ti": true, "au": true, "by": true, "length": true,
+	"offset": true, "la": true, "lang": true, "re": true, "tool": true, "ve": true, "version": true, "#": true,
+}
+
+// Parse reads LRC or plain text lyrics. When any line is timestamped the
+// lyrics are synced and lines without a timestamp are dropped; a line with
+// several timestamps is repeated at each. Otherwise every line is kept, and
+// blank lines at the start and end are trimmed.
+func Parse(text string) Lyrics {
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+
+	var parsed Lyrics
+	var timed, plain []Line
+	for _, raw := range strings.Split(text, "\n") {
+		line := strings.TrimSpace(raw)
+
+		var starts []int64
+		for {
+			m := lrcTimestamp.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			starts = append(starts, timestampMillis(m[1], m[2], m[3]))
+			line = line[len(m[0]):]
+		}
+		if len(starts) > 0 {
+			value := strings.TrimSpace(lrcWordTimestamp.ReplaceAllString(line, ""))
+			for _, start := range starts {
+				start := start
+				timed = append(timed, Line{Start: &start, Value: value})
+			}
+			continue
+		}
+
+		if m := lrcTag.FindStringSubmatch(line); m != nil && lrcTags[strings.ToLower(m[1])] {
+			value := strings.TrimSpace(m[2])
+			switch strings.ToLower(m[1]) {
+			case "ar":
+				parsed.Artist = value
+			case "ti":
+				parsed.Title = value
+			case "la", "lang":
+				parsed.Lang = value
+			case "offset":
+				parsed.Offset, _ = strconv.ParseInt(strings.TrimPrefix(value, "+"), 10, 64)
+			}
+			continue
+		}
+		plain = append(plain, Line{Value: line})
+	}
+
+	if len(timed) > 0 {
+		sort.SliceStable(timed, func(i, j int) bool { return *timed[i].Start < *timed[j].Start })
+		parsed.Synced = true
+		parsed.Lines = timed
+	} else {
+		parsed.Lines = trimBlankLines(plain)
+	}
+	parsed.Lang = NormalizeLanguage(parsed.Lang)
+	return parsed
+}
+
+// Format writes lyrics as LRC when synced and as plain text otherwise, so
+// they can be edited and parsed back
+func Format(l Lyrics) string {
+	var b strings.Builder
+	if l.Synced {
+		if l.Artist != "" {
+			fmt.Fprintf(&b, "[ar:%s]\n", l.Artist)
+		}
+		if l.Title != "" {
+			fmt.Fprintf(&b, "[ti:%s]\n", l.Title)
+		}
+		if l.Lang != "" && l.Lang != UnknownLanguage {
+			fmt.Fprintf(&b, "[la:%s]\n", l.Lang)
+		}
+		if l.Offset != 0 {
+			fmt.Fprintf(&b, "[offset:%+d]\n", l.Offset)
+		}
+	}
+	for _, line := range l.Lines {
+		if l.Synced && line.Start != nil {
+			start := *line.Start
+			if start%10 == 0 {
+				fmt.Fprintf(&b, "[%02d:%02d.%02d]", start/60000, start/1000%60, start%1000/10)
+			} else {
+				// Keep millisecond precision, e.g. from ID3 SYLT frames
+				fmt.Fprintf(&b, "[%02d:%02d.%03d]", start/60000, start/1000%60, start%1000)
+			}
+		}
+		b.WriteString(line.Value)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// NormalizeLanguage lower-cases a language code, UnknownLanguage when empty
+func NormalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "" {
+		return UnknownLanguage
+	}
+	return lang
+}
+
+// timestampMillis converts LRC minutes, seconds and a fraction of one to
+// three digits into milliseconds
+func timestampMillis(minutes, seconds, fraction string) int64 {
+	m, _ := strconv.ParseInt(minutes, 10, 64)
+	s, _ := strconv.ParseInt(seconds, 10, 64)
+	ms := (m*60 + s) * 1000
+	if fraction != "" {
+		f, _ := strconv.ParseInt(fraction, 10, 64)
+		for i := len(fraction); i < 3; i++ {
+			f *= 10
+		}
+		ms += f
+	}
+	return ms
+}
+
+func trimBlankLines(lines []Line) []Line {
+	for len(lines) > 0 && lines[0].Value == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1].Value == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,61 @@
+package lyrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func starts(l Lyrics) []int64 {
+	var out []int64
+	for _, line := range l.Lines {
+		if line.Start != nil {
+			out = append(out, *line.Start)
+		}
+	}
+	return out
+}
+
+func TestParse_LRC(t *testing.T) {
+	parsed := Parse("\ufeff[ar:Artist]\r\n[ti:Title]\r\n[la:ENG]\r\n[offset:+250]\r\n" +
+		"[00:12.00]First line\r\n" +
+		"[00:17.5][01:02.345]Chorus\r\n" +
+		"Untimed line\r\n" +
+		"[00:15.20]<00:15.20>Word <00:15.80>by word\r\n" +
+		"[00:20.00]\r\n")
+
+	assert.True(t, parsed.Synced)
+	assert.Equal(t, "Artist", parsed.Artist)
+	assert.Equal(t, "Title", parsed.Title)
+	assert.Equal(t, "eng", parsed.Lang)
+	assert.Equal(t, int64(250), parsed.Offset)
+	assert.Equal(t, []int64{12000, 15200, 17500, 20000, 62345}, starts(parsed))
+
+	values := make([]string, len(parsed.Lines))
+	for i, line := range parsed.Lines {
+		values[i] = line.Value
+	}
+	assert.Equal(t, []string{"First line", "Word by word", "Chorus", "", "Chorus"}, values)
+}
+
+func TestParse_PlainText(t *testing.T) {
+	parsed := Parse("\n\n[Chorus]\nLine one\n\nLine two\n\n")
+
+	assert.False(t, parsed.Synced)
+	assert.Equal(t, UnknownLanguage, parsed.Lang)
+	assert.Empty(t, starts(parsed))
+	require.Len(t, parsed.Lines, 4)
+	assert.Equal(t, "[Chorus]", parsed.Lines[0].Value)
+	assert.Equal(t, "", parsed.Lines[2].Value)
+	assert.Equal(t, "Line two", parsed.Lines[3].Value)
+}
+
+func TestFormat_RoundTrips(t *testing.T) {
+	text := "[ar:Artist]\n[la:deu]\n[offset:-100]\n[00:01.50]Eins\n[01:02.345]Zwei\n"
+	parsed := Parse(text)
+
+	assert.Equal(t, text, Format(parsed))
+	assert.Equal(t, parsed, Parse(Format(parsed)))
+	assert.Equal(t, "Line one\nLine two\n", Format(Parse("Line one\nLine two")))
+}
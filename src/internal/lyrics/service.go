@@ -0,0 +1,239 @@
+package lyrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"melodee/internal/models"
+	"melodee/internal/scanner"
+)
+
+// Sources of stored lyrics
+const (
+	SourceEmbedded = "embedded"
+	SourceSidecar  = "sidecar"
+	SourceManual   = "manual"
+)
+
+// MaxSize caps how much of a lyrics file is read
+const MaxSize = 1 << 20
+
+// sidecarExtensions are the lyrics files looked for next to a track, most preferred first
+var sidecarExtensions = []string{".lrc", ".txt"}
+
+// Sidecars returns the lyrics files next to an audio file: the same name
+// with an .lrc or .txt extension, in any case, .lrc first
+func Sidecars(audioPath string) []string {
+	dir := filepath.Dir(audioPath)
+	base := strings.TrimSuffix(filepath.Base(audioPath), filepath.Ext(audioPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var found []string
+	for _, ext := range sidecarExtensions {
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.EqualFold(filepath.Ext(name), ext) {
+				continue
+			}
+			if strings.TrimSuffix(name, filepath.Ext(name)) == base {
+				found = append(found, filepath.Join(dir, name))
+			}
+		}
+	}
+	return found
+}
+
+// Service stores and imports track lyrics
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new lyrics service
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db}
+}
+
+// ForTrack returns a track's lyrics, synced ones first
+func (s *Service) ForTrack(ctx context.Context, trackID int64) ([]models.Lyrics, error) {
+	var records []models.Lyrics
+	err := s.db.WithContext(ctx).
+		Where("track_id = ?", trackID).
+		Order("synced DESC, lang, id").
+		Find(&records).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lyrics: %w", err)
+	}
+	return records, nil
+}
+
+// Save stores lyrics for a track, replacing those with the same language and
+// kind (synced or not)
+func (s *Service) Save(ctx context.Context, trackID int64, l Lyrics, source string) (*models.Lyrics, error) {
+	lines, err := json.Marshal(l.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode lyrics: %w", err)
+	}
+	record := models.Lyrics{
+		TrackID:       trackID,
+		Lang:          NormalizeLanguage(l.Lang),
+		Synced:        l.Synced,
+		Offset:        l.Offset,
+		DisplayArtist: l.Artist,
+		DisplayTitle:  l.Title,
+		Lines:         lines,
+		Source:        source,
+		UpdatedAt:     time.Now(),
+	}
+
+	db := s.db.WithContext(ctx)
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "track_id"}, {Name: "lang"}, {Name: "synced"}},
+		DoUpdates: clause.AssignmentColumns([]string{"offset", "display_artist", "display_title", "lines", "source", "updated_at"}),
+	}).Create(&record).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save lyrics: %w", err)
+	}
+
+	// The ID of a replaced row isn't returned by every database
+	var saved models.Lyrics
+	err = db.Where("track_id = ? AND lang = ? AND synced = ?", trackID, record.Lang, record.Synced).First(&saved).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saved lyrics: %w", err)
+	}
+	return &saved, nil
+}
+
+// Delete removes one set of a track's lyrics
+func (s *Service) Delete(ctx context.Context, trackID, lyricsID int64) error {
+	result := s.db.WithContext(ctx).Where("id = ? AND track_id = ?", lyricsID, trackID).Delete(&models.Lyrics{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete lyrics: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Import reads the lyrics embedded in an audio file and in its sidecar
+// files and stores them for the track. Sidecars win over embedded lyrics of
+// the same language and kind; lyrics entered by hand are never replaced.
+// It returns how many sets of lyrics were stored.
+func (s *Service) Import(ctx context.Context, trackID int64, audioPath string) (int, error) {
+	type found struct {
+		lyrics Lyrics
+		source string
+	}
+	var all []found
+
+	if tags, err := scanner.ReadTags(audioPath); err == nil {
+		for _, tagged := range tags.Lyrics {
+			l := Parse(tagged.Text)
+			if l.Lang == UnknownLanguage && tagged.Lang != "" {
+				l.Lang = tagged.Lang
+			}
+			all = append(all, found{l, SourceEmbedded})
+		}
+	}
+	for _, path := range Sidecars(audioPath) {
+		text, err := readSidecar(path)
+		if err != nil {
+			return 0, err
+		}
+		all = append(all, found{Parse(text), SourceSidecar})
+	}
+
+	existing, err := s.ForTrack(ctx, trackID)
+	if err != nil {
+		return 0, err
+	}
+	manual := make(map[string]bool)
+	for _, record := range existing {
+		if record.Source == SourceManual {
+			manual[lyricsKey(record.Lang, record.Synced)] = true
+		}
+	}
+
+	// Later entries replace earlier ones with the same key
+	chosen := make(map[string]found)
+	for _, f := range all {
+		if len(f.lyrics.Lines) == 0 || manual[lyricsKey(f.lyrics.Lang, f.lyrics.Synced)] {
+			continue
+		}
+		chosen[lyricsKey(f.lyrics.Lang, f.lyrics.Synced)] = f
+	}
+	keys := make([]string, 0, len(chosen))
+	for key := range chosen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := s.Save(ctx, trackID, chosen[key].lyrics, chosen[key].source); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Decode returns stored lyrics with their lines
+func Decode(record models.Lyrics) (Lyrics, error) {
+	l := Lyrics{
+		Lang:   record.Lang,
+		Synced: record.Synced,
+		Offset: record.Offset,
+		Artist: record.DisplayArtist,
+		Title:  record.DisplayTitle,
+	}
+	if len(record.Lines) > 0 {
+		if err := json.Unmarshal(record.Lines, &l.Lines); err != nil {
+			return l, fmt.Errorf("failed to decode lyrics %d: %w", record.ID, err)
+		}
+	}
+	return l, nil
+}
+
+func lyricsKey(lang string, synced bool) string {
+	return fmt.Sprintf("%s/%t", lang, synced)
+}
+
+// readSidecar reads a lyrics file of up to MaxSize bytes
+func readSidecar(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open lyrics file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, MaxSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read lyrics file: %w", err)
+	}
+	return DecodeText(data), nil
+}
+
+// DecodeText reads lyrics text as UTF-8, treating anything else as Latin-1
+func DecodeText(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
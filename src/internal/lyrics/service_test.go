@@ -0,0 +1,103 @@
+package lyrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupLyricsTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE lyrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		track_id INTEGER NOT NULL,
+		lang TEXT NOT NULL DEFAULT 'xxx',
+		synced BOOLEAN NOT NULL DEFAULT 0,
+		offset INTEGER NOT NULL DEFAULT 0,
+		display_artist TEXT,
+		display_title TEXT,
+		lines TEXT NOT NULL DEFAULT '[]',
+		source TEXT NOT NULL,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE (track_id, lang, synced)
+	)`).Error)
+	return db
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+}
+
+func TestSidecars(t *testing.T) {
+	dir := t.TempDir()
+	audio := filepath.Join(dir, "01 - Song.flac")
+	writeFile(t, audio, "")
+	writeFile(t, filepath.Join(dir, "01 - Song.TXT"), "")
+	writeFile(t, filepath.Join(dir, "01 - Song.lrc"), "")
+	writeFile(t, filepath.Join(dir, "02 - Other.lrc"), "")
+
+	assert.Equal(t, []string{
+		filepath.Join(dir, "01 - Song.lrc"),
+		filepath.Join(dir, "01 - Song.TXT"),
+	}, Sidecars(audio))
+}
+
+func TestService_Import(t *testing.T) {
+	ctx := context.Background()
+	db := setupLyricsTestDB(t)
+	service := NewService(db)
+
+	dir := t.TempDir()
+	audio := filepath.Join(dir, "song.mp3")
+	writeFile(t, audio, "not audio")
+	writeFile(t, filepath.Join(dir, "song.lrc"), "[la:eng]\n[00:01.00]First\n[00:02.00]Second\n")
+	// Latin-1 plain text
+	writeFile(t, filepath.Join(dir, "song.txt"), "[la:fra]\nCaf\xe9\n")
+
+	count, err := service.Import(ctx, 7, audio)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	records, err := service.ForTrack(ctx, 7)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.True(t, records[0].Synced)
+	assert.Equal(t, "eng", records[0].Lang)
+	assert.Equal(t, SourceSidecar, records[0].Source)
+
+	plain, err := Decode(records[1])
+	require.NoError(t, err)
+	assert.Equal(t, "fra", plain.Lang)
+	assert.Equal(t, []Line{{Value: "Café"}}, plain.Lines)
+
+	// Lyrics entered by hand survive a reimport
+	_, err = service.Save(ctx, 7, Parse("[la:eng]\n[00:03.00]Edited"), SourceManual)
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(dir, "song.lrc"), "[la:eng]\n[00:01.00]Changed\n")
+
+	count, err = service.Import(ctx, 7, audio)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	records, err = service.ForTrack(ctx, 7)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	synced, err := Decode(records[0])
+	require.NoError(t, err)
+	assert.Equal(t, SourceManual, records[0].Source)
+	assert.Equal(t, "Edited", synced.Lines[0].Value)
+	assert.Equal(t, int64(3000), *synced.Lines[0].Start)
+
+	require.NoError(t, service.Delete(ctx, 7, records[0].ID))
+	assert.ErrorIs(t, service.Delete(ctx, 7, records[0].ID), gorm.ErrRecordNotFound)
+}
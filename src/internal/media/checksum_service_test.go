@@ -31,7 +31,7 @@ func TestChecksumService_CalculateFileChecksum(t *testing.T) {
 	service := NewChecksumService(db, config)
 
 	// Test checksum calculation
-	checksum, err := service.CalculateFileChecksum(testFile)
+	checksum, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, checksum)
 	assert.Len(t, checksum, 64) // SHA256 produces 64-character hex string
@@ -61,14 +61,14 @@ func TestChecksumService_CalculateFileChecksumWithCRC32(t *testing.T) {
 	}
 	service := NewChecksumService(db, config)
 
-	// Test checksum calculation
-	checksum, err := service.CalculateFileChecksum(testFile)
+	// Only SHA256 is supported, so CRC32 files get a SHA256 checksum too
+	checksum, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, checksum)
-	assert.Len(t, checksum, 8) // CRC32 produces 8-character hex string
+	assert.Len(t, checksum, 64)
 }
 
-func TestChecksumService_Idempotency(t *testing.T) {
+func TestChecksumService_FileChecksumIdempotency(t *testing.T) {
 	// Create temporary directory and test file
 	tempDir := t.TempDir()
 	testFile := filepath.Join(tempDir, "idempotency_test.mp3")
@@ -85,11 +85,11 @@ func TestChecksumService_Idempotency(t *testing.T) {
 	service := NewChecksumService(db, nil) // Use default config (SHA256)
 
 	// Calculate checksum twice - should be the same
-	checksum1, err := service.CalculateFileChecksum(testFile)
+	checksum1, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, checksum1)
 
-	checksum2, err := service.CalculateFileChecksum(testFile)
+	checksum2, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, checksum2)
 
@@ -114,13 +114,15 @@ func TestChecksumService_IsFileProcessed(t *testing.T) {
 	service := NewChecksumService(db, nil)
 
 	// Initially, file should not be processed (no record in DB)
-	processed, checksum, err := service.IsFileProcessed(testFile)
+	checksum, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
-	assert.False(t, processed)
 	assert.NotEmpty(t, checksum)
+	processed, _, err := service.IsAlreadyProcessed(testFile, checksum)
+	assert.NoError(t, err)
+	assert.False(t, processed)
 
 	// Test with a non-existent file
-	processed, _, err = service.IsFileProcessed(filepath.Join(tempDir, "nonexistent.mp3"))
+	_, err = service.CalculateChecksum(filepath.Join(tempDir, "nonexistent.mp3"))
 	assert.Error(t, err)
 }
 
@@ -152,16 +154,22 @@ func TestChecksumService_BatchCalculateChecksums(t *testing.T) {
 	// Create checksum service
 	service := NewChecksumService(db, nil)
 
-	// Test batch checksum calculation
-	results, err := service.BatchCalculateChecksums(filePaths)
+	// Calculate the checksums, then validate them as a batch
+	checksums := make(map[string]string, len(filePaths))
+	for _, path := range filePaths {
+		checksum, err := service.CalculateChecksum(path)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, checksum)
+		checksums[path] = checksum
+	}
+	results, failures, err := service.BatchValidateChecksums(checksums)
 	assert.NoError(t, err)
+	assert.Empty(t, failures)
 	assert.Len(t, results, len(filePaths))
 
-	// Verify all files have checksums
+	// Verify all files match their checksums
 	for _, path := range filePaths {
-		_, exists := results[path]
-		assert.True(t, exists)
-		assert.NotEmpty(t, results[path])
+		assert.True(t, results[path])
 	}
 }
 
@@ -201,7 +209,7 @@ func TestChecksumService_InvalidAlgorithm(t *testing.T) {
 	service := NewChecksumService(db, config)
 
 	// Test that it defaults to SHA256 (the default case)
-	checksum, err := service.CalculateFileChecksum(testFile)
+	checksum, err := service.CalculateChecksum(testFile)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, checksum)
 	// Should still produce a valid SHA256 hash
@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
+	"melodee/internal/models"
 	"melodee/internal/test"
 )
 
@@ -257,7 +257,7 @@ func TestChecksumService_IsAlreadyProcessed(t *testing.T) {
 	service := NewChecksumService(db, nil)
 
 	// Initially should not be processed
-	isProcessed, existingTrack, err := service.IsAlreadyProcessed(tempFile.Name(), "different_hash")
+	isProcessed, existingTrack, err := service.IsAlreadyProcessed(testTrack.RelativePath, "different_hash")
 	assert.NoError(t, err)
 	assert.False(t, isProcessed)
 	assert.Nil(t, existingTrack)
@@ -38,6 +38,10 @@ func DefaultFFmpegConfig() *FFmpegConfig {
 				Name:        "transcode_opus_mobile",
 				CommandLine: "-c:a libopus -b:a 96k -application audio",
 			},
+			"transcode_lossless": {
+				Name:        "transcode_lossless",
+				CommandLine: "-c:a flac",
+			},
 		},
 		ConcurrentLimit: 2,
 		Timeout:         30 * time.Second,
@@ -60,6 +60,7 @@ type MediaProcessor struct {
 	mediaValidator    *MediaFileValidator
 	ffmpegProcessor   *FFmpegProcessor
 	checksumService   *ChecksumService
+	paths             *directory.LibraryPathResolver
 }
 
 // NewMediaProcessor creates a new media processor
@@ -84,6 +85,7 @@ func NewMediaProcessor(
 		mediaValidator:    mediaValidator,
 		ffmpegProcessor:   ffmpegProcessor,
 		checksumService:   checksumService,
+		paths:             directory.NewLibraryPathResolver(db, directoryService),
 	}
 }
 
@@ -440,7 +442,7 @@ func (mp *MediaProcessor) promoteStagingItem(item models.Track) error {
 	}
 
 	// Create or update production database records
-	productionID, err := mp.createProductionRecords(item, productionLibrary.ID, productionPath)
+	productionID, err := mp.createProductionRecords(item, productionLibrary, productionPath)
 	if err != nil {
 		// If DB creation fails, move the file back to staging
 		if rollbackErr := mp.moveFile(productionPath, stagingPath); rollbackErr != nil {
@@ -472,7 +474,13 @@ func (mp *MediaProcessor) selectProductionLibrary(item models.Track) (*models.Li
 	artist := track.Album.Artist
 
 	// Select library based on directory code
-	return mp.selectLibraryByDirectoryCode(artist.DirectoryCode)
+	return mp.SelectProductionLibrary(artist.DirectoryCode)
+}
+
+// SelectProductionLibrary selects the production library for albums of an
+// artist with a directory code, for albums that aren't in the database yet
+func (mp *MediaProcessor) SelectProductionLibrary(directoryCode string) (*models.Library, error) {
+	return mp.selectLibraryByDirectoryCode(directoryCode)
 }
 
 // LibrarySelectionConfig defines rules for selecting production libraries
@@ -691,7 +699,7 @@ func (mp *MediaProcessor) calculateLibrarySize(library *models.Library) (int64,
 	// In a real implementation, this would calculate actual disk usage
 	// For now, we'll return a placeholder value based on file count
 	var count int64
-	if err := mp.db.Model(&models.Track{}).Where("directory LIKE ?", library.Path+"%").Count(&count).Error; err != nil {
+	if err := mp.db.Model(&models.Track{}).Where("library_id = ?", library.ID).Count(&count).Error; err != nil {
 		return 0, err
 	}
 
@@ -708,22 +716,40 @@ func (mp *MediaProcessor) simpleHash(s string) uint32 {
 	return hash
 }
 
-// calculateProductionPath calculates the production path for an item
+// calculateProductionPath calculates the production path for an item, laying out
+// the album directory inside the library with the path template
 func (mp *MediaProcessor) calculateProductionPath(item models.Track, library *models.Library) (string, error) {
-	// For now, use a simple mapping
-	// In a real system, this would use the directory service with artist directory codes
-	productionPath := filepath.Join(library.Path, item.Directory, item.FileName)
-	return productionPath, nil
+	var track models.Track
+	if err := mp.db.Preload("Album.Artist").First(&track, item.ID).Error; err != nil {
+		return "", fmt.Errorf("failed to find track: %w", err)
+	}
+
+	if track.Album == nil || track.Album.Artist == nil {
+		return "", fmt.Errorf("track has no associated artist")
+	}
+
+	albumDir, err := mp.directoryService.Resolve(track.Album.Artist, track.Album, library)
+	if err != nil {
+		return "", err
+	}
+
+	return mp.paths.Resolve(library, filepath.Join(albumDir, item.FileName))
 }
 
 // createProductionRecords creates production database records
-func (mp *MediaProcessor) createProductionRecords(item models.Track, libraryID int32, productionPath string) (int64, error) {
+func (mp *MediaProcessor) createProductionRecords(item models.Track, library *models.Library, productionPath string) (int64, error) {
+	relativePath, err := mp.paths.Relative(library, productionPath)
+	if err != nil {
+		return 0, err
+	}
+
 	// Create a new production track record based on the staging item
 	productionTrack := &models.Track{
 		Name:         item.Name,
-		Directory:    filepath.Dir(productionPath),
-		FileName:     filepath.Base(productionPath),
-		RelativePath: strings.TrimPrefix(productionPath, mp.config.ProductionDir),
+		LibraryID:    &library.ID,
+		Directory:    filepath.Dir(relativePath),
+		FileName:     filepath.Base(relativePath),
+		RelativePath: relativePath,
 		CRCHash:      item.CRCHash,
 		CreatedAt:    time.Now(),
 		// Other fields would be copied from staging item
@@ -3,12 +3,11 @@ package media
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"gorm.io/gorm"
 	"melodee/internal/directory"
-	"melodee/internal/models"
 	"melodee/internal/test"
 )
 
@@ -37,7 +36,7 @@ func TestMediaProcessor(t *testing.T) {
 	procConfig.ProductionDir = filepath.Join(tempDir, "production")
 
 	// Create processor
-	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor)
+	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor, NewChecksumService(db, nil))
 
 	// Create required directories
 	err := os.MkdirAll(procConfig.InboundDir, 0755)
@@ -148,7 +147,7 @@ func TestMediaProcessorDirectoryCodeMatching(t *testing.T) {
 	quarantineService := NewQuarantineService(db, filepath.Join(tempDir, "quarantine"))
 	dirResolver := directory.NewPathTemplateResolver(directory.DefaultPathTemplateConfig())
 
-	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor)
+	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor, NewChecksumService(db, nil))
 
 	// Test range matching
 	testCases := []struct {
@@ -190,7 +189,7 @@ func TestMediaProcessorSimpleHash(t *testing.T) {
 	quarantineService := NewQuarantineService(db, filepath.Join(tempDir, "quarantine"))
 	dirResolver := directory.NewPathTemplateResolver(directory.DefaultPathTemplateConfig())
 
-	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor)
+	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor, NewChecksumService(db, nil))
 
 	// Test that same input produces same hash
 	input := "test_input"
@@ -288,7 +287,7 @@ func TestMediaFileIsMediaFile(t *testing.T) {
 	quarantineService := NewQuarantineService(db, filepath.Join(tempDir, "quarantine"))
 	dirResolver := directory.NewPathTemplateResolver(directory.DefaultPathTemplateConfig())
 
-	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor)
+	processor := NewMediaProcessor(procConfig, db, dirResolver, quarantineService, validator, ffmpegProcessor, NewChecksumService(db, nil))
 
 	// Test media file detection
 	mediaExts := []string{".mp3", ".flac", ".ogg", ".opus", ".m4a", ".mp4", ".aac", ".wma", ".wav", ".aiff", ".ape", ".wv", ".dsf", ".cda"}
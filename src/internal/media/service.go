@@ -2,6 +2,7 @@ package media
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io/fs"
@@ -39,6 +40,14 @@ type LibraryScanPayload struct {
 	Force      bool    `json:"force"`
 }
 
+// StagingScanPayload represents the payload for staging scan jobs
+type StagingScanPayload struct {
+	Source    string   `json:"source"` // "staging_scan" for the cron, "file_watcher" for the watcher service
+	DryRun    bool     `json:"dry_run,omitempty"`
+	LibraryID int32    `json:"library_id,omitempty"`
+	Paths     []string `json:"paths,omitempty"` // Directories that changed, when triggered by the file watcher
+}
+
 // TaskHandler provides access to dependencies for task handlers
 type TaskHandler struct {
 	db                *gorm.DB
@@ -349,29 +358,10 @@ func HandleLibraryProcess(ctx context.Context, t *asynq.Task) error {
 	return nil
 }
 
-// LibraryMoveOKPayload represents the payload for promoting staging content to production
+// LibraryMoveOKPayload represents the payload for promoting approved staging
+// items to production. Jobs are handled by the promotion package.
 type LibraryMoveOKPayload struct {
-	AlbumID int64 `json:"album_id"`
-}
-
-// HandleLibraryMoveOK moves OK-status albums from staging to production
-func HandleLibraryMoveOK(ctx context.Context, t *asynq.Task) error {
-	var p LibraryMoveOKPayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal library move OK payload: %w", err)
-	}
-
-	log.Printf("Moving album ID: %d from staging to production", p.AlbumID)
-
-	// In a real implementation, this would:
-	// 1. Validate album is in OK status
-	// 2. Select appropriate production library based on directory code
-	// 3. Move files from staging to production location
-	// 4. Update database records
-
-	log.Printf("Album move completed for album ID: %d", p.AlbumID)
-
-	return nil
+	StagingItemIDs []int64 `json:"staging_item_ids,omitempty"` // empty promotes every approved item
 }
 
 // DirectoryRecalculatePayload represents the payload for directory code recalculation
@@ -401,46 +391,13 @@ type MetadataWritebackPayload struct {
 	TrackIDs []int64 `json:"track_ids"`
 }
 
-// HandleMetadataWriteback writes metadata changes back to files
-func HandleMetadataWriteback(ctx context.Context, t *asynq.Task) error {
-	var p MetadataWritebackPayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal metadata writeback payload: %w", err)
-	}
-
-	log.Printf("Writing back metadata for %d tracks", len(p.TrackIDs))
-
-	// In a real implementation, this would:
-	// 1. Fetch updated metadata from DB
-	// 2. Write it back to media files
-	// 3. Handle conflicts according to metadata rules
-
-	log.Printf("Metadata writeback completed for %d tracks", len(p.TrackIDs))
-
-	return nil
-}
-
-// MetadataEnhancePayload represents the payload for metadata enhancement
+// MetadataEnhancePayload represents the payload for metadata enhancement.
+// Jobs are handled by the enrichment package; an album job enriches the
+// album's artist too, and ArtistID alone enriches just the artist.
 type MetadataEnhancePayload struct {
-	AlbumID int64    `json:"album_id"`
-	Sources []string `json:"sources"`
-}
-
-// HandleMetadataEnhance enhances existing metadata with external sources
-func HandleMetadataEnhance(ctx context.Context, t *asynq.Task) error {
-	var p MetadataEnhancePayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal metadata enhance payload: %w", err)
-	}
-
-	log.Printf("Enhancing metadata for album ID: %d with sources: %v", p.AlbumID, p.Sources)
-
-	// In a real implementation, this would fetch metadata from external sources
-	// like MusicBrainz, LastFM, etc., and update the database
-
-	log.Printf("Metadata enhancement completed for album ID: %d", p.AlbumID)
-
-	return nil
+	AlbumID  int64    `json:"album_id"`
+	ArtistID int64    `json:"artist_id,omitempty"`
+	Sources  []string `json:"sources"`
 }
 
 // MediaService handles media processing operations
@@ -512,10 +469,11 @@ func (ms *MediaService) EnqueueLibraryProcess(client *asynq.Client, libraryID in
 	return nil
 }
 
-// EnqueueLibraryMoveOK creates and enqueues a library move OK job
-func (ms *MediaService) EnqueueLibraryMoveOK(client *asynq.Client, albumID int64) error {
+// EnqueueLibraryMoveOK creates and enqueues a library move OK job, which
+// promotes the given staging items, or every approved one when none are given
+func (ms *MediaService) EnqueueLibraryMoveOK(client *asynq.Client, stagingItemIDs []int64) error {
 	payload, err := json.Marshal(LibraryMoveOKPayload{
-		AlbumID: albumID,
+		StagingItemIDs: stagingItemIDs,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to marshal library move OK payload: %w", err)
@@ -524,7 +482,7 @@ func (ms *MediaService) EnqueueLibraryMoveOK(client *asynq.Client, albumID int64
 	task := asynq.NewTask(TypeLibraryMoveOK, payload)
 
 	// Use deduplication key
-	dedupKey := fmt.Sprintf("library.move_ok:%d", albumID)
+	dedupKey := fmt.Sprintf("library.move_ok:%v", stagingItemIDs)
 
 	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Timeout(30*time.Minute))
 	if err != nil {
@@ -558,6 +516,12 @@ func (ms *MediaService) EnqueueDirectoryRecalculate(client *asynq.Client, artist
 
 // EnqueueMetadataWriteback creates and enqueues a metadata writeback job
 func (ms *MediaService) EnqueueMetadataWriteback(client *asynq.Client, trackIDs []int64) error {
+	return EnqueueMetadataWriteback(client, trackIDs)
+}
+
+// EnqueueMetadataWriteback creates and enqueues a metadata writeback job for
+// jobs outside the media service
+func EnqueueMetadataWriteback(client *asynq.Client, trackIDs []int64) error {
 	payload, err := json.Marshal(MetadataWritebackPayload{
 		TrackIDs: trackIDs,
 	})
@@ -568,10 +532,16 @@ func (ms *MediaService) EnqueueMetadataWriteback(client *asynq.Client, trackIDs
 	task := asynq.NewTask(TypeMetadataWriteback, payload)
 
 	// Use deduplication key based on track IDs hash
-	// In a real implementation, we'd create a hash of the track IDs
-	dedupKey := fmt.Sprintf("metadata.writeback:%v", len(trackIDs)) // Simplified
+	dedupKey := fmt.Sprintf("metadata.writeback:%x", sha1.Sum(payload))
 
-	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Timeout(2*time.Minute))
+	// Each file may take as long as the tag writer allows, so a batch that is
+	// cut short isn't retried from its first track over and over
+	timeout := time.Duration(len(trackIDs)) * tagWriteTimeout
+	if timeout < 2*time.Minute {
+		timeout = 2 * time.Minute
+	}
+
+	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Timeout(timeout))
 	if err != nil {
 		return fmt.Errorf("failed to enqueue metadata writeback: %w", err)
 	}
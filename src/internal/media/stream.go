@@ -0,0 +1,329 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamFormat describes how the output of an encoder is muxed when written to a pipe
+type StreamFormat struct {
+	Muxer       string // ffmpeg -f value
+	Suffix      string // file suffix reported to clients and used for cache files
+	ContentType string
+}
+
+// streamFormats maps ffmpeg audio encoders to pipe friendly formats. MP4 based
+// containers need a seekable output, so AAC is streamed as ADTS.
+var streamFormats = map[string]StreamFormat{
+	"libmp3lame": {Muxer: "mp3", Suffix: "mp3", ContentType: "audio/mpeg"},
+	"libopus":    {Muxer: "ogg", Suffix: "opus", ContentType: "audio/ogg"},
+	"libvorbis":  {Muxer: "ogg", Suffix: "ogg", ContentType: "audio/ogg"},
+	"aac":        {Muxer: "adts", Suffix: "aac", ContentType: "audio/aac"},
+	"libfdk_aac": {Muxer: "adts", Suffix: "aac", ContentType: "audio/aac"},
+	"flac":       {Muxer: "flac", Suffix: "flac", ContentType: "audio/flac"},
+}
+
+// HasProfile reports whether a transcoding profile is configured
+func (fp *FFmpegProcessor) HasProfile(profileName string) bool {
+	_, exists := fp.config.Profiles[profileName]
+	return exists
+}
+
+// ProfileStreamFormat returns the stream format produced by a profile, based on its audio encoder
+func (fp *FFmpegProcessor) ProfileStreamFormat(profileName string) (StreamFormat, error) {
+	profile, exists := fp.config.Profiles[profileName]
+	if !exists {
+		return StreamFormat{}, fmt.Errorf("profile %s not found", profileName)
+	}
+
+	args := strings.Fields(profile.CommandLine)
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-c:a" || args[i] == "-acodec" || args[i] == "-codec:a" {
+			if format, ok := streamFormats[args[i+1]]; ok {
+				return format, nil
+			}
+			return StreamFormat{}, fmt.Errorf("profile %s uses encoder %s which cannot be streamed", profileName, args[i+1])
+		}
+	}
+	return StreamFormat{}, fmt.Errorf("profile %s does not set an audio encoder", profileName)
+}
+
+// ProfileForSuffix returns the name of a profile producing the given suffix
+// (e.g. "opus", "aac"), preferring the lowest bitrate profile when several match
+func (fp *FFmpegProcessor) ProfileForSuffix(suffix string) string {
+	best, bestRate := "", 0
+	for name := range fp.config.Profiles {
+		format, err := fp.ProfileStreamFormat(name)
+		if err != nil || format.Suffix != suffix {
+			continue
+		}
+		rate := fp.profileBitRate(name)
+		if best == "" || rate < bestRate || (rate == bestRate && name < best) {
+			best, bestRate = name, rate
+		}
+	}
+	return best
+}
+
+// profileBitRate returns the -b:a value of a profile in kbps, or 0 when it has none
+func (fp *FFmpegProcessor) profileBitRate(profileName string) int {
+	args := strings.Fields(fp.config.Profiles[profileName].CommandLine)
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-b:a" || args[i] == "-ab" {
+			rate, _ := strconv.Atoi(strings.TrimSuffix(strings.ToLower(args[i+1]), "k"))
+			return rate
+		}
+	}
+	return 0
+}
+
+// StreamArgs builds the ffmpeg arguments that transcode inputPath with the
+// profile in opts and write the result to stdout
+func (fp *FFmpegProcessor) StreamArgs(inputPath string, opts StreamOptions) ([]string, StreamFormat, error) {
+	format, err := fp.ProfileStreamFormat(opts.Profile)
+	if err != nil {
+		return nil, StreamFormat{}, err
+	}
+
+	args := []string{"-v", "error", "-nostdin"}
+	seek := opts.Start + time.Duration(opts.TimeOffset)*time.Second
+	if seek > 0 {
+		// Input seeking is fast and accurate for audio
+		args = append(args, "-ss", formatSeconds(seek))
+	}
+	args = append(args, "-i", inputPath)
+	if opts.End > 0 {
+		if opts.End <= seek {
+			return nil, StreamFormat{}, fmt.Errorf("time offset %ds is past the end of the track", opts.TimeOffset)
+		}
+		args = append(args, "-t", formatSeconds(opts.End-seek))
+	}
+	args = append(args, "-map", "0:a:0", "-map_metadata", "-1")
+	args = append(args, strings.Fields(fp.config.Profiles[opts.Profile].CommandLine)...)
+
+	// ffmpeg uses the last occurrence of an option, so the cap overrides the profile
+	if opts.MaxBitRate > 0 {
+		if profileRate := fp.profileBitRate(opts.Profile); profileRate == 0 || opts.MaxBitRate < profileRate {
+			args = append(args, "-b:a", fmt.Sprintf("%dk", opts.MaxBitRate))
+		}
+	}
+
+	if opts.Gain != 0 {
+		args = append(args, "-af", fmt.Sprintf("volume=%.2fdB", opts.Gain))
+	}
+
+	args = append(args, "-f", format.Muxer, "pipe:1")
+	return args, format, nil
+}
+
+// formatSeconds formats a duration as ffmpeg seconds, e.g. "30" or "187.24"
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// StreamOptions controls an on-the-fly transcode
+type StreamOptions struct {
+	Profile    string
+	MaxBitRate int     // kbps, 0 keeps the profile bitrate
+	TimeOffset int     // seconds to skip at the start of the input
+	Gain       float64 // dB added to the volume, such as to apply ReplayGain; 0 leaves it as it is
+
+	// Start and End limit the input to a segment, such as a cue sheet track.
+	// TimeOffset counts from Start; an End of zero is the end of the input.
+	Start time.Duration
+	End   time.Duration
+}
+
+// TranscodeStream is the output of a running or cached transcode. Closing it
+// stops ffmpeg if the client went away before the end of the stream.
+type TranscodeStream struct {
+	io.ReadCloser
+	Format StreamFormat
+	Cached bool // served from the transcode cache
+}
+
+// HasProfile reports whether a transcoding profile is configured
+func (ts *TranscodeService) HasProfile(profileName string) bool {
+	return ts.processor.HasProfile(profileName)
+}
+
+// ProfileForSuffix returns the name of a profile producing the given suffix, or ""
+func (ts *TranscodeService) ProfileForSuffix(suffix string) string {
+	return ts.processor.ProfileForSuffix(suffix)
+}
+
+// ProfileStreamFormat returns the stream format produced by a profile
+func (ts *TranscodeService) ProfileStreamFormat(profileName string) (StreamFormat, error) {
+	return ts.processor.ProfileStreamFormat(profileName)
+}
+
+// Stream starts transcoding inputPath and returns the output as it is produced.
+// Complete streams from the start of the file are teed into the transcode
+// cache, so the next request for the same rendition is served from disk.
+func (ts *TranscodeService) Stream(inputPath string, opts StreamOptions) (*TranscodeStream, error) {
+	args, format, err := ts.processor.StreamArgs(inputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seeked streams are partial renditions and are never cached
+	var cacheKey string
+	if opts.TimeOffset <= 0 {
+		// Renditions with a gain applied, and segments of the input, are
+		// cached apart from the plain one
+		keyProfile := opts.Profile
+		if opts.Gain != 0 {
+			keyProfile = fmt.Sprintf("%s_gain%.2f", keyProfile, opts.Gain)
+		}
+		if opts.Start > 0 || opts.End > 0 {
+			keyProfile = fmt.Sprintf("%s_%d-%d", keyProfile, opts.Start.Milliseconds(), opts.End.Milliseconds())
+		}
+		cacheKey, err = ts.generateCacheKey(inputPath, keyProfile, opts.MaxBitRate, format.Suffix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate cache key: %w", err)
+		}
+
+		if cachedPath, exists := ts.cache.Get(cacheKey); exists {
+			if file, err := os.Open(cachedPath); err == nil {
+				ts.cache.UpdateAccessTime(cacheKey)
+				return &TranscodeStream{ReadCloser: file, Format: format, Cached: true}, nil
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, ts.processor.config.FFmpegPath, args...)
+	stream := &teeStream{cmd: cmd, cancel: cancel}
+	cmd.Stderr = &stream.stderr
+	// Don't let a stray child holding stderr open block Close after a cancel
+	cmd.WaitDelay = 5 * time.Second
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create ffmpeg pipe: %w", err)
+	}
+	stream.stdout = stdout
+
+	if cacheKey != "" {
+		if tmp, err := os.CreateTemp(ts.cache.cacheDir, cacheKey+".*.tmp"); err == nil {
+			stream.cacheFile = tmp
+			stream.commit = func(tmpPath string) {
+				ts.commitStream(cacheKey, inputPath, opts.Profile, format.Suffix, opts.MaxBitRate, tmpPath)
+			}
+		} else {
+			fmt.Printf("Warning: transcode of %s will not be cached: %v\n", inputPath, err)
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		stream.discardCache()
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	return &TranscodeStream{ReadCloser: stream, Format: format}, nil
+}
+
+// commitStream moves a completely written stream into the cache
+func (ts *TranscodeService) commitStream(cacheKey, inputPath, profileName, suffix string, maxBitRate int, tmpPath string) {
+	// A concurrent request for the same rendition may have finished first
+	if _, exists := ts.cache.Get(cacheKey); exists {
+		os.Remove(tmpPath)
+		return
+	}
+
+	fileInfo, err := os.Stat(tmpPath)
+	if err != nil || fileInfo.Size() == 0 {
+		os.Remove(tmpPath)
+		return
+	}
+
+	if !ts.cache.WouldFit(fileInfo.Size()) {
+		ts.cache.EvictOldest(fileInfo.Size())
+	}
+
+	finalPath := filepath.Join(ts.cache.cacheDir, cacheKey+"."+suffix)
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	ts.cache.Add(cacheKey, inputPath, profileName, suffix, maxBitRate, finalPath)
+}
+
+// teeStream reads ffmpeg's stdout and copies it into a cache file as it goes
+type teeStream struct {
+	cmd       *exec.Cmd
+	cancel    context.CancelFunc
+	stdout    io.ReadCloser
+	stderr    bytes.Buffer
+	cacheFile *os.File
+	commit    func(tmpPath string)
+	eof       bool
+	closeOnce sync.Once
+}
+
+func (s *teeStream) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	if n > 0 && s.cacheFile != nil {
+		if _, werr := s.cacheFile.Write(p[:n]); werr != nil {
+			// A full cache disk must not interrupt playback
+			s.discardCache()
+		}
+	}
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// Close stops ffmpeg, waits for it and commits the cache file if the stream completed
+func (s *teeStream) Close() error {
+	var waitErr error
+	s.closeOnce.Do(func() {
+		if !s.eof {
+			// The client stopped reading; don't transcode the rest
+			s.cancel()
+		}
+		waitErr = s.cmd.Wait()
+		s.cancel()
+
+		if s.cacheFile == nil {
+			return
+		}
+		if s.eof && waitErr == nil {
+			tmpPath := s.cacheFile.Name()
+			if err := s.cacheFile.Close(); err == nil {
+				s.commit(tmpPath)
+			} else {
+				os.Remove(tmpPath)
+			}
+			s.cacheFile = nil
+			return
+		}
+		s.discardCache()
+	})
+
+	if waitErr != nil && s.eof {
+		return fmt.Errorf("ffmpeg transcoding failed: %w: %s", waitErr, strings.TrimSpace(s.stderr.String()))
+	}
+	return nil
+}
+
+func (s *teeStream) discardCache() {
+	if s.cacheFile == nil {
+		return
+	}
+	s.cacheFile.Close()
+	os.Remove(s.cacheFile.Name())
+	s.cacheFile = nil
+}
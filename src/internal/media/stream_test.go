@@ -0,0 +1,142 @@
+package media
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFFmpeg writes a script that copies the -i input to stdout, standing in
+// for ffmpeg so streaming and cache teeing can be tested without it
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "ffmpeg")
+	body := "#!/bin/sh\nwhile [ $# -gt 0 ]; do\n  if [ \"$1\" = \"-i\" ]; then exec cat \"$2\"; fi\n  shift\ndone\nexit 1\n"
+	require.NoError(t, os.WriteFile(script, []byte(body), 0755))
+	return script
+}
+
+func newStreamTestService(t *testing.T, ffmpegPath string) *TranscodeService {
+	t.Helper()
+	processor := NewFFmpegProcessor(&FFmpegConfig{
+		FFmpegPath: ffmpegPath,
+		Profiles: map[string]FFmpegProfile{
+			"transcode_mid":         {Name: "transcode_mid", CommandLine: "-c:a libmp3lame -b:a 192k -ar 44100 -ac 2"},
+			"transcode_opus_mobile": {Name: "transcode_opus_mobile", CommandLine: "-c:a libopus -b:a 96k -application audio"},
+		},
+		Timeout: 10 * time.Second,
+	})
+	service := NewTranscodeService(processor, t.TempDir(), 100*1024*1024)
+	t.Cleanup(service.cache.Close)
+	return service
+}
+
+func TestFFmpegProcessor_StreamArgs(t *testing.T) {
+	service := newStreamTestService(t, "ffmpeg")
+
+	args, format, err := service.processor.StreamArgs("/music/song.flac", StreamOptions{Profile: "transcode_mid", MaxBitRate: 128, TimeOffset: 30})
+	require.NoError(t, err)
+	assert.Equal(t, "mp3", format.Muxer)
+	assert.Equal(t, "audio/mpeg", format.ContentType)
+	assert.Equal(t, []string{
+		"-v", "error", "-nostdin", "-ss", "30", "-i", "/music/song.flac", "-map", "0:a:0", "-map_metadata", "-1",
+		"-c:a", "libmp3lame", "-b:a", "192k", "-ar", "44100", "-ac", "2",
+		"-b:a", "128k", "-f", "mp3", "pipe:1",
+	}, args)
+
+	// A cap above the profile bitrate leaves the profile alone
+	args, _, err = service.processor.StreamArgs("/music/song.flac", StreamOptions{Profile: "transcode_mid", MaxBitRate: 320})
+	require.NoError(t, err)
+	assert.NotContains(t, args, "320k")
+	assert.NotContains(t, args, "-ss")
+
+	// ReplayGain goes in as a volume filter
+	args, _, err = service.processor.StreamArgs("/music/song.flac", StreamOptions{Profile: "transcode_mid", Gain: -6.5})
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(args, " "), "-af volume=-6.50dB -f mp3 pipe:1")
+
+	// A cue sheet track is cut out of its file, and seeks count from its start
+	segment := StreamOptions{Profile: "transcode_mid", Start: 187240 * time.Millisecond, End: 412 * time.Second}
+	args, _, err = service.processor.StreamArgs("/music/image.flac", segment)
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(args, " "), "-ss 187.24 -i /music/image.flac -t 224.76 -map 0:a:0")
+	segment.TimeOffset = 20
+	args, _, err = service.processor.StreamArgs("/music/image.flac", segment)
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(args, " "), "-ss 207.24 -i /music/image.flac -t 204.76 -map 0:a:0")
+	segment.TimeOffset = 300
+	_, _, err = service.processor.StreamArgs("/music/image.flac", segment)
+	assert.Error(t, err, "seeking past the end of the track")
+
+	_, _, err = service.processor.StreamArgs("/music/song.flac", StreamOptions{Profile: "missing"})
+	assert.Error(t, err)
+
+	assert.Equal(t, "transcode_opus_mobile", service.ProfileForSuffix("opus"))
+	assert.Equal(t, "", service.ProfileForSuffix("aac"))
+}
+
+func TestTranscodeService_StreamTeesIntoCache(t *testing.T) {
+	service := newStreamTestService(t, fakeFFmpeg(t))
+
+	input := filepath.Join(t.TempDir(), "song.flac")
+	require.NoError(t, os.WriteFile(input, []byte("transcoded audio bytes"), 0644))
+
+	stream, err := service.Stream(input, StreamOptions{Profile: "transcode_mid", MaxBitRate: 128})
+	require.NoError(t, err)
+	assert.False(t, stream.Cached)
+
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	assert.Equal(t, "transcoded audio bytes", string(data))
+
+	// The completed stream is now served from the cache
+	cached, err := service.Stream(input, StreamOptions{Profile: "transcode_mid", MaxBitRate: 128})
+	require.NoError(t, err)
+	defer cached.Close()
+	assert.True(t, cached.Cached)
+	data, err = io.ReadAll(cached)
+	require.NoError(t, err)
+	assert.Equal(t, "transcoded audio bytes", string(data))
+
+	// Seeking produces a partial rendition that bypasses the cache
+	seeked, err := service.Stream(input, StreamOptions{Profile: "transcode_mid", MaxBitRate: 128, TimeOffset: 10})
+	require.NoError(t, err)
+	assert.False(t, seeked.Cached)
+	io.Copy(io.Discard, seeked)
+	require.NoError(t, seeked.Close())
+
+	// A segment of the file is a rendition of its own
+	segment, err := service.Stream(input, StreamOptions{Profile: "transcode_mid", MaxBitRate: 128, Start: time.Minute, End: 2 * time.Minute})
+	require.NoError(t, err)
+	assert.False(t, segment.Cached)
+	io.Copy(io.Discard, segment)
+	require.NoError(t, segment.Close())
+	assert.Equal(t, 2, service.cache.GetCacheStats()["file_count"])
+}
+
+func TestTranscodeService_AbandonedStreamIsNotCached(t *testing.T) {
+	service := newStreamTestService(t, fakeFFmpeg(t))
+
+	input := filepath.Join(t.TempDir(), "song.flac")
+	require.NoError(t, os.WriteFile(input, make([]byte, 1024*1024), 0644))
+
+	stream, err := service.Stream(input, StreamOptions{Profile: "transcode_mid"})
+	require.NoError(t, err)
+
+	buf := make([]byte, 16)
+	_, err = stream.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	assert.Equal(t, 0, service.cache.GetCacheStats()["file_count"])
+	entries, err := os.ReadDir(service.GetCacheDir())
+	require.NoError(t, err)
+	assert.Empty(t, entries, "partial cache files are removed")
+}
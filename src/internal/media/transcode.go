@@ -8,8 +8,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 // TranscodeCache manages cached transcoded files
@@ -102,16 +100,16 @@ func (ts *TranscodeService) TranscodeWithCache(inputPath string, profileName str
 		ts.cache.EvictOldest(fileInfo.Size())
 	}
 
-	// Add to cache
-	ts.cache.Add(cacheKey, inputPath, profileName, format, maxBitRate, outputPath)
-
 	// Rename temp file to final name to make it visible
 	finalPath := strings.TrimSuffix(outputPath, ".tmp."+format) + "." + format
 	if err := os.Rename(outputPath, finalPath); err != nil {
-		// If rename fails, still return the temp file
-		return outputPath, nil
+		// If rename fails, still cache and return the temp file
+		finalPath = outputPath
 	}
 
+	// Add to cache under the path the file actually has
+	ts.cache.Add(cacheKey, inputPath, profileName, format, maxBitRate, finalPath)
+
 	return finalPath, nil
 }
 
@@ -127,13 +125,13 @@ func (ts *TranscodeService) generateCacheKey(inputPath string, profileName strin
 	sourceInfo := fmt.Sprintf("%s-%d-%d", inputPath, fileInfo.ModTime().Unix(), fileInfo.Size())
 	sourceHash := fmt.Sprintf("%x", sha256.Sum256([]byte(sourceInfo)))
 
-	// Create cache key combining source hash, profile, and parameters
-	cacheKey := fmt.Sprintf("%s_%s_%d_%s_%s",
+	// Create cache key combining source hash, profile, and parameters. The key
+	// must be deterministic so repeated requests find the cached rendition.
+	cacheKey := fmt.Sprintf("%s_%s_%d_%s",
 		sourceHash[:16], // First 16 chars of source hash
 		profileName,
 		maxBitRate,
 		format,
-		uuid.New().String()[:8], // Add random component to prevent collisions
 	)
 
 	// Sanitize the key to be filesystem-safe
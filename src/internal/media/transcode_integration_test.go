@@ -1,8 +1,6 @@
 package media
 
 import (
-	"crypto/sha256"
-	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -169,22 +167,19 @@ func TestTranscodeServiceMaxBitRateLogic(t *testing.T) {
 	cacheDir := filepath.Join(tempDir, "cache")
 	service := NewTranscodeService(processor, cacheDir, 100*1024*1024)
 
-	// Test maxBitRate logic in transcodeFile
-	handler := &MediaHandler{
-		transcodeService: service,
-	}
+	// The stream handler picks the profile for a bitrate; each of them is
+	// transcoded with its bitrate here
 
-	// For bitrates > 256, should select "transcode_high"
-	_, err = handler.transcodeFile(testInputPath, 320, "mp3")
+	// For bitrates > 256, "transcode_high"
+	_, err = service.TranscodeWithCache(testInputPath, "transcode_high", 320, "mp3")
 	// This will fail without actual FFmpeg, but we're testing the profile selection logic in the implementation
-	// The implementation should map to appropriate profiles
 
-	// For bitrates < 128, should select "transcode_opus_mobile"
-	_, err2 := handler.transcodeFile(testInputPath, 96, "opus")
+	// For bitrates < 128, "transcode_opus_mobile"
+	_, err2 := service.TranscodeWithCache(testInputPath, "transcode_opus_mobile", 96, "opus")
 	// Same - testing the logic path
 
-	// For middle bitrates, should select default "transcode_mid"
-	_, err3 := handler.transcodeFile(testInputPath, 192, "mp3")
+	// For middle bitrates, the default "transcode_mid"
+	_, err3 := service.TranscodeWithCache(testInputPath, "transcode_mid", 192, "mp3")
 
 	// All should handle gracefully even without actual FFmpeg
 	_ = err
@@ -220,12 +215,8 @@ func TestTranscodeServiceFormatDetection(t *testing.T) {
 		cacheDir := filepath.Join(tempDir, "cache")
 		service := NewTranscodeService(processor, cacheDir, 100*1024*1024)
 
-		handler := &MediaHandler{
-			transcodeService: service,
-		}
-
 		// Test with empty format to trigger extension-based detection
-		_, err := handler.transcodeFile(testInputPath, 0, "")
+		_, err := service.TranscodeWithCache(testInputPath, "transcode_mid", 0, "")
 		// Format detection happens internally, so we're just ensuring no panic
 		_ = err
 	}
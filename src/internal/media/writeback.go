@@ -0,0 +1,420 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+
+	"melodee/internal/directory"
+	"melodee/internal/models"
+)
+
+// ErrUnsupportedTagContainer is returned for files whose tags cannot be rewritten
+var ErrUnsupportedTagContainer = errors.New("unsupported tag container")
+
+// TagContainer identifies the tag format of a media file
+type TagContainer string
+
+const (
+	ContainerID3    TagContainer = "id3"
+	ContainerVorbis TagContainer = "vorbis"
+	ContainerMP4    TagContainer = "mp4"
+)
+
+// tagFormats maps file extensions to their tag container and ffmpeg muxer
+var tagFormats = map[string]struct {
+	container TagContainer
+	muxer     string
+}{
+	".mp3":  {ContainerID3, "mp3"},
+	".flac": {ContainerVorbis, "flac"},
+	".ogg":  {ContainerVorbis, "ogg"},
+	".oga":  {ContainerVorbis, "ogg"},
+	".opus": {ContainerVorbis, "opus"},
+	".m4a":  {ContainerMP4, "ipod"},
+	".m4b":  {ContainerMP4, "ipod"},
+	".mp4":  {ContainerMP4, "mp4"},
+}
+
+// ContainerForFile returns the tag container used by a file, based on its extension
+func ContainerForFile(path string) (TagContainer, error) {
+	format, ok := tagFormats[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedTagContainer, filepath.Ext(path))
+	}
+	return format.container, nil
+}
+
+// TrackTags is the database state of a track as it is written into the file's tags
+type TrackTags struct {
+	Title               string
+	Artist              string
+	AlbumArtist         string
+	Album               string
+	TrackNumber         int
+	TrackTotal          int
+	DiscNumber          int
+	DiscTotal           int
+	Genre               string
+	ReleaseDate         string
+	Compilation         bool
+	Comment             string
+	ArtistMusicBrainzID string
+	ReplayGainTrackGain string
+	ReplayGainTrackPeak string
+	ReplayGainAlbumGain string
+	ReplayGainAlbumPeak string
+}
+
+// trackTagValues are the per-track values kept in Track.Tags that have no column of their own
+type trackTagValues struct {
+	DiscNumber          int    `json:"disc_number"`
+	DiscTotal           int    `json:"disc_total"`
+	TrackTotal          int    `json:"track_total"`
+	Genre               string `json:"genre"`
+	ReplayGainTrackGain string `json:"replaygain_track_gain"`
+	ReplayGainTrackPeak string `json:"replaygain_track_peak"`
+	ReplayGainAlbumGain string `json:"replaygain_album_gain"`
+	ReplayGainAlbumPeak string `json:"replaygain_album_peak"`
+}
+
+// TrackTagsFromModel builds the tags for a track. Album, Album.Artist and
+// Artist should be preloaded; missing relations leave their fields empty.
+func TrackTagsFromModel(track *models.Track) TrackTags {
+	tags := TrackTags{
+		Title:       track.Name,
+		TrackNumber: int(track.SortOrder),
+	}
+
+	var values trackTagValues
+	if len(track.Tags) > 0 {
+		if err := json.Unmarshal(track.Tags, &values); err != nil {
+			log.Printf("metadata writeback: ignoring unreadable tags for track %d: %v", track.ID, err)
+		}
+	}
+	tags.DiscNumber = values.DiscNumber
+	tags.DiscTotal = values.DiscTotal
+	tags.TrackTotal = values.TrackTotal
+	tags.Genre = values.Genre
+	tags.ReplayGainTrackGain = values.ReplayGainTrackGain
+	tags.ReplayGainTrackPeak = values.ReplayGainTrackPeak
+	tags.ReplayGainAlbumGain = values.ReplayGainAlbumGain
+	tags.ReplayGainAlbumPeak = values.ReplayGainAlbumPeak
+
+	if track.Artist != nil {
+		tags.Artist = track.Artist.Name
+		if track.Artist.MusicBrainzID != nil {
+			tags.ArtistMusicBrainzID = track.Artist.MusicBrainzID.String()
+		}
+	}
+
+	if album := track.Album; album != nil {
+		tags.Album = album.Name
+		tags.Compilation = album.IsCompilation
+		tags.Comment = album.Comment
+		if album.ReleaseDate != nil {
+			tags.ReleaseDate = album.ReleaseDate.Format("2006-01-02")
+		}
+		if tags.Genre == "" && len(album.Genres) > 0 {
+			tags.Genre = album.Genres[0]
+		}
+		if tags.TrackTotal == 0 {
+			tags.TrackTotal = int(album.TrackCountCached)
+		}
+		if album.Artist != nil {
+			tags.AlbumArtist = album.Artist.Name
+		}
+	}
+	if tags.AlbumArtist == "" {
+		tags.AlbumArtist = tags.Artist
+	}
+
+	return tags
+}
+
+// Metadata returns the ffmpeg metadata keys and values for the container,
+// following docs/METADATA_MAPPING.md. ffmpeg translates its generic keys into
+// the container's native names (title -> TIT2, ©nam, TITLE and so on). Fields
+// the database owns are always written, so an empty value removes the tag;
+// disc, MusicBrainz and ReplayGain values are only written when known, leaving
+// whatever the file already carries otherwise.
+func (t TrackTags) Metadata(container TagContainer) [][2]string {
+	metadata := [][2]string{
+		{"title", t.Title},
+		{"artist", t.Artist},
+		{"album_artist", t.AlbumArtist},
+		{"album", t.Album},
+		{"genre", t.Genre},
+		{"comment", t.Comment},
+		{"compilation", boolTag(t.Compilation)},
+	}
+	optional := func(key, value string) {
+		if value != "" {
+			metadata = append(metadata, [2]string{key, value})
+		}
+	}
+
+	switch container {
+	case ContainerID3:
+		metadata = append(metadata,
+			[2]string{"track", numberTag(t.TrackNumber, t.TrackTotal)},
+			[2]string{"TDRL", t.ReleaseDate},
+		)
+		optional("disc", numberTag(t.DiscNumber, t.DiscTotal))
+		optional("MusicBrainz Artist Id", t.ArtistMusicBrainzID) // written as TXXX
+		optional("REPLAYGAIN_TRACK_GAIN", t.ReplayGainTrackGain)
+		optional("REPLAYGAIN_TRACK_PEAK", t.ReplayGainTrackPeak)
+		optional("REPLAYGAIN_ALBUM_GAIN", t.ReplayGainAlbumGain)
+		optional("REPLAYGAIN_ALBUM_PEAK", t.ReplayGainAlbumPeak)
+	case ContainerVorbis:
+		metadata = append(metadata,
+			[2]string{"track", numberTag(t.TrackNumber, 0)},
+			[2]string{"TRACKTOTAL", numberTag(t.TrackTotal, 0)},
+			[2]string{"date", t.ReleaseDate},
+		)
+		optional("disc", numberTag(t.DiscNumber, 0))
+		optional("DISCTOTAL", numberTag(t.DiscTotal, 0))
+		optional("MUSICBRAINZ_ARTISTID", t.ArtistMusicBrainzID)
+		optional("REPLAYGAIN_TRACK_GAIN", t.ReplayGainTrackGain)
+		optional("REPLAYGAIN_TRACK_PEAK", t.ReplayGainTrackPeak)
+		optional("REPLAYGAIN_ALBUM_GAIN", t.ReplayGainAlbumGain)
+		optional("REPLAYGAIN_ALBUM_PEAK", t.ReplayGainAlbumPeak)
+	case ContainerMP4:
+		// ffmpeg cannot write freeform ----:com.apple.iTunes atoms, so the
+		// MusicBrainz and ReplayGain values already in the file are kept as they are
+		metadata = append(metadata,
+			[2]string{"track", numberTag(t.TrackNumber, t.TrackTotal)},
+			[2]string{"date", t.ReleaseDate},
+		)
+		optional("disc", numberTag(t.DiscNumber, t.DiscTotal))
+	}
+	return metadata
+}
+
+func numberTag(number, total int) string {
+	switch {
+	case number <= 0:
+		return ""
+	case total > 0:
+		return fmt.Sprintf("%d/%d", number, total)
+	default:
+		return strconv.Itoa(number)
+	}
+}
+
+func boolTag(value bool) string {
+	if value {
+		return "1"
+	}
+	return ""
+}
+
+// tagWriteTimeout is how long ffmpeg may take to rewrite one file
+const tagWriteTimeout = 5 * time.Minute
+
+// TagWriter rewrites the tags of media files with ffmpeg without re-encoding
+type TagWriter struct {
+	ffmpegPath string
+	timeout    time.Duration
+}
+
+// NewTagWriter creates a new tag writer
+func NewTagWriter(ffmpegPath string) *TagWriter {
+	if ffmpegPath == "" {
+		ffmpegPath = DefaultFFmpegConfig().FFmpegPath
+	}
+	return &TagWriter{
+		ffmpegPath: ffmpegPath,
+		timeout:    tagWriteTimeout,
+	}
+}
+
+// Args returns the ffmpeg arguments that copy input to output with new tags.
+// Every stream, the existing metadata and the chapters are copied, so tags
+// melodee does not manage, embedded artwork, chapters and gapless info
+// (LAME header, iTunSMPB and edit lists) survive the rewrite.
+func (w *TagWriter) Args(input, output string, tags TrackTags) ([]string, error) {
+	format, ok := tagFormats[strings.ToLower(filepath.Ext(input))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTagContainer, filepath.Ext(input))
+	}
+
+	args := []string{
+		"-v", "error", "-nostdin", "-y", "-i", input,
+		"-map", "0", "-c", "copy", "-map_metadata", "0", "-map_chapters", "0",
+	}
+	if format.container == ContainerID3 {
+		// TDRL is an ID3v2.4 frame
+		args = append(args, "-id3v2_version", "4")
+	}
+	for _, kv := range tags.Metadata(format.container) {
+		args = append(args, "-metadata", kv[0]+"="+kv[1])
+	}
+	return append(args, "-f", format.muxer, output), nil
+}
+
+// Write rewrites the tags of the file at path. The new file is written next to
+// the original and renamed over it, so a failed write leaves the original intact.
+func (w *TagWriter) Write(ctx context.Context, path string, tags TrackTags) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tagwrite")
+	args, err := w.Args(path, tmp, tags)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, w.ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed to write tags: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return fmt.Errorf("ffmpeg produced no output: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("ffmpeg produced an empty file")
+	}
+
+	if original, err := os.Stat(path); err == nil {
+		os.Chmod(tmp, original.Mode().Perm())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
+}
+
+// MetadataWritebackService writes track metadata from the database into media files
+type MetadataWritebackService struct {
+	db                *gorm.DB
+	writer            *TagWriter
+	paths             *directory.LibraryPathResolver
+	checksumService   *ChecksumService
+	quarantineService *QuarantineService
+}
+
+// NewMetadataWritebackService creates a new metadata writeback service
+func NewMetadataWritebackService(db *gorm.DB, writer *TagWriter, quarantineService *QuarantineService) *MetadataWritebackService {
+	return &MetadataWritebackService{
+		db:                db,
+		writer:            writer,
+		paths:             directory.NewLibraryPathResolver(db, nil),
+		checksumService:   NewChecksumService(db, &ChecksumConfig{Algorithm: "SHA256"}), // files change on every write, so nothing is cached
+		quarantineService: quarantineService,
+	}
+}
+
+// WriteTracks writes the current database state of the tracks into their files
+// and returns the number of tracks that failed. Files that cannot be rewritten
+// are quarantined with TagParseError.
+func (s *MetadataWritebackService) WriteTracks(ctx context.Context, trackIDs []int64) (int, error) {
+	var tracks []models.Track
+	if err := s.db.Preload("Album.Artist").Preload("Artist").Where("id IN ?", trackIDs).Find(&tracks).Error; err != nil {
+		return 0, fmt.Errorf("failed to load tracks: %w", err)
+	}
+	if len(tracks) < len(trackIDs) {
+		log.Printf("metadata writeback: %d of %d tracks no longer exist", len(trackIDs)-len(tracks), len(trackIDs))
+	}
+
+	failed := 0
+	for i := range tracks {
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+		if err := s.writeTrack(ctx, &tracks[i]); err != nil {
+			log.Printf("metadata writeback: track %d: %v", tracks[i].ID, err)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+func (s *MetadataWritebackService) writeTrack(ctx context.Context, track *models.Track) error {
+	path, err := s.paths.TrackPath(track)
+	if err != nil {
+		return err
+	}
+
+	if track.IsSegment() {
+		// The file's tags belong to every track of its cue sheet
+		log.Printf("metadata writeback: skipping %s: track %d is one of several in the file", path, track.ID)
+		return nil
+	}
+
+	if _, err := ContainerForFile(path); err != nil {
+		// Nothing is wrong with the file, melodee just can't tag it
+		log.Printf("metadata writeback: skipping %s: %v", path, err)
+		return nil
+	}
+
+	if err := s.writer.Write(ctx, path, TrackTagsFromModel(track)); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return s.quarantine(track, path, err)
+	}
+
+	checksum, err := s.checksumService.CalculateChecksum(path)
+	if err != nil {
+		return fmt.Errorf("failed to checksum rewritten file: %w", err)
+	}
+	if err := s.db.Model(&models.Track{}).Where("id = ?", track.ID).Update("crc_hash", checksum).Error; err != nil {
+		return fmt.Errorf("failed to update checksum: %w", err)
+	}
+	return nil
+}
+
+func (s *MetadataWritebackService) quarantine(track *models.Track, path string, cause error) error {
+	if s.quarantineService == nil {
+		return cause
+	}
+
+	var libraryID int32
+	if track.LibraryID != nil {
+		libraryID = *track.LibraryID
+	}
+	if err := s.quarantineService.QuarantineFile(path, TagParseError, cause.Error(), libraryID); err != nil {
+		return fmt.Errorf("%v (quarantine failed: %w)", cause, err)
+	}
+	return fmt.Errorf("quarantined: %w", cause)
+}
+
+// HandleMetadataWriteback writes metadata changes back to files
+func (s *MetadataWritebackService) HandleMetadataWriteback(ctx context.Context, t *asynq.Task) error {
+	var p MetadataWritebackPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal metadata writeback payload: %w", err)
+	}
+
+	log.Printf("Writing back metadata for %d tracks", len(p.TrackIDs))
+
+	failed, err := s.WriteTracks(ctx, p.TrackIDs)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		// Failed files are quarantined, so retrying would not find them
+		return fmt.Errorf("metadata writeback failed for %d of %d tracks: %w", failed, len(p.TrackIDs), asynq.SkipRetry)
+	}
+
+	log.Printf("Metadata writeback completed for %d tracks", len(p.TrackIDs))
+	return nil
+}
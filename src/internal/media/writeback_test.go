@@ -0,0 +1,213 @@
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// fakeTagFFmpeg writes a script that copies the -i input to the output file
+// and appends its arguments to it, standing in for ffmpeg's tag rewriting.
+// A failing script reports an error the way ffmpeg does for unreadable input.
+func fakeTagFFmpeg(t *testing.T, fail bool) string {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "ffmpeg")
+	body := "#!/bin/sh\nfor arg; do\n  if [ \"$prev\" = \"-i\" ]; then in=\"$arg\"; fi\n  prev=\"$arg\"\ndone\n" +
+		"cat \"$in\" > \"$prev\"\necho \"$@\" >> \"$prev\"\n"
+	if fail {
+		body = "#!/bin/sh\necho 'Invalid data found when processing input' >&2\nexit 1\n"
+	}
+	require.NoError(t, os.WriteFile(script, []byte(body), 0755))
+	return script
+}
+
+func setupWritebackTestDB(t *testing.T, libraryPath string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		artist_id INTEGER,
+		library_id INTEGER,
+		directory TEXT,
+		comment TEXT,
+		is_compilation BOOLEAN DEFAULT 0,
+		release_date DATETIME,
+		track_count_cached INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		library_id INTEGER,
+		relative_path TEXT,
+		directory TEXT,
+		file_name TEXT,
+		tags TEXT,
+		crc_hash TEXT,
+		sort_order INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE quarantine_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT,
+		original_path TEXT,
+		reason TEXT,
+		message TEXT,
+		library_id INTEGER,
+		created_at DATETIME
+	)`).Error)
+
+	db.Exec(`INSERT INTO libraries (id, name, path, type) VALUES (1, 'Production', ?, 'production')`, libraryPath)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Band'), (2, 'Various Artists')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id, library_id, comment, is_compilation, release_date, track_count_cached)
+		VALUES (1, 'Album', 2, 1, 'Remastered', 1, '2020-05-01 00:00:00', 12)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, library_id, relative_path, tags, crc_hash, sort_order) VALUES
+		(1, 'Song', 1, 1, 1, 'a/01.mp3', '{"disc_number": 2, "disc_total": 2, "genre": "Rock"}', 'stale', 3),
+		(2, 'Other', 1, 1, 1, 'a/02.flac', NULL, 'stale', 4),
+		(3, 'Video', 1, 1, 1, 'a/03.wav', NULL, 'stale', 5)`)
+	return db
+}
+
+func writeTrackFiles(t *testing.T, libraryPath string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Join(libraryPath, "a"), 0755))
+	for _, name := range []string{"01.mp3", "02.flac", "03.wav"} {
+		require.NoError(t, os.WriteFile(filepath.Join(libraryPath, "a", name), []byte("audio "+name+"\n"), 0644))
+	}
+}
+
+func TestTagWriter_Args(t *testing.T) {
+	writer := NewTagWriter("ffmpeg")
+	tags := TrackTags{
+		Title:               "Song",
+		Artist:              "Band",
+		AlbumArtist:         "Various Artists",
+		Album:               "Album",
+		TrackNumber:         3,
+		TrackTotal:          12,
+		DiscNumber:          2,
+		Genre:               "Rock",
+		ReleaseDate:         "2020-05-01",
+		Compilation:         true,
+		ArtistMusicBrainzID: "b10bbbfc-cf9e-42e0-be17-e2c3e1d2600d",
+	}
+
+	args, err := writer.Args("/music/01.mp3", "/music/.01.mp3.tagwrite", tags)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-v", "error", "-nostdin", "-y", "-i", "/music/01.mp3",
+		"-map", "0", "-c", "copy", "-map_metadata", "0", "-map_chapters", "0", "-id3v2_version", "4"}, args[:16])
+	assert.Equal(t, []string{"-f", "mp3", "/music/.01.mp3.tagwrite"}, args[len(args)-3:])
+	joined := strings.Join(args, " ")
+	assert.Contains(t, joined, "-metadata track=3/12")
+	assert.Contains(t, joined, "-metadata disc=2")
+	assert.Contains(t, joined, "-metadata TDRL=2020-05-01")
+	assert.Contains(t, joined, "-metadata compilation=1")
+	assert.Contains(t, joined, "-metadata comment=", "an empty comment clears the tag")
+	assert.Contains(t, joined, "-metadata MusicBrainz Artist Id=b10bbbfc-cf9e-42e0-be17-e2c3e1d2600d")
+	assert.NotContains(t, joined, "REPLAYGAIN", "unknown values are left as the file has them")
+
+	args, err = writer.Args("/music/01.flac", "/music/.01.flac.tagwrite", tags)
+	require.NoError(t, err)
+	joined = strings.Join(args, " ")
+	assert.Contains(t, joined, "-metadata track=3 -metadata TRACKTOTAL=12")
+	assert.Contains(t, joined, "-metadata MUSICBRAINZ_ARTISTID=")
+	assert.Contains(t, joined, "-f flac")
+	assert.NotContains(t, joined, "id3v2_version")
+
+	analyzed := tags
+	analyzed.ReplayGainTrackGain, analyzed.ReplayGainTrackPeak = "-6.52 dB", "0.988553"
+	analyzed.ReplayGainAlbumGain, analyzed.ReplayGainAlbumPeak = "-7.10 dB", "1.012000"
+	args, err = writer.Args("/music/01.flac", "/music/.01.flac.tagwrite", analyzed)
+	require.NoError(t, err)
+	joined = strings.Join(args, " ")
+	assert.Contains(t, joined, "-metadata REPLAYGAIN_TRACK_GAIN=-6.52 dB -metadata REPLAYGAIN_TRACK_PEAK=0.988553")
+	assert.Contains(t, joined, "-metadata REPLAYGAIN_ALBUM_GAIN=-7.10 dB -metadata REPLAYGAIN_ALBUM_PEAK=1.012000")
+
+	args, err = writer.Args("/music/01.m4a", "/music/.01.m4a.tagwrite", tags)
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(args, " "), "-f ipod")
+	assert.NotContains(t, strings.Join(args, " "), "MusicBrainz")
+
+	_, err = writer.Args("/music/01.wav", "/music/.01.wav.tagwrite", tags)
+	assert.ErrorIs(t, err, ErrUnsupportedTagContainer)
+}
+
+func TestMetadataWritebackService_WritesTagsAndUpdatesChecksum(t *testing.T) {
+	libraryPath := t.TempDir()
+	writeTrackFiles(t, libraryPath)
+	db := setupWritebackTestDB(t, libraryPath)
+	quarantine := NewQuarantineService(db, t.TempDir())
+	service := NewMetadataWritebackService(db, NewTagWriter(fakeTagFFmpeg(t, false)), quarantine)
+
+	payload, err := json.Marshal(MetadataWritebackPayload{TrackIDs: []int64{1, 2, 3}})
+	require.NoError(t, err)
+	require.NoError(t, service.HandleMetadataWriteback(context.Background(), asynq.NewTask(TypeMetadataWriteback, payload)))
+
+	content, err := os.ReadFile(filepath.Join(libraryPath, "a", "01.mp3"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "audio 01.mp3\n"), "the audio is copied")
+	for _, tag := range []string{"title=Song", "artist=Band", "album_artist=Various Artists", "album=Album",
+		"genre=Rock", "comment=Remastered", "compilation=1", "track=3/12", "disc=2/2", "TDRL=2020-05-01"} {
+		assert.Contains(t, string(content), "-metadata "+tag)
+	}
+
+	var track struct{ CRCHash string }
+	require.NoError(t, db.Table("tracks").Select("crc_hash").Where("id = ?", 1).Scan(&track).Error)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, hex.EncodeToString(sum[:]), track.CRCHash)
+
+	// Containers that cannot be tagged are left alone
+	require.NoError(t, db.Table("tracks").Select("crc_hash").Where("id = ?", 3).Scan(&track).Error)
+	assert.Equal(t, "stale", track.CRCHash)
+	assert.FileExists(t, filepath.Join(libraryPath, "a", "03.wav"))
+
+	entries, err := os.ReadDir(filepath.Join(libraryPath, "a"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 3, "no temporary files are left behind")
+}
+
+func TestMetadataWritebackService_QuarantinesFailures(t *testing.T) {
+	libraryPath := t.TempDir()
+	writeTrackFiles(t, libraryPath)
+	db := setupWritebackTestDB(t, libraryPath)
+	quarantineDir := t.TempDir()
+	service := NewMetadataWritebackService(db, NewTagWriter(fakeTagFFmpeg(t, true)), NewQuarantineService(db, quarantineDir))
+
+	payload, err := json.Marshal(MetadataWritebackPayload{TrackIDs: []int64{1}})
+	require.NoError(t, err)
+	err = service.HandleMetadataWriteback(context.Background(), asynq.NewTask(TypeMetadataWriteback, payload))
+	require.Error(t, err)
+	assert.ErrorIs(t, err, asynq.SkipRetry)
+
+	assert.NoFileExists(t, filepath.Join(libraryPath, "a", "01.mp3"))
+
+	var record QuarantineRecord
+	require.NoError(t, db.First(&record).Error)
+	assert.Equal(t, TagParseError, record.Reason)
+	assert.Equal(t, int32(1), record.LibraryID)
+	assert.Contains(t, record.Message, "Invalid data found")
+	assert.FileExists(t, record.FilePath)
+}
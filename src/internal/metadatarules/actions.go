@@ -0,0 +1,132 @@
+package metadatarules
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	// "Song (feat. A & B)", "Song [ft. A]"
+	featuringGroupPattern = regexp.MustCompile(`(?i)\s*[\(\[]\s*(?:feat\.?|ft\.?|featuring)\s+([^\)\]]+)[\)\]]`)
+	// "Song feat. A", "Artist ft. B"
+	featuringTailPattern = regexp.MustCompile(`(?i)\s+(?:feat\.?|ft\.?|featuring)\s+(.+)$`)
+	// ", " or " & " between featured artists
+	featuringSeparator = regexp.MustCompile(`\s*(?:,|&)\s*`)
+
+	// "Song [Bonus Track]", "Song (Bonus)", "Song - Bonus Track"
+	bonusPattern = regexp.MustCompile(`(?i)\s*(?:[\(\[]\s*bonus(?:\s+track)?\s*[\)\]]|\s-\s*bonus\s+track\s*$)`)
+
+	// "Song - Remastered 2011", "Song - 2011 Remaster", "Song (2011 Digital Remaster)",
+	// "Song [Remastered Version]"
+	remasterPattern = regexp.MustCompile(`(?i)\s*(?:\s-\s*|[\(\[]\s*)(?:(\d{4})\s+)?(?:digital(?:ly)?\s+)?remaster(?:ed)?(?:\s+(\d{4}))?(?:\s+version)?\s*[\)\]]?\s*$`)
+)
+
+// smallWords stay lower case in title case, except first and last
+var smallWords = map[string]bool{
+	"a": true, "an": true, "and": true, "as": true, "at": true, "but": true,
+	"by": true, "for": true, "from": true, "in": true, "into": true, "nor": true,
+	"of": true, "on": true, "or": true, "the": true, "to": true, "vs": true,
+	"vs.": true, "with": true,
+}
+
+// moveFeaturing removes the featured artists from a value and returns them
+func moveFeaturing(value string) (string, []string) {
+	var featured string
+	if match := featuringGroupPattern.FindStringSubmatchIndex(value); match != nil {
+		featured = value[match[2]:match[3]]
+		value = value[:match[0]] + value[match[1]:]
+	} else if match := featuringTailPattern.FindStringSubmatchIndex(value); match != nil {
+		featured = value[match[2]:match[3]]
+		value = value[:match[0]]
+	} else {
+		return value, nil
+	}
+
+	var names []string
+	for _, name := range featuringSeparator.Split(featured, -1) {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return strings.TrimSpace(value), names
+}
+
+// stripBonus removes bonus track markers
+func stripBonus(value string) string {
+	return strings.TrimSpace(bonusPattern.ReplaceAllString(value, ""))
+}
+
+// normalizeRemaster rewrites a remaster suffix as "(Remastered)" or
+// "(Remastered YYYY)"
+func normalizeRemaster(value string) string {
+	match := remasterPattern.FindStringSubmatch(value)
+	if match == nil {
+		return value
+	}
+	base := strings.TrimSpace(strings.TrimSuffix(value, match[0]))
+	if base == "" {
+		return value
+	}
+	year := match[1]
+	if year == "" {
+		year = match[2]
+	}
+	if year == "" {
+		return base + " (Remastered)"
+	}
+	return base + " (Remastered " + year + ")"
+}
+
+// titleCase capitalizes each word except small words in the middle. Words
+// with capitals after their first letter, such as "AC/DC" or "McCartney",
+// are left alone unless the whole value is upper case.
+func titleCase(value string) string {
+	if strings.ToUpper(value) == value {
+		value = strings.ToLower(value)
+	}
+
+	words := strings.Fields(value)
+	for i, word := range words {
+		lower := strings.ToLower(word)
+		if i > 0 && i < len(words)-1 && smallWords[lower] {
+			words[i] = lower
+			continue
+		}
+		if hasInnerCapital(word) {
+			continue
+		}
+		words[i] = capitalize(lower)
+	}
+	return strings.Join(words, " ")
+}
+
+// capitalize upper cases the first letter of a word, after any opening
+// punctuation
+func capitalize(word string) string {
+	runes := []rune(word)
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			runes[i] = unicode.ToUpper(r)
+			break
+		}
+		if unicode.IsDigit(r) {
+			break
+		}
+	}
+	return string(runes)
+}
+
+func hasInnerCapital(word string) bool {
+	seenLetter := false
+	for _, r := range word {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if seenLetter && unicode.IsUpper(r) {
+			return true
+		}
+		seenLetter = true
+	}
+	return false
+}
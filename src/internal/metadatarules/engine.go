@@ -0,0 +1,228 @@
+// Package metadatarules cleans up scanned metadata during inbound processing
+// with an ordered list of rules stored in the database. Each rule matches a
+// field with a regular expression, optionally only for one library or album
+// artist, and replaces text or runs one of the built-in cleanups.
+package metadatarules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+)
+
+// ErrInvalidRule is wrapped by every rule validation error
+var ErrInvalidRule = errors.New("invalid metadata rule")
+
+// Scope is where a file was scanned from, which rules may be limited to
+type Scope struct {
+	LibraryID   int32
+	AlbumArtist string // as scanned, before any rule changed it
+}
+
+// Track holds the track fields rules apply to
+type Track struct {
+	Title    string
+	Artist   string
+	Genre    string
+	Featured []string // artists moved out of the title or artist
+}
+
+// Change is a field changed by a rule
+type Change struct {
+	RuleID   int64  `json:"rule_id"`
+	Rule     string `json:"rule"`
+	Field    string `json:"field"`
+	FilePath string `json:"file_path,omitempty"` // empty for album fields
+	Before   string `json:"before"`
+	After    string `json:"after"`
+}
+
+// String describes a change for validation warnings
+func (c Change) String() string {
+	if c.FilePath != "" {
+		return fmt.Sprintf("Rule %q changed %s of %s: %q -> %q", c.Rule, c.Field, filepath.Base(c.FilePath), c.Before, c.After)
+	}
+	return fmt.Sprintf("Rule %q changed %s: %q -> %q", c.Rule, c.Field, c.Before, c.After)
+}
+
+// Engine applies rules in order
+type Engine struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	models.MetadataRule
+	pattern *regexp.Regexp // nil when the rule has no pattern
+}
+
+// Load returns an engine with the enabled rules in the database
+func Load(ctx context.Context, db *gorm.DB) (*Engine, error) {
+	var rules []models.MetadataRule
+	if err := db.WithContext(ctx).Where("enabled = ?", true).Order("position, id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("failed to load metadata rules: %w", err)
+	}
+	return NewEngine(rules)
+}
+
+// NewEngine returns an engine applying rules in the order given
+func NewEngine(rules []models.MetadataRule) (*Engine, error) {
+	engine := &Engine{rules: make([]compiledRule, 0, len(rules))}
+	for _, rule := range rules {
+		compiled, err := compile(rule)
+		if err != nil {
+			return nil, err
+		}
+		engine.rules = append(engine.rules, compiled)
+	}
+	return engine, nil
+}
+
+// Validate checks a rule before it is stored
+func Validate(rule models.MetadataRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("%w: a name is required", ErrInvalidRule)
+	}
+	_, err := compile(rule)
+	return err
+}
+
+func compile(rule models.MetadataRule) (compiledRule, error) {
+	name := rule.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", rule.ID)
+	}
+
+	switch rule.Field {
+	case models.MetadataRuleFieldTitle, models.MetadataRuleFieldArtist, models.MetadataRuleFieldAlbumArtist,
+		models.MetadataRuleFieldAlbum, models.MetadataRuleFieldGenre:
+	default:
+		return compiledRule{}, fmt.Errorf("%w %s: unknown field %q", ErrInvalidRule, name, rule.Field)
+	}
+
+	switch rule.Action {
+	case models.MetadataRuleReplace:
+		if rule.Pattern == "" {
+			return compiledRule{}, fmt.Errorf("%w %s: replace needs a pattern", ErrInvalidRule, name)
+		}
+	case models.MetadataRuleMoveFeaturing:
+		if rule.Field != models.MetadataRuleFieldTitle && rule.Field != models.MetadataRuleFieldArtist {
+			return compiledRule{}, fmt.Errorf("%w %s: featured artists can only be moved from title or artist", ErrInvalidRule, name)
+		}
+	case models.MetadataRuleStripBonus, models.MetadataRuleNormalizeRemaster, models.MetadataRuleTitleCase:
+	default:
+		return compiledRule{}, fmt.Errorf("%w %s: unknown action %q", ErrInvalidRule, name, rule.Action)
+	}
+
+	compiled := compiledRule{MetadataRule: rule}
+	compiled.Name = name
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return compiledRule{}, fmt.Errorf("%w %s: %v", ErrInvalidRule, name, err)
+		}
+		compiled.pattern = pattern
+	}
+	return compiled, nil
+}
+
+// ApplyAlbum applies the album artist and album rules to an album's names
+func (e *Engine) ApplyAlbum(scope Scope, albumArtist, album *string) []Change {
+	var changes []Change
+	for _, rule := range e.rules {
+		if !rule.applies(scope) {
+			continue
+		}
+		switch rule.Field {
+		case models.MetadataRuleFieldAlbumArtist:
+			changes = rule.apply(albumArtist, nil, "", changes)
+		case models.MetadataRuleFieldAlbum:
+			changes = rule.apply(album, nil, "", changes)
+		}
+	}
+	return changes
+}
+
+// ApplyTrack applies the title, artist and genre rules to a track of the
+// file at filePath
+func (e *Engine) ApplyTrack(scope Scope, filePath string, track *Track) []Change {
+	var changes []Change
+	for _, rule := range e.rules {
+		if !rule.applies(scope) {
+			continue
+		}
+		switch rule.Field {
+		case models.MetadataRuleFieldTitle:
+			changes = rule.apply(&track.Title, &track.Featured, filePath, changes)
+		case models.MetadataRuleFieldArtist:
+			changes = rule.apply(&track.Artist, &track.Featured, filePath, changes)
+		case models.MetadataRuleFieldGenre:
+			changes = rule.apply(&track.Genre, nil, filePath, changes)
+		}
+	}
+	return changes
+}
+
+func (r *compiledRule) applies(scope Scope) bool {
+	if r.LibraryID != nil && *r.LibraryID != scope.LibraryID {
+		return false
+	}
+	return r.ArtistName == "" || strings.EqualFold(r.ArtistName, scope.AlbumArtist)
+}
+
+// apply runs the rule on a value, adding any featured artists it moves, and
+// records the change
+func (r *compiledRule) apply(value *string, featured *[]string, filePath string, changes []Change) []Change {
+	if r.pattern != nil && !r.pattern.MatchString(*value) {
+		return changes
+	}
+
+	before := *value
+	after := before
+	switch r.Action {
+	case models.MetadataRuleReplace:
+		after = strings.TrimSpace(r.pattern.ReplaceAllString(before, r.Replacement))
+	case models.MetadataRuleMoveFeaturing:
+		var names []string
+		after, names = moveFeaturing(before)
+		for _, name := range names {
+			if !contains(*featured, name) {
+				*featured = append(*featured, name)
+			}
+		}
+	case models.MetadataRuleStripBonus:
+		after = stripBonus(before)
+	case models.MetadataRuleNormalizeRemaster:
+		after = normalizeRemaster(before)
+	case models.MetadataRuleTitleCase:
+		after = titleCase(before)
+	}
+
+	if after == before {
+		return changes
+	}
+	*value = after
+	return append(changes, Change{
+		RuleID:   r.ID,
+		Rule:     r.Name,
+		Field:    r.Field,
+		FilePath: filePath,
+		Before:   before,
+		After:    after,
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
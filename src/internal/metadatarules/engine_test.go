@@ -0,0 +1,160 @@
+package metadatarules
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"melodee/internal/models"
+	"melodee/internal/scanner"
+)
+
+func TestActions(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(string) string
+		in    string
+		want  string
+	}{
+		{"strip bracketed", stripBonus, "Song [Bonus Track]", "Song"},
+		{"strip parenthesized", stripBonus, "Song (bonus)", "Song"},
+		{"strip dashed", stripBonus, "Song - Bonus Track", "Song"},
+		{"strip leaves others", stripBonus, "Bonus Round", "Bonus Round"},
+		{"remaster dashed", normalizeRemaster, "Song - Remastered 2011", "Song (Remastered 2011)"},
+		{"remaster year first", normalizeRemaster, "Song - 2011 Remaster", "Song (Remastered 2011)"},
+		{"remaster digital", normalizeRemaster, "Song (2009 Digital Remaster)", "Song (Remastered 2009)"},
+		{"remaster version", normalizeRemaster, "Song [Remastered Version]", "Song (Remastered)"},
+		{"remaster normalized", normalizeRemaster, "Song (Remastered 2011)", "Song (Remastered 2011)"},
+		{"remaster leaves others", normalizeRemaster, "Remaster", "Remaster"},
+		{"title case", titleCase, "the sound of silence", "The Sound of Silence"},
+		{"title case upper", titleCase, "BACK IN BLACK", "Back in Black"},
+		{"title case keeps capitals", titleCase, "songs by AC/DC and McCartney", "Songs by AC/DC and McCartney"},
+		{"title case last small word", titleCase, "what are you waiting for", "What Are You Waiting For"},
+		{"title case punctuation", titleCase, "(don't fear) the reaper", "(Don't Fear) the Reaper"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.apply(tt.in))
+		})
+	}
+}
+
+func TestMoveFeaturing(t *testing.T) {
+	value, featured := moveFeaturing("Song (feat. A & B)")
+	assert.Equal(t, "Song", value)
+	assert.Equal(t, []string{"A", "B"}, featured)
+
+	value, featured = moveFeaturing("Song [ft. C] (Live)")
+	assert.Equal(t, "Song (Live)", value)
+	assert.Equal(t, []string{"C"}, featured)
+
+	value, featured = moveFeaturing("Artist featuring D, E")
+	assert.Equal(t, "Artist", value)
+	assert.Equal(t, []string{"D", "E"}, featured)
+
+	value, featured = moveFeaturing("Soft Feather")
+	assert.Equal(t, "Soft Feather", value)
+	assert.Empty(t, featured)
+}
+
+func TestEngineApply(t *testing.T) {
+	libraryID := int32(2)
+	engine, err := NewEngine([]models.MetadataRule{
+		{ID: 1, Name: "Features", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleMoveFeaturing},
+		{ID: 2, Name: "Bonus", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleStripBonus},
+		{ID: 3, Name: "Title case", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleTitleCase, Pattern: `^[a-z]`},
+		{ID: 4, Name: "Hip hop", Field: models.MetadataRuleFieldGenre, Action: models.MetadataRuleReplace, Pattern: `(?i)^hip[- ]?hop$`, Replacement: "Hip-Hop"},
+		{ID: 5, Name: "Other library", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleReplace, Pattern: `.+`, Replacement: "x", LibraryID: &libraryID},
+		{ID: 6, Name: "Prince", Field: models.MetadataRuleFieldAlbum, Action: models.MetadataRuleReplace, Pattern: `^Purple$`, Replacement: "Purple Rain", ArtistName: "prince"},
+		{ID: 7, Name: "Artist", Field: models.MetadataRuleFieldAlbumArtist, Action: models.MetadataRuleReplace, Pattern: `^Prince$`, Replacement: "Prince and the Revolution"},
+	})
+	require.NoError(t, err)
+
+	scope := Scope{LibraryID: 1, AlbumArtist: "Prince"}
+	track := Track{Title: "let's go crazy (feat. the revolution) [bonus track]", Genre: "hiphop"}
+	changes := engine.ApplyTrack(scope, "/inbound/01.flac", &track)
+	assert.Equal(t, "Let's Go Crazy", track.Title)
+	assert.Equal(t, "Hip-Hop", track.Genre)
+	assert.Equal(t, []string{"the revolution"}, track.Featured)
+	require.Len(t, changes, 4)
+	assert.Equal(t, `Rule "Features" changed title of 01.flac: "let's go crazy (feat. the revolution) [bonus track]" -> "let's go crazy [bonus track]"`, changes[0].String())
+	assert.Equal(t, []int64{1, 2, 3, 4}, []int64{changes[0].RuleID, changes[1].RuleID, changes[2].RuleID, changes[3].RuleID})
+
+	// Album rules are scoped by the album artist as scanned, not as changed
+	artist, album := "Prince", "Purple"
+	changes = engine.ApplyAlbum(scope, &artist, &album)
+	assert.Equal(t, "Prince and the Revolution", artist)
+	assert.Equal(t, "Purple Rain", album)
+	assert.Len(t, changes, 2)
+
+	artist, album = "Other", "Purple"
+	changes = engine.ApplyAlbum(Scope{LibraryID: 2, AlbumArtist: artist}, &artist, &album)
+	assert.Equal(t, "Purple", album)
+	assert.Empty(t, changes)
+}
+
+func TestValidate(t *testing.T) {
+	valid := models.MetadataRule{Name: "Rule", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleTitleCase}
+	assert.NoError(t, Validate(valid))
+
+	for name, rule := range map[string]models.MetadataRule{
+		"no name":         {Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleTitleCase},
+		"unknown field":   {Name: "Rule", Field: "composer", Action: models.MetadataRuleTitleCase},
+		"unknown action":  {Name: "Rule", Field: models.MetadataRuleFieldTitle, Action: "shout"},
+		"replace pattern": {Name: "Rule", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleReplace},
+		"bad pattern":     {Name: "Rule", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleReplace, Pattern: "("},
+		"featuring field": {Name: "Rule", Field: models.MetadataRuleFieldAlbum, Action: models.MetadataRuleMoveFeaturing},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, errors.Is(Validate(rule), ErrInvalidRule))
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	scanDB, err := scanner.NewScanDB(t.TempDir())
+	require.NoError(t, err)
+	defer scanDB.Close()
+
+	for i, title := range []string{"Intro", "Outro [Bonus Track]"} {
+		require.NoError(t, scanDB.InsertFile(&scanner.ScannedFile{
+			FilePath:    "/inbound/Artist/Album/" + title + ".flac",
+			FileSize:    100,
+			FileHash:    title,
+			AlbumArtist: "Artist",
+			Artist:      "Artist",
+			Album:       "Album",
+			Title:       title,
+			TrackNumber: i + 1,
+			DiscNumber:  1,
+			Year:        2020,
+			IsValid:     true,
+		}))
+	}
+	require.NoError(t, scanDB.InsertFile(&scanner.ScannedFile{
+		FilePath: "/inbound/Other/Record/Song.flac", FileSize: 100, FileHash: "song",
+		AlbumArtist: "Other", Artist: "Other", Album: "Record", Title: "Song", TrackNumber: 1, DiscNumber: 1, Year: 2020, IsValid: true,
+	}))
+	require.NoError(t, scanDB.ComputeAlbumGrouping())
+
+	engine, err := NewEngine([]models.MetadataRule{
+		{ID: 1, Name: "Bonus", Field: models.MetadataRuleFieldTitle, Action: models.MetadataRuleStripBonus},
+	})
+	require.NoError(t, err)
+
+	albums, err := engine.DryRun(scanDB, 1)
+	require.NoError(t, err)
+	require.Len(t, albums, 1)
+	assert.Equal(t, "Album", albums[0].AlbumName)
+	require.Len(t, albums[0].Changes, 1)
+	assert.Equal(t, "Outro [Bonus Track]", albums[0].Changes[0].Before)
+	assert.Equal(t, "Outro", albums[0].Changes[0].After)
+
+	// Nothing is written back to the scan
+	files, err := scanDB.GetFilesByAlbumGroup(albums[0].AlbumGroupID)
+	require.NoError(t, err)
+	titles := []string{files[0].Title, files[1].Title}
+	assert.Contains(t, titles, "Outro [Bonus Track]")
+}
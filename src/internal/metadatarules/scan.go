@@ -0,0 +1,63 @@
+package metadatarules
+
+import (
+	"fmt"
+
+	"melodee/internal/scanner"
+)
+
+// AlbumChanges is what the rules change in an album of a scan
+type AlbumChanges struct {
+	AlbumGroupID string   `json:"album_group_id"`
+	ArtistName   string   `json:"artist_name"` // as scanned
+	AlbumName    string   `json:"album_name"`  // as scanned
+	Changes      []Change `json:"changes"`
+}
+
+// ApplyScanned applies the rules to an album group of a scan and its files,
+// changing them in place. It returns the changes and the artists featured on
+// each file, in the order of files.
+func (e *Engine) ApplyScanned(libraryID int32, group *scanner.AlbumGroup, files []*scanner.ScannedFile) ([]Change, [][]string) {
+	scope := Scope{LibraryID: libraryID, AlbumArtist: group.ArtistName}
+	changes := e.ApplyAlbum(scope, &group.ArtistName, &group.AlbumName)
+
+	featured := make([][]string, len(files))
+	for i, file := range files {
+		track := Track{Title: file.Title, Artist: file.Artist, Genre: file.Genre}
+		changes = append(changes, e.ApplyTrack(scope, file.FilePath, &track)...)
+		file.Title, file.Artist, file.Genre = track.Title, track.Artist, track.Genre
+		featured[i] = track.Featured
+	}
+	return changes, featured
+}
+
+// DryRun returns what the rules would change in the albums of a scan
+// database scanned from a library, without changing anything. Albums the
+// rules leave alone are left out.
+func (e *Engine) DryRun(scanDB *scanner.ScanDB, libraryID int32) ([]AlbumChanges, error) {
+	groups, err := scanDB.GetAlbumGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get album groups: %w", err)
+	}
+
+	results := []AlbumChanges{}
+	for _, group := range groups {
+		files, err := scanDB.GetFilesByAlbumGroup(group.AlbumGroupID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get files of album group %s: %w", group.AlbumGroupID, err)
+		}
+
+		scanned := group
+		changes, _ := e.ApplyScanned(libraryID, &scanned, files)
+		if len(changes) == 0 {
+			continue
+		}
+		results = append(results, AlbumChanges{
+			AlbumGroupID: group.AlbumGroupID,
+			ArtistName:   group.ArtistName,
+			AlbumName:    group.AlbumName,
+			Changes:      changes,
+		})
+	}
+	return results, nil
+}
@@ -171,12 +171,11 @@ func (m *AuthMiddleware) BearerOrTokenAuth() fiber.Handler {
 
 		// Check for OpenSubsonic-style authentication parameters
 		username := c.Query("u", "")
-		password := c.Query("p", "")
 		token := c.Query("t", "")
 		salt := c.Query("s", "")
 
-		if username != "" && password != "" && token != "" && salt != "" {
-			user, err := m.authService.ValidateOpenSubsonicToken(username, password, token, salt)
+		if username != "" && token != "" && salt != "" {
+			user, err := m.authService.ValidateOpenSubsonicToken(username, token, salt)
 			if err != nil {
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 					"error":   "Unauthorized",
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,6 +24,8 @@ type User struct {
 	PasswordResetExpiry *time.Time `json:"-"`                      // When the password reset token expires
 	CreatedAt           time.Time  `json:"created_at"`
 	LastLoginAt         *time.Time `json:"last_login_at"`
+	JukeboxRole         bool       `gorm:"default:false" json:"jukebox_role"`
+	ConsolidateEditions bool       `gorm:"default:false" json:"consolidate_editions"` // Browse release groups as one album
 }
 
 func (User) TableName() string {
@@ -35,13 +40,29 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// SubsonicPassword is an app password used by Subsonic clients. The secret is
+// stored encrypted (not hashed) so salted token authentication can be verified.
+type SubsonicPassword struct {
+	ID              int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID          int64      `gorm:"index;not null" json:"user_id"`
+	Name            string     `gorm:"size:255;not null" json:"name"`
+	EncryptedSecret string     `gorm:"not null" json:"-"` // Never expose the secret in JSON
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
+
+func (SubsonicPassword) TableName() string {
+	return "subsonic_passwords"
+}
+
 // Library represents the libraries table
 type Library struct {
 	ID         int32     `gorm:"primaryKey;autoIncrement" json:"id"`
 	Name       string    `gorm:"size:255;not null" json:"name"`
 	Path       string    `gorm:"not null" json:"path"`
-	Type       string    `gorm:"size:50;not null;check:type IN ('inbound', 'staging', 'production')" json:"type"`
+	Type       string    `gorm:"size:50;not null;check:type IN ('inbound', 'staging', 'production', 'podcast')" json:"type"`
 	IsLocked   bool      `gorm:"default:false" json:"is_locked"`
+	IsWatched  bool      `gorm:"default:false" json:"is_watched"`
 	CreatedAt  time.Time `json:"created_at"`
 	TrackCount int32     `gorm:"default:0" json:"track_count"`
 	AlbumCount int32     `gorm:"default:0" json:"album_count"`
@@ -76,6 +97,8 @@ type Artist struct {
 	AMGID            string     `gorm:"size:255" json:"amg_id"`
 	WikidataID       string     `gorm:"size:255" json:"wikidata_id"`
 	SortOrder        int32      `gorm:"default:0" json:"sort_order"`
+	Biography        string     `json:"biography"`
+	ImageURL         string     `gorm:"size:1024" json:"image_url"` // Artist image found by a metadata provider
 
 	// Relationships
 	Albums []Album `gorm:"foreignKey:ArtistID" json:"-"`
@@ -93,6 +116,39 @@ func (a *Artist) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// ReleaseGroup groups the editions of an album (Original, Deluxe, Remaster...)
+// so they can be browsed as one album with every unique track
+type ReleaseGroup struct {
+	ID               int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	APIKey           uuid.UUID  `gorm:"type:uuid;uniqueIndex;default:gen_random_uuid()" json:"api_key"`
+	ArtistID         int64      `gorm:"not null;uniqueIndex:idx_release_groups_artist_name" json:"artist_id"`
+	Name             string     `gorm:"size:255;not null" json:"name"`
+	NameNormalized   string     `gorm:"size:255;not null;uniqueIndex:idx_release_groups_artist_name" json:"name_normalized"`
+	PrimaryAlbumID   *int64     `gorm:"index" json:"primary_album_id"` // Edition the group is browsed as
+	MusicBrainzID    *uuid.UUID `gorm:"type:uuid" json:"musicbrainz_id"`
+	ReleaseCount     int32      `gorm:"default:0" json:"release_count"`
+	TrackCountCached int32      `gorm:"default:0" json:"track_count_cached"` // Unique tracks across editions
+	DurationCached   int64      `gorm:"default:0" json:"duration_cached"`    // duration in milliseconds
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+
+	// Relationships
+	Artist *Artist `gorm:"foreignKey:ArtistID" json:"artist"`
+	Albums []Album `gorm:"foreignKey:ReleaseGroupID" json:"albums"`
+}
+
+func (ReleaseGroup) TableName() string {
+	return "release_groups"
+}
+
+// BeforeCreate sets the API key before creating a release group
+func (rg *ReleaseGroup) BeforeCreate(tx *gorm.DB) error {
+	if rg.APIKey == uuid.Nil {
+		rg.APIKey = uuid.New()
+	}
+	return nil
+}
+
 // Album represents the albums table
 type Album struct {
 	ID                  int64      `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -102,6 +158,7 @@ type Album struct {
 	NameNormalized      string     `gorm:"size:255;not null;index:idx_albums_name_normalized_gin,gin" json:"name_normalized"`
 	AlternateNames      []string   `gorm:"type:text[]" json:"alternate_names"`
 	ArtistID            int64      `gorm:"index:idx_albums_artist_id_covering;not null" json:"artist_id"`
+	LibraryID           *int32     `gorm:"index" json:"library_id"`             // Library the album directory is relative to
 	TrackCountCached    int32      `gorm:"default:0" json:"track_count_cached"` // Pre-calculated for performance
 	DurationCached      int64      `gorm:"default:0" json:"duration_cached"`    // duration in milliseconds
 	CreatedAt           time.Time  `json:"created_at"`
@@ -127,10 +184,14 @@ type Album struct {
 	AMGID               string     `gorm:"size:255;index:idx_albums_amg_id" json:"amg_id"`
 	WikidataID          string     `gorm:"size:255;index:idx_albums_wikidata_id" json:"wikidata_id"`
 	IsCompilation       bool       `gorm:"default:false;index:idx_albums_compilation" json:"is_compilation"`
+	ReleaseGroupID      *int64     `gorm:"index" json:"release_group_id"`         // Set when other editions of this album exist
+	EditionType         string     `gorm:"size:50" json:"edition_type,omitempty"` // original, deluxe, remaster, anniversary...
+	ImageURL            string     `gorm:"size:1024" json:"image_url"`            // Cover image found by a metadata provider
 
 	// Relationships
-	Artist *Artist `gorm:"foreignKey:ArtistID" json:"artist"`
-	Tracks []Track `gorm:"foreignKey:AlbumID" json:"tracks"`
+	Artist       *Artist       `gorm:"foreignKey:ArtistID" json:"artist"`
+	Tracks       []Track       `gorm:"foreignKey:AlbumID" json:"tracks"`
+	ReleaseGroup *ReleaseGroup `gorm:"foreignKey:ReleaseGroupID" json:"release_group,omitempty"`
 }
 
 func (Album) TableName() string {
@@ -154,6 +215,7 @@ type Track struct {
 	SortName       string    `gorm:"size:255" json:"sort_name"`
 	AlbumID        int64     `gorm:"index:idx_tracks_album_id_hash,hash;index:idx_tracks_album_id_sort_order;not null" json:"album_id"`
 	ArtistID       int64     `gorm:"index:idx_tracks_artist_id_hash,hash;index:idx_tracks_artist_id_album_id;not null" json:"artist_id"` // Denormalized for performance
+	LibraryID      *int32    `gorm:"index" json:"library_id"`                                                                            // Library the relative path is resolved against
 	Duration       int64     `json:"duration"`                                                                                           // duration in milliseconds
 	BitRate        int32     `json:"bit_rate"`                                                                                           // in kbps
 	BitDepth       int32     `json:"bit_depth"`
@@ -166,6 +228,16 @@ type Track struct {
 	RelativePath   string    `gorm:"not null;index:idx_tracks_relative_path" json:"relative_path"` // directory + file_name
 	CRCHash        string    `gorm:"size:255;not null" json:"crc_hash"`
 	SortOrder      int32     `gorm:"default:0;index:idx_tracks_sort_order" json:"sort_order"`
+	Fingerprint    string    `json:"-"`                             // Chromaprint fingerprint, see the fingerprint package
+	DuplicateOfID  *int64    `gorm:"index" json:"duplicate_of_id"`  // Same recording on another edition of the release group
+	StartOffset    int64     `gorm:"default:0" json:"start_offset"` // milliseconds into the file, for tracks read from a cue sheet
+	EndOffset      int64     `gorm:"default:0" json:"end_offset"`   // milliseconds into the file, 0 is its end
+
+	// ReplayGain 2.0 values from the EBU R128 loudness analysis, see the loudness package
+	ReplayGainTrackGain *float64 `gorm:"column:replaygain_track_gain" json:"replaygain_track_gain"` // dB to reach -18 LUFS
+	ReplayGainTrackPeak *float64 `gorm:"column:replaygain_track_peak" json:"replaygain_track_peak"` // true peak, 1.0 is full scale
+	ReplayGainAlbumGain *float64 `gorm:"column:replaygain_album_gain" json:"replaygain_album_gain"`
+	ReplayGainAlbumPeak *float64 `gorm:"column:replaygain_album_peak" json:"replaygain_album_peak"`
 
 	// Relationships
 	Album  *Album  `gorm:"foreignKey:AlbumID" json:"album"`
@@ -176,6 +248,12 @@ func (Track) TableName() string {
 	return "tracks"
 }
 
+// IsSegment reports whether the track is part of a file it shares with other
+// tracks, as the tracks of a cue sheet are
+func (t *Track) IsSegment() bool {
+	return t.StartOffset > 0 || t.EndOffset > 0
+}
+
 // BeforeCreate sets the API key before creating a track
 func (t *Track) BeforeCreate(tx *gorm.DB) error {
 	if t.APIKey == uuid.Nil {
@@ -184,6 +262,75 @@ func (t *Track) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// FingerprintHash indexes a track's fingerprint for fuzzy matching: each row
+// is the top bits of one of its sub-fingerprints, see the fingerprint package
+type FingerprintHash struct {
+	Hash    int32 `gorm:"primaryKey;autoIncrement:false" json:"hash"`
+	TrackID int64 `gorm:"primaryKey;autoIncrement:false;index" json:"track_id"`
+}
+
+func (FingerprintHash) TableName() string {
+	return "fingerprint_hashes"
+}
+
+// Lyrics are a track's lyrics in one language, as plain text or as lines with
+// start times. A track has at most one synced and one unsynced set per language.
+type Lyrics struct {
+	ID            int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	TrackID       int64     `gorm:"not null;uniqueIndex:idx_lyrics_track_lang" json:"track_id"`
+	Lang          string    `gorm:"size:16;not null;uniqueIndex:idx_lyrics_track_lang" json:"lang"` // ISO 639 code, "xxx" when unknown
+	Synced        bool      `gorm:"not null;uniqueIndex:idx_lyrics_track_lang" json:"synced"`
+	Offset        int64     `gorm:"default:0" json:"offset"` // milliseconds; positive shows lines sooner
+	DisplayArtist string    `gorm:"size:255" json:"display_artist"`
+	DisplayTitle  string    `gorm:"size:255" json:"display_title"`
+	Lines         []byte    `gorm:"type:jsonb;not null" json:"-"`   // [{"start":ms,"value":"..."}]
+	Source        string    `gorm:"size:20;not null" json:"source"` // embedded, sidecar or manual
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (Lyrics) TableName() string {
+	return "lyrics"
+}
+
+// Image types
+const (
+	ImageTypeFront  = "front"
+	ImageTypeBack   = "back"
+	ImageTypeDisc   = "disc"
+	ImageTypeArtist = "artist"
+)
+
+// Image sources
+const (
+	ImageSourceFolder   = "folder"   // an image file next to the audio files
+	ImageSourceEmbedded = "embedded" // extracted from an audio file's tags
+	ImageSourceUpload   = "upload"   // uploaded by an admin
+)
+
+// Image is an image file of an album, in the album's directory, or of an
+// artist, in the artist's directory. Each album and artist has at most one
+// primary image, the one served as its cover art.
+type Image struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	AlbumID   *int64    `gorm:"index:idx_images_album_id" json:"album_id,omitempty"`
+	ArtistID  *int64    `gorm:"index:idx_images_artist_id" json:"artist_id,omitempty"`
+	Type      string    `gorm:"size:20;not null;check:type IN ('front', 'back', 'disc', 'artist')" json:"type"`
+	Source    string    `gorm:"size:20;not null;check:source IN ('folder', 'embedded', 'upload')" json:"source"`
+	FileName  string    `gorm:"size:255;not null" json:"file_name"` // In the album or artist directory
+	Width     int32     `json:"width"`
+	Height    int32     `json:"height"`
+	FileSize  int64     `json:"file_size"`
+	Checksum  string    `gorm:"size:64;not null" json:"checksum"` // SHA-256 of the file, which names its resized variants
+	IsPrimary bool      `gorm:"not null" json:"is_primary"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (Image) TableName() string {
+	return "images"
+}
+
 // Playlist represents the playlists table
 type Playlist struct {
 	ID         int32     `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -198,11 +345,21 @@ type Playlist struct {
 	TrackCount int32     `json:"track_count"`
 	CoverArtID *int32    `json:"cover_art_id"` // foreign key to images table
 
+	// Smart playlists: tracks are evaluated from the rules (see the smartplaylist
+	// package) and stored as PlaylistTracks when refreshed
+	Rules       json.RawMessage `gorm:"type:jsonb" json:"rules,omitempty"`
+	RefreshedAt *time.Time      `json:"refreshed_at,omitempty"`
+
 	// Relationships
 	User   *User           `gorm:"foreignKey:UserID" json:"user"`
 	Tracks []PlaylistTrack `gorm:"foreignKey:PlaylistID" json:"tracks,omitempty"`
 }
 
+// IsSmart reports whether the playlist's tracks are defined by rules
+func (p *Playlist) IsSmart() bool {
+	return len(p.Rules) > 0 && string(p.Rules) != "null"
+}
+
 func (Playlist) TableName() string {
 	return "playlists"
 }
@@ -325,6 +482,156 @@ type Player struct {
 	UpdatedAt       time.Time `json:"updated_at"`
 }
 
+// PlayEvent is a completed play of a track (a scrobble). The table is
+// partitioned by month on PlayedAt; see the playhistory package.
+type PlayEvent struct {
+	ID             int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID         int64     `gorm:"not null" json:"user_id"`
+	TrackID        int64     `gorm:"not null" json:"track_id"`
+	PlayerID       *int32    `json:"player_id"`
+	Client         string    `gorm:"size:500" json:"client"`
+	PlayedAt       time.Time `gorm:"primaryKey" json:"played_at"` // When playback started
+	DurationPlayed int64     `json:"duration_played"`             // milliseconds
+	Source         string    `gorm:"size:50;not null" json:"source"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (PlayEvent) TableName() string {
+	return "play_events"
+}
+
+// NowPlaying is what a user's player is playing right now. There is one row
+// per user and client; rows expire rather than being removed when playback stops.
+type NowPlaying struct {
+	ID        int32     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    int64     `gorm:"not null" json:"user_id"`
+	PlayerID  *int32    `json:"player_id"`
+	Client    string    `gorm:"size:500;not null" json:"client"`
+	TrackID   int64     `gorm:"not null" json:"track_id"`
+	StartedAt time.Time `gorm:"not null" json:"started_at"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+
+	// Relationships
+	User   *User   `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Track  *Track  `gorm:"foreignKey:TrackID" json:"track,omitempty"`
+	Player *Player `gorm:"foreignKey:PlayerID" json:"player,omitempty"`
+}
+
+func (NowPlaying) TableName() string {
+	return "now_playing"
+}
+
+// TrackPlayStat is the daily roll-up of a user's play events for a track
+type TrackPlayStat struct {
+	UserID         int64     `gorm:"primaryKey" json:"user_id"`
+	TrackID        int64     `gorm:"primaryKey" json:"track_id"`
+	Day            time.Time `gorm:"primaryKey;type:date" json:"day"` // UTC
+	PlayCount      int32     `json:"play_count"`
+	DurationPlayed int64     `json:"duration_played"` // milliseconds
+	LastPlayedAt   time.Time `json:"last_played_at"`
+}
+
+func (TrackPlayStat) TableName() string {
+	return "track_play_stats"
+}
+
+// PlayStatsProgress records how far play events have been rolled up (a single row)
+type PlayStatsProgress struct {
+	ID          int32     `gorm:"primaryKey" json:"id"`
+	LastEventID int64     `json:"last_event_id"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (PlayStatsProgress) TableName() string {
+	return "play_stats_progress"
+}
+
+// ScrobblerAccount links a user to an external scrobbling service such as
+// Last.fm or ListenBrainz. The session is stored encrypted with the server key.
+type ScrobblerAccount struct {
+	ID               int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID           int64      `gorm:"not null;uniqueIndex:idx_scrobbler_accounts_user_service" json:"user_id"`
+	Service          string     `gorm:"size:50;not null;uniqueIndex:idx_scrobbler_accounts_user_service" json:"service"` // "lastfm" or "listenbrainz"
+	Username         string     `gorm:"size:255" json:"username"`                                                        // Account name at the service
+	EncryptedSession string     `gorm:"not null" json:"-"`                                                               // Never expose the session in JSON
+	Enabled          bool       `gorm:"default:true" json:"enabled"`                                                     // Cleared when the service rejects the session
+	LastError        string     `json:"last_error,omitempty"`
+	LastSubmittedAt  *time.Time `json:"last_submitted_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+func (ScrobblerAccount) TableName() string {
+	return "scrobbler_accounts"
+}
+
+// ScrobbleQueueEntry is a play waiting to be submitted to a linked scrobbler
+// account. Entries are removed once the service has accepted them.
+type ScrobbleQueueEntry struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	AccountID int64     `gorm:"not null;index:idx_scrobble_queue_account_played_at" json:"account_id"`
+	TrackID   int64     `gorm:"not null" json:"track_id"`
+	PlayedAt  time.Time `gorm:"not null;index:idx_scrobble_queue_account_played_at" json:"played_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (ScrobbleQueueEntry) TableName() string {
+	return "scrobble_queue"
+}
+
+// SimilarArtist is a precomputed neighbor of an artist, rebuilt by the similarity job
+type SimilarArtist struct {
+	ArtistID        int64   `gorm:"primaryKey;index:idx_similar_artists_artist_score,priority:1" json:"artist_id"`
+	SimilarArtistID int64   `gorm:"primaryKey" json:"similar_artist_id"`
+	Score           float64 `gorm:"not null;index:idx_similar_artists_artist_score,priority:2,sort:desc" json:"score"` // 0 to 1
+}
+
+func (SimilarArtist) TableName() string {
+	return "similar_artists"
+}
+
+// SimilarTrack is a precomputed neighbor of a track, rebuilt by the similarity job
+type SimilarTrack struct {
+	TrackID        int64   `gorm:"primaryKey;index:idx_similar_tracks_track_score,priority:1" json:"track_id"`
+	SimilarTrackID int64   `gorm:"primaryKey" json:"similar_track_id"`
+	Score          float64 `gorm:"not null;index:idx_similar_tracks_track_score,priority:2,sort:desc" json:"score"` // 0 to 1
+}
+
+func (SimilarTrack) TableName() string {
+	return "similar_tracks"
+}
+
+// MetadataProvenance records which metadata provider set a field of an
+// artist or album, so a less trusted provider doesn't replace it later
+type MetadataProvenance struct {
+	ID         int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	EntityType string    `gorm:"size:20;not null;uniqueIndex:idx_metadata_provenance_field" json:"entity_type"` // artist or album
+	EntityID   int64     `gorm:"not null;uniqueIndex:idx_metadata_provenance_field" json:"entity_id"`
+	Field      string    `gorm:"size:50;not null;uniqueIndex:idx_metadata_provenance_field" json:"field"`
+	Provider   string    `gorm:"size:50;not null" json:"provider"`
+	Value      string    `json:"value"` // Value as set, to tell when it was edited afterwards
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (MetadataProvenance) TableName() string {
+	return "metadata_provenance"
+}
+
+// MetadataCacheEntry is a cached metadata provider response. Lookups that
+// found nothing are cached too, with an empty body.
+type MetadataCacheEntry struct {
+	Provider  string    `gorm:"primaryKey;size:50" json:"provider"`
+	Key       string    `gorm:"primaryKey;size:64" json:"key"` // SHA-256 of the request URL
+	Status    int       `gorm:"not null" json:"status"`
+	Body      string    `json:"body"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (MetadataCacheEntry) TableName() string {
+	return "metadata_cache"
+}
+
 // PlayQueue represents play queues
 type PlayQueue struct {
 	ID             int32     `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -339,6 +646,34 @@ type PlayQueue struct {
 	UpdatedAt      time.Time `json:"updated_at"`
 }
 
+// JukeboxEntry is a track in the server-side jukebox queue
+type JukeboxEntry struct {
+	ID       int64 `gorm:"primaryKey;autoIncrement" json:"id"`
+	Position int32 `gorm:"not null;index" json:"position"` // Order in the queue
+	TrackID  int64 `gorm:"not null" json:"track_id"`
+
+	// Relationships
+	Track *Track `gorm:"foreignKey:TrackID" json:"track"`
+}
+
+func (JukeboxEntry) TableName() string {
+	return "jukebox_entries"
+}
+
+// JukeboxState holds the persisted playback state of the jukebox (a single row)
+type JukeboxState struct {
+	ID           int32     `gorm:"primaryKey" json:"id"`
+	CurrentIndex int32     `json:"current_index"`
+	Position     int32     `json:"position"` // seconds into the current track
+	Gain         float32   `json:"gain"`     // 0.0 - 1.0
+	Playing      bool      `json:"playing"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (JukeboxState) TableName() string {
+	return "jukebox_states"
+}
+
 // SearchHistory represents user search history
 type SearchHistory struct {
 	ID           int32     `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -349,29 +684,74 @@ type SearchHistory struct {
 	CreatedAt    time.Time `gorm:"index:idx_search_histories_created_at" json:"created_at"`
 }
 
-// Share represents shared content
+// Share represents shared content. Anyone holding the token can open the
+// share at /share/<token> until it expires or runs out of streams.
 type Share struct {
 	ID                  int32      `gorm:"primaryKey;autoIncrement" json:"id"`
 	UserID              int64      `gorm:"not null" json:"user_id"`
+	Token               string     `gorm:"size:64;uniqueIndex;not null" json:"token"`
 	Name                string     `gorm:"size:255" json:"name"`
 	Description         string     `json:"description"`
 	ExpiresAt           *time.Time `json:"expires_at"`
-	MaxStreamingMinutes int32      `json:"max_streaming_minutes"`
-	MaxStreamingCount   int32      `json:"max_streaming_count"`
+	MaxStreamingMinutes int32      `json:"max_streaming_minutes"` // 0 is unlimited
+	MaxStreamingCount   int32      `json:"max_streaming_count"`   // 0 is unlimited
 	AllowStreaming      bool       `gorm:"default:true" json:"allow_streaming"`
 	AllowDownload       bool       `gorm:"default:false" json:"allow_download"`
+	VisitCount          int32      `gorm:"default:0" json:"visit_count"`
+	LastVisitedAt       *time.Time `json:"last_visited_at"`
+	StreamCount         int32      `gorm:"default:0" json:"stream_count"`
+	StreamedSeconds     int64      `gorm:"default:0" json:"streamed_seconds"` // playing time of the tracks served, counted against MaxStreamingMinutes
 	CreatedAt           time.Time  `json:"created_at"`
 	UpdatedAt           time.Time  `json:"updated_at"`
 
 	// Relationships
-	User *User `gorm:"foreignKey:UserID" json:"user"`
+	User  *User       `gorm:"foreignKey:UserID" json:"user"`
+	Items []ShareItem `gorm:"foreignKey:ShareID" json:"items,omitempty"`
+}
+
+// BeforeCreate sets the token before creating a share
+func (s *Share) BeforeCreate(tx *gorm.DB) error {
+	if s.Token == "" {
+		token := make([]byte, 24)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		s.Token = base64.RawURLEncoding.EncodeToString(token)
+	}
+	return nil
 }
 
+// Share item types
+const (
+	ShareItemTrack    = "track"
+	ShareItemAlbum    = "album"
+	ShareItemPlaylist = "playlist"
+)
+
+// ShareItem is a track, album or playlist in a share. Albums and playlists
+// are expanded to their tracks when the share is opened.
+type ShareItem struct {
+	ID       int64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	ShareID  int32  `gorm:"index;not null" json:"share_id"`
+	ItemType string `gorm:"size:20;not null;check:item_type IN ('track', 'album', 'playlist')" json:"item_type"`
+	ItemID   int64  `gorm:"not null" json:"item_id"`
+	Position int32  `gorm:"not null" json:"position"`
+}
+
+// Share activity actions
+const (
+	ShareActionView     = "view"
+	ShareActionStream   = "stream"
+	ShareActionDownload = "download"
+)
+
 // ShareActivity represents share usage tracking
 type ShareActivity struct {
 	ID         int32     `gorm:"primaryKey;autoIncrement" json:"id"`
 	ShareID    int32     `gorm:"not null" json:"share_id"`
 	UserID     *int64    `json:"user_id"` // User who accessed (null if anonymous)
+	Action     string    `gorm:"size:20;not null" json:"action"`
+	TrackID    *int64    `json:"track_id"` // Track streamed or downloaded
 	IPAddress  string    `gorm:"size:45" json:"ip_address"`
 	AccessedAt time.Time `json:"accessed_at"`
 	UserAgent  string    `json:"user_agent"`
@@ -444,13 +824,62 @@ func (r *RadioStation) BeforeCreate(tx *gorm.DB) error {
 // Contributor represents song contributors like composers, performers, etc.
 type Contributor struct {
 	ID        int32     `gorm:"primaryKey;autoIncrement" json:"id"`
-	Name      string    `gorm:"size:255;not null" json:"name"`
-	Type      string    `gorm:"size:100;not null" json:"type"` // e.g., 'performer', 'composer', 'producer'
+	Name      string    `gorm:"size:255;not null;uniqueIndex:idx_contributors_name_type" json:"name"`
+	Type      string    `gorm:"size:100;not null;uniqueIndex:idx_contributors_name_type" json:"type"` // e.g., 'performer', 'composer', 'producer', 'featured'
 	SortName  string    `gorm:"size:255" json:"sort_name"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// TrackContributor links a track to one of its contributors, such as an
+// artist featured on it
+type TrackContributor struct {
+	TrackID       int64        `gorm:"primaryKey" json:"track_id"`
+	ContributorID int32        `gorm:"primaryKey" json:"contributor_id"`
+	Contributor   *Contributor `gorm:"foreignKey:ContributorID" json:"contributor,omitempty"`
+}
+
+func (TrackContributor) TableName() string {
+	return "track_contributors"
+}
+
+// Metadata rule fields and actions
+const (
+	MetadataRuleFieldTitle       = "title"
+	MetadataRuleFieldArtist      = "artist"
+	MetadataRuleFieldAlbumArtist = "album_artist"
+	MetadataRuleFieldAlbum       = "album"
+	MetadataRuleFieldGenre       = "genre"
+
+	MetadataRuleReplace           = "replace"            // replaces Pattern matches with Replacement
+	MetadataRuleMoveFeaturing     = "move_featuring"     // moves "feat. X" to the track's contributors
+	MetadataRuleStripBonus        = "strip_bonus"        // removes "[Bonus Track]" and the like
+	MetadataRuleNormalizeRemaster = "normalize_remaster" // rewrites remaster suffixes as "(Remastered YYYY)"
+	MetadataRuleTitleCase         = "title_case"
+)
+
+// MetadataRule cleans up a scanned field during inbound processing. Rules
+// run in Position order; the built-in actions run only where Pattern
+// matches, or everywhere when it is empty.
+type MetadataRule struct {
+	ID          int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	Name        string    `gorm:"size:255;not null" json:"name"`
+	Field       string    `gorm:"size:20;not null;check:field IN ('title', 'artist', 'album_artist', 'album', 'genre')" json:"field"`
+	Pattern     string    `json:"pattern"`
+	Action      string    `gorm:"size:30;not null;check:action IN ('replace', 'move_featuring', 'strip_bonus', 'normalize_remaster', 'title_case')" json:"action"`
+	Replacement string    `json:"replacement"`
+	LibraryID   *int32    `gorm:"index" json:"library_id"`     // only files scanned from this library, when set
+	ArtistName  string    `gorm:"size:255" json:"artist_name"` // only albums by this album artist, when set
+	Position    int32     `gorm:"not null;default:0" json:"position"`
+	Enabled     bool      `json:"enabled"` // no gorm default, so disabled rules can be created
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (MetadataRule) TableName() string {
+	return "metadata_rules"
+}
+
 // CapacityStatus represents the capacity status of a library
 type CapacityStatus struct {
 	ID           int32     `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -473,27 +902,102 @@ func (CapacityStatus) TableName() string {
 
 // StagingItem represents items in the file-based staging workflow
 type StagingItem struct {
-	ID           int64      `gorm:"primaryKey;autoIncrement" json:"id"`
-	ScanID       string     `gorm:"not null;index" json:"scan_id"`
-	StagingPath  string     `gorm:"not null;unique" json:"staging_path"`
-	MetadataFile string     `gorm:"not null" json:"metadata_file"`
-	ArtistName   string     `gorm:"not null;index:idx_staging_artist_album" json:"artist_name"`
-	AlbumName    string     `gorm:"not null;index:idx_staging_artist_album" json:"album_name"`
-	TrackCount   int32      `gorm:"default:0" json:"track_count"`
-	TotalSize    int64      `gorm:"default:0" json:"total_size"`
-	ProcessedAt  time.Time  `gorm:"not null" json:"processed_at"`
-	Status       string     `gorm:"size:50;not null;check:status IN ('pending_review', 'approved', 'rejected');index" json:"status"`
-	ReviewedBy   *int64     `json:"reviewed_by"`
-	ReviewedAt   *time.Time `json:"reviewed_at"`
-	Notes        string     `json:"notes"`
-	Checksum     string     `gorm:"not null" json:"checksum"`
-	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ID             int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	ScanID         string     `gorm:"not null;index" json:"scan_id"`
+	StagingPath    string     `gorm:"not null;unique" json:"staging_path"`
+	MetadataFile   string     `gorm:"not null" json:"metadata_file"`
+	ArtistName     string     `gorm:"not null;index:idx_staging_artist_album" json:"artist_name"`
+	AlbumName      string     `gorm:"not null;index:idx_staging_artist_album" json:"album_name"`
+	TrackCount     int32      `gorm:"default:0" json:"track_count"`
+	TotalSize      int64      `gorm:"default:0" json:"total_size"`
+	ProcessedAt    time.Time  `gorm:"not null" json:"processed_at"`
+	Status         string     `gorm:"size:50;not null;check:status IN ('pending_review', 'approved', 'rejected');index" json:"status"`
+	ReviewedBy     *int64     `json:"reviewed_by"`
+	ReviewedAt     *time.Time `json:"reviewed_at"`
+	Notes          string     `json:"notes"`
+	Checksum       string     `gorm:"not null" json:"checksum"`
+	DuplicateCount int32      `gorm:"default:0" json:"duplicate_count"` // Tracks that are likely duplicates of others
+	CreatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
 }
 
 func (StagingItem) TableName() string {
 	return "staging_items"
 }
 
+// StagingItemChange is a field of a staging item's album metadata changed by
+// a curator. Values are JSON encoded.
+type StagingItemChange struct {
+	ID            int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	StagingItemID int64     `gorm:"not null;index" json:"staging_item_id"`
+	EditorID      *int64    `json:"editor_id"`
+	Field         string    `gorm:"size:100;not null" json:"field"` // e.g. album.name, tracks[3].track_number
+	OldValue      string    `json:"old_value"`
+	NewValue      string    `json:"new_value"`
+	ChangedAt     time.Time `gorm:"not null" json:"changed_at"`
+}
+
+func (StagingItemChange) TableName() string {
+	return "staging_item_changes"
+}
+
+// Promotion job statuses. Files are copied while a job is copying, its rows
+// are created when it is committed, and the staging files are deleted before
+// it is completed.
+const (
+	PromotionStatusPending   = "pending"
+	PromotionStatusCopying   = "copying"
+	PromotionStatusCommitted = "committed"
+	PromotionStatusCompleted = "completed"
+	PromotionStatusFailed    = "failed"
+)
+
+// Promotion move statuses
+const (
+	PromotionMovePlanned = "planned"
+	PromotionMoveCopied  = "copied"
+	PromotionMoveDeleted = "deleted"
+)
+
+// PromotionJob is the promotion of an approved staging item to production.
+// Its file moves are journaled before any file is touched, so an interrupted
+// promotion can be finished when the worker starts again.
+type PromotionJob struct {
+	ID             int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	BatchID        string     `gorm:"size:36;not null;index" json:"batch_id"` // jobs queued together
+	StagingItemID  int64      `gorm:"not null;index" json:"staging_item_id"`  // the item is deleted when the job commits
+	Status         string     `gorm:"size:20;not null;check:status IN ('pending', 'copying', 'committed', 'completed', 'failed');index" json:"status"`
+	LibraryID      *int32     `json:"library_id"`
+	AlbumID        *int64     `json:"album_id"`
+	StagingPath    string     `json:"staging_path"`
+	ProductionPath string     `json:"production_path"`
+	FilesTotal     int32      `gorm:"default:0" json:"files_total"`
+	FilesCopied    int32      `gorm:"default:0" json:"files_copied"`
+	Error          string     `json:"error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	CompletedAt    *time.Time `json:"completed_at"`
+}
+
+func (PromotionJob) TableName() string {
+	return "promotion_jobs"
+}
+
+// PromotionMove is a file a promotion job moves from staging to production
+type PromotionMove struct {
+	ID         int64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	JobID      int64  `gorm:"not null;index" json:"job_id"`
+	SourcePath string `gorm:"not null" json:"source_path"`
+	TargetPath string `gorm:"not null" json:"target_path"`
+	Checksum   string `gorm:"size:64" json:"checksum"` // SHA-256 the copy must have; empty for files without one in the album metadata
+	Size       int64  `json:"size"`
+	Status     string `gorm:"size:20;not null;check:status IN ('planned', 'copied', 'deleted')" json:"status"`
+	Created    bool   `gorm:"default:false" json:"created"` // the job writes the target, so it may adopt or remove it
+}
+
+func (PromotionMove) TableName() string {
+	return "promotion_moves"
+}
+
 // PodcastChannel represents a podcast feed
 type PodcastChannel struct {
 	ID           int32            `gorm:"primaryKey;autoIncrement" json:"id"`
@@ -504,6 +1008,8 @@ type PodcastChannel struct {
 	ImageURL     string           `json:"image_url"`
 	Status       string           `gorm:"size:50;default:'new'" json:"status"` // new, downloading, completed, error
 	ErrorMessage string           `json:"error_message"`
+	KeepEpisodes int32            `gorm:"default:0" json:"keep_episodes"` // 0 uses the configured default
+	RefreshedAt  *time.Time       `json:"refreshed_at"`
 	CreatedAt    time.Time        `json:"created_at"`
 	UpdatedAt    time.Time        `json:"updated_at"`
 	Episodes     []PodcastEpisode `gorm:"foreignKey:ChannelID" json:"episodes"`
@@ -526,14 +1032,17 @@ type PodcastEpisode struct {
 	ID           int64           `gorm:"primaryKey;autoIncrement" json:"id"`
 	APIKey       uuid.UUID       `gorm:"type:uuid;uniqueIndex;default:gen_random_uuid()" json:"api_key"`
 	ChannelID    int32           `gorm:"not null;index" json:"channel_id"`
+	GUID         string          `gorm:"size:512;not null" json:"guid"` // Feed item guid, or the enclosure URL when the item has none
 	Title        string          `gorm:"size:255;not null" json:"title"`
 	Description  string          `json:"description"`
 	PublishDate  time.Time       `json:"publish_date"`
 	Duration     int             `json:"duration"`                            // in seconds
-	Status       string          `gorm:"size:50;default:'new'" json:"status"` // new, downloading, completed, error, skipped
+	Status       string          `gorm:"size:50;default:'new'" json:"status"` // new, downloading, completed, error, deleted, skipped
 	ErrorMessage string          `json:"error_message"`
-	FileName     string          `json:"file_name"`
+	EnclosureURL string          `json:"enclosure_url"`
+	FileName     string          `json:"file_name"` // Relative to the podcast library
 	FileSize     int64           `json:"file_size"`
+	Checksum     string          `gorm:"size:64" json:"checksum"` // SHA-256 of the downloaded file
 	ContentType  string          `json:"content_type"`
 	CreatedAt    time.Time       `json:"created_at"`
 	UpdatedAt    time.Time       `json:"updated_at"`
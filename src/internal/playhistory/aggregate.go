@@ -0,0 +1,215 @@
+package playhistory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"melodee/internal/models"
+)
+
+const (
+	aggregateBatchSize = 5000
+	partitionsAhead    = 1 // months of play_events partitions created in advance
+
+	// Events newer than this are left for the next run, so that an insert
+	// that took a lower ID but committed late is not skipped
+	aggregateSettleTime = 30 * time.Second
+)
+
+type statKey struct {
+	userID  int64
+	trackID int64
+	day     time.Time
+}
+
+// Aggregate rolls play events recorded since the last run up into
+// track_play_stats and returns how many events it rolled up. Each batch and
+// the progress marker are committed together, so an interrupted run resumes
+// where it stopped without counting any event twice.
+func (s *Service) Aggregate(ctx context.Context) (int, error) {
+	upTo := s.now().Add(-aggregateSettleTime).UTC()
+
+	total := 0
+	for {
+		count, more, err := s.aggregateBatch(ctx, upTo)
+		if err != nil {
+			return total, err
+		}
+		total += count
+		if !more {
+			return total, nil
+		}
+	}
+}
+
+// aggregateBatch rolls up one batch of events and reports whether more may follow
+func (s *Service) aggregateBatch(ctx context.Context, upTo time.Time) (int, bool, error) {
+	postgres := s.db.Dialector.Name() == "postgres"
+
+	count, more := 0, false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Runs are serialized on the progress row
+		progress := models.PlayStatsProgress{ID: 1}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&progress).Error; err != nil {
+			return fmt.Errorf("failed to initialize play stats progress: %w", err)
+		}
+		query := tx.Model(&models.PlayStatsProgress{})
+		if postgres {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if err := query.First(&progress, 1).Error; err != nil {
+			return fmt.Errorf("failed to load play stats progress: %w", err)
+		}
+
+		var events []models.PlayEvent
+		if err := tx.Where("id > ?", progress.LastEventID).
+			Order("id").Limit(aggregateBatchSize).Find(&events).Error; err != nil {
+			return fmt.Errorf("failed to load play events: %w", err)
+		}
+		fetched := len(events)
+		for i, event := range events {
+			if event.CreatedAt.After(upTo) {
+				events = events[:i]
+				break
+			}
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		stats := make(map[statKey]*models.TrackPlayStat)
+		order := make([]statKey, 0)
+		for _, event := range events {
+			playedAt := event.PlayedAt.UTC()
+			key := statKey{userID: event.UserID, trackID: event.TrackID, day: truncateDay(playedAt)}
+			stat, ok := stats[key]
+			if !ok {
+				stat = &models.TrackPlayStat{UserID: key.userID, TrackID: key.trackID, Day: key.day, LastPlayedAt: playedAt}
+				stats[key] = stat
+				order = append(order, key)
+			}
+			stat.PlayCount++
+			stat.DurationPlayed += event.DurationPlayed
+			if playedAt.After(stat.LastPlayedAt) {
+				stat.LastPlayedAt = playedAt
+			}
+		}
+
+		rows := make([]models.TrackPlayStat, 0, len(order))
+		for _, key := range order {
+			rows = append(rows, *stats[key])
+		}
+
+		latest := "MAX(track_play_stats.last_played_at, excluded.last_played_at)"
+		if postgres {
+			latest = "GREATEST(track_play_stats.last_played_at, excluded.last_played_at)"
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "user_id"}, {Name: "track_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"play_count":      gorm.Expr("track_play_stats.play_count + excluded.play_count"),
+				"duration_played": gorm.Expr("track_play_stats.duration_played + excluded.duration_played"),
+				"last_played_at":  gorm.Expr(latest),
+			}),
+		}).CreateInBatches(rows, 500).Error; err != nil {
+			return fmt.Errorf("failed to update play stats: %w", err)
+		}
+
+		progress.LastEventID = events[len(events)-1].ID
+		progress.UpdatedAt = s.now()
+		if err := tx.Save(&progress).Error; err != nil {
+			return fmt.Errorf("failed to save play stats progress: %w", err)
+		}
+
+		count = len(events)
+		more = fetched == aggregateBatchSize && count == fetched
+		return nil
+	})
+	return count, more, err
+}
+
+// EnsurePartitions creates the monthly play_events partitions for the
+// current and next month. Only Postgres partitions the table.
+func (s *Service) EnsurePartitions(ctx context.Context) error {
+	if s.db.Dialector.Name() != "postgres" {
+		return nil
+	}
+	if err := s.db.WithContext(ctx).Exec("SELECT melodee_ensure_play_event_partitions(?)", partitionsAhead).Error; err != nil {
+		return fmt.Errorf("failed to create play event partitions: %w", err)
+	}
+	return nil
+}
+
+// PruneEvents removes play events older than retentionMonths whole months;
+// 0 keeps everything. In Postgres expired monthly partitions are dropped.
+// Only events that have been rolled up are removed, so statistics are unaffected.
+func (s *Service) PruneEvents(ctx context.Context, retentionMonths int) (int64, error) {
+	if retentionMonths <= 0 {
+		return 0, nil
+	}
+
+	now := s.now().UTC()
+	cutoff := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -retentionMonths, 0)
+	db := s.db.WithContext(ctx)
+
+	var progress models.PlayStatsProgress
+	if err := db.Where("id = ?", 1).Limit(1).Find(&progress).Error; err != nil {
+		return 0, fmt.Errorf("failed to load play stats progress: %w", err)
+	}
+
+	if s.db.Dialector.Name() == "postgres" {
+		if err := s.dropPartitionsBefore(ctx, cutoff, progress.LastEventID); err != nil {
+			return 0, err
+		}
+	}
+
+	result := db.Where("played_at < ? AND id <= ?", cutoff, progress.LastEventID).Delete(&models.PlayEvent{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to prune play events: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// dropPartitionsBefore drops the monthly partitions that end before cutoff and
+// hold no event that is still to be rolled up
+func (s *Service) dropPartitionsBefore(ctx context.Context, cutoff time.Time, lastEventID int64) error {
+	db := s.db.WithContext(ctx)
+
+	var partitions []string
+	if err := db.Raw(`SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'play_events'::regclass`).Scan(&partitions).Error; err != nil {
+		return fmt.Errorf("failed to list play event partitions: %w", err)
+	}
+
+	for _, partition := range partitions {
+		var year, month int
+		if n, _ := fmt.Sscanf(partition, "play_events_y%4dm%2d", &year, &month); n != 2 {
+			continue // the default partition
+		}
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		if start.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+
+		// The name is rebuilt from the parsed date, never taken from the catalog as is
+		name := fmt.Sprintf("play_events_y%04dm%02d", year, month)
+		var pending int64
+		if err := db.Table(name).Where("id > ?", lastEventID).Count(&pending).Error; err != nil {
+			return fmt.Errorf("failed to check partition %s: %w", name, err)
+		}
+		if pending > 0 {
+			continue
+		}
+		if err := db.Exec("DROP TABLE IF EXISTS " + name).Error; err != nil {
+			return fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
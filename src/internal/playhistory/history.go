@@ -0,0 +1,204 @@
+// Package playhistory records what users play and turns it into listening
+// statistics. Completed plays are appended to the play_events log (partitioned
+// by month in Postgres); what a player is playing right now is kept apart in
+// now_playing. A periodic job rolls the log up into daily per-user track
+// counts, which back getTopSongs, the frequent and recent album lists and the
+// per-user stats API.
+package playhistory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"melodee/internal/models"
+)
+
+// ErrTrackNotFound is returned when a play refers to a track that does not exist
+var ErrTrackNotFound = errors.New("track not found")
+
+// Sources of play events
+const (
+	SourceSubsonic = "subsonic" // scrobble from an OpenSubsonic client
+	SourceAPI      = "api"      // the Melodee API
+)
+
+// nowPlayingFallback is how long a now playing entry lasts when the track's
+// duration is unknown; otherwise it lasts the track's duration plus nowPlayingGrace
+const (
+	nowPlayingFallback = 10 * time.Minute
+	nowPlayingGrace    = time.Minute
+)
+
+// Play is a play of a track by a user's player
+type Play struct {
+	UserID   int64
+	TrackID  int64
+	PlayerID *int32
+	Client   string
+	PlayedAt time.Time // when playback started
+	Source   string
+}
+
+// Service records plays and answers listening statistics queries
+type Service struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+// NewService creates a new play history service
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db, now: time.Now}
+}
+
+// RecordPlays appends completed plays to the play event log and updates the
+// users' play counts and last played times. A play is assumed to have lasted
+// the whole track. Plays with unknown tracks are rejected as a whole.
+func (s *Service) RecordPlays(ctx context.Context, plays []Play) error {
+	if len(plays) == 0 {
+		return nil
+	}
+
+	durations, err := s.trackDurations(ctx, plays)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		events := make([]models.PlayEvent, 0, len(plays))
+		for _, play := range plays {
+			events = append(events, models.PlayEvent{
+				UserID:         play.UserID,
+				TrackID:        play.TrackID,
+				PlayerID:       play.PlayerID,
+				Client:         play.Client,
+				PlayedAt:       play.PlayedAt.UTC(),
+				DurationPlayed: durations[play.TrackID],
+				Source:         play.Source,
+				CreatedAt:      now,
+			})
+		}
+		if err := tx.Create(&events).Error; err != nil {
+			return fmt.Errorf("failed to record play events: %w", err)
+		}
+
+		for _, play := range plays {
+			if err := recordUserTrackPlay(tx, play.UserID, play.TrackID, play.PlayedAt); err != nil {
+				return err
+			}
+
+			// The player has finished this track
+			if err := tx.Where("user_id = ? AND client = ? AND track_id = ?", play.UserID, play.Client, play.TrackID).
+				Delete(&models.NowPlaying{}).Error; err != nil {
+				return fmt.Errorf("failed to clear now playing: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// SetNowPlaying records that a user's player started playing a track. It
+// replaces whatever the same player was playing and does not count as a play.
+func (s *Service) SetNowPlaying(ctx context.Context, play Play) error {
+	durations, err := s.trackDurations(ctx, []Play{play})
+	if err != nil {
+		return err
+	}
+
+	expiresAt := play.PlayedAt.Add(nowPlayingFallback)
+	if duration := durations[play.TrackID]; duration > 0 {
+		expiresAt = play.PlayedAt.Add(time.Duration(duration)*time.Millisecond + nowPlayingGrace)
+	}
+
+	entry := models.NowPlaying{
+		UserID:    play.UserID,
+		PlayerID:  play.PlayerID,
+		Client:    play.Client,
+		TrackID:   play.TrackID,
+		StartedAt: play.PlayedAt.UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+	err = s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client"}},
+		DoUpdates: clause.AssignmentColumns([]string{"player_id", "track_id", "started_at", "expires_at"}),
+	}).Create(&entry).Error
+	if err != nil {
+		return fmt.Errorf("failed to record now playing: %w", err)
+	}
+	return nil
+}
+
+// NowPlaying returns the unexpired now playing entries with their users,
+// players and tracks, most recently started first. Expired entries are removed.
+func (s *Service) NowPlaying(ctx context.Context) ([]models.NowPlaying, error) {
+	now := s.now().UTC()
+	db := s.db.WithContext(ctx)
+
+	if err := db.Where("expires_at <= ?", now).Delete(&models.NowPlaying{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to remove expired now playing entries: %w", err)
+	}
+
+	var entries []models.NowPlaying
+	if err := db.Preload("User").Preload("Player").Preload("Track.Album").Preload("Track.Artist").
+		Where("expires_at > ?", now).Order("started_at DESC").Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to load now playing entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (s *Service) trackDurations(ctx context.Context, plays []Play) (map[int64]int64, error) {
+	ids := make([]int64, 0, len(plays))
+	for _, play := range plays {
+		ids = append(ids, play.TrackID)
+	}
+
+	var tracks []models.Track
+	if err := s.db.WithContext(ctx).Select("id", "duration").Where("id IN ?", ids).Find(&tracks).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tracks: %w", err)
+	}
+	durations := make(map[int64]int64, len(tracks))
+	for _, track := range tracks {
+		durations[track.ID] = track.Duration
+	}
+	for _, id := range ids {
+		if _, ok := durations[id]; !ok {
+			return nil, fmt.Errorf("%w: %d", ErrTrackNotFound, id)
+		}
+	}
+	return durations, nil
+}
+
+// recordUserTrackPlay bumps a user's play count for a track and moves its
+// last played time forward (plays submitted late never move it back)
+func recordUserTrackPlay(tx *gorm.DB, userID, trackID int64, playedAt time.Time) error {
+	var userTrack models.UserTrack
+	err := tx.Where("user_id = ? AND track_id = ?", userID, trackID).First(&userTrack).Error
+	if err == gorm.ErrRecordNotFound {
+		userTrack = models.UserTrack{
+			UserID:       userID,
+			TrackID:      trackID,
+			PlayedCount:  1,
+			LastPlayedAt: &playedAt,
+		}
+		if err := tx.Create(&userTrack).Error; err != nil {
+			return fmt.Errorf("failed to record play count: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load play count: %w", err)
+	}
+
+	userTrack.PlayedCount++
+	if userTrack.LastPlayedAt == nil || playedAt.After(*userTrack.LastPlayedAt) {
+		userTrack.LastPlayedAt = &playedAt
+	}
+	if err := tx.Save(&userTrack).Error; err != nil {
+		return fmt.Errorf("failed to record play count: %w", err)
+	}
+	return nil
+}
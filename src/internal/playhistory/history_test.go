@@ -0,0 +1,246 @@
+package playhistory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"melodee/internal/models"
+)
+
+func setupPlayHistoryTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT)`,
+		`CREATE TABLE players (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, client TEXT, user_id INTEGER)`,
+		`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`,
+		`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER, genres TEXT)`,
+		`CREATE TABLE tracks (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER, duration INTEGER)`,
+		`CREATE TABLE user_tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER, track_id INTEGER,
+			played_count INTEGER DEFAULT 0, last_played_at DATETIME,
+			is_starred BOOLEAN DEFAULT 0, is_hated BOOLEAN DEFAULT 0, starred_at DATETIME,
+			rating INTEGER DEFAULT 0, created_at DATETIME, updated_at DATETIME
+		)`,
+		`CREATE TABLE play_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, track_id INTEGER NOT NULL, player_id INTEGER, client TEXT,
+			played_at DATETIME NOT NULL, duration_played INTEGER NOT NULL DEFAULT 0,
+			source TEXT NOT NULL, created_at DATETIME
+		)`,
+		`CREATE TABLE track_play_stats (
+			user_id INTEGER NOT NULL, track_id INTEGER NOT NULL, day DATE NOT NULL,
+			play_count INTEGER NOT NULL DEFAULT 0, duration_played INTEGER NOT NULL DEFAULT 0,
+			last_played_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, track_id, day)
+		)`,
+		`CREATE TABLE play_stats_progress (id INTEGER PRIMARY KEY, last_event_id INTEGER NOT NULL DEFAULT 0, updated_at DATETIME)`,
+		`CREATE TABLE now_playing (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, player_id INTEGER, client TEXT NOT NULL, track_id INTEGER NOT NULL,
+			started_at DATETIME NOT NULL, expires_at DATETIME NOT NULL,
+			UNIQUE(user_id, client)
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO users (id, username) VALUES (1, 'alice'), (2, 'bob')`)
+	db.Exec(`INSERT INTO players (id, name, client, user_id) VALUES (5, 'DSub', 'DSub', 1)`)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Nirvana'), (2, 'Miles Davis')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id, genres) VALUES (1, 'Nevermind', 1, 'Rock,Grunge'), (2, 'Kind of Blue', 2, 'Jazz')`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, duration) VALUES
+		(10, 'Smells Like Teen Spirit', 1, 1, 301000),
+		(11, 'In Bloom', 1, 1, 254000),
+		(20, 'So What', 2, 2, 562000)`)
+	return db
+}
+
+// clearGenres lets albums be loaded into models: genres are arrays in Postgres
+// and sqlite can only hold them as text
+func clearGenres(db *gorm.DB) {
+	db.Exec(`UPDATE albums SET genres = NULL`)
+}
+
+func newTestService(db *gorm.DB, now *time.Time) *Service {
+	service := NewService(db)
+	service.now = func() time.Time { return *now }
+	return service
+}
+
+func TestService_RecordPlays(t *testing.T) {
+	db := setupPlayHistoryTestDB(t)
+	clearGenres(db)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	service := newTestService(db, &now)
+	ctx := context.Background()
+	playerID := int32(5)
+
+	require.NoError(t, service.SetNowPlaying(ctx, Play{UserID: 1, TrackID: 10, PlayerID: &playerID, Client: "DSub", PlayedAt: now}))
+	entries, err := service.NowPlaying(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alice", entries[0].User.Username)
+	assert.Equal(t, "DSub", entries[0].Player.Name)
+	assert.Equal(t, "Smells Like Teen Spirit", entries[0].Track.Name)
+
+	// Now playing does not count as a play
+	var events int64
+	db.Model(&models.PlayEvent{}).Count(&events)
+	assert.Zero(t, events)
+
+	earlier := now.Add(-time.Hour)
+	require.NoError(t, service.RecordPlays(ctx, []Play{
+		{UserID: 1, TrackID: 10, PlayerID: &playerID, Client: "DSub", PlayedAt: now, Source: SourceSubsonic},
+		{UserID: 1, TrackID: 10, Client: "DSub", PlayedAt: earlier, Source: SourceSubsonic},
+	}))
+
+	var recorded []models.PlayEvent
+	require.NoError(t, db.Order("id").Find(&recorded).Error)
+	require.Len(t, recorded, 2)
+	assert.Equal(t, int64(301000), recorded[0].DurationPlayed)
+	assert.Equal(t, SourceSubsonic, recorded[0].Source)
+
+	var userTrack models.UserTrack
+	require.NoError(t, db.Where("user_id = 1 AND track_id = 10").First(&userTrack).Error)
+	assert.Equal(t, int32(2), userTrack.PlayedCount)
+	assert.True(t, userTrack.LastPlayedAt.Equal(now), "a late submission does not move the last played time back")
+
+	// The finished track is no longer playing
+	entries, err = service.NowPlaying(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	err = service.RecordPlays(ctx, []Play{{UserID: 1, TrackID: 99, PlayedAt: now, Source: SourceSubsonic}})
+	assert.ErrorIs(t, err, ErrTrackNotFound)
+}
+
+func TestService_NowPlayingExpires(t *testing.T) {
+	db := setupPlayHistoryTestDB(t)
+	clearGenres(db)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	service := newTestService(db, &now)
+	ctx := context.Background()
+
+	require.NoError(t, service.SetNowPlaying(ctx, Play{UserID: 1, TrackID: 11, Client: "web", PlayedAt: now}))
+	require.NoError(t, service.SetNowPlaying(ctx, Play{UserID: 1, TrackID: 10, Client: "web", PlayedAt: now}))
+
+	entries, err := service.NowPlaying(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "one entry per player")
+	assert.Equal(t, int64(10), entries[0].TrackID)
+
+	now = now.Add(301*time.Second + time.Minute)
+	entries, err = service.NowPlaying(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestService_AggregateAndStats(t *testing.T) {
+	db := setupPlayHistoryTestDB(t)
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	service := newTestService(db, &now)
+	ctx := context.Background()
+
+	play := func(userID, trackID int64, at time.Time) Play {
+		return Play{UserID: userID, TrackID: trackID, Client: "web", PlayedAt: at, Source: SourceAPI}
+	}
+	require.NoError(t, service.RecordPlays(ctx, []Play{
+		play(1, 10, now.Add(-2*time.Hour)),
+		play(1, 10, now.Add(-time.Hour)),
+		play(1, 11, now.AddDate(0, 0, -3)),
+		play(1, 20, now.AddDate(0, -2, 0)),
+		play(2, 20, now.Add(-time.Hour)),
+	}))
+
+	// Events are left to settle before being rolled up
+	aggregated, err := service.Aggregate(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, aggregated)
+
+	now = now.Add(time.Minute)
+	aggregated, err = service.Aggregate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, aggregated)
+
+	// Running again does not count anything twice
+	aggregated, err = service.Aggregate(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, aggregated)
+
+	var stat models.TrackPlayStat
+	require.NoError(t, db.Where("user_id = 1 AND track_id = 10").First(&stat).Error)
+	assert.Equal(t, int32(2), stat.PlayCount)
+	assert.Equal(t, int64(2*301000), stat.DurationPlayed)
+
+	week, err := service.UserStats(ctx, 1, PeriodWeek, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), week.PlayCount)
+	assert.Equal(t, int64(2*301000+254000), week.ListeningTime)
+	require.Len(t, week.TopArtists, 1)
+	assert.Equal(t, Stat{ID: 1, Name: "Nirvana", PlayCount: 3, ListeningTime: 2*301000 + 254000}, week.TopArtists[0])
+	require.Len(t, week.TopTracks, 2)
+	assert.Equal(t, "Smells Like Teen Spirit", week.TopTracks[0].Name)
+	assert.Equal(t, "Nirvana", week.TopTracks[0].Artist)
+	assert.Equal(t, []string{"Grunge", "Rock"}, statNames(week.TopGenres))
+
+	all, err := service.UserStats(ctx, 1, PeriodAll, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), all.PlayCount)
+	assert.Nil(t, all.Since)
+	assert.Len(t, all.TopTracks, 1)
+
+	// Album lists and top songs come from the roll-up
+	var ids []int64
+	require.NoError(t, db.Model(&models.Album{}).Scopes(FrequentAlbums(1)).Pluck("albums.id", &ids).Error)
+	assert.Equal(t, []int64{1, 2}, ids)
+
+	require.NoError(t, db.Model(&models.Album{}).Scopes(RecentAlbums(2)).Pluck("albums.id", &ids).Error)
+	assert.Equal(t, []int64{2}, ids)
+
+	require.NoError(t, db.Model(&models.Track{}).Scopes(MostPlayedTracks).Pluck("tracks.id", &ids).Error)
+	assert.Equal(t, []int64{10, 20, 11}, ids)
+}
+
+func TestService_PruneEvents(t *testing.T) {
+	db := setupPlayHistoryTestDB(t)
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	service := newTestService(db, &now)
+	ctx := context.Background()
+
+	require.NoError(t, service.RecordPlays(ctx, []Play{
+		{UserID: 1, TrackID: 10, Client: "web", PlayedAt: now.AddDate(0, -3, 0), Source: SourceAPI},
+		{UserID: 1, TrackID: 11, Client: "web", PlayedAt: now.Add(-time.Hour), Source: SourceAPI},
+	}))
+
+	// Nothing that still has to be rolled up is pruned
+	pruned, err := service.PruneEvents(ctx, 1)
+	require.NoError(t, err)
+	assert.Zero(t, pruned)
+
+	now = now.Add(time.Minute)
+	_, err = service.Aggregate(ctx)
+	require.NoError(t, err)
+	pruned, err = service.PruneEvents(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+
+	stats, err := service.UserStats(ctx, 1, PeriodAll, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.PlayCount, "statistics outlive the events")
+}
+
+func statNames(stats []Stat) []string {
+	names := make([]string, 0, len(stats))
+	for _, stat := range stats {
+		names = append(names, stat.Name)
+	}
+	return names
+}
@@ -0,0 +1,226 @@
+package playhistory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Period is the time span listening statistics cover
+type Period string
+
+const (
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+	PeriodYear  Period = "year"
+	PeriodAll   Period = "all"
+)
+
+// ParsePeriod parses a period name, defaulting to a month
+func ParsePeriod(value string) (Period, error) {
+	switch Period(value) {
+	case "":
+		return PeriodMonth, nil
+	case PeriodWeek, PeriodMonth, PeriodYear, PeriodAll:
+		return Period(value), nil
+	}
+	return "", fmt.Errorf("invalid period %q: use week, month, year or all", value)
+}
+
+// since returns the first day a period covers, or the zero time for all time
+func (p Period) since(now time.Time) time.Time {
+	today := truncateDay(now.UTC())
+	switch p {
+	case PeriodWeek:
+		return today.AddDate(0, 0, -6)
+	case PeriodMonth:
+		return today.AddDate(0, 0, -29)
+	case PeriodYear:
+		return today.AddDate(0, 0, -364)
+	}
+	return time.Time{}
+}
+
+// Stat is a ranked artist, track or genre in a user's statistics
+type Stat struct {
+	ID            int64  `json:"id,omitempty"`
+	Name          string `json:"name"`
+	Artist        string `json:"artist,omitempty"` // tracks only
+	PlayCount     int64  `json:"play_count"`
+	ListeningTime int64  `json:"listening_time"` // milliseconds
+}
+
+// UserStats summarizes a user's listening over a period. Plays are counted
+// once they have been rolled up by the aggregation job.
+type UserStats struct {
+	Period        Period     `json:"period"`
+	Since         *time.Time `json:"since,omitempty"`
+	PlayCount     int64      `json:"play_count"`
+	ListeningTime int64      `json:"listening_time"` // milliseconds
+	TopArtists    []Stat     `json:"top_artists"`
+	TopTracks     []Stat     `json:"top_tracks"`
+	TopGenres     []Stat     `json:"top_genres"`
+}
+
+// UserStats returns a user's play totals and their top artists, tracks and
+// genres (each at most limit long) over a period
+func (s *Service) UserStats(ctx context.Context, userID int64, period Period, limit int) (*UserStats, error) {
+	stats := &UserStats{Period: period, TopArtists: []Stat{}, TopTracks: []Stat{}, TopGenres: []Stat{}}
+
+	since := period.since(s.now())
+	if !since.IsZero() {
+		stats.Since = &since
+	}
+	userPlays := func() *gorm.DB {
+		query := s.db.WithContext(ctx).Table("track_play_stats").Where("track_play_stats.user_id = ?", userID)
+		if !since.IsZero() {
+			query = query.Where("track_play_stats.day >= ?", since)
+		}
+		return query
+	}
+
+	var totals struct {
+		PlayCount     int64
+		ListeningTime int64
+	}
+	if err := userPlays().Select("COALESCE(SUM(play_count), 0) AS play_count, COALESCE(SUM(duration_played), 0) AS listening_time").
+		Scan(&totals).Error; err != nil {
+		return nil, fmt.Errorf("failed to sum plays: %w", err)
+	}
+	stats.PlayCount, stats.ListeningTime = totals.PlayCount, totals.ListeningTime
+
+	if err := userPlays().
+		Select("artists.id, artists.name, SUM(track_play_stats.play_count) AS play_count, SUM(track_play_stats.duration_played) AS listening_time").
+		Joins("JOIN tracks ON tracks.id = track_play_stats.track_id").
+		Joins("JOIN artists ON artists.id = tracks.artist_id").
+		Group("artists.id, artists.name").
+		Order("play_count DESC, listening_time DESC, artists.id").
+		Limit(limit).Scan(&stats.TopArtists).Error; err != nil {
+		return nil, fmt.Errorf("failed to rank artists: %w", err)
+	}
+
+	if err := userPlays().
+		Select("tracks.id, tracks.name, artists.name AS artist, SUM(track_play_stats.play_count) AS play_count, SUM(track_play_stats.duration_played) AS listening_time").
+		Joins("JOIN tracks ON tracks.id = track_play_stats.track_id").
+		Joins("LEFT JOIN artists ON artists.id = tracks.artist_id").
+		Group("tracks.id, tracks.name, artists.name").
+		Order("play_count DESC, listening_time DESC, tracks.id").
+		Limit(limit).Scan(&stats.TopTracks).Error; err != nil {
+		return nil, fmt.Errorf("failed to rank tracks: %w", err)
+	}
+
+	genres, err := s.topGenres(userPlays(), limit)
+	if err != nil {
+		return nil, err
+	}
+	stats.TopGenres = genres
+	return stats, nil
+}
+
+// topGenres ranks the genres of the albums of the played tracks
+func (s *Service) topGenres(plays *gorm.DB, limit int) ([]Stat, error) {
+	plays = plays.
+		Joins("JOIN tracks ON tracks.id = track_play_stats.track_id").
+		Joins("JOIN albums ON albums.id = tracks.album_id")
+
+	genres := []Stat{}
+	if s.db.Dialector.Name() == "postgres" {
+		err := plays.
+			Select("genre AS name, SUM(track_play_stats.play_count) AS play_count, SUM(track_play_stats.duration_played) AS listening_time").
+			Joins("CROSS JOIN LATERAL unnest(albums.genres) AS genre").
+			Group("genre").
+			Order("play_count DESC, listening_time DESC, genre").
+			Limit(limit).Scan(&genres).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to rank genres: %w", err)
+		}
+		return genres, nil
+	}
+
+	// Without arrays genres are stored comma separated
+	var rows []struct {
+		Genres        string
+		PlayCount     int64
+		ListeningTime int64
+	}
+	if err := plays.
+		Select("albums.genres, SUM(track_play_stats.play_count) AS play_count, SUM(track_play_stats.duration_played) AS listening_time").
+		Where("albums.genres IS NOT NULL").
+		Group("albums.genres").Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to rank genres: %w", err)
+	}
+	byName := make(map[string]*Stat)
+	for _, row := range rows {
+		for _, genre := range strings.Split(strings.Trim(row.Genres, "{}"), ",") {
+			genre = strings.Trim(strings.TrimSpace(genre), `"`)
+			if genre == "" {
+				continue
+			}
+			stat, ok := byName[genre]
+			if !ok {
+				stat = &Stat{Name: genre}
+				byName[genre] = stat
+			}
+			stat.PlayCount += row.PlayCount
+			stat.ListeningTime += row.ListeningTime
+		}
+	}
+	for _, stat := range byName {
+		genres = append(genres, *stat)
+	}
+	sort.Slice(genres, func(i, j int) bool {
+		if genres[i].PlayCount != genres[j].PlayCount {
+			return genres[i].PlayCount > genres[j].PlayCount
+		}
+		if genres[i].ListeningTime != genres[j].ListeningTime {
+			return genres[i].ListeningTime > genres[j].ListeningTime
+		}
+		return genres[i].Name < genres[j].Name
+	})
+	if len(genres) > limit {
+		genres = genres[:limit]
+	}
+	return genres, nil
+}
+
+// MostPlayedTracks is a scope on tracks that orders them by how often every
+// user has played them, unplayed tracks last
+func MostPlayedTracks(db *gorm.DB) *gorm.DB {
+	return db.
+		Joins(`LEFT JOIN (SELECT track_id, SUM(play_count) AS play_count FROM track_play_stats GROUP BY track_id) AS track_plays
+			ON track_plays.track_id = tracks.id`).
+		Order("COALESCE(track_plays.play_count, 0) DESC").
+		Order("tracks.id")
+}
+
+// FrequentAlbums returns a scope on albums that keeps the albums a user has
+// played, most played first
+func FrequentAlbums(userID int64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return joinAlbumPlays(db, userID).
+			Order("album_plays.play_count DESC").
+			Order("albums.id")
+	}
+}
+
+// RecentAlbums returns a scope on albums that keeps the albums a user has
+// played, most recently played first
+func RecentAlbums(userID int64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return joinAlbumPlays(db, userID).
+			Order("album_plays.last_played_at DESC").
+			Order("albums.id")
+	}
+}
+
+func joinAlbumPlays(db *gorm.DB, userID int64) *gorm.DB {
+	return db.Joins(`JOIN (SELECT tracks.album_id, SUM(track_play_stats.play_count) AS play_count,
+			MAX(track_play_stats.last_played_at) AS last_played_at
+		FROM track_play_stats JOIN tracks ON tracks.id = track_play_stats.track_id
+		WHERE track_play_stats.user_id = ? GROUP BY tracks.album_id) AS album_plays
+		ON album_plays.album_id = albums.id`, userID)
+}
@@ -0,0 +1,54 @@
+package playhistory
+
+import (
+	"context"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/config"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypePlayStatsAggregate = "stats:aggregate"
+)
+
+// NewAggregateTask creates a task that rolls play events up into statistics
+func NewAggregateTask() *asynq.Task {
+	return asynq.NewTask(TypePlayStatsAggregate, nil)
+}
+
+// TaskHandler runs play history jobs
+type TaskHandler struct {
+	service *Service
+	cfg     config.PlayHistoryConfig
+}
+
+// NewTaskHandler creates a new play history task handler
+func NewTaskHandler(service *Service, cfg config.PlayHistoryConfig) *TaskHandler {
+	return &TaskHandler{service: service, cfg: cfg}
+}
+
+// HandleAggregate keeps the play_events partitions ahead of time, rolls new
+// events up into statistics and prunes events past the retention period
+func (h *TaskHandler) HandleAggregate(ctx context.Context, t *asynq.Task) error {
+	if err := h.service.EnsurePartitions(ctx); err != nil {
+		// Events still land in the default partition
+		logging.Warnf("play history: %v", err)
+	}
+
+	aggregated, err := h.service.Aggregate(ctx)
+	if err != nil {
+		return err
+	}
+
+	pruned, err := h.service.PruneEvents(ctx, h.cfg.RetentionMonths)
+	if err != nil {
+		return err
+	}
+
+	if aggregated > 0 || pruned > 0 {
+		logging.Infof("play history: rolled up %d play events, pruned %d", aggregated, pruned)
+	}
+	return nil
+}
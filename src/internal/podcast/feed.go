@@ -0,0 +1,336 @@
+package podcast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	itunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+)
+
+// Feed is a parsed RSS or Atom podcast feed
+type Feed struct {
+	Title       string
+	Description string
+	ImageURL    string
+	Episodes    []FeedEpisode
+}
+
+// FeedEpisode is a feed item that carries an audio enclosure
+type FeedEpisode struct {
+	GUID          string
+	Title         string
+	Description   string
+	PublishDate   time.Time
+	Duration      int // seconds
+	EnclosureURL  string
+	EnclosureType string
+	EnclosureSize int64
+}
+
+// element captures an element whose name is shared between namespaces, such as
+// <title> and <itunes:title>, so the preferred one can be picked afterwards
+type element struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+	Href    string `xml:"href,attr"`
+	URL     string `xml:"url"`
+}
+
+type rssDocument struct {
+	Channel struct {
+		Titles       []element `xml:"title"`
+		Descriptions []element `xml:"description"`
+		Summaries    []element `xml:"summary"`
+		Images       []element `xml:"image"`
+		Items        []struct {
+			GUID         string    `xml:"guid"`
+			Titles       []element `xml:"title"`
+			Descriptions []element `xml:"description"`
+			Summaries    []element `xml:"summary"`
+			PubDate      string    `xml:"pubDate"`
+			Duration     string    `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+			Enclosure    struct {
+				URL    string `xml:"url,attr"`
+				Type   string `xml:"type,attr"`
+				Length string `xml:"length,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomDocument struct {
+	Titles    []element `xml:"title"`
+	Subtitles []element `xml:"subtitle"`
+	Logo      string    `xml:"logo"`
+	Icon      string    `xml:"icon"`
+	Images    []element `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+	Entries   []struct {
+		ID        string    `xml:"id"`
+		Titles    []element `xml:"title"`
+		Summaries []element `xml:"summary"`
+		Content   string    `xml:"content"`
+		Published string    `xml:"published"`
+		Updated   string    `xml:"updated"`
+		Duration  string    `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+		Links     []struct {
+			Rel    string `xml:"rel,attr"`
+			Href   string `xml:"href,attr"`
+			Type   string `xml:"type,attr"`
+			Length string `xml:"length,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// ParseFeed parses an RSS 2.0 or Atom feed, including the iTunes podcast
+// extensions. Items without an audio enclosure are skipped.
+func ParseFeed(r io.Reader) (*Feed, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed: %w", err)
+	}
+
+	root, err := rootElement(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch root.Local {
+	case "rss":
+		var doc rssDocument
+		if err := newDecoder(data).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to parse RSS feed: %w", err)
+		}
+		return doc.feed(), nil
+	case "feed":
+		var doc atomDocument
+		if err := newDecoder(data).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to parse Atom feed: %w", err)
+		}
+		return doc.feed(), nil
+	default:
+		return nil, fmt.Errorf("unsupported feed format: <%s>", root.Local)
+	}
+}
+
+func (doc *rssDocument) feed() *Feed {
+	channel := doc.Channel
+	feed := &Feed{
+		Title:       text(channel.Titles, ""),
+		Description: firstNonEmpty(text(channel.Descriptions, ""), text(channel.Summaries, itunesNamespace)),
+	}
+
+	// <itunes:image href> is usually larger than the RSS <image><url>
+	for _, image := range channel.Images {
+		if image.XMLName.Space == itunesNamespace && image.Href != "" {
+			feed.ImageURL = strings.TrimSpace(image.Href)
+			break
+		}
+		if feed.ImageURL == "" && image.URL != "" {
+			feed.ImageURL = strings.TrimSpace(image.URL)
+		}
+	}
+
+	for _, item := range channel.Items {
+		if item.Enclosure.URL == "" {
+			continue
+		}
+
+		episode := FeedEpisode{
+			GUID:          strings.TrimSpace(item.GUID),
+			Title:         firstNonEmpty(text(item.Titles, ""), text(item.Titles, itunesNamespace)),
+			Description:   firstNonEmpty(text(item.Descriptions, ""), text(item.Summaries, itunesNamespace)),
+			PublishDate:   parseDate(item.PubDate),
+			Duration:      parseDuration(item.Duration),
+			EnclosureURL:  strings.TrimSpace(item.Enclosure.URL),
+			EnclosureType: strings.TrimSpace(item.Enclosure.Type),
+		}
+		episode.EnclosureSize, _ = strconv.ParseInt(strings.TrimSpace(item.Enclosure.Length), 10, 64)
+		if episode.GUID == "" {
+			episode.GUID = episode.EnclosureURL
+		}
+		feed.Episodes = append(feed.Episodes, episode)
+	}
+	return feed
+}
+
+func (doc *atomDocument) feed() *Feed {
+	feed := &Feed{
+		Title:       firstNonEmpty(text(doc.Titles, atomNamespace), text(doc.Titles, "")),
+		Description: firstNonEmpty(text(doc.Subtitles, atomNamespace), text(doc.Subtitles, "")),
+		ImageURL:    strings.TrimSpace(firstNonEmpty(doc.Logo, doc.Icon)),
+	}
+	for _, image := range doc.Images {
+		if image.Href != "" {
+			feed.ImageURL = strings.TrimSpace(image.Href)
+			break
+		}
+	}
+
+	for _, entry := range doc.Entries {
+		episode := FeedEpisode{
+			GUID:        strings.TrimSpace(entry.ID),
+			Title:       firstNonEmpty(text(entry.Titles, atomNamespace), text(entry.Titles, "")),
+			Description: firstNonEmpty(text(entry.Summaries, atomNamespace), text(entry.Summaries, ""), strings.TrimSpace(entry.Content)),
+			PublishDate: parseDate(firstNonEmpty(entry.Published, entry.Updated)),
+			Duration:    parseDuration(entry.Duration),
+		}
+		for _, link := range entry.Links {
+			if link.Rel == "enclosure" && link.Href != "" {
+				episode.EnclosureURL = strings.TrimSpace(link.Href)
+				episode.EnclosureType = strings.TrimSpace(link.Type)
+				episode.EnclosureSize, _ = strconv.ParseInt(strings.TrimSpace(link.Length), 10, 64)
+				break
+			}
+		}
+		if episode.EnclosureURL == "" {
+			continue
+		}
+		if episode.GUID == "" {
+			episode.GUID = episode.EnclosureURL
+		}
+		feed.Episodes = append(feed.Episodes, episode)
+	}
+	return feed
+}
+
+// rootElement returns the name of the document's root element
+func rootElement(data []byte) (xml.Name, error) {
+	decoder := newDecoder(data)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.Name{}, fmt.Errorf("failed to parse feed: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name, nil
+		}
+	}
+}
+
+func newDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = charsetReader
+	return decoder
+}
+
+// charsetReader handles the non UTF-8 encodings feeds are commonly published in
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "windows-1252", "cp1252":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported feed charset: %s", charset)
+	}
+}
+
+// latin1Reader converts ISO-8859-1 bytes to UTF-8
+type latin1Reader struct {
+	r       *bufio.Reader
+	pending []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(l.pending) > 0 {
+			copied := copy(p[n:], l.pending)
+			l.pending = l.pending[copied:]
+			n += copied
+			continue
+		}
+
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		l.pending = utf8.AppendRune(nil, rune(b))
+	}
+	return n, nil
+}
+
+// text returns the trimmed text of the first element in the given namespace.
+// An empty namespace matches elements without one.
+func text(elements []element, namespace string) string {
+	for _, e := range elements {
+		if e.XMLName.Space == namespace {
+			return strings.TrimSpace(e.Text)
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon, 02 Jan 2006",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseDate parses the date formats found in RSS and Atom feeds
+func parseDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	for _, layout := range dateLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// parseDuration parses <itunes:duration>, which is either seconds or [HH:]MM:SS
+func parseDuration(value string) int {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	seconds := 0
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + int(n)
+	}
+	return seconds
+}
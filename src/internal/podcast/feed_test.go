@@ -0,0 +1,104 @@
+package podcast
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const rssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+  <channel>
+    <title>Test Show</title>
+    <description>A show about tests</description>
+    <image><url>https://example.com/small.jpg</url></image>
+    <itunes:image href="https://example.com/large.jpg"/>
+    <item>
+      <title>Episode 2</title>
+      <itunes:title>Two</itunes:title>
+      <guid isPermaLink="false">ep-2</guid>
+      <pubDate>Tue, 02 Jan 2024 10:00:00 +0000</pubDate>
+      <itunes:duration>1:02:03</itunes:duration>
+      <itunes:summary>Second episode</itunes:summary>
+      <enclosure url="https://example.com/ep2.mp3" type="audio/mpeg" length="1234"/>
+    </item>
+    <item>
+      <title>Episode 1</title>
+      <pubDate>Mon, 1 Jan 2024 10:00:00 GMT</pubDate>
+      <itunes:duration>125</itunes:duration>
+      <enclosure url="https://example.com/ep1.m4a" type="audio/mp4" length="99"/>
+    </item>
+    <item>
+      <title>Announcement without audio</title>
+    </item>
+  </channel>
+</rss>`
+
+func TestParseFeed_RSSWithITunes(t *testing.T) {
+	feed, err := ParseFeed(strings.NewReader(rssFeed))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Test Show", feed.Title)
+	assert.Equal(t, "A show about tests", feed.Description)
+	assert.Equal(t, "https://example.com/large.jpg", feed.ImageURL)
+	require.Len(t, feed.Episodes, 2)
+
+	second := feed.Episodes[0]
+	assert.Equal(t, "ep-2", second.GUID)
+	assert.Equal(t, "Episode 2", second.Title)
+	assert.Equal(t, "Second episode", second.Description)
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), second.PublishDate)
+	assert.Equal(t, 3723, second.Duration)
+	assert.Equal(t, "https://example.com/ep2.mp3", second.EnclosureURL)
+	assert.Equal(t, "audio/mpeg", second.EnclosureType)
+	assert.Equal(t, int64(1234), second.EnclosureSize)
+
+	// Items without a guid are identified by their enclosure
+	first := feed.Episodes[1]
+	assert.Equal(t, "https://example.com/ep1.m4a", first.GUID)
+	assert.Equal(t, 125, first.Duration)
+	assert.Equal(t, 2024, first.PublishDate.Year())
+}
+
+func TestParseFeed_Atom(t *testing.T) {
+	feed, err := ParseFeed(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Atom Show</title>
+  <subtitle>Atom description</subtitle>
+  <logo>https://example.com/logo.png</logo>
+  <entry>
+    <id>urn:uuid:1</id>
+    <title>Atom Episode</title>
+    <published>2024-03-01T08:30:00Z</published>
+    <summary>Summary</summary>
+    <link rel="alternate" href="https://example.com/page"/>
+    <link rel="enclosure" href="https://example.com/atom.ogg" type="audio/ogg" length="42"/>
+  </entry>
+</feed>`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Atom Show", feed.Title)
+	assert.Equal(t, "Atom description", feed.Description)
+	assert.Equal(t, "https://example.com/logo.png", feed.ImageURL)
+	require.Len(t, feed.Episodes, 1)
+	assert.Equal(t, "urn:uuid:1", feed.Episodes[0].GUID)
+	assert.Equal(t, "Atom Episode", feed.Episodes[0].Title)
+	assert.Equal(t, "https://example.com/atom.ogg", feed.Episodes[0].EnclosureURL)
+	assert.Equal(t, int64(42), feed.Episodes[0].EnclosureSize)
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC), feed.Episodes[0].PublishDate)
+}
+
+func TestParseFeed_Latin1(t *testing.T) {
+	feed, err := ParseFeed(strings.NewReader("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>" +
+		"<rss version=\"2.0\"><channel><title>Caf\xe9</title></channel></rss>"))
+	require.NoError(t, err)
+	assert.Equal(t, "Café", feed.Title)
+}
+
+func TestParseFeed_Unsupported(t *testing.T) {
+	_, err := ParseFeed(strings.NewReader(`<html><body>Not a feed</body></html>`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,580 @@
+package podcast
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"melodee/internal/config"
+	"melodee/internal/directory"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+)
+
+// LibraryType is the library type episodes are downloaded into
+const LibraryType = "podcast"
+
+const userAgent = "Melodee Podcast Fetcher"
+
+var (
+	// ErrChecksumMismatch is returned when a downloaded file does not match the digest sent by the server
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNotDownloaded is returned when an episode has no downloaded file
+	ErrNotDownloaded = errors.New("episode has not been downloaded")
+)
+
+// Service refreshes podcast feeds and downloads their episodes into the podcast library
+type Service struct {
+	db           *gorm.DB
+	client       *http.Client
+	paths        *directory.LibraryPathResolver
+	keepEpisodes int
+	autoDownload bool
+}
+
+// NewService creates a new podcast service
+func NewService(db *gorm.DB, cfg config.PodcastConfig) *Service {
+	return &Service{
+		db:           db,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		paths:        directory.NewLibraryPathResolver(db, nil),
+		keepEpisodes: cfg.KeepEpisodes,
+		autoDownload: cfg.AutoDownload,
+	}
+}
+
+// RefreshAll refreshes every channel and returns the episodes that should be
+// downloaded. A channel that fails to refresh is marked with the error and
+// does not stop the others.
+func (s *Service) RefreshAll(ctx context.Context) ([]int64, error) {
+	var channelIDs []int32
+	if err := s.db.Model(&models.PodcastChannel{}).Order("id").Pluck("id", &channelIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load podcast channels: %w", err)
+	}
+
+	var downloads []int64
+	for _, channelID := range channelIDs {
+		if err := ctx.Err(); err != nil {
+			return downloads, err
+		}
+
+		episodeIDs, err := s.RefreshChannel(ctx, channelID)
+		if err != nil {
+			logging.Warnf("podcast: failed to refresh channel %d: %v", channelID, err)
+			continue
+		}
+		downloads = append(downloads, episodeIDs...)
+	}
+	return downloads, nil
+}
+
+// RefreshChannel fetches a channel's feed, updates the channel and records new
+// episodes. It returns the new episodes that should be downloaded: with
+// auto download on, the new ones among the newest episodes the channel keeps.
+func (s *Service) RefreshChannel(ctx context.Context, channelID int32) ([]int64, error) {
+	var channel models.PodcastChannel
+	if err := s.db.First(&channel, channelID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load podcast channel %d: %w", channelID, err)
+	}
+
+	feed, err := s.fetchFeed(ctx, channel.URL)
+	if err != nil {
+		s.db.Model(&channel).Updates(map[string]interface{}{
+			"status":        "error",
+			"error_message": err.Error(),
+		})
+		return nil, err
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"status":        "completed",
+		"error_message": "",
+		"refreshed_at":  now,
+	}
+	if feed.Title != "" {
+		updates["title"] = truncate(feed.Title, 255)
+	}
+	if feed.Description != "" {
+		updates["description"] = feed.Description
+	}
+	if feed.ImageURL != "" {
+		updates["image_url"] = feed.ImageURL
+	}
+	if err := s.db.Model(&channel).Updates(updates).Error; err != nil {
+		return nil, fmt.Errorf("failed to update podcast channel %d: %w", channelID, err)
+	}
+
+	var existing []string
+	if err := s.db.Model(&models.PodcastEpisode{}).Where("channel_id = ?", channelID).Pluck("guid", &existing).Error; err != nil {
+		return nil, fmt.Errorf("failed to load episodes of channel %d: %w", channelID, err)
+	}
+	known := make(map[string]bool, len(existing))
+	for _, guid := range existing {
+		known[guid] = true
+	}
+
+	// Newest first, so the episodes retention would keep are the first ones
+	episodes := feed.Episodes
+	sort.SliceStable(episodes, func(i, j int) bool {
+		return episodes[i].PublishDate.After(episodes[j].PublishDate)
+	})
+
+	keep := s.keepFor(&channel)
+	var downloads []int64
+	for i, item := range episodes {
+		if known[item.GUID] {
+			continue
+		}
+		known[item.GUID] = true
+
+		status := "new"
+		if keep > 0 && i >= keep {
+			status = "skipped"
+		}
+
+		episode := models.PodcastEpisode{
+			ChannelID:    channelID,
+			GUID:         truncate(item.GUID, 512),
+			Title:        truncate(firstNonEmpty(item.Title, item.GUID), 255),
+			Description:  item.Description,
+			PublishDate:  item.PublishDate,
+			Duration:     item.Duration,
+			Status:       status,
+			EnclosureURL: item.EnclosureURL,
+			FileSize:     item.EnclosureSize,
+			ContentType:  item.EnclosureType,
+		}
+		if err := s.db.Create(&episode).Error; err != nil {
+			return downloads, fmt.Errorf("failed to save episode %q: %w", item.Title, err)
+		}
+		if status == "new" && s.autoDownload {
+			downloads = append(downloads, episode.ID)
+		}
+	}
+	return downloads, nil
+}
+
+// DownloadEpisode downloads an episode's enclosure into the podcast library.
+// An interrupted download resumes from the partial file on the next attempt.
+func (s *Service) DownloadEpisode(ctx context.Context, episodeID int64) error {
+	var episode models.PodcastEpisode
+	if err := s.db.First(&episode, episodeID).Error; err != nil {
+		return fmt.Errorf("failed to load podcast episode %d: %w", episodeID, err)
+	}
+	if episode.EnclosureURL == "" {
+		return fmt.Errorf("podcast episode %d has no enclosure", episodeID)
+	}
+
+	library, err := s.paths.LibraryOfType(LibraryType)
+	if err != nil {
+		return err
+	}
+
+	relativePath := filepath.Join(strconv.Itoa(int(episode.ChannelID)), strconv.FormatInt(episode.ID, 10)+episodeExtension(&episode))
+	destination, err := s.paths.Resolve(library, relativePath)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do when the file on disk is the one already recorded
+	if episode.Status == "completed" && episode.Checksum != "" {
+		if checksum, err := fileChecksum(destination); err == nil && checksum == episode.Checksum {
+			return nil
+		}
+	}
+
+	s.db.Model(&episode).Updates(map[string]interface{}{"status": "downloading", "error_message": ""})
+
+	result, err := s.download(ctx, episode.EnclosureURL, destination)
+	if err != nil {
+		s.db.Model(&episode).Updates(map[string]interface{}{"status": "error", "error_message": err.Error()})
+		return fmt.Errorf("failed to download episode %d: %w", episodeID, err)
+	}
+
+	updates := map[string]interface{}{
+		"status":        "completed",
+		"error_message": "",
+		"file_name":     relativePath,
+		"file_size":     result.size,
+		"checksum":      result.checksum,
+	}
+	if result.contentType != "" {
+		updates["content_type"] = result.contentType
+	}
+	if err := s.db.Model(&episode).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to update podcast episode %d: %w", episodeID, err)
+	}
+
+	return s.ApplyRetention(episode.ChannelID)
+}
+
+// ApplyRetention deletes the files of downloaded episodes beyond the newest
+// ones the channel keeps
+func (s *Service) ApplyRetention(channelID int32) error {
+	var channel models.PodcastChannel
+	if err := s.db.First(&channel, channelID).Error; err != nil {
+		return fmt.Errorf("failed to load podcast channel %d: %w", channelID, err)
+	}
+
+	keep := s.keepFor(&channel)
+	if keep <= 0 {
+		return nil
+	}
+
+	var downloaded []models.PodcastEpisode
+	if err := s.db.Where("channel_id = ? AND status = ?", channelID, "completed").
+		Order("publish_date DESC, id DESC").Find(&downloaded).Error; err != nil {
+		return fmt.Errorf("failed to load episodes of channel %d: %w", channelID, err)
+	}
+
+	for i := keep; i < len(downloaded); i++ {
+		if err := s.removeEpisodeFile(&downloaded[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteEpisode deletes an episode's downloaded file. The episode is kept,
+// marked deleted, so later refreshes do not download it again.
+func (s *Service) DeleteEpisode(episodeID int64) error {
+	var episode models.PodcastEpisode
+	if err := s.db.First(&episode, episodeID).Error; err != nil {
+		return fmt.Errorf("failed to load podcast episode %d: %w", episodeID, err)
+	}
+	return s.removeEpisodeFile(&episode)
+}
+
+// DeleteChannel deletes a channel, its episodes and their downloaded files
+func (s *Service) DeleteChannel(channelID int32) error {
+	if library, err := s.paths.LibraryOfType(LibraryType); err == nil {
+		channelDirectory, err := s.paths.Resolve(library, strconv.Itoa(int(channelID)))
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(channelDirectory); err != nil {
+			return fmt.Errorf("failed to delete files of channel %d: %w", channelID, err)
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("channel_id = ?", channelID).Delete(&models.PodcastEpisode{}).Error; err != nil {
+			return fmt.Errorf("failed to delete episodes of channel %d: %w", channelID, err)
+		}
+		result := tx.Delete(&models.PodcastChannel{}, channelID)
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete podcast channel %d: %w", channelID, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// EpisodePath returns the absolute path of an episode's downloaded file
+func (s *Service) EpisodePath(episode *models.PodcastEpisode) (string, error) {
+	return EpisodePath(s.paths, episode)
+}
+
+// EpisodePath returns the absolute path of an episode's downloaded file
+func EpisodePath(paths *directory.LibraryPathResolver, episode *models.PodcastEpisode) (string, error) {
+	if episode.Status != "completed" || episode.FileName == "" {
+		return "", ErrNotDownloaded
+	}
+
+	library, err := paths.LibraryOfType(LibraryType)
+	if err != nil {
+		return "", err
+	}
+	return paths.Resolve(library, episode.FileName)
+}
+
+// keepFor returns how many downloaded episodes a channel keeps, 0 meaning all
+func (s *Service) keepFor(channel *models.PodcastChannel) int {
+	if channel.KeepEpisodes > 0 {
+		return int(channel.KeepEpisodes)
+	}
+	return s.keepEpisodes
+}
+
+func (s *Service) removeEpisodeFile(episode *models.PodcastEpisode) error {
+	if path, err := s.EpisodePath(episode); err == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete episode file %s: %w", path, err)
+		}
+	}
+
+	return s.db.Model(episode).Updates(map[string]interface{}{
+		"status":    "deleted",
+		"file_name": "",
+		"checksum":  "",
+	}).Error
+}
+
+func (s *Service) fetchFeed(ctx context.Context, url string) (*Feed, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch feed: %s", resp.Status)
+	}
+	return ParseFeed(resp.Body)
+}
+
+type downloadResult struct {
+	size        int64
+	checksum    string
+	contentType string
+}
+
+// download fetches url into destination through a ".part" file, resuming the
+// partial file with a range request when one is left from an earlier attempt.
+// The completed file is checked against the expected length and any digest
+// the server sent before it is moved into place.
+func (s *Service) download(ctx context.Context, url, destination string) (*downloadResult, error) {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create episode directory: %w", err)
+	}
+
+	partial := destination + ".part"
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid enclosure URL: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var total int64 = -1
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Full body, either a fresh download or a server without range support
+		offset = 0
+		flags |= os.O_TRUNC
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(partial)
+			return nil, fmt.Errorf("unexpected Content-Range %q for resume at %d", resp.Header.Get("Content-Range"), offset)
+		}
+		flags |= os.O_APPEND
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file may already hold the whole enclosure
+		_, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || size != offset {
+			os.Remove(partial)
+			return nil, fmt.Errorf("cannot resume download at %d: %s", offset, resp.Status)
+		}
+		total = size
+	default:
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		file, err := os.OpenFile(partial, flags, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", partial, err)
+		}
+		_, copyErr := io.Copy(file, resp.Body)
+		closeErr := file.Close()
+		if copyErr != nil {
+			return nil, fmt.Errorf("download interrupted: %w", copyErr)
+		}
+		if closeErr != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", partial, closeErr)
+		}
+	}
+
+	info, err := os.Stat(partial)
+	if err != nil {
+		return nil, err
+	}
+	if total >= 0 && info.Size() != total {
+		return nil, fmt.Errorf("incomplete download: got %d of %d bytes", info.Size(), total)
+	}
+
+	sha, md, err := fileDigests(partial)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigests(resp, sha, md); err != nil {
+		// A corrupt partial file must not be resumed
+		os.Remove(partial)
+		return nil, err
+	}
+
+	if err := os.Rename(partial, destination); err != nil {
+		return nil, fmt.Errorf("failed to move download into place: %w", err)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	return &downloadResult{
+		size:        info.Size(),
+		checksum:    hex.EncodeToString(sha),
+		contentType: contentType,
+	}, nil
+}
+
+// verifyDigests checks the downloaded file against the Digest header (RFC 3230,
+// covering the whole file) and, for full responses, Content-MD5
+func verifyDigests(resp *http.Response, sha, md []byte) error {
+	for _, value := range strings.Split(resp.Header.Get("Digest"), ",") {
+		algorithm, encoded, found := strings.Cut(strings.TrimSpace(value), "=")
+		if !found {
+			continue
+		}
+		var actual []byte
+		switch strings.ToLower(algorithm) {
+		case "sha-256":
+			actual = sha
+		case "md5":
+			actual = md
+		default:
+			continue
+		}
+		if base64.StdEncoding.EncodeToString(actual) != encoded {
+			return fmt.Errorf("%w: %s digest does not match", ErrChecksumMismatch, algorithm)
+		}
+	}
+
+	if expected := resp.Header.Get("Content-MD5"); expected != "" && resp.StatusCode == http.StatusOK {
+		if base64.StdEncoding.EncodeToString(md) != expected {
+			return fmt.Errorf("%w: Content-MD5 does not match", ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes start-end/size" and "bytes */size"
+func parseContentRange(value string) (start, size int64, ok bool) {
+	value, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, sizeValue, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, false
+	}
+
+	size, err := strconv.ParseInt(sizeValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if span == "*" {
+		return 0, size, true
+	}
+
+	startValue, _, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err = strconv.ParseInt(startValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+func fileDigests(path string) (sha, md []byte, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	shaHash := sha256.New()
+	mdHash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(shaHash, mdHash), file); err != nil {
+		return nil, nil, fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+	return shaHash.Sum(nil), mdHash.Sum(nil), nil
+}
+
+func fileChecksum(path string) (string, error) {
+	sha, _, err := fileDigests(path)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha), nil
+}
+
+// episodeExtension picks the file extension from the enclosure URL, falling
+// back to the enclosure's content type
+func episodeExtension(episode *models.PodcastEpisode) string {
+	urlPath := episode.EnclosureURL
+	if i := strings.IndexAny(urlPath, "?#"); i >= 0 {
+		urlPath = urlPath[:i]
+	}
+	if ext := strings.ToLower(path.Ext(urlPath)); len(ext) > 1 && len(ext) <= 5 {
+		return ext
+	}
+
+	switch strings.ToLower(episode.ContentType) {
+	case "audio/mpeg", "audio/mp3":
+		return ".mp3"
+	case "audio/mp4", "audio/x-m4a", "audio/aac":
+		return ".m4a"
+	case "audio/ogg":
+		return ".ogg"
+	}
+	if extensions, err := mime.ExtensionsByType(episode.ContentType); err == nil && len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ".mp3"
+}
+
+func truncate(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	// Cut on a rune boundary
+	for max > 0 && !utf8.RuneStart(value[max]) {
+		max--
+	}
+	return value[:max]
+}
@@ -0,0 +1,250 @@
+package podcast
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func setupPodcastTestDB(t *testing.T, libraryPath string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE podcast_channels (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		url TEXT UNIQUE,
+		title TEXT,
+		description TEXT,
+		image_url TEXT,
+		status TEXT DEFAULT 'new',
+		error_message TEXT,
+		keep_episodes INTEGER DEFAULT 0,
+		refreshed_at DATETIME,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE podcast_episodes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		channel_id INTEGER,
+		guid TEXT,
+		title TEXT,
+		description TEXT,
+		publish_date DATETIME,
+		duration INTEGER,
+		status TEXT DEFAULT 'new',
+		error_message TEXT,
+		enclosure_url TEXT,
+		file_name TEXT,
+		file_size INTEGER,
+		checksum TEXT,
+		content_type TEXT,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE(channel_id, guid)
+	)`).Error)
+
+	require.NoError(t, db.Exec(`INSERT INTO libraries (name, path, type) VALUES ('Podcasts', ?, 'podcast')`, libraryPath).Error)
+	return db
+}
+
+func newTestService(db *gorm.DB, keep int) *Service {
+	return NewService(db, config.PodcastConfig{KeepEpisodes: keep, AutoDownload: true, Timeout: 10 * time.Second})
+}
+
+// audio is served with range support by http.ServeContent
+var audio = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func audioDigest() string {
+	sum := sha256.Sum256(audio)
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestService_RefreshAndDownload(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed.xml":
+			fmt.Fprintf(w, `<rss version="2.0"><channel><title>Show</title>
+				<item><guid>3</guid><title>Three</title><pubDate>Wed, 03 Jan 2024 10:00:00 +0000</pubDate><enclosure url="%[1]s/3.mp3" type="audio/mpeg"/></item>
+				<item><guid>2</guid><title>Two</title><pubDate>Tue, 02 Jan 2024 10:00:00 +0000</pubDate><enclosure url="%[1]s/2.mp3" type="audio/mpeg"/></item>
+				<item><guid>1</guid><title>One</title><pubDate>Mon, 01 Jan 2024 10:00:00 +0000</pubDate><enclosure url="%[1]s/1.mp3" type="audio/mpeg"/></item>
+				</channel></rss>`, server.URL)
+		default:
+			w.Header().Set("Digest", audioDigest())
+			http.ServeContent(w, r, "episode.mp3", time.Time{}, bytes.NewReader(audio))
+		}
+	}))
+	defer server.Close()
+
+	libraryPath := t.TempDir()
+	db := setupPodcastTestDB(t, libraryPath)
+	service := newTestService(db, 2)
+
+	channel := models.PodcastChannel{URL: server.URL + "/feed.xml", Status: "new"}
+	require.NoError(t, db.Create(&channel).Error)
+
+	downloads, err := service.RefreshChannel(context.Background(), channel.ID)
+	require.NoError(t, err)
+	require.Len(t, downloads, 2, "only the newest episodes the channel keeps are downloaded")
+
+	require.NoError(t, db.First(&channel, channel.ID).Error)
+	assert.Equal(t, "Show", channel.Title)
+	assert.Equal(t, "completed", channel.Status)
+	assert.NotNil(t, channel.RefreshedAt)
+
+	var skipped models.PodcastEpisode
+	require.NoError(t, db.Where("guid = ?", "1").First(&skipped).Error)
+	assert.Equal(t, "skipped", skipped.Status)
+
+	// A second refresh finds nothing new
+	again, err := service.RefreshChannel(context.Background(), channel.ID)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	for _, episodeID := range downloads {
+		require.NoError(t, service.DownloadEpisode(context.Background(), episodeID))
+	}
+
+	var episode models.PodcastEpisode
+	require.NoError(t, db.First(&episode, downloads[0]).Error)
+	assert.Equal(t, "completed", episode.Status)
+	assert.Equal(t, int64(len(audio)), episode.FileSize)
+	sum := sha256.Sum256(audio)
+	assert.Equal(t, hex.EncodeToString(sum[:]), episode.Checksum)
+
+	path, err := service.EpisodePath(&episode)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(libraryPath, fmt.Sprint(channel.ID), fmt.Sprintf("%d.mp3", episode.ID)), path)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, audio, content)
+}
+
+func TestService_DownloadResumesPartialFile(t *testing.T) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Digest", audioDigest())
+		http.ServeContent(w, r, "episode.mp3", time.Time{}, bytes.NewReader(audio))
+	}))
+	defer server.Close()
+
+	libraryPath := t.TempDir()
+	db := setupPodcastTestDB(t, libraryPath)
+	service := newTestService(db, 0)
+
+	channel := models.PodcastChannel{URL: "https://example.com/feed.xml"}
+	require.NoError(t, db.Create(&channel).Error)
+	episode := models.PodcastEpisode{ChannelID: channel.ID, GUID: "1", Title: "One", Status: "error", EnclosureURL: server.URL + "/1.mp3"}
+	require.NoError(t, db.Create(&episode).Error)
+
+	// Leave half the file behind, as an interrupted download would
+	destination := filepath.Join(libraryPath, fmt.Sprint(channel.ID), fmt.Sprintf("%d.mp3", episode.ID))
+	require.NoError(t, os.MkdirAll(filepath.Dir(destination), 0755))
+	require.NoError(t, os.WriteFile(destination+".part", audio[:len(audio)/2], 0644))
+
+	require.NoError(t, service.DownloadEpisode(context.Background(), episode.ID))
+	assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(audio)/2)}, ranges)
+
+	content, err := os.ReadFile(destination)
+	require.NoError(t, err)
+	assert.Equal(t, audio, content)
+	assert.NoFileExists(t, destination+".part")
+}
+
+func TestService_DownloadRejectsChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+		http.ServeContent(w, r, "episode.mp3", time.Time{}, bytes.NewReader(audio))
+	}))
+	defer server.Close()
+
+	libraryPath := t.TempDir()
+	db := setupPodcastTestDB(t, libraryPath)
+	service := newTestService(db, 0)
+
+	channel := models.PodcastChannel{URL: "https://example.com/feed.xml"}
+	require.NoError(t, db.Create(&channel).Error)
+	episode := models.PodcastEpisode{ChannelID: channel.ID, GUID: "1", Title: "One", EnclosureURL: server.URL + "/1.mp3"}
+	require.NoError(t, db.Create(&episode).Error)
+
+	err := service.DownloadEpisode(context.Background(), episode.ID)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	require.NoError(t, db.First(&episode, episode.ID).Error)
+	assert.Equal(t, "error", episode.Status)
+	assert.True(t, strings.Contains(episode.ErrorMessage, "checksum"))
+
+	entries, _ := os.ReadDir(filepath.Join(libraryPath, fmt.Sprint(channel.ID)))
+	assert.Empty(t, entries, "a corrupt download is not kept for resuming")
+}
+
+func TestService_RetentionKeepsNewestEpisodes(t *testing.T) {
+	libraryPath := t.TempDir()
+	db := setupPodcastTestDB(t, libraryPath)
+	service := newTestService(db, 5)
+
+	channel := models.PodcastChannel{URL: "https://example.com/feed.xml", KeepEpisodes: 2}
+	require.NoError(t, db.Create(&channel).Error)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var episodes []models.PodcastEpisode
+	for i := 0; i < 4; i++ {
+		fileName := filepath.Join(fmt.Sprint(channel.ID), fmt.Sprintf("%d.mp3", i))
+		require.NoError(t, os.MkdirAll(filepath.Join(libraryPath, fmt.Sprint(channel.ID)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(libraryPath, fileName), []byte("audio"), 0644))
+
+		episode := models.PodcastEpisode{
+			ChannelID:   channel.ID,
+			GUID:        fmt.Sprint(i),
+			Title:       fmt.Sprint(i),
+			PublishDate: start.AddDate(0, 0, i),
+			Status:      "completed",
+			FileName:    fileName,
+		}
+		require.NoError(t, db.Create(&episode).Error)
+		episodes = append(episodes, episode)
+	}
+
+	require.NoError(t, service.ApplyRetention(channel.ID))
+
+	for i, episode := range episodes {
+		var stored models.PodcastEpisode
+		require.NoError(t, db.First(&stored, episode.ID).Error)
+		path := filepath.Join(libraryPath, episode.FileName)
+		if i >= 2 {
+			assert.Equal(t, "completed", stored.Status)
+			assert.FileExists(t, path)
+		} else {
+			assert.Equal(t, "deleted", stored.Status)
+			assert.Empty(t, stored.FileName)
+			assert.NoFileExists(t, path)
+		}
+	}
+}
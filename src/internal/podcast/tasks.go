@@ -0,0 +1,150 @@
+package podcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypePodcastRefresh  = "podcast:refresh"
+	TypePodcastDownload = "podcast:download"
+)
+
+// RefreshPayload represents the payload for podcast refresh jobs
+type RefreshPayload struct {
+	ChannelID int32 `json:"channel_id"` // 0 refreshes every channel
+}
+
+// DownloadPayload represents the payload for episode download jobs
+type DownloadPayload struct {
+	EpisodeID int64 `json:"episode_id"`
+}
+
+// NewRefreshTask creates a refresh task for a channel, or for every channel when channelID is 0
+func NewRefreshTask(channelID int32) (*asynq.Task, error) {
+	payload, err := json.Marshal(RefreshPayload{ChannelID: channelID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal podcast refresh payload: %w", err)
+	}
+	return asynq.NewTask(TypePodcastRefresh, payload), nil
+}
+
+// EnqueueRefresh creates and enqueues a podcast refresh job
+func EnqueueRefresh(client *asynq.Client, channelID int32) error {
+	task, err := NewRefreshTask(channelID)
+	if err != nil {
+		return err
+	}
+
+	// Use deduplication key so repeated refresh requests collapse into one
+	dedupKey := fmt.Sprintf("podcast.refresh:%d", channelID)
+
+	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Timeout(10*time.Minute))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue podcast refresh: %w", err)
+	}
+	return nil
+}
+
+// EnqueueDownload creates and enqueues an episode download job. An episode
+// whose download is queued or running isn't queued again.
+func EnqueueDownload(client *asynq.Client, episodeID int64) error {
+	payload, err := json.Marshal(DownloadPayload{EpisodeID: episodeID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal podcast download payload: %w", err)
+	}
+
+	task := asynq.NewTask(TypePodcastDownload, payload)
+
+	// Use deduplication key
+	dedupKey := fmt.Sprintf("podcast.download:%d", episodeID)
+
+	// Retries resume from the partial file
+	_, err = client.Enqueue(task,
+		asynq.TaskID(dedupKey),
+		asynq.Queue("bulk"),
+		asynq.Timeout(time.Hour),
+		asynq.MaxRetry(5),
+	)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue podcast download: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs podcast jobs
+type TaskHandler struct {
+	service *Service
+	client  *asynq.Client
+}
+
+// NewTaskHandler creates a new podcast task handler. Downloads found by a
+// refresh are enqueued through client, or run in the refresh job when it is nil.
+func NewTaskHandler(service *Service, client *asynq.Client) *TaskHandler {
+	return &TaskHandler{
+		service: service,
+		client:  client,
+	}
+}
+
+// HandleRefresh refreshes one channel or all of them and queues the new episodes for download
+func (h *TaskHandler) HandleRefresh(ctx context.Context, t *asynq.Task) error {
+	var p RefreshPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal podcast refresh payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	var downloads []int64
+	var err error
+	if p.ChannelID == 0 {
+		downloads, err = h.service.RefreshAll(ctx)
+	} else {
+		downloads, err = h.service.RefreshChannel(ctx, p.ChannelID)
+	}
+	if err != nil {
+		return err
+	}
+
+	logging.Infof("podcast: refresh found %d episodes to download", len(downloads))
+	for _, episodeID := range downloads {
+		if h.client == nil {
+			if err := h.service.DownloadEpisode(ctx, episodeID); err != nil {
+				logging.Warnf("podcast: %v", err)
+			}
+			continue
+		}
+		if err := EnqueueDownload(h.client, episodeID); err != nil {
+			logging.Warnf("podcast: %v", err)
+		}
+	}
+	return nil
+}
+
+// HandleDownload downloads a single episode
+func (h *TaskHandler) HandleDownload(ctx context.Context, t *asynq.Task) error {
+	var p DownloadPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal podcast download payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	err := h.service.DownloadEpisode(ctx, p.EpisodeID)
+	if err != nil {
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		if retried >= maxRetry {
+			// The episode is left in error for the user to download again
+			// rather than archiving the task, which would keep its ID and
+			// ignore further requests for the episode
+			logging.Warnf("podcast: giving up on episode %d: %v", p.EpisodeID, err)
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,502 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"melodee/internal/artwork"
+	"melodee/internal/models"
+)
+
+// AlbumTypes are the album types an album can be promoted with
+var AlbumTypes = []string{
+	"NotSet", "Album", "EP", "Single", "Compilation", "Live", "Remix",
+	"Soundtrack", "SpokenWord", "Interview", "Audiobook",
+}
+
+// AlbumCoverFile is the name of the cover image in an album directory
+const AlbumCoverFile = "cover.jpg"
+
+// ErrInvalidEdit is returned for an edit that can't be applied
+var ErrInvalidEdit = errors.New("invalid edit")
+
+// MetadataEdit is a curator's edit of a staged album. Fields left nil are
+// unchanged. Track edits are applied first, then SplitDisc, MergeDiscs and
+// Renumber, in that order.
+type MetadataEdit struct {
+	Artist     *ArtistEdit `json:"artist,omitempty"`
+	Album      *AlbumEdit  `json:"album,omitempty"`
+	Tracks     []TrackEdit `json:"tracks,omitempty"`
+	SplitDisc  *DiscSplit  `json:"split_disc,omitempty"`
+	MergeDiscs bool        `json:"merge_discs,omitempty"`
+	Renumber   bool        `json:"renumber,omitempty"`
+}
+
+// ArtistEdit changes the album artist
+type ArtistEdit struct {
+	Name          *string `json:"name,omitempty"`
+	SortName      *string `json:"sort_name,omitempty"`
+	MusicBrainzID *string `json:"musicbrainz_id,omitempty"` // empty clears it
+}
+
+// AlbumEdit changes the album
+type AlbumEdit struct {
+	Name          *string   `json:"name,omitempty"`
+	AlbumType     *string   `json:"album_type,omitempty"`
+	IsCompilation *bool     `json:"is_compilation,omitempty"`
+	ReleaseDate   *string   `json:"release_date,omitempty"` // YYYY-MM-DD, empty clears it
+	Year          *int      `json:"year,omitempty"`
+	Genres        *[]string `json:"genres,omitempty"`
+}
+
+// TrackEdit changes the track at Index in the album's track list
+type TrackEdit struct {
+	Index       int     `json:"index"`
+	Name        *string `json:"name,omitempty"`
+	TrackNumber *int    `json:"track_number,omitempty"`
+	DiscNumber  *int    `json:"disc_number,omitempty"`
+}
+
+// DiscSplit moves the tracks of Disc from track AtTrack on to a new disc
+// after it, renumbering later discs
+type DiscSplit struct {
+	Disc    int `json:"disc"`
+	AtTrack int `json:"at_track"`
+}
+
+// FieldChange is a field changed by an edit, with its values JSON encoded
+type FieldChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// Apply applies an edit to an album's metadata and returns the fields it
+// changed. The metadata is left as it was when the edit is invalid.
+func (e *MetadataEdit) Apply(metadata *AlbumMetadata) ([]FieldChange, error) {
+	edited, err := copyAlbumMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.apply(edited); err != nil {
+		return nil, err
+	}
+
+	changes, err := diffAlbumMetadata(metadata, edited)
+	if err != nil {
+		return nil, err
+	}
+	*metadata = *edited
+	return changes, nil
+}
+
+func (e *MetadataEdit) apply(metadata *AlbumMetadata) error {
+	if e.Artist != nil {
+		if e.Artist.Name != nil {
+			name := strings.TrimSpace(*e.Artist.Name)
+			metadata.Artist.Name = name
+			metadata.Artist.NameNormalized = NormalizeString(name)
+		}
+		if e.Artist.SortName != nil {
+			metadata.Artist.SortName = strings.TrimSpace(*e.Artist.SortName)
+		}
+		if e.Artist.MusicBrainzID != nil {
+			metadata.Artist.MusicBrainzID = nil
+			if id := strings.TrimSpace(*e.Artist.MusicBrainzID); id != "" {
+				metadata.Artist.MusicBrainzID = &id
+			}
+		}
+	}
+
+	if e.Album != nil {
+		album := &metadata.Album
+		if e.Album.Name != nil {
+			name := strings.TrimSpace(*e.Album.Name)
+			album.Name = name
+			album.NameNormalized = NormalizeString(name)
+		}
+		if e.Album.AlbumType != nil {
+			album.AlbumType = *e.Album.AlbumType
+		}
+		if e.Album.IsCompilation != nil {
+			album.IsCompilation = *e.Album.IsCompilation
+		}
+		if e.Album.Year != nil {
+			album.Year = *e.Album.Year
+		}
+		if e.Album.ReleaseDate != nil {
+			album.ReleaseDate = nil
+			if date := strings.TrimSpace(*e.Album.ReleaseDate); date != "" {
+				album.ReleaseDate = &date
+				// The year follows the release date unless it is set too
+				if t, err := time.Parse("2006-01-02", date); err == nil && e.Album.Year == nil {
+					album.Year = t.Year()
+				}
+			}
+		}
+		if e.Album.Genres != nil {
+			album.Genres = []string{}
+			for _, genre := range *e.Album.Genres {
+				if genre = strings.TrimSpace(genre); genre != "" {
+					album.Genres = append(album.Genres, genre)
+				}
+			}
+		}
+	}
+
+	for _, edit := range e.Tracks {
+		if edit.Index < 0 || edit.Index >= len(metadata.Tracks) {
+			return fmt.Errorf("%w: no track at index %d", ErrInvalidEdit, edit.Index)
+		}
+		track := &metadata.Tracks[edit.Index]
+		if edit.Name != nil {
+			track.Name = strings.TrimSpace(*edit.Name)
+		}
+		if edit.TrackNumber != nil {
+			track.TrackNumber = *edit.TrackNumber
+		}
+		if edit.DiscNumber != nil {
+			track.DiscNumber = *edit.DiscNumber
+		}
+	}
+
+	if e.SplitDisc != nil {
+		if err := SplitDisc(metadata, e.SplitDisc.Disc, e.SplitDisc.AtTrack); err != nil {
+			return err
+		}
+	}
+	if e.MergeDiscs {
+		MergeDiscs(metadata)
+	}
+	if e.Renumber {
+		RenumberTracks(metadata)
+	}
+	return nil
+}
+
+// SplitDisc moves the tracks of a disc numbered atTrack and up to a new disc
+// after it, numbered from 1. The discs after it move up by one.
+func SplitDisc(metadata *AlbumMetadata, disc, atTrack int) error {
+	var moved []int
+	kept := 0
+	for i, track := range metadata.Tracks {
+		if track.DiscNumber != disc {
+			continue
+		}
+		if track.TrackNumber >= atTrack {
+			moved = append(moved, i)
+		} else {
+			kept++
+		}
+	}
+	if len(moved) == 0 || kept == 0 {
+		return fmt.Errorf("%w: splitting disc %d at track %d leaves a disc without tracks", ErrInvalidEdit, disc, atTrack)
+	}
+
+	for i := range metadata.Tracks {
+		if metadata.Tracks[i].DiscNumber > disc {
+			metadata.Tracks[i].DiscNumber++
+		}
+	}
+	for _, i := range moved {
+		metadata.Tracks[i].DiscNumber = disc + 1
+		metadata.Tracks[i].TrackNumber -= atTrack - 1
+	}
+	return nil
+}
+
+// MergeDiscs moves every track onto disc 1, numbered on from the discs
+// before it
+func MergeDiscs(metadata *AlbumMetadata) {
+	for number, i := range trackOrder(metadata) {
+		metadata.Tracks[i].DiscNumber = 1
+		metadata.Tracks[i].TrackNumber = number + 1
+	}
+}
+
+// RenumberTracks numbers the tracks of each disc from 1, keeping their order.
+// Tracks without a disc number are put on disc 1.
+func RenumberTracks(metadata *AlbumMetadata) {
+	next := make(map[int]int)
+	for _, i := range trackOrder(metadata) {
+		disc := metadata.Tracks[i].DiscNumber
+		if disc < 1 {
+			disc = 1
+			metadata.Tracks[i].DiscNumber = disc
+		}
+		next[disc]++
+		metadata.Tracks[i].TrackNumber = next[disc]
+	}
+}
+
+// trackOrder returns the indexes of an album's tracks in disc and track
+// order. Tracks with the same numbers keep the order of the track list.
+func trackOrder(metadata *AlbumMetadata) []int {
+	order := make([]int, len(metadata.Tracks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ta, tb := metadata.Tracks[order[a]], metadata.Tracks[order[b]]
+		if ta.DiscNumber != tb.DiscNumber {
+			return ta.DiscNumber < tb.DiscNumber
+		}
+		return ta.TrackNumber < tb.TrackNumber
+	})
+	return order
+}
+
+// ValidateAlbumMetadata checks an album staged in stagingPath and replaces
+// its validation errors and numbering warnings. Warnings from processing,
+// such as possible duplicates, are kept.
+func ValidateAlbumMetadata(metadata *AlbumMetadata, stagingPath string) {
+	var errs, warnings []string
+
+	if strings.TrimSpace(metadata.Artist.Name) == "" {
+		errs = append(errs, "Artist name is required")
+	}
+	if strings.TrimSpace(metadata.Album.Name) == "" {
+		errs = append(errs, "Album name is required")
+	}
+	if !isAlbumType(metadata.Album.AlbumType) {
+		errs = append(errs, fmt.Sprintf("Unknown album type %q", metadata.Album.AlbumType))
+	}
+	if metadata.Album.ReleaseDate != nil {
+		date, err := time.Parse("2006-01-02", *metadata.Album.ReleaseDate)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Release date %q is not a YYYY-MM-DD date", *metadata.Album.ReleaseDate))
+		} else if metadata.Album.Year != 0 && date.Year() != metadata.Album.Year {
+			warnings = append(warnings, fmt.Sprintf("Release date %s is not in year %d", *metadata.Album.ReleaseDate, metadata.Album.Year))
+		}
+	}
+	if len(metadata.Tracks) == 0 {
+		errs = append(errs, "Album has no tracks")
+	}
+
+	type position struct{ disc, track int }
+	numbered := make(map[position]string)
+	discs := make(map[int][]int)
+	for _, track := range metadata.Tracks {
+		if strings.TrimSpace(track.Name) == "" {
+			errs = append(errs, fmt.Sprintf("Track %d-%d has no name", track.DiscNumber, track.TrackNumber))
+		}
+		if track.DiscNumber < 1 || track.TrackNumber < 1 {
+			errs = append(errs, fmt.Sprintf("%s has invalid disc or track number %d-%d", track.Name, track.DiscNumber, track.TrackNumber))
+			continue
+		}
+		pos := position{track.DiscNumber, track.TrackNumber}
+		if other, ok := numbered[pos]; ok {
+			errs = append(errs, fmt.Sprintf("%s and %s are both track %d-%d", other, track.Name, track.DiscNumber, track.TrackNumber))
+			continue
+		}
+		numbered[pos] = track.Name
+		discs[track.DiscNumber] = append(discs[track.DiscNumber], track.TrackNumber)
+
+		if stagingPath != "" {
+			if _, err := os.Stat(filepath.Join(stagingPath, filepath.Base(track.FilePath))); err != nil {
+				errs = append(errs, fmt.Sprintf("File of %s is missing: %s", track.Name, filepath.Base(track.FilePath)))
+			}
+		}
+	}
+
+	discNumbers := make([]int, 0, len(discs))
+	for disc := range discs {
+		discNumbers = append(discNumbers, disc)
+	}
+	sort.Ints(discNumbers)
+	for i, disc := range discNumbers {
+		if disc != i+1 {
+			warnings = append(warnings, fmt.Sprintf("Disc %d is missing", i+1))
+			break
+		}
+	}
+	for _, disc := range discNumbers {
+		numbers := discs[disc]
+		sort.Ints(numbers)
+		for i, number := range numbers {
+			if number != i+1 {
+				warnings = append(warnings, fmt.Sprintf("Disc %d is missing track %d", disc, i+1))
+				break
+			}
+		}
+	}
+
+	metadata.Validation.Errors = errs
+	if metadata.Validation.Errors == nil {
+		metadata.Validation.Errors = []string{}
+	}
+	metadata.Validation.IsValid = len(errs) == 0
+
+	kept := []string{}
+	for _, warning := range metadata.Validation.Warnings {
+		if !isValidationWarning(warning) {
+			kept = append(kept, warning)
+		}
+	}
+	metadata.Validation.Warnings = append(kept, warnings...)
+}
+
+// isValidationWarning reports whether a warning is one ValidateAlbumMetadata
+// gives, rather than one from processing
+func isValidationWarning(warning string) bool {
+	return strings.HasPrefix(warning, "Disc ") || strings.HasPrefix(warning, "Release date ")
+}
+
+func isAlbumType(albumType string) bool {
+	return containsString(AlbumTypes, albumType)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteAlbumCover replaces the cover of an album staged in stagingPath with a
+// JPEG or PNG image, converting PNG to JPEG. It returns the SHA-256 of the
+// cover it replaced, empty when there was none, and of the new cover.
+func WriteAlbumCover(stagingPath string, data []byte) (oldSum, newSum string, err error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: cover is not a JPEG or PNG image: %v", ErrInvalidEdit, err)
+	}
+	switch format {
+	case "jpeg":
+	case "png":
+		var converted bytes.Buffer
+		if err := jpeg.Encode(&converted, img, &jpeg.Options{Quality: 90}); err != nil {
+			return "", "", fmt.Errorf("failed to convert cover to JPEG: %w", err)
+		}
+		data = converted.Bytes()
+	default:
+		return "", "", fmt.Errorf("%w: cover is a %s image, not JPEG or PNG", ErrInvalidEdit, format)
+	}
+
+	coverPath := filepath.Join(stagingPath, AlbumCoverFile)
+	if previous, err := os.ReadFile(coverPath); err == nil {
+		sum := sha256.Sum256(previous)
+		oldSum = hex.EncodeToString(sum[:])
+	}
+
+	// Written next to the cover and renamed over it, so it is never half written
+	tmpPath := coverPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write cover: %w", err)
+	}
+	if err := os.Rename(tmpPath, coverPath); err != nil {
+		os.Remove(tmpPath)
+		return "", "", fmt.Errorf("failed to replace cover: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return oldSum, hex.EncodeToString(sum[:]), nil
+}
+
+// RecordAlbumCover records the cover WriteAlbumCover wrote as the album's
+// primary image, uploaded by a curator, in place of the one it replaced
+func RecordAlbumCover(metadata *AlbumMetadata, stagingPath string) error {
+	info, err := artwork.InspectFile(filepath.Join(stagingPath, AlbumCoverFile))
+	if err != nil {
+		return fmt.Errorf("failed to read cover: %w", err)
+	}
+
+	images := []ImageMetadata{{
+		FileName:  AlbumCoverFile,
+		Type:      models.ImageTypeFront,
+		Source:    models.ImageSourceUpload,
+		Width:     info.Width,
+		Height:    info.Height,
+		FileSize:  info.Size,
+		Checksum:  info.Checksum,
+		IsPrimary: true,
+	}}
+	for _, image := range metadata.Album.Images {
+		if !image.IsPrimary && image.FileName != AlbumCoverFile {
+			images = append(images, image)
+		}
+	}
+	metadata.Album.Images = images
+	metadata.Album.ImageCount = len(images)
+
+	// What processing had to say about the cover no longer applies
+	warnings := make([]string, 0, len(metadata.Validation.Warnings))
+	for _, warning := range metadata.Validation.Warnings {
+		if warning != noCoverWarning && !strings.HasPrefix(warning, smallCoverWarning) {
+			warnings = append(warnings, warning)
+		}
+	}
+	metadata.Validation.Warnings = warnings
+	return nil
+}
+
+func copyAlbumMetadata(metadata *AlbumMetadata) (*AlbumMetadata, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy metadata: %w", err)
+	}
+	var copied AlbumMetadata
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("failed to copy metadata: %w", err)
+	}
+	return &copied, nil
+}
+
+// diffAlbumMetadata returns the editable fields that differ between two
+// versions of an album's metadata
+func diffAlbumMetadata(before, after *AlbumMetadata) ([]FieldChange, error) {
+	type field struct {
+		name          string
+		before, after interface{}
+	}
+	fields := []field{
+		{"artist.name", before.Artist.Name, after.Artist.Name},
+		{"artist.sort_name", before.Artist.SortName, after.Artist.SortName},
+		{"artist.musicbrainz_id", before.Artist.MusicBrainzID, after.Artist.MusicBrainzID},
+		{"album.name", before.Album.Name, after.Album.Name},
+		{"album.album_type", before.Album.AlbumType, after.Album.AlbumType},
+		{"album.is_compilation", before.Album.IsCompilation, after.Album.IsCompilation},
+		{"album.release_date", before.Album.ReleaseDate, after.Album.ReleaseDate},
+		{"album.year", before.Album.Year, after.Album.Year},
+		{"album.genres", before.Album.Genres, after.Album.Genres},
+	}
+	for i := range before.Tracks {
+		prefix := fmt.Sprintf("tracks[%d].", i)
+		fields = append(fields,
+			field{prefix + "name", before.Tracks[i].Name, after.Tracks[i].Name},
+			field{prefix + "track_number", before.Tracks[i].TrackNumber, after.Tracks[i].TrackNumber},
+			field{prefix + "disc_number", before.Tracks[i].DiscNumber, after.Tracks[i].DiscNumber},
+		)
+	}
+
+	var changes []FieldChange
+	for _, f := range fields {
+		oldValue, err := json.Marshal(f.before)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare %s: %w", f.name, err)
+		}
+		newValue, err := json.Marshal(f.after)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare %s: %w", f.name, err)
+		}
+		if string(oldValue) != string(newValue) {
+			changes = append(changes, FieldChange{Field: f.name, OldValue: string(oldValue), NewValue: string(newValue)})
+		}
+	}
+	return changes, nil
+}
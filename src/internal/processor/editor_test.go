@@ -0,0 +1,248 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+)
+
+func testAlbumMetadata() *AlbumMetadata {
+	return &AlbumMetadata{
+		Version:     "1.0",
+		ProcessedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		ScanID:      "scan-1",
+		Artist:      ArtistMetadata{Name: "Artist", NameNormalized: "artist", DirectoryCode: "AR"},
+		Album:       AlbumInfo{Name: "Album", NameNormalized: "album", AlbumType: "Album", Genres: []string{}, Year: 2020},
+		Tracks: []TrackMetadata{
+			{DiscNumber: 1, TrackNumber: 1, Name: "One", FilePath: "AR/Artist/2020 - Album/01 - One.flac"},
+			{DiscNumber: 1, TrackNumber: 2, Name: "Two", FilePath: "AR/Artist/2020 - Album/02 - Two.flac"},
+			{DiscNumber: 1, TrackNumber: 3, Name: "Three", FilePath: "AR/Artist/2020 - Album/03 - Three.flac"},
+			{DiscNumber: 1, TrackNumber: 4, Name: "Four", FilePath: "AR/Artist/2020 - Album/04 - Four.flac"},
+		},
+		Status:     "pending_review",
+		Validation: ValidationInfo{IsValid: true, Errors: []string{}, Warnings: []string{"Possible duplicate: Two"}},
+	}
+}
+
+func trackNumbers(metadata *AlbumMetadata) [][2]int {
+	numbers := make([][2]int, len(metadata.Tracks))
+	for i, track := range metadata.Tracks {
+		numbers[i] = [2]int{track.DiscNumber, track.TrackNumber}
+	}
+	return numbers
+}
+
+func TestMetadataEditApply(t *testing.T) {
+	metadata := testAlbumMetadata()
+	name := " New Album "
+	releaseDate := "2019-03-08"
+	compilation := true
+	trackName := "Uno"
+	edit := MetadataEdit{
+		Album:  &AlbumEdit{Name: &name, ReleaseDate: &releaseDate, IsCompilation: &compilation},
+		Tracks: []TrackEdit{{Index: 0, Name: &trackName}},
+	}
+
+	changes, err := edit.Apply(metadata)
+	require.NoError(t, err)
+	assert.Equal(t, "New Album", metadata.Album.Name)
+	assert.Equal(t, "new album", metadata.Album.NameNormalized)
+	assert.Equal(t, 2019, metadata.Album.Year)
+	assert.Equal(t, "Uno", metadata.Tracks[0].Name)
+	assert.Equal(t, []FieldChange{
+		{Field: "album.name", OldValue: `"Album"`, NewValue: `"New Album"`},
+		{Field: "album.is_compilation", OldValue: "false", NewValue: "true"},
+		{Field: "album.release_date", OldValue: "null", NewValue: `"2019-03-08"`},
+		{Field: "album.year", OldValue: "2020", NewValue: "2019"},
+		{Field: "tracks[0].name", OldValue: `"One"`, NewValue: `"Uno"`},
+	}, changes)
+
+	// An edit that can't be applied leaves the metadata as it was
+	edit = MetadataEdit{Album: &AlbumEdit{Name: &trackName}, Tracks: []TrackEdit{{Index: 4, Name: &trackName}}}
+	_, err = edit.Apply(metadata)
+	assert.True(t, errors.Is(err, ErrInvalidEdit))
+	assert.Equal(t, "New Album", metadata.Album.Name)
+}
+
+func TestSplitMergeAndRenumber(t *testing.T) {
+	metadata := testAlbumMetadata()
+	require.NoError(t, SplitDisc(metadata, 1, 3))
+	assert.Equal(t, [][2]int{{1, 1}, {1, 2}, {2, 1}, {2, 2}}, trackNumbers(metadata))
+
+	require.NoError(t, SplitDisc(metadata, 1, 2))
+	assert.Equal(t, [][2]int{{1, 1}, {2, 1}, {3, 1}, {3, 2}}, trackNumbers(metadata))
+
+	err := SplitDisc(metadata, 1, 1)
+	assert.True(t, errors.Is(err, ErrInvalidEdit))
+
+	MergeDiscs(metadata)
+	assert.Equal(t, [][2]int{{1, 1}, {1, 2}, {1, 3}, {1, 4}}, trackNumbers(metadata))
+
+	metadata.Tracks[0].TrackNumber = 7
+	metadata.Tracks[2].TrackNumber = 0
+	metadata.Tracks[3].DiscNumber = 0
+	RenumberTracks(metadata)
+	assert.Equal(t, [][2]int{{1, 4}, {1, 3}, {1, 2}, {1, 1}}, trackNumbers(metadata))
+}
+
+func TestValidateAlbumMetadata(t *testing.T) {
+	stagingPath := t.TempDir()
+	metadata := testAlbumMetadata()
+	for _, track := range metadata.Tracks[1:] {
+		require.NoError(t, os.WriteFile(filepath.Join(stagingPath, filepath.Base(track.FilePath)), []byte("audio"), 0644))
+	}
+	metadata.Album.AlbumType = "Bootleg"
+	metadata.Tracks[2].TrackNumber = 2
+	releaseDate := "2021-01-01"
+	metadata.Album.ReleaseDate = &releaseDate
+
+	ValidateAlbumMetadata(metadata, stagingPath)
+	assert.False(t, metadata.Validation.IsValid)
+	assert.Equal(t, []string{
+		`Unknown album type "Bootleg"`,
+		"File of One is missing: 01 - One.flac",
+		"Two and Three are both track 1-2",
+	}, metadata.Validation.Errors)
+	assert.Equal(t, []string{
+		"Possible duplicate: Two",
+		"Release date 2021-01-01 is not in year 2020",
+		"Disc 1 is missing track 3",
+	}, metadata.Validation.Warnings)
+
+	// Fixing the album clears its errors and numbering warnings
+	metadata.Album.AlbumType = "Album"
+	metadata.Album.ReleaseDate = nil
+	metadata.Tracks = metadata.Tracks[1:]
+	RenumberTracks(metadata)
+	ValidateAlbumMetadata(metadata, stagingPath)
+	assert.True(t, metadata.Validation.IsValid)
+	assert.Empty(t, metadata.Validation.Errors)
+	assert.Equal(t, []string{"Possible duplicate: Two"}, metadata.Validation.Warnings)
+}
+
+func TestSaveStagingItemMetadata(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(`CREATE TABLE staging_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT, scan_id TEXT, staging_path TEXT, metadata_file TEXT,
+		artist_name TEXT, album_name TEXT, track_count INTEGER, total_size INTEGER, processed_at DATETIME,
+		status TEXT, reviewed_by INTEGER, reviewed_at DATETIME, notes TEXT, checksum TEXT,
+		duplicate_count INTEGER, created_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE staging_item_changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT, staging_item_id INTEGER, editor_id INTEGER,
+		field TEXT, old_value TEXT, new_value TEXT, changed_at DATETIME
+	)`).Error)
+
+	stagingPath := t.TempDir()
+	metadata := testAlbumMetadata()
+	metadataFile := filepath.Join(stagingPath, "album.melodee.json")
+	require.NoError(t, WriteAlbumMetadata(metadataFile, metadata))
+	repo := NewStagingRepository(db)
+	require.NoError(t, repo.CreateStagingItemFromResult(ProcessResult{StagingPath: stagingPath, MetadataFile: metadataFile}, metadata))
+
+	var item models.StagingItem
+	require.NoError(t, db.First(&item).Error)
+	stale := item
+
+	name := "Renamed"
+	changes, err := (&MetadataEdit{Album: &AlbumEdit{Name: &name}}).Apply(metadata)
+	require.NoError(t, err)
+	editor := int64(7)
+	require.NoError(t, repo.SaveStagingItemMetadata(&item, metadata, changes, &editor))
+
+	saved, err := ReadAlbumMetadata(metadataFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", saved.Album.Name)
+	checksum, err := calculateJSONChecksum(saved)
+	require.NoError(t, err)
+	assert.Equal(t, checksum, item.Checksum)
+
+	var stored models.StagingItem
+	require.NoError(t, db.First(&stored, item.ID).Error)
+	assert.Equal(t, "Renamed", stored.AlbumName)
+	assert.Equal(t, checksum, stored.Checksum)
+
+	history, err := repo.GetStagingItemChanges(item.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "album.name", history[0].Field)
+	assert.Equal(t, `"Album"`, history[0].OldValue)
+	assert.Equal(t, `"Renamed"`, history[0].NewValue)
+	assert.Equal(t, &editor, history[0].EditorID)
+
+	// An edit of the item as it was before is refused and leaves the sidecar alone
+	name = "Stale"
+	changes, err = (&MetadataEdit{Album: &AlbumEdit{Name: &name}}).Apply(metadata)
+	require.NoError(t, err)
+	err = repo.SaveStagingItemMetadata(&stale, metadata, changes, &editor)
+	assert.True(t, errors.Is(err, ErrStagingItemChanged))
+	saved, err = ReadAlbumMetadata(metadataFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", saved.Album.Name)
+}
+
+func TestWriteAlbumCover(t *testing.T) {
+	stagingPath := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	oldSum, newSum, err := WriteAlbumCover(stagingPath, buf.Bytes())
+	require.NoError(t, err)
+	assert.Empty(t, oldSum)
+	assert.NotEmpty(t, newSum)
+
+	cover, err := os.ReadFile(filepath.Join(stagingPath, AlbumCoverFile))
+	require.NoError(t, err)
+	_, format, err := image.DecodeConfig(bytes.NewReader(cover))
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+
+	replacedSum, _, err := WriteAlbumCover(stagingPath, cover)
+	require.NoError(t, err)
+	assert.Equal(t, newSum, replacedSum)
+
+	_, _, err = WriteAlbumCover(stagingPath, []byte("not an image"))
+	assert.True(t, errors.Is(err, ErrInvalidEdit))
+}
+
+func TestRecordAlbumCover(t *testing.T) {
+	stagingPath := t.TempDir()
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 6))))
+	_, _, err := WriteAlbumCover(stagingPath, buf.Bytes())
+	require.NoError(t, err)
+
+	metadata := testAlbumMetadata()
+	metadata.Album.Images = []ImageMetadata{
+		{FileName: AlbumCoverFile, Type: models.ImageTypeFront, Source: models.ImageSourceEmbedded, IsPrimary: true},
+		{FileName: "back.jpg", Type: models.ImageTypeBack, Source: models.ImageSourceFolder},
+	}
+	metadata.Validation.Warnings = append(metadata.Validation.Warnings, smallCoverWarning+"100x100")
+
+	require.NoError(t, RecordAlbumCover(metadata, stagingPath))
+	require.Len(t, metadata.Album.Images, 2)
+	cover := metadata.Album.Images[0]
+	assert.True(t, cover.IsPrimary)
+	assert.Equal(t, models.ImageSourceUpload, cover.Source)
+	assert.Equal(t, 8, cover.Width)
+	assert.Equal(t, 6, cover.Height)
+	assert.Equal(t, "back.jpg", metadata.Album.Images[1].FileName)
+	assert.Equal(t, 2, metadata.Album.ImageCount)
+	assert.Equal(t, []string{"Possible duplicate: Two"}, metadata.Validation.Warnings)
+}
@@ -33,28 +33,65 @@ type ArtistMetadata struct {
 
 // AlbumInfo contains album information
 type AlbumInfo struct {
-	Name           string    `json:"name"`
-	NameNormalized string    `json:"name_normalized"`
-	ReleaseDate    *string   `json:"release_date,omitempty"`
-	AlbumType      string    `json:"album_type"`
-	Genres         []string  `json:"genres"`
-	IsCompilation  bool      `json:"is_compilation"`
-	ImageCount     int       `json:"image_count"`
-	Year           int       `json:"year"`
+	Name           string          `json:"name"`
+	NameNormalized string          `json:"name_normalized"`
+	ReleaseDate    *string         `json:"release_date,omitempty"`
+	AlbumType      string          `json:"album_type"`
+	Genres         []string        `json:"genres"`
+	IsCompilation  bool            `json:"is_compilation"`
+	ImageCount     int             `json:"image_count"`
+	Images         []ImageMetadata `json:"images,omitempty"`
+	Year           int             `json:"year"`
+}
+
+// ImageMetadata is an image staged with the album. Artist images are moved
+// to the artist directory when the album is promoted.
+type ImageMetadata struct {
+	FileName  string `json:"file_name"` // in the album directory
+	Type      string `json:"type"`      // front, back, disc or artist
+	Source    string `json:"source"`    // folder, embedded or upload
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	FileSize  int64  `json:"file_size"`
+	Checksum  string `json:"checksum"` // SHA-256
+	IsPrimary bool   `json:"is_primary"`
 }
 
 // TrackMetadata contains track information
 type TrackMetadata struct {
-	TrackNumber  int    `json:"track_number"`
-	DiscNumber   int    `json:"disc_number"`
-	Name         string `json:"name"`
-	Duration     int    `json:"duration"`      // milliseconds
-	FilePath     string `json:"file_path"`     // relative to staging root
-	FileSize     int64  `json:"file_size"`
-	Bitrate      int    `json:"bitrate"`
-	SampleRate   int    `json:"sample_rate"`
-	Checksum     string `json:"checksum"`
-	OriginalPath string `json:"original_path"` // original inbound path
+	TrackNumber  int                   `json:"track_number"`
+	DiscNumber   int                   `json:"disc_number"`
+	Name         string                `json:"name"`
+	Duration     int                   `json:"duration"`  // milliseconds
+	FilePath     string                `json:"file_path"` // relative to staging root
+	FileSize     int64                 `json:"file_size"`
+	Bitrate      int                   `json:"bitrate"`
+	SampleRate   int                   `json:"sample_rate"`
+	Checksum     string                `json:"checksum"`
+	OriginalPath string                `json:"original_path"`          // original inbound path
+	StartOffset  int64                 `json:"start_offset,omitempty"` // cue sheet tracks: milliseconds into FilePath
+	EndOffset    int64                 `json:"end_offset,omitempty"`   // cue sheet tracks: milliseconds into FilePath, 0 is its end
+	Fingerprint  string                `json:"fingerprint,omitempty"`  // see the fingerprint package
+	Duplicates   []DuplicateMatch      `json:"duplicates,omitempty"`
+	Contributors []ContributorMetadata `json:"contributors,omitempty"`
+}
+
+// ContributorMetadata is an artist credited on a track besides its album
+// artist, such as one featured on it
+type ContributorMetadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // e.g. featured
+}
+
+// DuplicateMatch is a track that is likely the same recording as a staged
+// track: one in production (TrackID set) or another on the same album
+type DuplicateMatch struct {
+	TrackID    int64   `json:"track_id,omitempty"`
+	Name       string  `json:"name"`
+	AlbumName  string  `json:"album_name"`
+	ArtistName string  `json:"artist_name"`
+	FilePath   string  `json:"file_path,omitempty"` // relative to staging root
+	Similarity float64 `json:"similarity"`
 }
 
 // ValidationInfo contains validation status
@@ -1,6 +1,7 @@
 package processor
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -11,15 +12,42 @@ import (
 	"sync"
 	"time"
 
+	"melodee/internal/artwork"
+	"melodee/internal/fingerprint"
+	"melodee/internal/lyrics"
+	"melodee/internal/metadatarules"
+	"melodee/internal/models"
 	"melodee/internal/scanner"
 )
 
+// Warnings about an album's cover
+const (
+	noCoverWarning    = "No cover image found"
+	smallCoverWarning = "Cover image is only "
+)
+
 // ProcessorConfig contains configuration for the processor
 type ProcessorConfig struct {
 	StagingRoot   string
 	Workers       int
 	RateLimit     int // files per second (0 = unlimited)
 	DryRun        bool
+
+	// Fingerprints, when set, flags tracks that are likely duplicates of
+	// tracks in production or of other tracks of the same album
+	Fingerprints *fingerprint.Service
+
+	// Rules, when set, clean up the scanned metadata. LibraryID is the
+	// inbound library the files were scanned from, which rules may be
+	// limited to.
+	Rules     *metadatarules.Engine
+	LibraryID int32
+
+	// Artwork, when set, extracts the cover embedded in the first file of
+	// albums that have no front image next to their files. Front images at
+	// least ArtworkMinSize pixels wide and high are preferred as the cover.
+	Artwork        artwork.Extractor
+	ArtworkMinSize int
 }
 
 // Processor handles moving files from inbound to staging
@@ -138,6 +166,13 @@ func (p *Processor) processAlbum(group scanner.AlbumGroup) ProcessResult {
 		return result
 	}
 
+	// Metadata rules clean up the scanned names before anything is named after them
+	var ruleChanges []metadatarules.Change
+	featured := make([][]string, len(files))
+	if p.config.Rules != nil {
+		ruleChanges, featured = p.config.Rules.ApplyScanned(p.config.LibraryID, &group, files)
+	}
+
 	// Generate directory structure
 	dirCode := GenerateDirectoryCode(group.ArtistName)
 	albumDirName := fmt.Sprintf("%d - %s", group.Year, cleanDirectoryName(group.AlbumName))
@@ -186,15 +221,54 @@ func (p *Processor) processAlbum(group scanner.AlbumGroup) ProcessResult {
 			Warnings: []string{},
 		},
 	}
+	for _, change := range ruleChanges {
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings, change.String())
+	}
+
+	// The album's genres are those of its tracks, in the order first seen
+	for _, file := range files {
+		genre := strings.TrimSpace(file.Genre)
+		if genre != "" && !containsString(metadata.Album.Genres, genre) {
+			metadata.Album.Genres = append(metadata.Album.Genres, genre)
+		}
+	}
+
+	// Carry the MusicBrainz artist ID through when the files are tagged with one
+	for _, file := range files {
+		artistMBID := file.MusicBrainzAlbumArtistID
+		if artistMBID == "" {
+			artistMBID = file.MusicBrainzArtistID
+		}
+		if artistMBID != "" {
+			metadata.Artist.MusicBrainzID = &artistMBID
+			break
+		}
+	}
 
 	// Process each file
 	var totalSize int64
-	for _, file := range files {
+	staged := make(map[string]string) // cue sheets and their audio files, by inbound path
+	for i, file := range files {
 		// Rate limiting
 		if p.semaphore != nil {
 			<-p.semaphore
 		}
 
+		// Cue sheet tracks share their audio file, which is moved once
+		if file.CuePath != "" {
+			newFilename, err := p.stageCueAudio(file, stagingPath, staged, metadata)
+			if err != nil {
+				metadata.Validation.IsValid = false
+				metadata.Validation.Errors = append(metadata.Validation.Errors,
+					fmt.Sprintf("Failed to move %s: %v", filepath.Base(file.FilePath), err))
+				continue
+			}
+			relPath := filepath.Join(dirCode, cleanDirectoryName(group.ArtistName), albumDirName, newFilename)
+			p.addTrack(metadata, file, relPath, filepath.Join(stagingPath, newFilename), featured[i])
+			totalSize += file.FileSize
+			continue
+		}
+
 		// Determine destination filename
 		ext := filepath.Ext(file.FilePath)
 		newFilename := FormatFilename(file.DiscNumber, file.TrackNumber, file.Title, ext)
@@ -202,36 +276,37 @@ func (p *Processor) processAlbum(group scanner.AlbumGroup) ProcessResult {
 
 		// Move file
 		if !p.config.DryRun {
+			sidecars := lyrics.Sidecars(file.FilePath)
 			if err := SafeMoveFile(file.FilePath, dstPath); err != nil {
 				metadata.Validation.IsValid = false
 				metadata.Validation.Errors = append(metadata.Validation.Errors,
 					fmt.Sprintf("Failed to move %s: %v", filepath.Base(file.FilePath), err))
 				continue
 			}
+
+			// Lyrics files follow the track, renamed to match it
+			for _, sidecar := range sidecars {
+				sidecarPath := strings.TrimSuffix(dstPath, ext) + strings.ToLower(filepath.Ext(sidecar))
+				if err := SafeMoveFile(sidecar, sidecarPath); err != nil {
+					metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+						fmt.Sprintf("Failed to move lyrics %s: %v", filepath.Base(sidecar), err))
+				}
+			}
 		}
 
 		// Calculate relative path
 		relPath := filepath.Join(dirCode, cleanDirectoryName(group.ArtistName), albumDirName, newFilename)
 
 		// Add to metadata
-		metadata.Tracks = append(metadata.Tracks, TrackMetadata{
-			TrackNumber:  file.TrackNumber,
-			DiscNumber:   file.DiscNumber,
-			Name:         file.Title,
-			Duration:     file.Duration,
-			FilePath:     relPath,
-			FileSize:     file.FileSize,
-			Bitrate:      file.Bitrate,
-			SampleRate:   file.SampleRate,
-			Checksum:     file.FileHash,
-			OriginalPath: file.FilePath,
-		})
+		p.addTrack(metadata, file, relPath, dstPath, featured[i])
 
 		totalSize += file.FileSize
 	}
 
 	result.TotalSize = totalSize
 
+	p.stageImages(metadata, files, stagingPath)
+
 	// Write metadata file
 	metadataPath := filepath.Join(stagingPath, "album.melodee.json")
 	result.MetadataFile = metadataPath
@@ -259,6 +334,216 @@ func (p *Processor) processAlbum(group scanner.AlbumGroup) ProcessResult {
 	return result
 }
 
+// addTrack adds a staged file, with the artists featured on it, to the album
+// metadata
+func (p *Processor) addTrack(metadata *AlbumMetadata, file *scanner.ScannedFile, relPath, dstPath string, featured []string) {
+	track := TrackMetadata{
+		TrackNumber:  file.TrackNumber,
+		DiscNumber:   file.DiscNumber,
+		Name:         file.Title,
+		Duration:     file.Duration,
+		FilePath:     relPath,
+		FileSize:     file.FileSize,
+		Bitrate:      file.Bitrate,
+		SampleRate:   file.SampleRate,
+		Checksum:     file.FileHash,
+		OriginalPath: file.FilePath,
+		StartOffset:  file.StartOffset,
+		EndOffset:    file.EndOffset,
+	}
+	for _, name := range featured {
+		track.Contributors = append(track.Contributors, ContributorMetadata{Name: name, Type: "featured"})
+	}
+	if p.config.Fingerprints != nil {
+		audioPath := dstPath
+		if p.config.DryRun {
+			audioPath = file.FilePath
+		}
+		p.flagDuplicates(metadata, &track, audioPath)
+	}
+	metadata.Tracks = append(metadata.Tracks, track)
+}
+
+// stageImages finds the album's images next to its inbound files, or the
+// cover embedded in its first file when none of them is a front image, and
+// stages the ones worth keeping. The primary image becomes the album's
+// cover.jpg; the others are named after what they show.
+func (p *Processor) stageImages(metadata *AlbumMetadata, files []*scanner.ScannedFile, stagingPath string) {
+	audioPaths := make([]string, len(files))
+	for i, file := range files {
+		audioPaths[i] = file.FilePath
+	}
+	candidates, errs := artwork.FindFolderImages(artwork.AlbumDirectories(audioPaths))
+	for _, err := range errs {
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+			fmt.Sprintf("Failed to read image: %v", err))
+	}
+
+	if artwork.ChoosePrimary(candidates, p.config.ArtworkMinSize) < 0 && p.config.Artwork != nil && len(metadata.Tracks) > 0 {
+		// The tracks of an album nearly always embed the same cover. Most
+		// files without one make ffmpeg fail, so failures aren't reported.
+		audioPath := filepath.Join(stagingPath, filepath.Base(metadata.Tracks[0].FilePath))
+		if p.config.DryRun {
+			audioPath = metadata.Tracks[0].OriginalPath
+		}
+		if embedded, err := artwork.ExtractEmbedded(p.config.Artwork, audioPath); err == nil {
+			candidates = append(candidates, embedded)
+		}
+	}
+
+	selected, hasPrimary := artwork.Select(candidates, p.config.ArtworkMinSize)
+	if !hasPrimary {
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings, noCoverWarning)
+	}
+	images := make([]ImageMetadata, 0, len(selected))
+	for i, candidate := range selected {
+		image := ImageMetadata{
+			FileName:  artwork.FileName(candidate.Type, candidate.Disc, candidate.Format),
+			Type:      candidate.Type,
+			Source:    candidate.Source,
+			Width:     candidate.Width,
+			Height:    candidate.Height,
+			FileSize:  candidate.Size,
+			Checksum:  candidate.Checksum,
+			IsPrimary: hasPrimary && i == 0,
+		}
+
+		if image.IsPrimary {
+			if candidate.Width < p.config.ArtworkMinSize || candidate.Height < p.config.ArtworkMinSize {
+				metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+					fmt.Sprintf("%s%dx%d", smallCoverWarning, candidate.Width, candidate.Height))
+			}
+			image.FileName = AlbumCoverFile
+			if !p.config.DryRun {
+				_, sum, err := WriteAlbumCover(stagingPath, candidate.Data)
+				if err != nil {
+					metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+						fmt.Sprintf("Failed to write cover image: %v", err))
+					continue
+				}
+				// PNG covers are converted to JPEG
+				image.Checksum = sum
+				if info, err := os.Stat(filepath.Join(stagingPath, AlbumCoverFile)); err == nil {
+					image.FileSize = info.Size()
+				}
+				if candidate.Source == models.ImageSourceFolder {
+					os.Remove(candidate.Path)
+				}
+			}
+		} else if !p.config.DryRun {
+			if err := SafeMoveFile(candidate.Path, filepath.Join(stagingPath, image.FileName)); err != nil {
+				metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+					fmt.Sprintf("Failed to move image %s: %v", filepath.Base(candidate.Path), err))
+				continue
+			}
+		}
+		images = append(images, image)
+	}
+	metadata.Album.Images = images
+	metadata.Album.ImageCount = len(images)
+}
+
+// stageCueAudio moves the audio file of a cue sheet track into the album
+// directory the first time one of its tracks is staged, and returns its staged
+// name. The audio file and its sheet keep their names, which the sheet refers
+// to, unless another disc of the album already took them.
+func (p *Processor) stageCueAudio(file *scanner.ScannedFile, stagingPath string, staged map[string]string, metadata *AlbumMetadata) (string, error) {
+	if name, ok := staged[file.FilePath]; ok {
+		if name == "" {
+			return "", fmt.Errorf("moving it failed for an earlier track")
+		}
+		return name, nil
+	}
+
+	name, err := p.stageFile(file.FilePath, file.DiscNumber, stagingPath, staged)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := staged[file.CuePath]; !ok {
+		if _, err := p.stageFile(file.CuePath, file.DiscNumber, stagingPath, staged); err != nil {
+			metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+				fmt.Sprintf("Failed to move cue sheet %s: %v", filepath.Base(file.CuePath), err))
+		}
+	}
+	return name, nil
+}
+
+// stageFile moves a file into the album directory under its own name, or
+// prefixed with the disc number when that name is taken, and records it in
+// staged. A file that couldn't be moved is recorded with an empty name.
+func (p *Processor) stageFile(srcPath string, discNumber int, stagingPath string, staged map[string]string) (string, error) {
+	name := filepath.Base(srcPath)
+	for _, taken := range staged {
+		if taken == name {
+			name = fmt.Sprintf("%d - %s", discNumber, name)
+			break
+		}
+	}
+
+	if !p.config.DryRun {
+		if err := SafeMoveFile(srcPath, filepath.Join(stagingPath, name)); err != nil {
+			staged[srcPath] = ""
+			return "", err
+		}
+	}
+	staged[srcPath] = name
+	return name, nil
+}
+
+// flagDuplicates fingerprints a track and records the tracks in production,
+// and the earlier tracks of its album, that are likely the same recording
+func (p *Processor) flagDuplicates(metadata *AlbumMetadata, track *TrackMetadata, audioPath string) {
+	ctx := context.Background()
+	raw, err := p.config.Fingerprints.FingerprintSegment(ctx, audioPath,
+		time.Duration(track.StartOffset)*time.Millisecond, time.Duration(track.EndOffset)*time.Millisecond)
+	if err != nil {
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+			fmt.Sprintf("Failed to fingerprint %s: %v", filepath.Base(audioPath), err))
+		return
+	}
+	track.Fingerprint = fingerprint.Encode(raw)
+
+	matches, err := p.config.Fingerprints.Match(ctx, raw)
+	if err != nil {
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+			fmt.Sprintf("Failed to look for duplicates of %s: %v", track.Name, err))
+	}
+	for _, match := range matches {
+		track.Duplicates = append(track.Duplicates, DuplicateMatch{
+			TrackID:    match.TrackID,
+			Name:       match.Name,
+			AlbumName:  match.AlbumName,
+			ArtistName: match.ArtistName,
+			Similarity: match.Similarity,
+		})
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+			fmt.Sprintf("Possible duplicate: %s is %.0f%% similar to %s by %s on %s (track %d)",
+				track.Name, match.Similarity*100, match.Name, match.ArtistName, match.AlbumName, match.TrackID))
+	}
+
+	threshold := p.config.Fingerprints.Threshold()
+	for _, other := range metadata.Tracks {
+		otherRaw, err := fingerprint.Decode(other.Fingerprint)
+		if err != nil || len(otherRaw) == 0 {
+			continue
+		}
+		similarity := fingerprint.Similarity(raw, otherRaw)
+		if similarity < threshold {
+			continue
+		}
+		track.Duplicates = append(track.Duplicates, DuplicateMatch{
+			Name:       other.Name,
+			AlbumName:  metadata.Album.Name,
+			ArtistName: metadata.Artist.Name,
+			FilePath:   other.FilePath,
+			Similarity: similarity,
+		})
+		metadata.Validation.Warnings = append(metadata.Validation.Warnings,
+			fmt.Sprintf("Possible duplicate: %s is %.0f%% similar to %s on this album",
+				track.Name, similarity*100, other.Name))
+	}
+}
+
 // cleanDirectoryName removes or replaces characters that are problematic in directory names
 func cleanDirectoryName(name string) string {
 	// Replace problematic characters
@@ -4,13 +4,19 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"melodee/internal/models"
 	"gorm.io/gorm"
 )
 
+// ErrStagingItemChanged is returned when saving metadata of a staging item
+// that was edited since it was read
+var ErrStagingItemChanged = errors.New("staging item was changed by another edit")
+
 // StagingRepository handles database operations for staging items
 type StagingRepository struct {
 	db *gorm.DB
@@ -35,22 +41,98 @@ func (r *StagingRepository) CreateStagingItemFromResult(result ProcessResult, me
 	}
 
 	item := &models.StagingItem{
-		ScanID:       metadata.ScanID,
-		StagingPath:  result.StagingPath,
-		MetadataFile: result.MetadataFile,
-		ArtistName:   metadata.Artist.Name,
-		AlbumName:    metadata.Album.Name,
-		TrackCount:   int32(len(metadata.Tracks)),
-		TotalSize:    result.TotalSize,
-		ProcessedAt:  metadata.ProcessedAt,
-		Status:       metadata.Status,
-		Checksum:     checksum,
-		CreatedAt:    time.Now(),
+		ScanID:         metadata.ScanID,
+		StagingPath:    result.StagingPath,
+		MetadataFile:   result.MetadataFile,
+		ArtistName:     metadata.Artist.Name,
+		AlbumName:      metadata.Album.Name,
+		TrackCount:     int32(len(metadata.Tracks)),
+		TotalSize:      result.TotalSize,
+		ProcessedAt:    metadata.ProcessedAt,
+		Status:         metadata.Status,
+		Checksum:       checksum,
+		DuplicateCount: countDuplicates(metadata),
+		CreatedAt:      time.Now(),
 	}
 
 	return r.CreateStagingItem(item)
 }
 
+// SaveStagingItemMetadata writes an item's edited album metadata to its
+// sidecar, brings the item in line with it and records the changed fields.
+// It fails with ErrStagingItemChanged when the item was edited since it was
+// read, and leaves the sidecar as it was when anything fails.
+func (r *StagingRepository) SaveStagingItemMetadata(item *models.StagingItem, metadata *AlbumMetadata, changes []FieldChange, editorID *int64) error {
+	checksum, err := calculateJSONChecksum(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+
+	previous, err := os.ReadFile(item.MetadataFile)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	now := time.Now()
+	written := false
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.StagingItem{}).
+			Where("id = ? AND checksum = ?", item.ID, item.Checksum).
+			Updates(map[string]interface{}{
+				"artist_name":     metadata.Artist.Name,
+				"album_name":      metadata.Album.Name,
+				"track_count":     int32(len(metadata.Tracks)),
+				"duplicate_count": countDuplicates(metadata),
+				"checksum":        checksum,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update staging item: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrStagingItemChanged
+		}
+
+		for _, change := range changes {
+			record := models.StagingItemChange{
+				StagingItemID: item.ID,
+				EditorID:      editorID,
+				Field:         change.Field,
+				OldValue:      change.OldValue,
+				NewValue:      change.NewValue,
+				ChangedAt:     now,
+			}
+			if err := tx.Create(&record).Error; err != nil {
+				return fmt.Errorf("failed to record change: %w", err)
+			}
+		}
+
+		written = true
+		return WriteAlbumMetadata(item.MetadataFile, metadata)
+	})
+	if err != nil {
+		if written {
+			if restoreErr := os.WriteFile(item.MetadataFile, previous, 0644); restoreErr != nil {
+				return fmt.Errorf("%w (restoring metadata file failed: %v)", err, restoreErr)
+			}
+		}
+		return err
+	}
+
+	item.ArtistName = metadata.Artist.Name
+	item.AlbumName = metadata.Album.Name
+	item.TrackCount = int32(len(metadata.Tracks))
+	item.DuplicateCount = countDuplicates(metadata)
+	item.Checksum = checksum
+	return nil
+}
+
+// GetStagingItemChanges returns the change history of a staging item, oldest first
+func (r *StagingRepository) GetStagingItemChanges(id int64) ([]models.StagingItemChange, error) {
+	var changes []models.StagingItemChange
+	err := r.db.Where("staging_item_id = ?", id).Order("changed_at, id").Find(&changes).Error
+	return changes, err
+}
+
 // GetStagingItemsByStatus returns staging items with a specific status
 func (r *StagingRepository) GetStagingItemsByStatus(status string) ([]models.StagingItem, error) {
 	var items []models.StagingItem
@@ -98,6 +180,17 @@ func (r *StagingRepository) GetApprovedStagingItems() ([]models.StagingItem, err
 	return r.GetStagingItemsByStatus("approved")
 }
 
+// countDuplicates returns the number of tracks that are likely duplicates
+func countDuplicates(metadata *AlbumMetadata) int32 {
+	var count int32
+	for _, track := range metadata.Tracks {
+		if len(track.Duplicates) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
 // calculateJSONChecksum calculates SHA256 checksum of JSON data
 func calculateJSONChecksum(data interface{}) (string, error) {
 	jsonData, err := json.Marshal(data)
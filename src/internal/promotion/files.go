@@ -0,0 +1,128 @@
+package promotion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// partialSuffix names the file a copy is written to before it is verified
+const partialSuffix = ".partial"
+
+// copyFile copies src to dst through a partial file that is synced to disk,
+// read back and checked before it is renamed into place. The copy must have
+// checksum when it is set, and the checksum of src otherwise. Callers only
+// pass a dst that exists when their job created it: one that is already the
+// same file, copied before the job was interrupted, is kept, and any other
+// is an error.
+func copyFile(src, dst, checksum string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		want := checksum
+		if want == "" {
+			if want, err = hashFile(src); err != nil {
+				return err
+			}
+		}
+		have, err := hashFile(dst)
+		if err != nil {
+			return err
+		}
+		if have != want {
+			return fmt.Errorf("%w: %s", ErrTargetExists, dst)
+		}
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	partial := dst + partialSuffix
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(out, io.TeeReader(in, hash))
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	if checksum == "" {
+		checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+	// What is on disk is checked, not what was written to it
+	written, err := hashFile(partial)
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if written != checksum {
+		os.Remove(partial)
+		return fmt.Errorf("%w: expected %s, copied %s", ErrChecksumMismatch, checksum, written)
+	}
+
+	if err := os.Rename(partial, dst); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// hashFile returns the SHA-256 of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// syncDir syncs a directory, so the files renamed into it stay there after a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeEmptyDirs removes dir and the directories in it when they hold no files
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir)
+}
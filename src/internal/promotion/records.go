@@ -0,0 +1,201 @@
+package promotion
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/fingerprint"
+	"melodee/internal/logging"
+	"melodee/internal/lyrics"
+	"melodee/internal/models"
+	"melodee/internal/processor"
+)
+
+// albumDirectory returns an album's directory relative to its library
+func albumDirectory(metadata *processor.AlbumMetadata) string {
+	return filepath.Join(
+		metadata.Artist.DirectoryCode,
+		metadata.Artist.Name,
+		fmt.Sprintf("%d - %s", metadata.Album.Year, metadata.Album.Name),
+	)
+}
+
+// findOrCreateArtist finds an existing artist or creates a new one
+func findOrCreateArtist(tx *gorm.DB, metadata *processor.AlbumMetadata) (*models.Artist, error) {
+	var artist models.Artist
+
+	// Try to find by name first
+	err := tx.Where("name_normalized = ?", metadata.Artist.NameNormalized).First(&artist).Error
+	if err == nil {
+		return &artist, nil
+	}
+
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	// Create new artist
+	artist = models.Artist{
+		Name:           metadata.Artist.Name,
+		NameNormalized: metadata.Artist.NameNormalized,
+		DirectoryCode:  metadata.Artist.DirectoryCode,
+		SortName:       metadata.Artist.SortName,
+	}
+
+	if err := tx.Create(&artist).Error; err != nil {
+		return nil, err
+	}
+
+	return &artist, nil
+}
+
+// createAlbum creates a new album
+func createAlbum(tx *gorm.DB, metadata *processor.AlbumMetadata, artistID int64, libraryID int32) (*models.Album, error) {
+	album := models.Album{
+		Name:           metadata.Album.Name,
+		NameNormalized: metadata.Album.NameNormalized,
+		ArtistID:       artistID,
+		LibraryID:      &libraryID,
+		AlbumType:      metadata.Album.AlbumType,
+		Genres:         metadata.Album.Genres,
+		IsCompilation:  metadata.Album.IsCompilation,
+		ImageCount:     int32(albumImageCount(metadata)),
+		Directory:      albumDirectory(metadata),
+	}
+
+	// Set release date if provided
+	if metadata.Album.ReleaseDate != nil {
+		if t, err := time.Parse("2006-01-02", *metadata.Album.ReleaseDate); err == nil {
+			album.ReleaseDate = &t
+		}
+	}
+
+	if err := tx.Create(&album).Error; err != nil {
+		return nil, err
+	}
+
+	return &album, nil
+}
+
+// createTracks creates tracks for an album, importing the lyrics of the
+// staged files in stagingPath
+func createTracks(tx *gorm.DB, metadata *processor.AlbumMetadata, stagingPath string, albumID, artistID int64, libraryID int32) error {
+	for _, trackMeta := range metadata.Tracks {
+		track := models.Track{
+			Name:           trackMeta.Name,
+			NameNormalized: processor.NormalizeString(trackMeta.Name),
+			AlbumID:        albumID,
+			ArtistID:       artistID,
+			LibraryID:      &libraryID,
+			Duration:       int64(trackMeta.Duration),
+			BitRate:        int32(trackMeta.Bitrate),
+			SampleRate:     int32(trackMeta.SampleRate),
+			Directory:      filepath.Dir(trackMeta.FilePath),
+			FileName:       filepath.Base(trackMeta.FilePath),
+			RelativePath:   trackMeta.FilePath,
+			CRCHash:        trackMeta.Checksum,
+			SortOrder:      int32(trackMeta.TrackNumber),
+			StartOffset:    trackMeta.StartOffset,
+			EndOffset:      trackMeta.EndOffset,
+		}
+
+		if err := tx.Create(&track).Error; err != nil {
+			return err
+		}
+
+		for _, credit := range trackMeta.Contributors {
+			contributor := models.Contributor{Name: credit.Name, Type: credit.Type}
+			if err := tx.Where("name = ? AND type = ?", credit.Name, credit.Type).FirstOrCreate(&contributor).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&models.TrackContributor{TrackID: track.ID, ContributorID: contributor.ID}).Error; err != nil {
+				return err
+			}
+		}
+
+		// Lyrics that can't be read don't hold up the promotion; the
+		// savepoint keeps a failed import from aborting the transaction.
+		// The lyrics of a file shared by cue sheet tracks belong to none of them.
+		if !track.IsSegment() {
+			stagedPath := filepath.Join(stagingPath, filepath.Base(trackMeta.FilePath))
+			err := tx.Transaction(func(sp *gorm.DB) error {
+				_, err := lyrics.NewService(sp).Import(context.Background(), track.ID, stagedPath)
+				return err
+			})
+			if err != nil {
+				logging.Warnf("promotion: failed to import lyrics for track %d: %v", track.ID, err)
+			}
+		}
+
+		// Index the fingerprint taken in staging so later albums are checked against it
+		if trackMeta.Fingerprint != "" {
+			raw, err := fingerprint.Decode(trackMeta.Fingerprint)
+			if err == nil {
+				err = fingerprint.Store(context.Background(), tx, track.ID, raw)
+			}
+			if err != nil {
+				logging.Warnf("promotion: failed to store fingerprint for track %d: %v", track.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createImages records the album's staged images. The artist image is
+// recorded for the artist instead when it was moved to the artist directory,
+// unless the artist has gained an image since; otherwise it stays with the
+// album unrecorded.
+func createImages(tx *gorm.DB, metadata *processor.AlbumMetadata, albumID, artistID int64, artistImage bool) error {
+	for _, meta := range metadata.Album.Images {
+		image := models.Image{
+			Type:      meta.Type,
+			Source:    meta.Source,
+			FileName:  meta.FileName,
+			Width:     int32(meta.Width),
+			Height:    int32(meta.Height),
+			FileSize:  meta.FileSize,
+			Checksum:  meta.Checksum,
+			IsPrimary: meta.IsPrimary,
+		}
+		if meta.Type == models.ImageTypeArtist {
+			if !artistImage {
+				continue
+			}
+			var count int64
+			if err := tx.Model(&models.Image{}).Where("artist_id = ?", artistID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			image.ArtistID = &artistID
+			image.IsPrimary = true
+		} else {
+			image.AlbumID = &albumID
+		}
+		if err := tx.Create(&image).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// albumImageCount returns the number of images the album keeps; artist
+// images go to the artist
+func albumImageCount(metadata *processor.AlbumMetadata) int {
+	if metadata.Album.Images == nil {
+		return metadata.Album.ImageCount
+	}
+	count := 0
+	for _, image := range metadata.Album.Images {
+		if image.Type != models.ImageTypeArtist {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,501 @@
+// Package promotion moves approved albums from staging to production. Each
+// promotion is a job whose file moves are journaled before any file is
+// touched: files are copied and verified first, the album's rows are created
+// in one transaction, and only then are the staging files deleted. A job
+// interrupted at any point is finished when it runs again, and a job that
+// fails before its rows are created leaves staging as it was.
+package promotion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"melodee/internal/directory"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+	"melodee/internal/processor"
+	"melodee/internal/releasegroup"
+)
+
+var (
+	// ErrNotApproved is returned when promoting a staging item that isn't approved
+	ErrNotApproved = errors.New("only approved items can be promoted")
+	// ErrInProgress is returned when promoting a staging item that is being promoted
+	ErrInProgress = errors.New("staging item is already being promoted")
+	// ErrChecksumMismatch is returned when a copied file isn't the file staging has
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrTargetExists is returned when a production file is in the way of a copy
+	ErrTargetExists = errors.New("production file already exists")
+)
+
+// LibrarySelector picks the production library albums of an artist with a
+// directory code are promoted into. *media.MediaProcessor is one.
+type LibrarySelector interface {
+	SelectProductionLibrary(directoryCode string) (*models.Library, error)
+}
+
+// Service plans and runs promotions
+type Service struct {
+	db            *gorm.DB
+	libraries     LibrarySelector
+	paths         *directory.LibraryPathResolver
+	releaseGroups *releasegroup.Service
+}
+
+// NewService creates a new promotion service
+func NewService(db *gorm.DB, libraries LibrarySelector) *Service {
+	return &Service{
+		db:            db,
+		libraries:     libraries,
+		paths:         directory.NewLibraryPathResolver(db, nil),
+		releaseGroups: releasegroup.NewService(db),
+	}
+}
+
+// NewBatchID returns an ID for jobs queued together
+func NewBatchID() string {
+	return uuid.New().String()
+}
+
+// Create creates the pending promotion job of an approved staging item
+func (s *Service) Create(ctx context.Context, stagingItemID int64, batchID string) (*models.PromotionJob, error) {
+	var job models.PromotionJob
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Promotions of an item are serialized on its row, so only one of
+		// them finds no unfinished job
+		var item models.StagingItem
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&item, stagingItemID).Error; err != nil {
+			return err
+		}
+		if item.Status != "approved" {
+			return ErrNotApproved
+		}
+
+		var unfinished int64
+		if err := tx.Model(&models.PromotionJob{}).
+			Where("staging_item_id = ? AND status IN ?", item.ID, unfinishedStatuses).
+			Count(&unfinished).Error; err != nil {
+			return err
+		}
+		if unfinished > 0 {
+			return ErrInProgress
+		}
+
+		job = models.PromotionJob{
+			BatchID:       batchID,
+			StagingItemID: item.ID,
+			Status:        models.PromotionStatusPending,
+			StagingPath:   item.StagingPath,
+		}
+		return tx.Create(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// unfinishedStatuses are the statuses of jobs that still have work to do
+var unfinishedStatuses = []string{
+	models.PromotionStatusPending,
+	models.PromotionStatusCopying,
+	models.PromotionStatusCommitted,
+}
+
+// Unfinished returns the jobs that still have work to do, oldest first
+func (s *Service) Unfinished(ctx context.Context) ([]models.PromotionJob, error) {
+	var jobs []models.PromotionJob
+	if err := s.db.WithContext(ctx).Where("status IN ?", unfinishedStatuses).Order("id").Find(&jobs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load unfinished promotion jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// Progress is how far the jobs of a batch have got
+type Progress struct {
+	BatchID     string                `json:"batch_id"`
+	Total       int                   `json:"total"`
+	Completed   int                   `json:"completed"`
+	Failed      int                   `json:"failed"`
+	Running     int                   `json:"running"`
+	FilesTotal  int32                 `json:"files_total"`
+	FilesCopied int32                 `json:"files_copied"`
+	Jobs        []models.PromotionJob `json:"jobs"`
+}
+
+// Batch returns the progress of a batch, or gorm.ErrRecordNotFound when it
+// has no jobs
+func (s *Service) Batch(ctx context.Context, batchID string) (*Progress, error) {
+	progress := Progress{BatchID: batchID}
+	if err := s.db.WithContext(ctx).Where("batch_id = ?", batchID).Order("id").Find(&progress.Jobs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load promotion jobs: %w", err)
+	}
+	if len(progress.Jobs) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	progress.Total = len(progress.Jobs)
+	for _, job := range progress.Jobs {
+		switch job.Status {
+		case models.PromotionStatusCompleted:
+			progress.Completed++
+		case models.PromotionStatusFailed:
+			progress.Failed++
+		default:
+			progress.Running++
+		}
+		progress.FilesTotal += job.FilesTotal
+		progress.FilesCopied += job.FilesCopied
+	}
+	return &progress, nil
+}
+
+// Run carries a job on from wherever it stopped: it plans the moves of a
+// pending job, copies the files of a copying job and creates its rows, and
+// deletes the staging files of a committed job. Failures before the rows are
+// created mark the job failed, remove its copies and are returned wrapped in
+// a *FailedError; the job can't be run again.
+func (s *Service) Run(ctx context.Context, jobID int64) error {
+	var job models.PromotionJob
+	if err := s.db.WithContext(ctx).First(&job, jobID).Error; err != nil {
+		return fmt.Errorf("failed to load promotion job %d: %w", jobID, err)
+	}
+
+	switch job.Status {
+	case models.PromotionStatusCompleted, models.PromotionStatusFailed:
+		return nil
+	case models.PromotionStatusPending:
+		if err := s.plan(ctx, &job); err != nil {
+			return s.fail(ctx, &job, err)
+		}
+		fallthrough
+	case models.PromotionStatusCopying:
+		if err := s.copy(ctx, &job); err != nil {
+			return s.fail(ctx, &job, err)
+		}
+		if err := s.commit(ctx, &job); err != nil {
+			return s.fail(ctx, &job, err)
+		}
+	}
+	return s.finish(ctx, &job)
+}
+
+// FailedError is returned by Run for jobs that failed
+type FailedError struct {
+	JobID int64
+	Err   error
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("promotion job %d failed: %v", e.JobID, e.Err)
+}
+
+func (e *FailedError) Unwrap() error {
+	return e.Err
+}
+
+// plan journals the moves of a pending job: every file in the staging
+// directory goes to the same place in the album's production directory,
+// except the artist image, which goes to the artist directory when the
+// artist has no image yet
+func (s *Service) plan(ctx context.Context, job *models.PromotionJob) error {
+	var item models.StagingItem
+	if err := s.db.WithContext(ctx).First(&item, job.StagingItemID).Error; err != nil {
+		return fmt.Errorf("failed to load staging item: %w", err)
+	}
+	if item.Status != "approved" {
+		return ErrNotApproved
+	}
+	metadata, err := processor.ReadAlbumMetadata(item.MetadataFile)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	library, err := s.libraries.SelectProductionLibrary(metadata.Artist.DirectoryCode)
+	if err != nil {
+		return fmt.Errorf("failed to select production library: %w", err)
+	}
+	productionPath, err := s.paths.Resolve(library, albumDirectory(metadata))
+	if err != nil {
+		return fmt.Errorf("failed to resolve production path: %w", err)
+	}
+
+	checksums := make(map[string]string)
+	for _, track := range metadata.Tracks {
+		if track.Checksum != "" {
+			checksums[filepath.Base(track.FilePath)] = track.Checksum
+		}
+	}
+	artistImage, err := s.artistImageTarget(ctx, metadata, productionPath)
+	if err != nil {
+		return err
+	}
+
+	var moves []models.PromotionMove
+	err = filepath.WalkDir(item.StagingPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(item.StagingPath, path)
+		if err != nil {
+			return err
+		}
+
+		move := models.PromotionMove{
+			SourcePath: path,
+			TargetPath: filepath.Join(productionPath, rel),
+			Size:       info.Size(),
+			Status:     models.PromotionMovePlanned,
+		}
+		if filepath.Dir(rel) == "." {
+			move.Checksum = checksums[rel]
+			if artistImage != "" && rel == filepath.Base(artistImage) {
+				move.TargetPath = artistImage
+			}
+		}
+		// Production files are never overwritten, and a file that is
+		// already there is another album's or an earlier promotion's
+		if _, err := os.Lstat(move.TargetPath); err == nil {
+			return fmt.Errorf("%w: %s", ErrTargetExists, move.TargetPath)
+		}
+		moves = append(moves, move)
+		return nil
+	})
+	if errors.Is(err, ErrTargetExists) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list staging files: %w", err)
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range moves {
+			moves[i].JobID = job.ID
+		}
+		if len(moves) > 0 {
+			if err := tx.Create(&moves).Error; err != nil {
+				return err
+			}
+		}
+		job.Status = models.PromotionStatusCopying
+		job.LibraryID = &library.ID
+		job.StagingPath = item.StagingPath
+		job.ProductionPath = productionPath
+		job.FilesTotal = int32(len(moves))
+		return tx.Save(job).Error
+	})
+}
+
+// artistImageTarget returns where the album's artist image goes in the
+// artist directory, or "" when it stays with the album because the artist
+// has an image already
+func (s *Service) artistImageTarget(ctx context.Context, metadata *processor.AlbumMetadata, productionPath string) (string, error) {
+	name := artistImageName(metadata)
+	if name == "" {
+		return "", nil
+	}
+
+	var count int64
+	err := s.db.WithContext(ctx).Model(&models.Image{}).
+		Joins("JOIN artists ON artists.id = images.artist_id").
+		Where("artists.name_normalized = ?", metadata.Artist.NameNormalized).
+		Count(&count).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to check artist images: %w", err)
+	}
+	target := filepath.Join(filepath.Dir(productionPath), name)
+	if count > 0 {
+		return "", nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		return "", nil
+	}
+	return target, nil
+}
+
+// artistImageName returns the file name of the album's artist image, or ""
+// when it has none
+func artistImageName(metadata *processor.AlbumMetadata) string {
+	for _, image := range metadata.Album.Images {
+		if image.Type == models.ImageTypeArtist {
+			return image.FileName
+		}
+	}
+	return ""
+}
+
+// copy copies the planned files of a job, each verified and synced to disk
+// before it is marked copied. A target is journaled as created by the job
+// before it is written, so a job interrupted right after writing it keeps
+// the file when it runs again, and removes it when it fails.
+func (s *Service) copy(ctx context.Context, job *models.PromotionJob) error {
+	var moves []models.PromotionMove
+	if err := s.db.WithContext(ctx).Where("job_id = ? AND status = ?", job.ID, models.PromotionMovePlanned).Order("id").Find(&moves).Error; err != nil {
+		return fmt.Errorf("failed to load promotion moves: %w", err)
+	}
+
+	for i := range moves {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		move := &moves[i]
+		if !move.Created {
+			if _, err := os.Lstat(move.TargetPath); err == nil {
+				return fmt.Errorf("%w: %s", ErrTargetExists, move.TargetPath)
+			}
+			if err := s.db.WithContext(ctx).Model(move).Update("created", true).Error; err != nil {
+				return fmt.Errorf("failed to record copy of %s: %w", filepath.Base(move.SourcePath), err)
+			}
+		}
+		if err := copyFile(move.SourcePath, move.TargetPath, move.Checksum); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(move.SourcePath), err)
+		}
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(move).Update("status", models.PromotionMoveCopied).Error; err != nil {
+				return err
+			}
+			return tx.Model(job).Update("files_copied", gorm.Expr("files_copied + 1")).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record copy of %s: %w", filepath.Base(move.SourcePath), err)
+		}
+	}
+	return nil
+}
+
+// commit creates the rows of a job's album and deletes its staging item in
+// one transaction with marking the job committed
+func (s *Service) commit(ctx context.Context, job *models.PromotionJob) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var item models.StagingItem
+		if err := tx.First(&item, job.StagingItemID).Error; err != nil {
+			return fmt.Errorf("failed to load staging item: %w", err)
+		}
+		if item.Status != "approved" {
+			return ErrNotApproved
+		}
+		metadata, err := processor.ReadAlbumMetadata(item.MetadataFile)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata file: %w", err)
+		}
+
+		artist, err := findOrCreateArtist(tx, metadata)
+		if err != nil {
+			return fmt.Errorf("failed to create artist: %w", err)
+		}
+		album, err := createAlbum(tx, metadata, artist.ID, *job.LibraryID)
+		if err != nil {
+			return fmt.Errorf("failed to create album: %w", err)
+		}
+		if err := createTracks(tx, metadata, item.StagingPath, album.ID, artist.ID, *job.LibraryID); err != nil {
+			return fmt.Errorf("failed to create tracks: %w", err)
+		}
+
+		// The artist image is the artist's only when it was copied to the artist directory
+		var moved int64
+		if name := artistImageName(metadata); name != "" {
+			target := filepath.Join(filepath.Dir(job.ProductionPath), name)
+			if err := tx.Model(&models.PromotionMove{}).Where("job_id = ? AND target_path = ?", job.ID, target).Count(&moved).Error; err != nil {
+				return err
+			}
+		}
+		if err := createImages(tx, metadata, album.ID, artist.ID, moved > 0); err != nil {
+			return fmt.Errorf("failed to create images: %w", err)
+		}
+
+		if err := tx.Delete(&item).Error; err != nil {
+			return fmt.Errorf("failed to delete staging item: %w", err)
+		}
+		job.Status = models.PromotionStatusCommitted
+		job.AlbumID = &album.ID
+		return tx.Model(job).Updates(map[string]interface{}{"status": job.Status, "album_id": album.ID}).Error
+	})
+}
+
+// finish deletes the staging files of a committed job and completes it
+func (s *Service) finish(ctx context.Context, job *models.PromotionJob) error {
+	var moves []models.PromotionMove
+	if err := s.db.WithContext(ctx).Where("job_id = ? AND status = ?", job.ID, models.PromotionMoveCopied).Order("id").Find(&moves).Error; err != nil {
+		return fmt.Errorf("failed to load promotion moves: %w", err)
+	}
+	for i := range moves {
+		if err := os.Remove(moves[i].SourcePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete staging file: %w", err)
+		}
+		if err := s.db.WithContext(ctx).Model(&moves[i]).Update("status", models.PromotionMoveDeleted).Error; err != nil {
+			return fmt.Errorf("failed to record deletion of %s: %w", filepath.Base(moves[i].SourcePath), err)
+		}
+	}
+	removeEmptyDirs(job.StagingPath)
+
+	now := time.Now()
+	job.Status = models.PromotionStatusCompleted
+	job.CompletedAt = &now
+	if err := s.db.WithContext(ctx).Model(job).Updates(map[string]interface{}{"status": job.Status, "completed_at": now}).Error; err != nil {
+		return fmt.Errorf("failed to complete promotion job: %w", err)
+	}
+
+	// Group the new album with the artist's other editions. The album is
+	// already in production, so a failure here is left for the next rebuild.
+	var album models.Album
+	if job.AlbumID != nil && s.db.WithContext(ctx).First(&album, *job.AlbumID).Error == nil {
+		if err := s.releaseGroups.ConsolidateArtist(ctx, album.ArtistID); err != nil {
+			logging.Warnf("promotion: failed to consolidate release groups for artist %d: %v", album.ArtistID, err)
+		}
+	}
+	return nil
+}
+
+// fail marks a job failed and removes the files it created. Staging is left
+// as it was, so the item can be promoted again. A job stopped because its
+// context ended, such as by the worker shutting down, is left to run again.
+func (s *Service) fail(ctx context.Context, job *models.PromotionJob, cause error) error {
+	if ctx.Err() != nil {
+		return cause
+	}
+
+	var moves []models.PromotionMove
+	if err := s.db.WithContext(ctx).Where("job_id = ?", job.ID).Find(&moves).Error; err != nil {
+		return fmt.Errorf("failed to load promotion moves: %w (job failed: %v)", err, cause)
+	}
+	for _, move := range moves {
+		if move.Created {
+			os.Remove(move.TargetPath)
+			os.Remove(move.TargetPath + partialSuffix)
+		}
+	}
+	if job.ProductionPath != "" {
+		removeEmptyDirs(job.ProductionPath)
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PromotionMove{}).Where("job_id = ?", job.ID).
+			Updates(map[string]interface{}{"status": models.PromotionMovePlanned, "created": false}).Error; err != nil {
+			return err
+		}
+		return tx.Model(job).Updates(map[string]interface{}{
+			"status":       models.PromotionStatusFailed,
+			"error":        cause.Error(),
+			"files_copied": 0,
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark promotion job failed: %w (job failed: %v)", err, cause)
+	}
+	job.Status = models.PromotionStatusFailed
+	job.Error = cause.Error()
+	return &FailedError{JobID: job.ID, Err: cause}
+}
@@ -0,0 +1,331 @@
+package promotion
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+	"melodee/internal/processor"
+)
+
+type fixedLibrary struct {
+	library *models.Library
+}
+
+func (f fixedLibrary) SelectProductionLibrary(string) (*models.Library, error) {
+	return f.library, nil
+}
+
+func setupPromotionTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE staging_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		scan_id TEXT, staging_path TEXT, metadata_file TEXT,
+		artist_name TEXT, album_name TEXT, track_count INTEGER, total_size INTEGER,
+		processed_at DATETIME, status TEXT, reviewed_by INTEGER, reviewed_at DATETIME,
+		notes TEXT, checksum TEXT, duplicate_count INTEGER, created_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key, is_locked BOOLEAN, name, name_normalized, directory_code, sort_name, alternate_names,
+		track_count_cached, album_count_cached, duration_cached, created_at DATETIME, last_scanned_at DATETIME, tags,
+		music_brainz_id, spotify_id, last_fm_id, discogs_id, i_tunes_id, amg_id, wikidata_id,
+		sort_order, biography, image_url
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key, is_locked BOOLEAN, name, name_normalized, alternate_names, artist_id, library_id,
+		track_count_cached, duration_cached, created_at DATETIME, tags, release_date DATETIME, original_release_date DATETIME,
+		album_type, directory, sort_name, sort_order, image_count, comment, description, genres,
+		moods, notes, deezer_id, music_brainz_id, spotify_id, last_fm_id, discogs_id, i_tunes_id,
+		amg_id, wikidata_id, is_compilation BOOLEAN, release_group_id, edition_type, image_url
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key, name, name_normalized, sort_name, album_id, artist_id, library_id, duration,
+		bit_rate, bit_depth, sample_rate, channels, created_at DATETIME, tags, directory, file_name,
+		relative_path, crc_hash, sort_order, fingerprint, duplicate_of_id, start_offset, end_offset,
+		replaygain_track_gain, replaygain_track_peak, replaygain_album_gain, replaygain_album_peak
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		album_id, artist_id, type, source, file_name, width, height, file_size, checksum,
+		is_primary BOOLEAN, created_at DATETIME, updated_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE promotion_jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		batch_id TEXT, staging_item_id INTEGER, status TEXT, library_id INTEGER, album_id INTEGER,
+		staging_path TEXT, production_path TEXT, files_total INTEGER DEFAULT 0,
+		files_copied INTEGER DEFAULT 0, error TEXT,
+		created_at DATETIME, updated_at DATETIME, completed_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE promotion_moves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER, source_path TEXT, target_path TEXT, checksum TEXT, size INTEGER, status TEXT,
+		created BOOLEAN DEFAULT 0
+	)`).Error)
+	return db
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// stageAlbum writes an approved staged album with two tracks and an artist
+// image, returning the staging item
+func stageAlbum(t *testing.T, db *gorm.DB, root string) *models.StagingItem {
+	t.Helper()
+	stagingPath := filepath.Join(root, "staging", "scan1", "Band - Album")
+	require.NoError(t, os.MkdirAll(stagingPath, 0755))
+
+	files := map[string][]byte{
+		"01 - One.mp3": []byte("first track"),
+		"02 - Two.mp3": []byte("second track"),
+		"artist.jpg":   []byte("artist image"),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(stagingPath, name), data, 0644))
+	}
+
+	metadata := &processor.AlbumMetadata{
+		Artist: processor.ArtistMetadata{Name: "Band", NameNormalized: "band", DirectoryCode: "BA"},
+		Album: processor.AlbumInfo{
+			Name: "Album", NameNormalized: "album", Year: 2001,
+			Images: []processor.ImageMetadata{
+				{FileName: "artist.jpg", Type: models.ImageTypeArtist, Source: "folder", Checksum: checksum(files["artist.jpg"])},
+			},
+		},
+		Tracks: []processor.TrackMetadata{
+			{TrackNumber: 1, Name: "One", FilePath: "scan1/Band - Album/01 - One.mp3", Checksum: checksum(files["01 - One.mp3"])},
+			{TrackNumber: 2, Name: "Two", FilePath: "scan1/Band - Album/02 - Two.mp3", Checksum: checksum(files["02 - Two.mp3"])},
+		},
+	}
+	metadataFile := filepath.Join(stagingPath, "album.melodee.json")
+	require.NoError(t, processor.WriteAlbumMetadata(metadataFile, metadata))
+
+	item := &models.StagingItem{
+		ScanID:       "scan1",
+		StagingPath:  stagingPath,
+		MetadataFile: metadataFile,
+		ArtistName:   "Band",
+		AlbumName:    "Album",
+		TrackCount:   2,
+		ProcessedAt:  time.Now(),
+		Status:       "approved",
+	}
+	require.NoError(t, db.Create(item).Error)
+	return item
+}
+
+func newTestService(db *gorm.DB, root string) *Service {
+	library := &models.Library{ID: 1, Name: "Production", Path: filepath.Join(root, "production"), Type: "production"}
+	return NewService(db, fixedLibrary{library})
+}
+
+func TestRun_PromotesAlbum(t *testing.T) {
+	db := setupPromotionTestDB(t)
+	root := t.TempDir()
+	item := stageAlbum(t, db, root)
+	service := newTestService(db, root)
+	ctx := context.Background()
+
+	batchID := NewBatchID()
+	job, err := service.Create(ctx, item.ID, batchID)
+	require.NoError(t, err)
+	require.NoError(t, service.Run(ctx, job.ID))
+
+	albumDir := filepath.Join(root, "production", "BA", "Band", "2001 - Album")
+	data, err := os.ReadFile(filepath.Join(albumDir, "01 - One.mp3"))
+	require.NoError(t, err)
+	assert.Equal(t, "first track", string(data))
+	assert.FileExists(t, filepath.Join(albumDir, "02 - Two.mp3"))
+	assert.FileExists(t, filepath.Join(albumDir, "album.melodee.json"))
+	assert.FileExists(t, filepath.Join(root, "production", "BA", "Band", "artist.jpg"))
+	assert.NoFileExists(t, filepath.Join(albumDir, "artist.jpg"))
+	assert.NoDirExists(t, item.StagingPath)
+
+	var album models.Album
+	require.NoError(t, db.First(&album).Error)
+	assert.Equal(t, "BA/Band/2001 - Album", album.Directory)
+	var tracks int64
+	db.Model(&models.Track{}).Where("album_id = ?", album.ID).Count(&tracks)
+	assert.Equal(t, int64(2), tracks)
+	var image models.Image
+	require.NoError(t, db.First(&image).Error)
+	require.NotNil(t, image.ArtistID)
+	assert.Equal(t, album.ArtistID, *image.ArtistID)
+
+	var items int64
+	db.Model(&models.StagingItem{}).Count(&items)
+	assert.Zero(t, items)
+
+	progress, err := service.Batch(ctx, batchID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, progress.Total)
+	assert.Equal(t, 1, progress.Completed)
+	assert.Equal(t, int32(4), progress.FilesTotal)
+	assert.Equal(t, int32(4), progress.FilesCopied)
+	assert.Equal(t, models.PromotionStatusCompleted, progress.Jobs[0].Status)
+	require.NotNil(t, progress.Jobs[0].AlbumID)
+	assert.Equal(t, album.ID, *progress.Jobs[0].AlbumID)
+
+	var moves []models.PromotionMove
+	db.Where("job_id = ?", job.ID).Find(&moves)
+	for _, move := range moves {
+		assert.Equal(t, models.PromotionMoveDeleted, move.Status)
+	}
+
+	// A finished job is left alone when it runs again
+	require.NoError(t, service.Run(ctx, job.ID))
+}
+
+func TestRun_ChecksumMismatchLeavesStaging(t *testing.T) {
+	db := setupPromotionTestDB(t)
+	root := t.TempDir()
+	item := stageAlbum(t, db, root)
+	service := newTestService(db, root)
+	ctx := context.Background()
+
+	// The file changed on disk since it was processed
+	require.NoError(t, os.WriteFile(filepath.Join(item.StagingPath, "02 - Two.mp3"), []byte("corrupted"), 0644))
+
+	job, err := service.Create(ctx, item.ID, NewBatchID())
+	require.NoError(t, err)
+	err = service.Run(ctx, job.ID)
+	var failed *FailedError
+	require.ErrorAs(t, err, &failed)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	assert.NoDirExists(t, filepath.Join(root, "production", "BA", "Band", "2001 - Album"))
+	assert.NoFileExists(t, filepath.Join(root, "production", "BA", "Band", "artist.jpg"))
+	assert.FileExists(t, filepath.Join(item.StagingPath, "01 - One.mp3"))
+	assert.FileExists(t, filepath.Join(item.StagingPath, "02 - Two.mp3"))
+
+	require.NoError(t, db.First(job, job.ID).Error)
+	assert.Equal(t, models.PromotionStatusFailed, job.Status)
+	assert.Contains(t, job.Error, "02 - Two.mp3")
+	assert.Zero(t, job.FilesCopied)
+
+	var albums, items int64
+	db.Model(&models.Album{}).Count(&albums)
+	db.Model(&models.StagingItem{}).Count(&items)
+	assert.Zero(t, albums)
+	assert.Equal(t, int64(1), items)
+
+	// The item can be promoted again once the job failed
+	_, err = service.Create(ctx, item.ID, NewBatchID())
+	assert.NoError(t, err)
+}
+
+func TestRun_ResumesInterruptedCopy(t *testing.T) {
+	db := setupPromotionTestDB(t)
+	root := t.TempDir()
+	item := stageAlbum(t, db, root)
+	service := newTestService(db, root)
+	ctx := context.Background()
+
+	job, err := service.Create(ctx, item.ID, NewBatchID())
+	require.NoError(t, err)
+	require.NoError(t, service.plan(ctx, job))
+
+	// Interrupted after one file was copied but before it was recorded, with
+	// another left half written
+	var moves []models.PromotionMove
+	require.NoError(t, db.Where("job_id = ?", job.ID).Order("id").Find(&moves).Error)
+	require.Len(t, moves, 4)
+	require.NoError(t, db.Model(&models.PromotionMove{}).Where("id IN ?", []int64{moves[0].ID, moves[1].ID}).Update("created", true).Error)
+	require.NoError(t, copyFile(moves[0].SourcePath, moves[0].TargetPath, moves[0].Checksum))
+	require.NoError(t, os.WriteFile(moves[1].TargetPath+partialSuffix, []byte("half"), 0644))
+
+	require.NoError(t, service.Run(ctx, job.ID))
+	require.NoError(t, db.First(job, job.ID).Error)
+	assert.Equal(t, models.PromotionStatusCompleted, job.Status)
+	for _, move := range moves {
+		assert.FileExists(t, move.TargetPath)
+		assert.NoFileExists(t, move.TargetPath+partialSuffix)
+		assert.NoFileExists(t, move.SourcePath)
+	}
+}
+
+func TestRun_KeepsExistingProductionFiles(t *testing.T) {
+	db := setupPromotionTestDB(t)
+	root := t.TempDir()
+	item := stageAlbum(t, db, root)
+	service := newTestService(db, root)
+	ctx := context.Background()
+
+	existing := filepath.Join(root, "production", "BA", "Band", "2001 - Album", "01 - One.mp3")
+	require.NoError(t, os.MkdirAll(filepath.Dir(existing), 0755))
+	require.NoError(t, os.WriteFile(existing, []byte("another recording"), 0644))
+
+	job, err := service.Create(ctx, item.ID, NewBatchID())
+	require.NoError(t, err)
+	err = service.Run(ctx, job.ID)
+	assert.ErrorIs(t, err, ErrTargetExists)
+
+	data, err := os.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "another recording", string(data))
+	assert.FileExists(t, filepath.Join(item.StagingPath, "01 - One.mp3"))
+
+	// A file the job didn't write is kept even when it is the same file,
+	// such as one promoted by another job since this one was planned
+	require.NoError(t, os.Remove(existing))
+	job, err = service.Create(ctx, item.ID, NewBatchID())
+	require.NoError(t, err)
+	require.NoError(t, service.plan(ctx, job))
+	require.NoError(t, os.WriteFile(existing, []byte("first track"), 0644))
+	err = service.Run(ctx, job.ID)
+	assert.ErrorIs(t, err, ErrTargetExists)
+
+	data, err = os.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "first track", string(data))
+	var albums int64
+	db.Model(&models.Album{}).Count(&albums)
+	assert.Zero(t, albums)
+}
+
+func TestCreate(t *testing.T) {
+	db := setupPromotionTestDB(t)
+	root := t.TempDir()
+	item := stageAlbum(t, db, root)
+	service := newTestService(db, root)
+	ctx := context.Background()
+
+	_, err := service.Create(ctx, item.ID+1, NewBatchID())
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	job, err := service.Create(ctx, item.ID, NewBatchID())
+	require.NoError(t, err)
+	assert.Equal(t, models.PromotionStatusPending, job.Status)
+	_, err = service.Create(ctx, item.ID, NewBatchID())
+	assert.ErrorIs(t, err, ErrInProgress)
+
+	unfinished, err := service.Unfinished(ctx)
+	require.NoError(t, err)
+	require.Len(t, unfinished, 1)
+	assert.Equal(t, job.ID, unfinished[0].ID)
+
+	require.NoError(t, db.Model(item).Update("status", "pending_review").Error)
+	db.Model(job).Update("status", models.PromotionStatusFailed)
+	_, err = service.Create(ctx, item.ID, NewBatchID())
+	assert.ErrorIs(t, err, ErrNotApproved)
+
+	_, err = service.Batch(ctx, "missing")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,146 @@
+package promotion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+	"melodee/internal/media"
+	"melodee/internal/models"
+)
+
+// Job types for Asynq
+const (
+	TypePromotionRun = "promotion:run"
+)
+
+// RunPayload represents the payload for promotion jobs
+type RunPayload struct {
+	JobID int64 `json:"job_id"`
+}
+
+// NewRunTask creates a task that runs a promotion job
+func NewRunTask(jobID int64) (*asynq.Task, error) {
+	payload, err := json.Marshal(RunPayload{JobID: jobID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal promotion run payload: %w", err)
+	}
+	return asynq.NewTask(TypePromotionRun, payload), nil
+}
+
+// Enqueue creates and enqueues the task of a promotion job. A job whose task
+// is still queued or retrying isn't queued again; tasks of unfinished jobs
+// are never archived, so their IDs don't keep recovery from queueing them.
+func Enqueue(client *asynq.Client, jobID int64) error {
+	task, err := NewRunTask(jobID)
+	if err != nil {
+		return err
+	}
+	_, err = client.Enqueue(task, asynq.TaskID(fmt.Sprintf("promotion.run:%d", jobID)), asynq.Timeout(2*time.Hour))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue promotion: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs promotion jobs
+type TaskHandler struct {
+	service *Service
+	client  *asynq.Client
+}
+
+// NewTaskHandler creates a new promotion task handler. The client queues the
+// jobs of move-OK runs and of recovery.
+func NewTaskHandler(service *Service, client *asynq.Client) *TaskHandler {
+	return &TaskHandler{service: service, client: client}
+}
+
+// HandleRun runs a promotion job. Failed jobs are not retried; the staging
+// item can be promoted again instead. A job still unfinished after the last
+// retry is left for recovery.
+func (h *TaskHandler) HandleRun(ctx context.Context, t *asynq.Task) error {
+	var p RunPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal promotion run payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	started := time.Now()
+	if err := h.service.Run(ctx, p.JobID); err != nil {
+		var failed *FailedError
+		if errors.As(err, &failed) {
+			logging.Errorf("promotion: %v", err)
+			return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		if retried >= maxRetry {
+			// The job stays unfinished for Recover to queue when the worker
+			// starts again, rather than archiving the task, which would keep
+			// its ID and keep Recover from queueing it
+			logging.Errorf("promotion: giving up on job %d until recovery: %v", p.JobID, err)
+			return nil
+		}
+		return err
+	}
+	logging.Infof("promotion: job %d done in %s", p.JobID, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// HandleMoveOK promotes the given approved staging items, or every approved
+// item that isn't being promoted when none are given, as one batch
+func (h *TaskHandler) HandleMoveOK(ctx context.Context, t *asynq.Task) error {
+	var p media.LibraryMoveOKPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal library move OK payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	ids := p.StagingItemIDs
+	if len(ids) == 0 {
+		if err := h.service.db.WithContext(ctx).Model(&models.StagingItem{}).
+			Where("status = ?", "approved").Order("id").Pluck("id", &ids).Error; err != nil {
+			return fmt.Errorf("failed to load approved staging items: %w", err)
+		}
+	}
+
+	batchID := NewBatchID()
+	queued := 0
+	for _, id := range ids {
+		job, err := h.service.Create(ctx, id, batchID)
+		if err != nil {
+			if !errors.Is(err, ErrInProgress) {
+				logging.Warnf("promotion: staging item %d not promoted: %v", id, err)
+			}
+			continue
+		}
+		if err := Enqueue(h.client, job.ID); err != nil {
+			// Picked up by recovery when the worker starts again
+			logging.Errorf("promotion: %v", err)
+			continue
+		}
+		queued++
+	}
+	logging.Infof("promotion: queued %d of %d staging items as batch %s", queued, len(ids), batchID)
+	return nil
+}
+
+// Recover queues the jobs left unfinished when the worker stopped or after
+// their last retry, so they are finished. Run it when the worker starts.
+func (h *TaskHandler) Recover(ctx context.Context) error {
+	jobs, err := h.service.Unfinished(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := Enqueue(h.client, job.ID); err != nil {
+			return err
+		}
+	}
+	if len(jobs) > 0 {
+		logging.Infof("promotion: recovering %d unfinished promotion jobs", len(jobs))
+	}
+	return nil
+}
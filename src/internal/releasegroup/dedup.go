@@ -0,0 +1,64 @@
+package releasegroup
+
+import (
+	"melodee/internal/fingerprint"
+	"melodee/internal/models"
+)
+
+const (
+	// durationTolerance is how far apart, in milliseconds, two copies of a
+	// recording may be; remasters often differ by a second or two of silence
+	durationTolerance = 3000
+
+	// fingerprintThreshold is the fingerprint similarity above which two
+	// tracks are the same recording
+	fingerprintThreshold = 0.85
+)
+
+// SameRecording reports whether two tracks from different editions are the
+// same recording. When both tracks carry a fingerprint it decides; otherwise
+// the titles, with edition qualifiers such as "(2011 Remaster)" removed, must
+// match. Durations must agree either way when both are known.
+func SameRecording(a, b *models.Track) bool {
+	if a.Duration > 0 && b.Duration > 0 {
+		diff := a.Duration - b.Duration
+		if diff < -durationTolerance || diff > durationTolerance {
+			return false
+		}
+	}
+
+	if a.Fingerprint != "" && b.Fingerprint != "" {
+		if similarity, err := fingerprint.Compare(a.Fingerprint, b.Fingerprint); err == nil {
+			return similarity >= fingerprintThreshold
+		}
+	}
+
+	titleA, titleB := DetectEdition(a.Name).Normalized, DetectEdition(b.Name).Normalized
+	return titleA != "" && titleA == titleB
+}
+
+// deduplicate returns, for every track that repeats a recording already seen
+// on an earlier edition, the ID of that first copy. Tracks must be ordered by
+// edition, primary edition first; repeats within one edition are kept.
+func deduplicate(tracks []models.Track) map[int64]int64 {
+	duplicateOf := make(map[int64]int64)
+	var unique []*models.Track
+
+	for i := range tracks {
+		track := &tracks[i]
+		var original *models.Track
+		for _, candidate := range unique {
+			if candidate.AlbumID != track.AlbumID && SameRecording(candidate, track) {
+				original = candidate
+				break
+			}
+		}
+
+		if original != nil {
+			duplicateOf[track.ID] = original.ID
+		} else {
+			unique = append(unique, track)
+		}
+	}
+	return duplicateOf
+}
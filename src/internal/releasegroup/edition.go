@@ -0,0 +1,103 @@
+// Package releasegroup consolidates the editions of an album (Original,
+// Deluxe, Remaster...) into release groups, as described in
+// docs/ALBUM_EDITION_CONSOLIDATION.md
+package releasegroup
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Edition types detected from album names
+const (
+	EditionOriginal    = "original"
+	EditionDeluxe      = "deluxe"
+	EditionRemaster    = "remaster"
+	EditionAnniversary = "anniversary"
+	EditionExpanded    = "expanded"
+	EditionSpecial     = "special"
+)
+
+// editionKeywords map qualifier text to an edition type. Qualifiers that match
+// none of them, such as "(Live)" or "(Disc 2)", are part of the album's identity.
+var editionKeywords = []struct {
+	pattern *regexp.Regexp
+	edition string
+}{
+	{regexp.MustCompile(`(?i)\bdeluxe\b`), EditionDeluxe},
+	{regexp.MustCompile(`(?i)\bre-?master(ed)?\b`), EditionRemaster},
+	{regexp.MustCompile(`(?i)\banniversary\b`), EditionAnniversary},
+	{regexp.MustCompile(`(?i)\b(expanded|bonus tracks?|extended edition)\b`), EditionExpanded},
+	{regexp.MustCompile(`(?i)\b(special|limited|collector'?s|legacy|platinum|tour) edition\b|\breissue\b`), EditionSpecial},
+	{regexp.MustCompile(`(?i)\b(edition|version)\b`), EditionSpecial},
+}
+
+// trailingQualifier matches a qualifier at the end of a name:
+// "(Deluxe Edition)", "[Remastered 2011]" or " - 2011 Remaster"
+var trailingQualifier = regexp.MustCompile(`\s*(\([^()]*\)|\[[^\[\]]*\]|\s-\s[^-()\[\]]+)\s*$`)
+
+// Edition is an album name split into the name of its release group and the edition
+type Edition struct {
+	Base       string // "Highway 101"
+	Normalized string // "highway101", the release group key
+	Type       string // EditionOriginal when the name carries no edition qualifier
+	Qualifier  string // "Deluxe Edition"
+}
+
+// DetectEdition strips edition qualifiers from the end of an album name
+func DetectEdition(name string) Edition {
+	base := strings.TrimSpace(name)
+	edition := Edition{Type: EditionOriginal}
+
+	for {
+		match := trailingQualifier.FindStringSubmatchIndex(base)
+		if match == nil || match[0] == 0 {
+			break
+		}
+
+		qualifier := strings.TrimSpace(base[match[2]:match[3]])
+		qualifier = strings.TrimSpace(strings.TrimPrefix(qualifier, "-"))
+		qualifier = strings.Trim(qualifier, "()[]")
+		editionType := editionTypeOf(qualifier)
+		if editionType == "" {
+			break
+		}
+
+		// The qualifier closest to the name wins: "X (Deluxe) [Remastered]" is a deluxe edition
+		edition.Type = editionType
+		edition.Qualifier = qualifier
+		base = strings.TrimSpace(base[:match[0]])
+	}
+
+	edition.Base = base
+	edition.Normalized = Normalize(base)
+	return edition
+}
+
+func editionTypeOf(qualifier string) string {
+	for _, keyword := range editionKeywords {
+		if keyword.pattern.MatchString(qualifier) {
+			return keyword.edition
+		}
+	}
+	return ""
+}
+
+// Normalize folds a name for matching: accents are removed, case is folded and
+// everything but letters and digits is dropped, so "Highway 101!" and
+// "highway-101" compare equal
+func Normalize(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// combining accent
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
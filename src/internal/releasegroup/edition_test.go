@@ -0,0 +1,44 @@
+package releasegroup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectEdition(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		edition   string
+		qualifier string
+	}{
+		{"Highway 101", "Highway 101", EditionOriginal, ""},
+		{"Highway 101 (Deluxe Edition)", "Highway 101", EditionDeluxe, "Deluxe Edition"},
+		{"Highway 101 [Remastered 2011]", "Highway 101", EditionRemaster, "Remastered 2011"},
+		{"Highway 101 - 2011 Remaster", "Highway 101", EditionRemaster, "2011 Remaster"},
+		{"Highway 101 (20th Anniversary Edition)", "Highway 101", EditionAnniversary, "20th Anniversary Edition"},
+		{"Highway 101 (Deluxe) [Remastered]", "Highway 101", EditionDeluxe, "Deluxe"},
+		{"Highway 101 (Expanded)", "Highway 101", EditionExpanded, "Expanded"},
+		{"Highway 101 (Collector's Edition)", "Highway 101", EditionSpecial, "Collector's Edition"},
+		// Qualifiers that are not editions are part of the album
+		{"Highway 101 (Live)", "Highway 101 (Live)", EditionOriginal, ""},
+		{"Greatest Hits - Volume 2", "Greatest Hits - Volume 2", EditionOriginal, ""},
+		{"(Deluxe)", "(Deluxe)", EditionOriginal, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edition := DetectEdition(tt.name)
+			assert.Equal(t, tt.base, edition.Base)
+			assert.Equal(t, tt.edition, edition.Type)
+			assert.Equal(t, tt.qualifier, edition.Qualifier)
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, "highway101", Normalize("Highway 101!"))
+	assert.Equal(t, Normalize("Café del Mar"), Normalize("cafe-del-mar"))
+	assert.Equal(t, DetectEdition("Highway 101").Normalized, DetectEdition("HIGHWAY 101 (Deluxe Edition)").Normalized)
+}
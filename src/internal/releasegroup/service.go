@@ -0,0 +1,327 @@
+package releasegroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+)
+
+// Service groups albums into release groups and deduplicates their tracks
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new release group service
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db}
+}
+
+// ConsolidatedAlbums is a scope that hides every edition of a release group
+// except the one the group is browsed as
+func ConsolidatedAlbums(db *gorm.DB) *gorm.DB {
+	return db.Where(`albums.release_group_id IS NULL OR EXISTS (
+		SELECT 1 FROM release_groups WHERE release_groups.id = albums.release_group_id AND release_groups.primary_album_id = albums.id)`)
+}
+
+// ConsolidateAll consolidates the albums of every artist
+func (s *Service) ConsolidateAll(ctx context.Context) error {
+	const batchSize = 500
+
+	var lastID int64
+	for {
+		var artistIDs []int64
+		if err := s.db.WithContext(ctx).Model(&models.Artist{}).
+			Where("id > ?", lastID).Order("id").Limit(batchSize).
+			Pluck("id", &artistIDs).Error; err != nil {
+			return fmt.Errorf("failed to load artists: %w", err)
+		}
+		if len(artistIDs) == 0 {
+			return nil
+		}
+
+		for _, artistID := range artistIDs {
+			if err := s.ConsolidateArtist(ctx, artistID); err != nil {
+				return err
+			}
+		}
+		lastID = artistIDs[len(artistIDs)-1]
+	}
+}
+
+// ConsolidateArtist groups an artist's albums whose names only differ by an
+// edition qualifier into release groups, and marks the tracks that repeat a
+// recording from another edition. Groups left with a single edition are removed.
+func (s *Service) ConsolidateArtist(ctx context.Context, artistID int64) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var albums []models.Album
+		if err := tx.Where("artist_id = ?", artistID).Order("id").Find(&albums).Error; err != nil {
+			return fmt.Errorf("failed to load albums for artist %d: %w", artistID, err)
+		}
+
+		editions := make(map[int64]Edition, len(albums))
+		groups := make(map[string][]*models.Album)
+		var keys []string
+		for i := range albums {
+			album := &albums[i]
+			edition := DetectEdition(album.Name)
+			editions[album.ID] = edition
+			if edition.Normalized == "" {
+				continue
+			}
+
+			if album.EditionType != edition.Type {
+				if err := tx.Model(&models.Album{}).Where("id = ?", album.ID).Update("edition_type", edition.Type).Error; err != nil {
+					return fmt.Errorf("failed to update edition of album %d: %w", album.ID, err)
+				}
+				album.EditionType = edition.Type
+			}
+
+			if _, ok := groups[edition.Normalized]; !ok {
+				keys = append(keys, edition.Normalized)
+			}
+			groups[edition.Normalized] = append(groups[edition.Normalized], album)
+		}
+
+		kept := make(map[int64]bool)
+		for _, key := range keys {
+			if len(groups[key]) < 2 {
+				continue
+			}
+			group, err := consolidate(tx, artistID, key, groups[key], editions)
+			if err != nil {
+				return err
+			}
+			kept[group.ID] = true
+		}
+
+		var existing []models.ReleaseGroup
+		if err := tx.Where("artist_id = ?", artistID).Find(&existing).Error; err != nil {
+			return fmt.Errorf("failed to load release groups for artist %d: %w", artistID, err)
+		}
+		for _, group := range existing {
+			if !kept[group.ID] {
+				if err := dissolve(tx, group.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// consolidate creates or updates the release group for a set of editions
+func consolidate(tx *gorm.DB, artistID int64, key string, albums []*models.Album, editions map[int64]Edition) (*models.ReleaseGroup, error) {
+	var group models.ReleaseGroup
+	err := tx.Where("artist_id = ? AND name_normalized = ?", artistID, key).First(&group).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to load release group %q: %w", key, err)
+	}
+
+	// An admin's choice of primary edition is kept while it is still part of the group
+	primary := choosePrimary(albums)
+	for _, album := range albums {
+		if group.PrimaryAlbumID != nil && album.ID == *group.PrimaryAlbumID {
+			primary = album
+		}
+	}
+	ordered := orderEditions(albums, primary)
+
+	group.ArtistID = artistID
+	group.NameNormalized = key
+	group.Name = editions[primary.ID].Base
+	group.PrimaryAlbumID = &primary.ID
+	group.ReleaseCount = int32(len(albums))
+	if group.MusicBrainzID == nil {
+		group.MusicBrainzID = primary.MusicBrainzID
+	}
+	if err := tx.Save(&group).Error; err != nil {
+		return nil, fmt.Errorf("failed to save release group %q: %w", key, err)
+	}
+
+	albumIDs := make([]int64, len(ordered))
+	rank := make(map[int64]int, len(ordered))
+	for i, album := range ordered {
+		albumIDs[i] = album.ID
+		rank[album.ID] = i
+	}
+
+	// Albums renamed out of the group become standalone again
+	detached := tx.Model(&models.Album{}).Select("id").Where("release_group_id = ? AND id NOT IN ?", group.ID, albumIDs)
+	if err := tx.Model(&models.Track{}).Where("album_id IN (?)", detached).Update("duplicate_of_id", nil).Error; err != nil {
+		return nil, fmt.Errorf("failed to clear duplicates of detached albums: %w", err)
+	}
+	if err := tx.Model(&models.Album{}).Where("release_group_id = ? AND id NOT IN ?", group.ID, albumIDs).
+		Update("release_group_id", nil).Error; err != nil {
+		return nil, fmt.Errorf("failed to detach albums from release group %d: %w", group.ID, err)
+	}
+	if err := tx.Model(&models.Album{}).Where("id IN ?", albumIDs).Update("release_group_id", group.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to attach albums to release group %d: %w", group.ID, err)
+	}
+
+	var tracks []models.Track
+	if err := tx.Where("album_id IN ?", albumIDs).Order("sort_order, id").Find(&tracks).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tracks of release group %d: %w", group.ID, err)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return rank[tracks[i].AlbumID] < rank[tracks[j].AlbumID]
+	})
+
+	duplicateOf := deduplicate(tracks)
+	var uniqueCount int32
+	var duration int64
+	for _, track := range tracks {
+		var want *int64
+		if originalID, ok := duplicateOf[track.ID]; ok {
+			want = &originalID
+		} else {
+			uniqueCount++
+			duration += track.Duration
+		}
+
+		if !sameID(track.DuplicateOfID, want) {
+			if err := tx.Model(&models.Track{}).Where("id = ?", track.ID).Update("duplicate_of_id", want).Error; err != nil {
+				return nil, fmt.Errorf("failed to update track %d: %w", track.ID, err)
+			}
+		}
+	}
+
+	if err := tx.Model(&group).Updates(map[string]interface{}{
+		"track_count_cached": uniqueCount,
+		"duration_cached":    duration,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to update release group %d: %w", group.ID, err)
+	}
+	group.TrackCountCached = uniqueCount
+	group.DurationCached = duration
+	return &group, nil
+}
+
+// dissolve removes a release group, leaving its albums as standalone albums
+func dissolve(tx *gorm.DB, groupID int64) error {
+	albums := tx.Model(&models.Album{}).Select("id").Where("release_group_id = ?", groupID)
+	if err := tx.Model(&models.Track{}).Where("album_id IN (?)", albums).Update("duplicate_of_id", nil).Error; err != nil {
+		return fmt.Errorf("failed to clear duplicates of release group %d: %w", groupID, err)
+	}
+	if err := tx.Model(&models.Album{}).Where("release_group_id = ?", groupID).Update("release_group_id", nil).Error; err != nil {
+		return fmt.Errorf("failed to detach albums from release group %d: %w", groupID, err)
+	}
+	if err := tx.Delete(&models.ReleaseGroup{}, groupID).Error; err != nil {
+		return fmt.Errorf("failed to delete release group %d: %w", groupID, err)
+	}
+	return nil
+}
+
+// choosePrimary picks the edition a group is browsed as: the original edition
+// when there is one, otherwise the earliest release
+func choosePrimary(albums []*models.Album) *models.Album {
+	var primary *models.Album
+	for _, album := range albums {
+		if primary == nil || editionBefore(album, primary) {
+			primary = album
+		}
+	}
+	return primary
+}
+
+func editionBefore(a, b *models.Album) bool {
+	aOriginal, bOriginal := a.EditionType == EditionOriginal, b.EditionType == EditionOriginal
+	if aOriginal != bOriginal {
+		return aOriginal
+	}
+
+	aDate, bDate := releaseDate(a), releaseDate(b)
+	switch {
+	case aDate != nil && bDate != nil && !aDate.Equal(*bDate):
+		return aDate.Before(*bDate)
+	case (aDate == nil) != (bDate == nil):
+		return aDate != nil
+	}
+	return a.ID < b.ID
+}
+
+func releaseDate(album *models.Album) *time.Time {
+	if album.OriginalReleaseDate != nil {
+		return album.OriginalReleaseDate
+	}
+	return album.ReleaseDate
+}
+
+// orderEditions puts the primary edition first and the rest in release order
+func orderEditions(albums []*models.Album, primary *models.Album) []*models.Album {
+	ordered := append([]*models.Album(nil), albums...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if (ordered[i] == primary) != (ordered[j] == primary) {
+			return ordered[i] == primary
+		}
+		return editionBefore(ordered[i], ordered[j])
+	})
+	return ordered
+}
+
+func sameID(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Editions returns a release group's albums, primary edition first
+func (s *Service) Editions(groupID int64) ([]models.Album, error) {
+	var group models.ReleaseGroup
+	if err := s.db.First(&group, groupID).Error; err != nil {
+		return nil, err
+	}
+
+	var albums []models.Album
+	if err := s.db.Preload("Artist").Where("release_group_id = ?", groupID).Order("id").Find(&albums).Error; err != nil {
+		return nil, fmt.Errorf("failed to load editions of release group %d: %w", groupID, err)
+	}
+
+	pointers := make([]*models.Album, len(albums))
+	var primary *models.Album
+	for i := range albums {
+		pointers[i] = &albums[i]
+		if group.PrimaryAlbumID != nil && albums[i].ID == *group.PrimaryAlbumID {
+			primary = &albums[i]
+		}
+	}
+
+	ordered := make([]models.Album, 0, len(albums))
+	for _, album := range orderEditions(pointers, primary) {
+		ordered = append(ordered, *album)
+	}
+	return ordered, nil
+}
+
+// UniqueTracks returns every unique track of a release group: the primary
+// edition's tracks followed by the tracks only found on other editions
+func (s *Service) UniqueTracks(groupID int64) ([]models.Track, error) {
+	editions, err := s.Editions(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	albumIDs := make([]int64, len(editions))
+	rank := make(map[int64]int, len(editions))
+	for i, album := range editions {
+		albumIDs[i] = album.ID
+		rank[album.ID] = i
+	}
+
+	var tracks []models.Track
+	if err := s.db.Preload("Album").Preload("Artist").
+		Where("album_id IN ? AND duplicate_of_id IS NULL", albumIDs).
+		Order("sort_order, id").Find(&tracks).Error; err != nil {
+		return nil, fmt.Errorf("failed to load tracks of release group %d: %w", groupID, err)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return rank[tracks[i].AlbumID] < rank[tracks[j].AlbumID]
+	})
+	return tracks, nil
+}
@@ -0,0 +1,175 @@
+package releasegroup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/fingerprint"
+	"melodee/internal/models"
+)
+
+func setupReleaseGroupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE release_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		artist_id INTEGER NOT NULL,
+		name TEXT,
+		name_normalized TEXT,
+		primary_album_id INTEGER,
+		music_brainz_id TEXT,
+		release_count INTEGER DEFAULT 0,
+		track_count_cached INTEGER DEFAULT 0,
+		duration_cached INTEGER DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE(artist_id, name_normalized)
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		artist_id INTEGER,
+		release_date DATETIME,
+		original_release_date DATETIME,
+		music_brainz_id TEXT,
+		release_group_id INTEGER,
+		edition_type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		duration INTEGER,
+		sort_order INTEGER DEFAULT 0,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER
+	)`).Error)
+
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Band')`)
+	return db
+}
+
+func insertAlbum(t *testing.T, db *gorm.DB, id int64, name, releaseDate string, tracks ...string) {
+	t.Helper()
+	require.NoError(t, db.Exec(`INSERT INTO albums (id, name, artist_id, release_date) VALUES (?, ?, 1, ?)`, id, name, releaseDate).Error)
+	for i, title := range tracks {
+		require.NoError(t, db.Exec(`INSERT INTO tracks (name, album_id, artist_id, duration, sort_order) VALUES (?, ?, 1, ?, ?)`,
+			title, id, 200000+i*1000, i+1).Error)
+	}
+}
+
+func trackNames(tracks []models.Track) []string {
+	names := make([]string, len(tracks))
+	for i, track := range tracks {
+		names[i] = track.Name
+	}
+	return names
+}
+
+func TestService_ConsolidateArtist(t *testing.T) {
+	db := setupReleaseGroupTestDB(t)
+	insertAlbum(t, db, 1, "Highway 101 (20th Anniversary)", "2000-01-01", "One", "Two", "Three", "Bonus", "Demo")
+	insertAlbum(t, db, 2, "Highway 101", "1980-01-01", "One", "Two", "Three")
+	insertAlbum(t, db, 3, "Highway 101 (Deluxe Edition)", "1980-01-01", "One", "Two (Remastered)", "Three", "Bonus")
+	insertAlbum(t, db, 4, "Something Else", "1985-01-01", "One")
+
+	service := NewService(db)
+	require.NoError(t, service.ConsolidateArtist(context.Background(), 1))
+
+	var group models.ReleaseGroup
+	require.NoError(t, db.First(&group).Error)
+	assert.Equal(t, "Highway 101", group.Name)
+	assert.Equal(t, int64(2), *group.PrimaryAlbumID, "the original edition is the primary")
+	assert.Equal(t, int32(3), group.ReleaseCount)
+	assert.Equal(t, int32(5), group.TrackCountCached)
+
+	var standalone models.Album
+	require.NoError(t, db.First(&standalone, 4).Error)
+	assert.Nil(t, standalone.ReleaseGroupID)
+
+	var deluxe models.Album
+	require.NoError(t, db.First(&deluxe, 3).Error)
+	assert.Equal(t, EditionDeluxe, deluxe.EditionType)
+
+	editions, err := service.Editions(group.ID)
+	require.NoError(t, err)
+	require.Len(t, editions, 3)
+	assert.Equal(t, []int64{2, 3, 1}, []int64{editions[0].ID, editions[1].ID, editions[2].ID})
+
+	tracks, err := service.UniqueTracks(group.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"One", "Two", "Three", "Bonus", "Demo"}, trackNames(tracks))
+	assert.Equal(t, int64(2), tracks[0].AlbumID)
+	assert.Equal(t, int64(3), tracks[3].AlbumID, "bonus tracks come from the first edition that has them")
+
+	// Editions stay addressable: every track still belongs to its own album
+	var count int64
+	db.Model(&models.Track{}).Where("album_id = ?", 1).Count(&count)
+	assert.Equal(t, int64(5), count)
+
+	var browsed []models.Album
+	require.NoError(t, db.Scopes(ConsolidatedAlbums).Order("id").Find(&browsed).Error)
+	assert.Equal(t, []int64{2, 4}, []int64{browsed[0].ID, browsed[1].ID})
+}
+
+func TestService_ConsolidateArtistDissolvesGroups(t *testing.T) {
+	db := setupReleaseGroupTestDB(t)
+	insertAlbum(t, db, 1, "Highway 101", "1980-01-01", "One")
+	insertAlbum(t, db, 2, "Highway 101 (Deluxe Edition)", "1980-01-01", "One", "Bonus")
+
+	service := NewService(db)
+	require.NoError(t, service.ConsolidateArtist(context.Background(), 1))
+
+	var duplicate models.Track
+	require.NoError(t, db.Where("album_id = ? AND name = ?", 2, "One").First(&duplicate).Error)
+	require.NotNil(t, duplicate.DuplicateOfID)
+
+	// Renaming the deluxe edition into a different album dissolves the group
+	require.NoError(t, db.Exec(`UPDATE albums SET name = 'Other Album' WHERE id = 2`).Error)
+	require.NoError(t, service.ConsolidateArtist(context.Background(), 1))
+
+	var groups int64
+	db.Model(&models.ReleaseGroup{}).Count(&groups)
+	assert.Zero(t, groups)
+	require.NoError(t, db.First(&duplicate, duplicate.ID).Error)
+	assert.Nil(t, duplicate.DuplicateOfID)
+}
+
+func TestSameRecording(t *testing.T) {
+	raw := make([]uint32, 200)
+	for i := range raw {
+		raw[i] = uint32(i) * 2654435761
+	}
+	other := make([]uint32, 200)
+	for i := range other {
+		other[i] = ^raw[i]
+	}
+
+	a := &models.Track{Name: "Intro", Duration: 60000, Fingerprint: fingerprint.Encode(raw)}
+	b := &models.Track{Name: "Intro (2011 Remaster)", Duration: 61000, Fingerprint: fingerprint.Encode(raw)}
+	assert.True(t, SameRecording(a, b))
+
+	// The fingerprint wins over matching titles
+	b.Fingerprint = fingerprint.Encode(other)
+	assert.False(t, SameRecording(a, b))
+
+	// Without fingerprints the titles decide
+	a.Fingerprint, b.Fingerprint = "", ""
+	assert.True(t, SameRecording(a, b))
+
+	// A different length is a different recording, such as a live take
+	b.Duration = 90000
+	assert.False(t, SameRecording(a, b))
+}
@@ -0,0 +1,71 @@
+package releasegroup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypeReleaseGroupConsolidate = "releasegroup:consolidate"
+)
+
+// ConsolidatePayload represents the payload for release group consolidation jobs
+type ConsolidatePayload struct {
+	ArtistID int64 `json:"artist_id"` // 0 consolidates every artist
+}
+
+// EnqueueConsolidate creates and enqueues a consolidation job for an artist,
+// or for every artist when artistID is 0
+func EnqueueConsolidate(client *asynq.Client, artistID int64) error {
+	payload, err := json.Marshal(ConsolidatePayload{ArtistID: artistID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal release group payload: %w", err)
+	}
+
+	task := asynq.NewTask(TypeReleaseGroupConsolidate, payload)
+
+	// Use deduplication key so repeated requests for an artist collapse into one
+	dedupKey := fmt.Sprintf("releasegroup.consolidate:%d", artistID)
+
+	timeout := 2 * time.Minute
+	if artistID == 0 {
+		timeout = 2 * time.Hour
+	}
+
+	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Queue("maintenance"), asynq.Timeout(timeout))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue release group consolidation: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs release group jobs
+type TaskHandler struct {
+	service *Service
+}
+
+// NewTaskHandler creates a new release group task handler
+func NewTaskHandler(service *Service) *TaskHandler {
+	return &TaskHandler{service: service}
+}
+
+// HandleConsolidate consolidates one artist's editions, or every artist's
+func (h *TaskHandler) HandleConsolidate(ctx context.Context, t *asynq.Task) error {
+	var p ConsolidatePayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal release group payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	if p.ArtistID == 0 {
+		logging.Info("releasegroup: consolidating all artists")
+		return h.service.ConsolidateAll(ctx)
+	}
+	return h.service.ConsolidateArtist(ctx, p.ArtistID)
+}
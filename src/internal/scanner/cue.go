@@ -0,0 +1,385 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// MetadataSourceCue marks tracks whose descriptive fields came from a cue sheet
+const MetadataSourceCue = "cue"
+
+// DefaultCueEncoding decodes cue sheets that are neither UTF-8 nor UTF-16.
+// Most are written by Windows rippers in the system code page.
+const DefaultCueEncoding = "windows-1252"
+
+// cueFramesPerSecond is the resolution of cue sheet timestamps (mm:ss:ff)
+const cueFramesPerSecond = 75
+
+// CueSheet is a parsed cue sheet: one or more audio files and the tracks they hold
+type CueSheet struct {
+	Performer  string
+	Title      string
+	Songwriter string
+	Genre      string // REM GENRE
+	Date       string // REM DATE, usually just the year
+	DiscID     string // REM DISCID
+	Comment    string // REM COMMENT
+	DiscNumber int    // REM DISCNUMBER
+	DiscTotal  int    // REM TOTALDISCS
+	Files      []string
+	Tracks     []CueTrack
+}
+
+// CueTrack is one track of a cue sheet. It runs from Start to End in File, or
+// to the end of File when End is zero. The gap before the next track, between
+// its INDEX 00 and INDEX 01, is played at the end of this one.
+type CueTrack struct {
+	Number     int
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	File       string        // FILE entry holding INDEX 01
+	Pregap     time.Duration // INDEX 00 to INDEX 01, or PREGAP silence
+	Start      time.Duration // INDEX 01
+	End        time.Duration
+}
+
+// Year returns the year the sheet's date starts with, or 0
+func (c *CueSheet) Year() int {
+	if len(c.Date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(c.Date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+// TracksOf returns the tracks that start in a file of the sheet
+func (c *CueSheet) TracksOf(file string) []CueTrack {
+	var tracks []CueTrack
+	for _, track := range c.Tracks {
+		if track.File == file {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// CueEncoding returns the encoding with the given name, e.g. "windows-1252"
+// or "shift_jis", or DefaultCueEncoding when name is empty
+func CueEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return charmap.Windows1252, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown cue sheet encoding %q", name)
+	}
+	return enc, nil
+}
+
+// ReadCueSheet reads and parses a cue sheet file, see ParseCueSheet
+func ReadCueSheet(path string, fallback encoding.Encoding) (*CueSheet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sheet, err := ParseCueSheet(data, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return sheet, nil
+}
+
+// ParseCueSheet parses a cue sheet. Sheets with a UTF-8 or UTF-16 byte order
+// mark, and sheets that are valid UTF-8, are read as such; anything else is
+// decoded with fallback, or Windows-1252 when fallback is nil.
+func ParseCueSheet(data []byte, fallback encoding.Encoding) (*CueSheet, error) {
+	text, err := decodeCueSheet(data, fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := &CueSheet{}
+	var track *CueTrack
+	var file string
+	var index00 time.Duration
+	var index00File string
+	var dataTrack bool // fields of data tracks are skipped
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := cueFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		command, args := strings.ToUpper(fields[0]), fields[1:]
+		arg := strings.Join(args, " ")
+
+		switch command {
+		case "REM":
+			if len(args) < 2 {
+				continue
+			}
+			value := strings.Join(args[1:], " ")
+			switch strings.ToUpper(args[0]) {
+			case "GENRE":
+				sheet.Genre = value
+			case "DATE":
+				sheet.Date = value
+			case "DISCID":
+				sheet.DiscID = value
+			case "COMMENT":
+				sheet.Comment = value
+			case "DISCNUMBER":
+				sheet.DiscNumber, _ = strconv.Atoi(value)
+			case "TOTALDISCS":
+				sheet.DiscTotal, _ = strconv.Atoi(value)
+			}
+		case "PERFORMER", "TITLE", "SONGWRITER":
+			if !dataTrack {
+				setCueField(sheet, track, command, arg)
+			}
+		case "ISRC":
+			if track != nil {
+				track.ISRC = arg
+			}
+		case "FILE":
+			if len(args) < 1 {
+				return nil, fmt.Errorf("line %d: FILE without a file name", lineNumber)
+			}
+			// The last argument is the file type, unless the name is all there is
+			file = args[0]
+			if len(args) > 1 {
+				file = strings.Join(args[:len(args)-1], " ")
+			}
+			sheet.Files = append(sheet.Files, file)
+		case "TRACK":
+			if len(args) < 1 {
+				return nil, fmt.Errorf("line %d: TRACK without a number", lineNumber)
+			}
+			if track != nil && track.File == "" {
+				return nil, fmt.Errorf("line %d: track %d has no INDEX 01", lineNumber, track.Number)
+			}
+			number, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid track number %q", lineNumber, args[0])
+			}
+			// Data tracks of enhanced CDs are not audio and have no place in a library
+			dataTrack = len(args) > 1 && !strings.EqualFold(args[1], "AUDIO")
+			if dataTrack {
+				track = nil
+				continue
+			}
+			sheet.Tracks = append(sheet.Tracks, CueTrack{Number: number})
+			track = &sheet.Tracks[len(sheet.Tracks)-1]
+			index00File = ""
+		case "PREGAP":
+			if track != nil {
+				gap, err := parseCueTime(arg)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+				}
+				track.Pregap = gap
+			}
+		case "INDEX":
+			if track == nil || len(args) < 2 {
+				continue
+			}
+			number, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid index number %q", lineNumber, args[0])
+			}
+			offset, err := parseCueTime(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			switch number {
+			case 0:
+				index00, index00File = offset, file
+			case 1:
+				if file == "" {
+					return nil, fmt.Errorf("line %d: track %d starts before any FILE", lineNumber, track.Number)
+				}
+				track.File, track.Start = file, offset
+				// A pregap that starts in the previous file is played with that file's last track
+				if index00File == file {
+					track.Pregap = offset - index00
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if track != nil && track.File == "" {
+		return nil, fmt.Errorf("track %d has no INDEX 01", track.Number)
+	}
+	if len(sheet.Tracks) == 0 {
+		return nil, fmt.Errorf("cue sheet has no audio tracks")
+	}
+
+	for i := range sheet.Tracks {
+		if i+1 < len(sheet.Tracks) && sheet.Tracks[i+1].File == sheet.Tracks[i].File {
+			sheet.Tracks[i].End = sheet.Tracks[i+1].Start
+			if sheet.Tracks[i].End <= sheet.Tracks[i].Start {
+				return nil, fmt.Errorf("track %d starts before track %d", sheet.Tracks[i+1].Number, sheet.Tracks[i].Number)
+			}
+		}
+	}
+	return sheet, nil
+}
+
+// setCueField sets a PERFORMER, TITLE or SONGWRITER of the current track, or
+// of the sheet before the first track
+func setCueField(sheet *CueSheet, track *CueTrack, command, value string) {
+	if track != nil {
+		switch command {
+		case "PERFORMER":
+			track.Performer = value
+		case "TITLE":
+			track.Title = value
+		case "SONGWRITER":
+			track.Songwriter = value
+		}
+		return
+	}
+	switch command {
+	case "PERFORMER":
+		sheet.Performer = value
+	case "TITLE":
+		sheet.Title = value
+	case "SONGWRITER":
+		sheet.Songwriter = value
+	}
+}
+
+// decodeCueSheet returns the text of a cue sheet without any byte order mark
+func decodeCueSheet(data []byte, fallback encoding.Encoding) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:]), nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}), bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		decoded, err := unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder().Bytes(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid UTF-16 cue sheet: %w", err)
+		}
+		return string(decoded), nil
+	case utf8.Valid(data):
+		return string(data), nil
+	}
+
+	if fallback == nil {
+		fallback = charmap.Windows1252
+	}
+	decoded, err := fallback.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode cue sheet: %w", err)
+	}
+	return string(decoded), nil
+}
+
+// cueFields splits a cue sheet line into its command and arguments. Quoted
+// arguments may contain spaces; the quotes are removed.
+func cueFields(line string) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				// Unterminated quote: the rest of the line is the argument
+				fields = append(fields, line[1:])
+				break
+			}
+			fields = append(fields, line[1:end+1])
+			line = strings.TrimSpace(line[end+2:])
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			fields = append(fields, line)
+			break
+		}
+		fields = append(fields, line[:end])
+		line = strings.TrimSpace(line[end:])
+	}
+	return fields
+}
+
+// parseCueTime parses a cue sheet timestamp, mm:ss:ff with 75 frames a second
+func parseCueTime(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid cue time %q", value)
+	}
+	var n [3]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid cue time %q", value)
+		}
+		n[i] = v
+	}
+	if n[1] >= 60 || n[2] >= cueFramesPerSecond {
+		return 0, fmt.Errorf("invalid cue time %q", value)
+	}
+	frames := (n[0]*60+n[1])*cueFramesPerSecond + n[2]
+	return time.Duration(frames) * time.Second / cueFramesPerSecond, nil
+}
+
+// ResolveCueFile finds the audio file a FILE entry of a sheet in dir refers
+// to. Rippers often write the name with another case, and re-encoding a rip
+// changes the extension without updating the sheet, so both are tolerated.
+// It returns "" when there is no such file.
+func ResolveCueFile(dir, name string) string {
+	name = filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if filepath.IsAbs(name) || (len(name) > 1 && name[1] == ':') {
+		// Absolute paths are from the ripping machine; look next to the sheet
+		name = filepath.Base(name)
+	}
+	candidate := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, candidate); err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+		return candidate
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(candidate))
+	if err != nil {
+		return ""
+	}
+	base := filepath.Base(candidate)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	var sameStem string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		entryName := entry.Name()
+		if strings.EqualFold(entryName, base) {
+			return filepath.Join(filepath.Dir(candidate), entryName)
+		}
+		entryStem := strings.TrimSuffix(entryName, filepath.Ext(entryName))
+		if sameStem == "" && strings.EqualFold(entryStem, stem) && isMediaFile(entryName) {
+			sameStem = filepath.Join(filepath.Dir(candidate), entryName)
+		}
+	}
+	return sameStem
+}
@@ -0,0 +1,284 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const testCueSheet = `REM GENRE "Progressive Rock"
+REM DATE 1973
+REM DISCID 8F0A3B0C
+REM COMMENT "ExactAudioCopy v1.6"
+PERFORMER "The Band"
+TITLE "The Record"
+FILE "The Band - The Record.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Opening"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Middle"
+    PERFORMER "The Band feat. Guest"
+    ISRC GBAYE7300001
+    INDEX 00 00:02:50
+    INDEX 01 00:03:00
+  TRACK 03 MODE1/2352
+    TITLE "Enhanced CD data"
+    INDEX 01 00:05:00
+  TRACK 04 AUDIO
+    TITLE "Closing"
+    INDEX 01 00:06:37
+`
+
+func TestParseCueSheet(t *testing.T) {
+	sheet, err := ParseCueSheet([]byte(testCueSheet), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "The Band", sheet.Performer)
+	assert.Equal(t, "The Record", sheet.Title)
+	assert.Equal(t, "Progressive Rock", sheet.Genre)
+	assert.Equal(t, 1973, sheet.Year())
+	assert.Equal(t, "8F0A3B0C", sheet.DiscID)
+	assert.Equal(t, "ExactAudioCopy v1.6", sheet.Comment)
+	assert.Equal(t, []string{"The Band - The Record.flac"}, sheet.Files)
+
+	require.Len(t, sheet.Tracks, 3, "the data track is skipped")
+	first, second, last := sheet.Tracks[0], sheet.Tracks[1], sheet.Tracks[2]
+
+	assert.Equal(t, 1, first.Number)
+	assert.Equal(t, "Opening", first.Title)
+	assert.Equal(t, time.Duration(0), first.Start)
+	assert.Equal(t, 3*time.Second, first.End, "the pregap of the next track is played at the end")
+
+	assert.Equal(t, 2, second.Number)
+	assert.Equal(t, "The Band feat. Guest", second.Performer)
+	assert.Equal(t, "GBAYE7300001", second.ISRC)
+	assert.Equal(t, 3*time.Second, second.Start)
+	assert.Equal(t, int64(333), second.Pregap.Milliseconds(), "INDEX 00 is 25 frames before INDEX 01")
+	assert.Equal(t, 6*time.Second+37*time.Second/75, second.End)
+
+	assert.Equal(t, 4, last.Number)
+	assert.Equal(t, "Closing", last.Title)
+	assert.Equal(t, time.Duration(0), last.End, "the last track runs to the end of the file")
+}
+
+func TestParseCueSheet_MultipleFiles(t *testing.T) {
+	// A gap-preserving rip: track 2's pregap is at the end of the first file
+	sheet, err := ParseCueSheet([]byte(`PERFORMER Band
+TITLE Record
+FILE "01 - One.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE One
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE Two
+    INDEX 00 04:10:20
+FILE "02 - Two.wav" WAVE
+    INDEX 01 00:00:00
+  TRACK 03 AUDIO
+    TITLE Three
+    INDEX 01 03:00:00
+`), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"01 - One.wav", "02 - Two.wav"}, sheet.Files)
+	require.Len(t, sheet.Tracks, 3)
+
+	one := sheet.TracksOf("01 - One.wav")
+	require.Len(t, one, 1)
+	assert.Equal(t, "One", one[0].Title)
+	assert.Equal(t, time.Duration(0), one[0].End, "a file's last track runs to its end, gap included")
+
+	two := sheet.TracksOf("02 - Two.wav")
+	require.Len(t, two, 2)
+	assert.Equal(t, "Two", two[0].Title)
+	assert.Equal(t, time.Duration(0), two[0].Start)
+	assert.Equal(t, time.Duration(0), two[0].Pregap, "the gap is played from the previous file")
+	assert.Equal(t, 3*time.Minute, two[0].End)
+	assert.Equal(t, 3*time.Minute, two[1].Start)
+}
+
+func TestParseCueSheet_Encodings(t *testing.T) {
+	sheet := "PERFORMER \"Björk\"\r\nTITLE \"Début\"\r\nFILE \"a.flac\" WAVE\r\n  TRACK 01 AUDIO\r\n    INDEX 01 00:00:00\r\n"
+
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes([]byte(sheet))
+	require.NoError(t, err)
+
+	windows1252 := []byte("PERFORMER \"Bj\xf6rk\"\r\nTITLE \"D\xe9but\"\r\nFILE \"a.flac\" WAVE\r\n  TRACK 01 AUDIO\r\n    INDEX 01 00:00:00\r\n")
+
+	for name, data := range map[string][]byte{
+		"utf-8":        []byte(sheet),
+		"utf-8 bom":    append([]byte{0xEF, 0xBB, 0xBF}, sheet...),
+		"utf-16 bom":   utf16,
+		"windows-1252": windows1252,
+	} {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := ParseCueSheet(data, nil)
+			require.NoError(t, err)
+			assert.Equal(t, "Björk", parsed.Performer)
+			assert.Equal(t, "Début", parsed.Title)
+		})
+	}
+
+	t.Run("configured fallback", func(t *testing.T) {
+		data, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("PERFORMER \"椎名林檎\"\nTITLE \"無罪モラトリアム\"\nFILE \"a.flac\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:00\n"))
+		require.NoError(t, err)
+
+		enc, err := CueEncoding("shift_jis")
+		require.NoError(t, err)
+		parsed, err := ParseCueSheet(data, enc)
+		require.NoError(t, err)
+		assert.Equal(t, "椎名林檎", parsed.Performer)
+		assert.Equal(t, "無罪モラトリアム", parsed.Title)
+	})
+
+	_, err = CueEncoding("klingon")
+	assert.Error(t, err)
+}
+
+func TestParseCueSheet_Invalid(t *testing.T) {
+	for name, sheet := range map[string]string{
+		"no tracks":      "FILE \"a.flac\" WAVE\n",
+		"no index 01":    "FILE \"a.flac\" WAVE\n  TRACK 01 AUDIO\n    INDEX 00 00:00:00\n",
+		"bad timestamp":  "FILE \"a.flac\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 00:00:75\n",
+		"no file":        "TRACK 01 AUDIO\n  INDEX 01 00:00:00\n",
+		"tracks reverse": "FILE \"a.flac\" WAVE\n  TRACK 01 AUDIO\n    INDEX 01 01:00:00\n  TRACK 02 AUDIO\n    INDEX 01 00:30:00\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseCueSheet([]byte(sheet), nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestResolveCueFile(t *testing.T) {
+	dir := t.TempDir()
+	image := writeTestFile(t, filepath.Join(dir, "CDImage.flac"), buildFLAC())
+
+	assert.Equal(t, image, ResolveCueFile(dir, "CDImage.flac"))
+	assert.Equal(t, image, ResolveCueFile(dir, "cdimage.FLAC"), "case differs")
+	assert.Equal(t, image, ResolveCueFile(dir, "CDImage.wav"), "re-encoded from WAV")
+	assert.Equal(t, image, ResolveCueFile(dir, `C:\Rips\CDImage.flac`), "absolute path from the ripping machine")
+	assert.Empty(t, ResolveCueFile(dir, "Other.flac"))
+	assert.Empty(t, ResolveCueFile(filepath.Join(dir, "sub"), "../CDImage.flac"), "outside the sheet's directory")
+}
+
+// scanCueAlbum scans root with a full scan and returns the files of its only album
+func scanCueAlbum(t *testing.T, scanDB *ScanDB, root string) []*ScannedFile {
+	t.Helper()
+
+	require.NoError(t, NewFileScanner(scanDB, 2).ScanDirectory(root))
+	require.NoError(t, scanDB.ComputeAlbumGrouping())
+	groups, err := scanDB.GetAlbumGroups()
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+
+	files, err := scanDB.GetFilesByAlbumGroup(groups[0].AlbumGroupID)
+	require.NoError(t, err)
+	return files
+}
+
+func TestScanDirectory_CueSheet(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "The Band - The Record")
+	image := writeTestFile(t, filepath.Join(album, "The Band - The Record.flac"), buildFLAC("GENRE=Rock", "DATE=1973"))
+	writeTestFile(t, filepath.Join(album, "The Band - The Record.cue"), []byte(testCueSheet))
+
+	scanDB, err := NewScanDB(t.TempDir())
+	require.NoError(t, err)
+	defer scanDB.Close()
+
+	files := scanCueAlbum(t, scanDB, root)
+	require.Len(t, files, 3, "the image is split into its tracks instead of scanned whole")
+
+	info, err := os.Stat(image)
+	require.NoError(t, err)
+	var totalSize int64
+	for _, f := range files {
+		assert.Equal(t, image, f.FilePath)
+		assert.Equal(t, filepath.Join(album, "The Band - The Record.cue"), f.CuePath)
+		assert.Equal(t, MetadataSourceCue, f.MetadataSource)
+		assert.Equal(t, "The Band", f.AlbumArtist)
+		assert.Equal(t, "The Record", f.Album)
+		assert.Equal(t, "Progressive Rock", f.Genre, "the sheet wins over the tags")
+		assert.Equal(t, 1973, f.Year)
+		assert.Equal(t, 3, f.TrackTotal)
+		assert.True(t, f.IsValid)
+		totalSize += f.FileSize
+	}
+	assert.InDelta(t, info.Size(), totalSize, 3, "the image's size is shared out by duration")
+
+	assert.Equal(t, "Opening", files[0].Title)
+	assert.Equal(t, "The Band", files[0].Artist)
+	assert.Equal(t, int64(0), files[0].StartOffset)
+	assert.Equal(t, int64(3000), files[0].EndOffset)
+	assert.Equal(t, 3000, files[0].Duration)
+
+	assert.Equal(t, "Middle", files[1].Title)
+	assert.Equal(t, "The Band feat. Guest", files[1].Artist)
+
+	assert.Equal(t, 4, files[2].TrackNumber)
+	assert.Equal(t, int64(6493), files[2].StartOffset)
+	assert.Equal(t, int64(0), files[2].EndOffset)
+	assert.Equal(t, 10000-6493, files[2].Duration, "the last track runs to the end of the 10 second image")
+
+	stats, err := scanDB.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.TaggedFiles)
+}
+
+func TestScanDirectory_CueSheetIncremental(t *testing.T) {
+	root := t.TempDir()
+	indexDir := t.TempDir()
+	album := filepath.Join(root, "The Band - The Record")
+	writeTestFile(t, filepath.Join(album, "The Band - The Record.flac"), buildFLAC())
+	writeTestFile(t, filepath.Join(album, "The Band - The Record.cue"), []byte(testCueSheet))
+	// The same sheet saved twice must not split the image twice
+	writeTestFile(t, filepath.Join(album, "The Band - The Record (UTF-8).cue"), []byte(testCueSheet))
+
+	stats := runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 3, stats.TotalFiles)
+	assert.Equal(t, 3, stats.NewFiles)
+
+	stats = runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 3, stats.UnchangedFiles)
+	assert.Equal(t, 0, stats.RemovedFiles)
+}
+
+func TestScanDirectory_CueSheetMissingAudio(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "Band - Record")
+	cuePath := writeTestFile(t, filepath.Join(album, "Record.cue"), []byte(`PERFORMER Band
+TITLE Record
+FILE "CD1.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+FILE "CD2.flac" WAVE
+  TRACK 02 AUDIO
+    INDEX 01 00:00:00
+`))
+	present := writeTestFile(t, filepath.Join(album, "CD1.flac"), buildFLAC("ARTIST=Band", "ALBUM=Record", "TITLE=Whole"))
+
+	scanDB, err := NewScanDB(t.TempDir())
+	require.NoError(t, err)
+	defer scanDB.Close()
+
+	require.NoError(t, NewFileScanner(scanDB, 2).ScanDirectory(root))
+
+	stats, err := scanDB.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.TotalFiles, "audio of an incomplete sheet is not scanned on its own")
+
+	incomplete, err := scanDB.GetIncompleteCueSheets()
+	require.NoError(t, err)
+	require.Len(t, incomplete, 1)
+	assert.Equal(t, cuePath, incomplete[0].CuePath)
+	assert.Equal(t, []string{"CD2.flac"}, incomplete[0].MissingFiles)
+	assert.Equal(t, []string{present}, incomplete[0].AudioFiles)
+}
@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -84,18 +85,24 @@ func (s *ScanDB) InsertFile(file *ScannedFile) error {
 	query := `
 		INSERT INTO scanned_files (
 			file_path, file_size, file_hash, modified_time,
-			artist, album_artist, album, title, track_number, disc_number, year, genre,
-			duration, bitrate, sample_rate,
-			is_valid, validation_error
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			artist, album_artist, album, title, track_number, track_total, disc_number, disc_total, year, genre,
+			duration, bitrate, sample_rate, channels, bit_depth,
+			musicbrainz_track_id, musicbrainz_album_id, musicbrainz_artist_id,
+			musicbrainz_album_artist_id, musicbrainz_release_group_id, metadata_source,
+			cue_path, start_offset, end_offset,
+			is_valid, validation_error, change_type, previous_path
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
 	_, err := s.db.Exec(query,
 		file.FilePath, file.FileSize, file.FileHash, file.ModifiedTime,
 		file.Artist, file.AlbumArtist, file.Album, file.Title,
-		file.TrackNumber, file.DiscNumber, file.Year, file.Genre,
-		file.Duration, file.Bitrate, file.SampleRate,
-		file.IsValid, file.ValidationError,
+		file.TrackNumber, file.TrackTotal, file.DiscNumber, file.DiscTotal, file.Year, file.Genre,
+		file.Duration, file.Bitrate, file.SampleRate, file.Channels, file.BitDepth,
+		file.MusicBrainzTrackID, file.MusicBrainzAlbumID, file.MusicBrainzArtistID,
+		file.MusicBrainzAlbumArtistID, file.MusicBrainzReleaseGroupID, file.MetadataSource,
+		file.CuePath, file.StartOffset, file.EndOffset,
+		file.IsValid, file.ValidationError, file.ChangeType, file.PreviousPath,
 	)
 	
 	return err
@@ -116,10 +123,13 @@ func (s *ScanDB) InsertBatch(files []*ScannedFile) error {
 	stmt, err := tx.Prepare(`
 		INSERT INTO scanned_files (
 			file_path, file_size, file_hash, modified_time,
-			artist, album_artist, album, title, track_number, disc_number, year, genre,
-			duration, bitrate, sample_rate,
-			is_valid, validation_error
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			artist, album_artist, album, title, track_number, track_total, disc_number, disc_total, year, genre,
+			duration, bitrate, sample_rate, channels, bit_depth,
+			musicbrainz_track_id, musicbrainz_album_id, musicbrainz_artist_id,
+			musicbrainz_album_artist_id, musicbrainz_release_group_id, metadata_source,
+			cue_path, start_offset, end_offset,
+			is_valid, validation_error, change_type, previous_path
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
@@ -130,9 +140,12 @@ func (s *ScanDB) InsertBatch(files []*ScannedFile) error {
 		_, err := stmt.Exec(
 			file.FilePath, file.FileSize, file.FileHash, file.ModifiedTime,
 			file.Artist, file.AlbumArtist, file.Album, file.Title,
-			file.TrackNumber, file.DiscNumber, file.Year, file.Genre,
-			file.Duration, file.Bitrate, file.SampleRate,
-			file.IsValid, file.ValidationError,
+			file.TrackNumber, file.TrackTotal, file.DiscNumber, file.DiscTotal, file.Year, file.Genre,
+			file.Duration, file.Bitrate, file.SampleRate, file.Channels, file.BitDepth,
+			file.MusicBrainzTrackID, file.MusicBrainzAlbumID, file.MusicBrainzArtistID,
+			file.MusicBrainzAlbumArtistID, file.MusicBrainzReleaseGroupID, file.MetadataSource,
+			file.CuePath, file.StartOffset, file.EndOffset,
+			file.IsValid, file.ValidationError, file.ChangeType, file.PreviousPath,
 		)
 		if err != nil {
 			return err
@@ -307,13 +320,16 @@ func (s *ScanDB) GetFilesByAlbumGroup(groupID string) ([]*ScannedFile, error) {
 	query := `
 		SELECT 
 			id, file_path, file_size, file_hash, modified_time,
-			artist, album_artist, album, title, track_number, disc_number, year, genre,
-			duration, bitrate, sample_rate,
-			is_valid, validation_error,
+			artist, album_artist, album, title, track_number, track_total, disc_number, disc_total, year, genre,
+			duration, bitrate, sample_rate, channels, bit_depth,
+			musicbrainz_track_id, musicbrainz_album_id, musicbrainz_artist_id,
+			musicbrainz_album_artist_id, musicbrainz_release_group_id, metadata_source,
+			cue_path, start_offset, end_offset,
+			is_valid, validation_error, change_type, previous_path,
 			album_group_hash, album_group_id, created_at
 		FROM scanned_files
 		WHERE album_group_id = ?
-		ORDER BY disc_number, track_number
+		ORDER BY disc_number, track_number, file_path, start_offset
 	`
 	
 	rows, err := s.db.Query(query, groupID)
@@ -328,9 +344,12 @@ func (s *ScanDB) GetFilesByAlbumGroup(groupID string) ([]*ScannedFile, error) {
 		err := rows.Scan(
 			&file.ID, &file.FilePath, &file.FileSize, &file.FileHash, &file.ModifiedTime,
 			&file.Artist, &file.AlbumArtist, &file.Album, &file.Title,
-			&file.TrackNumber, &file.DiscNumber, &file.Year, &file.Genre,
-			&file.Duration, &file.Bitrate, &file.SampleRate,
-			&file.IsValid, &file.ValidationError,
+			&file.TrackNumber, &file.TrackTotal, &file.DiscNumber, &file.DiscTotal, &file.Year, &file.Genre,
+			&file.Duration, &file.Bitrate, &file.SampleRate, &file.Channels, &file.BitDepth,
+			&file.MusicBrainzTrackID, &file.MusicBrainzAlbumID, &file.MusicBrainzArtistID,
+			&file.MusicBrainzAlbumArtistID, &file.MusicBrainzReleaseGroupID, &file.MetadataSource,
+			&file.CuePath, &file.StartOffset, &file.EndOffset,
+			&file.IsValid, &file.ValidationError, &file.ChangeType, &file.PreviousPath,
 			&file.AlbumGroupHash, &file.AlbumGroupID, &file.CreatedAt,
 		)
 		if err != nil {
@@ -353,19 +372,178 @@ func (s *ScanDB) GetStats() (*ScanStats, error) {
 	err := s.db.QueryRow(`
 		SELECT 
 			COUNT(*) as total,
-			SUM(CASE WHEN is_valid = 1 THEN 1 ELSE 0 END) as valid,
-			SUM(CASE WHEN is_valid = 0 THEN 1 ELSE 0 END) as invalid,
-			COUNT(DISTINCT album_group_id) as albums
+			COALESCE(SUM(CASE WHEN is_valid = 1 THEN 1 ELSE 0 END), 0) as valid,
+			COALESCE(SUM(CASE WHEN is_valid = 0 THEN 1 ELSE 0 END), 0) as invalid,
+			COUNT(DISTINCT album_group_id) as albums,
+			COALESCE(SUM(CASE WHEN metadata_source IN ('tags', 'cue') THEN 1 ELSE 0 END), 0) as tagged,
+			COALESCE(SUM(CASE WHEN metadata_source NOT IN ('tags', 'cue') THEN 1 ELSE 0 END), 0) as fallback
 		FROM scanned_files
-	`).Scan(&stats.TotalFiles, &stats.ValidFiles, &stats.InvalidFiles, &stats.AlbumsFound)
+	`).Scan(&stats.TotalFiles, &stats.ValidFiles, &stats.InvalidFiles, &stats.AlbumsFound,
+		&stats.TaggedFiles, &stats.FallbackFiles)
 	
 	if err != nil {
 		return nil, err
 	}
 	
+	changeRows, err := s.db.Query(`
+		SELECT change_type, COUNT(*) FROM scanned_files
+		WHERE change_type != '' GROUP BY change_type
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer changeRows.Close()
+	
+	for changeRows.Next() {
+		var changeType string
+		var count int
+		if err := changeRows.Scan(&changeType, &count); err != nil {
+			return nil, err
+		}
+		switch changeType {
+		case ChangeNew:
+			stats.NewFiles = count
+		case ChangeChanged:
+			stats.ChangedFiles = count
+		case ChangeUnchanged:
+			stats.UnchangedFiles = count
+		case ChangeRenamed:
+			stats.RenamedFiles = count
+		}
+	}
+	if err := changeRows.Err(); err != nil {
+		return nil, err
+	}
+	
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM removed_files").Scan(&stats.RemovedFiles); err != nil {
+		return nil, err
+	}
+	
 	if stats.Duration.Seconds() > 0 {
 		stats.FilesPerSecond = float64(stats.TotalFiles) / stats.Duration.Seconds()
 	}
 	
 	return stats, nil
 }
+
+// GetFilesByChangeType returns the path and hash of every file with the given
+// change type. A file holding several cue sheet tracks is returned once.
+func (s *ScanDB) GetFilesByChangeType(changeType string) ([]IndexedFile, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT file_path, COALESCE(file_hash, '') FROM scanned_files WHERE change_type = ?
+	`, changeType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var files []IndexedFile
+	for rows.Next() {
+		var f IndexedFile
+		if err := rows.Scan(&f.FilePath, &f.FileHash); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	
+	return files, rows.Err()
+}
+
+// MarkRenamed flags a scanned file as a rename of a file seen in the previous scan
+func (s *ScanDB) MarkRenamed(filePath, previousPath string) error {
+	_, err := s.db.Exec(`
+		UPDATE scanned_files SET change_type = ?, previous_path = ? WHERE file_path = ?
+	`, ChangeRenamed, previousPath, filePath)
+	return err
+}
+
+// RecordRemoved stores files that disappeared since the previous scan
+func (s *ScanDB) RecordRemoved(files []IndexedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO removed_files (file_path, file_hash) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	
+	for _, f := range files {
+		if _, err := stmt.Exec(f.FilePath, f.FileHash); err != nil {
+			return err
+		}
+	}
+	
+	return tx.Commit()
+}
+
+// GetRemovedFiles returns the files that disappeared since the previous scan
+func (s *ScanDB) GetRemovedFiles() ([]IndexedFile, error) {
+	rows, err := s.db.Query(`SELECT file_path, COALESCE(file_hash, '') FROM removed_files ORDER BY file_path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var files []IndexedFile
+	for rows.Next() {
+		var f IndexedFile
+		if err := rows.Scan(&f.FilePath, &f.FileHash); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	
+	return files, rows.Err()
+}
+
+// RecordIncompleteCueSheet stores a cue sheet whose audio files can't all be found
+func (s *ScanDB) RecordIncompleteCueSheet(sheet IncompleteCueSheet) error {
+	missing, err := json.Marshal(sheet.MissingFiles)
+	if err != nil {
+		return err
+	}
+	audio, err := json.Marshal(sheet.AudioFiles)
+	if err != nil {
+		return err
+	}
+	
+	_, err = s.db.Exec(`
+		INSERT OR REPLACE INTO incomplete_cue_sheets (cue_path, missing_files, audio_files) VALUES (?, ?, ?)
+	`, sheet.CuePath, string(missing), string(audio))
+	return err
+}
+
+// GetIncompleteCueSheets returns the cue sheets whose audio files can't all be found
+func (s *ScanDB) GetIncompleteCueSheets() ([]IncompleteCueSheet, error) {
+	rows, err := s.db.Query(`SELECT cue_path, missing_files, audio_files FROM incomplete_cue_sheets ORDER BY cue_path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var sheets []IncompleteCueSheet
+	for rows.Next() {
+		var sheet IncompleteCueSheet
+		var missing, audio string
+		if err := rows.Scan(&sheet.CuePath, &missing, &audio); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(missing), &sheet.MissingFiles); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(audio), &sheet.AudioFiles); err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, sheet)
+	}
+	
+	return sheets, rows.Err()
+}
@@ -0,0 +1,295 @@
+package scanner
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileIndexName is the file name of the persistent index kept next to the scan databases
+const FileIndexName = "file_index.db"
+
+// Change types recorded per file in incremental scans
+const (
+	ChangeNew       = "new"
+	ChangeChanged   = "changed"
+	ChangeUnchanged = "unchanged"
+	ChangeRenamed   = "renamed"
+)
+
+const fileIndexSchema = `
+CREATE TABLE IF NOT EXISTS file_index (
+    file_path TEXT PRIMARY KEY,
+    file_size INTEGER NOT NULL,
+    modified_time INTEGER NOT NULL,
+    file_hash TEXT NOT NULL,
+    artist TEXT, album_artist TEXT, album TEXT, title TEXT,
+    track_number INTEGER, track_total INTEGER, disc_number INTEGER, disc_total INTEGER,
+    year INTEGER, genre TEXT,
+    duration INTEGER, bitrate INTEGER, sample_rate INTEGER, channels INTEGER, bit_depth INTEGER,
+    musicbrainz_track_id TEXT, musicbrainz_album_id TEXT, musicbrainz_artist_id TEXT,
+    musicbrainz_album_artist_id TEXT, musicbrainz_release_group_id TEXT, metadata_source TEXT,
+    is_valid BOOLEAN, validation_error TEXT,
+    last_seen_scan TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_index_hash ON file_index(file_hash);
+CREATE INDEX IF NOT EXISTS idx_file_index_last_seen ON file_index(last_seen_scan);
+`
+
+// fileIndexColumns is shared by every statement that reads or writes a full index row
+const fileIndexColumns = `file_path, file_size, modified_time, file_hash,
+    artist, album_artist, album, title, track_number, track_total, disc_number, disc_total, year, genre,
+    duration, bitrate, sample_rate, channels, bit_depth,
+    musicbrainz_track_id, musicbrainz_album_id, musicbrainz_artist_id,
+    musicbrainz_album_artist_id, musicbrainz_release_group_id, metadata_source,
+    is_valid, validation_error`
+
+// FileIndex is a persistent SQLite index of previously scanned files keyed by
+// path. A file whose size and modification time match its index entry is
+// reused as-is, so only new or modified files are hashed and have their tags read.
+type FileIndex struct {
+	db   *sql.DB
+	path string
+}
+
+// IndexedFile is the subset of an index row used for change detection
+type IndexedFile struct {
+	FilePath string
+	FileHash string
+}
+
+// OpenFileIndex opens (or creates) the file index in basePath. When the index
+// does not exist yet it is seeded from the most recent scan database in the
+// same directory, so switching to incremental scans does not require one more
+// full rehash.
+func OpenFileIndex(basePath string) (*FileIndex, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	indexPath := filepath.Join(basePath, FileIndexName)
+	_, statErr := os.Stat(indexPath)
+	isNew := os.IsNotExist(statErr)
+
+	db, err := sql.Open("sqlite3", indexPath+"?_journal_mode=WAL&_synchronous=NORMAL&_cache_size=10000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file index: %w", err)
+	}
+
+	if _, err := db.Exec(fileIndexSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create file index schema: %w", err)
+	}
+
+	index := &FileIndex{db: db, path: indexPath}
+
+	if isNew {
+		// Seed from the newest scan database that has files; a scan database
+		// created moments ago for the current run is still empty and skipped.
+		for _, previous := range scanDBsNewestFirst(basePath) {
+			seeded, err := index.seedFromScanDB(previous)
+			if err != nil {
+				// Not fatal: the first incremental scan simply hashes everything
+				fmt.Printf("Could not seed file index from %s: %v\n", previous, err)
+				break
+			}
+			if seeded > 0 {
+				break
+			}
+		}
+	}
+
+	return index, nil
+}
+
+// Close closes the index database
+func (i *FileIndex) Close() error {
+	if i.db != nil {
+		return i.db.Close()
+	}
+	return nil
+}
+
+// GetPath returns the index database file path
+func (i *FileIndex) GetPath() string {
+	return i.path
+}
+
+// scanDBsNewestFirst lists the scan_*.db files in basePath, newest first.
+// Scan IDs embed a sortable timestamp, so lexical order is chronological.
+func scanDBsNewestFirst(basePath string) []string {
+	matches, err := filepath.Glob(filepath.Join(basePath, "scan_*.db"))
+	if err != nil {
+		return nil
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	return matches
+}
+
+// seedFromScanDB copies the files of a previous scan database into the index
+// and returns how many rows were imported
+func (i *FileIndex) seedFromScanDB(scanDBPath string) (int64, error) {
+	// ATTACH is per connection, so pin one for the whole import
+	conn, err := i.db.Conn(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS previous", scanDBPath); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE previous")
+
+	// Files split into several cue sheet tracks have no row of their own to
+	// copy, so they are left for the next scan to index
+	result, err := conn.ExecContext(ctx, `
+		INSERT OR REPLACE INTO file_index (`+fileIndexColumns+`, last_seen_scan)
+		SELECT `+fileIndexColumns+`, ''
+		FROM previous.scanned_files
+		WHERE file_hash IS NOT NULL AND file_hash != ''
+		AND file_path NOT IN (SELECT file_path FROM previous.scanned_files GROUP BY file_path HAVING COUNT(*) > 1)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Lookup returns the indexed copy of a file, or nil if the path is not indexed
+func (i *FileIndex) Lookup(filePath string) (*ScannedFile, error) {
+	file := &ScannedFile{}
+	var validationError sql.NullString
+	err := i.db.QueryRow(`SELECT `+fileIndexColumns+` FROM file_index WHERE file_path = ?`, filePath).Scan(
+		&file.FilePath, &file.FileSize, &file.ModifiedTime, &file.FileHash,
+		&file.Artist, &file.AlbumArtist, &file.Album, &file.Title,
+		&file.TrackNumber, &file.TrackTotal, &file.DiscNumber, &file.DiscTotal, &file.Year, &file.Genre,
+		&file.Duration, &file.Bitrate, &file.SampleRate, &file.Channels, &file.BitDepth,
+		&file.MusicBrainzTrackID, &file.MusicBrainzAlbumID, &file.MusicBrainzArtistID,
+		&file.MusicBrainzAlbumArtistID, &file.MusicBrainzReleaseGroupID, &file.MetadataSource,
+		&file.IsValid, &validationError,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.ValidationError = validationError.String
+	return file, nil
+}
+
+// UpdateBatch records the files seen by a scan. New and changed files are
+// written in full; unchanged files only have their last-seen marker updated.
+// Cue sheet tracks are skipped: their audio file is indexed as a whole.
+func (i *FileIndex) UpdateBatch(runID string, files []*ScannedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(`
+		INSERT OR REPLACE INTO file_index (` + fileIndexColumns + `, last_seen_scan)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	touch, err := tx.Prepare(`UPDATE file_index SET last_seen_scan = ? WHERE file_path = ?`)
+	if err != nil {
+		return err
+	}
+	defer touch.Close()
+
+	for _, file := range files {
+		if file.CuePath != "" {
+			continue
+		}
+		// Unchanged files only need marking as seen. Files that could not be
+		// hashed are not written either, so they are retried next scan.
+		if file.ChangeType == ChangeUnchanged || file.FileHash == "" {
+			if _, err := touch.Exec(runID, file.FilePath); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err := upsert.Exec(
+			file.FilePath, file.FileSize, file.ModifiedTime, file.FileHash,
+			file.Artist, file.AlbumArtist, file.Album, file.Title,
+			file.TrackNumber, file.TrackTotal, file.DiscNumber, file.DiscTotal, file.Year, file.Genre,
+			file.Duration, file.Bitrate, file.SampleRate, file.Channels, file.BitDepth,
+			file.MusicBrainzTrackID, file.MusicBrainzAlbumID, file.MusicBrainzArtistID,
+			file.MusicBrainzAlbumArtistID, file.MusicBrainzReleaseGroupID, file.MetadataSource,
+			file.IsValid, file.ValidationError,
+			runID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Unseen returns indexed files under rootPath that were not seen by the scan run runID
+func (i *FileIndex) Unseen(runID, rootPath string) ([]IndexedFile, error) {
+	prefix := strings.TrimSuffix(rootPath, string(filepath.Separator)) + string(filepath.Separator)
+
+	rows, err := i.db.Query(`
+		SELECT file_path, file_hash FROM file_index
+		WHERE last_seen_scan IS NOT ? AND substr(file_path, 1, ?) = ?
+	`, runID, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []IndexedFile
+	for rows.Next() {
+		var f IndexedFile
+		if err := rows.Scan(&f.FilePath, &f.FileHash); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Remove deletes index entries for files that no longer exist
+func (i *FileIndex) Remove(filePaths []string) error {
+	if len(filePaths) == 0 {
+		return nil
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`DELETE FROM file_index WHERE file_path = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range filePaths {
+		if _, err := stmt.Exec(p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,72 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runIncrementalScan performs one incremental scan of root and returns its stats.
+// Scan IDs have one second resolution, so each run gets its own directory.
+func runIncrementalScan(t *testing.T, indexDir, root string) *ScanStats {
+	t.Helper()
+
+	scanDB, err := NewScanDB(t.TempDir())
+	require.NoError(t, err)
+	defer scanDB.Close()
+
+	index, err := OpenFileIndex(indexDir)
+	require.NoError(t, err)
+	defer index.Close()
+
+	require.NoError(t, NewIncrementalFileScanner(scanDB, index, 2).ScanDirectory(root))
+
+	stats, err := scanDB.GetStats()
+	require.NoError(t, err)
+	return stats
+}
+
+func TestIncrementalScan_Deltas(t *testing.T) {
+	root := t.TempDir()
+	indexDir := t.TempDir()
+	album := filepath.Join(root, "Band - Record")
+
+	for i, title := range []string{"One", "Two", "Three"} {
+		writeTestFile(t, filepath.Join(album, title+".flac"), buildFLAC(
+			"ARTIST=Band", "ALBUM=Record", "TITLE="+title, "TRACKNUMBER="+string(rune('1'+i)),
+		))
+	}
+
+	stats := runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 3, stats.NewFiles)
+	assert.Equal(t, 0, stats.UnchangedFiles)
+
+	stats = runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 0, stats.NewFiles)
+	assert.Equal(t, 3, stats.UnchangedFiles)
+	assert.Equal(t, 3, stats.TotalFiles, "unchanged files still appear in the scan database")
+
+	// Modify one file, rename another and delete the third
+	changed := filepath.Join(album, "One.flac")
+	writeTestFile(t, changed, buildFLAC("ARTIST=Band", "ALBUM=Record", "TITLE=One (Edit)", "TRACKNUMBER=1"))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(changed, later, later))
+	require.NoError(t, os.Rename(filepath.Join(album, "Two.flac"), filepath.Join(album, "02 - Two.flac")))
+	require.NoError(t, os.Remove(filepath.Join(album, "Three.flac")))
+
+	stats = runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 1, stats.ChangedFiles)
+	assert.Equal(t, 1, stats.RenamedFiles)
+	assert.Equal(t, 1, stats.RemovedFiles)
+	assert.Equal(t, 0, stats.NewFiles)
+	assert.Equal(t, 0, stats.UnchangedFiles)
+
+	// Everything settles once the index has caught up
+	stats = runIncrementalScan(t, indexDir, root)
+	assert.Equal(t, 2, stats.UnchangedFiles)
+	assert.Equal(t, 0, stats.RemovedFiles)
+}
@@ -16,17 +16,40 @@ type ScannedFile struct {
 	Album       string `db:"album"`
 	Title       string `db:"title"`
 	TrackNumber int    `db:"track_number"`
+	TrackTotal  int    `db:"track_total"`
 	DiscNumber  int    `db:"disc_number"`
+	DiscTotal   int    `db:"disc_total"`
 	Year        int    `db:"year"`
 	Genre       string `db:"genre"`
 	Duration    int    `db:"duration"`     // milliseconds
 	Bitrate     int    `db:"bitrate"`      // kbps
 	SampleRate  int    `db:"sample_rate"` // Hz
+	Channels    int    `db:"channels"`
+	BitDepth    int    `db:"bit_depth"`
+	
+	// MusicBrainz identifiers (empty when untagged)
+	MusicBrainzTrackID        string `db:"musicbrainz_track_id"`
+	MusicBrainzAlbumID        string `db:"musicbrainz_album_id"`
+	MusicBrainzArtistID       string `db:"musicbrainz_artist_id"`
+	MusicBrainzAlbumArtistID  string `db:"musicbrainz_album_artist_id"`
+	MusicBrainzReleaseGroupID string `db:"musicbrainz_release_group_id"`
+	
+	// MetadataSource records where the descriptive fields came from (tags, filename, both or a cue sheet)
+	MetadataSource string `db:"metadata_source"`
+	
+	// Cue sheet tracks share FilePath with the rest of the sheet's tracks in that file
+	CuePath     string `db:"cue_path"`     // empty for ordinary files
+	StartOffset int64  `db:"start_offset"` // milliseconds into the file
+	EndOffset   int64  `db:"end_offset"`   // milliseconds into the file, 0 is its end
 	
 	// Validation
 	IsValid         bool   `db:"is_valid"`
 	ValidationError string `db:"validation_error"`
 	
+	// Incremental scan change tracking (empty for full scans)
+	ChangeType   string `db:"change_type"`   // new, changed, unchanged or renamed
+	PreviousPath string `db:"previous_path"` // set when ChangeType is renamed
+	
 	// Grouping (computed after scan)
 	AlbumGroupHash string `db:"album_group_hash"`
 	AlbumGroupID   string `db:"album_group_id"`
@@ -45,12 +68,29 @@ type AlbumGroup struct {
 	FilePaths    []string
 }
 
+// IncompleteCueSheet is a cue sheet that refers to audio files that can't be
+// found. None of its tracks are scanned.
+type IncompleteCueSheet struct {
+	CuePath      string
+	MissingFiles []string // FILE entries without a matching file
+	AudioFiles   []string // the files it refers to that do exist
+}
+
 // ScanStats holds statistics about a scan operation
 type ScanStats struct {
 	TotalFiles      int
 	ValidFiles      int
 	InvalidFiles    int
 	AlbumsFound     int
+	TaggedFiles     int // metadata came entirely from embedded tags or a cue sheet
+	FallbackFiles   int // some or all metadata came from file/directory names
+	
+	// Per-scan deltas against the file index (zero for full scans)
+	NewFiles        int
+	ChangedFiles    int
+	UnchangedFiles  int
+	RenamedFiles    int
+	RemovedFiles    int
 	StartTime       time.Time
 	EndTime         time.Time
 	Duration        time.Duration
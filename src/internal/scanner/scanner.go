@@ -7,14 +7,35 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/text/encoding"
 )
 
 // FileScanner scans a directory tree and extracts metadata from media files
 type FileScanner struct {
 	workers int
 	scanDB  *ScanDB
+	index   *FileIndex // nil for full scans
+	runID   string     // marks index entries seen by the current scan
+
+	// cueEncoding decodes cue sheets that are neither UTF-8 nor UTF-16
+	cueEncoding encoding.Encoding
+
+	// cueAudio collects the audio files split into cue sheet tracks, which
+	// are indexed as a whole once the scan is done
+	cueAudio   []*ScannedFile
+	cueAudioMu sync.Mutex
+}
+
+// scanJob is a media file, or a cue sheet and the audio files it refers to
+type scanJob struct {
+	path  string
+	sheet *CueSheet
+	audio map[string]string // FILE entry to audio file path
 }
 
 // NewFileScanner creates a new file scanner
@@ -28,10 +49,36 @@ func NewFileScanner(scanDB *ScanDB, workers int) *FileScanner {
 	}
 }
 
-// ScanDirectory scans a directory and all subdirectories for media files
+// NewIncrementalFileScanner creates a scanner that consults a persistent file
+// index: files whose size and modification time are unchanged are copied from
+// the index instead of being rehashed, and new, changed, renamed and removed
+// files are recorded in the scan database.
+func NewIncrementalFileScanner(scanDB *ScanDB, index *FileIndex, workers int) *FileScanner {
+	fs := NewFileScanner(scanDB, workers)
+	fs.index = index
+	return fs
+}
+
+// SetCueEncoding sets the encoding of cue sheets that are neither UTF-8 nor
+// UTF-16, e.g. "shift_jis". The default is DefaultCueEncoding.
+func (fs *FileScanner) SetCueEncoding(name string) error {
+	enc, err := CueEncoding(name)
+	if err != nil {
+		return err
+	}
+	fs.cueEncoding = enc
+	return nil
+}
+
+// ScanDirectory scans a directory and all subdirectories for media files.
+// Audio files referred to by a cue sheet are split into the sheet's tracks.
 func (fs *FileScanner) ScanDirectory(rootPath string) error {
-	// Channel for file paths to process
-	filePaths := make(chan string, 1000)
+	// Scan IDs only have one second resolution, so make the run marker unique
+	fs.runID = fmt.Sprintf("%s_%d", fs.scanDB.GetScanID(), time.Now().UnixNano())
+	fs.cueAudio = nil
+	
+	// Channel for files and cue sheets to process
+	jobs := make(chan scanJob, 1000)
 	
 	// Channel for scanned files
 	scannedFiles := make(chan *ScannedFile, 1000)
@@ -46,11 +93,23 @@ func (fs *FileScanner) ScanDirectory(rootPath string) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for filePath := range filePaths {
-				file, err := fs.scanFile(filePath)
+			for job := range jobs {
+				if job.sheet != nil {
+					tracks, err := fs.scanCueSheet(job.path, job.sheet, job.audio)
+					if err != nil {
+						fmt.Printf("Error scanning cue sheet %s: %v\n", job.path, err)
+						continue
+					}
+					for _, track := range tracks {
+						scannedFiles <- track
+					}
+					continue
+				}
+				
+				file, err := fs.scanFile(job.path)
 				if err != nil {
 					// Log error but continue
-					fmt.Printf("Error scanning %s: %v\n", filePath, err)
+					fmt.Printf("Error scanning %s: %v\n", job.path, err)
 					continue
 				}
 				if file != nil {
@@ -70,8 +129,11 @@ func (fs *FileScanner) ScanDirectory(rootPath string) error {
 			batch = append(batch, file)
 			
 			if len(batch) >= 1000 {
-				if err := fs.scanDB.InsertBatch(batch); err != nil {
+				if err := fs.insertBatch(batch); err != nil {
 					errChan <- err
+					// Keep draining so the workers never block
+					for range scannedFiles {
+					}
 					return
 				}
 				batch = batch[:0]
@@ -80,31 +142,33 @@ func (fs *FileScanner) ScanDirectory(rootPath string) error {
 		
 		// Insert remaining files
 		if len(batch) > 0 {
-			if err := fs.scanDB.InsertBatch(batch); err != nil {
+			if err := fs.insertBatch(batch); err != nil {
 				errChan <- err
 			}
 		}
 	}()
 	
-	// Walk directory tree
+	// Walk directory tree. A directory is visited before its files, so the
+	// audio files its cue sheets claim are known before they are reached.
+	claimed := make(map[string]bool)
 	walkErr := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		
 		if info.IsDir() {
-			return nil
+			return fs.queueCueSheets(path, jobs, claimed)
 		}
 		
 		// Check if it's a media file
-		if isMediaFile(path) {
-			filePaths <- path
+		if isMediaFile(path) && !claimed[path] {
+			jobs <- scanJob{path: path}
 		}
 		
 		return nil
 	})
 	
-	close(filePaths)
+	close(jobs)
 	wg.Wait()
 	close(scannedFiles)
 	<-insertDone
@@ -116,7 +180,225 @@ func (fs *FileScanner) ScanDirectory(rootPath string) error {
 	default:
 	}
 	
-	return walkErr
+	if walkErr != nil {
+		return walkErr
+	}
+	
+	if fs.index != nil {
+		if err := fs.index.UpdateBatch(fs.runID, fs.cueAudio); err != nil {
+			return fmt.Errorf("failed to update file index: %w", err)
+		}
+		return fs.reconcileIndex(rootPath)
+	}
+	
+	return nil
+}
+
+// queueCueSheets queues the cue sheets in a directory for scanning and marks
+// the audio files they refer to as claimed, so those aren't scanned as single
+// tracks. A sheet whose audio files can't all be found is recorded as
+// incomplete instead; the files it does find are left to it all the same.
+func (fs *FileScanner) queueCueSheets(dir string, jobs chan<- scanJob, claimed map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	
+	for _, entry := range entries {
+		if entry.IsDir() || !isCueSheet(entry.Name()) {
+			continue
+		}
+		cuePath := filepath.Join(dir, entry.Name())
+		sheet, err := ReadCueSheet(cuePath, fs.cueEncoding)
+		if err != nil {
+			// The audio files are scanned as they are
+			fmt.Printf("Error reading cue sheet %s: %v\n", cuePath, err)
+			continue
+		}
+		
+		audio := make(map[string]string)
+		incomplete := IncompleteCueSheet{CuePath: cuePath}
+		duplicate := false
+		for _, name := range sheet.Files {
+			audioPath := ResolveCueFile(dir, name)
+			switch {
+			case audioPath == "":
+				incomplete.MissingFiles = append(incomplete.MissingFiles, name)
+			case claimed[audioPath]:
+				// Rippers often save one sheet in several encodings
+				duplicate = true
+			default:
+				audio[name] = audioPath
+			}
+		}
+		if duplicate {
+			fmt.Printf("Skipping cue sheet %s: its audio belongs to another cue sheet\n", cuePath)
+			continue
+		}
+		for _, audioPath := range audio {
+			claimed[audioPath] = true
+			incomplete.AudioFiles = append(incomplete.AudioFiles, audioPath)
+		}
+		
+		if len(incomplete.MissingFiles) > 0 {
+			sort.Strings(incomplete.AudioFiles)
+			if err := fs.scanDB.RecordIncompleteCueSheet(incomplete); err != nil {
+				return fmt.Errorf("failed to record incomplete cue sheet: %w", err)
+			}
+			continue
+		}
+		jobs <- scanJob{path: cuePath, sheet: sheet, audio: audio}
+	}
+	
+	return nil
+}
+
+// scanCueSheet scans the audio files of a cue sheet and splits them into the
+// sheet's tracks
+func (fs *FileScanner) scanCueSheet(cuePath string, sheet *CueSheet, audio map[string]string) ([]*ScannedFile, error) {
+	var tracks []*ScannedFile
+	for _, name := range sheet.Files {
+		audioPath, ok := audio[name]
+		if !ok {
+			continue
+		}
+		delete(audio, name) // a file listed twice is scanned once
+		file, err := fs.scanFile(audioPath)
+		if err != nil {
+			return nil, err
+		}
+		if fs.index != nil && file.FileHash != "" {
+			fs.cueAudioMu.Lock()
+			fs.cueAudio = append(fs.cueAudio, file)
+			fs.cueAudioMu.Unlock()
+		}
+		
+		fileTracks := sheet.TracksOf(name)
+		for _, track := range fileTracks {
+			tracks = append(tracks, cueTrackFile(file, cuePath, sheet, track, len(fileTracks)))
+		}
+	}
+	return tracks, nil
+}
+
+// cueTrackFile makes a scanned track of a cue sheet track. Descriptive fields
+// come from the sheet, falling back to the tags of the audio file; its size is
+// the share of the audio file it plays.
+func cueTrackFile(audio *ScannedFile, cuePath string, sheet *CueSheet, track CueTrack, fileTracks int) *ScannedFile {
+	file := *audio
+	file.CuePath = cuePath
+	file.StartOffset = track.Start.Milliseconds()
+	file.EndOffset = track.End.Milliseconds()
+	
+	switch {
+	case track.End > 0:
+		file.Duration = int((track.End - track.Start).Milliseconds())
+	case audio.Duration > 0:
+		file.Duration = max(audio.Duration-int(file.StartOffset), 0)
+	default:
+		file.Duration = 0
+	}
+	if audio.Duration > 0 {
+		file.FileSize = audio.FileSize * int64(file.Duration) / int64(audio.Duration)
+	} else {
+		file.FileSize = audio.FileSize / int64(fileTracks)
+	}
+	
+	file.Artist = track.Performer
+	fillString(&file.Artist, sheet.Performer)
+	fillString(&file.Artist, audio.Artist)
+	file.AlbumArtist = sheet.Performer
+	fillString(&file.AlbumArtist, audio.AlbumArtist)
+	file.Album = sheet.Title
+	fillString(&file.Album, audio.Album)
+	file.Title = track.Title
+	fillString(&file.Title, fmt.Sprintf("Track %02d", track.Number))
+	file.TrackNumber = track.Number
+	file.TrackTotal = len(sheet.Tracks)
+	file.DiscNumber = sheet.DiscNumber
+	fillInt(&file.DiscNumber, audio.DiscNumber)
+	fillInt(&file.DiscNumber, 1)
+	file.DiscTotal = sheet.DiscTotal
+	fillInt(&file.DiscTotal, audio.DiscTotal)
+	file.Year = sheet.Year()
+	fillInt(&file.Year, audio.Year)
+	file.Genre = sheet.Genre
+	fillString(&file.Genre, audio.Genre)
+	// The file's recording ID, if tagged, can't be that of every track
+	file.MusicBrainzTrackID = ""
+	file.MetadataSource = MetadataSourceCue
+	
+	// The audio file's own title or track number may be missing; the track's aren't
+	if file.FileHash != "" {
+		file.IsValid = true
+		file.ValidationError = ""
+		if file.Artist == "" || file.Album == "" {
+			file.IsValid = false
+			file.ValidationError = "missing required metadata (artist, album, or title)"
+		}
+	}
+	
+	return &file
+}
+
+// insertBatch writes a batch to the scan database and, for incremental scans, the file index
+func (fs *FileScanner) insertBatch(batch []*ScannedFile) error {
+	if err := fs.scanDB.InsertBatch(batch); err != nil {
+		return err
+	}
+	if fs.index != nil {
+		if err := fs.index.UpdateBatch(fs.runID, batch); err != nil {
+			return fmt.Errorf("failed to update file index: %w", err)
+		}
+	}
+	return nil
+}
+
+// reconcileIndex detects files that disappeared since the previous scan.
+// A new file with the same content hash as a vanished one is recorded as a
+// rename; the rest are recorded as removed. Both are dropped from the index.
+func (fs *FileScanner) reconcileIndex(rootPath string) error {
+	unseen, err := fs.index.Unseen(fs.runID, rootPath)
+	if err != nil {
+		return fmt.Errorf("failed to find removed files: %w", err)
+	}
+	if len(unseen) == 0 {
+		return nil
+	}
+	
+	vanished := make(map[string][]IndexedFile)
+	for _, f := range unseen {
+		vanished[f.FileHash] = append(vanished[f.FileHash], f)
+	}
+	
+	newFiles, err := fs.scanDB.GetFilesByChangeType(ChangeNew)
+	if err != nil {
+		return fmt.Errorf("failed to load new files: %w", err)
+	}
+	for _, f := range newFiles {
+		candidates := vanished[f.FileHash]
+		if f.FileHash == "" || len(candidates) == 0 {
+			continue
+		}
+		if err := fs.scanDB.MarkRenamed(f.FilePath, candidates[0].FilePath); err != nil {
+			return fmt.Errorf("failed to record rename: %w", err)
+		}
+		vanished[f.FileHash] = candidates[1:]
+	}
+	
+	var removed []IndexedFile
+	for _, files := range vanished {
+		removed = append(removed, files...)
+	}
+	if err := fs.scanDB.RecordRemoved(removed); err != nil {
+		return fmt.Errorf("failed to record removed files: %w", err)
+	}
+	
+	paths := make([]string, len(unseen))
+	for i, f := range unseen {
+		paths[i] = f.FilePath
+	}
+	return fs.index.Remove(paths)
 }
 
 // scanFile extracts metadata from a single file
@@ -133,6 +415,23 @@ func (fs *FileScanner) scanFile(filePath string) (*ScannedFile, error) {
 		IsValid:      true,
 	}
 	
+	// Reuse the indexed copy when size and modification time are unchanged
+	if fs.index != nil {
+		cached, err := fs.index.Lookup(filePath)
+		if err != nil {
+			fmt.Printf("File index lookup failed for %s: %v\n", filePath, err)
+		}
+		switch {
+		case cached == nil:
+			file.ChangeType = ChangeNew
+		case cached.FileSize == file.FileSize && cached.ModifiedTime == file.ModifiedTime:
+			cached.ChangeType = ChangeUnchanged
+			return cached, nil
+		default:
+			file.ChangeType = ChangeChanged
+		}
+	}
+	
 	// Calculate file hash
 	hash, err := calculateFileHash(filePath)
 	if err != nil {
@@ -142,13 +441,8 @@ func (fs *FileScanner) scanFile(filePath string) (*ScannedFile, error) {
 	}
 	file.FileHash = hash
 	
-	// Extract metadata (basic implementation - can be enhanced with taglib/ffprobe)
-	metadata, err := extractBasicMetadata(filePath)
-	if err != nil {
-		file.IsValid = false
-		file.ValidationError = fmt.Sprintf("metadata extraction failed: %v", err)
-		return file, nil
-	}
+	// Extract metadata from embedded tags, falling back to the path
+	metadata := extractMetadata(filePath)
 	
 	// Populate metadata fields
 	file.Artist = metadata.Artist
@@ -156,12 +450,22 @@ func (fs *FileScanner) scanFile(filePath string) (*ScannedFile, error) {
 	file.Album = metadata.Album
 	file.Title = metadata.Title
 	file.TrackNumber = metadata.TrackNumber
+	file.TrackTotal = metadata.TrackTotal
 	file.DiscNumber = metadata.DiscNumber
+	file.DiscTotal = metadata.DiscTotal
 	file.Year = metadata.Year
 	file.Genre = metadata.Genre
 	file.Duration = metadata.Duration
 	file.Bitrate = metadata.Bitrate
 	file.SampleRate = metadata.SampleRate
+	file.Channels = metadata.Channels
+	file.BitDepth = metadata.BitDepth
+	file.MusicBrainzTrackID = metadata.MusicBrainzTrackID
+	file.MusicBrainzAlbumID = metadata.MusicBrainzAlbumID
+	file.MusicBrainzArtistID = metadata.MusicBrainzArtistID
+	file.MusicBrainzAlbumArtistID = metadata.MusicBrainzAlbumArtistID
+	file.MusicBrainzReleaseGroupID = metadata.MusicBrainzReleaseGroupID
+	file.MetadataSource = metadata.Source
 	
 	// Validate required fields
 	if file.Artist == "" || file.Album == "" || file.Title == "" {
@@ -172,25 +476,43 @@ func (fs *FileScanner) scanFile(filePath string) (*ScannedFile, error) {
 	return file, nil
 }
 
-// Metadata holds basic metadata extracted from a file
-type Metadata struct {
-	Artist      string
-	AlbumArtist string
-	Album       string
-	Title       string
-	TrackNumber int
-	DiscNumber  int
-	Year        int
-	Genre       string
-	Duration    int // milliseconds
-	Bitrate     int // kbps
-	SampleRate  int // Hz
+// extractMetadata reads embedded tags and fills any missing artist, album,
+// title or track number from the file and directory names. Stream properties
+// only ever come from the file itself; they stay zero when unreadable.
+func extractMetadata(filePath string) *Metadata {
+	metadata, err := ReadTags(filePath)
+	if err != nil || metadata == nil {
+		metadata = &Metadata{}
+	}
+	
+	if metadata.hasTags() {
+		metadata.Source = MetadataSourceTags
+	} else {
+		metadata.Source = MetadataSourceFilename
+	}
+	
+	if metadata.Artist == "" || metadata.Album == "" || metadata.Title == "" || metadata.TrackNumber == 0 {
+		fallback := parseFilenameMetadata(filePath)
+		if metadata.Source == MetadataSourceTags {
+			metadata.Source = MetadataSourceMixed
+		}
+		fillString(&metadata.Artist, fallback.Artist)
+		fillString(&metadata.Album, fallback.Album)
+		fillString(&metadata.Title, fallback.Title)
+		fillInt(&metadata.TrackNumber, fallback.TrackNumber)
+		fillInt(&metadata.Year, fallback.Year)
+	}
+	
+	if metadata.DiscNumber == 0 {
+		metadata.DiscNumber = 1
+	}
+	
+	return metadata
 }
 
-// extractBasicMetadata extracts metadata from a file
-// This is a placeholder implementation that parses filenames
-// TODO: Replace with proper tag reading (taglib, ffprobe)
-func extractBasicMetadata(filePath string) (*Metadata, error) {
+// parseFilenameMetadata guesses metadata from file and directory names.
+// It is only used as a fallback when a file carries no usable tags.
+func parseFilenameMetadata(filePath string) *Metadata {
 	fileName := filepath.Base(filePath)
 	dirName := filepath.Base(filepath.Dir(filePath))
 	
@@ -237,7 +559,7 @@ func extractBasicMetadata(filePath string) (*Metadata, error) {
 		metadata.Album = dirName
 	}
 	
-	// Set default values for testing
+	// Fall back to placeholder names
 	if metadata.Artist == "" {
 		metadata.Artist = "Unknown Artist"
 	}
@@ -245,11 +567,7 @@ func extractBasicMetadata(filePath string) (*Metadata, error) {
 		metadata.Album = "Unknown Album"
 	}
 	
-	metadata.Duration = 180000    // 3 minutes default
-	metadata.Bitrate = 320        // 320 kbps default
-	metadata.SampleRate = 44100   // 44.1 kHz default
-	
-	return metadata, nil
+	return metadata
 }
 
 // calculateFileHash calculates SHA256 hash of a file
@@ -268,6 +586,11 @@ func calculateFileHash(filePath string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// isCueSheet checks if a file is a cue sheet
+func isCueSheet(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".cue")
+}
+
 // isMediaFile checks if a file is a supported media file
 func isMediaFile(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
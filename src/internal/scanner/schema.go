@@ -3,7 +3,7 @@ package scanner
 const ScanDatabaseSchema = `
 CREATE TABLE IF NOT EXISTS scanned_files (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    file_path TEXT NOT NULL UNIQUE,
+    file_path TEXT NOT NULL,
     file_size INTEGER,
     file_hash TEXT,
     modified_time INTEGER,
@@ -14,22 +14,43 @@ CREATE TABLE IF NOT EXISTS scanned_files (
     album TEXT,
     title TEXT,
     track_number INTEGER,
+    track_total INTEGER DEFAULT 0,
     disc_number INTEGER,
+    disc_total INTEGER DEFAULT 0,
     year INTEGER,
     genre TEXT,
     duration INTEGER,
     bitrate INTEGER,
     sample_rate INTEGER,
+    channels INTEGER DEFAULT 0,
+    bit_depth INTEGER DEFAULT 0,
+    musicbrainz_track_id TEXT DEFAULT '',
+    musicbrainz_album_id TEXT DEFAULT '',
+    musicbrainz_artist_id TEXT DEFAULT '',
+    musicbrainz_album_artist_id TEXT DEFAULT '',
+    musicbrainz_release_group_id TEXT DEFAULT '',
+    metadata_source TEXT DEFAULT 'filename',
+    
+    -- Cue sheet tracks: a segment of file_path, which other rows share
+    cue_path TEXT DEFAULT '',
+    start_offset INTEGER DEFAULT 0,
+    end_offset INTEGER DEFAULT 0,
     
     -- Validation
     is_valid BOOLEAN DEFAULT 1,
     validation_error TEXT,
     
+    -- Incremental scan change tracking
+    change_type TEXT DEFAULT '',
+    previous_path TEXT DEFAULT '',
+    
     -- Grouping (computed later)
     album_group_hash TEXT,
     album_group_id TEXT,
     
-    created_at INTEGER DEFAULT (strftime('%s','now'))
+    created_at INTEGER DEFAULT (strftime('%s','now')),
+    
+    UNIQUE (file_path, start_offset)
 );
 
 CREATE INDEX IF NOT EXISTS idx_artist_album ON scanned_files(artist, album, year);
@@ -37,4 +58,18 @@ CREATE INDEX IF NOT EXISTS idx_album_group_hash ON scanned_files(album_group_has
 CREATE INDEX IF NOT EXISTS idx_album_group_id ON scanned_files(album_group_id);
 CREATE INDEX IF NOT EXISTS idx_is_valid ON scanned_files(is_valid);
 CREATE INDEX IF NOT EXISTS idx_file_hash ON scanned_files(file_hash);
+CREATE INDEX IF NOT EXISTS idx_change_type ON scanned_files(change_type);
+
+-- Files present in the previous scan of this root that have since disappeared
+CREATE TABLE IF NOT EXISTS removed_files (
+    file_path TEXT NOT NULL PRIMARY KEY,
+    file_hash TEXT
+);
+
+-- Cue sheets referring to audio files that could not be found, as JSON arrays of paths
+CREATE TABLE IF NOT EXISTS incomplete_cue_sheets (
+    cue_path TEXT NOT NULL PRIMARY KEY,
+    missing_files TEXT NOT NULL,
+    audio_files TEXT NOT NULL
+);
 `
@@ -0,0 +1,313 @@
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Metadata sources recorded per scanned file
+const (
+	MetadataSourceTags     = "tags"          // every required field came from embedded tags
+	MetadataSourceMixed    = "tags+filename" // tags were present but some fields were filled from the path
+	MetadataSourceFilename = "filename"      // no usable tags, everything was guessed from the path
+)
+
+// ErrUnsupportedFormat is returned when no tag reader understands the file
+var ErrUnsupportedFormat = errors.New("unsupported media format")
+
+// Metadata holds metadata extracted from a file
+type Metadata struct {
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Title       string
+	TrackNumber int
+	TrackTotal  int
+	DiscNumber  int
+	DiscTotal   int
+	Year        int
+	Genre       string
+
+	MusicBrainzTrackID        string
+	MusicBrainzAlbumID        string
+	MusicBrainzArtistID       string
+	MusicBrainzAlbumArtistID  string
+	MusicBrainzReleaseGroupID string
+
+	// Stream properties
+	Duration   int // milliseconds
+	Bitrate    int // kbps
+	SampleRate int // Hz
+	Channels   int
+	BitDepth   int // bits per sample, 0 for lossy formats
+
+	// Lyrics embedded in the tags, in the order they were read
+	Lyrics []TaggedLyrics
+
+	// Source records where the descriptive fields came from (see MetadataSource*)
+	Source string
+
+	// originalYear is only used when no release year is tagged
+	originalYear int
+}
+
+// TaggedLyrics are lyrics embedded in a file's tags. Text is plain or in LRC
+// format; ID3 SYLT frames, which carry their own timestamps, are converted to LRC.
+type TaggedLyrics struct {
+	Lang string // ISO 639-2 code from ID3 frames, empty for other tag formats
+	Text string
+}
+
+// hasTags reports whether any descriptive field was populated from embedded tags
+func (m *Metadata) hasTags() bool {
+	return m.Artist != "" || m.AlbumArtist != "" || m.Album != "" || m.Title != "" ||
+		m.TrackNumber != 0 || m.Year != 0 || m.Genre != ""
+}
+
+// merge fills empty fields of m from other without overwriting existing values
+func (m *Metadata) merge(other *Metadata) {
+	if other == nil {
+		return
+	}
+	fillString(&m.Artist, other.Artist)
+	fillString(&m.AlbumArtist, other.AlbumArtist)
+	fillString(&m.Album, other.Album)
+	fillString(&m.Title, other.Title)
+	fillInt(&m.TrackNumber, other.TrackNumber)
+	fillInt(&m.TrackTotal, other.TrackTotal)
+	fillInt(&m.DiscNumber, other.DiscNumber)
+	fillInt(&m.DiscTotal, other.DiscTotal)
+	fillInt(&m.Year, other.Year)
+	fillInt(&m.originalYear, other.originalYear)
+	fillString(&m.Genre, other.Genre)
+	fillString(&m.MusicBrainzTrackID, other.MusicBrainzTrackID)
+	fillString(&m.MusicBrainzAlbumID, other.MusicBrainzAlbumID)
+	fillString(&m.MusicBrainzArtistID, other.MusicBrainzArtistID)
+	fillString(&m.MusicBrainzAlbumArtistID, other.MusicBrainzAlbumArtistID)
+	fillString(&m.MusicBrainzReleaseGroupID, other.MusicBrainzReleaseGroupID)
+	fillInt(&m.Duration, other.Duration)
+	fillInt(&m.Bitrate, other.Bitrate)
+	fillInt(&m.SampleRate, other.SampleRate)
+	fillInt(&m.Channels, other.Channels)
+	fillInt(&m.BitDepth, other.BitDepth)
+	if len(m.Lyrics) == 0 {
+		m.Lyrics = other.Lyrics
+	}
+}
+
+func fillString(dst *string, v string) {
+	if *dst == "" {
+		*dst = strings.TrimSpace(v)
+	}
+}
+
+func fillInt(dst *int, v int) {
+	if *dst == 0 {
+		*dst = v
+	}
+}
+
+// setField maps a tag key (Vorbis comment, APEv2 item or ID3 TXXX description)
+// onto the matching Metadata field. Keys are compared case-insensitively with
+// spaces and underscores removed, so "Album Artist", "ALBUMARTIST" and
+// "album_artist" are equivalent. The first value seen for a field wins.
+func (m *Metadata) setField(key, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" {
+		return
+	}
+
+	switch normalizeTagKey(key) {
+	case "ARTIST":
+		fillString(&m.Artist, value)
+	case "ALBUMARTIST":
+		fillString(&m.AlbumArtist, value)
+	case "ALBUM":
+		fillString(&m.Album, value)
+	case "TITLE":
+		fillString(&m.Title, value)
+	case "TRACKNUMBER", "TRACK":
+		n, total := parseNumberPair(value)
+		fillInt(&m.TrackNumber, n)
+		fillInt(&m.TrackTotal, total)
+	case "TRACKTOTAL", "TOTALTRACKS":
+		n, _ := parseNumberPair(value)
+		fillInt(&m.TrackTotal, n)
+	case "DISCNUMBER", "DISC":
+		n, total := parseNumberPair(value)
+		fillInt(&m.DiscNumber, n)
+		fillInt(&m.DiscTotal, total)
+	case "DISCTOTAL", "TOTALDISCS":
+		n, _ := parseNumberPair(value)
+		fillInt(&m.DiscTotal, n)
+	case "DATE", "YEAR":
+		fillInt(&m.Year, parseYear(value))
+	case "ORIGINALDATE", "ORIGINALYEAR":
+		fillInt(&m.originalYear, parseYear(value))
+	case "GENRE":
+		fillString(&m.Genre, value)
+	case "MUSICBRAINZTRACKID":
+		fillString(&m.MusicBrainzTrackID, value)
+	case "MUSICBRAINZALBUMID":
+		fillString(&m.MusicBrainzAlbumID, value)
+	case "MUSICBRAINZARTISTID":
+		fillString(&m.MusicBrainzArtistID, value)
+	case "MUSICBRAINZALBUMARTISTID":
+		fillString(&m.MusicBrainzAlbumArtistID, value)
+	case "MUSICBRAINZRELEASEGROUPID":
+		fillString(&m.MusicBrainzReleaseGroupID, value)
+	case "LYRICS", "UNSYNCEDLYRICS":
+		// Unlike other fields every value is kept: a file may carry both LRC and plain lyrics
+		m.Lyrics = append(m.Lyrics, TaggedLyrics{Text: value})
+	}
+}
+
+func normalizeTagKey(key string) string {
+	key = strings.ToUpper(strings.TrimSpace(key))
+	return strings.NewReplacer(" ", "", "_", "").Replace(key)
+}
+
+// parseNumberPair parses "3", "3/12" or "03 of 12" style values
+func parseNumberPair(value string) (int, int) {
+	value = strings.TrimSpace(value)
+	var first, second string
+	if i := strings.IndexAny(value, "/\\"); i >= 0 {
+		first, second = value[:i], value[i+1:]
+	} else if i := strings.Index(strings.ToLower(value), " of "); i >= 0 {
+		first, second = value[:i], value[i+4:]
+	} else {
+		first = value
+	}
+	return leadingInt(first), leadingInt(second)
+}
+
+// parseYear extracts a year from "1994", "1994-05-02" or "1994-05-02T00:00:00"
+func parseYear(value string) int {
+	value = strings.TrimSpace(value)
+	if len(value) >= 4 {
+		if y, err := strconv.Atoi(value[:4]); err == nil && y > 0 {
+			return y
+		}
+	}
+	return 0
+}
+
+// leadingInt parses the leading decimal digits of s, ignoring surrounding whitespace
+func leadingInt(s string) int {
+	s = strings.TrimSpace(s)
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	if end == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+// ReadTags reads embedded tags and stream properties from a media file.
+// Supported containers are MP3 (ID3v2.2/2.3/2.4, ID3v1, APEv2), FLAC and
+// Ogg (Vorbis comments in FLAC, Vorbis and Opus streams), MP4 (M4A/AAC/ALAC
+// atoms), Monkey's Audio and WavPack (APEv2) and WAV (RIFF INFO).
+// The returned Metadata may have empty descriptive fields when the file has
+// no tags; callers decide how to fall back.
+func ReadTags(filePath string) (*Metadata, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return readTags(f, info.Size(), strings.ToLower(filepath.Ext(filePath)))
+}
+
+// readTags sniffs the container format and dispatches to the matching reader
+func readTags(r io.ReaderAt, size int64, ext string) (*Metadata, error) {
+	// An ID3v2 tag may precede any container (it is common in front of FLAC too)
+	id3v2, audioStart, err := readID3v2(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 12)
+	n, _ := r.ReadAt(magic, audioStart)
+	magic = magic[:n]
+
+	var meta *Metadata
+	switch {
+	case bytes.HasPrefix(magic, []byte("fLaC")):
+		meta, err = readFLAC(r, size, audioStart)
+	case bytes.HasPrefix(magic, []byte("OggS")):
+		meta, err = readOgg(r, size, audioStart)
+	case len(magic) >= 8 && string(magic[4:8]) == "ftyp":
+		meta, err = readMP4(r, size)
+	case bytes.HasPrefix(magic, []byte("MAC ")):
+		meta, err = readMonkeysAudio(r, size, audioStart)
+	case bytes.HasPrefix(magic, []byte("wvpk")):
+		meta, err = readWavPack(r, size, audioStart)
+	case bytes.HasPrefix(magic, []byte("RIFF")) && len(magic) >= 12 && string(magic[8:12]) == "WAVE":
+		meta, err = readWAV(r, size)
+	case ext == ".mp3" || id3v2 != nil || isMPEGSync(magic):
+		meta, err = readMPEG(r, size, audioStart)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Precedence for descriptive fields: container-native tags, then ID3v2
+	// (the native tag for MPEG), then APEv2, then ID3v1.
+	result := &Metadata{}
+	result.merge(meta)
+	result.merge(id3v2)
+
+	apeEnd := size
+	id3v1 := readID3v1(r, size)
+	if id3v1 != nil {
+		apeEnd -= id3v1Size
+	}
+	if ape, _ := readAPEv2(r, apeEnd); ape != nil {
+		result.merge(ape)
+	}
+	result.merge(id3v1)
+	fillInt(&result.Year, result.originalYear)
+
+	return result, nil
+}
+
+// readBytes reads exactly n bytes at off
+func readBytes(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	if n < 0 || off < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	read, err := r.ReadAt(buf, off)
+	if read == n {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// bitrateKbps derives an average bitrate from an audio payload size and a duration
+func bitrateKbps(audioBytes int64, durationMs int) int {
+	if audioBytes <= 0 || durationMs <= 0 {
+		return 0
+	}
+	return int(audioBytes * 8 / int64(durationMs))
+}
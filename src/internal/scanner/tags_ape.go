@@ -0,0 +1,236 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const apeFooterSize = 32
+
+// readAPEv2 reads an APEv2 tag whose footer ends at end (the file size, or
+// the start of a trailing ID3v1 tag). It returns nil when there is no tag.
+func readAPEv2(r io.ReaderAt, end int64) (*Metadata, error) {
+	if end < apeFooterSize {
+		return nil, nil
+	}
+	footer, err := readBytes(r, end-apeFooterSize, apeFooterSize)
+	if err != nil || string(footer[:8]) != "APETAGEX" {
+		return nil, nil
+	}
+
+	tagSize := int64(binary.LittleEndian.Uint32(footer[12:16])) // items + footer
+	count := int(binary.LittleEndian.Uint32(footer[16:20]))
+	if tagSize < apeFooterSize || tagSize > end || tagSize > maxOggHeaderPacket {
+		return nil, errMalformedStream
+	}
+
+	items, err := readBytes(r, end-tagSize, int(tagSize-apeFooterSize))
+	if err != nil {
+		return nil, errMalformedStream
+	}
+
+	meta := &Metadata{}
+	pos := 0
+	for i := 0; i < count && pos+8 < len(items); i++ {
+		valueLen := int(binary.LittleEndian.Uint32(items[pos:]))
+		flags := binary.LittleEndian.Uint32(items[pos+4:])
+		pos += 8
+
+		keyEnd := bytes.IndexByte(items[pos:], 0)
+		if keyEnd < 0 {
+			break
+		}
+		key := string(items[pos : pos+keyEnd])
+		pos += keyEnd + 1
+		if valueLen < 0 || pos+valueLen > len(items) {
+			break
+		}
+		value := items[pos : pos+valueLen]
+		pos += valueLen
+
+		// Bits 1-2 hold the item type; only UTF-8 text items (0) carry tag values
+		if (flags>>1)&0x03 != 0 {
+			continue
+		}
+		// Multiple values are null separated; keep the first
+		if i := bytes.IndexByte(value, 0); i >= 0 {
+			value = value[:i]
+		}
+		meta.setField(key, string(value))
+	}
+	return meta, nil
+}
+
+// readMonkeysAudio reads the stream header of a Monkey's Audio (.ape) file
+func readMonkeysAudio(r io.ReaderAt, size int64, start int64) (*Metadata, error) {
+	b, err := readBytes(r, start, 6)
+	if err != nil {
+		return nil, errMalformedStream
+	}
+	version := int(binary.LittleEndian.Uint16(b[4:6]))
+
+	var compression, formatFlags, channels, bitDepth int
+	var sampleRate int
+	var totalFrames, finalFrameBlocks, blocksPerFrame int64
+
+	if version >= 3980 {
+		// APE_DESCRIPTOR (descriptor length at offset 8) followed by APE_HEADER
+		desc, err := readBytes(r, start, 12)
+		if err != nil {
+			return nil, errMalformedStream
+		}
+		descLen := int64(binary.LittleEndian.Uint32(desc[8:12]))
+		h, err := readBytes(r, start+descLen, 24)
+		if err != nil {
+			return nil, errMalformedStream
+		}
+		compression = int(binary.LittleEndian.Uint16(h[0:2]))
+		formatFlags = int(binary.LittleEndian.Uint16(h[2:4]))
+		blocksPerFrame = int64(binary.LittleEndian.Uint32(h[4:8]))
+		finalFrameBlocks = int64(binary.LittleEndian.Uint32(h[8:12]))
+		totalFrames = int64(binary.LittleEndian.Uint32(h[12:16]))
+		bitDepth = int(binary.LittleEndian.Uint16(h[16:18]))
+		channels = int(binary.LittleEndian.Uint16(h[18:20]))
+		sampleRate = int(binary.LittleEndian.Uint32(h[20:24]))
+	} else {
+		h, err := readBytes(r, start, 32)
+		if err != nil {
+			return nil, errMalformedStream
+		}
+		compression = int(binary.LittleEndian.Uint16(h[6:8]))
+		formatFlags = int(binary.LittleEndian.Uint16(h[8:10]))
+		channels = int(binary.LittleEndian.Uint16(h[10:12]))
+		sampleRate = int(binary.LittleEndian.Uint32(h[12:16]))
+		totalFrames = int64(binary.LittleEndian.Uint32(h[24:28]))
+		finalFrameBlocks = int64(binary.LittleEndian.Uint32(h[28:32]))
+
+		switch {
+		case version >= 3950:
+			blocksPerFrame = 73728 * 4
+		case version >= 3900 || (version >= 3800 && compression == 4000):
+			blocksPerFrame = 73728
+		default:
+			blocksPerFrame = 9216
+		}
+		switch {
+		case formatFlags&0x01 != 0:
+			bitDepth = 8
+		case formatFlags&0x08 != 0:
+			bitDepth = 24
+		default:
+			bitDepth = 16
+		}
+	}
+
+	meta := &Metadata{SampleRate: sampleRate, Channels: channels, BitDepth: bitDepth}
+	if totalFrames > 0 && sampleRate > 0 {
+		samples := (totalFrames-1)*blocksPerFrame + finalFrameBlocks
+		meta.Duration = int(samples * 1000 / int64(sampleRate))
+		meta.Bitrate = bitrateKbps(size-start, meta.Duration)
+	}
+	return meta, nil
+}
+
+// wavPackSampleRates maps the 4-bit rate index in WavPack block flags
+var wavPackSampleRates = []int{6000, 8000, 9600, 11025, 12000, 16000, 22050, 24000,
+	32000, 44100, 48000, 64000, 88200, 96000, 192000}
+
+// readWavPack reads the first WavPack block header
+func readWavPack(r io.ReaderAt, size int64, start int64) (*Metadata, error) {
+	h, err := readBytes(r, start, 32)
+	if err != nil {
+		return nil, errMalformedStream
+	}
+	totalSamples := binary.LittleEndian.Uint32(h[12:16])
+	flags := binary.LittleEndian.Uint32(h[24:28])
+
+	meta := &Metadata{
+		BitDepth: int(flags&0x03+1) * 8,
+		Channels: 2,
+	}
+	if flags&0x04 != 0 {
+		meta.Channels = 1
+	}
+	if idx := int(flags>>23) & 0x0f; idx < len(wavPackSampleRates) {
+		meta.SampleRate = wavPackSampleRates[idx]
+	}
+	if totalSamples != 0xFFFFFFFF && meta.SampleRate > 0 {
+		meta.Duration = int(int64(totalSamples) * 1000 / int64(meta.SampleRate))
+		meta.Bitrate = bitrateKbps(size-start, meta.Duration)
+	}
+	return meta, nil
+}
+
+// riffInfoFields maps RIFF LIST/INFO chunk IDs to tag keys
+var riffInfoFields = map[string]string{
+	"IART": "ARTIST",
+	"INAM": "TITLE",
+	"IPRD": "ALBUM",
+	"ICRD": "DATE",
+	"IGNR": "GENRE",
+	"ITRK": "TRACKNUMBER",
+	"IPRT": "TRACKNUMBER",
+}
+
+// readWAV reads the fmt and LIST/INFO chunks of a RIFF WAVE file
+func readWAV(r io.ReaderAt, size int64) (*Metadata, error) {
+	meta := &Metadata{}
+	var byteRate, dataSize int64
+
+	for pos := int64(12); pos+8 <= size; {
+		h, err := readBytes(r, pos, 8)
+		if err != nil {
+			break
+		}
+		id := string(h[:4])
+		length := int64(binary.LittleEndian.Uint32(h[4:8]))
+		body := pos + 8
+
+		switch id {
+		case "fmt ":
+			f, err := readBytes(r, body, 16)
+			if err != nil {
+				return nil, errMalformedStream
+			}
+			meta.Channels = int(binary.LittleEndian.Uint16(f[2:4]))
+			meta.SampleRate = int(binary.LittleEndian.Uint32(f[4:8]))
+			byteRate = int64(binary.LittleEndian.Uint32(f[8:12]))
+			meta.BitDepth = int(binary.LittleEndian.Uint16(f[14:16]))
+		case "data":
+			dataSize = length
+			if body+dataSize > size {
+				dataSize = size - body
+			}
+		case "LIST":
+			if length >= 4 && length <= 1024*1024 {
+				if list, err := readBytes(r, body, int(length)); err == nil && string(list[:4]) == "INFO" {
+					readRIFFInfo(meta, list[4:])
+				}
+			}
+		}
+
+		pos = body + length + length%2 // chunks are word aligned
+	}
+
+	if byteRate > 0 && dataSize > 0 {
+		meta.Duration = int(dataSize * 1000 / byteRate)
+		meta.Bitrate = int(byteRate * 8 / 1000)
+	}
+	return meta, nil
+}
+
+func readRIFFInfo(meta *Metadata, b []byte) {
+	for pos := 0; pos+8 <= len(b); {
+		id := string(b[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		pos += 8
+		if length < 0 || pos+length > len(b) {
+			return
+		}
+		if key, ok := riffInfoFields[id]; ok {
+			meta.setField(key, string(bytes.TrimRight(b[pos:pos+length], "\x00")))
+		}
+		pos += length + length%2
+	}
+}
@@ -0,0 +1,580 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const id3v1Size = 128
+
+// readID3v2 parses an ID3v2 tag at the start of the file. It returns the
+// parsed metadata (nil when there is no tag) and the offset of the first byte
+// after the tag.
+func readID3v2(r io.ReaderAt, size int64) (*Metadata, int64, error) {
+	header, err := readBytes(r, 0, 10)
+	if err != nil || string(header[:3]) != "ID3" {
+		return nil, 0, nil
+	}
+
+	major := header[3]
+	flags := header[5]
+	tagSize := int64(syncsafe(header[6:10]))
+	end := 10 + tagSize
+	if flags&0x10 != 0 { // footer present (v2.4)
+		end += 10
+	}
+	if end > size {
+		return nil, 0, nil
+	}
+	if major < 2 || major > 4 {
+		return nil, end, nil
+	}
+
+	body, err := readBytes(r, 10, int(tagSize))
+	if err != nil {
+		return nil, end, nil
+	}
+
+	// v2.2/v2.3 unsynchronise the whole tag; v2.4 does it per frame
+	if flags&0x80 != 0 && major < 4 {
+		body = removeUnsync(body)
+	}
+
+	if flags&0x40 != 0 && major >= 3 && len(body) >= 4 {
+		// Skip the extended header
+		var extSize int
+		if major == 4 {
+			extSize = int(syncsafe(body[:4]))
+		} else {
+			extSize = int(binary.BigEndian.Uint32(body[:4])) + 4
+		}
+		if extSize > len(body) {
+			return nil, end, nil
+		}
+		body = body[extSize:]
+	}
+
+	meta := &Metadata{}
+	parseID3v2Frames(meta, body, major)
+	return meta, end, nil
+}
+
+// parseID3v2Frames walks the frames of an ID3v2 tag body
+func parseID3v2Frames(meta *Metadata, body []byte, major byte) {
+	idLen, headerLen := 4, 10
+	if major == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for pos := 0; pos+headerLen <= len(body); {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			break // padding
+		}
+
+		var frameSize int
+		var formatFlags byte
+		switch major {
+		case 2:
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[pos+4 : pos+8]))
+			formatFlags = body[pos+9]
+		default:
+			frameSize = int(syncsafe(body[pos+4 : pos+8]))
+			formatFlags = body[pos+9]
+		}
+		pos += headerLen
+		if frameSize <= 0 || pos+frameSize > len(body) {
+			break
+		}
+		data := body[pos : pos+frameSize]
+		pos += frameSize
+
+		if major == 3 && formatFlags&0xC0 != 0 {
+			continue // compressed or encrypted
+		}
+		if major == 4 {
+			if formatFlags&0x0C != 0 {
+				continue // compressed or encrypted
+			}
+			if formatFlags&0x40 != 0 && len(data) > 0 {
+				data = data[1:] // group identifier
+			}
+			if formatFlags&0x01 != 0 && len(data) >= 4 {
+				data = data[4:] // data length indicator
+			}
+			if formatFlags&0x02 != 0 {
+				data = removeUnsync(data)
+			}
+		}
+
+		applyID3v2Frame(meta, id, data)
+	}
+}
+
+// applyID3v2Frame maps a single frame onto Metadata. v2.2 three-character IDs
+// are handled alongside their v2.3/v2.4 equivalents.
+func applyID3v2Frame(meta *Metadata, id string, data []byte) {
+	switch id {
+	case "TPE1", "TP1":
+		fillString(&meta.Artist, id3Text(data))
+	case "TPE2", "TP2":
+		fillString(&meta.AlbumArtist, id3Text(data))
+	case "TALB", "TAL":
+		fillString(&meta.Album, id3Text(data))
+	case "TIT2", "TT2":
+		fillString(&meta.Title, id3Text(data))
+	case "TRCK", "TRK":
+		meta.setField("TRACKNUMBER", id3Text(data))
+	case "TPOS", "TPA":
+		meta.setField("DISCNUMBER", id3Text(data))
+	case "TYER", "TYE", "TDRC":
+		fillInt(&meta.Year, parseYear(id3Text(data)))
+	case "TDOR", "TORY", "TOR":
+		fillInt(&meta.originalYear, parseYear(id3Text(data)))
+	case "TCON", "TCO":
+		fillString(&meta.Genre, id3Genre(id3Text(data)))
+	case "TXXX", "TXX":
+		desc, value := id3UserText(data)
+		meta.setField(desc, value)
+	case "USLT", "ULT":
+		if lyrics, ok := id3UnsyncedLyrics(data); ok {
+			meta.Lyrics = append(meta.Lyrics, lyrics)
+		}
+	case "SYLT", "SLT":
+		if lyrics, ok := id3SyncedLyrics(data); ok {
+			meta.Lyrics = append(meta.Lyrics, lyrics)
+		}
+	case "UFID", "UFI":
+		if i := bytes.IndexByte(data, 0); i >= 0 && string(data[:i]) == "http://musicbrainz.org" {
+			fillString(&meta.MusicBrainzTrackID, string(data[i+1:]))
+		}
+	}
+}
+
+// id3Text decodes a text frame, returning the first value of multi-valued frames
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	values := splitID3Strings(data[0], data[1:])
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+// id3UserText decodes a TXXX frame into its description and value
+func id3UserText(data []byte) (string, string) {
+	if len(data) == 0 {
+		return "", ""
+	}
+	values := splitID3Strings(data[0], data[1:])
+	if len(values) < 2 {
+		return "", ""
+	}
+	return values[0], values[1]
+}
+
+// id3UnsyncedLyrics decodes a USLT frame: encoding, language, content
+// descriptor and the lyrics text
+func id3UnsyncedLyrics(data []byte) (TaggedLyrics, bool) {
+	if len(data) < 5 {
+		return TaggedLyrics{}, false
+	}
+	_, raw := id3TerminatedString(data[0], data[4:])
+	text := strings.TrimSpace(strings.TrimRight(decodeID3String(data[0], raw), "\x00"))
+	if text == "" {
+		return TaggedLyrics{}, false
+	}
+	return TaggedLyrics{Lang: id3Language(data[1:4]), Text: text}, true
+}
+
+// id3SyncedLyrics decodes a SYLT frame into LRC text. Each entry is a text
+// and the millisecond it starts at. Entries beginning with a line break start
+// a new line; when some do, the others are syllables of the current line.
+// Timestamps in MPEG frames are not supported.
+func id3SyncedLyrics(data []byte) (TaggedLyrics, bool) {
+	const millisecondTimestamps = 2
+	if len(data) < 6 || data[4] != millisecondTimestamps {
+		return TaggedLyrics{}, false
+	}
+	encoding := data[0]
+	_, rest := id3TerminatedString(encoding, data[6:]) // content descriptor
+
+	type entry struct {
+		start   uint32
+		text    string
+		newLine bool
+	}
+	var entries []entry
+	byLineBreak := false
+	for len(rest) > 0 {
+		var raw []byte
+		raw, rest = id3TerminatedString(encoding, rest)
+		if len(rest) < 4 {
+			break
+		}
+		text := decodeID3String(encoding, raw)
+		e := entry{start: binary.BigEndian.Uint32(rest), newLine: strings.HasPrefix(text, "\n") || strings.HasPrefix(text, "\r")}
+		e.text = strings.Trim(text, "\r\n")
+		byLineBreak = byLineBreak || e.newLine
+		entries = append(entries, e)
+		rest = rest[4:]
+	}
+
+	var lines []string
+	for i, e := range entries {
+		if byLineBreak && !e.newLine && i > 0 {
+			lines[len(lines)-1] += e.text
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[%02d:%02d.%03d]%s", e.start/60000, e.start/1000%60, e.start%1000, e.text))
+	}
+	if len(lines) == 0 {
+		return TaggedLyrics{}, false
+	}
+	return TaggedLyrics{Lang: id3Language(data[1:4]), Text: strings.Join(lines, "\n")}, true
+}
+
+// id3TerminatedString splits a string terminated in the given ID3 text
+// encoding off the front of data
+func id3TerminatedString(encoding byte, data []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[:i], data[i+2:]
+			}
+		}
+		return data, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+// id3Language returns a frame's ISO 639-2 language code, empty when unset
+func id3Language(b []byte) string {
+	lang := strings.ToLower(strings.Trim(string(b), "\x00 "))
+	if lang == "xxx" || len(lang) != 3 {
+		return ""
+	}
+	return lang
+}
+
+// splitID3Strings decodes a null-separated list of strings in the given ID3 text encoding
+func splitID3Strings(encoding byte, data []byte) []string {
+	var parts [][]byte
+	if encoding == 1 || encoding == 2 {
+		// UTF-16 terminators are two zero bytes on an even boundary
+		start := 0
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				parts = append(parts, data[start:i])
+				start = i + 2
+			}
+		}
+		if start < len(data) {
+			parts = append(parts, data[start:])
+		}
+	} else {
+		parts = bytes.Split(data, []byte{0})
+	}
+
+	values := make([]string, 0, len(parts))
+	for _, p := range parts {
+		values = append(values, decodeID3String(encoding, p))
+	}
+	// Drop the empty trailing element left by a terminating null
+	for len(values) > 0 && values[len(values)-1] == "" {
+		values = values[:len(values)-1]
+	}
+	return values
+}
+
+// decodeID3String converts bytes in an ID3 text encoding to a Go string
+func decodeID3String(encoding byte, b []byte) string {
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(b) >= 2 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				bigEndian, b = false, b[2:]
+			} else if b[0] == 0xFE && b[1] == 0xFF {
+				bigEndian, b = true, b[2:]
+			}
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[2*i:])
+			}
+		}
+		return string(utf16.Decode(units))
+	default: // UTF-8
+		return string(b)
+	}
+}
+
+// id3Genre resolves numeric genre references such as "(17)", "17" or "(17)Rock"
+func id3Genre(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "(") {
+		if end := strings.Index(value, ")"); end > 0 {
+			if rest := strings.TrimSpace(value[end+1:]); rest != "" {
+				return rest
+			}
+			value = value[1:end]
+		}
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n >= 0 && n < len(id3v1Genres) {
+			return id3v1Genres[n]
+		}
+		return ""
+	}
+	return value
+}
+
+// readID3v1 reads the fixed 128-byte ID3v1/1.1 tag at the end of the file
+func readID3v1(r io.ReaderAt, size int64) *Metadata {
+	if size < id3v1Size {
+		return nil
+	}
+	b, err := readBytes(r, size-id3v1Size, id3v1Size)
+	if err != nil || string(b[:3]) != "TAG" {
+		return nil
+	}
+
+	field := func(start, end int) string {
+		return strings.TrimSpace(decodeID3String(0, bytes.TrimRight(b[start:end], "\x00 ")))
+	}
+
+	meta := &Metadata{
+		Title:  field(3, 33),
+		Artist: field(33, 63),
+		Album:  field(63, 93),
+		Year:   leadingInt(field(93, 97)),
+	}
+	// ID3v1.1 stores the track number in the last byte of the comment
+	if b[125] == 0 && b[126] != 0 {
+		meta.TrackNumber = int(b[126])
+	}
+	if int(b[127]) < len(id3v1Genres) {
+		meta.Genre = id3v1Genres[b[127]]
+	}
+	return meta
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// removeUnsync reverses ID3 unsynchronisation (0xFF 0x00 -> 0xFF)
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+// id3v1Genres is the ID3v1 genre table including the Winamp extensions
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+	"Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson", "Opera",
+	"Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove", "Satire", "Slow Jam",
+	"Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall", "Goa", "Drum & Bass",
+	"Club-House", "Hardcore", "Terror", "Indie", "BritPop", "Negerpunk", "Polsk Punk", "Beat",
+	"Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover", "Contemporary Christian", "Christian Rock", "Merengue", "Salsa",
+	"Thrash Metal", "Anime", "JPop", "Synthpop",
+}
+
+// MPEG audio frame tables, indexed by [version][layer][index]
+var mpegBitrates = [2][3][16]int{
+	{ // MPEG-1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	{ // MPEG-2 and MPEG-2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+var mpegSampleRates = [3]int{44100, 48000, 32000}
+
+// mpegFrame is a decoded MPEG audio frame header
+type mpegFrame struct {
+	mpeg1           bool
+	layer           int // 1, 2 or 3
+	bitrate         int // kbps
+	sampleRate      int
+	channels        int
+	samplesPerFrame int
+	length          int // bytes including header
+}
+
+func isMPEGSync(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0
+}
+
+// parseMPEGHeader decodes a four byte frame header
+func parseMPEGHeader(b []byte) (mpegFrame, bool) {
+	var f mpegFrame
+	if len(b) < 4 || !isMPEGSync(b) {
+		return f, false
+	}
+
+	version := (b[1] >> 3) & 0x03 // 0: 2.5, 2: 2, 3: 1
+	layerBits := (b[1] >> 1) & 0x03
+	bitrateIdx := b[2] >> 4
+	rateIdx := (b[2] >> 2) & 0x03
+	padding := int((b[2] >> 1) & 0x01)
+	if version == 1 || layerBits == 0 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return f, false
+	}
+
+	f.mpeg1 = version == 3
+	f.layer = 4 - int(layerBits)
+	table := 1
+	if f.mpeg1 {
+		table = 0
+	}
+	f.bitrate = mpegBitrates[table][f.layer-1][bitrateIdx]
+	f.sampleRate = mpegSampleRates[rateIdx]
+	switch version {
+	case 2:
+		f.sampleRate /= 2
+	case 0:
+		f.sampleRate /= 4
+	}
+	f.channels = 2
+	if b[3]>>6 == 3 {
+		f.channels = 1
+	}
+
+	switch {
+	case f.layer == 1:
+		f.samplesPerFrame = 384
+		f.length = (12*f.bitrate*1000/f.sampleRate + padding) * 4
+	case f.layer == 3 && !f.mpeg1:
+		f.samplesPerFrame = 576
+		f.length = 72*f.bitrate*1000/f.sampleRate + padding
+	default:
+		f.samplesPerFrame = 1152
+		f.length = 144*f.bitrate*1000/f.sampleRate + padding
+	}
+	return f, f.length > 4
+}
+
+// readMPEG locates the first audio frame after audioStart and derives stream
+// properties from a Xing/Info or VBRI header, or from the CBR frame bitrate.
+func readMPEG(r io.ReaderAt, size int64, audioStart int64) (*Metadata, error) {
+	const searchWindow = 64 * 1024
+
+	buf := make([]byte, searchWindow)
+	n, _ := r.ReadAt(buf, audioStart)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		frame, ok := parseMPEGHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		// Require the following frame to line up, unless the file ends first
+		if next := i + frame.length; next+4 <= len(buf) {
+			if _, ok := parseMPEGHeader(buf[next:]); !ok {
+				continue
+			}
+		}
+
+		meta := &Metadata{SampleRate: frame.sampleRate, Channels: frame.channels}
+		frameOffset := audioStart + int64(i)
+		audioBytes := size - frameOffset
+		if readID3v1(r, size) != nil {
+			audioBytes -= id3v1Size
+		}
+
+		frames, vbrBytes := mpegVBRInfo(buf[i:], frame)
+		if frames > 0 {
+			meta.Duration = int(int64(frames) * int64(frame.samplesPerFrame) * 1000 / int64(frame.sampleRate))
+			if vbrBytes > 0 {
+				audioBytes = int64(vbrBytes)
+			}
+			meta.Bitrate = bitrateKbps(audioBytes, meta.Duration)
+		} else {
+			meta.Bitrate = frame.bitrate
+			meta.Duration = int(audioBytes * 8 / int64(frame.bitrate))
+		}
+		return meta, nil
+	}
+
+	return &Metadata{}, nil
+}
+
+// mpegVBRInfo reads the frame and byte counts from a Xing/Info or VBRI header
+// embedded in the first frame. Zero frames means no VBR header was found.
+func mpegVBRInfo(frameData []byte, frame mpegFrame) (frames uint32, byteCount uint32) {
+	sideInfo := 17
+	switch {
+	case frame.mpeg1 && frame.channels == 2:
+		sideInfo = 32
+	case !frame.mpeg1 && frame.channels == 1:
+		sideInfo = 9
+	}
+
+	if off := 4 + sideInfo; off+16 <= len(frameData) {
+		tag := string(frameData[off : off+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(frameData[off+4:])
+			p := off + 8
+			if flags&0x1 != 0 {
+				frames = binary.BigEndian.Uint32(frameData[p:])
+				p += 4
+			}
+			if flags&0x2 != 0 && p+4 <= len(frameData) {
+				byteCount = binary.BigEndian.Uint32(frameData[p:])
+			}
+			return frames, byteCount
+		}
+	}
+
+	if off := 36; off+18 <= len(frameData) && string(frameData[off:off+4]) == "VBRI" {
+		byteCount = binary.BigEndian.Uint32(frameData[off+10:])
+		frames = binary.BigEndian.Uint32(frameData[off+14:])
+	}
+	return frames, byteCount
+}
@@ -0,0 +1,308 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// maxMP4MetadataAtom caps how much of a metadata atom we load (cover art lives in ilst)
+const maxMP4MetadataAtom = 32 * 1024 * 1024
+
+// mp4Atom is a box header inside an MP4/QuickTime file
+type mp4Atom struct {
+	kind    string
+	dataPos int64 // first byte after the header
+	end     int64 // first byte after the atom
+}
+
+// readMP4Atoms lists the atoms between start and end
+func readMP4Atoms(r io.ReaderAt, start, end int64) []mp4Atom {
+	var atoms []mp4Atom
+	for pos := start; pos+8 <= end; {
+		header, err := readBytes(r, pos, 8)
+		if err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0: // extends to end of the enclosing container
+			size = end - pos
+		case 1: // 64-bit size follows the type
+			ext, err := readBytes(r, pos+8, 8)
+			if err != nil {
+				return atoms
+			}
+			size = int64(binary.BigEndian.Uint64(ext))
+			headerLen = 16
+		}
+		if size < headerLen || pos+size > end {
+			break
+		}
+		atoms = append(atoms, mp4Atom{kind: string(header[4:8]), dataPos: pos + headerLen, end: pos + size})
+		pos += size
+	}
+	return atoms
+}
+
+func findMP4Atom(atoms []mp4Atom, kind string) (mp4Atom, bool) {
+	for _, a := range atoms {
+		if a.kind == kind {
+			return a, true
+		}
+	}
+	return mp4Atom{}, false
+}
+
+// readMP4 reads iTunes-style ilst metadata and audio track properties
+func readMP4(r io.ReaderAt, size int64) (*Metadata, error) {
+	moov, ok := findMP4Atom(readMP4Atoms(r, 0, size), "moov")
+	if !ok {
+		return nil, errMalformedStream
+	}
+	meta := &Metadata{}
+	moovChildren := readMP4Atoms(r, moov.dataPos, moov.end)
+
+	if mvhd, ok := findMP4Atom(moovChildren, "mvhd"); ok {
+		if timescale, duration := readMP4Duration(r, mvhd); timescale > 0 {
+			meta.Duration = int(duration * 1000 / timescale)
+		}
+	}
+
+	for _, trak := range moovChildren {
+		if trak.kind == "trak" && readMP4AudioTrack(r, trak, meta) {
+			break
+		}
+	}
+
+	if udta, ok := findMP4Atom(moovChildren, "udta"); ok {
+		if metaAtom, ok := findMP4Atom(readMP4Atoms(r, udta.dataPos, udta.end), "meta"); ok {
+			readMP4Meta(r, metaAtom, meta)
+		}
+	}
+
+	if meta.Bitrate == 0 {
+		if mdat, ok := findMP4Atom(readMP4Atoms(r, 0, size), "mdat"); ok {
+			meta.Bitrate = bitrateKbps(mdat.end-mdat.dataPos, meta.Duration)
+		}
+	}
+	return meta, nil
+}
+
+// readMP4Duration decodes the timescale and duration of an mvhd or mdhd atom
+func readMP4Duration(r io.ReaderAt, atom mp4Atom) (int64, int64) {
+	b, err := readBytes(r, atom.dataPos, 32)
+	if err != nil {
+		return 0, 0
+	}
+	if b[0] == 1 { // version 1: 64-bit creation/modification times and duration
+		return int64(binary.BigEndian.Uint32(b[20:24])), int64(binary.BigEndian.Uint64(b[24:32]))
+	}
+	return int64(binary.BigEndian.Uint32(b[12:16])), int64(binary.BigEndian.Uint32(b[16:20]))
+}
+
+// readMP4AudioTrack fills stream properties from the first sound track and
+// reports whether trak was an audio track
+func readMP4AudioTrack(r io.ReaderAt, trak mp4Atom, meta *Metadata) bool {
+	mdia, ok := findMP4Atom(readMP4Atoms(r, trak.dataPos, trak.end), "mdia")
+	if !ok {
+		return false
+	}
+	mdiaChildren := readMP4Atoms(r, mdia.dataPos, mdia.end)
+	hdlr, ok := findMP4Atom(mdiaChildren, "hdlr")
+	if !ok {
+		return false
+	}
+	if h, err := readBytes(r, hdlr.dataPos, 12); err != nil || string(h[8:12]) != "soun" {
+		return false
+	}
+
+	if mdhd, ok := findMP4Atom(mdiaChildren, "mdhd"); ok && meta.Duration == 0 {
+		if timescale, duration := readMP4Duration(r, mdhd); timescale > 0 {
+			meta.Duration = int(duration * 1000 / timescale)
+		}
+	}
+
+	minf, ok := findMP4Atom(mdiaChildren, "minf")
+	if !ok {
+		return true
+	}
+	stbl, ok := findMP4Atom(readMP4Atoms(r, minf.dataPos, minf.end), "stbl")
+	if !ok {
+		return true
+	}
+	stsd, ok := findMP4Atom(readMP4Atoms(r, stbl.dataPos, stbl.end), "stsd")
+	if !ok {
+		return true
+	}
+
+	// stsd: version/flags (4), entry count (4), then sample entries
+	entries := readMP4Atoms(r, stsd.dataPos+8, stsd.end)
+	if len(entries) == 0 {
+		return true
+	}
+	entry := entries[0]
+	b, err := readBytes(r, entry.dataPos, 28)
+	if err != nil {
+		return true
+	}
+	// AudioSampleEntry: reserved (6), data ref (2), reserved (8), channels, sample size,
+	// compression id, packet size, sample rate as 16.16 fixed point
+	meta.Channels = int(binary.BigEndian.Uint16(b[16:18]))
+	meta.SampleRate = int(binary.BigEndian.Uint32(b[24:28]) >> 16)
+
+	for _, child := range readMP4Atoms(r, entry.dataPos+28, entry.end) {
+		switch child.kind {
+		case "esds":
+			if avg := readESDSAvgBitrate(r, child); avg > 0 {
+				meta.Bitrate = avg / 1000
+			}
+		case "alac":
+			if cfg, err := readBytes(r, child.dataPos, 28); err == nil {
+				// ALACSpecificConfig follows version/flags
+				meta.BitDepth = int(cfg[9])
+				meta.Channels = int(cfg[13])
+				if avg := int(binary.BigEndian.Uint32(cfg[20:24])); avg > 0 {
+					meta.Bitrate = avg / 1000
+				}
+				meta.SampleRate = int(binary.BigEndian.Uint32(cfg[24:28]))
+			}
+		}
+	}
+	return true
+}
+
+// readESDSAvgBitrate extracts avgBitrate from the DecoderConfigDescriptor
+func readESDSAvgBitrate(r io.ReaderAt, esds mp4Atom) int {
+	n := esds.end - esds.dataPos
+	if n <= 4 || n > 4096 {
+		return 0
+	}
+	b, err := readBytes(r, esds.dataPos+4, int(n-4))
+	if err != nil {
+		return 0
+	}
+
+	// Walk descriptors: tag (1), variable length size, payload
+	var walk func(b []byte) int
+	walk = func(b []byte) int {
+		for pos := 0; pos < len(b); {
+			tag := b[pos]
+			pos++
+			length := 0
+			for i := 0; i < 4 && pos < len(b); i++ {
+				c := b[pos]
+				pos++
+				length = length<<7 | int(c&0x7f)
+				if c&0x80 == 0 {
+					break
+				}
+			}
+			if pos+length > len(b) {
+				return 0
+			}
+			payload := b[pos : pos+length]
+			pos += length
+
+			switch tag {
+			case 0x03: // ES_Descriptor: ES_ID (2), flags (1), optional fields, then children
+				if len(payload) < 3 {
+					return 0
+				}
+				flags := payload[2]
+				skip := 3
+				if flags&0x80 != 0 {
+					skip += 2
+				}
+				if flags&0x40 != 0 && skip < len(payload) {
+					skip += 1 + int(payload[skip])
+				}
+				if flags&0x20 != 0 {
+					skip += 2
+				}
+				if skip < len(payload) {
+					return walk(payload[skip:])
+				}
+			case 0x04: // DecoderConfigDescriptor
+				if len(payload) >= 13 {
+					return int(binary.BigEndian.Uint32(payload[9:13]))
+				}
+			}
+		}
+		return 0
+	}
+	return walk(b)
+}
+
+// readMP4Meta parses the ilst item list inside a meta atom
+func readMP4Meta(r io.ReaderAt, metaAtom mp4Atom, meta *Metadata) {
+	// meta is a full box (version/flags) in MP4, but a plain box in some QuickTime files
+	start := metaAtom.dataPos
+	if b, err := readBytes(r, start+4, 4); err == nil && string(b) != "hdlr" {
+		start += 4
+	}
+
+	ilst, ok := findMP4Atom(readMP4Atoms(r, start, metaAtom.end), "ilst")
+	if !ok {
+		return
+	}
+
+	for _, item := range readMP4Atoms(r, ilst.dataPos, ilst.end) {
+		if item.end-item.dataPos > maxMP4MetadataAtom {
+			continue
+		}
+		children := readMP4Atoms(r, item.dataPos, item.end)
+		data, ok := findMP4Atom(children, "data")
+		if !ok || data.end-data.dataPos < 8 {
+			continue
+		}
+		value, err := readBytes(r, data.dataPos+8, int(data.end-data.dataPos-8))
+		if err != nil {
+			continue
+		}
+
+		switch item.kind {
+		case "\xa9ART":
+			fillString(&meta.Artist, string(value))
+		case "aART":
+			fillString(&meta.AlbumArtist, string(value))
+		case "\xa9alb":
+			fillString(&meta.Album, string(value))
+		case "\xa9nam":
+			fillString(&meta.Title, string(value))
+		case "\xa9day":
+			fillInt(&meta.Year, parseYear(string(value)))
+		case "\xa9gen":
+			fillString(&meta.Genre, string(value))
+		case "\xa9lyr":
+			meta.setField("LYRICS", string(value))
+		case "gnre":
+			// ID3v1 genre index plus one
+			if len(value) >= 2 {
+				if idx := int(binary.BigEndian.Uint16(value)) - 1; idx >= 0 && idx < len(id3v1Genres) {
+					fillString(&meta.Genre, id3v1Genres[idx])
+				}
+			}
+		case "trkn", "disk":
+			if len(value) >= 6 {
+				number := int(binary.BigEndian.Uint16(value[2:4]))
+				total := int(binary.BigEndian.Uint16(value[4:6]))
+				if item.kind == "trkn" {
+					fillInt(&meta.TrackNumber, number)
+					fillInt(&meta.TrackTotal, total)
+				} else {
+					fillInt(&meta.DiscNumber, number)
+					fillInt(&meta.DiscTotal, total)
+				}
+			}
+		case "----":
+			// Freeform: mean ("com.apple.iTunes"), name ("MusicBrainz Album Id"), data
+			if name, ok := findMP4Atom(children, "name"); ok && name.end-name.dataPos > 4 {
+				if key, err := readBytes(r, name.dataPos+4, int(name.end-name.dataPos-4)); err == nil {
+					meta.setField(strings.TrimSpace(string(key)), string(value))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func id3v23Frame(id, text string) []byte {
+	var b bytes.Buffer
+	b.WriteString(id)
+	binary.Write(&b, binary.BigEndian, uint32(len(text)+1))
+	b.Write([]byte{0, 0, 3}) // flags, UTF-8 encoding
+	b.WriteString(text)
+	return b.Bytes()
+}
+
+func buildMP3(frames ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, f := range frames {
+		body.Write(f)
+	}
+	size := body.Len()
+
+	var b bytes.Buffer
+	b.WriteString("ID3")
+	b.Write([]byte{3, 0, 0})
+	b.Write([]byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)})
+	b.Write(body.Bytes())
+
+	// 100 CBR frames: MPEG-1 Layer III, 128 kbps, 44.1 kHz, stereo (417 bytes each)
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	for i := 0; i < 100; i++ {
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+func buildFLAC(comments ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+
+	// STREAMINFO: 44.1 kHz, 2 channels, 16 bits, 441000 samples (10 seconds)
+	streamInfo := make([]byte, 34)
+	packed := uint64(44100)<<44 | uint64(1)<<41 | uint64(15)<<36 | uint64(441000)
+	binary.BigEndian.PutUint64(streamInfo[10:18], packed)
+	b.Write([]byte{0x00, 0, 0, 34})
+	b.Write(streamInfo)
+
+	var vc bytes.Buffer
+	binary.Write(&vc, binary.LittleEndian, uint32(4))
+	vc.WriteString("test")
+	binary.Write(&vc, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		binary.Write(&vc, binary.LittleEndian, uint32(len(c)))
+		vc.WriteString(c)
+	}
+	n := vc.Len()
+	b.Write([]byte{0x84, byte(n >> 16), byte(n >> 8), byte(n)})
+	b.Write(vc.Bytes())
+
+	b.Write(make([]byte, 44100)) // audio frames
+	return b.Bytes()
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestReadTags_MP3WithID3v23(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, filepath.Join(dir, "track.mp3"), buildMP3(
+		id3v23Frame("TPE1", "Artist"),
+		id3v23Frame("TPE2", "Album Artist"),
+		id3v23Frame("TALB", "Album"),
+		id3v23Frame("TIT2", "Title"),
+		id3v23Frame("TRCK", "3/12"),
+		id3v23Frame("TPOS", "1/2"),
+		id3v23Frame("TYER", "1994"),
+		id3v23Frame("TCON", "(17)"),
+		id3v23Frame("TXXX", "MusicBrainz Album Id\x00c7a4e0f2-1111-2222-3333-444455556666"),
+	))
+
+	meta, err := ReadTags(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Artist", meta.Artist)
+	assert.Equal(t, "Album Artist", meta.AlbumArtist)
+	assert.Equal(t, "Album", meta.Album)
+	assert.Equal(t, "Title", meta.Title)
+	assert.Equal(t, 3, meta.TrackNumber)
+	assert.Equal(t, 12, meta.TrackTotal)
+	assert.Equal(t, 1, meta.DiscNumber)
+	assert.Equal(t, 2, meta.DiscTotal)
+	assert.Equal(t, 1994, meta.Year)
+	assert.Equal(t, "Rock", meta.Genre)
+	assert.Equal(t, "c7a4e0f2-1111-2222-3333-444455556666", meta.MusicBrainzAlbumID)
+	assert.Equal(t, 128, meta.Bitrate)
+	assert.Equal(t, 44100, meta.SampleRate)
+	assert.Equal(t, 2, meta.Channels)
+	// 100 frames * 417 bytes at 128 kbps
+	assert.InDelta(t, 2606, meta.Duration, 5)
+}
+
+func TestReadTags_FLACVorbisComments(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, filepath.Join(dir, "track.flac"), buildFLAC(
+		"ARTIST=Flac Artist",
+		"ALBUMARTIST=Various Artists",
+		"ALBUM=Flac Album",
+		"TITLE=Flac Title",
+		"TRACKNUMBER=7",
+		"TRACKTOTAL=10",
+		"DISCNUMBER=2",
+		"DATE=2011-04-05",
+		"GENRE=Jazz",
+		"MUSICBRAINZ_TRACKID=aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee",
+	))
+
+	meta, err := ReadTags(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Flac Artist", meta.Artist)
+	assert.Equal(t, "Various Artists", meta.AlbumArtist)
+	assert.Equal(t, "Flac Album", meta.Album)
+	assert.Equal(t, "Flac Title", meta.Title)
+	assert.Equal(t, 7, meta.TrackNumber)
+	assert.Equal(t, 10, meta.TrackTotal)
+	assert.Equal(t, 2, meta.DiscNumber)
+	assert.Equal(t, 2011, meta.Year)
+	assert.Equal(t, "Jazz", meta.Genre)
+	assert.Equal(t, "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", meta.MusicBrainzTrackID)
+	assert.Equal(t, 10000, meta.Duration)
+	assert.Equal(t, 44100, meta.SampleRate)
+	assert.Equal(t, 2, meta.Channels)
+	assert.Equal(t, 16, meta.BitDepth)
+}
+
+func TestReadTags_Lyrics(t *testing.T) {
+	dir := t.TempDir()
+
+	// SYLT: language, millisecond timestamps, lyrics content, empty descriptor
+	// and then text/time pairs
+	sylt := "eng\x02\x01\x00" +
+		"First line\x00\x00\x00\x05\xdc" +
+		"\nSec\x00\x00\x00\x0f\xa0" +
+		"ond line\x00\x00\x00\x10\x68"
+	mp3 := writeTestFile(t, filepath.Join(dir, "track.mp3"), buildMP3(
+		id3v23Frame("TIT2", "Title"),
+		id3v23Frame("USLT", "eng\x00Plain words\nMore words"),
+		id3v23Frame("SYLT", sylt),
+	))
+
+	meta, err := ReadTags(mp3)
+	require.NoError(t, err)
+	require.Len(t, meta.Lyrics, 2)
+	assert.Equal(t, TaggedLyrics{Lang: "eng", Text: "Plain words\nMore words"}, meta.Lyrics[0])
+	assert.Equal(t, TaggedLyrics{Lang: "eng", Text: "[00:01.500]First line\n[00:04.000]Second line"}, meta.Lyrics[1])
+
+	flac := writeTestFile(t, filepath.Join(dir, "track.flac"), buildFLAC(
+		"TITLE=Flac Title",
+		"LYRICS=[00:12.00]Sung line",
+		"UNSYNCEDLYRICS=Sung line",
+	))
+
+	meta, err = ReadTags(flac)
+	require.NoError(t, err)
+	assert.Equal(t, []TaggedLyrics{{Text: "[00:12.00]Sung line"}, {Text: "Sung line"}}, meta.Lyrics)
+}
+
+func TestExtractMetadata_RecordsSource(t *testing.T) {
+	dir := t.TempDir()
+
+	tagged := writeTestFile(t, filepath.Join(dir, "Tagged", "01 - Ignored.flac"), buildFLAC(
+		"ARTIST=A", "ALBUM=B", "TITLE=C", "TRACKNUMBER=1",
+	))
+	meta := extractMetadata(tagged)
+	assert.Equal(t, MetadataSourceTags, meta.Source)
+	assert.Equal(t, "C", meta.Title)
+
+	partial := writeTestFile(t, filepath.Join(dir, "Band - Record", "04 - Song.flac"), buildFLAC(
+		"ARTIST=Tagged Band",
+	))
+	meta = extractMetadata(partial)
+	assert.Equal(t, MetadataSourceMixed, meta.Source)
+	assert.Equal(t, "Tagged Band", meta.Artist)
+	assert.Equal(t, "Record", meta.Album)
+	assert.Equal(t, "Song", meta.Title)
+	assert.Equal(t, 4, meta.TrackNumber)
+	assert.Equal(t, 10000, meta.Duration)
+
+	untagged := writeTestFile(t, filepath.Join(dir, "Band - Record", "05 - Other.wma"), []byte("not really audio"))
+	meta = extractMetadata(untagged)
+	assert.Equal(t, MetadataSourceFilename, meta.Source)
+	assert.Equal(t, "Band", meta.Artist)
+	assert.Equal(t, 5, meta.TrackNumber)
+	assert.Zero(t, meta.Duration, "stream properties must not be invented")
+	assert.Zero(t, meta.Bitrate)
+}
+
+func TestParseNumberPair(t *testing.T) {
+	tests := []struct {
+		in            string
+		number, total int
+	}{
+		{"3", 3, 0},
+		{"03/12", 3, 12},
+		{" 4 of 9 ", 4, 9},
+		{"", 0, 0},
+		{"A1", 0, 0},
+	}
+	for _, tt := range tests {
+		n, total := parseNumberPair(tt.in)
+		assert.Equal(t, tt.number, n, tt.in)
+		assert.Equal(t, tt.total, total, tt.in)
+	}
+}
@@ -0,0 +1,251 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxOggHeaderPacket caps how much of a header packet we buffer; comment
+// packets can carry embedded artwork but nothing legitimate is larger.
+const maxOggHeaderPacket = 32 * 1024 * 1024
+
+var errMalformedStream = errors.New("malformed audio stream")
+
+// readFLAC walks the FLAC metadata blocks for STREAMINFO and VORBIS_COMMENT
+func readFLAC(r io.ReaderAt, size int64, start int64) (*Metadata, error) {
+	meta := &Metadata{}
+	var totalSamples int64
+
+	pos := start + 4 // "fLaC"
+	for {
+		header, err := readBytes(r, pos, 4)
+		if err != nil {
+			return nil, errMalformedStream
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		pos += 4
+
+		switch blockType {
+		case 0: // STREAMINFO
+			data, err := readBytes(r, pos, length)
+			if err != nil || length < 18 {
+				return nil, errMalformedStream
+			}
+			totalSamples = applyStreamInfo(meta, data)
+		case 4: // VORBIS_COMMENT
+			data, err := readBytes(r, pos, length)
+			if err != nil {
+				return nil, errMalformedStream
+			}
+			parseVorbisComment(meta, data)
+		}
+
+		pos += int64(length)
+		if last || pos >= size {
+			break
+		}
+	}
+
+	if meta.SampleRate > 0 && totalSamples > 0 {
+		meta.Duration = int(totalSamples * 1000 / int64(meta.SampleRate))
+		meta.Bitrate = bitrateKbps(size-pos, meta.Duration)
+	}
+	return meta, nil
+}
+
+// applyStreamInfo decodes a FLAC STREAMINFO block and returns the total sample count
+func applyStreamInfo(meta *Metadata, b []byte) int64 {
+	meta.SampleRate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+	meta.Channels = int((b[12]>>1)&0x07) + 1
+	meta.BitDepth = int((b[12]&0x01)<<4|b[13]>>4) + 1
+	return int64(b[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(b[14:18]))
+}
+
+// parseVorbisComment decodes a little-endian Vorbis comment block
+// (vendor string followed by KEY=value entries)
+func parseVorbisComment(meta *Metadata, data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(data))
+	pos := 4 + vendorLen
+	if pos+4 > len(data) || vendorLen < 0 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+
+	for i := 0; i < count && pos+4 <= len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			return
+		}
+		entry := string(data[pos : pos+length])
+		pos += length
+
+		if eq := strings.IndexByte(entry, '='); eq > 0 {
+			meta.setField(entry[:eq], entry[eq+1:])
+		}
+	}
+}
+
+// oggPage is the subset of an Ogg page header we need
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte
+	dataPos  int64
+	next     int64
+}
+
+func readOggPage(r io.ReaderAt, pos int64) (*oggPage, error) {
+	header, err := readBytes(r, pos, 27)
+	if err != nil || string(header[:4]) != "OggS" {
+		return nil, errMalformedStream
+	}
+	nsegs := int(header[26])
+	segments, err := readBytes(r, pos+27, nsegs)
+	if err != nil {
+		return nil, errMalformedStream
+	}
+	payload := 0
+	for _, s := range segments {
+		payload += int(s)
+	}
+	dataPos := pos + 27 + int64(nsegs)
+	return &oggPage{
+		granule:  int64(binary.LittleEndian.Uint64(header[6:14])),
+		serial:   binary.LittleEndian.Uint32(header[14:18]),
+		segments: segments,
+		dataPos:  dataPos,
+		next:     dataPos + int64(payload),
+	}, nil
+}
+
+// readOggPackets reassembles the first n packets of the first logical stream
+func readOggPackets(r io.ReaderAt, size int64, start int64, n int) ([][]byte, uint32, error) {
+	var packets [][]byte
+	var current []byte
+	var serial uint32
+	first := true
+
+	for pos := start; pos < size && len(packets) < n; {
+		page, err := readOggPage(r, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos = page.next
+		if first {
+			serial, first = page.serial, false
+		} else if page.serial != serial {
+			continue
+		}
+
+		data, err := readBytes(r, page.dataPos, int(page.next-page.dataPos))
+		if err != nil {
+			return nil, 0, errMalformedStream
+		}
+		offset := 0
+		for _, seg := range page.segments {
+			current = append(current, data[offset:offset+int(seg)]...)
+			offset += int(seg)
+			if len(current) > maxOggHeaderPacket {
+				return nil, 0, errMalformedStream
+			}
+			if seg < 255 {
+				packets = append(packets, current)
+				current = nil
+				if len(packets) == n {
+					break
+				}
+			}
+		}
+	}
+
+	if len(packets) < n {
+		return nil, 0, errMalformedStream
+	}
+	return packets, serial, nil
+}
+
+// lastOggGranule finds the granule position of the last page of a stream
+func lastOggGranule(r io.ReaderAt, size int64, serial uint32) int64 {
+	const tail = 128 * 1024
+	start := size - tail
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, size-start)
+	n, _ := r.ReadAt(buf, start)
+	buf = buf[:n]
+
+	for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+		if i+27 > len(buf) {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(buf[i+6 : i+14]))
+		if binary.LittleEndian.Uint32(buf[i+14:i+18]) == serial && granule > 0 {
+			return granule
+		}
+	}
+	return 0
+}
+
+// readOgg handles Vorbis, Opus and FLAC streams in an Ogg container
+func readOgg(r io.ReaderAt, size int64, start int64) (*Metadata, error) {
+	packets, serial, err := readOggPackets(r, size, start, 2)
+	if err != nil {
+		return nil, err
+	}
+	id, comment := packets[0], packets[1]
+	meta := &Metadata{}
+	granule := lastOggGranule(r, size, serial)
+
+	switch {
+	case len(id) >= 28 && id[0] == 1 && string(id[1:7]) == "vorbis":
+		meta.Channels = int(id[11])
+		meta.SampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		if len(comment) > 7 && comment[0] == 3 && string(comment[1:7]) == "vorbis" {
+			parseVorbisComment(meta, comment[7:])
+		}
+		if meta.SampleRate > 0 && granule > 0 {
+			meta.Duration = int(granule * 1000 / int64(meta.SampleRate))
+		}
+
+	case len(id) >= 19 && string(id[:8]) == "OpusHead":
+		meta.Channels = int(id[9])
+		preSkip := int64(binary.LittleEndian.Uint16(id[10:12]))
+		// Opus always decodes at 48 kHz; the header records the original input rate
+		meta.SampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		if meta.SampleRate == 0 {
+			meta.SampleRate = 48000
+		}
+		if len(comment) > 8 && string(comment[:8]) == "OpusTags" {
+			parseVorbisComment(meta, comment[8:])
+		}
+		if granule > preSkip {
+			meta.Duration = int((granule - preSkip) * 1000 / 48000)
+		}
+
+	case len(id) >= 51 && id[0] == 0x7f && string(id[1:5]) == "FLAC" && string(id[9:13]) == "fLaC":
+		applyStreamInfo(meta, id[17:51])
+		if len(comment) > 4 && comment[0]&0x7f == 4 {
+			parseVorbisComment(meta, comment[4:])
+		}
+		if meta.SampleRate > 0 && granule > 0 {
+			meta.Duration = int(granule * 1000 / int64(meta.SampleRate))
+		}
+
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	meta.Bitrate = bitrateKbps(size-start, meta.Duration)
+	return meta, nil
+}
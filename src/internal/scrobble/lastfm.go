@@ -0,0 +1,196 @@
+package scrobble
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lastFMBatchSize is the most scrobbles track.scrobble accepts at once
+const lastFMBatchSize = 50
+
+// LastFM scrobbles to Last.fm with signed calls to its 2.0 web service
+type LastFM struct {
+	client    *http.Client
+	endpoint  string
+	authURL   string
+	apiKey    string
+	apiSecret string
+}
+
+// NewLastFM creates a Last.fm scrobbler for the API account apiKey.
+// endpoint is the web service root and authURL the page users authorize on.
+func NewLastFM(client *http.Client, endpoint, authURL, apiKey, apiSecret string) *LastFM {
+	return &LastFM{
+		client:    client,
+		endpoint:  endpoint,
+		authURL:   authURL,
+		apiKey:    apiKey,
+		apiSecret: apiSecret,
+	}
+}
+
+// Name returns the service name
+func (l *LastFM) Name() string {
+	return ServiceLastFM
+}
+
+// BatchSize returns the most scrobbles submitted at once
+func (l *LastFM) BatchSize() int {
+	return lastFMBatchSize
+}
+
+// AuthURL returns the page where a user grants Melodee access to their
+// account. Last.fm then redirects to callback with a token to Authenticate.
+func (l *LastFM) AuthURL(callback string) string {
+	params := url.Values{"api_key": {l.apiKey}}
+	if callback != "" {
+		params.Set("cb", callback)
+	}
+	return l.authURL + "?" + params.Encode()
+}
+
+// Authenticate exchanges an authorized token for a session key
+func (l *LastFM) Authenticate(ctx context.Context, token string) (Session, error) {
+	var response struct {
+		Session struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"session"`
+	}
+	err := l.call(ctx, "auth.getSession", url.Values{"token": {token}}, &response)
+	if err != nil {
+		return Session{}, err
+	}
+	if response.Session.Key == "" {
+		return Session{}, fmt.Errorf("last.fm: no session in response")
+	}
+	return Session{Key: response.Session.Key, Username: response.Session.Name}, nil
+}
+
+// NowPlaying updates the user's now playing track
+func (l *LastFM) NowPlaying(ctx context.Context, session string, listen Listen) error {
+	params := url.Values{"sk": {session}}
+	setLastFMTrack(params, "", listen)
+	return l.call(ctx, "track.updateNowPlaying", params, nil)
+}
+
+// Scrobble submits up to BatchSize listens
+func (l *LastFM) Scrobble(ctx context.Context, session string, listens []Listen) error {
+	if len(listens) > lastFMBatchSize {
+		return fmt.Errorf("last.fm: at most %d scrobbles per call", lastFMBatchSize)
+	}
+
+	params := url.Values{"sk": {session}}
+	for i, listen := range listens {
+		suffix := fmt.Sprintf("[%d]", i)
+		setLastFMTrack(params, suffix, listen)
+		params.Set("timestamp"+suffix, strconv.FormatInt(listen.PlayedAt.Unix(), 10))
+	}
+	return l.call(ctx, "track.scrobble", params, nil)
+}
+
+// setLastFMTrack sets the track parameters of a listen; scrobbles number them as artist[0], ...
+func setLastFMTrack(params url.Values, suffix string, listen Listen) {
+	params.Set("artist"+suffix, listen.Artist)
+	params.Set("track"+suffix, listen.Track)
+	if listen.Album != "" {
+		params.Set("album"+suffix, listen.Album)
+	}
+	if listen.AlbumArtist != "" && listen.AlbumArtist != listen.Artist {
+		params.Set("albumArtist"+suffix, listen.AlbumArtist)
+	}
+	if listen.TrackNumber > 0 {
+		params.Set("trackNumber"+suffix, strconv.Itoa(listen.TrackNumber))
+	}
+	if listen.Duration > 0 {
+		params.Set("duration"+suffix, strconv.Itoa(int(listen.Duration.Seconds())))
+	}
+}
+
+// call makes a signed POST to the web service and decodes the JSON response
+func (l *LastFM) call(ctx context.Context, method string, params url.Values, out interface{}) error {
+	params.Set("method", method)
+	params.Set("api_key", l.apiKey)
+	params.Set("api_sig", l.sign(params))
+	params.Set("format", "json")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("last.fm: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("last.fm %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("last.fm %s: %w", method, err)
+	}
+
+	// Errors come as {"error": 9, "message": "..."}, usually with a 4xx status
+	var apiErr struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != 0 {
+		return lastFMError(method, apiErr.Error, apiErr.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("last.fm %s: unexpected status %d", method, resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("last.fm %s: invalid response: %w", method, err)
+		}
+	}
+	return nil
+}
+
+// sign computes api_sig: the MD5 of the parameters sorted by name, each name
+// followed by its value, then the shared secret
+func (l *LastFM) sign(params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name == "format" || name == "callback" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(params.Get(name))
+	}
+	b.WriteString(l.apiSecret)
+
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// lastFMError maps a Last.fm error code to ErrUnauthorized, ErrRejected or a temporary error
+func lastFMError(method string, code int, message string) error {
+	switch code {
+	case 4, 9, 10, 14, 15, 26: // authentication failed, invalid session, invalid API key, unauthorized or expired token, suspended API key
+		return fmt.Errorf("last.fm %s: %s (%d): %w", method, message, code, ErrUnauthorized)
+	case 8, 11, 16, 29: // operation failed, service offline, temporarily unavailable, rate limit exceeded
+		return fmt.Errorf("last.fm %s: %s (%d)", method, message, code)
+	}
+	return fmt.Errorf("last.fm %s: %s (%d): %w", method, message, code, ErrRejected)
+}
@@ -0,0 +1,178 @@
+package scrobble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// listenBrainzBatchSize keeps imports well below the server's limit of 1000 listens
+const listenBrainzBatchSize = 100
+
+// ListenBrainz submits listens to a ListenBrainz server with a user token
+type ListenBrainz struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewListenBrainz creates a ListenBrainz scrobbler for the server at endpoint
+func NewListenBrainz(client *http.Client, endpoint string) *ListenBrainz {
+	return &ListenBrainz{
+		client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+	}
+}
+
+// Name returns the service name
+func (l *ListenBrainz) Name() string {
+	return ServiceListenBrainz
+}
+
+// BatchSize returns the most listens submitted at once
+func (l *ListenBrainz) BatchSize() int {
+	return listenBrainzBatchSize
+}
+
+// Authenticate validates a user token; the token itself is the session
+func (l *ListenBrainz) Authenticate(ctx context.Context, token string) (Session, error) {
+	var response struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+	}
+	if err := l.do(ctx, http.MethodGet, "/1/validate-token", token, nil, &response); err != nil {
+		return Session{}, err
+	}
+	if !response.Valid {
+		return Session{}, fmt.Errorf("listenbrainz: invalid token: %w", ErrUnauthorized)
+	}
+	return Session{Key: token, Username: response.UserName}, nil
+}
+
+// listenBrainzSubmission is the body of POST /1/submit-listens
+type listenBrainzSubmission struct {
+	ListenType string               `json:"listen_type"` // "single", "import" or "playing_now"
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+// NowPlaying sets the user's playing now listen
+func (l *ListenBrainz) NowPlaying(ctx context.Context, session string, listen Listen) error {
+	submission := listenBrainzSubmission{
+		ListenType: "playing_now",
+		Payload:    []listenBrainzListen{{TrackMetadata: listenBrainzMetadata(listen)}},
+	}
+	return l.do(ctx, http.MethodPost, "/1/submit-listens", session, submission, nil)
+}
+
+// Scrobble submits up to BatchSize listens
+func (l *ListenBrainz) Scrobble(ctx context.Context, session string, listens []Listen) error {
+	if len(listens) > listenBrainzBatchSize {
+		return fmt.Errorf("listenbrainz: at most %d listens per submission", listenBrainzBatchSize)
+	}
+
+	submission := listenBrainzSubmission{ListenType: "import"}
+	if len(listens) == 1 {
+		submission.ListenType = "single"
+	}
+	for _, listen := range listens {
+		submission.Payload = append(submission.Payload, listenBrainzListen{
+			ListenedAt:    listen.PlayedAt.Unix(),
+			TrackMetadata: listenBrainzMetadata(listen),
+		})
+	}
+	return l.do(ctx, http.MethodPost, "/1/submit-listens", session, submission, nil)
+}
+
+func listenBrainzMetadata(listen Listen) listenBrainzTrackMetadata {
+	info := map[string]interface{}{
+		"submission_client": "Melodee",
+	}
+	if listen.Duration > 0 {
+		info["duration_ms"] = listen.Duration.Milliseconds()
+	}
+	if listen.TrackNumber > 0 {
+		info["tracknumber"] = listen.TrackNumber
+	}
+	return listenBrainzTrackMetadata{
+		ArtistName:     listen.Artist,
+		TrackName:      listen.Track,
+		ReleaseName:    listen.Album,
+		AdditionalInfo: info,
+	}
+}
+
+// do sends a request authorized with the user token and decodes the JSON response
+func (l *ListenBrainz) do(ctx context.Context, method, path, token string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("listenbrainz: %w", err)
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, l.endpoint+path, body)
+	if err != nil {
+		return fmt.Errorf("listenbrainz: %w", err)
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("User-Agent", userAgent)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("listenbrainz %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("listenbrainz %s: %w", path, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("listenbrainz %s: %s: %w", path, listenBrainzMessage(data), ErrUnauthorized)
+	case resp.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("listenbrainz %s: %s: %w", path, listenBrainzMessage(data), ErrRejected)
+	case resp.StatusCode != http.StatusOK:
+		// Rate limits (429) and outages are retried
+		return fmt.Errorf("listenbrainz %s: unexpected status %d", path, resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("listenbrainz %s: invalid response: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// listenBrainzMessage extracts the error from a {"code": 400, "error": "..."} response
+func listenBrainzMessage(data []byte) string {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+		return apiErr.Error
+	}
+	return "request failed"
+}
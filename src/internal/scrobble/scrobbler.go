@@ -0,0 +1,73 @@
+// Package scrobble submits users' plays to external scrobbling services such
+// as Last.fm and ListenBrainz. Users link an account per service; completed
+// plays are queued per account in the scrobble_queue table and submitted in
+// the order they were played by asynq jobs, so plays made while a service is
+// unreachable are replayed once it is back. Now playing updates are sent
+// straight away and are not retried for long.
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Service names accounts are linked under
+const (
+	ServiceLastFM       = "lastfm"
+	ServiceListenBrainz = "listenbrainz"
+)
+
+const (
+	userAgent       = "Melodee Scrobbler"
+	maxResponseSize = 1 << 20
+)
+
+// Errors a Scrobbler reports for failures that retrying cannot fix. Any other
+// error (network failures, rate limits, outages) is temporary and the
+// submission is retried later.
+var (
+	// ErrUnauthorized is returned when a service rejects the account's
+	// session or token; the account has to be linked again
+	ErrUnauthorized = errors.New("scrobbling service rejected the credentials")
+	// ErrRejected is returned when a service refuses the listens themselves;
+	// sending them again would fail the same way
+	ErrRejected = errors.New("scrobbling service rejected the listens")
+)
+
+// Listen is a play of a track as sent to a scrobbling service
+type Listen struct {
+	Artist      string
+	Track       string
+	Album       string
+	AlbumArtist string
+	TrackNumber int
+	Duration    time.Duration
+	PlayedAt    time.Time
+}
+
+// Session is an authenticated account at a scrobbling service
+type Session struct {
+	Key      string // Last.fm session key or ListenBrainz user token
+	Username string
+}
+
+// Scrobbler is a scrobbling service
+type Scrobbler interface {
+	// Name is the service name accounts are linked under
+	Name() string
+	// Authenticate exchanges a token given by the user for a session
+	Authenticate(ctx context.Context, token string) (Session, error)
+	// NowPlaying tells the service what the user has started playing
+	NowPlaying(ctx context.Context, session string, listen Listen) error
+	// Scrobble submits completed listens, at most BatchSize at a time
+	Scrobble(ctx context.Context, session string, listens []Listen) error
+	// BatchSize is the most listens the service accepts in one submission
+	BatchSize() int
+}
+
+// Authorizer is implemented by services that link accounts through a web
+// page on the service, which returns the token to Authenticate to callback
+type Authorizer interface {
+	AuthURL(callback string) string
+}
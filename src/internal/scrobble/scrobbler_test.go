@@ -0,0 +1,144 @@
+package scrobble
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastFM_ScrobbleSignsBatch(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Write([]byte(`{"scrobbles":{"@attr":{"accepted":2,"ignored":0}}}`))
+	}))
+	defer server.Close()
+
+	lastfm := NewLastFM(server.Client(), server.URL, "", "key", "secret")
+	playedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := lastfm.Scrobble(context.Background(), "session", []Listen{
+		{Artist: "Nirvana", Track: "In Bloom", Album: "Nevermind", TrackNumber: 2, Duration: 254 * time.Second, PlayedAt: playedAt},
+		{Artist: "Nirvana", Track: "Lithium", PlayedAt: playedAt.Add(254 * time.Second)},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "track.scrobble", form.Get("method"))
+	assert.Equal(t, "In Bloom", form.Get("track[0]"))
+	assert.Equal(t, "2", form.Get("trackNumber[0]"))
+	assert.Equal(t, "254", form.Get("duration[0]"))
+	assert.Equal(t, "1717243200", form.Get("timestamp[0]"))
+	assert.Equal(t, "Lithium", form.Get("track[1]"))
+	assert.Empty(t, form.Get("album[1]"))
+
+	// Parameters sorted by name bytewise, then the secret; format is not signed
+	signed := "album[0]Nevermindapi_keykeyartist[0]Nirvanaartist[1]Nirvanaduration[0]254methodtrack.scrobble" +
+		"sksessiontimestamp[0]1717243200timestamp[1]1717243454trackNumber[0]2track[0]In Bloomtrack[1]Lithiumsecret"
+	sum := md5.Sum([]byte(signed))
+	assert.Equal(t, hex.EncodeToString(sum[:]), form.Get("api_sig"))
+	assert.Equal(t, "json", form.Get("format"))
+}
+
+func TestLastFM_Errors(t *testing.T) {
+	code := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code == 0 {
+			w.Write([]byte(`{"session":{"name":"alice","key":"sk-1","subscriber":0}}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": code, "message": "failed"})
+	}))
+	defer server.Close()
+
+	lastfm := NewLastFM(server.Client(), server.URL, "https://last.fm/api/auth/", "key", "secret")
+	ctx := context.Background()
+
+	session, err := lastfm.Authenticate(ctx, "token")
+	require.NoError(t, err)
+	assert.Equal(t, Session{Key: "sk-1", Username: "alice"}, session)
+	assert.Equal(t, "https://last.fm/api/auth/?api_key=key&cb=https%3A%2F%2Fmelodee%2Fcallback", lastfm.AuthURL("https://melodee/callback"))
+
+	code = 9 // invalid session key
+	err = lastfm.NowPlaying(ctx, "sk-1", Listen{Artist: "Nirvana", Track: "In Bloom"})
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	code = 6 // invalid parameters
+	err = lastfm.NowPlaying(ctx, "sk-1", Listen{Artist: "Nirvana", Track: "In Bloom"})
+	assert.ErrorIs(t, err, ErrRejected)
+
+	code = 29 // rate limit exceeded
+	err = lastfm.NowPlaying(ctx, "sk-1", Listen{Artist: "Nirvana", Track: "In Bloom"})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnauthorized)
+	assert.NotErrorIs(t, err, ErrRejected)
+}
+
+func TestListenBrainz_Submissions(t *testing.T) {
+	var submissions []listenBrainzSubmission
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token user-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":401,"error":"Invalid authorization token."}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/1/validate-token":
+			w.Write([]byte(`{"code":200,"message":"Token valid.","valid":true,"user_name":"alice"}`))
+		case "/1/submit-listens":
+			var submission listenBrainzSubmission
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&submission))
+			submissions = append(submissions, submission)
+			w.WriteHeader(status)
+			w.Write([]byte(`{"status":"ok"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	listenbrainz := NewListenBrainz(server.Client(), server.URL+"/")
+	ctx := context.Background()
+
+	session, err := listenbrainz.Authenticate(ctx, "user-token")
+	require.NoError(t, err)
+	assert.Equal(t, Session{Key: "user-token", Username: "alice"}, session)
+
+	_, err = listenbrainz.Authenticate(ctx, "wrong")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	playedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	listen := Listen{Artist: "Miles Davis", Track: "So What", Album: "Kind of Blue", Duration: 562 * time.Second, PlayedAt: playedAt}
+	require.NoError(t, listenbrainz.NowPlaying(ctx, "user-token", listen))
+	require.NoError(t, listenbrainz.Scrobble(ctx, "user-token", []Listen{listen}))
+	require.NoError(t, listenbrainz.Scrobble(ctx, "user-token", []Listen{listen, listen}))
+
+	require.Len(t, submissions, 3)
+	assert.Equal(t, "playing_now", submissions[0].ListenType)
+	assert.Zero(t, submissions[0].Payload[0].ListenedAt)
+	assert.Equal(t, "single", submissions[1].ListenType)
+	assert.Equal(t, playedAt.Unix(), submissions[1].Payload[0].ListenedAt)
+	assert.Equal(t, "Kind of Blue", submissions[1].Payload[0].TrackMetadata.ReleaseName)
+	assert.Equal(t, float64(562000), submissions[1].Payload[0].TrackMetadata.AdditionalInfo["duration_ms"])
+	assert.Equal(t, "import", submissions[2].ListenType)
+	assert.Len(t, submissions[2].Payload, 2)
+
+	status = http.StatusTooManyRequests
+	err = listenbrainz.Scrobble(ctx, "user-token", []Listen{listen})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRejected)
+
+	status = http.StatusBadRequest
+	err = listenbrainz.Scrobble(ctx, "user-token", []Listen{listen})
+	assert.ErrorIs(t, err, ErrRejected)
+}
@@ -0,0 +1,408 @@
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"melodee/internal/config"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+	"melodee/internal/utils"
+)
+
+var (
+	// ErrUnknownService is returned for a service that is not configured
+	ErrUnknownService = errors.New("unknown or disabled scrobbling service")
+	// ErrNotLinked is returned when a user has no account at a service
+	ErrNotLinked = errors.New("scrobbling account not linked")
+	// ErrNoWebAuth is returned by AuthURL for services linked with a token the user copies
+	ErrNoWebAuth = errors.New("scrobbling service does not authorize through a web page")
+)
+
+// Play is a completed play of a track to be scrobbled
+type Play struct {
+	TrackID  int64
+	PlayedAt time.Time
+}
+
+// Account is a linked scrobbler account with the number of plays waiting to be submitted
+type Account struct {
+	models.ScrobblerAccount
+	Pending int64 `json:"pending"`
+}
+
+// Service links users' scrobbler accounts and submits their plays
+type Service struct {
+	db         *gorm.DB
+	scrobblers map[string]Scrobbler
+	serverKey  string
+	now        func() time.Time
+}
+
+// NewService creates a scrobble service for the services enabled in cfg.
+// Sessions are encrypted with serverKey, like Subsonic app passwords.
+func NewService(db *gorm.DB, cfg config.ScrobbleConfig, serverKey string) *Service {
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	s := &Service{
+		db:         db,
+		scrobblers: make(map[string]Scrobbler),
+		serverKey:  serverKey,
+		now:        time.Now,
+	}
+	if cfg.LastFM.Enabled {
+		s.scrobblers[ServiceLastFM] = NewLastFM(client, cfg.LastFM.Endpoint, cfg.LastFM.AuthURL, cfg.LastFM.APIKey, cfg.LastFM.APISecret)
+	}
+	if cfg.ListenBrainz.Enabled {
+		s.scrobblers[ServiceListenBrainz] = NewListenBrainz(client, cfg.ListenBrainz.Endpoint)
+	}
+	return s
+}
+
+// Services returns the names of the enabled services
+func (s *Service) Services() []string {
+	names := make([]string, 0, len(s.scrobblers))
+	for name := range s.scrobblers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuthURL returns the page where a user authorizes Melodee at a service that
+// links accounts through the web
+func (s *Service) AuthURL(service, callback string) (string, error) {
+	scrobbler, ok := s.scrobblers[service]
+	if !ok {
+		return "", ErrUnknownService
+	}
+	authorizer, ok := scrobbler.(Authorizer)
+	if !ok {
+		return "", ErrNoWebAuth
+	}
+	return authorizer.AuthURL(callback), nil
+}
+
+// Link authenticates token at a service and links the resulting account to
+// the user, replacing and re-enabling any account already linked there
+func (s *Service) Link(ctx context.Context, userID int64, service, token string) (*models.ScrobblerAccount, error) {
+	scrobbler, ok := s.scrobblers[service]
+	if !ok {
+		return nil, ErrUnknownService
+	}
+
+	session, err := scrobbler.Authenticate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := utils.EncryptSecret(s.serverKey, session.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt scrobbler session: %w", err)
+	}
+
+	account := models.ScrobblerAccount{
+		UserID:           userID,
+		Service:          service,
+		Username:         session.Username,
+		EncryptedSession: encrypted,
+		Enabled:          true,
+	}
+	db := s.db.WithContext(ctx)
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "service"}},
+		DoUpdates: clause.AssignmentColumns([]string{"username", "encrypted_session", "enabled", "last_error", "updated_at"}),
+	}).Create(&account).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save scrobbler account: %w", err)
+	}
+
+	// The upsert leaves the ID unset when it updated an existing row
+	if err := db.Where("user_id = ? AND service = ?", userID, service).First(&account).Error; err != nil {
+		return nil, fmt.Errorf("failed to load scrobbler account: %w", err)
+	}
+	return &account, nil
+}
+
+// Unlink removes a user's account at a service along with its queued plays
+func (s *Service) Unlink(ctx context.Context, userID int64, service string) error {
+	db := s.db.WithContext(ctx)
+	return db.Transaction(func(tx *gorm.DB) error {
+		var account models.ScrobblerAccount
+		err := tx.Where("user_id = ? AND service = ?", userID, service).First(&account).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotLinked
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load scrobbler account: %w", err)
+		}
+
+		if err := tx.Where("account_id = ?", account.ID).Delete(&models.ScrobbleQueueEntry{}).Error; err != nil {
+			return fmt.Errorf("failed to clear scrobble queue: %w", err)
+		}
+		if err := tx.Delete(&account).Error; err != nil {
+			return fmt.Errorf("failed to delete scrobbler account: %w", err)
+		}
+		return nil
+	})
+}
+
+// Accounts returns a user's linked accounts with their pending plays
+func (s *Service) Accounts(ctx context.Context, userID int64) ([]Account, error) {
+	db := s.db.WithContext(ctx)
+
+	var linked []models.ScrobblerAccount
+	if err := db.Where("user_id = ?", userID).Order("service").Find(&linked).Error; err != nil {
+		return nil, fmt.Errorf("failed to load scrobbler accounts: %w", err)
+	}
+
+	accounts := make([]Account, 0, len(linked))
+	for _, account := range linked {
+		var pending int64
+		if err := db.Model(&models.ScrobbleQueueEntry{}).Where("account_id = ?", account.ID).Count(&pending).Error; err != nil {
+			return nil, fmt.Errorf("failed to count queued scrobbles: %w", err)
+		}
+		accounts = append(accounts, Account{ScrobblerAccount: account, Pending: pending})
+	}
+	return accounts, nil
+}
+
+// ActiveAccounts returns the IDs of a user's enabled accounts at enabled services
+func (s *Service) ActiveAccounts(ctx context.Context, userID int64) ([]int64, error) {
+	var ids []int64
+	if len(s.scrobblers) == 0 {
+		return ids, nil
+	}
+	if err := s.db.WithContext(ctx).Model(&models.ScrobblerAccount{}).
+		Where("user_id = ? AND enabled = ? AND service IN ?", userID, true, s.Services()).
+		Order("id").Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to load scrobbler accounts: %w", err)
+	}
+	return ids, nil
+}
+
+// Queue adds a user's completed plays to the queue of each of their active
+// accounts and returns the accounts that have plays to submit
+func (s *Service) Queue(ctx context.Context, userID int64, plays []Play) ([]int64, error) {
+	accountIDs, err := s.ActiveAccounts(ctx, userID)
+	if err != nil || len(accountIDs) == 0 || len(plays) == 0 {
+		return nil, err
+	}
+
+	now := s.now()
+	entries := make([]models.ScrobbleQueueEntry, 0, len(accountIDs)*len(plays))
+	for _, accountID := range accountIDs {
+		for _, play := range plays {
+			entries = append(entries, models.ScrobbleQueueEntry{
+				AccountID: accountID,
+				TrackID:   play.TrackID,
+				PlayedAt:  play.PlayedAt.UTC(),
+				CreatedAt: now,
+			})
+		}
+	}
+	if err := s.db.WithContext(ctx).Create(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to queue scrobbles: %w", err)
+	}
+	return accountIDs, nil
+}
+
+// PendingAccounts returns the active accounts with queued plays
+func (s *Service) PendingAccounts(ctx context.Context) ([]int64, error) {
+	var ids []int64
+	if len(s.scrobblers) == 0 {
+		return ids, nil
+	}
+	if err := s.db.WithContext(ctx).Model(&models.ScrobblerAccount{}).
+		Where("enabled = ? AND service IN ?", true, s.Services()).
+		Where("EXISTS (SELECT 1 FROM scrobble_queue WHERE scrobble_queue.account_id = scrobbler_accounts.id)").
+		Order("id").Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to load pending scrobbler accounts: %w", err)
+	}
+	return ids, nil
+}
+
+// Submit sends an account's queued plays to its service, oldest first, and
+// returns how many were accepted. It stops at the first batch that fails;
+// those plays stay queued and are sent first next time. An account whose
+// credentials are rejected is disabled until it is linked again.
+func (s *Service) Submit(ctx context.Context, accountID int64) (int, error) {
+	account, scrobbler, session, err := s.open(ctx, accountID)
+	if err != nil || scrobbler == nil {
+		return 0, err
+	}
+
+	db := s.db.WithContext(ctx)
+	submitted := 0
+	for {
+		entryIDs, listens, err := s.queuedListens(ctx, account.ID, scrobbler.BatchSize())
+		if err != nil {
+			return submitted, err
+		}
+		if len(listens) == 0 {
+			return submitted, nil
+		}
+
+		err = scrobbler.Scrobble(ctx, session, listens)
+		if errors.Is(err, ErrRejected) {
+			// Sending them again would fail the same way
+			logging.Warnf("scrobble: dropping %d plays for account %d: %v", len(entryIDs), account.ID, err)
+		} else if err != nil {
+			s.recordError(ctx, account, err)
+			return submitted, err
+		} else {
+			submitted += len(entryIDs)
+		}
+
+		if err := db.Where("id IN ?", entryIDs).Delete(&models.ScrobbleQueueEntry{}).Error; err != nil {
+			return submitted, fmt.Errorf("failed to remove submitted scrobbles: %w", err)
+		}
+		now := s.now()
+		if err := db.Model(account).Updates(map[string]interface{}{"last_submitted_at": now, "last_error": ""}).Error; err != nil {
+			return submitted, fmt.Errorf("failed to update scrobbler account: %w", err)
+		}
+	}
+}
+
+// NowPlaying tells an account's service that the user started playing a track
+func (s *Service) NowPlaying(ctx context.Context, accountID, trackID int64) error {
+	account, scrobbler, session, err := s.open(ctx, accountID)
+	if err != nil || scrobbler == nil {
+		return err
+	}
+
+	listen, err := s.trackListen(ctx, trackID, s.now())
+	if err != nil || listen == nil {
+		return err
+	}
+
+	if err := scrobbler.NowPlaying(ctx, session, *listen); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			s.recordError(ctx, account, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// open loads an active account with its scrobbler and decrypted session.
+// The scrobbler is nil when there is nothing to do: the account is gone or
+// disabled, or its service is no longer enabled.
+func (s *Service) open(ctx context.Context, accountID int64) (*models.ScrobblerAccount, Scrobbler, string, error) {
+	var account models.ScrobblerAccount
+	err := s.db.WithContext(ctx).First(&account, accountID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, "", nil
+	}
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to load scrobbler account: %w", err)
+	}
+
+	scrobbler, ok := s.scrobblers[account.Service]
+	if !account.Enabled || !ok {
+		return &account, nil, "", nil
+	}
+
+	session, err := utils.DecryptSecret(s.serverKey, account.EncryptedSession)
+	if err != nil {
+		// Encrypted with a previous server key; the account must be linked again
+		err = fmt.Errorf("scrobbler session cannot be decrypted: %w", ErrUnauthorized)
+		s.recordError(ctx, &account, err)
+		return &account, nil, "", err
+	}
+	return &account, scrobbler, session, nil
+}
+
+// recordError saves the last error of an account and disables it when its credentials were rejected
+func (s *Service) recordError(ctx context.Context, account *models.ScrobblerAccount, cause error) {
+	updates := map[string]interface{}{"last_error": cause.Error()}
+	if errors.Is(cause, ErrUnauthorized) {
+		updates["enabled"] = false
+	}
+	if err := s.db.WithContext(ctx).Model(account).Updates(updates).Error; err != nil {
+		logging.Warnf("scrobble: failed to update account %d: %v", account.ID, err)
+	}
+}
+
+// listenColumns are the columns of a listen, selected from tracks joined by joinListenColumns
+const listenColumns = "tracks.name AS track, tracks.duration, tracks.sort_order AS track_number, " +
+	"albums.name AS album, artists.name AS artist, album_artists.name AS album_artist"
+
+func joinListenColumns(db *gorm.DB) *gorm.DB {
+	return db.
+		Joins("LEFT JOIN albums ON albums.id = tracks.album_id").
+		Joins("LEFT JOIN artists ON artists.id = tracks.artist_id").
+		Joins("LEFT JOIN artists AS album_artists ON album_artists.id = albums.artist_id")
+}
+
+type listenRow struct {
+	EntryID     int64
+	PlayedAt    time.Time
+	Track       string
+	Duration    int64
+	TrackNumber int
+	Album       *string
+	Artist      *string
+	AlbumArtist *string
+}
+
+func (r listenRow) listen() Listen {
+	return Listen{
+		Artist:      deref(r.Artist),
+		Track:       r.Track,
+		Album:       deref(r.Album),
+		AlbumArtist: deref(r.AlbumArtist),
+		TrackNumber: r.TrackNumber,
+		Duration:    time.Duration(r.Duration) * time.Millisecond,
+		PlayedAt:    r.PlayedAt,
+	}
+}
+
+// trackListen loads a track as a listen played at playedAt
+func (s *Service) trackListen(ctx context.Context, trackID int64, playedAt time.Time) (*Listen, error) {
+	var rows []listenRow
+	if err := s.db.WithContext(ctx).Table("tracks").Select(listenColumns).Scopes(joinListenColumns).
+		Where("tracks.id = ?", trackID).Limit(1).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load track: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	listen := rows[0].listen()
+	listen.PlayedAt = playedAt
+	return &listen, nil
+}
+
+// queuedListens loads the oldest queued plays of an account
+func (s *Service) queuedListens(ctx context.Context, accountID int64, limit int) ([]int64, []Listen, error) {
+	var rows []listenRow
+	if err := s.db.WithContext(ctx).Table("scrobble_queue").
+		Select("scrobble_queue.id AS entry_id, scrobble_queue.played_at, "+listenColumns).
+		Joins("JOIN tracks ON tracks.id = scrobble_queue.track_id").
+		Scopes(joinListenColumns).
+		Where("scrobble_queue.account_id = ?", accountID).
+		Order("scrobble_queue.played_at, scrobble_queue.id").
+		Limit(limit).Scan(&rows).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load queued scrobbles: %w", err)
+	}
+
+	entryIDs := make([]int64, 0, len(rows))
+	listens := make([]Listen, 0, len(rows))
+	for _, row := range rows {
+		entryIDs = append(entryIDs, row.EntryID)
+		listens = append(listens, row.listen())
+	}
+	return entryIDs, listens, nil
+}
+
+func deref(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,199 @@
+package scrobble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func setupScrobbleTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`,
+		`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER)`,
+		`CREATE TABLE tracks (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER, duration INTEGER, sort_order INTEGER DEFAULT 0)`,
+		`CREATE TABLE scrobbler_accounts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, service TEXT NOT NULL, username TEXT,
+			encrypted_session TEXT NOT NULL, enabled BOOLEAN DEFAULT 1, last_error TEXT,
+			last_submitted_at DATETIME, created_at DATETIME, updated_at DATETIME,
+			UNIQUE(user_id, service)
+		)`,
+		`CREATE TABLE scrobble_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id INTEGER NOT NULL, track_id INTEGER NOT NULL,
+			played_at DATETIME NOT NULL, created_at DATETIME
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Miles Davis')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id) VALUES (1, 'Kind of Blue', 1)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, duration, sort_order) VALUES
+		(10, 'So What', 1, 1, 562000, 1),
+		(11, 'Freddie Freeloader', 1, 1, 589000, 2)`)
+	return db
+}
+
+// listenBrainzStandIn records the listens submitted to it and fails with status while it is set
+type listenBrainzStandIn struct {
+	mu          sync.Mutex
+	status      int
+	submissions []listenBrainzSubmission
+}
+
+func (s *listenBrainzStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Token user-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/1/validate-token" {
+		w.Write([]byte(`{"valid":true,"user_name":"alice"}`))
+		return
+	}
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	var submission listenBrainzSubmission
+	json.NewDecoder(r.Body).Decode(&submission)
+	s.submissions = append(s.submissions, submission)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (s *listenBrainzStandIn) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func newTestService(t *testing.T, db *gorm.DB, standIn http.Handler) *Service {
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	return NewService(db, config.ScrobbleConfig{
+		Timeout:      5 * time.Second,
+		ListenBrainz: config.ListenBrainzConfig{Enabled: true, Endpoint: server.URL},
+	}, "server-key")
+}
+
+func TestService_SubmitReplaysQueueInOrder(t *testing.T) {
+	db := setupScrobbleTestDB(t)
+	standIn := &listenBrainzStandIn{}
+	service := newTestService(t, db, standIn)
+	ctx := context.Background()
+
+	assert.Equal(t, []string{ServiceListenBrainz}, service.Services())
+	_, err := service.Link(ctx, 1, ServiceLastFM, "token")
+	assert.ErrorIs(t, err, ErrUnknownService)
+
+	account, err := service.Link(ctx, 1, ServiceListenBrainz, "user-token")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", account.Username)
+	assert.NotContains(t, account.EncryptedSession, "user-token")
+
+	// The service is down: plays stay queued
+	standIn.setStatus(http.StatusServiceUnavailable)
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	accountIDs, err := service.Queue(ctx, 1, []Play{{TrackID: 11, PlayedAt: start.Add(10 * time.Minute)}})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{account.ID}, accountIDs)
+	_, err = service.Queue(ctx, 1, []Play{{TrackID: 10, PlayedAt: start}})
+	require.NoError(t, err)
+
+	submitted, err := service.Submit(ctx, account.ID)
+	assert.Error(t, err)
+	assert.Zero(t, submitted)
+
+	accounts, err := service.Accounts(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.Equal(t, int64(2), accounts[0].Pending)
+	assert.NotEmpty(t, accounts[0].LastError)
+	assert.True(t, accounts[0].Enabled)
+
+	pending, err := service.PendingAccounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{account.ID}, pending)
+
+	// Back online: the plays are submitted in the order they were played
+	standIn.setStatus(0)
+	submitted, err = service.Submit(ctx, account.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, submitted)
+
+	require.Len(t, standIn.submissions, 1)
+	payload := standIn.submissions[0].Payload
+	require.Len(t, payload, 2)
+	assert.Equal(t, "So What", payload[0].TrackMetadata.TrackName)
+	assert.Equal(t, "Kind of Blue", payload[0].TrackMetadata.ReleaseName)
+	assert.Equal(t, "Miles Davis", payload[0].TrackMetadata.ArtistName)
+	assert.Equal(t, start.Unix(), payload[0].ListenedAt)
+	assert.Equal(t, "Freddie Freeloader", payload[1].TrackMetadata.TrackName)
+
+	accounts, err = service.Accounts(ctx, 1)
+	require.NoError(t, err)
+	assert.Zero(t, accounts[0].Pending)
+	assert.Empty(t, accounts[0].LastError)
+	assert.NotNil(t, accounts[0].LastSubmittedAt)
+}
+
+func TestService_RejectedCredentialsDisableAccount(t *testing.T) {
+	db := setupScrobbleTestDB(t)
+	standIn := &listenBrainzStandIn{}
+	service := newTestService(t, db, standIn)
+	ctx := context.Background()
+
+	account, err := service.Link(ctx, 1, ServiceListenBrainz, "user-token")
+	require.NoError(t, err)
+	require.NoError(t, service.NowPlaying(ctx, account.ID, 10))
+	require.Len(t, standIn.submissions, 1)
+	assert.Equal(t, "playing_now", standIn.submissions[0].ListenType)
+
+	_, err = service.Queue(ctx, 1, []Play{{TrackID: 10, PlayedAt: time.Now()}})
+	require.NoError(t, err)
+
+	standIn.setStatus(http.StatusUnauthorized)
+	_, err = service.Submit(ctx, account.ID)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	var stored models.ScrobblerAccount
+	require.NoError(t, db.First(&stored, account.ID).Error)
+	assert.False(t, stored.Enabled)
+
+	// Disabled accounts queue nothing more but keep what is queued for when they are linked again
+	accountIDs, err := service.Queue(ctx, 1, []Play{{TrackID: 11, PlayedAt: time.Now()}})
+	require.NoError(t, err)
+	assert.Empty(t, accountIDs)
+	var queued int64
+	db.Model(&models.ScrobbleQueueEntry{}).Count(&queued)
+	assert.Equal(t, int64(1), queued)
+
+	standIn.setStatus(0)
+	_, err = service.Link(ctx, 1, ServiceListenBrainz, "user-token")
+	require.NoError(t, err)
+	submitted, err := service.Submit(ctx, account.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, submitted)
+
+	require.NoError(t, service.Unlink(ctx, 1, ServiceListenBrainz))
+	assert.ErrorIs(t, service.Unlink(ctx, 1, ServiceListenBrainz), ErrNotLinked)
+}
@@ -0,0 +1,165 @@
+package scrobble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypeScrobbleSubmit     = "scrobble:submit"
+	TypeScrobbleNowPlaying = "scrobble:now_playing"
+	TypeScrobbleRetry      = "scrobble:retry"
+)
+
+// submitMaxRetry bounds the backoff of a submission (asynq waits longer after
+// each attempt, a few hours in total). Plays still queued after that are
+// picked up by the periodic retry job.
+const submitMaxRetry = 10
+
+// SubmitPayload represents the payload for scrobble submission jobs
+type SubmitPayload struct {
+	AccountID int64 `json:"account_id"`
+}
+
+// NowPlayingPayload represents the payload for now playing jobs
+type NowPlayingPayload struct {
+	AccountID int64 `json:"account_id"`
+	TrackID   int64 `json:"track_id"`
+}
+
+// EnqueueSubmit creates and enqueues a job submitting an account's queued plays
+func EnqueueSubmit(client *asynq.Client, accountID int64) error {
+	payload, err := json.Marshal(SubmitPayload{AccountID: accountID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal scrobble submit payload: %w", err)
+	}
+
+	task := asynq.NewTask(TypeScrobbleSubmit, payload)
+
+	// One job per account keeps submissions in order; a job that is already
+	// queued or retrying sends the new plays too
+	dedupKey := fmt.Sprintf("scrobble.submit:%d", accountID)
+
+	_, err = client.Enqueue(task,
+		asynq.TaskID(dedupKey),
+		asynq.Timeout(5*time.Minute),
+		asynq.MaxRetry(submitMaxRetry),
+	)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue scrobble submission: %w", err)
+	}
+	return nil
+}
+
+// EnqueueNowPlaying creates and enqueues a now playing update for an account
+func EnqueueNowPlaying(client *asynq.Client, accountID, trackID int64) error {
+	payload, err := json.Marshal(NowPlayingPayload{AccountID: accountID, TrackID: trackID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal now playing payload: %w", err)
+	}
+
+	// Now playing is soon out of date, so it is not retried for long
+	task := asynq.NewTask(TypeScrobbleNowPlaying, payload)
+	_, err = client.Enqueue(task,
+		asynq.Queue("critical"),
+		asynq.Timeout(30*time.Second),
+		asynq.MaxRetry(2),
+		asynq.Deadline(time.Now().Add(5*time.Minute)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue now playing update: %w", err)
+	}
+	return nil
+}
+
+// NewRetryTask creates a task that submits the queued plays of every account
+func NewRetryTask() *asynq.Task {
+	return asynq.NewTask(TypeScrobbleRetry, nil)
+}
+
+// TaskHandler runs scrobble jobs
+type TaskHandler struct {
+	service *Service
+	client  *asynq.Client
+}
+
+// NewTaskHandler creates a new scrobble task handler. Submissions found by the
+// retry job are enqueued through client, or run in the retry job when it is nil.
+func NewTaskHandler(service *Service, client *asynq.Client) *TaskHandler {
+	return &TaskHandler{
+		service: service,
+		client:  client,
+	}
+}
+
+// HandleSubmit submits an account's queued plays
+func (h *TaskHandler) HandleSubmit(ctx context.Context, t *asynq.Task) error {
+	var p SubmitPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal scrobble submit payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	submitted, err := h.service.Submit(ctx, p.AccountID)
+	if submitted > 0 {
+		logging.Infof("scrobble: submitted %d plays for account %d", submitted, p.AccountID)
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		// The account is disabled until the user links it again. The task
+		// isn't archived, as its ID would block submissions after relinking.
+		logging.Warnf("scrobble: account %d disabled: %v", p.AccountID, err)
+		return nil
+	}
+	if err != nil {
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		if retried >= maxRetry {
+			// Leave the plays queued for the retry job rather than archiving the
+			// task, which would keep its ID and block further submissions
+			logging.Warnf("scrobble: giving up on account %d until the next retry run: %v", p.AccountID, err)
+			return nil
+		}
+	}
+	return err
+}
+
+// HandleNowPlaying sends a now playing update
+func (h *TaskHandler) HandleNowPlaying(ctx context.Context, t *asynq.Task) error {
+	var p NowPlayingPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal now playing payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	err := h.service.NowPlaying(ctx, p.AccountID, p.TrackID)
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrRejected) {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// HandleRetry queues submissions for every account with plays left to submit
+func (h *TaskHandler) HandleRetry(ctx context.Context, t *asynq.Task) error {
+	accountIDs, err := h.service.PendingAccounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, accountID := range accountIDs {
+		if h.client == nil {
+			if _, err := h.service.Submit(ctx, accountID); err != nil {
+				logging.Warnf("scrobble: account %d: %v", accountID, err)
+			}
+			continue
+		}
+		if err := EnqueueSubmit(h.client, accountID); err != nil {
+			logging.Warnf("scrobble: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Package search implements ranked library search across artists, albums and
+// tracks for the Melodee API and OpenSubsonic search endpoints.
+package search
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query is a parsed search query. Free words and quoted phrases are matched
+// against entity names; qualifiers narrow the results.
+//
+//	beatles "let it be" artist:"the beatles" album:abbey year:1990..1999 genre:rock
+type Query struct {
+	Terms    []string // free words, lowercased
+	Phrases  []string // quoted phrases, lowercased
+	Artist   string   // artist: qualifier
+	Album    string   // album: qualifier
+	Genre    string   // genre: qualifier
+	YearFrom int      // year: lower bound, 0 when open
+	YearTo   int      // year: upper bound, 0 when open
+}
+
+// Parse parses a raw query. Unknown qualifiers and malformed years are kept
+// as free words so that nothing the user typed is silently dropped.
+func Parse(raw string) Query {
+	var q Query
+	for _, token := range tokenize(raw) {
+		if token.quoted {
+			if text := normalize(token.text); text != "" {
+				q.Phrases = append(q.Phrases, text)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(token.text, ":")
+		if ok && value != "" {
+			value = normalize(value)
+			switch strings.ToLower(key) {
+			case "artist":
+				q.Artist = value
+				continue
+			case "album":
+				q.Album = value
+				continue
+			case "genre":
+				q.Genre = value
+				continue
+			case "year":
+				if from, to, ok := parseYears(value); ok {
+					q.YearFrom, q.YearTo = from, to
+					continue
+				}
+			}
+		}
+
+		if text := normalize(token.text); text != "" {
+			q.Terms = append(q.Terms, text)
+		}
+	}
+	return q
+}
+
+// Text returns the free words and phrases as one string
+func (q Query) Text() string {
+	return strings.Join(append(append([]string(nil), q.Terms...), q.Phrases...), " ")
+}
+
+// HasText reports whether the query has free words or phrases
+func (q Query) HasText() bool {
+	return len(q.Terms) > 0 || len(q.Phrases) > 0
+}
+
+// HasAlbumFilters reports whether the query has qualifiers only albums and
+// tracks can satisfy
+func (q Query) HasAlbumFilters() bool {
+	return q.Album != "" || q.Genre != "" || q.YearFrom != 0 || q.YearTo != 0
+}
+
+// IsEmpty reports whether the query matches nothing in particular
+func (q Query) IsEmpty() bool {
+	return !q.HasText() && q.Artist == "" && !q.HasAlbumFilters()
+}
+
+// TSQuery returns the free words and phrases as a Postgres tsquery: every
+// word is a prefix match, phrase words must be adjacent, and all of them must
+// match. Words are reduced to letters and digits so user input cannot inject
+// tsquery operators.
+func (q Query) TSQuery() string {
+	var parts []string
+	for _, term := range q.Terms {
+		for _, word := range words(term) {
+			parts = append(parts, word+":*")
+		}
+	}
+	for _, phrase := range q.Phrases {
+		ws := words(phrase)
+		switch len(ws) {
+		case 0:
+		case 1:
+			parts = append(parts, ws[0])
+		default:
+			parts = append(parts, "("+strings.Join(ws, " <-> ")+")")
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits on whitespace, keeping double-quoted text together. A quote
+// right after a qualifier's colon quotes the qualifier's value.
+func tokenize(raw string) []token {
+	var tokens []token
+	var current strings.Builder
+	inQuotes, quoted := false, false
+
+	flush := func() {
+		if current.Len() > 0 || quoted {
+			tokens = append(tokens, token{text: current.String(), quoted: quoted})
+		}
+		current.Reset()
+		quoted = false
+	}
+
+	for _, r := range raw {
+		switch {
+		case r == '"' && inQuotes:
+			inQuotes = false
+			if quoted {
+				flush()
+			}
+		case r == '"':
+			inQuotes = true
+			// artist:"pink floyd" is a qualifier value, not a phrase
+			if !strings.HasSuffix(current.String(), ":") {
+				flush()
+				quoted = true
+			}
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func parseYears(value string) (from, to int, ok bool) {
+	lo, hi, isRange := strings.Cut(value, "..")
+	if !isRange {
+		year, err := strconv.Atoi(value)
+		if err != nil || !validYear(year) {
+			return 0, 0, false
+		}
+		return year, year, true
+	}
+
+	if lo != "" {
+		if from, ok = atoiYear(lo); !ok {
+			return 0, 0, false
+		}
+	}
+	if hi != "" {
+		if to, ok = atoiYear(hi); !ok {
+			return 0, 0, false
+		}
+	}
+	if from == 0 && to == 0 {
+		return 0, 0, false
+	}
+	if from != 0 && to != 0 && from > to {
+		from, to = to, from
+	}
+	return from, to, true
+}
+
+func atoiYear(s string) (int, bool) {
+	year, err := strconv.Atoi(s)
+	return year, err == nil && validYear(year)
+}
+
+func validYear(year int) bool {
+	return year >= 1000 && year <= 9999
+}
+
+// normalize lowercases and collapses whitespace the way name_normalized is stored
+func normalize(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// words splits text into runs of letters and digits
+func words(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,50 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Query
+	}{
+		{"Beatles", Query{Terms: []string{"beatles"}}},
+		{`  let  "It Be"  `, Query{Terms: []string{"let"}, Phrases: []string{"it be"}}},
+		{`artist:"Pink Floyd" wall`, Query{Terms: []string{"wall"}, Artist: "pink floyd"}},
+		{"album:Abbey artist:beatles", Query{Artist: "beatles", Album: "abbey"}},
+		{"genre:Rock", Query{Genre: "rock"}},
+		{"year:1990..1999", Query{YearFrom: 1990, YearTo: 1999}},
+		{"year:1999..1990", Query{YearFrom: 1990, YearTo: 1999}},
+		{"year:1977", Query{YearFrom: 1977, YearTo: 1977}},
+		{"year:..1969", Query{YearTo: 1969}},
+		{"year:2000..", Query{YearFrom: 2000}},
+		{"year:soon", Query{Terms: []string{"year:soon"}}},
+		{"mood:happy", Query{Terms: []string{"mood:happy"}}},
+		{"artist:", Query{Terms: []string{"artist:"}}},
+		{`""`, Query{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			assert.Equal(t, tt.want, Parse(tt.raw))
+		})
+	}
+}
+
+func TestQuery_TSQuery(t *testing.T) {
+	assert.Equal(t, "beat:* & abbey:*", Parse("beat abbey").TSQuery())
+	assert.Equal(t, "love:* & (let <-> it <-> be)", Parse(`love "let it be"`).TSQuery())
+	assert.Equal(t, "ac:* & dc:*", Parse("AC/DC").TSQuery())
+	assert.Equal(t, "beyoncé:*", Parse("Beyoncé").TSQuery())
+	assert.Equal(t, "", Parse("!!! :*&|").TSQuery(), "operators never reach the tsquery")
+}
+
+func TestQuery_IsEmpty(t *testing.T) {
+	assert.True(t, Parse("  ").IsEmpty())
+	assert.False(t, Parse("year:1990").IsEmpty())
+	assert.True(t, Parse("year:1990").HasAlbumFilters())
+	assert.False(t, Parse("artist:abba").HasAlbumFilters())
+}
@@ -0,0 +1,365 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+)
+
+// Kind is the type of entity a hit refers to
+type Kind string
+
+const (
+	KindArtist Kind = "artist"
+	KindAlbum  Kind = "album"
+	KindSong   Kind = "song"
+)
+
+// AllKinds are the kinds searched when no type is given, in the order hits
+// with the same score are listed
+var AllKinds = []Kind{KindArtist, KindAlbum, KindSong}
+
+// ParseKind maps the type names accepted by the APIs to a kind
+func ParseKind(name string) (Kind, bool) {
+	switch strings.ToLower(name) {
+	case "artist", "artists":
+		return KindArtist, true
+	case "album", "albums":
+		return KindAlbum, true
+	case "song", "songs", "track", "tracks":
+		return KindSong, true
+	}
+	return "", false
+}
+
+// Hit is one ranked search result. Exactly one of Artist, Album and Track is
+// set; they are left out of JSON, which lists the ranking only.
+type Hit struct {
+	Kind   Kind           `json:"type"`
+	ID     int64          `json:"id"`
+	Score  float64        `json:"score"`
+	Artist *models.Artist `json:"-"`
+	Album  *models.Album  `json:"-"`
+	Track  *models.Track  `json:"-"`
+}
+
+// Results is one page of hits ranked across all searched kinds
+type Results struct {
+	Hits   []Hit
+	Total  int64          // matches across all searched kinds
+	Totals map[Kind]int64 // matches per kind
+}
+
+// Artists returns the artists on the page in rank order
+func (r *Results) Artists() []models.Artist {
+	artists := make([]models.Artist, 0)
+	for _, hit := range r.Hits {
+		if hit.Artist != nil {
+			artists = append(artists, *hit.Artist)
+		}
+	}
+	return artists
+}
+
+// Albums returns the albums on the page in rank order
+func (r *Results) Albums() []models.Album {
+	albums := make([]models.Album, 0)
+	for _, hit := range r.Hits {
+		if hit.Album != nil {
+			albums = append(albums, *hit.Album)
+		}
+	}
+	return albums
+}
+
+// Tracks returns the tracks on the page in rank order
+func (r *Results) Tracks() []models.Track {
+	tracks := make([]models.Track, 0)
+	for _, hit := range r.Hits {
+		if hit.Track != nil {
+			tracks = append(tracks, *hit.Track)
+		}
+	}
+	return tracks
+}
+
+// Service runs ranked searches.
+//
+// On Postgres names are matched with accent-folded full-text search (every
+// word a prefix, alternate names included) or trigram similarity for typos,
+// and ranked by ts_rank_cd plus similarity with a bonus for exact names. The
+// functions and indexes this relies on are created by init-scripts/001_schema.sql.
+// Other databases fall back to case-insensitive substring matching ranked
+// exact, prefix, then substring.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new search service
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db}
+}
+
+// Search returns one page of hits across the given kinds, ranked together so
+// that offset and limit page through a single merged list
+func (s *Service) Search(ctx context.Context, q Query, kinds []Kind, limit, offset int) (*Results, error) {
+	results := &Results{Hits: []Hit{}, Totals: make(map[Kind]int64)}
+	if q.IsEmpty() || limit <= 0 {
+		return results, nil
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	db := s.db.WithContext(ctx)
+	b := builder{postgres: s.db.Dialector.Name() == "postgres", query: q}
+
+	var parts []string
+	var args []interface{}
+	for _, kind := range kinds {
+		sql, partArgs, ok := b.selectKind(kind)
+		if !ok {
+			continue
+		}
+
+		var total int64
+		if err := db.Raw("SELECT COUNT(*) FROM ("+sql+") matches", partArgs...).Scan(&total).Error; err != nil {
+			return nil, fmt.Errorf("failed to count %s matches: %w", kind, err)
+		}
+		results.Totals[kind] = total
+		results.Total += total
+
+		if total > 0 {
+			parts = append(parts, sql)
+			args = append(args, partArgs...)
+		}
+	}
+	if len(parts) == 0 || int64(offset) >= results.Total {
+		return results, nil
+	}
+
+	var rows []struct {
+		Kind  string
+		ID    int64
+		Score float64
+	}
+	page := "SELECT kind, id, score FROM (" + strings.Join(parts, " UNION ALL ") + ") hits " +
+		"ORDER BY score DESC, kind_order ASC, sort_name ASC, id ASC LIMIT ? OFFSET ?"
+	if err := db.Raw(page, append(args, limit, offset)...).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+
+	for _, row := range rows {
+		results.Hits = append(results.Hits, Hit{Kind: Kind(row.Kind), ID: row.ID, Score: row.Score})
+	}
+	if err := s.load(db, results.Hits); err != nil {
+		return nil, err
+	}
+
+	// Entities deleted between the search and loading them are dropped
+	loaded := results.Hits[:0]
+	for _, hit := range results.Hits {
+		if hit.Artist != nil || hit.Album != nil || hit.Track != nil {
+			loaded = append(loaded, hit)
+		}
+	}
+	results.Hits = loaded
+	return results, nil
+}
+
+// load fills in the entities of the hits
+func (s *Service) load(db *gorm.DB, hits []Hit) error {
+	ids := make(map[Kind][]int64)
+	for _, hit := range hits {
+		ids[hit.Kind] = append(ids[hit.Kind], hit.ID)
+	}
+
+	artists := make(map[int64]*models.Artist)
+	if len(ids[KindArtist]) > 0 {
+		var rows []models.Artist
+		if err := db.Where("id IN ?", ids[KindArtist]).Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to load artists: %w", err)
+		}
+		for i := range rows {
+			artists[rows[i].ID] = &rows[i]
+		}
+	}
+
+	albums := make(map[int64]*models.Album)
+	if len(ids[KindAlbum]) > 0 {
+		var rows []models.Album
+		if err := db.Preload("Artist").Where("id IN ?", ids[KindAlbum]).Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to load albums: %w", err)
+		}
+		for i := range rows {
+			albums[rows[i].ID] = &rows[i]
+		}
+	}
+
+	tracks := make(map[int64]*models.Track)
+	if len(ids[KindSong]) > 0 {
+		var rows []models.Track
+		if err := db.Preload("Album").Preload("Artist").Where("id IN ?", ids[KindSong]).Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to load tracks: %w", err)
+		}
+		for i := range rows {
+			tracks[rows[i].ID] = &rows[i]
+		}
+	}
+
+	for i := range hits {
+		switch hits[i].Kind {
+		case KindArtist:
+			hits[i].Artist = artists[hits[i].ID]
+		case KindAlbum:
+			hits[i].Album = albums[hits[i].ID]
+		case KindSong:
+			hits[i].Track = tracks[hits[i].ID]
+		}
+	}
+	return nil
+}
+
+// builder writes the SQL selecting the matches of one kind
+type builder struct {
+	postgres bool
+	query    Query
+}
+
+// selectKind returns a SELECT of kind, kind_order, id, score and sort_name for
+// the matches of one kind, or false when the query's qualifiers rule the kind out
+func (b builder) selectKind(kind Kind) (string, []interface{}, bool) {
+	q := b.query
+	var from, name, alternateNames string
+	var order int
+
+	switch kind {
+	case KindArtist:
+		// Artists have no album, genre or year to filter on
+		if q.HasAlbumFilters() {
+			return "", nil, false
+		}
+		from = "artists"
+		name, alternateNames = "artists.name_normalized", "artists.alternate_names"
+		order = 0
+	case KindAlbum:
+		from = "albums LEFT JOIN artists ON artists.id = albums.artist_id"
+		name, alternateNames = "albums.name_normalized", "albums.alternate_names"
+		order = 1
+	case KindSong:
+		from = "tracks LEFT JOIN albums ON albums.id = tracks.album_id LEFT JOIN artists ON artists.id = tracks.artist_id"
+		name = "tracks.name_normalized"
+		order = 2
+	default:
+		return "", nil, false
+	}
+
+	var where []string
+	var whereArgs []interface{}
+	add := func(sql string, args ...interface{}) {
+		where = append(where, sql)
+		whereArgs = append(whereArgs, args...)
+	}
+
+	if q.HasText() {
+		sql, args := b.match(name, alternateNames, q)
+		add(sql, args...)
+	}
+	if q.Artist != "" {
+		sql, args := b.match("artists.name_normalized", "artists.alternate_names", Query{Terms: words(q.Artist)})
+		add(sql, args...)
+	}
+	if q.Album != "" && kind != KindArtist {
+		sql, args := b.match("albums.name_normalized", "albums.alternate_names", Query{Terms: words(q.Album)})
+		add(sql, args...)
+	}
+	if q.Genre != "" {
+		if b.postgres {
+			add("EXISTS (SELECT 1 FROM unnest(albums.genres) AS genre WHERE lower(genre) = ?)", q.Genre)
+		} else {
+			add("lower(albums.genres) LIKE ?", "%"+q.Genre+"%")
+		}
+	}
+	year := "CAST(strftime('%Y', albums.release_date) AS INTEGER)"
+	if b.postgres {
+		year = "EXTRACT(YEAR FROM albums.release_date)"
+	}
+	if q.YearFrom != 0 {
+		add(year+" >= ?", q.YearFrom)
+	}
+	if q.YearTo != 0 {
+		add(year+" <= ?", q.YearTo)
+	}
+
+	score, scoreArgs := "0.0", []interface{}(nil)
+	if q.HasText() {
+		score, scoreArgs = b.score(name, alternateNames, q)
+	}
+
+	table := strings.Fields(from)[0]
+	sql := fmt.Sprintf("SELECT '%s' AS kind, %d AS kind_order, %s.id AS id, %s AS score, %s AS sort_name FROM %s",
+		kind, order, table, score, name, from)
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	return sql, append(scoreArgs, whereArgs...), true
+}
+
+// match returns a condition matching the name or alternate names against the
+// query's words and phrases. alternateNames may be empty.
+func (b builder) match(name, alternateNames string, q Query) (string, []interface{}) {
+	if b.postgres {
+		text := q.Text()
+		trigram := "melodee_unaccent(" + name + ") % melodee_unaccent(?)"
+		tsquery := q.TSQuery()
+		if tsquery == "" {
+			return trigram, []interface{}{text}
+		}
+		return fmt.Sprintf("(%s @@ to_tsquery('simple', melodee_unaccent(?)) OR %s)", b.vector(name, alternateNames), trigram),
+			[]interface{}{tsquery, text}
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, text := range append(append([]string(nil), q.Terms...), q.Phrases...) {
+		pattern := "%" + text + "%"
+		if alternateNames == "" {
+			conditions = append(conditions, "lower("+name+") LIKE ?")
+			args = append(args, pattern)
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("(lower(%s) LIKE ? OR lower(COALESCE(%s, '')) LIKE ?)", name, alternateNames))
+		args = append(args, pattern, pattern)
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+// score returns the relevance of a match; higher is better
+func (b builder) score(name, alternateNames string, q Query) (string, []interface{}) {
+	text := q.Text()
+	if b.postgres {
+		exact := fmt.Sprintf("CASE WHEN melodee_unaccent(%s) = melodee_unaccent(?) THEN 1 ELSE 0 END", name)
+		similarity := fmt.Sprintf("similarity(melodee_unaccent(%s), melodee_unaccent(?))", name)
+		tsquery := q.TSQuery()
+		if tsquery == "" {
+			return "(" + exact + " + " + similarity + ")", []interface{}{text, text}
+		}
+		rank := fmt.Sprintf("ts_rank_cd(%s, to_tsquery('simple', melodee_unaccent(?)))", b.vector(name, alternateNames))
+		return "(" + exact + " + " + similarity + " + " + rank + ")", []interface{}{text, text, tsquery}
+	}
+
+	return fmt.Sprintf("(CASE WHEN lower(%[1]s) = ? THEN 3 WHEN lower(%[1]s) LIKE ? THEN 2 ELSE 1 END)", name),
+		[]interface{}{text, text + "%"}
+}
+
+// vector must match the expressions of the search indexes in the schema
+func (b builder) vector(name, alternateNames string) string {
+	if alternateNames == "" {
+		alternateNames = "NULL::text[]"
+	}
+	return fmt.Sprintf("melodee_search_vector(%s, %s)", name, alternateNames)
+}
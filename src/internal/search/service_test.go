@@ -0,0 +1,196 @@
+package search
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupSearchTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		is_locked BOOLEAN DEFAULT 0,
+		name TEXT,
+		name_normalized TEXT,
+		directory_code TEXT,
+		sort_name TEXT,
+		alternate_names TEXT,
+		track_count_cached INTEGER DEFAULT 0,
+		album_count_cached INTEGER DEFAULT 0,
+		duration_cached INTEGER DEFAULT 0,
+		created_at DATETIME,
+		last_scanned_at DATETIME,
+		tags TEXT,
+		music_brainz_id TEXT,
+		spotify_id TEXT,
+		last_fm_id TEXT,
+		discogs_id TEXT,
+		i_tunes_id TEXT,
+		amg_id TEXT,
+		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
+		sort_order INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		is_locked BOOLEAN DEFAULT 0,
+		name TEXT,
+		name_normalized TEXT,
+		alternate_names TEXT,
+		artist_id INTEGER,
+		library_id INTEGER,
+		track_count_cached INTEGER DEFAULT 0,
+		duration_cached INTEGER DEFAULT 0,
+		created_at DATETIME,
+		tags TEXT,
+		release_date DATETIME,
+		original_release_date DATETIME,
+		album_type TEXT,
+		directory TEXT,
+		sort_name TEXT,
+		sort_order INTEGER DEFAULT 0,
+		image_count INTEGER DEFAULT 0,
+		comment TEXT,
+		description TEXT,
+		genres TEXT,
+		moods TEXT,
+		notes TEXT,
+		deezer_id TEXT,
+		music_brainz_id TEXT,
+		spotify_id TEXT,
+		last_fm_id TEXT,
+		discogs_id TEXT,
+		i_tunes_id TEXT,
+		amg_id TEXT,
+		wikidata_id TEXT,
+		image_url TEXT,
+		is_compilation BOOLEAN DEFAULT 0,
+		release_group_id INTEGER,
+		edition_type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		name TEXT,
+		name_normalized TEXT,
+		sort_name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		library_id INTEGER,
+		duration INTEGER,
+		bit_rate INTEGER,
+		bit_depth INTEGER,
+		sample_rate INTEGER,
+		channels INTEGER,
+		created_at DATETIME,
+		tags TEXT,
+		directory TEXT,
+		file_name TEXT,
+		relative_path TEXT,
+		crc_hash TEXT,
+		sort_order INTEGER DEFAULT 0,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER
+	)`).Error)
+
+	db.Exec(`INSERT INTO artists (id, name, name_normalized) VALUES
+		(1, 'The Beatles', 'the beatles'),
+		(2, 'Beat Happening', 'beat happening'),
+		(3, 'Pink Floyd', 'pink floyd')`)
+	db.Exec(`INSERT INTO albums (id, name, name_normalized, artist_id, release_date) VALUES
+		(10, 'Abbey Road', 'abbey road', 1, '1969-09-26 00:00:00'),
+		(11, 'Beat Happening', 'beat happening', 2, '1985-01-01 00:00:00'),
+		(12, 'The Division Bell', 'the division bell', 3, '1994-03-28 00:00:00')`)
+	db.Exec(`INSERT INTO tracks (id, name, name_normalized, album_id, artist_id) VALUES
+		(100, 'Come Together', 'come together', 10, 1),
+		(101, 'Beat Beat', 'beat beat', 11, 2),
+		(102, 'High Hopes', 'high hopes', 12, 3)`)
+	return db
+}
+
+func hitIDs(results *Results) []string {
+	ids := make([]string, 0, len(results.Hits))
+	for _, hit := range results.Hits {
+		switch hit.Kind {
+		case KindArtist:
+			ids = append(ids, "artist:"+hit.Artist.Name)
+		case KindAlbum:
+			ids = append(ids, "album:"+hit.Album.Name)
+		case KindSong:
+			ids = append(ids, "song:"+hit.Track.Name)
+		}
+	}
+	return ids
+}
+
+func TestService_RanksAcrossKinds(t *testing.T) {
+	service := NewService(setupSearchTestDB(t))
+
+	results, err := service.Search(context.Background(), Parse("beat happening"), AllKinds, 10, 0)
+	require.NoError(t, err)
+	// Exact names first, artists before albums on equal score
+	assert.Equal(t, []string{"artist:Beat Happening", "album:Beat Happening"}, hitIDs(results))
+	assert.Equal(t, int64(2), results.Total)
+
+	results, err = service.Search(context.Background(), Parse("beat"), AllKinds, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"artist:Beat Happening", "album:Beat Happening", "song:Beat Beat", // prefix matches
+		"artist:The Beatles", // substring match
+	}, hitIDs(results))
+	assert.Equal(t, map[Kind]int64{KindArtist: 2, KindAlbum: 1, KindSong: 1}, results.Totals)
+}
+
+func TestService_PaginatesMergedResults(t *testing.T) {
+	service := NewService(setupSearchTestDB(t))
+	ctx := context.Background()
+
+	all, err := service.Search(ctx, Parse("beat"), AllKinds, 10, 0)
+	require.NoError(t, err)
+
+	var paged []string
+	for offset := 0; offset < 4; offset += 2 {
+		page, err := service.Search(ctx, Parse("beat"), AllKinds, 2, offset)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), page.Total)
+		paged = append(paged, hitIDs(page)...)
+	}
+	assert.Equal(t, hitIDs(all), paged)
+
+	past, err := service.Search(ctx, Parse("beat"), AllKinds, 2, 10)
+	require.NoError(t, err)
+	assert.Empty(t, past.Hits)
+	assert.Equal(t, int64(4), past.Total)
+}
+
+func TestService_Qualifiers(t *testing.T) {
+	service := NewService(setupSearchTestDB(t))
+	ctx := context.Background()
+
+	results, err := service.Search(ctx, Parse("artist:beatles"), AllKinds, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"artist:The Beatles", "album:Abbey Road", "song:Come Together"}, hitIDs(results))
+
+	results, err = service.Search(ctx, Parse("year:1980..1999"), AllKinds, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"album:Beat Happening", "album:The Division Bell", "song:Beat Beat", "song:High Hopes"},
+		hitIDs(results), "artists have no year")
+
+	results, err = service.Search(ctx, Parse(`album:"division bell" high`), []Kind{KindSong}, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"song:High Hopes"}, hitIDs(results))
+
+	results, err = service.Search(ctx, Parse("beat year:..1970"), AllKinds, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, results.Hits)
+}
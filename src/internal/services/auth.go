@@ -31,6 +31,7 @@ func (e *AccountLockedException) Error() string {
 type AuthService struct {
 	db        *gorm.DB
 	jwtSecret string
+	secretKey string // encrypts Subsonic app passwords
 }
 
 // ValidatePassword validates a password against security requirements
@@ -115,9 +116,17 @@ func NewAuthService(db *gorm.DB, jwtSecret string) *AuthService {
 	return &AuthService{
 		db:        db,
 		jwtSecret: jwtSecret,
+		secretKey: jwtSecret,
 	}
 }
 
+// WithSecretKey sets the key Subsonic app passwords are encrypted with, so
+// they don't depend on the JWT secret. It defaults to the JWT secret.
+func (a *AuthService) WithSecretKey(secretKey string) *AuthService {
+	a.secretKey = secretKey
+	return a
+}
+
 // GetJWTSecret returns the JWT secret (for middleware use)
 func (a *AuthService) GetJWTSecret() string {
 	return a.jwtSecret
@@ -312,7 +321,9 @@ func (a *AuthService) ValidateToken(tokenString string) (*AuthUser, error) {
 }
 
 // ValidateOpenSubsonicToken validates OpenSubsonic token authentication
-func (a *AuthService) ValidateOpenSubsonicToken(username, password, token, salt string) (*models.User, error) {
+// (token = MD5(secret + salt)) against the user's Subsonic app passwords.
+// The login password is bcrypt hashed and cannot be used for token auth.
+func (a *AuthService) ValidateOpenSubsonicToken(username, token, salt string) (*models.User, error) {
 	var user models.User
 	if err := a.db.Where("username = ?", username).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -321,17 +332,77 @@ func (a *AuthService) ValidateOpenSubsonicToken(username, password, token, salt
 		return nil, err
 	}
 
-	// For OpenSubsonic token validation, we need to verify that the token matches
-	// the password hash in the expected manner (token = MD5(password + salt))
-	// This is a simplified version - in a real implementation, we'd compute the expected token
-	// and compare it with the provided one
+	var passwords []models.SubsonicPassword
+	if err := a.db.Where("user_id = ?", user.ID).Find(&passwords).Error; err != nil {
+		return nil, err
+	}
 
-	// Compare password hash to ensure the token is valid for this user
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+	for _, p := range passwords {
+		secret, err := utils.DecryptSecret(a.secretKey, p.EncryptedSecret)
+		if err != nil {
+			// Encrypted with a previous secret key; the password must be reissued
+			log.Printf("[AUTH] Failed to decrypt Subsonic app password %d of user %s: %v", p.ID, user.Username, err)
+			continue
+		}
+		if utils.VerifySubsonicToken(secret, salt, token) {
+			now := time.Now()
+			a.db.Model(&p).Update("last_used_at", now)
+			return &user, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid credentials")
+}
+
+// IssueSubsonicPassword creates a new Subsonic app password for a user. The
+// plaintext secret is returned once and is stored encrypted with the secret key.
+func (a *AuthService) IssueSubsonicPassword(userID int64, name string) (*models.SubsonicPassword, string, error) {
+	var user models.User
+	if err := a.db.First(&user, userID).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to find user: %w", err)
+	}
+
+	secret, err := utils.GenerateRandomString(18)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	encrypted, err := utils.EncryptSecret(a.secretKey, secret)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt secret: %w", err)
 	}
 
-	return &user, nil
+	password := &models.SubsonicPassword{
+		UserID:          userID,
+		Name:            name,
+		EncryptedSecret: encrypted,
+	}
+	if err := a.db.Create(password).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to save subsonic password: %w", err)
+	}
+
+	return password, secret, nil
+}
+
+// ListSubsonicPasswords returns a user's Subsonic app passwords (without secrets)
+func (a *AuthService) ListSubsonicPasswords(userID int64) ([]models.SubsonicPassword, error) {
+	var passwords []models.SubsonicPassword
+	if err := a.db.Where("user_id = ?", userID).Order("created_at").Find(&passwords).Error; err != nil {
+		return nil, fmt.Errorf("failed to list subsonic passwords: %w", err)
+	}
+	return passwords, nil
+}
+
+// RevokeSubsonicPassword deletes one of a user's Subsonic app passwords
+func (a *AuthService) RevokeSubsonicPassword(userID, passwordID int64) error {
+	result := a.db.Where("id = ? AND user_id = ?", passwordID, userID).Delete(&models.SubsonicPassword{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke subsonic password: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
 
 // generateAccessToken generates a JWT access token
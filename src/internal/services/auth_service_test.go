@@ -1,6 +1,8 @@
 package services
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"testing"
 	"time"
 
@@ -377,3 +379,61 @@ func TestAuthService_LockUser(t *testing.T) {
 	assert.NotNil(t, lockedUser.LockedUntil)
 	assert.True(t, lockedUser.LockedUntil.After(time.Now()))
 }
+
+func TestAuthService_SubsonicPasswords(t *testing.T) {
+	// Create a test database instance
+	db, tearDown := test.GetTestDB(t)
+	defer tearDown()
+
+	authService := NewAuthService(db, "test-secret-key-change-in-production")
+
+	user := &models.User{
+		Username: "subsonicuser",
+		Email:    "subsonic@example.com",
+		APIKey:   uuid.New(),
+	}
+	err := db.Create(user).Error
+	assert.NoError(t, err)
+
+	password, secret, err := authService.IssueSubsonicPassword(user.ID, "DSub")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, secret)
+	assert.NotContains(t, password.EncryptedSecret, secret)
+
+	// Salted token built the way Subsonic clients do
+	salt := "c19b2d"
+	sum := md5.Sum([]byte(secret + salt))
+	token := hex.EncodeToString(sum[:])
+
+	authedUser, err := authService.ValidateOpenSubsonicToken("subsonicuser", token, salt)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, authedUser.ID)
+
+	_, err = authService.ValidateOpenSubsonicToken("subsonicuser", token, "other-salt")
+	assert.Error(t, err)
+
+	// A different server key cannot decrypt the stored secret
+	_, err = NewAuthService(db, "rotated-secret").ValidateOpenSubsonicToken("subsonicuser", token, salt)
+	assert.Error(t, err)
+
+	// With a secret key of its own, the JWT secret can be rotated
+	keyed := NewAuthService(db, "test-secret-key-change-in-production").WithSecretKey("app-password-key")
+	_, keyedSecret, err := keyed.IssueSubsonicPassword(user.ID, "Ultrasonic")
+	assert.NoError(t, err)
+	sum = md5.Sum([]byte(keyedSecret + salt))
+	_, err = NewAuthService(db, "rotated-secret").WithSecretKey("app-password-key").
+		ValidateOpenSubsonicToken("subsonicuser", hex.EncodeToString(sum[:]), salt)
+	assert.NoError(t, err)
+
+	passwords, err := authService.ListSubsonicPasswords(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, passwords, 2)
+	assert.Equal(t, "DSub", passwords[0].Name)
+
+	// Revoked passwords no longer authenticate
+	assert.NoError(t, authService.RevokeSubsonicPassword(user.ID, password.ID))
+	assert.Error(t, authService.RevokeSubsonicPassword(user.ID, password.ID))
+
+	_, err = authService.ValidateOpenSubsonicToken("subsonicuser", token, salt)
+	assert.Error(t, err)
+}
@@ -1,9 +1,11 @@
 package services
 
 import (
+	"context"
 	"fmt"
 
 	"melodee/internal/models"
+	"melodee/internal/search"
 
 	"gorm.io/gorm"
 )
@@ -171,144 +173,35 @@ func (r *Repository) GetTrackByID(id int64) (*models.Track, error) {
 }
 
 // Search operations
-// SearchEntities searches for artists, albums, and tracks based on the query and type
+// SearchEntities runs a ranked search for artists, albums, and tracks based on
+// the query and type. "any" pages through one list ranked across all types.
 func (r *Repository) SearchEntities(query string, entityType string, limit, offset int) ([]interface{}, int64, error) {
-	var results []interface{}
-	var total int64
-
-	// Normalize the query for searching
-	normalizedQuery := fmt.Sprintf("%%%s%%", query)
-
-	switch entityType {
-	case "artist", "artists":
-		// Search for artists
-		var artists []models.Artist
-		err := r.db.Model(&models.Artist{}).
-			Where("name_normalized ILIKE ?", normalizedQuery).
-			Count(&total).
-			Limit(limit).Offset(offset).
-			Order("name_normalized ASC, id ASC").
-			Find(&artists).Error
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to search artists: %w", err)
-		}
-
-		// Convert to interface slice
-		for _, artist := range artists {
-			results = append(results, artist)
-		}
-
-	case "album", "albums":
-		// Search for albums
-		var albums []models.Album
-		err := r.db.Model(&models.Album{}).
-			Where("name_normalized ILIKE ?", normalizedQuery).
-			Count(&total).
-			Limit(limit).Offset(offset).
-			Order("name_normalized ASC, id ASC").
-			Preload("Artist"). // Preload associated artist
-			Find(&albums).Error
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to search albums: %w", err)
-		}
-
-		// Convert to interface slice
-		for _, album := range albums {
-			results = append(results, album)
+	kinds := search.AllKinds
+	if entityType != "any" && entityType != "all" && entityType != "" {
+		kind, ok := search.ParseKind(entityType)
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported entity type for search: %s", entityType)
 		}
-
-	case "song", "songs", "track", "tracks":
-		// Search for tracks
-		var tracks []models.Track
-		err := r.db.Model(&models.Track{}).
-			Where("name_normalized ILIKE ?", normalizedQuery).
-			Count(&total).
-			Limit(limit).Offset(offset).
-			Order("name_normalized ASC, id ASC").
-			Preload("Album").  // Preload associated album
-			Preload("Artist"). // Preload associated artist
-			Find(&tracks).Error
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to search tracks: %w", err)
-		}
-
-		// Convert to interface slice
-		for _, track := range tracks {
-			results = append(results, track)
-		}
-
-	case "any", "all", "":
-		// Search across all entity types - this will require multiple queries
-		// We'll search artists, albums, and tracks separately and combine results if needed
-		return r.searchAllEntities(query, limit, offset)
-
-	default:
-		return nil, 0, fmt.Errorf("unsupported entity type for search: %s", entityType)
-	}
-
-	return results, total, nil
-}
-
-// searchAllEntities performs a search across all entity types
-func (r *Repository) searchAllEntities(query string, limit, offset int) ([]interface{}, int64, error) {
-	// This is a simplified approach - in a real implementation, you might want to
-	// use a full-text search or combine results in a more sophisticated way
-	normalizedQuery := fmt.Sprintf("%%%s%%", query)
-
-	var total int64
-
-	// Count total across all entities
-	var artistCount, albumCount, trackCount int64
-	r.db.Model(&models.Artist{}).Where("name_normalized ILIKE ?", normalizedQuery).Count(&artistCount)
-	r.db.Model(&models.Album{}).Where("name_normalized ILIKE ?", normalizedQuery).Count(&albumCount)
-	r.db.Model(&models.Track{}).Where("name_normalized ILIKE ?", normalizedQuery).Count(&trackCount)
-	total = artistCount + albumCount + trackCount
-
-	// For offset/limit pagination, we would need to implement a more complex solution
-	// For now, let's get results from each type up to the limit
-	var results []interface{}
-
-	// Get artists
-	var artists []models.Artist
-	artistLimit := limit / 3 // Divide the limit between entity types
-	if artistLimit < 1 {
-		artistLimit = 1
+		kinds = []search.Kind{kind}
 	}
-	r.db.Where("name_normalized ILIKE ?", normalizedQuery).
-		Limit(artistLimit).Offset(0).
-		Order("name_normalized ASC, id ASC").
-		Find(&artists)
 
-	for _, artist := range artists {
-		results = append(results, artist)
-	}
-
-	// Get albums
-	var albums []models.Album
-	r.db.Where("name_normalized ILIKE ?", normalizedQuery).
-		Limit(artistLimit).Offset(0).
-		Order("name_normalized ASC, id ASC").
-		Preload("Artist").
-		Find(&albums)
-
-	for _, album := range albums {
-		results = append(results, album)
+	found, err := search.NewService(r.db).Search(context.Background(), search.Parse(query), kinds, limit, offset)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	// Get tracks
-	var tracks []models.Track
-	r.db.Where("name_normalized ILIKE ?", normalizedQuery).
-		Limit(artistLimit).Offset(0).
-		Order("name_normalized ASC, id ASC").
-		Preload("Album").
-		Preload("Artist").
-		Find(&tracks)
-
-	for _, track := range tracks {
-		results = append(results, track)
+	var results []interface{}
+	for _, hit := range found.Hits {
+		switch {
+		case hit.Artist != nil:
+			results = append(results, *hit.Artist)
+		case hit.Album != nil:
+			results = append(results, *hit.Album)
+		case hit.Track != nil:
+			results = append(results, *hit.Track)
+		}
 	}
-
-	return results, total, nil
+	return results, found.Total, nil
 }
 
 // SearchArtistsPaginated searches for artists with pagination
@@ -0,0 +1,413 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"melodee/internal/models"
+)
+
+// resumeWindow is how long after a track's playing time a stream of it may
+// be resumed without counting as another stream
+const resumeWindow = time.Hour
+
+var (
+	// ErrNotFound is returned for a token no share has
+	ErrNotFound = errors.New("share not found")
+	// ErrExpired is returned for a share past its expiry
+	ErrExpired = errors.New("share has expired")
+	// ErrNoItems is returned when creating a share with nothing in it
+	ErrNoItems = errors.New("share has no items")
+	// ErrItemNotFound is returned when creating a share with an item that doesn't exist
+	ErrItemNotFound = errors.New("shared item not found")
+	// ErrNotShared is returned for a track that isn't part of the share
+	ErrNotShared = errors.New("track is not part of the share")
+	// ErrStreamingDisabled is returned when streaming a share that doesn't allow it
+	ErrStreamingDisabled = errors.New("share does not allow streaming")
+	// ErrDownloadDisabled is returned when downloading from a share that doesn't allow it
+	ErrDownloadDisabled = errors.New("share does not allow downloads")
+	// ErrLimitReached is returned once a share has used up its streams or minutes
+	ErrLimitReached = errors.New("share streaming limit reached")
+)
+
+// Visitor is who opened a share
+type Visitor struct {
+	UserID    *int64 // nil for anonymous visitors
+	IPAddress string
+	UserAgent string
+}
+
+// Service creates shares and serves them by token
+type Service struct {
+	db          *gorm.DB
+	externalURL string
+}
+
+// NewService creates a new share service. Share URLs are built from
+// externalURL, or from the host of the request when it is empty.
+func NewService(db *gorm.DB, externalURL string) *Service {
+	return &Service{db: db, externalURL: strings.TrimRight(externalURL, "/")}
+}
+
+// ParseItemID parses the id of a shared item: "al-<id>" for an album,
+// "pl-<id>" for a playlist and a plain id for a track
+func ParseItemID(id string) (models.ShareItem, error) {
+	itemType := models.ShareItemTrack
+	if rest, ok := strings.CutPrefix(id, "al-"); ok {
+		itemType, id = models.ShareItemAlbum, rest
+	} else if rest, ok := strings.CutPrefix(id, "pl-"); ok {
+		itemType, id = models.ShareItemPlaylist, rest
+	}
+	itemID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || itemID <= 0 {
+		return models.ShareItem{}, fmt.Errorf("invalid share item id %q", id)
+	}
+	return models.ShareItem{ItemType: itemType, ItemID: itemID}, nil
+}
+
+// Create stores a share with its items, in the order given. Playlists must
+// belong to the share's user or be public.
+func (s *Service) Create(ctx context.Context, share *models.Share, items []models.ShareItem) error {
+	if len(items) == 0 {
+		return ErrNoItems
+	}
+	for _, item := range items {
+		if err := s.checkItem(ctx, share.UserID, item); err != nil {
+			return err
+		}
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Items", "User").Create(share).Error; err != nil {
+			return fmt.Errorf("failed to create share: %w", err)
+		}
+		return createItems(tx, share, items)
+	})
+}
+
+// ReplaceItems replaces the items of a share with items, in the order given.
+// They are checked as in Create.
+func (s *Service) ReplaceItems(ctx context.Context, share *models.Share, items []models.ShareItem) error {
+	if len(items) == 0 {
+		return ErrNoItems
+	}
+	for _, item := range items {
+		if err := s.checkItem(ctx, share.UserID, item); err != nil {
+			return err
+		}
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("share_id = ?", share.ID).Delete(&models.ShareItem{}).Error; err != nil {
+			return fmt.Errorf("failed to delete share items: %w", err)
+		}
+		return createItems(tx, share, items)
+	})
+}
+
+func createItems(tx *gorm.DB, share *models.Share, items []models.ShareItem) error {
+	share.Items = make([]models.ShareItem, len(items))
+	for i, item := range items {
+		item.ShareID = share.ID
+		item.Position = int32(i)
+		share.Items[i] = item
+	}
+	if err := tx.Create(&share.Items).Error; err != nil {
+		return fmt.Errorf("failed to create share items: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) checkItem(ctx context.Context, userID int64, item models.ShareItem) error {
+	query := s.db.WithContext(ctx)
+	switch item.ItemType {
+	case models.ShareItemTrack:
+		query = query.Model(&models.Track{}).Where("id = ?", item.ItemID)
+	case models.ShareItemAlbum:
+		query = query.Model(&models.Album{}).Where("id = ?", item.ItemID)
+	case models.ShareItemPlaylist:
+		query = query.Model(&models.Playlist{}).Where("id = ? AND (user_id = ? OR public = ?)", item.ItemID, userID, true)
+	default:
+		return fmt.Errorf("unknown share item type %q", item.ItemType)
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check share item: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s %d", ErrItemNotFound, item.ItemType, item.ItemID)
+	}
+	return nil
+}
+
+// Open returns the share with a token, with its user and items. Expired
+// shares return ErrExpired.
+func (s *Service) Open(ctx context.Context, token string) (*models.Share, error) {
+	var share models.Share
+	err := s.db.WithContext(ctx).
+		Preload("User").
+		Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Where("token = ?", token).
+		First(&share).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load share: %w", err)
+	}
+	if share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now()) {
+		return &share, ErrExpired
+	}
+	return &share, nil
+}
+
+// Tracks returns the tracks of a share in order, with albums and playlists
+// expanded. A track shared more than once is listed the first time only.
+func (s *Service) Tracks(ctx context.Context, share *models.Share) ([]models.Track, error) {
+	tracks, err := s.SharedTracks(ctx, []models.Share{*share})
+	if err != nil {
+		return nil, err
+	}
+	return tracks[share.ID], nil
+}
+
+// SharedTracks returns the tracks of each of shares by share ID, as Tracks
+// does, loading those of every share together
+func (s *Service) SharedTracks(ctx context.Context, shares []models.Share) (map[int32][]models.Track, error) {
+	db := s.db.WithContext(ctx)
+
+	items := make(map[int32][]models.ShareItem, len(shares))
+	var unloaded []int32
+	for _, share := range shares {
+		if share.Items == nil {
+			unloaded = append(unloaded, share.ID)
+		} else {
+			items[share.ID] = share.Items
+		}
+	}
+	if len(unloaded) > 0 {
+		var loaded []models.ShareItem
+		if err := db.Where("share_id IN ?", unloaded).Order("position").Find(&loaded).Error; err != nil {
+			return nil, fmt.Errorf("failed to load share items: %w", err)
+		}
+		for _, item := range loaded {
+			items[item.ShareID] = append(items[item.ShareID], item)
+		}
+	}
+
+	var trackIDs, albumIDs, playlistIDs []int64
+	for _, shareItems := range items {
+		for _, item := range shareItems {
+			switch item.ItemType {
+			case models.ShareItemTrack:
+				trackIDs = append(trackIDs, item.ItemID)
+			case models.ShareItemAlbum:
+				albumIDs = append(albumIDs, item.ItemID)
+			case models.ShareItemPlaylist:
+				playlistIDs = append(playlistIDs, item.ItemID)
+			}
+		}
+	}
+
+	// Every track is loaded once, and albums and playlists list theirs in order
+	byID := make(map[int64]models.Track)
+	albumTracks := make(map[int64][]int64)
+	playlistTracks := make(map[int64][]int64)
+	if len(albumIDs) > 0 {
+		var found []models.Track
+		if err := db.Preload("Album").Preload("Artist").Where("album_id IN ?", albumIDs).Order("sort_order, id").Find(&found).Error; err != nil {
+			return nil, fmt.Errorf("failed to load shared tracks: %w", err)
+		}
+		for _, track := range found {
+			byID[track.ID] = track
+			albumTracks[track.AlbumID] = append(albumTracks[track.AlbumID], track.ID)
+		}
+	}
+	if len(playlistIDs) > 0 {
+		var entries []models.PlaylistTrack
+		if err := db.Where("playlist_id IN ?", playlistIDs).Order("position").Find(&entries).Error; err != nil {
+			return nil, fmt.Errorf("failed to load shared playlists: %w", err)
+		}
+		for _, entry := range entries {
+			playlistTracks[int64(entry.PlaylistID)] = append(playlistTracks[int64(entry.PlaylistID)], entry.TrackID)
+			trackIDs = append(trackIDs, entry.TrackID)
+		}
+	}
+	var missing []int64
+	for _, id := range trackIDs {
+		if _, ok := byID[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		var found []models.Track
+		if err := db.Preload("Album").Preload("Artist").Where("id IN ?", missing).Find(&found).Error; err != nil {
+			return nil, fmt.Errorf("failed to load shared tracks: %w", err)
+		}
+		for _, track := range found {
+			byID[track.ID] = track
+		}
+	}
+
+	result := make(map[int32][]models.Track, len(shares))
+	for _, share := range shares {
+		var tracks []models.Track
+		seen := make(map[int64]bool)
+		add := func(ids ...int64) {
+			for _, id := range ids {
+				if track, ok := byID[id]; ok && !seen[id] {
+					seen[id] = true
+					tracks = append(tracks, track)
+				}
+			}
+		}
+		for _, item := range items[share.ID] {
+			switch item.ItemType {
+			case models.ShareItemTrack:
+				add(item.ItemID)
+			case models.ShareItemAlbum:
+				add(albumTracks[item.ItemID]...)
+			case models.ShareItemPlaylist:
+				add(playlistTracks[item.ItemID]...)
+			}
+		}
+		result[share.ID] = tracks
+	}
+	return result, nil
+}
+
+// Track returns a track of a share, or ErrNotShared
+func (s *Service) Track(ctx context.Context, share *models.Share, trackID int64) (*models.Track, error) {
+	var track models.Track
+	err := s.db.WithContext(ctx).Preload("Album").Preload("Artist").
+		Where("tracks.id = ?", trackID).
+		Where(`EXISTS (SELECT 1 FROM share_items WHERE share_items.share_id = ? AND (
+			(share_items.item_type = ? AND share_items.item_id = tracks.id) OR
+			(share_items.item_type = ? AND share_items.item_id = tracks.album_id) OR
+			(share_items.item_type = ? AND share_items.item_id IN (
+				SELECT playlist_tracks.playlist_id FROM playlist_tracks WHERE playlist_tracks.track_id = tracks.id))))`,
+			share.ID, models.ShareItemTrack, models.ShareItemAlbum, models.ShareItemPlaylist).
+		Take(&track).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotShared
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shared track: %w", err)
+	}
+	return &track, nil
+}
+
+// URL returns the public URL of a share. requestBase, the scheme and host the
+// request came in on, is used when no external URL is configured.
+func (s *Service) URL(share *models.Share, requestBase string) string {
+	base := s.externalURL
+	if base == "" {
+		base = strings.TrimRight(requestBase, "/")
+	}
+	return base + "/share/" + share.Token
+}
+
+// RecordVisit counts a visit to a share and logs it
+func (s *Service) RecordVisit(ctx context.Context, share *models.Share, visitor Visitor) error {
+	now := time.Now()
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Share{}).Where("id = ?", share.ID).Updates(map[string]interface{}{
+			"visit_count":     gorm.Expr("visit_count + 1"),
+			"last_visited_at": now,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to count share visit: %w", err)
+		}
+		share.VisitCount++
+		share.LastVisitedAt = &now
+		return s.logActivity(tx, share, models.ShareActionView, nil, visitor, now)
+	})
+}
+
+// StartStream checks that a track of a share may be streamed, or downloaded
+// when action is models.ShareActionDownload, and counts it against the
+// share's limits. Both count as a stream; the minutes limit counts the
+// playing time of the tracks served, and a stream that starts under it may
+// run past it.
+func (s *Service) StartStream(ctx context.Context, share *models.Share, track *models.Track, action string, visitor Visitor) error {
+	if err := checkAllowed(share, action); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seconds := track.Duration / 1000
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The limits are checked in the update so concurrent streams can't overrun them
+		result := tx.Model(&models.Share{}).
+			Where("id = ?", share.ID).
+			Where("(max_streaming_count <= 0 OR stream_count < max_streaming_count)").
+			Where("(max_streaming_minutes <= 0 OR streamed_seconds < max_streaming_minutes * 60)").
+			Updates(map[string]interface{}{
+				"stream_count":     gorm.Expr("stream_count + 1"),
+				"streamed_seconds": gorm.Expr("streamed_seconds + ?", seconds),
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to count share stream: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrLimitReached
+		}
+		share.StreamCount++
+		share.StreamedSeconds += seconds
+		return s.logActivity(tx, share, action, &track.ID, visitor, now)
+	})
+}
+
+// ResumeStream is StartStream for requests that continue a stream, such as
+// range requests after seeking. A stream of the track the visitor started
+// recently isn't counted again.
+func (s *Service) ResumeStream(ctx context.Context, share *models.Share, track *models.Track, action string, visitor Visitor) error {
+	if err := checkAllowed(share, action); err != nil {
+		return err
+	}
+
+	since := time.Now().Add(-resumeWindow - time.Duration(track.Duration)*time.Millisecond)
+	var started int64
+	err := s.db.WithContext(ctx).Model(&models.ShareActivity{}).
+		Where("share_id = ? AND track_id = ? AND action = ? AND ip_address = ? AND accessed_at > ?",
+			share.ID, track.ID, action, visitor.IPAddress, since).
+		Count(&started).Error
+	if err != nil {
+		return fmt.Errorf("failed to load share activity: %w", err)
+	}
+	if started > 0 {
+		return nil
+	}
+	return s.StartStream(ctx, share, track, action, visitor)
+}
+
+func checkAllowed(share *models.Share, action string) error {
+	switch {
+	case action == models.ShareActionDownload && !share.AllowDownload:
+		return ErrDownloadDisabled
+	case action != models.ShareActionDownload && !share.AllowStreaming:
+		return ErrStreamingDisabled
+	}
+	return nil
+}
+
+func (s *Service) logActivity(tx *gorm.DB, share *models.Share, action string, trackID *int64, visitor Visitor, at time.Time) error {
+	activity := models.ShareActivity{
+		ShareID:    share.ID,
+		UserID:     visitor.UserID,
+		Action:     action,
+		TrackID:    trackID,
+		IPAddress:  visitor.IPAddress,
+		AccessedAt: at,
+		UserAgent:  visitor.UserAgent,
+	}
+	if err := tx.Create(&activity).Error; err != nil {
+		return fmt.Errorf("failed to log share activity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+)
+
+func setupShareTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	for _, ddl := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, api_key TEXT)`,
+		`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`,
+		`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER)`,
+		`CREATE TABLE tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER,
+			sort_order INTEGER DEFAULT 0, duration INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE playlists (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, name TEXT, public BOOLEAN DEFAULT 0)`,
+		`CREATE TABLE playlist_tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, playlist_id INTEGER, track_id INTEGER, position INTEGER, created_at DATETIME
+		)`,
+		`CREATE TABLE shares (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, token TEXT NOT NULL UNIQUE,
+			name TEXT, description TEXT, expires_at DATETIME,
+			max_streaming_minutes INTEGER DEFAULT 0, max_streaming_count INTEGER DEFAULT 0,
+			allow_streaming BOOLEAN DEFAULT 1, allow_download BOOLEAN DEFAULT 0,
+			visit_count INTEGER DEFAULT 0, last_visited_at DATETIME,
+			stream_count INTEGER DEFAULT 0, streamed_seconds INTEGER DEFAULT 0,
+			created_at DATETIME, updated_at DATETIME
+		)`,
+		`CREATE TABLE share_items (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, share_id INTEGER NOT NULL, item_type TEXT NOT NULL,
+			item_id INTEGER NOT NULL, position INTEGER NOT NULL
+		)`,
+		`CREATE TABLE share_activities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, share_id INTEGER NOT NULL, user_id INTEGER, action TEXT NOT NULL,
+			track_id INTEGER, ip_address TEXT, accessed_at DATETIME, user_agent TEXT
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO users (id, username) VALUES (1, 'alice'), (2, 'bob')`)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Nina Simone')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id) VALUES (1, 'Pastel Blues', 1), (2, 'Wild Is the Wind', 1)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, sort_order, duration) VALUES
+		(1, 'Be My Husband', 1, 1, 1, 180000),
+		(2, 'Nobody Knows You', 1, 1, 2, 240000),
+		(3, 'Sinnerman', 1, 1, 3, 600000),
+		(4, 'Four Women', 2, 1, 1, 300000)`)
+	db.Exec(`INSERT INTO playlists (id, user_id, name, public) VALUES (1, 1, 'Mine', 0), (2, 2, 'Private', 0), (3, 2, 'Public', 1)`)
+	db.Exec(`INSERT INTO playlist_tracks (playlist_id, track_id, position) VALUES (1, 4, 0), (1, 1, 1)`)
+	return db
+}
+
+func createShare(t *testing.T, service *Service, share models.Share, ids ...string) *models.Share {
+	var items []models.ShareItem
+	for _, id := range ids {
+		item, err := ParseItemID(id)
+		require.NoError(t, err)
+		items = append(items, item)
+	}
+	if share.UserID == 0 {
+		share.UserID = 1
+	}
+	require.NoError(t, service.Create(context.Background(), &share, items))
+	return &share
+}
+
+func trackIDs(tracks []models.Track) []int64 {
+	ids := make([]int64, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.ID
+	}
+	return ids
+}
+
+func TestParseItemID(t *testing.T) {
+	tests := []struct {
+		id       string
+		wantType string
+		wantID   int64
+		wantErr  bool
+	}{
+		{"12", models.ShareItemTrack, 12, false},
+		{"al-3", models.ShareItemAlbum, 3, false},
+		{"pl-7", models.ShareItemPlaylist, 7, false},
+		{"ar-1", "", 0, true},
+		{"0", "", 0, true},
+		{"", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			item, err := ParseItemID(tt.id)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantType, item.ItemType)
+			assert.Equal(t, tt.wantID, item.ItemID)
+		})
+	}
+}
+
+func TestService_CreateAndOpen(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "https://music.example.com/")
+	ctx := context.Background()
+
+	created := createShare(t, service, models.Share{Description: "road trip"}, "3", "al-1", "pl-1")
+	assert.Len(t, created.Token, 32)
+	assert.Equal(t, "https://music.example.com/share/"+created.Token, service.URL(created, "http://localhost:8080"))
+
+	opened, err := service.Open(ctx, created.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "road trip", opened.Description)
+	assert.Equal(t, "alice", opened.User.Username)
+	require.Len(t, opened.Items, 3)
+	assert.Equal(t, models.ShareItemPlaylist, opened.Items[2].ItemType)
+
+	// Items keep their order and a track shared twice is listed once
+	tracks, err := service.Tracks(ctx, opened)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 1, 2, 4}, trackIDs(tracks))
+	assert.Equal(t, "Pastel Blues", tracks[0].Album.Name)
+
+	_, err = service.Track(ctx, opened, 4)
+	assert.NoError(t, err)
+
+	other := createShare(t, service, models.Share{}, "1")
+	assert.NotEqual(t, created.Token, other.Token)
+	_, err = service.Track(ctx, other, 3)
+	assert.ErrorIs(t, err, ErrNotShared)
+
+	_, err = service.Open(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestService_SharedTracks(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+
+	first := createShare(t, service, models.Share{}, "al-2", "pl-1")
+	second := createShare(t, service, models.Share{}, "2", "al-1")
+	empty := models.Share{ID: 99}
+
+	var shares []models.Share
+	require.NoError(t, db.Order("id").Find(&shares).Error)
+	shares = append(shares, empty)
+	tracks, err := service.SharedTracks(ctx, shares)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{4, 1}, trackIDs(tracks[first.ID]))
+	assert.Equal(t, []int64{2, 1, 3}, trackIDs(tracks[second.ID]))
+	assert.Equal(t, "Pastel Blues", tracks[second.ID][0].Album.Name)
+	assert.Empty(t, tracks[empty.ID])
+
+	// Tracks are found through the album, playlist or track they're shared as
+	for _, id := range []int64{1, 4} {
+		track, err := service.Track(ctx, first, id)
+		require.NoError(t, err, id)
+		assert.Equal(t, "Nina Simone", track.Artist.Name)
+	}
+	_, err = service.Track(ctx, first, 2)
+	assert.ErrorIs(t, err, ErrNotShared)
+	_, err = service.Track(ctx, second, 3)
+	assert.NoError(t, err)
+	_, err = service.Track(ctx, second, 4)
+	assert.ErrorIs(t, err, ErrNotShared)
+}
+
+func TestService_CreateChecksItems(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+
+	err := service.Create(ctx, &models.Share{UserID: 1}, nil)
+	assert.ErrorIs(t, err, ErrNoItems)
+
+	for _, id := range []string{"99", "al-99", "pl-2"} {
+		item, err := ParseItemID(id)
+		require.NoError(t, err)
+		err = service.Create(ctx, &models.Share{UserID: 1}, []models.ShareItem{item})
+		assert.ErrorIs(t, err, ErrItemNotFound, id)
+	}
+
+	// Public playlists of other users can be shared
+	createShare(t, service, models.Share{}, "pl-3")
+
+	var count int64
+	db.Model(&models.Share{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// Without an external URL the request's host is used
+	share := &models.Share{Token: "abc"}
+	assert.Equal(t, "http://localhost:8080/share/abc", service.URL(share, "http://localhost:8080/"))
+}
+
+func TestService_ReplaceItems(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+
+	created := createShare(t, service, models.Share{}, "1", "2")
+
+	err := service.ReplaceItems(ctx, created, nil)
+	assert.ErrorIs(t, err, ErrNoItems)
+	missing, err := ParseItemID("99")
+	require.NoError(t, err)
+	err = service.ReplaceItems(ctx, created, []models.ShareItem{missing})
+	assert.ErrorIs(t, err, ErrItemNotFound)
+
+	// A failed replacement leaves the items as they were
+	opened, err := service.Open(ctx, created.Token)
+	require.NoError(t, err)
+	require.Len(t, opened.Items, 2)
+
+	var items []models.ShareItem
+	for _, id := range []string{"4", "al-1"} {
+		item, err := ParseItemID(id)
+		require.NoError(t, err)
+		items = append(items, item)
+	}
+	require.NoError(t, service.ReplaceItems(ctx, created, items))
+
+	opened, err = service.Open(ctx, created.Token)
+	require.NoError(t, err)
+	tracks, err := service.Tracks(ctx, opened)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{4, 1, 2, 3}, trackIDs(tracks))
+}
+
+func TestService_OpenExpired(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+
+	expired := time.Now().Add(-time.Minute)
+	share := createShare(t, service, models.Share{ExpiresAt: &expired}, "1")
+	_, err := service.Open(context.Background(), share.Token)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestService_RecordVisit(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+
+	share := createShare(t, service, models.Share{}, "1")
+	visitor := Visitor{IPAddress: "203.0.113.9", UserAgent: "test"}
+	require.NoError(t, service.RecordVisit(ctx, share, visitor))
+	require.NoError(t, service.RecordVisit(ctx, share, visitor))
+
+	opened, err := service.Open(ctx, share.Token)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), opened.VisitCount)
+	assert.NotNil(t, opened.LastVisitedAt)
+
+	var activities []models.ShareActivity
+	db.Where("share_id = ?", share.ID).Find(&activities)
+	require.Len(t, activities, 2)
+	assert.Equal(t, models.ShareActionView, activities[0].Action)
+	assert.Equal(t, "203.0.113.9", activities[0].IPAddress)
+	assert.Nil(t, activities[0].UserID)
+}
+
+func TestService_StartStreamEnforcesLimits(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+	track := &models.Track{ID: 3, Duration: 600000}
+
+	t.Run("count", func(t *testing.T) {
+		share := createShare(t, service, models.Share{MaxStreamingCount: 2}, "3")
+		require.NoError(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}))
+		require.NoError(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}))
+		assert.ErrorIs(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}), ErrLimitReached)
+
+		var activities int64
+		db.Model(&models.ShareActivity{}).Where("share_id = ? AND action = ? AND track_id = ?", share.ID, models.ShareActionStream, 3).Count(&activities)
+		assert.Equal(t, int64(2), activities)
+	})
+
+	t.Run("minutes", func(t *testing.T) {
+		// A stream that starts under the limit may run past it
+		share := createShare(t, service, models.Share{MaxStreamingMinutes: 15}, "3")
+		require.NoError(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}))
+		require.NoError(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}))
+		assert.ErrorIs(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}), ErrLimitReached)
+		assert.Equal(t, int64(1200), share.StreamedSeconds)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		share := createShare(t, service, models.Share{MaxStreamingCount: 3}, "3")
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				concurrent := *share
+				if err := service.StartStream(ctx, &concurrent, track, models.ShareActionStream, Visitor{}); err == nil {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				} else if !errors.Is(err, ErrLimitReached) {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 3, allowed)
+	})
+
+	t.Run("permissions", func(t *testing.T) {
+		share := createShare(t, service, models.Share{}, "3")
+		share.AllowStreaming = false
+		assert.ErrorIs(t, service.StartStream(ctx, share, track, models.ShareActionStream, Visitor{}), ErrStreamingDisabled)
+		assert.ErrorIs(t, service.StartStream(ctx, share, track, models.ShareActionDownload, Visitor{}), ErrDownloadDisabled)
+		share.AllowDownload = true
+		assert.NoError(t, service.StartStream(ctx, share, track, models.ShareActionDownload, Visitor{}))
+	})
+}
+
+func TestService_ResumeStream(t *testing.T) {
+	db := setupShareTestDB(t)
+	service := NewService(db, "")
+	ctx := context.Background()
+	track := &models.Track{ID: 3, Duration: 600000}
+	visitor := Visitor{IPAddress: "203.0.113.9"}
+
+	share := createShare(t, service, models.Share{MaxStreamingCount: 1}, "3")
+
+	// Resuming a stream that was never started starts one
+	require.NoError(t, service.ResumeStream(ctx, share, track, models.ShareActionStream, visitor))
+	assert.Equal(t, int32(1), share.StreamCount)
+
+	// Seeking in it afterwards doesn't count again, even at the limit
+	require.NoError(t, service.ResumeStream(ctx, share, track, models.ShareActionStream, visitor))
+	assert.Equal(t, int32(1), share.StreamCount)
+
+	// Another visitor can't resume it
+	other := Visitor{IPAddress: "198.51.100.4"}
+	assert.ErrorIs(t, service.ResumeStream(ctx, share, track, models.ShareActionStream, other), ErrLimitReached)
+}
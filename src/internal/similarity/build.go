@@ -0,0 +1,607 @@
+package similarity
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+const (
+	// sessionWindow is how many of the tracks played before it in a session a
+	// track is paired with; it bounds the work for long sessions
+	sessionWindow = 10
+
+	// maxStarredPerUser bounds the starred tracks and artists paired per user,
+	// most recently starred first
+	maxStarredPerUser = 200
+
+	// maxTagCandidates bounds the artists sharing a genre or mood that are
+	// scored for an artist; the closest in era are preferred
+	maxTagCandidates = 200
+
+	insertBatchSize = 1000
+)
+
+// Builder rebuilds the similarity tables
+type Builder struct {
+	db  *gorm.DB
+	cfg config.SimilarityConfig
+	now func() time.Time
+}
+
+// NewBuilder creates a new similarity builder
+func NewBuilder(db *gorm.DB, cfg config.SimilarityConfig) *Builder {
+	return &Builder{
+		db:  db,
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// Result counts the neighbors a rebuild stored
+type Result struct {
+	Artists int `json:"artists"`
+	Tracks  int `json:"tracks"`
+}
+
+// album is what the catalog keeps of an album
+type album struct {
+	artistID int64
+	genres   tagSet
+	moods    tagSet
+	year     int
+}
+
+// track is what the catalog keeps of a track
+type track struct {
+	artistID int64
+	albumID  int64
+}
+
+// artist is an artist's genres, moods and median album year
+type artist struct {
+	genres tagSet
+	moods  tagSet
+	year   int
+}
+
+// catalog is the library as the similarity computation sees it
+type catalog struct {
+	artists   map[int64]*artist
+	albums    map[int64]*album
+	tracks    map[int64]track
+	canonical map[int64]int64 // duplicate track ID -> ID of the original recording
+	related   map[int64]map[int64]bool
+}
+
+// signals are the co-occurrences collected from users' behavior
+type signals struct {
+	trackListening  *cooccurrence
+	artistListening *cooccurrence
+	trackStarring   *cooccurrence
+	artistStarring  *cooccurrence
+}
+
+// Rebuild recomputes every artist's and track's neighbors and replaces the
+// similarity tables with them
+func (b *Builder) Rebuild(ctx context.Context) (Result, error) {
+	cat, err := b.loadCatalog(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	sig := signals{
+		trackListening:  newCooccurrence(),
+		artistListening: newCooccurrence(),
+		trackStarring:   newCooccurrence(),
+		artistStarring:  newCooccurrence(),
+	}
+	if err := b.loadListening(ctx, cat, &sig); err != nil {
+		return Result{}, err
+	}
+	if err := b.loadStarring(ctx, cat, &sig); err != nil {
+		return Result{}, err
+	}
+
+	artists := b.artistNeighbors(cat, &sig)
+	tracks := b.trackNeighbors(cat, &sig)
+	return b.store(ctx, artists, tracks)
+}
+
+// tagList selects a text[] column as text and returns the separator to split
+// it on. SQLite, used in tests, stores such columns as comma separated text.
+func tagList(db *gorm.DB, column string) (string, string) {
+	if db.Dialector.Name() == "postgres" {
+		return fmt.Sprintf("array_to_string(%s, chr(31))", column), "\x1f"
+	}
+	return column, ","
+}
+
+func splitTags(value *string, separator string) []string {
+	if value == nil || *value == "" {
+		return nil
+	}
+	return strings.Split(*value, separator)
+}
+
+func (b *Builder) loadCatalog(ctx context.Context) (*catalog, error) {
+	db := b.db.WithContext(ctx)
+	cat := &catalog{
+		artists:   make(map[int64]*artist),
+		albums:    make(map[int64]*album),
+		tracks:    make(map[int64]track),
+		canonical: make(map[int64]int64),
+		related:   make(map[int64]map[int64]bool),
+	}
+
+	var artistIDs []int64
+	if err := db.Model(&models.Artist{}).Pluck("id", &artistIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load artists: %w", err)
+	}
+	for _, id := range artistIDs {
+		cat.artists[id] = &artist{genres: tagSet{}, moods: tagSet{}}
+	}
+
+	genres, separator := tagList(b.db, "albums.genres")
+	moods, _ := tagList(b.db, "albums.moods")
+	rows, err := db.Model(&models.Album{}).
+		Select("albums.id, albums.artist_id, " + genres + ", " + moods + ", albums.release_date, albums.original_release_date").
+		Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load albums: %w", err)
+	}
+	years := make(map[int64][]int)
+	for rows.Next() {
+		var id, artistID int64
+		var albumGenres, albumMoods *string
+		var released, originallyReleased *time.Time
+		if err := rows.Scan(&id, &artistID, &albumGenres, &albumMoods, &released, &originallyReleased); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read album: %w", err)
+		}
+
+		a := &album{
+			artistID: artistID,
+			genres:   newTagSet(splitTags(albumGenres, separator)),
+			moods:    newTagSet(splitTags(albumMoods, separator)),
+		}
+		if originallyReleased != nil {
+			a.year = originallyReleased.Year()
+		} else if released != nil {
+			a.year = released.Year()
+		}
+		cat.albums[id] = a
+
+		if profile, ok := cat.artists[artistID]; ok {
+			for tag := range a.genres {
+				profile.genres[tag] = struct{}{}
+			}
+			for tag := range a.moods {
+				profile.moods[tag] = struct{}{}
+			}
+			if a.year > 0 {
+				years[artistID] = append(years[artistID], a.year)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load albums: %w", err)
+	}
+	for artistID, albumYears := range years {
+		sort.Ints(albumYears)
+		cat.artists[artistID].year = albumYears[len(albumYears)/2]
+	}
+
+	rows, err = db.Model(&models.Track{}).Select("id, artist_id, album_id, duplicate_of_id").Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tracks: %w", err)
+	}
+	for rows.Next() {
+		var id, artistID, albumID int64
+		var duplicateOf *int64
+		if err := rows.Scan(&id, &artistID, &albumID, &duplicateOf); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read track: %w", err)
+		}
+		if duplicateOf != nil {
+			// Plays and stars of another edition's copy count for the original
+			cat.canonical[id] = *duplicateOf
+			continue
+		}
+		cat.tracks[id] = track{artistID: artistID, albumID: albumID}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load tracks: %w", err)
+	}
+
+	var relations []models.ArtistRelation
+	if err := db.Select("from_artist_id, to_artist_id").Find(&relations).Error; err != nil {
+		return nil, fmt.Errorf("failed to load artist relations: %w", err)
+	}
+	for _, relation := range relations {
+		cat.relate(relation.FromArtistID, relation.ToArtistID)
+	}
+
+	return cat, nil
+}
+
+// relate records a relation between two artists, in both directions
+func (cat *catalog) relate(a, b int64) {
+	if a == b {
+		return
+	}
+	for _, edge := range [][2]int64{{a, b}, {b, a}} {
+		if cat.related[edge[0]] == nil {
+			cat.related[edge[0]] = make(map[int64]bool)
+		}
+		cat.related[edge[0]][edge[1]] = true
+	}
+}
+
+// track returns the original recording of a track, or false if it is unknown
+func (cat *catalog) track(id int64) (int64, track, bool) {
+	if original, ok := cat.canonical[id]; ok {
+		id = original
+	}
+	t, ok := cat.tracks[id]
+	return id, t, ok
+}
+
+// session collects the distinct tracks and artists of one listening session
+type session struct {
+	userID  int64
+	last    time.Time
+	tracks  []int64
+	artists []int64
+	seen    map[int64]bool
+}
+
+// add pairs a newly played track and artist with the ones played shortly before
+func (s *session) add(sig *signals, trackID, artistID int64) {
+	if !s.seen[trackID] {
+		sig.trackListening.addItem(trackID)
+		for _, earlier := range tail(s.tracks, sessionWindow) {
+			sig.trackListening.addPair(earlier, trackID)
+		}
+		s.tracks = append(s.tracks, trackID)
+		s.seen[trackID] = true
+	}
+
+	// Artist IDs are negated in seen so they don't collide with track IDs
+	if !s.seen[-artistID] {
+		sig.artistListening.addItem(artistID)
+		for _, earlier := range tail(s.artists, sessionWindow) {
+			sig.artistListening.addPair(earlier, artistID)
+		}
+		s.artists = append(s.artists, artistID)
+		s.seen[-artistID] = true
+	}
+}
+
+func tail(ids []int64, n int) []int64 {
+	if len(ids) > n {
+		return ids[len(ids)-n:]
+	}
+	return ids
+}
+
+// loadListening splits each user's plays into sessions and counts the tracks
+// and artists played in the same session
+func (b *Builder) loadListening(ctx context.Context, cat *catalog, sig *signals) error {
+	query := b.db.WithContext(ctx).Model(&models.PlayEvent{}).
+		Select("user_id, track_id, played_at").
+		Order("user_id, played_at")
+	if b.cfg.HistoryDays > 0 {
+		query = query.Where("played_at >= ?", b.now().AddDate(0, 0, -b.cfg.HistoryDays))
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return fmt.Errorf("failed to load play events: %w", err)
+	}
+	defer rows.Close()
+
+	var current *session
+	for rows.Next() {
+		var userID, trackID int64
+		var playedAt time.Time
+		if err := rows.Scan(&userID, &trackID, &playedAt); err != nil {
+			return fmt.Errorf("failed to read play event: %w", err)
+		}
+		trackID, t, ok := cat.track(trackID)
+		if !ok {
+			continue
+		}
+
+		if current == nil || current.userID != userID || playedAt.Sub(current.last) > b.cfg.SessionGap {
+			current = &session{userID: userID, seen: make(map[int64]bool)}
+		}
+		current.last = playedAt
+		current.add(sig, trackID, t.artistID)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load play events: %w", err)
+	}
+	return nil
+}
+
+// starredRow is a user's star on a track, album or artist
+type starredRow struct {
+	UserID int64
+	ItemID int64
+}
+
+// loadStarring counts the tracks and the artists starred by the same users.
+// Starring an album or a track counts as starring its artist too.
+func (b *Builder) loadStarring(ctx context.Context, cat *catalog, sig *signals) error {
+	db := b.db.WithContext(ctx)
+	load := func(table, column string) ([]starredRow, error) {
+		var rows []starredRow
+		err := db.Table(table).
+			Select("user_id, "+column+" AS item_id").
+			Where("is_starred = ?", true).
+			Order("user_id, starred_at DESC, id DESC").
+			Scan(&rows).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", table, err)
+		}
+		return rows, nil
+	}
+
+	starredTracks, err := load("user_tracks", "track_id")
+	if err != nil {
+		return err
+	}
+	starredAlbums, err := load("user_albums", "album_id")
+	if err != nil {
+		return err
+	}
+	starredArtists, err := load("user_artists", "artist_id")
+	if err != nil {
+		return err
+	}
+
+	tracksByUser := make(map[int64][]int64)
+	artistsByUser := make(map[int64][]int64)
+	for _, row := range starredTracks {
+		if trackID, t, ok := cat.track(row.ItemID); ok {
+			tracksByUser[row.UserID] = append(tracksByUser[row.UserID], trackID)
+			artistsByUser[row.UserID] = append(artistsByUser[row.UserID], t.artistID)
+		}
+	}
+	for _, row := range starredAlbums {
+		if a, ok := cat.albums[row.ItemID]; ok {
+			artistsByUser[row.UserID] = append(artistsByUser[row.UserID], a.artistID)
+		}
+	}
+	for _, row := range starredArtists {
+		if _, ok := cat.artists[row.ItemID]; ok {
+			artistsByUser[row.UserID] = append(artistsByUser[row.UserID], row.ItemID)
+		}
+	}
+
+	for _, ids := range tracksByUser {
+		sig.trackStarring.addGroup(distinct(ids, maxStarredPerUser))
+	}
+	for _, ids := range artistsByUser {
+		sig.artistStarring.addGroup(distinct(ids, maxStarredPerUser))
+	}
+	return nil
+}
+
+// distinct returns the first limit distinct IDs, in order
+func distinct(ids []int64, limit int) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	result := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] && len(result) < limit {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// tagIndex lists the artists carrying each genre or mood, ordered by year
+type tagIndex map[string][]int64
+
+func newTagIndex(cat *catalog, tags func(*artist) tagSet) tagIndex {
+	index := make(tagIndex)
+	for id, a := range cat.artists {
+		for tag := range tags(a) {
+			index[tag] = append(index[tag], id)
+		}
+	}
+	for _, ids := range index {
+		sort.Slice(ids, func(i, j int) bool {
+			yi, yj := cat.artists[ids[i]].year, cat.artists[ids[j]].year
+			if yi != yj {
+				return yi < yj
+			}
+			return ids[i] < ids[j]
+		})
+	}
+	return index
+}
+
+// candidates adds up to limit artists sharing a tag with the artist, rarest
+// tags first and, within a tag, the closest in era
+func (index tagIndex) candidates(cat *catalog, id int64, tags tagSet, limit int, into map[int64]bool) {
+	ordered := make([]string, 0, len(tags))
+	for tag := range tags {
+		ordered = append(ordered, tag)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if len(index[ordered[i]]) != len(index[ordered[j]]) {
+			return len(index[ordered[i]]) < len(index[ordered[j]])
+		}
+		return ordered[i] < ordered[j]
+	})
+
+	year := cat.artists[id].year
+	added := 0
+	for _, tag := range ordered {
+		ids := index[tag]
+		// Walk outwards from the artist's year
+		right := sort.Search(len(ids), func(i int) bool { return cat.artists[ids[i]].year >= year })
+		left := right - 1
+		for added < limit && (left >= 0 || right < len(ids)) {
+			var next int64
+			if right >= len(ids) || (left >= 0 && year-cat.artists[ids[left]].year <= cat.artists[ids[right]].year-year) {
+				next = ids[left]
+				left--
+			} else {
+				next = ids[right]
+				right++
+			}
+			if next != id && !into[next] {
+				into[next] = true
+				added++
+			}
+		}
+		if added >= limit {
+			return
+		}
+	}
+}
+
+// artistNeighbors scores every artist against the artists it was listened to
+// or starred with, is related to or shares genres or moods with
+func (b *Builder) artistNeighbors(cat *catalog, sig *signals) map[int64][]neighbor {
+	genreIndex := newTagIndex(cat, func(a *artist) tagSet { return a.genres })
+	moodIndex := newTagIndex(cat, func(a *artist) tagSet { return a.moods })
+
+	result := make(map[int64][]neighbor)
+	for id, a := range cat.artists {
+		candidates := make(map[int64]bool)
+		for _, other := range sig.artistListening.neighbors[id] {
+			candidates[other] = true
+		}
+		for _, other := range sig.artistStarring.neighbors[id] {
+			candidates[other] = true
+		}
+		for other := range cat.related[id] {
+			candidates[other] = true
+		}
+		genreIndex.candidates(cat, id, a.genres, maxTagCandidates, candidates)
+		moodIndex.candidates(cat, id, a.moods, maxTagCandidates, candidates)
+
+		var scored []neighbor
+		for other := range candidates {
+			o, ok := cat.artists[other]
+			if !ok {
+				continue
+			}
+			f := features{
+				coListening: sig.artistListening.cosine(id, other),
+				coStarring:  sig.artistStarring.cosine(id, other),
+				genres:      jaccard(a.genres, o.genres),
+				moods:       jaccard(a.moods, o.moods),
+				era:         eraProximity(a.year, o.year),
+			}
+			if cat.related[id][other] {
+				f.related = 1
+			}
+			if s := score(f, b.cfg.Weights); s >= minScore {
+				scored = append(scored, neighbor{id: other, score: s})
+			}
+		}
+		if len(scored) > 0 {
+			result[id] = topNeighbors(scored, b.cfg.Neighbors)
+		}
+	}
+	return result
+}
+
+// trackNeighbors scores every track against the tracks it was listened to or
+// starred with. Tracks nobody played or starred have no neighbors of their
+// own; mixes fall back on their artist's neighbors.
+func (b *Builder) trackNeighbors(cat *catalog, sig *signals) map[int64][]neighbor {
+	result := make(map[int64][]neighbor)
+	for id, t := range cat.tracks {
+		candidates := make(map[int64]bool)
+		for _, other := range sig.trackListening.neighbors[id] {
+			candidates[other] = true
+		}
+		for _, other := range sig.trackStarring.neighbors[id] {
+			candidates[other] = true
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		a := cat.albums[t.albumID]
+		var scored []neighbor
+		for other := range candidates {
+			o := cat.tracks[other]
+			f := features{
+				coListening: sig.trackListening.cosine(id, other),
+				coStarring:  sig.trackStarring.cosine(id, other),
+			}
+			if oa := cat.albums[o.albumID]; a != nil && oa != nil {
+				f.genres = jaccard(a.genres, oa.genres)
+				f.moods = jaccard(a.moods, oa.moods)
+				f.era = eraProximity(a.year, oa.year)
+			}
+			if o.artistID == t.artistID || cat.related[t.artistID][o.artistID] {
+				f.related = 1
+			}
+			if s := score(f, b.cfg.Weights); s >= minScore {
+				scored = append(scored, neighbor{id: other, score: s})
+			}
+		}
+		if len(scored) > 0 {
+			result[id] = topNeighbors(scored, b.cfg.Neighbors)
+		}
+	}
+	return result
+}
+
+// store replaces the similarity tables in one transaction, so readers see
+// either the previous or the new neighbors
+func (b *Builder) store(ctx context.Context, artists, tracks map[int64][]neighbor) (Result, error) {
+	var artistRows []models.SimilarArtist
+	for id, neighbors := range artists {
+		for _, n := range neighbors {
+			artistRows = append(artistRows, models.SimilarArtist{ArtistID: id, SimilarArtistID: n.id, Score: n.score})
+		}
+	}
+	var trackRows []models.SimilarTrack
+	for id, neighbors := range tracks {
+		for _, n := range neighbors {
+			trackRows = append(trackRows, models.SimilarTrack{TrackID: id, SimilarTrackID: n.id, Score: n.score})
+		}
+	}
+
+	err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM similar_artists").Error; err != nil {
+			return fmt.Errorf("failed to clear similar artists: %w", err)
+		}
+		if err := tx.Exec("DELETE FROM similar_tracks").Error; err != nil {
+			return fmt.Errorf("failed to clear similar tracks: %w", err)
+		}
+		if len(artistRows) > 0 {
+			if err := tx.CreateInBatches(artistRows, insertBatchSize).Error; err != nil {
+				return fmt.Errorf("failed to store similar artists: %w", err)
+			}
+		}
+		if len(trackRows) > 0 {
+			if err := tx.CreateInBatches(trackRows, insertBatchSize).Error; err != nil {
+				return fmt.Errorf("failed to store similar tracks: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Artists: len(artistRows), Tracks: len(trackRows)}, nil
+}
@@ -0,0 +1,171 @@
+// Package similarity precomputes similar artists and songs from play history,
+// stars, genres and moods, artist relations and release years. A periodic job
+// rebuilds the similar_artists and similar_tracks tables; getSimilarSongs,
+// getArtistInfo and instant mixes read them.
+package similarity
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"melodee/internal/config"
+)
+
+const (
+	// eraSpan is the difference in release years at which era proximity reaches 0
+	eraSpan = 20.0
+
+	// minScore drops neighbors too weak to be worth storing
+	minScore = 0.02
+)
+
+// features are the signals compared for a pair of artists or tracks, each 0 to 1
+type features struct {
+	coListening float64
+	coStarring  float64
+	genres      float64
+	moods       float64
+	related     float64
+	era         float64
+}
+
+// score combines features into a 0 to 1 similarity with the configured weights
+func score(f features, w config.SimilarityWeights) float64 {
+	total := w.CoListening + w.CoStarring + w.Genres + w.Moods + w.Relations + w.Era
+	if total <= 0 {
+		return 0
+	}
+	sum := w.CoListening*f.coListening + w.CoStarring*f.coStarring +
+		w.Genres*f.genres + w.Moods*f.moods + w.Relations*f.related + w.Era*f.era
+	return sum / total
+}
+
+// pair is an unordered pair of IDs, smaller first
+type pair struct {
+	a, b int64
+}
+
+func newPair(a, b int64) pair {
+	if a > b {
+		a, b = b, a
+	}
+	return pair{a, b}
+}
+
+// cooccurrence counts how often items appear together in the same group (a
+// listening session, or the items a user starred)
+type cooccurrence struct {
+	together  map[pair]uint32
+	groups    map[int64]uint32 // groups each item appears in
+	neighbors map[int64][]int64
+}
+
+func newCooccurrence() *cooccurrence {
+	return &cooccurrence{
+		together:  make(map[pair]uint32),
+		groups:    make(map[int64]uint32),
+		neighbors: make(map[int64][]int64),
+	}
+}
+
+// addItem counts a group an item appears in
+func (c *cooccurrence) addItem(id int64) {
+	c.groups[id]++
+}
+
+// addPair counts a group two distinct items appear in together; a pair must
+// be added at most once per group
+func (c *cooccurrence) addPair(a, b int64) {
+	if a == b {
+		return
+	}
+	p := newPair(a, b)
+	if c.together[p] == 0 {
+		c.neighbors[a] = append(c.neighbors[a], b)
+		c.neighbors[b] = append(c.neighbors[b], a)
+	}
+	c.together[p]++
+}
+
+// addGroup counts a group of distinct items, pairing every item with every other
+func (c *cooccurrence) addGroup(ids []int64) {
+	for i, a := range ids {
+		c.addItem(a)
+		for _, b := range ids[i+1:] {
+			c.addPair(a, b)
+		}
+	}
+}
+
+// cosine is how often a and b appear together relative to how often each
+// appears at all: 1 when they always appear together
+func (c *cooccurrence) cosine(a, b int64) float64 {
+	together := c.together[newPair(a, b)]
+	if together == 0 {
+		return 0
+	}
+	return math.Min(1, float64(together)/math.Sqrt(float64(c.groups[a])*float64(c.groups[b])))
+}
+
+// tagSet is a set of lower-cased genres or moods
+type tagSet map[string]struct{}
+
+func newTagSet(tags ...[]string) tagSet {
+	set := make(tagSet)
+	for _, list := range tags {
+		for _, tag := range list {
+			if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+				set[tag] = struct{}{}
+			}
+		}
+	}
+	return set
+}
+
+// jaccard is the share of the two sets' tags they have in common
+func jaccard(a, b tagSet) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	shared := 0
+	for tag := range a {
+		if _, ok := b[tag]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// eraProximity is 1 for the same release year, falling to 0 eraSpan years
+// apart; 0 when either year is unknown
+func eraProximity(a, b int) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return math.Max(0, 1-math.Abs(float64(a-b))/eraSpan)
+}
+
+// neighbor is a candidate similar item with its score
+type neighbor struct {
+	id    int64
+	score float64
+}
+
+// topNeighbors keeps the limit best scoring neighbors, best first; ties go to
+// the lower ID so rebuilds are stable
+func topNeighbors(neighbors []neighbor, limit int) []neighbor {
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].score != neighbors[j].score {
+			return neighbors[i].score > neighbors[j].score
+		}
+		return neighbors[i].id < neighbors[j].id
+	})
+	if len(neighbors) > limit {
+		neighbors = neighbors[:limit]
+	}
+	return neighbors
+}
@@ -0,0 +1,51 @@
+package similarity
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"melodee/internal/config"
+)
+
+func TestScore_WeightsSignals(t *testing.T) {
+	weights := config.SimilarityWeights{CoListening: 3, Genres: 1}
+
+	assert.InDelta(t, 1.0, score(features{coListening: 1, genres: 1, era: 1}, weights), 1e-9)
+	assert.InDelta(t, 0.75, score(features{coListening: 1}, weights), 1e-9)
+	assert.InDelta(t, 0.25, score(features{genres: 1, moods: 1}, weights), 1e-9)
+	assert.Zero(t, score(features{coListening: 1}, config.SimilarityWeights{}))
+}
+
+func TestCooccurrence_Cosine(t *testing.T) {
+	c := newCooccurrence()
+	c.addGroup([]int64{1, 2})
+	c.addGroup([]int64{1, 2, 3})
+	c.addGroup([]int64{1})
+	c.addGroup([]int64{4, 4})
+
+	// 1 appears in 3 groups, 2 in 2, together in 2
+	assert.InDelta(t, 2/2.449489742783178, c.cosine(1, 2), 1e-9)
+	assert.InDelta(t, c.cosine(1, 2), c.cosine(2, 1), 1e-9)
+	assert.InDelta(t, 1/1.4142135623730951, c.cosine(2, 3), 1e-9)
+	assert.Zero(t, c.cosine(1, 4))
+	assert.Zero(t, c.cosine(4, 4))
+	assert.ElementsMatch(t, []int64{2, 3}, c.neighbors[1])
+}
+
+func TestTagsAndEra(t *testing.T) {
+	jazz := newTagSet([]string{"Jazz", " Cool Jazz"}, []string{"jazz"})
+	assert.Len(t, jazz, 2)
+	assert.InDelta(t, 1.0/3, jaccard(jazz, newTagSet([]string{"jazz", "bebop"})), 1e-9)
+	assert.Zero(t, jaccard(jazz, newTagSet(nil)))
+
+	assert.Equal(t, 1.0, eraProximity(1959, 1959))
+	assert.InDelta(t, 0.5, eraProximity(1959, 1969), 1e-9)
+	assert.Zero(t, eraProximity(1959, 1991))
+	assert.Zero(t, eraProximity(0, 1959))
+}
+
+func TestTopNeighbors(t *testing.T) {
+	top := topNeighbors([]neighbor{{id: 3, score: 0.5}, {id: 1, score: 0.9}, {id: 2, score: 0.5}, {id: 4, score: 0.1}}, 3)
+	assert.Equal(t, []neighbor{{id: 1, score: 0.9}, {id: 2, score: 0.5}, {id: 3, score: 0.5}}, top)
+}
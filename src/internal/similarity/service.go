@@ -0,0 +1,183 @@
+package similarity
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"melodee/internal/models"
+)
+
+const (
+	// mixArtists is how many similar artists an artist mix draws from
+	mixArtists = 20
+
+	// mixTracksPerArtist bounds the tracks an artist mix takes from each artist
+	mixTracksPerArtist = 5
+)
+
+// Service reads the precomputed similar artists and tracks. Everything a
+// user marked hated (the track, its album or its artist) is left out.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new similarity service
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db}
+}
+
+// notHatedArtists excludes artists the user hates
+func notHatedArtists(userID int64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if userID == 0 {
+			return db
+		}
+		return db.Where("NOT EXISTS (SELECT 1 FROM user_artists WHERE user_artists.artist_id = artists.id AND user_artists.user_id = ? AND user_artists.is_hated = ?)", userID, true)
+	}
+}
+
+// notHatedTracks excludes tracks the user hates, or whose album or artist the user hates
+func notHatedTracks(userID int64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if userID == 0 {
+			return db
+		}
+		return db.
+			Where("NOT EXISTS (SELECT 1 FROM user_tracks WHERE user_tracks.track_id = tracks.id AND user_tracks.user_id = ? AND user_tracks.is_hated = ?)", userID, true).
+			Where("NOT EXISTS (SELECT 1 FROM user_albums WHERE user_albums.album_id = tracks.album_id AND user_albums.user_id = ? AND user_albums.is_hated = ?)", userID, true).
+			Where("NOT EXISTS (SELECT 1 FROM user_artists WHERE user_artists.artist_id = tracks.artist_id AND user_artists.user_id = ? AND user_artists.is_hated = ?)", userID, true)
+	}
+}
+
+// SimilarArtists returns up to limit artists similar to an artist, most similar first
+func (s *Service) SimilarArtists(ctx context.Context, artistID, userID int64, limit int) ([]models.Artist, error) {
+	var artists []models.Artist
+	err := s.db.WithContext(ctx).
+		Select("artists.*").
+		Joins("JOIN similar_artists ON similar_artists.similar_artist_id = artists.id").
+		Where("similar_artists.artist_id = ?", artistID).
+		Scopes(notHatedArtists(userID)).
+		Order("similar_artists.score DESC, artists.id").
+		Limit(limit).
+		Find(&artists).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load similar artists: %w", err)
+	}
+	return artists, nil
+}
+
+// TrackMix returns up to count tracks to play after a track: its own
+// neighbors first, then tracks by its artist's similar artists and by its
+// artist. The track itself is not included.
+func (s *Service) TrackMix(ctx context.Context, trackID, userID int64, count int) ([]models.Track, error) {
+	var seed models.Track
+	if err := s.db.WithContext(ctx).First(&seed, trackID).Error; err != nil {
+		return nil, err
+	}
+	if seed.DuplicateOfID != nil {
+		// Neighbors are computed for the original recording
+		trackID = *seed.DuplicateOfID
+	}
+
+	var tracks []models.Track
+	err := s.db.WithContext(ctx).
+		Select("tracks.*").
+		Joins("JOIN similar_tracks ON similar_tracks.similar_track_id = tracks.id").
+		Where("similar_tracks.track_id = ?", trackID).
+		Scopes(notHatedTracks(userID)).
+		Order("similar_tracks.score DESC, tracks.id").
+		Limit(count).
+		Preload("Album").
+		Preload("Artist").
+		Find(&tracks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load similar tracks: %w", err)
+	}
+	if len(tracks) >= count {
+		return tracks, nil
+	}
+
+	exclude := map[int64]bool{seed.ID: true, trackID: true}
+	for _, t := range tracks {
+		exclude[t.ID] = true
+	}
+	more, err := s.artistTracks(ctx, seed.ArtistID, userID, count-len(tracks), exclude)
+	if err != nil {
+		return nil, err
+	}
+	return append(tracks, more...), nil
+}
+
+// ArtistMix returns up to count tracks by an artist and by its similar
+// artists, taking turns between the artists, most similar first
+func (s *Service) ArtistMix(ctx context.Context, artistID, userID int64, count int) ([]models.Track, error) {
+	return s.artistTracks(ctx, artistID, userID, count, map[int64]bool{})
+}
+
+// artistTracks picks up to count tracks, a few random ones from each of the
+// artist and its similar artists, skipping the tracks in exclude
+func (s *Service) artistTracks(ctx context.Context, artistID, userID int64, count int, exclude map[int64]bool) ([]models.Track, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	artistIDs := []int64{artistID}
+	var similar []int64
+	err := s.db.WithContext(ctx).Model(&models.SimilarArtist{}).
+		Joins("JOIN artists ON artists.id = similar_artists.similar_artist_id").
+		Where("similar_artists.artist_id = ?", artistID).
+		Scopes(notHatedArtists(userID)).
+		Order("similar_artists.score DESC, similar_artists.similar_artist_id").
+		Limit(mixArtists).
+		Pluck("similar_artists.similar_artist_id", &similar).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load similar artists: %w", err)
+	}
+	artistIDs = append(artistIDs, similar...)
+
+	perArtist := (count + len(artistIDs) - 1) / len(artistIDs)
+	if perArtist > mixTracksPerArtist {
+		perArtist = mixTracksPerArtist
+	}
+
+	random := "RANDOM()"
+	if s.db.Dialector.Name() == "mysql" {
+		random = "RAND()"
+	}
+
+	byArtist := make([][]models.Track, 0, len(artistIDs))
+	for _, id := range artistIDs {
+		var tracks []models.Track
+		query := s.db.WithContext(ctx).
+			Where("tracks.artist_id = ? AND tracks.duplicate_of_id IS NULL", id).
+			Scopes(notHatedTracks(userID))
+		if len(exclude) > 0 {
+			ids := make([]int64, 0, len(exclude))
+			for excluded := range exclude {
+				ids = append(ids, excluded)
+			}
+			query = query.Where("tracks.id NOT IN ?", ids)
+		}
+		err := query.Order(random).
+			Limit(perArtist).
+			Preload("Album").
+			Preload("Artist").
+			Find(&tracks).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tracks for artist %d: %w", id, err)
+		}
+		byArtist = append(byArtist, tracks)
+	}
+
+	// Take turns so the mix doesn't play one artist after another
+	mix := make([]models.Track, 0, count)
+	for round := 0; round < perArtist && len(mix) < count; round++ {
+		for _, tracks := range byArtist {
+			if round < len(tracks) && len(mix) < count {
+				mix = append(mix, tracks[round])
+			}
+		}
+	}
+	return mix, nil
+}
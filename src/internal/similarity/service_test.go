@@ -0,0 +1,212 @@
+package similarity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func setupSimilarityTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	for _, ddl := range []string{
+		`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`,
+		`CREATE TABLE albums (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER,
+			genres TEXT, moods TEXT, release_date DATETIME, original_release_date DATETIME
+		)`,
+		`CREATE TABLE tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER,
+			duplicate_of_id INTEGER, duration INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE play_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, track_id INTEGER NOT NULL,
+			played_at DATETIME NOT NULL, created_at DATETIME
+		)`,
+		`CREATE TABLE user_tracks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, track_id INTEGER,
+			is_starred BOOLEAN DEFAULT 0, is_hated BOOLEAN DEFAULT 0, starred_at DATETIME
+		)`,
+		`CREATE TABLE user_albums (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, album_id INTEGER,
+			is_starred BOOLEAN DEFAULT 0, is_hated BOOLEAN DEFAULT 0, starred_at DATETIME
+		)`,
+		`CREATE TABLE user_artists (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, artist_id INTEGER,
+			is_starred BOOLEAN DEFAULT 0, is_hated BOOLEAN DEFAULT 0, starred_at DATETIME
+		)`,
+		`CREATE TABLE artist_relations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT, from_artist_id INTEGER, to_artist_id INTEGER, relation_type TEXT
+		)`,
+		`CREATE TABLE similar_artists (
+			artist_id INTEGER NOT NULL, similar_artist_id INTEGER NOT NULL, score REAL NOT NULL,
+			PRIMARY KEY (artist_id, similar_artist_id)
+		)`,
+		`CREATE TABLE similar_tracks (
+			track_id INTEGER NOT NULL, similar_track_id INTEGER NOT NULL, score REAL NOT NULL,
+			PRIMARY KEY (track_id, similar_track_id)
+		)`,
+	} {
+		require.NoError(t, db.Exec(ddl).Error)
+	}
+
+	db.Exec(`INSERT INTO artists (id, name) VALUES
+		(1, 'Miles Davis'), (2, 'John Coltrane'), (3, 'Bill Evans'), (4, 'Nirvana'), (5, 'Hole')`)
+	return db
+}
+
+func testSimilarityConfig() config.SimilarityConfig {
+	return config.DefaultAppConfig().Similarity
+}
+
+func similarArtistIDs(t *testing.T, db *gorm.DB, artistID int64) []int64 {
+	var ids []int64
+	require.NoError(t, db.Model(&models.SimilarArtist{}).Where("artist_id = ?", artistID).
+		Order("score DESC").Pluck("similar_artist_id", &ids).Error)
+	return ids
+}
+
+func TestBuilder_RebuildCombinesSignals(t *testing.T) {
+	db := setupSimilarityTestDB(t)
+	ctx := context.Background()
+
+	db.Exec(`INSERT INTO albums (id, name, artist_id, genres, release_date) VALUES
+		(1, 'Kind of Blue', 1, 'Jazz,Modal Jazz', '1959-08-17 00:00:00'),
+		(2, 'Giant Steps', 2, 'Jazz,Hard Bop', '1960-01-27 00:00:00'),
+		(3, 'Sunday at the Village Vanguard', 3, 'Jazz', '1961-10-01 00:00:00'),
+		(4, 'Nevermind', 4, 'Rock,Grunge', '1991-09-24 00:00:00'),
+		(5, 'Live Through This', 5, 'Rock,Grunge', '1994-04-12 00:00:00'),
+		(6, 'Giant Steps (Deluxe)', 2, 'Jazz,Hard Bop', '2020-01-01 00:00:00')`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, duplicate_of_id) VALUES
+		(10, 'So What', 1, 1, NULL),
+		(11, 'Freddie Freeloader', 1, 1, NULL),
+		(20, 'Giant Steps', 2, 2, NULL),
+		(21, 'Giant Steps', 6, 2, 20),
+		(30, 'Gloria''s Step', 3, 3, NULL),
+		(40, 'In Bloom', 4, 4, NULL),
+		(50, 'Doll Parts', 5, 5, NULL)`)
+	db.Exec(`INSERT INTO artist_relations (from_artist_id, to_artist_id, relation_type) VALUES (3, 1, 'member')`)
+
+	// One session pairs So What with the deluxe copy of Giant Steps; Nirvana
+	// and Hole are played hours later, in another session
+	start := time.Now().Add(-24 * time.Hour).UTC()
+	for _, play := range []struct {
+		trackID int64
+		offset  time.Duration
+	}{{10, 0}, {21, 10 * time.Minute}, {40, 4 * time.Hour}, {50, 4*time.Hour + 5*time.Minute}} {
+		require.NoError(t, db.Exec(`INSERT INTO play_events (user_id, track_id, played_at) VALUES (1, ?, ?)`,
+			play.trackID, start.Add(play.offset)).Error)
+	}
+	db.Exec(`INSERT INTO user_tracks (user_id, track_id, is_starred, starred_at) VALUES
+		(2, 10, 1, '2024-01-01 00:00:00'), (2, 30, 1, '2024-01-02 00:00:00')`)
+
+	builder := NewBuilder(db, testSimilarityConfig())
+	result, err := builder.Rebuild(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, result.Artists)
+	assert.Positive(t, result.Tracks)
+
+	miles := similarArtistIDs(t, db, 1)
+	assert.Contains(t, miles, int64(2), "listened to together and both jazz")
+	assert.Contains(t, miles, int64(3), "related, starred together and both jazz")
+	assert.NotContains(t, miles, int64(4))
+	assert.Equal(t, []int64{5}, similarArtistIDs(t, db, 4))
+
+	var soWhat []models.SimilarTrack
+	require.NoError(t, db.Where("track_id = ?", 10).Order("score DESC").Find(&soWhat).Error)
+	var neighbors []int64
+	for _, n := range soWhat {
+		neighbors = append(neighbors, n.SimilarTrackID)
+		assert.True(t, n.Score > 0 && n.Score <= 1)
+	}
+	assert.ElementsMatch(t, []int64{20, 30}, neighbors, "the deluxe copy counts for the original")
+
+	var deluxe int64
+	db.Model(&models.SimilarTrack{}).Where("track_id = ? OR similar_track_id = ?", 21, 21).Count(&deluxe)
+	assert.Zero(t, deluxe)
+
+	// A rebuild replaces the previous neighbors
+	again, err := builder.Rebuild(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, result, again)
+	var stored int64
+	db.Model(&models.SimilarArtist{}).Count(&stored)
+	assert.Equal(t, int64(result.Artists), stored)
+}
+
+func TestService_MixesSkipHated(t *testing.T) {
+	db := setupSimilarityTestDB(t)
+	ctx := context.Background()
+
+	db.Exec(`INSERT INTO albums (id, name, artist_id) VALUES
+		(1, 'Kind of Blue', 1), (2, 'Giant Steps', 2), (3, 'Sunday at the Village Vanguard', 3), (6, 'Giant Steps (Deluxe)', 2)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, duplicate_of_id) VALUES
+		(10, 'So What', 1, 1, NULL),
+		(11, 'Freddie Freeloader', 1, 1, NULL),
+		(20, 'Giant Steps', 2, 2, NULL),
+		(21, 'Giant Steps', 6, 2, 20),
+		(22, 'Naima', 2, 2, NULL),
+		(30, 'Gloria''s Step', 3, 3, NULL)`)
+	require.NoError(t, db.Create([]models.SimilarArtist{
+		{ArtistID: 1, SimilarArtistID: 2, Score: 0.8},
+		{ArtistID: 1, SimilarArtistID: 3, Score: 0.6},
+	}).Error)
+	require.NoError(t, db.Create([]models.SimilarTrack{
+		{TrackID: 10, SimilarTrackID: 20, Score: 0.9},
+		{TrackID: 10, SimilarTrackID: 30, Score: 0.4},
+	}).Error)
+
+	service := NewService(db)
+
+	artists, err := service.SimilarArtists(ctx, 1, 7, 10)
+	require.NoError(t, err)
+	require.Len(t, artists, 2)
+	assert.Equal(t, "John Coltrane", artists[0].Name)
+
+	// Neighbors come first, then tracks by similar artists and the artist itself
+	mix, err := service.TrackMix(ctx, 10, 7, 4)
+	require.NoError(t, err)
+	require.Len(t, mix, 4)
+	assert.Equal(t, int64(20), mix[0].ID)
+	assert.Equal(t, int64(30), mix[1].ID)
+	assert.NotNil(t, mix[0].Artist)
+	ids := map[int64]bool{}
+	for _, track := range mix {
+		assert.NotEqual(t, int64(10), track.ID)
+		assert.NotEqual(t, int64(21), track.ID, "duplicates are left out of mixes")
+		assert.False(t, ids[track.ID])
+		ids[track.ID] = true
+	}
+
+	// User 7 hates Bill Evans and Naima
+	db.Exec(`INSERT INTO user_artists (user_id, artist_id, is_hated) VALUES (7, 3, 1)`)
+	db.Exec(`INSERT INTO user_tracks (user_id, track_id, is_hated) VALUES (7, 22, 1)`)
+
+	artists, err = service.SimilarArtists(ctx, 1, 7, 10)
+	require.NoError(t, err)
+	require.Len(t, artists, 1)
+	assert.Equal(t, int64(2), artists[0].ID)
+
+	mix, err = service.ArtistMix(ctx, 1, 7, 10)
+	require.NoError(t, err)
+	var mixed []int64
+	for _, track := range mix {
+		mixed = append(mixed, track.ID)
+	}
+	assert.ElementsMatch(t, []int64{10, 11, 20}, mixed)
+	assert.Equal(t, int64(1), mix[0].ArtistID, "the artist itself comes first")
+
+	// Another user's hates don't apply
+	artists, err = service.SimilarArtists(ctx, 1, 8, 10)
+	require.NoError(t, err)
+	assert.Len(t, artists, 2)
+}
@@ -0,0 +1,57 @@
+package similarity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/logging"
+)
+
+// Job types for Asynq
+const (
+	TypeSimilarityRebuild = "similarity:rebuild"
+)
+
+// NewRebuildTask creates a task that rebuilds the similarity tables
+func NewRebuildTask() *asynq.Task {
+	return asynq.NewTask(TypeSimilarityRebuild, nil)
+}
+
+// EnqueueRebuild creates and enqueues a rebuild of the similarity tables
+func EnqueueRebuild(client *asynq.Client) error {
+	// One rebuild at a time: a rebuild requested while one is queued or running is dropped
+	_, err := client.Enqueue(NewRebuildTask(),
+		asynq.TaskID("similarity.rebuild"),
+		asynq.Queue("maintenance"),
+		asynq.Timeout(2*time.Hour),
+	)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue similarity rebuild: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs similarity jobs
+type TaskHandler struct {
+	builder *Builder
+}
+
+// NewTaskHandler creates a new similarity task handler
+func NewTaskHandler(builder *Builder) *TaskHandler {
+	return &TaskHandler{builder: builder}
+}
+
+// HandleRebuild recomputes similar artists and tracks
+func (h *TaskHandler) HandleRebuild(ctx context.Context, t *asynq.Task) error {
+	started := time.Now()
+	result, err := h.builder.Rebuild(ctx)
+	if err != nil {
+		return err
+	}
+	logging.Infof("similarity: stored %d similar artists and %d similar tracks in %s",
+		result.Artists, result.Tracks, time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,364 @@
+package smartplaylist
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxDepth      = 8   // nesting of all/any/not groups
+	maxConditions = 200 // rules in one playlist
+)
+
+type fieldKind int
+
+const (
+	numberField fieldKind = iota
+	boolField
+	dateField
+	genreField
+)
+
+// field is a rule field. column is empty for fields whose SQL depends on the dialect.
+type field struct {
+	kind     fieldKind
+	column   string
+	min, max int64
+	nullable bool // is_not also matches tracks without a value
+}
+
+var fields = map[string]field{
+	"genre":       {kind: genreField},
+	"year":        {kind: numberField, min: 1, max: 9999, nullable: true},
+	"rating":      {kind: numberField, column: "COALESCE(user_tracks.rating, 0)", min: 0, max: 5},
+	"play_count":  {kind: numberField, column: "COALESCE(user_tracks.played_count, 0)", min: 0, max: math.MaxInt32},
+	"last_played": {kind: dateField, column: "user_tracks.last_played_at"},
+	"starred":     {kind: boolField, column: "COALESCE(user_tracks.is_starred, FALSE)"},
+	"hated":       {kind: boolField, column: "COALESCE(user_tracks.is_hated, FALSE)"},
+	"bitrate":     {kind: numberField, column: "tracks.bit_rate", min: 0, max: math.MaxInt32},
+	"added":       {kind: dateField, column: "tracks.created_at"},
+	"library":     {kind: numberField, column: "tracks.library_id", min: 1, max: math.MaxInt32, nullable: true},
+}
+
+var sortColumns = map[string]string{
+	"title":       "tracks.name_normalized",
+	"album":       "albums.name_normalized",
+	"track":       "tracks.sort_order",
+	"year":        "", // dialect specific
+	"rating":      "COALESCE(user_tracks.rating, 0)",
+	"play_count":  "COALESCE(user_tracks.played_count, 0)",
+	"last_played": "COALESCE(user_tracks.last_played_at, '1970-01-01')",
+	"added":       "tracks.created_at",
+	"bitrate":     "tracks.bit_rate",
+	"random":      "", // seeded or not
+}
+
+// Options control how rules are compiled
+type Options struct {
+	Postgres  bool      // use Postgres SQL for dialect specific fields
+	MaxTracks int       // the limit when rules have none, and its upper bound
+	Now       time.Time // reference time for in_last_days rules
+}
+
+// Compiled is a checked rule set ready to run
+type Compiled struct {
+	where string
+	args  []interface{}
+	order []string
+	limit int
+}
+
+// Compile checks rules and turns them into SQL. Errors wrap ErrInvalidRules
+// and name the offending rule, e.g. "all[1].any[0]: rating must be between 0 and 5".
+func Compile(rules *Rules, opts Options) (*Compiled, error) {
+	c := &compiler{opts: opts}
+
+	compiled := &Compiled{limit: opts.MaxTracks}
+	if !rules.Condition.isEmpty() {
+		where, err := c.condition(rules.Condition, "rules", 0)
+		if err != nil {
+			return nil, err
+		}
+		compiled.where, compiled.args = where, c.args
+	}
+
+	switch {
+	case rules.Limit < 0 || rules.Limit > opts.MaxTracks:
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidRules, opts.MaxTracks)
+	case rules.Limit > 0:
+		compiled.limit = rules.Limit
+	}
+
+	order, err := c.order(rules)
+	if err != nil {
+		return nil, err
+	}
+	compiled.order = order
+	return compiled, nil
+}
+
+// Query selects the IDs of the tracks matching the rules for a user, in playlist order
+func (c *Compiled) Query(db *gorm.DB, userID int64) *gorm.DB {
+	query := db.Table("tracks").
+		Select("tracks.id").
+		Joins("LEFT JOIN albums ON albums.id = tracks.album_id").
+		Joins("LEFT JOIN user_tracks ON user_tracks.track_id = tracks.id AND user_tracks.user_id = ?", userID)
+	if c.where != "" {
+		query = query.Where(c.where, c.args...)
+	}
+	for _, order := range c.order {
+		query = query.Order(order)
+	}
+	return query.Limit(c.limit)
+}
+
+type compiler struct {
+	opts       Options
+	args       []interface{}
+	conditions int
+}
+
+func (c Condition) isEmpty() bool {
+	return len(c.All) == 0 && len(c.Any) == 0 && c.Not == nil && c.Field == "" && c.Op == "" && len(c.Value) == 0
+}
+
+func invalid(path, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidRules, path, fmt.Sprintf(format, args...))
+}
+
+func (c *compiler) condition(cond Condition, path string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", invalid(path, "conditions are nested more than %d levels deep", maxDepth)
+	}
+	c.conditions++
+	if c.conditions > maxConditions {
+		return "", invalid(path, "more than %d conditions", maxConditions)
+	}
+
+	parts := 0
+	for _, set := range []bool{len(cond.All) > 0, len(cond.Any) > 0, cond.Not != nil, cond.Field != ""} {
+		if set {
+			parts++
+		}
+	}
+	if parts != 1 {
+		return "", invalid(path, "a condition needs exactly one of all, any, not or field")
+	}
+
+	switch {
+	case len(cond.All) > 0:
+		return c.group(cond.All, " AND ", path+".all", depth)
+	case len(cond.Any) > 0:
+		return c.group(cond.Any, " OR ", path+".any", depth)
+	case cond.Not != nil:
+		sql, err := c.condition(*cond.Not, path+".not", depth+1)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + sql + ")", nil
+	default:
+		return c.rule(cond, path)
+	}
+}
+
+func (c *compiler) group(conditions []Condition, join, path string, depth int) (string, error) {
+	parts := make([]string, 0, len(conditions))
+	for i, cond := range conditions {
+		sql, err := c.condition(cond, fmt.Sprintf("%s[%d]", path, i), depth+1)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, sql)
+	}
+	return "(" + strings.Join(parts, join) + ")", nil
+}
+
+func (c *compiler) rule(cond Condition, path string) (string, error) {
+	f, ok := fields[cond.Field]
+	if !ok {
+		return "", invalid(path, "unknown field %q", cond.Field)
+	}
+	if len(cond.Value) == 0 {
+		return "", invalid(path, "%s %s needs a value", cond.Field, cond.Op)
+	}
+
+	switch f.kind {
+	case numberField:
+		return c.numberRule(cond, f, path)
+	case boolField:
+		if cond.Op != "is" {
+			return "", invalid(path, "%s only supports is", cond.Field)
+		}
+		var value bool
+		if err := json.Unmarshal(cond.Value, &value); err != nil {
+			return "", invalid(path, "%s must be true or false", cond.Field)
+		}
+		return c.bind(f.column+" = ?", value), nil
+	case dateField:
+		return c.dateRule(cond, f, path)
+	default:
+		return c.genreRule(cond, path)
+	}
+}
+
+func (c *compiler) numberRule(cond Condition, f field, path string) (string, error) {
+	column := f.column
+	if cond.Field == "year" {
+		column = c.yearColumn()
+	}
+
+	if cond.Op == "between" {
+		var bounds []int64
+		if err := json.Unmarshal(cond.Value, &bounds); err != nil || len(bounds) != 2 {
+			return "", invalid(path, "%s between needs two whole numbers", cond.Field)
+		}
+		for _, bound := range bounds {
+			if bound < f.min || bound > f.max {
+				return "", invalid(path, "%s must be between %d and %d", cond.Field, f.min, f.max)
+			}
+		}
+		if bounds[0] > bounds[1] {
+			bounds[0], bounds[1] = bounds[1], bounds[0]
+		}
+		return c.bind(column+" BETWEEN ? AND ?", bounds[0], bounds[1]), nil
+	}
+
+	var value int64
+	if err := json.Unmarshal(cond.Value, &value); err != nil {
+		return "", invalid(path, "%s must be a whole number", cond.Field)
+	}
+	if value < f.min || value > f.max {
+		return "", invalid(path, "%s must be between %d and %d", cond.Field, f.min, f.max)
+	}
+
+	switch cond.Op {
+	case "is":
+		return c.bind(column+" = ?", value), nil
+	case "is_not":
+		if f.nullable {
+			return c.bind("("+column+" IS NULL OR "+column+" <> ?)", value), nil
+		}
+		return c.bind(column+" <> ?", value), nil
+	case "gt":
+		return c.bind(column+" > ?", value), nil
+	case "gte":
+		return c.bind(column+" >= ?", value), nil
+	case "lt":
+		return c.bind(column+" < ?", value), nil
+	case "lte":
+		return c.bind(column+" <= ?", value), nil
+	}
+	return "", invalid(path, "%s does not support %q; use is, is_not, gt, gte, lt, lte or between", cond.Field, cond.Op)
+}
+
+func (c *compiler) dateRule(cond Condition, f field, path string) (string, error) {
+	switch cond.Op {
+	case "in_last_days", "not_in_last_days":
+		var days int
+		if err := json.Unmarshal(cond.Value, &days); err != nil || days < 1 || days > 36500 {
+			return "", invalid(path, "%s %s needs a number of days between 1 and 36500", cond.Field, cond.Op)
+		}
+		since := c.opts.Now.AddDate(0, 0, -days)
+		if cond.Op == "in_last_days" {
+			return c.bind(f.column+" >= ?", since), nil
+		}
+		return c.bind("("+f.column+" IS NULL OR "+f.column+" < ?)", since), nil
+	case "before", "after":
+		var value string
+		if err := json.Unmarshal(cond.Value, &value); err != nil {
+			return "", invalid(path, "%s %s needs a date like 2006-01-02", cond.Field, cond.Op)
+		}
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", invalid(path, "%s %s needs a date like 2006-01-02", cond.Field, cond.Op)
+		}
+		if cond.Op == "before" {
+			return c.bind(f.column+" < ?", date), nil
+		}
+		return c.bind(f.column+" >= ?", date.AddDate(0, 0, 1)), nil
+	}
+	return "", invalid(path, "%s does not support %q; use in_last_days, not_in_last_days, before or after", cond.Field, cond.Op)
+}
+
+func (c *compiler) genreRule(cond Condition, path string) (string, error) {
+	var genre string
+	if err := json.Unmarshal(cond.Value, &genre); err != nil || strings.TrimSpace(genre) == "" {
+		return "", invalid(path, "genre must be a non-empty string")
+	}
+	genre = strings.ToLower(strings.TrimSpace(genre))
+
+	var match string
+	switch cond.Op {
+	case "is", "is_not":
+		if c.opts.Postgres {
+			match = c.bind("EXISTS (SELECT 1 FROM unnest(albums.genres) AS genre WHERE lower(genre) = ?)", genre)
+		} else {
+			match = c.bind("lower(COALESCE(albums.genres, '')) LIKE ?", "%"+genre+"%")
+		}
+	case "contains", "not_contains":
+		if c.opts.Postgres {
+			match = c.bind("EXISTS (SELECT 1 FROM unnest(albums.genres) AS genre WHERE lower(genre) LIKE ?)", "%"+genre+"%")
+		} else {
+			match = c.bind("lower(COALESCE(albums.genres, '')) LIKE ?", "%"+genre+"%")
+		}
+	default:
+		return "", invalid(path, "genre does not support %q; use is, is_not, contains or not_contains", cond.Op)
+	}
+
+	if cond.Op == "is_not" || cond.Op == "not_contains" {
+		return "NOT " + match, nil
+	}
+	return match, nil
+}
+
+func (c *compiler) order(rules *Rules) ([]string, error) {
+	if len(rules.Sort) == 0 {
+		return []string{"albums.name_normalized ASC", "tracks.sort_order ASC", "tracks.id ASC"}, nil
+	}
+
+	order := make([]string, 0, len(rules.Sort)+1)
+	for i, sort := range rules.Sort {
+		column, ok := sortColumns[sort.Field]
+		if !ok {
+			return nil, invalid(fmt.Sprintf("sort[%d]", i), "unknown sort field %q", sort.Field)
+		}
+		switch sort.Field {
+		case "year":
+			column = "COALESCE(" + c.yearColumn() + ", 0)"
+		case "random":
+			column = "RANDOM()"
+			if rules.Seed != nil {
+				// A hash of the track ID, so the same seed gives the same order
+				seed := *rules.Seed % 2147483647
+				if seed < 0 {
+					seed = -seed
+				}
+				column = fmt.Sprintf("((tracks.id * 1103515245 + %d) %% 2147483647)", seed)
+			}
+		}
+
+		direction := "ASC"
+		if sort.Desc {
+			direction = "DESC"
+		}
+		order = append(order, column+" "+direction)
+	}
+	return append(order, "tracks.id ASC"), nil
+}
+
+func (c *compiler) yearColumn() string {
+	if c.opts.Postgres {
+		return "CAST(EXTRACT(YEAR FROM albums.release_date) AS INTEGER)"
+	}
+	return "CAST(strftime('%Y', albums.release_date) AS INTEGER)"
+}
+
+func (c *compiler) bind(sql string, args ...interface{}) string {
+	c.args = append(c.args, args...)
+	return sql
+}
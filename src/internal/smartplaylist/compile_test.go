@@ -0,0 +1,75 @@
+package smartplaylist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compileJSON(t *testing.T, data string) (*Compiled, error) {
+	t.Helper()
+	rules, err := Parse([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return Compile(rules, Options{MaxTracks: 100, Now: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)})
+}
+
+func TestCompile_RejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{"unknown key", `{"all": [], "limt": 5}`, `unknown field "limt"`},
+		{"unknown field", `{"field": "mood", "op": "is", "value": "happy"}`, `rules: unknown field "mood"`},
+		{"unknown operator", `{"all": [{"field": "year", "op": "like", "value": 1990}]}`, `rules.all[0]: year does not support "like"`},
+		{"out of range", `{"all": [{"any": [{"field": "rating", "op": "gte", "value": 9}]}]}`, "rules.all[0].any[0]: rating must be between 0 and 5"},
+		{"wrong type", `{"field": "starred", "op": "is", "value": "yes"}`, "starred must be true or false"},
+		{"bad date", `{"field": "added", "op": "before", "value": "last week"}`, "added before needs a date like 2006-01-02"},
+		{"between", `{"field": "year", "op": "between", "value": [1990]}`, "year between needs two whole numbers"},
+		{"missing value", `{"field": "genre", "op": "is"}`, "genre is needs a value"},
+		{"mixed condition", `{"field": "genre", "op": "is", "value": "Rock", "any": [{"field": "hated", "op": "is", "value": false}]}`, "exactly one of all, any, not or field"},
+		{"limit", `{"limit": 500}`, "limit must be between 1 and 100"},
+		{"sort", `{"sort": [{"field": "mood"}]}`, `sort[0]: unknown sort field "mood"`},
+		{"sql in field", `{"field": "year; DROP TABLE tracks", "op": "is", "value": 1}`, "unknown field"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileJSON(t, tt.rules)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrInvalidRules))
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestCompile_Limits(t *testing.T) {
+	nested := `{"field": "hated", "op": "is", "value": false}`
+	for i := 0; i <= maxDepth; i++ {
+		nested = `{"not": ` + nested + `}`
+	}
+	_, err := compileJSON(t, nested)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "nested more than")
+
+	compiled, err := compileJSON(t, `{}`)
+	require.NoError(t, err)
+	assert.Equal(t, 100, compiled.limit, "defaults to max tracks")
+	assert.Empty(t, compiled.where)
+}
+
+func TestCompile_BindsValues(t *testing.T) {
+	compiled, err := compileJSON(t, `{"all": [
+		{"field": "genre", "op": "is", "value": "Rock'; --"},
+		{"field": "last_played", "op": "in_last_days", "value": 30}
+	]}`)
+	require.NoError(t, err)
+
+	assert.NotContains(t, compiled.where, "Rock")
+	assert.Equal(t, []interface{}{"%rock'; --%", time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)}, compiled.args)
+}
@@ -0,0 +1,69 @@
+// Package smartplaylist evaluates rule-based playlists. Rules are JSON, are
+// checked by a typed compiler against a fixed set of fields and operators,
+// and become parameterized SQL; no part of a rule is ever pasted into a query.
+package smartplaylist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidRules is wrapped by every rule validation error
+var ErrInvalidRules = errors.New("invalid smart playlist rules")
+
+// Rules defines a smart playlist: a condition over track, album and user
+// fields, the order of the matching tracks and how many are kept.
+//
+//	{
+//	  "all": [
+//	    {"field": "genre", "op": "is", "value": "Rock"},
+//	    {"field": "year", "op": "between", "value": [1990, 1999]},
+//	    {"any": [
+//	      {"field": "rating", "op": "gte", "value": 4},
+//	      {"field": "starred", "op": "is", "value": true}
+//	    ]},
+//	    {"field": "hated", "op": "is", "value": false}
+//	  ],
+//	  "sort": [{"field": "random"}],
+//	  "seed": 42,
+//	  "limit": 100
+//	}
+type Rules struct {
+	Condition
+	Sort  []Sort `json:"sort,omitempty"`  // defaults to album, then track number
+	Limit int    `json:"limit,omitempty"` // defaults to smart_playlists.max_tracks
+	Seed  *int64 `json:"seed,omitempty"`  // makes random sorts repeatable between refreshes
+}
+
+// Condition is either a group (all, any or not) or a single rule comparing a
+// field with a value. User fields (rating, play_count, last_played, starred,
+// hated) are those of the playlist's owner.
+type Condition struct {
+	All   []Condition     `json:"all,omitempty"`
+	Any   []Condition     `json:"any,omitempty"`
+	Not   *Condition      `json:"not,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Sort orders the matching tracks by a field
+type Sort struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+// Parse decodes rules, rejecting unknown keys so that typos are not silently
+// ignored. The rules still need to be compiled to be checked.
+func Parse(data []byte) (*Rules, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var rules Rules
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRules, err)
+	}
+	return &rules, nil
+}
@@ -0,0 +1,189 @@
+package smartplaylist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"melodee/internal/config"
+	"melodee/internal/logging"
+	"melodee/internal/models"
+)
+
+// Service validates smart playlist rules and refreshes the playlists' tracks
+type Service struct {
+	db         *gorm.DB
+	staleAfter time.Duration
+	maxTracks  int
+	now        func() time.Time
+}
+
+// NewService creates a new smart playlist service
+func NewService(db *gorm.DB, cfg config.SmartPlaylistConfig) *Service {
+	maxTracks := cfg.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = 1000
+	}
+	return &Service{
+		db:         db,
+		staleAfter: cfg.StaleAfter,
+		maxTracks:  maxTracks,
+		now:        time.Now,
+	}
+}
+
+// Validate parses and compiles rules and returns them re-encoded for storage.
+// Errors wrap ErrInvalidRules.
+func (s *Service) Validate(data []byte) (json.RawMessage, error) {
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.compile(rules); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rules)
+}
+
+// ValidUntil returns when a smart playlist is next refreshed on access
+func (s *Service) ValidUntil(playlist *models.Playlist) *time.Time {
+	if playlist.RefreshedAt == nil {
+		return nil
+	}
+	validUntil := playlist.RefreshedAt.Add(s.staleAfter)
+	return &validUntil
+}
+
+// RefreshIfStale refreshes a smart playlist that has not been refreshed
+// within smart_playlists.stale_after. Regular playlists are left alone.
+func (s *Service) RefreshIfStale(ctx context.Context, playlist *models.Playlist) error {
+	if !playlist.IsSmart() {
+		return nil
+	}
+	if playlist.RefreshedAt != nil && s.now().Sub(*playlist.RefreshedAt) < s.staleAfter {
+		return nil
+	}
+	return s.Refresh(ctx, playlist)
+}
+
+// Refresh evaluates a smart playlist's rules for its owner and replaces its
+// tracks, track count and duration. ChangedAt only moves when the tracks do.
+func (s *Service) Refresh(ctx context.Context, playlist *models.Playlist) error {
+	if !playlist.IsSmart() {
+		return fmt.Errorf("playlist %d is not a smart playlist", playlist.ID)
+	}
+
+	rules, err := Parse(playlist.Rules)
+	if err != nil {
+		return err
+	}
+	compiled, err := s.compile(rules)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var trackIDs []int64
+		if err := compiled.Query(tx, playlist.UserID).Pluck("tracks.id", &trackIDs).Error; err != nil {
+			return fmt.Errorf("failed to evaluate smart playlist %d: %w", playlist.ID, err)
+		}
+
+		var previous []int64
+		if err := tx.Model(&models.PlaylistTrack{}).Where("playlist_id = ?", playlist.ID).
+			Order("position").Pluck("track_id", &previous).Error; err != nil {
+			return fmt.Errorf("failed to load playlist tracks: %w", err)
+		}
+
+		updates := map[string]interface{}{"refreshed_at": now}
+		if !sameTracks(previous, trackIDs) {
+			if err := tx.Where("playlist_id = ?", playlist.ID).Delete(&models.PlaylistTrack{}).Error; err != nil {
+				return fmt.Errorf("failed to clear playlist tracks: %w", err)
+			}
+
+			entries := make([]models.PlaylistTrack, 0, len(trackIDs))
+			for i, trackID := range trackIDs {
+				entries = append(entries, models.PlaylistTrack{
+					PlaylistID: playlist.ID,
+					TrackID:    trackID,
+					Position:   int32(i + 1), // Position starts from 1
+					CreatedAt:  now,
+				})
+			}
+			if len(entries) > 0 {
+				if err := tx.CreateInBatches(entries, 500).Error; err != nil {
+					return fmt.Errorf("failed to store playlist tracks: %w", err)
+				}
+			}
+
+			var duration int64
+			if len(trackIDs) > 0 {
+				if err := tx.Model(&models.Track{}).Where("id IN ?", trackIDs).
+					Select("COALESCE(SUM(duration), 0)").Scan(&duration).Error; err != nil {
+					return fmt.Errorf("failed to sum playlist duration: %w", err)
+				}
+			}
+
+			updates["track_count"] = len(trackIDs)
+			updates["duration"] = duration
+			updates["changed_at"] = now
+			playlist.TrackCount = int32(len(trackIDs))
+			playlist.Duration = duration
+			playlist.ChangedAt = now
+		}
+
+		if err := tx.Model(&models.Playlist{}).Where("id = ?", playlist.ID).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update playlist: %w", err)
+		}
+		playlist.RefreshedAt = &now
+		return nil
+	})
+}
+
+// RefreshAll refreshes every smart playlist. A playlist that fails to refresh
+// is logged and does not stop the others.
+func (s *Service) RefreshAll(ctx context.Context) error {
+	var playlists []models.Playlist
+	if err := s.db.WithContext(ctx).Where("rules IS NOT NULL").Order("id").Find(&playlists).Error; err != nil {
+		return fmt.Errorf("failed to load smart playlists: %w", err)
+	}
+
+	refreshed := 0
+	for i := range playlists {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !playlists[i].IsSmart() {
+			continue
+		}
+		if err := s.Refresh(ctx, &playlists[i]); err != nil {
+			logging.Warnf("smart playlist: failed to refresh playlist %d: %v", playlists[i].ID, err)
+			continue
+		}
+		refreshed++
+	}
+	logging.Infof("smart playlist: refreshed %d playlists", refreshed)
+	return nil
+}
+
+func (s *Service) compile(rules *Rules) (*Compiled, error) {
+	return Compile(rules, Options{
+		Postgres:  s.db.Dialector.Name() == "postgres",
+		MaxTracks: s.maxTracks,
+		Now:       s.now(),
+	})
+}
+
+func sameTracks(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
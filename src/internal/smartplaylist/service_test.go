@@ -0,0 +1,188 @@
+package smartplaylist
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"melodee/internal/config"
+	"melodee/internal/models"
+)
+
+func setupSmartPlaylistTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		name_normalized TEXT,
+		release_date DATETIME,
+		genres TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		name_normalized TEXT,
+		album_id INTEGER,
+		library_id INTEGER,
+		duration INTEGER,
+		bit_rate INTEGER,
+		created_at DATETIME,
+		sort_order INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE user_tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		track_id INTEGER,
+		played_count INTEGER DEFAULT 0,
+		last_played_at DATETIME,
+		is_starred BOOLEAN DEFAULT 0,
+		is_hated BOOLEAN DEFAULT 0,
+		rating INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE playlists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		comment TEXT,
+		public BOOLEAN DEFAULT 0,
+		created_at DATETIME,
+		changed_at DATETIME,
+		duration INTEGER,
+		track_count INTEGER,
+		cover_art_id INTEGER,
+		rules TEXT,
+		refreshed_at DATETIME
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE playlist_tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		playlist_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		created_at DATETIME
+	)`).Error)
+
+	db.Exec(`INSERT INTO albums (id, name, name_normalized, release_date, genres) VALUES
+		(1, 'Nevermind', 'nevermind', '1991-09-24 00:00:00', 'Rock,Grunge'),
+		(2, 'Kind of Blue', 'kind of blue', '1959-08-17 00:00:00', 'Jazz'),
+		(3, 'Dookie', 'dookie', '1994-02-01 00:00:00', 'Rock,Punk')`)
+	db.Exec(`INSERT INTO tracks (id, name, name_normalized, album_id, library_id, duration, bit_rate, sort_order) VALUES
+		(10, 'Smells Like Teen Spirit', 'smells like teen spirit', 1, 1, 301000, 320, 1),
+		(11, 'In Bloom', 'in bloom', 1, 1, 254000, 320, 2),
+		(20, 'So What', 'so what', 2, 1, 562000, 256, 1),
+		(30, 'Basket Case', 'basket case', 3, 2, 181000, 192, 1)`)
+	db.Exec(`INSERT INTO user_tracks (user_id, track_id, rating, is_starred, is_hated) VALUES
+		(1, 10, 5, 1, 0),
+		(1, 11, 2, 0, 1),
+		(1, 30, 4, 0, 0),
+		(2, 11, 5, 1, 0)`)
+	return db
+}
+
+func createSmartPlaylist(t *testing.T, db *gorm.DB, userID int64, rules string) *models.Playlist {
+	playlist := &models.Playlist{UserID: userID, Name: "Smart", Rules: json.RawMessage(rules)}
+	require.NoError(t, db.Omit("api_key").Create(playlist).Error)
+	return playlist
+}
+
+func playlistTrackIDs(t *testing.T, db *gorm.DB, playlistID int32) []int64 {
+	var ids []int64
+	require.NoError(t, db.Model(&models.PlaylistTrack{}).Where("playlist_id = ?", playlistID).
+		Order("position").Pluck("track_id", &ids).Error)
+	return ids
+}
+
+func TestService_Refresh(t *testing.T) {
+	db := setupSmartPlaylistTestDB(t)
+	service := NewService(db, config.SmartPlaylistConfig{StaleAfter: time.Minute, MaxTracks: 100})
+	ctx := context.Background()
+
+	playlist := createSmartPlaylist(t, db, 1, `{
+		"all": [
+			{"field": "genre", "op": "is", "value": "rock"},
+			{"field": "year", "op": "between", "value": [1990, 1999]},
+			{"any": [
+				{"field": "rating", "op": "gte", "value": 4},
+				{"field": "starred", "op": "is", "value": true}
+			]},
+			{"field": "hated", "op": "is", "value": false}
+		],
+		"sort": [{"field": "rating", "desc": true}]
+	}`)
+
+	require.NoError(t, service.Refresh(ctx, playlist))
+	assert.Equal(t, []int64{10, 30}, playlistTrackIDs(t, db, playlist.ID))
+
+	var stored models.Playlist
+	require.NoError(t, db.First(&stored, playlist.ID).Error)
+	assert.Equal(t, int32(2), stored.TrackCount)
+	assert.Equal(t, int64(301000+181000), stored.Duration)
+	require.NotNil(t, stored.RefreshedAt)
+
+	// Another user's ratings give another result
+	other := createSmartPlaylist(t, db, 2, `{"field": "starred", "op": "is", "value": true}`)
+	require.NoError(t, service.Refresh(ctx, other))
+	assert.Equal(t, []int64{11}, playlistTrackIDs(t, db, other.ID))
+}
+
+func TestService_RefreshIfStale(t *testing.T) {
+	db := setupSmartPlaylistTestDB(t)
+	service := NewService(db, config.SmartPlaylistConfig{StaleAfter: time.Hour, MaxTracks: 100})
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	playlist := createSmartPlaylist(t, db, 1, `{"field": "library", "op": "is", "value": 1, "limit": 2}`)
+	require.NoError(t, service.RefreshIfStale(ctx, playlist))
+	assert.Equal(t, []int64{20, 10}, playlistTrackIDs(t, db, playlist.ID), "sorted by album then track, limited")
+	assert.Equal(t, now, playlist.ChangedAt)
+	assert.Equal(t, now.Add(time.Hour), *service.ValidUntil(playlist))
+
+	// Fresh playlists are not re-evaluated
+	db.Exec(`DELETE FROM playlist_tracks`)
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, service.RefreshIfStale(ctx, playlist))
+	assert.Empty(t, playlistTrackIDs(t, db, playlist.ID))
+
+	// Stale ones are, and an unchanged result keeps changed_at
+	require.NoError(t, service.Refresh(ctx, playlist))
+	changedAt := playlist.ChangedAt
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, service.RefreshIfStale(ctx, playlist))
+	assert.Equal(t, []int64{20, 10}, playlistTrackIDs(t, db, playlist.ID))
+	assert.Equal(t, changedAt, playlist.ChangedAt)
+	assert.Equal(t, now, *playlist.RefreshedAt)
+}
+
+func TestService_SeededRandomIsRepeatable(t *testing.T) {
+	db := setupSmartPlaylistTestDB(t)
+	service := NewService(db, config.SmartPlaylistConfig{MaxTracks: 100})
+	ctx := context.Background()
+
+	first := createSmartPlaylist(t, db, 1, `{"sort": [{"field": "random"}], "seed": 7}`)
+	second := createSmartPlaylist(t, db, 1, `{"sort": [{"field": "random"}], "seed": 7}`)
+	require.NoError(t, service.Refresh(ctx, first))
+	require.NoError(t, service.Refresh(ctx, second))
+
+	ids := playlistTrackIDs(t, db, first.ID)
+	assert.Len(t, ids, 4)
+	assert.Equal(t, ids, playlistTrackIDs(t, db, second.ID))
+}
+
+func TestService_Validate(t *testing.T) {
+	service := NewService(setupSmartPlaylistTestDB(t), config.SmartPlaylistConfig{MaxTracks: 100})
+
+	rules, err := service.Validate([]byte(`{"field": "play_count", "op": "gt", "value": 3}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"field": "play_count", "op": "gt", "value": 3}`, string(rules))
+
+	_, err = service.Validate([]byte(`{"field": "play_count", "op": "gt", "value": -1}`))
+	assert.ErrorIs(t, err, ErrInvalidRules)
+}
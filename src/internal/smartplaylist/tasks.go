@@ -0,0 +1,82 @@
+package smartplaylist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"melodee/internal/models"
+)
+
+// Job types for Asynq
+const (
+	TypeSmartPlaylistRefresh = "playlist:smart_refresh"
+)
+
+// RefreshPayload represents the payload for smart playlist refresh jobs
+type RefreshPayload struct {
+	PlaylistID int32 `json:"playlist_id"` // 0 refreshes every smart playlist
+}
+
+// NewRefreshTask creates a refresh task for a playlist, or for every smart playlist when playlistID is 0
+func NewRefreshTask(playlistID int32) (*asynq.Task, error) {
+	payload, err := json.Marshal(RefreshPayload{PlaylistID: playlistID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal smart playlist refresh payload: %w", err)
+	}
+	return asynq.NewTask(TypeSmartPlaylistRefresh, payload), nil
+}
+
+// EnqueueRefresh creates and enqueues a smart playlist refresh job
+func EnqueueRefresh(client *asynq.Client, playlistID int32) error {
+	task, err := NewRefreshTask(playlistID)
+	if err != nil {
+		return err
+	}
+
+	// Use deduplication key so repeated refresh requests collapse into one
+	dedupKey := fmt.Sprintf("playlist.smart_refresh:%d", playlistID)
+
+	_, err = client.Enqueue(task, asynq.TaskID(dedupKey), asynq.Timeout(10*time.Minute))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue smart playlist refresh: %w", err)
+	}
+	return nil
+}
+
+// TaskHandler runs smart playlist jobs
+type TaskHandler struct {
+	service *Service
+}
+
+// NewTaskHandler creates a new smart playlist task handler
+func NewTaskHandler(service *Service) *TaskHandler {
+	return &TaskHandler{service: service}
+}
+
+// HandleRefresh refreshes one smart playlist or all of them
+func (h *TaskHandler) HandleRefresh(ctx context.Context, t *asynq.Task) error {
+	var p RefreshPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal smart playlist refresh payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	if p.PlaylistID == 0 {
+		return h.service.RefreshAll(ctx)
+	}
+
+	var playlist models.Playlist
+	if err := h.service.db.WithContext(ctx).First(&playlist, p.PlaylistID).Error; err != nil {
+		return fmt.Errorf("failed to load playlist %d: %v: %w", p.PlaylistID, err, asynq.SkipRetry)
+	}
+	if err := h.service.Refresh(ctx, &playlist); err != nil {
+		if errors.Is(err, ErrInvalidRules) {
+			return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		return err
+	}
+	return nil
+}
@@ -32,6 +32,8 @@ func GetTestDB(t *testing.T) (*gorm.DB, func()) {
 	// Create users table with basic types
 	err = db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		api_key TEXT,
 		username TEXT NOT NULL,
 		email TEXT,
@@ -48,6 +50,15 @@ func GetTestDB(t *testing.T) (*gorm.DB, func()) {
 
 	// Create other tables as needed for specific tests
 	// For auth tests, we mostly just need the users table
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS subsonic_passwords (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		encrypted_secret TEXT NOT NULL,
+		created_at DATETIME,
+		last_used_at DATETIME
+	)`).Error
+	assert.NoError(t, err)
 
 	// Create a cleanup function
 	tearDown := func() {
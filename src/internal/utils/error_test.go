@@ -2,7 +2,6 @@ package utils
 
 import (
 	"net/http/httptest"
-	"strings"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
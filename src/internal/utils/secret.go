@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// EncryptSecret encrypts a secret with AES-256-GCM using a key derived from
+// serverKey. Unlike a password hash the result can be decrypted again, which
+// Subsonic token authentication needs in order to recompute MD5(secret + salt).
+func EncryptSecret(serverKey, secret string) (string, error) {
+	gcm, err := newSecretCipher(serverKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := GenerateRandomBytes(gcm.NonceSize())
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret reverses EncryptSecret
+func DecryptSecret(serverKey, encrypted string) (string, error) {
+	gcm, err := newSecretCipher(serverKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted secret: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted secret: too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// newSecretCipher derives a 256-bit key from the server key
+func newSecretCipher(serverKey string) (cipher.AEAD, error) {
+	if serverKey == "" {
+		return nil, fmt.Errorf("server key cannot be empty")
+	}
+
+	key := sha256.Sum256([]byte(serverKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// VerifySubsonicToken reports whether token is the Subsonic salted token for
+// secret, i.e. the hex encoded MD5(secret + salt)
+func VerifySubsonicToken(secret, salt, token string) bool {
+	sum := md5.Sum([]byte(secret + salt))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(token))) == 1
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptSecret_RoundTrip(t *testing.T) {
+	encrypted, err := EncryptSecret("server-key", "app-password")
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "app-password")
+
+	// A fresh nonce is used each time
+	again, err := EncryptSecret("server-key", "app-password")
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, again)
+
+	plain, err := DecryptSecret("server-key", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "app-password", plain)
+
+	_, err = DecryptSecret("other-key", encrypted)
+	assert.Error(t, err)
+
+	_, err = EncryptSecret("", "app-password")
+	assert.Error(t, err)
+}
+
+func TestVerifySubsonicToken(t *testing.T) {
+	// Example from the Subsonic API documentation
+	assert.True(t, VerifySubsonicToken("sesame", "c19b2d", "26719a1196d2a940705a59634eb18eab"))
+	assert.True(t, VerifySubsonicToken("sesame", "c19b2d", "26719A1196D2A940705A59634EB18EAB"))
+	assert.False(t, VerifySubsonicToken("sesame", "c19b2e", "26719a1196d2a940705a59634eb18eab"))
+	assert.False(t, VerifySubsonicToken("open", "c19b2d", "26719a1196d2a940705a59634eb18eab"))
+}
@@ -0,0 +1,83 @@
+package watcher
+
+import (
+	"sort"
+	"time"
+)
+
+// Status is the watcher's state as reported by /healthz
+type Status struct {
+	Status             string          `json:"status"`
+	StartedAt          *time.Time      `json:"started_at,omitempty"`
+	Libraries          []LibraryStatus `json:"libraries"`
+	Watches            int             `json:"watches"`
+	PendingDirectories int             `json:"pending_directories"`
+	EventsTotal        int64           `json:"events_total"`
+	ScansQueued        int64           `json:"scans_queued"`
+	Errors             int64           `json:"errors"`
+	LastEventAt        *time.Time      `json:"last_event_at,omitempty"`
+	LastScanQueuedAt   *time.Time      `json:"last_scan_queued_at,omitempty"`
+	LastError          string          `json:"last_error,omitempty"`
+}
+
+// LibraryStatus describes a watched library
+type LibraryStatus struct {
+	ID   int32  `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+// Status returns the watcher's current state. A watcher that was never
+// started reports "disabled"; one that cannot watch a library or queue a scan
+// reports "degraded" until that succeeds again.
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := Status{
+		Libraries:          make([]LibraryStatus, 0, len(w.libraries)),
+		PendingDirectories: len(w.pending),
+		EventsTotal:        w.eventsTotal,
+		ScansQueued:        w.scansQueued,
+		Errors:             w.errorsTotal,
+		LastError:          w.lastError,
+		StartedAt:          timePtr(w.startedAt),
+		LastEventAt:        timePtr(w.lastEventAt),
+		LastScanQueuedAt:   timePtr(w.lastQueuedAt),
+	}
+
+	switch {
+	case w.startedAt.IsZero():
+		status.Status = StatusDisabled
+	case w.fs == nil:
+		status.Status = StatusStopped
+	case w.refreshFailing || w.enqueueFailing:
+		status.Status = StatusDegraded
+	default:
+		status.Status = StatusOK
+	}
+
+	if w.fs != nil {
+		status.Watches = len(w.fs.WatchList())
+	}
+	for _, library := range w.libraries {
+		status.Libraries = append(status.Libraries, LibraryStatus{
+			ID:   library.ID,
+			Name: library.Name,
+			Path: library.Path,
+			Type: library.Type,
+		})
+	}
+	sort.Slice(status.Libraries, func(i, j int) bool {
+		return status.Libraries[i].ID < status.Libraries[j].ID
+	})
+	return status
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
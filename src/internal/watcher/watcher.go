@@ -0,0 +1,479 @@
+// Package watcher watches the directories of libraries flagged is_watched and
+// queues a scan for every album directory whose files have stopped changing.
+//
+// fsnotify is not recursive, so every directory below a library root gets its
+// own watch; directories created later are added as their events arrive.
+// Events are coalesced per directory: a directory is only considered once no
+// event arrived for the debounce time and the names, sizes and modification
+// times of its files stayed the same for the stable time. That keeps a slow
+// copy into a drop folder from being scanned half way through.
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/logging"
+	"melodee/internal/media"
+	"melodee/internal/models"
+)
+
+// Watcher states reported by Status
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusDisabled = "disabled"
+	StatusStopped  = "stopped"
+)
+
+// Enqueuer queues background jobs; *asynq.Client satisfies it
+type Enqueuer interface {
+	Enqueue(task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+}
+
+// Watcher turns filesystem events in watched libraries into scan jobs
+type Watcher struct {
+	cfg    config.FileWatchConfig
+	db     *gorm.DB
+	client Enqueuer
+	tick   time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	fs        *fsnotify.Watcher
+	libraries map[int32]models.Library
+	pending   map[string]*pendingDir
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	startedAt      time.Time
+	eventsTotal    int64
+	scansQueued    int64
+	errorsTotal    int64
+	lastEventAt    time.Time
+	lastQueuedAt   time.Time
+	lastError      string
+	refreshFailing bool
+	enqueueFailing bool
+}
+
+// pendingDir is a directory with changes that have not been queued yet
+type pendingDir struct {
+	libraryID   int32
+	lastEvent   time.Time
+	snapshot    dirSnapshot
+	stableSince time.Time // zero until the first snapshot is taken
+}
+
+// dirSnapshot summarizes the files directly inside a directory
+type dirSnapshot struct {
+	exists  bool
+	files   int
+	size    int64
+	modTime int64
+}
+
+// NewWatcher creates a new file watcher. Nothing is watched until Start.
+func NewWatcher(cfg config.FileWatchConfig, db *gorm.DB, client Enqueuer) *Watcher {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Minute
+	}
+	return &Watcher{
+		cfg:       cfg,
+		db:        db,
+		client:    client,
+		tick:      time.Second,
+		now:       time.Now,
+		libraries: make(map[int32]models.Library),
+		pending:   make(map[string]*pendingDir),
+	}
+}
+
+// Start watches the libraries flagged is_watched and begins processing events
+func (w *Watcher) Start(ctx context.Context) error {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem watcher: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w.mu.Lock()
+	w.fs = fs
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	w.startedAt = w.now()
+	w.mu.Unlock()
+
+	w.refresh()
+
+	go w.run(ctx, fs)
+	return nil
+}
+
+// Stop stops watching and waits for the event loop to exit
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	fs, cancel, done := w.fs, w.cancel, w.done
+	w.mu.Unlock()
+	if fs == nil {
+		return
+	}
+
+	cancel()
+	<-done
+	fs.Close()
+
+	w.mu.Lock()
+	w.fs = nil
+	w.libraries = make(map[int32]models.Library)
+	w.pending = make(map[string]*pendingDir)
+	w.mu.Unlock()
+}
+
+func (w *Watcher) run(ctx context.Context, fs *fsnotify.Watcher) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	refresh := time.NewTicker(w.cfg.RefreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-fs.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+		case err, ok := <-fs.Errors:
+			if !ok {
+				return
+			}
+			w.handleError(err)
+		case <-ticker.C:
+			w.flush()
+		case <-refresh.C:
+			w.refresh()
+		}
+	}
+}
+
+// refresh reconciles the watches with the libraries currently flagged
+// is_watched. Newly watched libraries are scanned once to pick up files that
+// arrived while nobody was watching. Failures are recorded in the status.
+func (w *Watcher) refresh() {
+	var libraries []models.Library
+	err := w.db.Where("is_watched = ?", true).Find(&libraries).Error
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.refreshFailing = true
+		w.recordErrorLocked(fmt.Errorf("failed to load watched libraries: %w", err))
+		return
+	}
+	if w.fs == nil {
+		return
+	}
+
+	wanted := make(map[int32]models.Library, len(libraries))
+	for _, library := range libraries {
+		if library.Type == "podcast" {
+			continue
+		}
+		library.Path = filepath.Clean(library.Path)
+		wanted[library.ID] = library
+	}
+
+	for id, library := range w.libraries {
+		if current, ok := wanted[id]; !ok || current.Path != library.Path {
+			w.unwatchLocked(library)
+			delete(w.libraries, id)
+			logging.Infof("watcher: stopped watching library %d (%s)", library.ID, library.Path)
+		}
+	}
+
+	var errs []error
+	for id, library := range wanted {
+		if _, ok := w.libraries[id]; ok {
+			continue
+		}
+		if err := w.addTreeLocked(library.Path); err != nil {
+			errs = append(errs, fmt.Errorf("library %d: %w", library.ID, err))
+			w.unwatchLocked(library)
+			continue
+		}
+		w.libraries[id] = library
+		w.markPendingLocked(library.ID, library.Path)
+		logging.Infof("watcher: watching library %d (%s) at %s", library.ID, library.Type, library.Path)
+	}
+
+	w.refreshFailing = len(errs) > 0
+	if err := errors.Join(errs...); err != nil {
+		w.recordErrorLocked(err)
+	}
+}
+
+// addTreeLocked adds a watch for a directory and every directory below it
+func (w *Watcher) addTreeLocked(root string) error {
+	return filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if path != root && errors.Is(err, os.ErrNotExist) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && w.ignored(entry.Name()) {
+			return filepath.SkipDir
+		}
+		if err := w.fs.Add(path); err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				return fmt.Errorf("failed to watch %s: inotify watch limit reached, raise fs.inotify.max_user_watches: %w", path, err)
+			}
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// unwatchLocked removes the watches of a library and forgets its pending directories
+func (w *Watcher) unwatchLocked(library models.Library) {
+	for _, path := range w.fs.WatchList() {
+		if within(library.Path, path) {
+			_ = w.fs.Remove(path)
+		}
+	}
+	for dir, p := range w.pending {
+		if p.libraryID == library.ID {
+			delete(w.pending, dir)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	// Permission and timestamp changes never change what a scan finds
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fs == nil {
+		return
+	}
+
+	library, ok := w.libraryForLocked(event.Name)
+	if !ok || w.ignored(filepath.Base(event.Name)) {
+		return
+	}
+	w.eventsTotal++
+	w.lastEventAt = w.now()
+
+	dir := filepath.Dir(event.Name)
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// A directory moved or copied in; its contents produce no events of their own
+			if err := w.addTreeLocked(event.Name); err != nil {
+				w.recordErrorLocked(err)
+			}
+			dir = event.Name
+		}
+	}
+	if !within(library.Path, dir) {
+		dir = library.Path
+	}
+	w.markPendingLocked(library.ID, dir)
+}
+
+func (w *Watcher) handleError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.recordErrorLocked(err)
+	if errors.Is(err, fsnotify.ErrEventOverflow) {
+		// Events were lost, so rescan every watched library
+		for _, library := range w.libraries {
+			w.markPendingLocked(library.ID, library.Path)
+		}
+	}
+}
+
+func (w *Watcher) markPendingLocked(libraryID int32, dir string) {
+	p, ok := w.pending[dir]
+	if !ok {
+		p = &pendingDir{libraryID: libraryID}
+		w.pending[dir] = p
+	}
+	p.lastEvent = w.now()
+	p.stableSince = time.Time{}
+}
+
+// flush queues scans for the pending directories that have settled. Settled
+// directories of one library are queued together as a single job.
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	ready := make(map[int32][]string)
+	for dir, p := range w.pending {
+		if now.Sub(p.lastEvent) < w.cfg.Debounce {
+			continue
+		}
+		snapshot := snapshotDir(dir)
+		if p.stableSince.IsZero() || snapshot != p.snapshot {
+			p.snapshot = snapshot
+			p.stableSince = now
+			continue
+		}
+		if now.Sub(p.stableSince) < w.cfg.StableTime {
+			continue
+		}
+		ready[p.libraryID] = append(ready[p.libraryID], dir)
+		delete(w.pending, dir)
+	}
+
+	for libraryID, dirs := range ready {
+		library, ok := w.libraries[libraryID]
+		if !ok {
+			continue
+		}
+		sort.Strings(dirs)
+		if err := w.enqueue(library, dirs); err != nil {
+			if errors.Is(err, asynq.ErrTaskIDConflict) {
+				// A scan for this library is already queued or running. Keep
+				// the directories so a follow-up scan picks up these changes.
+				for _, dir := range dirs {
+					w.markPendingLocked(libraryID, dir)
+				}
+				continue
+			}
+			w.enqueueFailing = true
+			w.recordErrorLocked(err)
+			for _, dir := range dirs {
+				w.markPendingLocked(libraryID, dir)
+			}
+			continue
+		}
+		w.enqueueFailing = false
+		w.scansQueued++
+		w.lastQueuedAt = now
+		logging.Infof("watcher: queued scan of library %d for %d directories", library.ID, len(dirs))
+	}
+}
+
+// enqueue queues the job that picks up changes in a library: the staging scan
+// for drop folders, a library scan otherwise
+func (w *Watcher) enqueue(library models.Library, dirs []string) error {
+	var task *asynq.Task
+	var opts []asynq.Option
+
+	switch library.Type {
+	case "inbound", "staging":
+		payload, err := json.Marshal(media.StagingScanPayload{
+			Source:    "file_watcher",
+			LibraryID: library.ID,
+			Paths:     dirs,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal staging scan payload: %w", err)
+		}
+		task = asynq.NewTask(media.TypeStagingScan, payload)
+		opts = []asynq.Option{asynq.Queue("maintenance"), asynq.TaskID("staging-scan-watcher")}
+	default:
+		// Library scans recount the whole library
+		payload, err := json.Marshal(media.LibraryScanPayload{
+			LibraryIDs: []int32{library.ID},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal library scan payload: %w", err)
+		}
+		task = asynq.NewTask(media.TypeLibraryScan, payload)
+		// Same deduplication key as scans queued from the admin API
+		opts = []asynq.Option{asynq.TaskID(fmt.Sprintf("library.scan:%v", []int32{library.ID})), asynq.Timeout(5 * time.Minute)}
+	}
+
+	if _, err := w.client.Enqueue(task, opts...); err != nil {
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			return err
+		}
+		return fmt.Errorf("failed to enqueue scan of library %d: %w", library.ID, err)
+	}
+	return nil
+}
+
+func (w *Watcher) libraryForLocked(path string) (models.Library, bool) {
+	var match models.Library
+	found := false
+	for _, library := range w.libraries {
+		if within(library.Path, path) && (!found || len(library.Path) > len(match.Path)) {
+			match = library
+			found = true
+		}
+	}
+	return match, found
+}
+
+// ignored reports whether a file or directory name matches an ignore pattern
+func (w *Watcher) ignored(name string) bool {
+	for _, pattern := range w.cfg.IgnorePatterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) recordErrorLocked(err error) {
+	w.errorsTotal++
+	w.lastError = err.Error()
+	logging.Warnf("watcher: %v", err)
+}
+
+// snapshotDir summarizes a directory's files. A missing directory has a zero
+// snapshot, so deleted album directories settle like any other.
+func snapshotDir(dir string) dirSnapshot {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return dirSnapshot{}
+	}
+
+	snapshot := dirSnapshot{exists: true}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshot.files++
+		snapshot.size += info.Size()
+		snapshot.modTime = max(snapshot.modTime, info.ModTime().UnixNano())
+	}
+	return snapshot
+}
+
+// within reports whether path is root or below it
+func within(root, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
@@ -0,0 +1,217 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/config"
+	"melodee/internal/media"
+	"melodee/internal/models"
+)
+
+type fakeEnqueuer struct {
+	mu    sync.Mutex
+	tasks []*asynq.Task
+	err   error
+}
+
+func (f *fakeEnqueuer) Enqueue(task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.tasks = append(f.tasks, task)
+	return &asynq.TaskInfo{}, nil
+}
+
+func (f *fakeEnqueuer) queued() []*asynq.Task {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*asynq.Task(nil), f.tasks...)
+}
+
+func setupWatcherTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT,
+		is_locked BOOLEAN DEFAULT 0,
+		is_watched BOOLEAN DEFAULT 0,
+		created_at DATETIME,
+		track_count INTEGER DEFAULT 0,
+		album_count INTEGER DEFAULT 0,
+		duration INTEGER DEFAULT 0
+	)`).Error)
+	return db
+}
+
+func testConfig() config.FileWatchConfig {
+	return config.FileWatchConfig{
+		Enabled:         true,
+		Debounce:        50 * time.Millisecond,
+		StableTime:      100 * time.Millisecond,
+		RefreshInterval: time.Minute,
+		IgnorePatterns:  []string{".*", "*.part"},
+	}
+}
+
+func stagingPaths(t *testing.T, task *asynq.Task) []string {
+	t.Helper()
+	require.Equal(t, media.TypeStagingScan, task.Type())
+	var p media.StagingScanPayload
+	require.NoError(t, json.Unmarshal(task.Payload(), &p))
+	assert.Equal(t, "file_watcher", p.Source)
+	return p.Paths
+}
+
+func TestWatcher_QueuesScanForNewAlbum(t *testing.T) {
+	root := t.TempDir()
+	db := setupWatcherTestDB(t)
+	db.Exec(`INSERT INTO libraries (id, name, path, type, is_watched) VALUES (1, 'Inbound', ?, 'inbound', 1)`, root)
+	db.Exec(`INSERT INTO libraries (id, name, path, type, is_watched) VALUES (2, 'Other', ?, 'production', 0)`, t.TempDir())
+
+	client := &fakeEnqueuer{}
+	w := NewWatcher(testConfig(), db, client)
+	w.tick = 20 * time.Millisecond
+	assert.Equal(t, StatusDisabled, w.Status().Status)
+
+	require.NoError(t, w.Start(context.Background()))
+	defer w.Stop()
+
+	status := w.Status()
+	assert.Equal(t, StatusOK, status.Status)
+	require.Len(t, status.Libraries, 1)
+	assert.Equal(t, root, status.Libraries[0].Path)
+
+	// The library is scanned once on start for files that arrived while unwatched
+	require.Eventually(t, func() bool { return len(client.queued()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{root}, stagingPaths(t, client.queued()[0]))
+
+	album := filepath.Join(root, "Artist", "Album")
+	require.NoError(t, os.MkdirAll(album, 0o755))
+	time.Sleep(50 * time.Millisecond) // let the new directories get their watches
+	require.NoError(t, os.WriteFile(filepath.Join(album, "01.flac"), []byte("audio"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(album, "02.flac"), []byte("audio"), 0o644))
+
+	require.Eventually(t, func() bool {
+		for _, task := range client.queued()[1:] {
+			for _, path := range stagingPaths(t, task) {
+				if path == album {
+					return true
+				}
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Positive(t, w.Status().EventsTotal)
+}
+
+func TestWatcher_WaitsForStableFiles(t *testing.T) {
+	root := t.TempDir()
+	album := filepath.Join(root, "Album")
+	require.NoError(t, os.MkdirAll(album, 0o755))
+	track := filepath.Join(album, "01.flac")
+	require.NoError(t, os.WriteFile(track, []byte("a"), 0o644))
+
+	fs, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer fs.Close()
+
+	client := &fakeEnqueuer{}
+	w := NewWatcher(testConfig(), setupWatcherTestDB(t), client)
+	w.fs = fs
+	w.libraries[1] = models.Library{ID: 1, Path: root, Type: "inbound"}
+	clock := time.Now()
+	w.now = func() time.Time { return clock }
+
+	// Temporary and hidden files never trigger a scan
+	w.handleEvent(fsnotify.Event{Name: filepath.Join(album, "01.flac.part"), Op: fsnotify.Create})
+	w.handleEvent(fsnotify.Event{Name: filepath.Join(album, ".DS_Store"), Op: fsnotify.Write})
+	assert.Empty(t, w.pending)
+
+	w.handleEvent(fsnotify.Event{Name: track, Op: fsnotify.Write})
+	clock = clock.Add(60 * time.Millisecond)
+	w.flush() // first snapshot
+	assert.Empty(t, client.queued())
+
+	// The file keeps growing without events, as on a network share
+	f, err := os.OpenFile(track, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("more")
+	require.NoError(t, err)
+	f.Close()
+	clock = clock.Add(150 * time.Millisecond)
+	w.flush()
+	assert.Empty(t, client.queued(), "a changed directory is not scanned")
+
+	clock = clock.Add(150 * time.Millisecond)
+	w.flush()
+	require.Len(t, client.queued(), 1)
+	assert.Equal(t, []string{album}, stagingPaths(t, client.queued()[0]))
+	assert.Empty(t, w.pending)
+}
+
+func TestWatcher_KeepsChangesWhileScanIsQueued(t *testing.T) {
+	root := t.TempDir()
+	fs, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	defer fs.Close()
+
+	client := &fakeEnqueuer{err: asynq.ErrTaskIDConflict}
+	w := NewWatcher(testConfig(), setupWatcherTestDB(t), client)
+	w.fs = fs
+	w.libraries[1] = models.Library{ID: 1, Path: root, Type: "production"}
+	clock := time.Now()
+	w.now = func() time.Time { return clock }
+
+	w.handleEvent(fsnotify.Event{Name: filepath.Join(root, "01.flac"), Op: fsnotify.Create})
+	for i := 0; i < 3; i++ {
+		clock = clock.Add(200 * time.Millisecond)
+		w.flush()
+	}
+	assert.Contains(t, w.pending, root, "the directory waits for the running scan")
+	assert.False(t, w.enqueueFailing, "a queued scan is not a failure")
+
+	client.err = nil
+	for i := 0; i < 3; i++ {
+		clock = clock.Add(200 * time.Millisecond)
+		w.flush()
+	}
+	require.Len(t, client.queued(), 1)
+	task := client.queued()[0]
+	assert.Equal(t, media.TypeLibraryScan, task.Type())
+	var p media.LibraryScanPayload
+	require.NoError(t, json.Unmarshal(task.Payload(), &p))
+	assert.Equal(t, []int32{1}, p.LibraryIDs)
+}
+
+func TestWatcher_MissingLibraryPathIsDegraded(t *testing.T) {
+	db := setupWatcherTestDB(t)
+	db.Exec(`INSERT INTO libraries (id, name, path, type, is_watched) VALUES (1, 'Gone', ?, 'inbound', 1)`,
+		filepath.Join(t.TempDir(), "missing"))
+
+	w := NewWatcher(testConfig(), db, &fakeEnqueuer{})
+	require.NoError(t, w.Start(context.Background()))
+	defer w.Stop()
+
+	status := w.Status()
+	assert.Equal(t, StatusDegraded, status.Status)
+	assert.Empty(t, status.Libraries)
+	assert.NotEmpty(t, status.LastError)
+}
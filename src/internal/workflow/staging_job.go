@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"melodee/internal/config"
+	"melodee/internal/fingerprint"
 	"melodee/internal/logging"
+	"melodee/internal/media"
+	"melodee/internal/metadatarules"
 	"melodee/internal/models"
 	"melodee/internal/processor"
 	"melodee/internal/scanner"
@@ -21,6 +27,17 @@ type StagingJobConfig struct {
 	RateLimit      int
 	DryRun         bool
 	ScanDBDataPath string
+	Incremental    bool // consult the persistent file index and skip unchanged files
+	FFmpegPath     string
+	Fingerprint    config.FingerprintConfig // flag likely duplicates when enabled
+	Artwork        config.ArtworkConfig     // how album covers are picked
+	CueEncoding    string                   // encoding of cue sheets that are neither UTF-8 nor UTF-16
+
+	// LibraryID and Paths limit a run to changes the file watcher saw: a run
+	// for a library other than the inbound library stages nothing, and Paths
+	// limits the scan to the inbound directories holding them
+	LibraryID int32
+	Paths     []string
 }
 
 // StagingJobResult contains the results of a staging job run
@@ -31,6 +48,11 @@ type StagingJobResult struct {
 	AlbumsTotal   int
 	AlbumsSuccess int
 	AlbumsFailed  int
+	NewFiles      int
+	ChangedFiles  int
+	RemovedFiles  int
+	RenamedFiles  int
+	IncompleteCue int // cue sheets quarantined because audio they reference is missing
 	Duration      time.Duration
 	ProcessedAt   time.Time
 	DryRun        bool
@@ -143,6 +165,13 @@ func (s *StagingJobService) RunStagingJobCycle(ctx context.Context, cfg StagingJ
 
 	s.logger.Infof("Resolved libraries - Inbound: %s, Staging: %s", inboundPath, stagingPath)
 
+	// Only changes in the inbound library have anything to stage
+	if cfg.LibraryID != 0 && cfg.LibraryID != inboundLibrary.ID {
+		s.logger.Infof("Library %d is not the inbound library, nothing to stage", cfg.LibraryID)
+		result.Duration = time.Since(startTime)
+		return result, nil
+	}
+
 	// Check if paths exist
 	if _, err := os.Stat(inboundPath); os.IsNotExist(err) {
 		err := fmt.Errorf("inbound path does not exist: %s", inboundPath)
@@ -169,15 +198,43 @@ func (s *StagingJobService) RunStagingJobCycle(ctx context.Context, cfg StagingJ
 	result.ScanDBPath = scanDB.GetPath()
 	s.logger.Infof("Created scan database: %s", scanDB.GetPath())
 
-	// Create file scanner
-	fileScanner := scanner.NewFileScanner(scanDB, cfg.Workers)
+	// Create file scanner, reusing the file index from previous runs when incremental
+	var fileScanner *scanner.FileScanner
+	if cfg.Incremental {
+		fileIndex, err := scanner.OpenFileIndex(scanOutputDir)
+		if err != nil {
+			err := fmt.Errorf("failed to open file index: %w", err)
+			s.logger.Errorf("Staging job failed: %v", err)
+			return &StagingJobResult{Error: err}, err
+		}
+		defer fileIndex.Close()
 
-	// Scan the directory
-	s.logger.Infof("Scanning inbound directory %s with %d workers...", inboundPath, cfg.Workers)
-	if err := fileScanner.ScanDirectory(inboundPath); err != nil {
-		err := fmt.Errorf("failed to scan directory: %w", err)
-		s.logger.Errorf("Staging job failed: %v", err)
-		return &StagingJobResult{Error: err}, err
+		s.logger.Infof("Using file index: %s", fileIndex.GetPath())
+		fileScanner = scanner.NewIncrementalFileScanner(scanDB, fileIndex, cfg.Workers)
+	} else {
+		fileScanner = scanner.NewFileScanner(scanDB, cfg.Workers)
+	}
+	if cfg.CueEncoding != "" {
+		if err := fileScanner.SetCueEncoding(cfg.CueEncoding); err != nil {
+			s.logger.Errorf("Staging job failed: %v", err)
+			return &StagingJobResult{Error: err}, err
+		}
+	}
+
+	// Scan the inbound directory, or only the parts of it that changed
+	for _, root := range scanRoots(inboundPath, cfg.Paths) {
+		if root != inboundPath {
+			if _, err := os.Stat(root); os.IsNotExist(err) {
+				// Removed since; the next full scan drops it from the index
+				continue
+			}
+		}
+		s.logger.Infof("Scanning inbound directory %s with %d workers...", root, cfg.Workers)
+		if err := fileScanner.ScanDirectory(root); err != nil {
+			err := fmt.Errorf("failed to scan directory: %w", err)
+			s.logger.Errorf("Staging job failed: %v", err)
+			return &StagingJobResult{Error: err}, err
+		}
 	}
 
 	// Compute album grouping
@@ -207,6 +264,36 @@ func (s *StagingJobService) RunStagingJobCycle(ctx context.Context, cfg StagingJ
 
 	s.logger.Infof("Scan completed - Total files: %d, Valid files: %d, Albums found: %d",
 		stats.TotalFiles, stats.ValidFiles, stats.AlbumsFound)
+	if cfg.Incremental {
+		s.logger.Infof("Scan deltas - New: %d, Changed: %d, Unchanged: %d, Renamed: %d, Removed: %d",
+			stats.NewFiles, stats.ChangedFiles, stats.UnchangedFiles, stats.RenamedFiles, stats.RemovedFiles)
+	}
+	result.NewFiles = stats.NewFiles
+	result.ChangedFiles = stats.ChangedFiles
+	result.RemovedFiles = stats.RemovedFiles
+	result.RenamedFiles = stats.RenamedFiles
+
+	// Cue sheets whose audio is missing are left out of the scan and quarantined with their audio
+	incomplete, err := scanDB.GetIncompleteCueSheets()
+	if err != nil {
+		err := fmt.Errorf("failed to get incomplete cue sheets: %w", err)
+		s.logger.Errorf("Staging job failed: %v", err)
+		return &StagingJobResult{Error: err}, err
+	}
+	result.IncompleteCue = len(incomplete)
+	for _, sheet := range incomplete {
+		s.logger.Warnf("Cue sheet %s references missing audio: %s", sheet.CuePath, strings.Join(sheet.MissingFiles, ", "))
+		if cfg.DryRun || s.db == nil {
+			continue
+		}
+		quarantine := media.NewDefaultQuarantineService(s.db)
+		message := "missing audio: " + strings.Join(sheet.MissingFiles, ", ")
+		for _, path := range append([]string{sheet.CuePath}, sheet.AudioFiles...) {
+			if err := quarantine.QuarantineFile(path, media.CueMissingAudio, message, inboundLibrary.ID); err != nil {
+				s.logger.Warnf("Could not quarantine %s: %v", path, err)
+			}
+		}
+	}
 
 	// 2) Process albums to staging (like process-scan)
 	procConfig := &processor.ProcessorConfig{
@@ -214,6 +301,26 @@ func (s *StagingJobService) RunStagingJobCycle(ctx context.Context, cfg StagingJ
 		Workers:     cfg.Workers,
 		RateLimit:   cfg.RateLimit,
 		DryRun:      cfg.DryRun,
+
+		ArtworkMinSize: cfg.Artwork.MinSize,
+	}
+	if cfg.FFmpegPath != "" {
+		procConfig.Artwork = media.NewFFmpegProcessor(&media.FFmpegConfig{
+			FFmpegPath: cfg.FFmpegPath,
+			Timeout:    media.DefaultFFmpegConfig().Timeout,
+		})
+	}
+	if cfg.Fingerprint.Enabled && s.db != nil {
+		procConfig.Fingerprints = fingerprint.NewService(s.db, cfg.FFmpegPath, cfg.Fingerprint)
+	}
+	if s.db != nil {
+		rules, err := metadatarules.Load(ctx, s.db)
+		if err != nil {
+			s.logger.Errorf("Staging job failed: %v", err)
+			return &StagingJobResult{Error: err}, err
+		}
+		procConfig.Rules = rules
+		procConfig.LibraryID = inboundLibrary.ID
 	}
 
 	proc := processor.NewProcessor(procConfig, scanDB)
@@ -303,14 +410,48 @@ func (s *StagingJobService) resolveLibraryByType(libraryType string) (*models.Li
 	return &library, nil
 }
 
-// RunStagingJobCycleWithConfig resolves configuration from app config and runs the staging job
-func (s *StagingJobService) RunStagingJobCycleWithConfig(ctx context.Context, appConfig *config.AppConfig) (*StagingJobResult, error) {
-	jobConfig := &StagingJobConfig{
+// scanRoots returns the directories to scan for changes in paths: the top
+// level directories of the inbound directory holding them, so albums split
+// over disc directories are scanned whole. Without paths, or with a change
+// outside of them, the whole inbound directory is scanned.
+func scanRoots(inboundPath string, paths []string) []string {
+	if len(paths) == 0 {
+		return []string{inboundPath}
+	}
+
+	seen := make(map[string]bool)
+	var roots []string
+	for _, path := range paths {
+		rel, err := filepath.Rel(inboundPath, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return []string{inboundPath}
+		}
+		root := filepath.Join(inboundPath, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// NewStagingJobConfig returns the staging job configuration of an app config
+func NewStagingJobConfig(appConfig *config.AppConfig) StagingJobConfig {
+	return StagingJobConfig{
 		Workers:        appConfig.StagingScan.Workers,
 		RateLimit:      appConfig.StagingScan.RateLimit,
 		DryRun:         appConfig.StagingScan.DryRun,
 		ScanDBDataPath: appConfig.StagingScan.ScanDBDataPath,
+		Incremental:    appConfig.StagingScan.Incremental,
+		FFmpegPath:     appConfig.Processing.FFmpegPath,
+		Fingerprint:    appConfig.Fingerprint,
+		Artwork:        appConfig.Artwork,
+		CueEncoding:    appConfig.StagingScan.CueEncoding,
 	}
+}
 
-	return s.RunStagingJobCycle(ctx, *jobConfig)
+// RunStagingJobCycleWithConfig resolves configuration from app config and runs the staging job
+func (s *StagingJobService) RunStagingJobCycleWithConfig(ctx context.Context, appConfig *config.AppConfig) (*StagingJobResult, error) {
+	return s.RunStagingJobCycle(ctx, NewStagingJobConfig(appConfig))
 }
@@ -90,6 +90,20 @@ func TestStagingJobConfigStructure(t *testing.T) {
 }
 
 // TestStagingJobResultStructure tests the staging job result structure
+func TestScanRoots(t *testing.T) {
+	inbound := "/music/inbound"
+
+	assert.Equal(t, []string{inbound}, scanRoots(inbound, nil))
+	assert.Equal(t, []string{"/music/inbound/Artist - Album"},
+		scanRoots(inbound, []string{"/music/inbound/Artist - Album/CD2", "/music/inbound/Artist - Album"}))
+	assert.Equal(t, []string{"/music/inbound/A", "/music/inbound/B"},
+		scanRoots(inbound, []string{"/music/inbound/B/CD1", "/music/inbound/A"}))
+
+	// Changes at the root or outside of it scan everything
+	assert.Equal(t, []string{inbound}, scanRoots(inbound, []string{"/music/inbound/A", inbound}))
+	assert.Equal(t, []string{inbound}, scanRoots(inbound, []string{"/music/staging/A"}))
+}
+
 func TestStagingJobResultStructure(t *testing.T) {
 	result := &StagingJobResult{
 		InboundPath:   "/path/to/inbound",
@@ -17,14 +17,21 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/hibiken/asynq"
 
+	"melodee/internal/artwork"
 	"melodee/internal/capacity"
 	"melodee/internal/config"
 	"melodee/internal/database"
 	"melodee/internal/directory"
 	"melodee/internal/handlers"
+	"melodee/internal/jukebox"
 	"melodee/internal/media"
 	"melodee/internal/middleware"
+	"melodee/internal/podcast"
+	"melodee/internal/promotion"
+	"melodee/internal/scrobble"
 	"melodee/internal/services"
+	"melodee/internal/share"
+	"melodee/internal/smartplaylist"
 	open_subsonic_handlers "melodee/open_subsonic/handlers"
 	open_subsonic_middleware "melodee/open_subsonic/middleware"
 )
@@ -72,7 +79,7 @@ func NewServer() (*Server, error) {
 
 	// Initialize repository and services
 	repo := services.NewRepository(dbManager.GetGormDB())
-	authService := services.NewAuthService(dbManager.GetGormDB(), cfg.JWT.Secret)
+	authService := services.NewAuthService(dbManager.GetGormDB(), cfg.JWT.Secret).WithSecretKey(cfg.SecretKey())
 
 	// Initialize Asynq client and scheduler
 	asynqClient := asynq.NewClient(asynq.RedisClientOpt{
@@ -213,9 +220,24 @@ func (s *Server) setupInternalRoutes() {
 	users.Get("/:id", userHandler.GetUser)
 	users.Put("/:id", userHandler.UpdateUser)
 	users.Delete("/:id", authMiddleware.AdminOnly(), userHandler.DeleteUser)
+	users.Get("/:id/subsonic-passwords", userHandler.GetSubsonicPasswords)
+	users.Post("/:id/subsonic-passwords", userHandler.CreateSubsonicPassword)
+	users.Delete("/:id/subsonic-passwords/:passwordId", userHandler.DeleteSubsonicPassword)
+
+	// Listening statistics
+	statsHandler := handlers.NewStatsHandler(s.repo)
+	users.Get("/:id/stats", statsHandler.GetUserStats)
+
+	// Outbound scrobbling accounts
+	scrobblerHandler := handlers.NewScrobblerHandler(s.repo, s.cfg.Scrobble, s.cfg.JWT.Secret)
+	users.Get("/:id/scrobblers", scrobblerHandler.GetScrobblers)
+	users.Get("/:id/scrobblers/:service/authorize", scrobblerHandler.AuthorizeScrobbler)
+	users.Put("/:id/scrobblers/:service", scrobblerHandler.LinkScrobbler)
+	users.Delete("/:id/scrobblers/:service", scrobblerHandler.UnlinkScrobbler)
 
 	// Playlist management
-	playlistHandler := handlers.NewPlaylistHandler(s.repo)
+	playlistHandler := handlers.NewPlaylistHandler(s.repo).
+		WithSmartPlaylists(smartplaylist.NewService(s.repo.GetDB(), s.cfg.SmartPlaylists))
 	playlists := protected.Group("/playlists")
 	playlists.Get("/", playlistHandler.GetPlaylists)
 	playlists.Post("/", playlistHandler.CreatePlaylist)
@@ -292,7 +314,6 @@ func (s *Server) setupInternalRoutes() {
 		}), // FFmpeg processor
 		checksumSvc,
 	)
-	_ = mediaProcessor // Will be used in future endpoints
 
 	// Library management
 	libraryHandler := handlers.NewLibraryHandler(s.repo, mediaSvc, s.asynqClient, mediaSvc.QuarantineService)
@@ -303,6 +324,75 @@ func (s *Server) setupInternalRoutes() {
 	libraries.Post("/scan", libraryHandler.TriggerLibraryScan)
 	libraries.Post("/process", libraryHandler.TriggerLibraryProcess)
 	libraries.Post("/move-ok", libraryHandler.TriggerLibraryMoveOK)
+	libraries.Put("/:id/watch", libraryHandler.SetLibraryWatched)
+
+	// Release groups (album edition consolidation)
+	releaseGroupHandler := handlers.NewReleaseGroupHandler(s.repo, s.asynqClient)
+	admin.Get("/release-groups/:id", releaseGroupHandler.GetReleaseGroup)
+	admin.Post("/release-groups/rebuild", releaseGroupHandler.RebuildReleaseGroups)
+
+	// Similar artists and tracks
+	similarityHandler := handlers.NewSimilarityHandler(s.asynqClient)
+	admin.Post("/similarity/rebuild", similarityHandler.RebuildSimilarity)
+
+	// Artist and album enrichment from external metadata providers
+	metadataHandler := handlers.NewMetadataHandler(s.repo, s.cfg.Metadata, s.asynqClient)
+	admin.Post("/metadata/artists/:id/enrich", metadataHandler.EnrichArtist)
+	admin.Get("/metadata/artists/:id/provenance", metadataHandler.GetArtistProvenance)
+	admin.Post("/metadata/albums/:id/enrich", metadataHandler.EnrichAlbum)
+	admin.Get("/metadata/albums/:id/provenance", metadataHandler.GetAlbumProvenance)
+
+	// Metadata cleanup rules for inbound processing
+	metadataRulesHandler := handlers.NewMetadataRulesHandler(s.repo, s.cfg.StagingScan.ScanDBDataPath)
+	admin.Get("/metadata-rules", metadataRulesHandler.GetMetadataRules)
+	admin.Post("/metadata-rules", metadataRulesHandler.CreateMetadataRule)
+	admin.Post("/metadata-rules/dry-run", metadataRulesHandler.DryRunMetadataRules)
+	admin.Put("/metadata-rules/:id", metadataRulesHandler.UpdateMetadataRule)
+	admin.Delete("/metadata-rules/:id", metadataRulesHandler.DeleteMetadataRule)
+
+	// Album and artist images; variants are only made for OpenSubsonic clients
+	artworkHandler := handlers.NewArtworkHandler(s.repo, artwork.NewService(s.repo.GetDB(), artwork.NewCache(s.cfg.Artwork, nil)))
+	admin.Get("/albums/:id/images", artworkHandler.GetAlbumImages)
+	admin.Put("/albums/:id/images/:type", artworkHandler.PutAlbumImage)
+	admin.Get("/artists/:id/images", artworkHandler.GetArtistImages)
+	admin.Put("/artists/:id/image", artworkHandler.PutArtistImage)
+
+	// Track lyrics
+	lyricsHandler := handlers.NewLyricsHandler(s.repo)
+	admin.Get("/tracks/:id/lyrics", lyricsHandler.GetTrackLyrics)
+	admin.Put("/tracks/:id/lyrics", lyricsHandler.PutTrackLyrics)
+	admin.Delete("/tracks/:id/lyrics/:lyricsId", lyricsHandler.DeleteTrackLyrics)
+
+	// Duplicate recordings by acoustic fingerprint
+	fingerprintHandler := handlers.NewFingerprintHandler(s.repo, s.cfg.Processing.FFmpegPath, s.cfg.Fingerprint, s.asynqClient)
+	admin.Get("/duplicates", fingerprintHandler.GetDuplicates)
+	admin.Post("/fingerprints/backfill", fingerprintHandler.BackfillFingerprints)
+
+	// ReplayGain values from EBU R128 loudness analysis
+	loudnessHandler := handlers.NewLoudnessHandler(s.asynqClient)
+	admin.Post("/loudness/analyze", loudnessHandler.AnalyzeLoudness)
+
+	// Staging review and metadata editing. Staging items carry their own
+	// paths, so no staging root is needed.
+	stagingHandler := handlers.NewStagingHandler(s.repo.GetDB(), "")
+	staging := protected.Group("/v1/staging")
+	staging.Use(authMiddleware.AdminOnly())
+	staging.Get("/", stagingHandler.ListStagingItems)
+	staging.Get("/stats", stagingHandler.GetStagingStats)
+	staging.Get("/:id", stagingHandler.GetStagingItem)
+	staging.Get("/:id/history", stagingHandler.GetStagingItemHistory)
+	staging.Patch("/:id/metadata", stagingHandler.EditStagingItem)
+	staging.Put("/:id/artwork", stagingHandler.ReplaceStagingArtwork)
+	staging.Post("/:id/approve", stagingHandler.ApproveStagingItem)
+	staging.Post("/:id/reject", stagingHandler.RejectStagingItem)
+	staging.Delete("/:id", stagingHandler.DeleteStagingItem)
+
+	// Promotion of approved albums to production, run by the worker. The
+	// media processor selects each album's production library.
+	promotionHandler := handlers.NewPromotionHandler(promotion.NewService(s.repo.GetDB(), mediaProcessor), s.asynqClient)
+	staging.Post("/promote-batch", promotionHandler.PromoteBatch)
+	staging.Get("/promotions/:batchId", promotionHandler.GetPromotionBatch)
+	staging.Post("/:id/promote", promotionHandler.PromoteAlbum)
 
 	// Settings management
 	settingsHandler := handlers.NewSettingsHandler(s.repo)
@@ -310,7 +400,7 @@ func (s *Server) setupInternalRoutes() {
 	admin.Put("/settings/:key", settingsHandler.UpdateSetting)
 
 	// Shares management
-	sharesHandler := handlers.NewSharesHandler(s.repo)
+	sharesHandler := handlers.NewSharesHandler(s.repo).WithShares(share.NewService(s.repo.GetDB(), s.cfg.Server.ExternalURL))
 	admin.Get("/shares", sharesHandler.GetShares)
 	admin.Post("/shares", sharesHandler.CreateShare)
 	admin.Put("/shares/:id", sharesHandler.UpdateShare)
@@ -337,12 +427,14 @@ func (s *Server) setupInternalRoutes() {
 	artistsV1.Get("/recent", artistsV1Handler.GetRecentArtists)
 	artistsV1.Get("/:id/albums", artistsV1Handler.GetArtistAlbums)
 	artistsV1.Get("/:id/songs", artistsV1Handler.GetArtistSongs)
+	artistsV1.Get("/:id/instant-mix", artistsV1Handler.GetInstantMix)
 
 	tracksV1Handler := handlers.NewTracksV1Handler(s.repo)
 	tracksV1 := protected.Group("/v1/Tracks")
 	tracksV1.Get("/", tracksV1Handler.GetTracks)
 	tracksV1.Get("/:id", tracksV1Handler.GetTrack)
 	tracksV1.Get("/recent", tracksV1Handler.GetRecentTracks)
+	tracksV1.Get("/:id/instant-mix", tracksV1Handler.GetInstantMix)
 	tracksV1.Post("/starred/:id/:isStarred", tracksV1Handler.ToggleTrackStarred)
 	tracksV1.Post("/setrating/:id/:rating", tracksV1Handler.SetTrackRating)
 
@@ -366,7 +458,7 @@ func (s *Server) setupOpenSubsonicRoutes() {
 	})
 
 	// OpenSubsonic authentication middleware
-	openSubsonicAuth := open_subsonic_middleware.NewOpenSubsonicAuthMiddleware(s.dbManager.GetGormDB(), s.cfg.JWT.Secret)
+	openSubsonicAuth := open_subsonic_middleware.NewOpenSubsonicAuthMiddleware(s.dbManager.GetGormDB(), s.authService)
 
 	// Initialize FFmpeg processor
 	ffmpegConfig := &media.FFmpegConfig{
@@ -390,20 +482,35 @@ func (s *Server) setupOpenSubsonicRoutes() {
 
 	// Create handlers for OpenSubsonic endpoints
 	browsingHandler := open_subsonic_handlers.NewBrowsingHandler(s.repo.GetDB())
-	mediaHandler := open_subsonic_handlers.NewMediaHandler(s.repo.GetDB(), s.cfg, transcodeService)
+	// ffmpeg makes the WebP cover art variants; unlike transcoding it needs a timeout
+	artworkFFmpeg := media.NewFFmpegProcessor(&media.FFmpegConfig{
+		FFmpegPath: s.cfg.Processing.FFmpegPath,
+		Timeout:    media.DefaultFFmpegConfig().Timeout,
+	})
+	mediaHandler := open_subsonic_handlers.NewMediaHandler(s.repo.GetDB(), s.cfg, transcodeService).
+		WithArtwork(artwork.NewService(s.repo.GetDB(), artwork.NewCache(s.cfg.Artwork, artworkFFmpeg)))
 	searchHandler := open_subsonic_handlers.NewSearchHandler(s.repo.GetDB())
-	playlistHandler := open_subsonic_handlers.NewPlaylistHandler(s.repo.GetDB())
-	userHandler := open_subsonic_handlers.NewUserHandler(s.repo.GetDB())
+	playlistHandler := open_subsonic_handlers.NewPlaylistHandler(s.repo.GetDB()).
+		WithSmartPlaylists(smartplaylist.NewService(s.repo.GetDB(), s.cfg.SmartPlaylists))
+	userHandler := open_subsonic_handlers.NewUserHandler(s.repo.GetDB()).
+		WithScrobbling(scrobble.NewService(s.repo.GetDB(), s.cfg.Scrobble, s.cfg.SecretKey()), s.asynqClient)
 	systemHandler := open_subsonic_handlers.NewSystemHandler(s.repo)
 	bookmarkHandler := open_subsonic_handlers.NewBookmarkHandler(s.repo.GetDB())
 	playQueueHandler := open_subsonic_handlers.NewPlayQueueHandler(s.repo.GetDB())
-	podcastHandler := open_subsonic_handlers.NewPodcastHandler(s.repo.GetDB())
+	podcastService := podcast.NewService(s.repo.GetDB(), s.cfg.Podcast)
+	podcastHandler := open_subsonic_handlers.NewPodcastHandler(s.repo.GetDB(), podcastService, s.asynqClient)
 	internetRadioHandler := open_subsonic_handlers.NewInternetRadioHandler(s.repo.GetDB())
-	sharesHandler := open_subsonic_handlers.NewSharesHandler(s.repo.GetDB())
+	shareService := share.NewService(s.repo.GetDB(), s.cfg.Server.ExternalURL)
+	sharesHandler := open_subsonic_handlers.NewSharesHandler(s.repo.GetDB()).WithShares(shareService)
+	publicShareHandler := open_subsonic_handlers.NewPublicShareHandler(shareService, mediaHandler)
 	videoHandler := open_subsonic_handlers.NewVideoHandler(s.repo.GetDB())
 	chatHandler := open_subsonic_handlers.NewChatHandler(s.repo.GetDB())
 	scanHandler := open_subsonic_handlers.NewScanHandler(s.repo.GetDB())
-	jukeboxHandler := open_subsonic_handlers.NewJukeboxHandler(s.repo.GetDB())
+	jukeboxService, err := jukebox.NewFromConfig(s.repo.GetDB(), s.cfg)
+	if err != nil {
+		log.Printf("Warning: jukebox disabled: %v", err)
+	}
+	jukeboxHandler := open_subsonic_handlers.NewJukeboxHandler(s.repo.GetDB(), jukeboxService)
 
 	// Browsing endpoints
 	rest.Get("/getMusicFolders", openSubsonicAuth.Authenticate, browsingHandler.GetMusicFolders)
@@ -499,6 +606,12 @@ func (s *Server) setupOpenSubsonicRoutes() {
 	rest.Get("/updateShare", openSubsonicAuth.Authenticate, sharesHandler.UpdateShare)
 	rest.Get("/deleteShare", openSubsonicAuth.Authenticate, sharesHandler.DeleteShare)
 
+	// Public shares, open to anyone with the token
+	s.app.Get("/share/:token", publicShareHandler.Manifest)
+	s.app.Get("/share/:token/stream/:trackId", publicShareHandler.Stream)
+	s.app.Get("/share/:token/download/:trackId", publicShareHandler.Download)
+	s.app.Get("/share/:token/cover/:trackId", publicShareHandler.CoverArt)
+
 	// Video endpoints
 	rest.Get("/getVideos", openSubsonicAuth.Authenticate, videoHandler.GetVideos)
 	rest.Get("/getVideoInfo", openSubsonicAuth.Authenticate, videoHandler.GetVideoInfo)
@@ -20,6 +20,7 @@ import (
 	// "melodee/internal/database"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -29,7 +30,7 @@ import (
 func TestAuthSemanticsContract(t *testing.T) {
 	db := setupTestDatabase(t)
 	cfg := getTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupTestApp(db, cfg, authMiddleware)
 
 	// Test cases for auth errors with expected error codes
@@ -110,7 +111,7 @@ func TestAuthHappyPath(t *testing.T) {
 	err := db.Create(user).Error
 	assert.NoError(t, err)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupTestApp(db, cfg, authMiddleware)
 
 	// TODO: Implement proper password hash for the test user
@@ -127,7 +128,7 @@ func TestAuthHappyPath(t *testing.T) {
 func TestExactXMLErrorCodes(t *testing.T) {
 	db := setupTestDatabase(t)
 	cfg := getTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupTestApp(db, cfg, authMiddleware)
 
 	// Test different error scenarios and validate their specific codes
@@ -194,7 +195,7 @@ func setupTestDatabase(t *testing.T) *gorm.DB {
 	assert.NoError(t, err)
 
 	// Auto-migrate the models
-	err = db.AutoMigrate(&models.User{}, &models.Library{}, &models.Artist{}, &models.Album{}, &models.Track{})
+	err = db.AutoMigrate(&models.User{}, &models.SubsonicPassword{}, &models.Library{}, &models.Artist{}, &models.Album{}, &models.Track{})
 	assert.NoError(t, err)
 
 	return db
@@ -19,6 +19,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -29,7 +30,7 @@ func TestAllEndpointsContract(t *testing.T) {
 	tempDir := t.TempDir()
 	db := setupComprehensiveTestDatabase(t, tempDir)
 	cfg := getComprehensiveTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupComprehensiveTestApp(db, cfg, authMiddleware, tempDir)
 
 	endpointTests := []struct {
@@ -123,7 +124,7 @@ func TestAllEndpointsContract(t *testing.T) {
 func TestErrorResponsesContract(t *testing.T) {
 	db := setupComprehensiveTestDatabase(t, "")
 	cfg := getComprehensiveTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupComprehensiveTestApp(db, cfg, authMiddleware, "")
 
 	errorTests := []struct {
@@ -172,7 +173,7 @@ func TestErrorResponsesContract(t *testing.T) {
 func TestMissingAuthResponses(t *testing.T) {
 	db := setupComprehensiveTestDatabase(t, "")
 	cfg := getComprehensiveTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupComprehensiveTestApp(db, cfg, authMiddleware, "")
 
 	authTests := []struct {
@@ -222,7 +223,7 @@ func TestMissingAuthResponses(t *testing.T) {
 func TestSuccessResponseFormat(t *testing.T) {
 	db := setupComprehensiveTestDatabase(t, "")
 	cfg := getComprehensiveTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupComprehensiveTestApp(db, cfg, authMiddleware, "")
 
 	// Test with minimal valid request to get a successful response
@@ -16,6 +16,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/database"
 	"melodee/internal/media"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -34,6 +35,8 @@ func runContractTestServer() (*fiber.App, func()) {
 	// For tests, we'll create a minimal schema
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT NOT NULL,
 		password_hash TEXT NOT NULL,
 		api_key TEXT
@@ -77,7 +80,7 @@ func runContractTestServer() (*fiber.App, func()) {
 	systemHandler := handlers.NewSystemHandler(db)
 
 	// Create auth middleware
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 
 	// Initialize Fiber app for testing
 	app := fiber.New(fiber.Config{
@@ -17,6 +17,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 )
@@ -43,7 +44,7 @@ func TestCoverArtCaching(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupCoverArtTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data
@@ -155,7 +156,7 @@ func TestAvatarCaching(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupCoverArtTestApp(db, cfg, authMiddleware, transcodeService)
 
 	avatarTests := []struct {
@@ -236,7 +237,7 @@ func TestCacheHeaders(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupCoverArtTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data and cover art file
@@ -332,7 +333,7 @@ func TestMissingArtBehavior(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupCoverArtTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Test with non-existent album ID for cover art
@@ -377,7 +378,7 @@ func TestFallbackCoverArt(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupCoverArtTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create album directory with different cover art file names
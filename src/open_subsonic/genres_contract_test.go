@@ -18,6 +18,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -27,7 +28,7 @@ import (
 func TestGenresEndpoint(t *testing.T) {
 	db := setupGenresTestDatabase(t)
 	cfg := getGenresTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupGenresTestApp(db, cfg, authMiddleware)
 
 	// Create test data with various genres in tags
@@ -229,7 +230,7 @@ func TestExtractGenreFromTags(t *testing.T) {
 func TestGenresWithEmptyData(t *testing.T) {
 	db := setupGenresTestDatabase(t)
 	cfg := getGenresTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupGenresTestApp(db, cfg, authMiddleware)
 
 	// Test with no songs or albums having genres
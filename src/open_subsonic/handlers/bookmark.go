@@ -67,6 +67,7 @@ func (h *BookmarkHandler) GetBookmarks(c *fiber.Ctx) error {
 			BitRate:     int(track.BitRate),
 			Path:        track.RelativePath,
 			Created:     utils.FormatTime(track.CreatedAt),
+			ReplayGain:  replayGain(track),
 		}
 
 		if track.Album.ReleaseDate != nil {
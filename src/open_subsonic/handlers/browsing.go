@@ -11,19 +11,29 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
+	"melodee/internal/lyrics"
 	"melodee/internal/models"
+	"melodee/internal/playhistory"
+	"melodee/internal/releasegroup"
+	"melodee/internal/similarity"
 	"melodee/open_subsonic/utils"
 )
 
 // BrowsingHandler handles OpenSubsonic browsing endpoints
 type BrowsingHandler struct {
-	db *gorm.DB
+	db      *gorm.DB
+	history *playhistory.Service
+	similar *similarity.Service
+	lyrics  *lyrics.Service
 }
 
 // NewBrowsingHandler creates a new browsing handler
 func NewBrowsingHandler(db *gorm.DB) *BrowsingHandler {
 	return &BrowsingHandler{
-		db: db,
+		db:      db,
+		history: playhistory.NewService(db),
+		similar: similarity.NewService(db),
+		lyrics:  lyrics.NewService(db),
 	}
 }
 
@@ -208,9 +218,19 @@ func (h *BrowsingHandler) GetArtist(c *fiber.Ctx) error {
 	// Get albums for this artist
 	// All albums in production are valid (promoted from staging)
 	var albums []models.Album
-	if err := h.db.Where("artist_id = ?", artist.ID).Find(&albums).Error; err != nil {
+	query := h.db.Where("artist_id = ?", artist.ID)
+	consolidate := consolidatesEditions(c)
+	if consolidate {
+		query = query.Scopes(releasegroup.ConsolidatedAlbums)
+	}
+	if err := query.Find(&albums).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve albums")
 	}
+	if consolidate {
+		if err := h.applyReleaseGroups(albums); err != nil {
+			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve albums")
+		}
+	}
 
 	// Build response
 	response := utils.SuccessResponse()
@@ -262,14 +282,8 @@ func (h *BrowsingHandler) GetAlbumInfo(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
 	}
 
-	// For now, return a basic response - more detailed implementation needed
 	response := utils.SuccessResponse()
-	albumInfo := utils.AlbumInfo{
-		ID: int(album.ID),
-		// Add more fields as needed based on specifications
-	}
-
-	response.AlbumInfo = &albumInfo
+	response.AlbumInfo = albumInfo(album)
 
 	return utils.SendResponse(c, response)
 }
@@ -290,19 +304,27 @@ func (h *BrowsingHandler) GetAlbumInfo2(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
 	}
 
-	// Build response
 	response := utils.SuccessResponse()
-	albumInfo := utils.AlbumInfo{
-		ID: int(album.ID),
-		// Add more fields as needed based on specifications
-		// Notes, MusicBrainzID, LastFmUrl, etc.
-	}
-
-	response.AlbumInfo = &albumInfo
+	response.AlbumInfo = albumInfo(album)
 
 	return utils.SendResponse(c, response)
 }
 
+// albumInfo returns the notes, MusicBrainz ID and image metadata enrichment found for an album
+func albumInfo(album models.Album) *utils.AlbumInfo {
+	info := &utils.AlbumInfo{
+		ID:             int(album.ID),
+		Notes:          album.Description,
+		SmallImageURL:  album.ImageURL,
+		MediumImageURL: album.ImageURL,
+		LargeImageURL:  album.ImageURL,
+	}
+	if album.MusicBrainzID != nil {
+		info.MusicBrainzID = album.MusicBrainzID.String()
+	}
+	return info
+}
+
 // GetArtistInfo returns artist information
 func (h *BrowsingHandler) GetArtistInfo(c *fiber.Ctx) error {
 	return h.getArtistInfoCommon(c, 1)
@@ -328,37 +350,57 @@ func (h *BrowsingHandler) getArtistInfoCommon(c *fiber.Ctx, version int) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve artist")
 	}
 
-	// Build response
-	// Ideally we would fetch biography, image URL, etc. from external services or DB
-	// For now, return basic info with placeholders
-
-	// In a real implementation, we would have a separate table for artist metadata
-	// or fetch it from Last.fm/MusicBrainz
+	// Biography, image and MusicBrainz ID are filled in by metadata enrichment
+	var musicBrainzID string
+	if artist.MusicBrainzID != nil {
+		musicBrainzID = artist.MusicBrainzID.String()
+	}
 
-	biography := fmt.Sprintf("Biography for %s. (Metadata integration pending)", artist.Name)
+	count := c.QueryInt("count", 20)
+	if count <= 0 {
+		count = 20
+	}
+	if count > 100 {
+		count = 100
+	}
+	var userID int64
+	if user, ok := utils.GetUserFromContext(c); ok {
+		userID = user.ID
+	}
+	similarArtists, err := h.similar.SimilarArtists(c.Context(), artist.ID, userID, count)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve similar artists")
+	}
+	similar := make([]utils.Artist, 0, len(similarArtists))
+	for _, a := range similarArtists {
+		similar = append(similar, utils.Artist{
+			ID:         int(a.ID),
+			Name:       a.Name,
+			AlbumCount: int(a.AlbumCountCached),
+			CoverArt:   getCoverArtID("artist", a.ID),
+		})
+	}
 
 	response := utils.SuccessResponse()
 
 	if version == 2 {
 		artistInfo := utils.ArtistInfo2{
-			Biography:      biography,
-			MusicBrainzID:  "",               // Placeholder
-			LastFmURL:      "",               // Placeholder
-			SmallImageURL:  "",               // Placeholder
-			MediumImageURL: "",               // Placeholder
-			LargeImageURL:  "",               // Placeholder
-			SimilarArtists: []utils.Artist{}, // Empty for now
+			Biography:      artist.Biography,
+			MusicBrainzID:  musicBrainzID,
+			SmallImageURL:  artist.ImageURL,
+			MediumImageURL: artist.ImageURL,
+			LargeImageURL:  artist.ImageURL,
+			SimilarArtists: similar,
 		}
 		response.ArtistInfo2 = &artistInfo
 	} else {
 		artistInfo := utils.ArtistInfo{
-			Biography:      biography,
-			MusicBrainzID:  "",               // Placeholder
-			LastFmURL:      "",               // Placeholder
-			SmallImageURL:  "",               // Placeholder
-			MediumImageURL: "",               // Placeholder
-			LargeImageURL:  "",               // Placeholder
-			SimilarArtists: []utils.Artist{}, // Empty for now
+			Biography:      artist.Biography,
+			MusicBrainzID:  musicBrainzID,
+			SmallImageURL:  artist.ImageURL,
+			MediumImageURL: artist.ImageURL,
+			LargeImageURL:  artist.ImageURL,
+			SimilarArtists: similar,
 		}
 		response.ArtistInfo = &artistInfo
 	}
@@ -388,7 +430,8 @@ func (h *BrowsingHandler) GetLyrics(c *fiber.Ctx) error {
 	return h.returnLyrics(c, song)
 }
 
-// GetLyricsBySongId returns lyrics for a song by ID
+// GetLyricsBySongId returns the structured lyrics of a song, synced ones
+// first, as described by the OpenSubsonic songLyrics extension
 func (h *BrowsingHandler) GetLyricsBySongId(c *fiber.Ctx) error {
 	id := c.QueryInt("id", -1)
 	if id <= 0 {
@@ -403,26 +446,91 @@ func (h *BrowsingHandler) GetLyricsBySongId(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve song")
 	}
 
-	return h.returnLyrics(c, song)
+	sets, err := h.songLyrics(c, song)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve lyrics")
+	}
+
+	list := &utils.LyricsList{StructuredLyrics: []utils.StructuredLyrics{}}
+	for _, set := range sets {
+		structured := utils.StructuredLyrics{
+			DisplayArtist: set.Artist,
+			DisplayTitle:  set.Title,
+			Lang:          set.Lang,
+			Offset:        set.Offset,
+			Synced:        set.Synced,
+			Line:          make([]utils.LyricLine, 0, len(set.Lines)),
+		}
+		if structured.DisplayArtist == "" {
+			structured.DisplayArtist = song.Artist.Name
+		}
+		if structured.DisplayTitle == "" {
+			structured.DisplayTitle = song.Name
+		}
+		for _, line := range set.Lines {
+			structured.Line = append(structured.Line, utils.LyricLine{Start: line.Start, Value: line.Value})
+		}
+		list.StructuredLyrics = append(list.StructuredLyrics, structured)
+	}
+
+	response := utils.SuccessResponse()
+	response.LyricsList = list
+	return utils.SendResponse(c, response)
 }
 
+// returnLyrics sends a song's lyrics as plain text, preferring unsynced lyrics
 func (h *BrowsingHandler) returnLyrics(c *fiber.Ctx, song models.Track) error {
-	// Extract lyrics from tags if available
-	// Or fetch from external service
+	sets, err := h.songLyrics(c, song)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve lyrics")
+	}
 
-	// For now, check tags
-	lyrics := extractLyricsFromTags(song.Tags)
+	content := ""
+	for i, set := range sets {
+		if !set.Synced || i == len(sets)-1 {
+			values := make([]string, len(set.Lines))
+			for j, line := range set.Lines {
+				values[j] = line.Value
+			}
+			content = strings.Join(values, "\n")
+			break
+		}
+	}
 
 	response := utils.SuccessResponse()
 	response.Lyrics = &utils.Lyrics{
 		Artist:  song.Artist.Name,
 		Title:   song.Name,
-		Content: lyrics,
+		Content: content,
 	}
 
 	return utils.SendResponse(c, response)
 }
 
+// songLyrics returns the stored lyrics of a song, falling back to any found
+// in its tags
+func (h *BrowsingHandler) songLyrics(c *fiber.Ctx, song models.Track) ([]lyrics.Lyrics, error) {
+	records, err := h.lyrics.ForTrack(c.Context(), song.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([]lyrics.Lyrics, 0, len(records))
+	for _, record := range records {
+		set, err := lyrics.Decode(record)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	if len(sets) == 0 {
+		if text := extractLyricsFromTags(song.Tags); text != "" {
+			sets = append(sets, lyrics.Parse(text))
+		}
+	}
+	return sets, nil
+}
+
 // extractLyricsFromTags extracts lyrics from song tags
 func extractLyricsFromTags(tags []byte) string {
 	if tags == nil || len(tags) == 0 {
@@ -535,6 +643,7 @@ func (h *BrowsingHandler) GetMusicDirectory(c *fiber.Ctx) error {
 				ContentType: getContentType(song.FileName),
 				Suffix:      getSuffix(song.FileName),
 				Path:        song.RelativePath,
+				ReplayGain:  replayGain(song),
 			}
 			directory.Children = append(directory.Children, child)
 		}
@@ -562,9 +671,20 @@ func (h *BrowsingHandler) GetAlbum(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
 	}
 
-	// Get songs in this album
+	// Get songs in this album. The primary edition of a release group stands
+	// for the whole group when the user consolidates editions; the other
+	// editions are still returned as they are.
 	var songs []models.Track
-	if err := h.db.Where("album_id = ?", album.ID).Order("sort_order").Find(&songs).Error; err != nil {
+	group, err := h.consolidatedGroup(c, album)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
+	}
+	if group != nil {
+		applyReleaseGroup(&album, *group)
+		if songs, err = releasegroup.NewService(h.db).UniqueTracks(group.ID); err != nil {
+			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve songs")
+		}
+	} else if err := h.db.Where("album_id = ?", album.ID).Order("sort_order").Find(&songs).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve songs")
 	}
 
@@ -580,6 +700,7 @@ func (h *BrowsingHandler) GetAlbum(c *fiber.Ctx) error {
 		TrackCount: len(songs),
 		Created:    utils.FormatTime(album.CreatedAt),
 		Duration:   int(album.DurationCached / 1000), // Convert to seconds
+		Version:    editionVersion(album),
 	}
 
 	if album.ReleaseDate != nil {
@@ -606,6 +727,7 @@ func (h *BrowsingHandler) GetAlbum(c *fiber.Ctx) error {
 			ContentType: getContentType(song.FileName),
 			Suffix:      getSuffix(song.FileName),
 			Path:        song.RelativePath,
+			ReplayGain:  replayGain(song),
 		}
 		albumResp.Songs = append(albumResp.Songs, child)
 	}
@@ -648,6 +770,7 @@ func (h *BrowsingHandler) GetSong(c *fiber.Ctx) error {
 		ContentType: getContentType(song.FileName),
 		Suffix:      getSuffix(song.FileName),
 		Path:        song.RelativePath,
+		ReplayGain:  replayGain(song),
 	}
 
 	response.Song = &child
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -103,6 +105,49 @@ func TestBrowsingHandler_GetArtist(t *testing.T) {
 	assert.NotEqual(t, http.StatusForbidden, resp.StatusCode)
 }
 
+func TestBrowsingHandler_GetSongReplayGain(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		duration INTEGER,
+		file_name TEXT,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL
+	)`).Error)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Band')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id) VALUES (1, 'Album', 1)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, file_name, replaygain_track_gain, replaygain_track_peak, replaygain_album_gain, replaygain_album_peak)
+		VALUES (1, 'Analyzed', 1, 1, 'one.flac', -6.52, 0.988553, -7.1, 1.035142), (2, 'Not Analyzed', 1, 1, 'two.flac', NULL, NULL, NULL, NULL)`)
+
+	app := fiber.New()
+	app.Get("/getSong", NewBrowsingHandler(db).GetSong)
+
+	song := getSubsonicResponse(t, app, "/getSong?id=1&f=json")["song"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"trackGain": -6.52,
+		"trackPeak": 0.988553,
+		"albumGain": -7.1,
+		"albumPeak": 1.035142,
+	}, song["replayGain"])
+
+	song = getSubsonicResponse(t, app, "/getSong?id=2&f=json")["song"].(map[string]interface{})
+	assert.NotContains(t, song, "replayGain")
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/getSong?id=1", nil))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `<replayGain trackGain="-6.52" albumGain="-7.1" trackPeak="0.988553" albumPeak="1.035142"></replayGain>`)
+}
+
 func getTestDB() *gorm.DB {
 	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
 	if err != nil {
@@ -112,6 +157,8 @@ func getTestDB() *gorm.DB {
 	// Manually create tables for SQLite
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -146,12 +193,17 @@ func getTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		artist_id INTEGER,
 		track_count_cached INTEGER DEFAULT 0,
@@ -181,12 +233,22 @@ func getTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -213,6 +275,7 @@ func getTestDB() *gorm.DB {
 		path TEXT,
 		type TEXT,
 		is_locked BOOLEAN DEFAULT 0,
+		is_watched BOOLEAN DEFAULT 0,
 		created_at DATETIME,
 		track_count INTEGER DEFAULT 0,
 		album_count INTEGER DEFAULT 0,
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+	"melodee/internal/releasegroup"
+	"melodee/open_subsonic/utils"
+)
+
+// consolidatesEditions reports whether the requesting user browses release
+// groups as one album instead of one album per edition
+func consolidatesEditions(c *fiber.Ctx) bool {
+	user, ok := utils.GetUserFromContext(c)
+	return ok && user.ConsolidateEditions
+}
+
+// applyReleaseGroups presents each primary edition as its release group: the
+// group's name and its unique track count and duration
+func (h *BrowsingHandler) applyReleaseGroups(albums []models.Album) error {
+	var groupIDs []int64
+	for _, album := range albums {
+		if album.ReleaseGroupID != nil {
+			groupIDs = append(groupIDs, *album.ReleaseGroupID)
+		}
+	}
+	if len(groupIDs) == 0 {
+		return nil
+	}
+
+	var groups []models.ReleaseGroup
+	if err := h.db.Where("id IN ?", groupIDs).Find(&groups).Error; err != nil {
+		return err
+	}
+	byID := make(map[int64]models.ReleaseGroup, len(groups))
+	for _, group := range groups {
+		byID[group.ID] = group
+	}
+
+	for i := range albums {
+		if albums[i].ReleaseGroupID == nil {
+			continue
+		}
+		if group, ok := byID[*albums[i].ReleaseGroupID]; ok {
+			applyReleaseGroup(&albums[i], group)
+		}
+	}
+	return nil
+}
+
+func applyReleaseGroup(album *models.Album, group models.ReleaseGroup) {
+	album.Name = group.Name
+	album.TrackCountCached = group.TrackCountCached
+	album.DurationCached = group.DurationCached
+	album.EditionType = ""
+}
+
+// editionVersion returns the edition qualifier of an album that has other
+// editions, such as "Deluxe Edition", for the OpenSubsonic version field
+func editionVersion(album models.Album) string {
+	if album.ReleaseGroupID == nil || album.EditionType == "" {
+		return ""
+	}
+	return releasegroup.DetectEdition(album.Name).Qualifier
+}
+
+// consolidatedGroup returns the release group an album is browsed as, or nil
+// when the user does not consolidate editions or the album is not the
+// group's primary edition
+func (h *BrowsingHandler) consolidatedGroup(c *fiber.Ctx, album models.Album) (*models.ReleaseGroup, error) {
+	if album.ReleaseGroupID == nil || !consolidatesEditions(c) {
+		return nil, nil
+	}
+
+	var group models.ReleaseGroup
+	if err := h.db.First(&group, *album.ReleaseGroupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if group.PrimaryAlbumID == nil || *group.PrimaryAlbumID != album.ID {
+		return nil, nil
+	}
+	return &group, nil
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"melodee/internal/models"
+	"melodee/internal/releasegroup"
+)
+
+func setupEditionsTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Exec(`CREATE TABLE artists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_count_cached INTEGER DEFAULT 0
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE release_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		api_key TEXT,
+		artist_id INTEGER NOT NULL,
+		name TEXT,
+		name_normalized TEXT,
+		primary_album_id INTEGER,
+		music_brainz_id TEXT,
+		release_count INTEGER DEFAULT 0,
+		track_count_cached INTEGER DEFAULT 0,
+		duration_cached INTEGER DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE(artist_id, name_normalized)
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		artist_id INTEGER,
+		track_count_cached INTEGER DEFAULT 0,
+		duration_cached INTEGER DEFAULT 0,
+		created_at DATETIME,
+		release_date DATETIME,
+		original_release_date DATETIME,
+		music_brainz_id TEXT,
+		release_group_id INTEGER,
+		edition_type TEXT
+	)`).Error)
+	require.NoError(t, db.Exec(`CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		duration INTEGER,
+		bit_rate INTEGER,
+		sort_order INTEGER DEFAULT 0,
+		created_at DATETIME,
+		tags TEXT,
+		file_name TEXT,
+		relative_path TEXT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL
+	)`).Error)
+
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Band')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id, track_count_cached, release_date) VALUES
+		(1, 'Highway 101', 1, 2, '1980-01-01'),
+		(2, 'Highway 101 (Deluxe Edition)', 1, 3, '2010-01-01'),
+		(3, 'Something Else', 1, 1, '1985-01-01')`)
+	db.Exec(`INSERT INTO tracks (name, album_id, artist_id, duration, sort_order) VALUES
+		('One', 1, 1, 200000, 1), ('Two', 1, 1, 210000, 2),
+		('One', 2, 1, 200000, 1), ('Two', 2, 1, 210000, 2), ('Bonus', 2, 1, 180000, 3),
+		('Else', 3, 1, 190000, 1)`)
+
+	require.NoError(t, releasegroup.NewService(db).ConsolidateArtist(context.Background(), 1))
+	return db
+}
+
+func setupEditionsTestApp(db *gorm.DB, consolidate bool) *fiber.App {
+	handler := NewBrowsingHandler(db)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &models.User{ID: 1, Username: "testuser", ConsolidateEditions: consolidate})
+		return c.Next()
+	})
+	app.Get("/getAlbumList2", handler.GetAlbumList2)
+	app.Get("/getAlbum", handler.GetAlbum)
+	return app
+}
+
+func getSubsonicResponse(t *testing.T, app *fiber.App, url string) map[string]interface{} {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", url, nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var response map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	return response["subsonic-response"].(map[string]interface{})
+}
+
+func albumNames(subResp map[string]interface{}) []string {
+	albums := subResp["albumList2"].(map[string]interface{})["album"].([]interface{})
+	names := make([]string, len(albums))
+	for i, album := range albums {
+		names[i] = album.(map[string]interface{})["name"].(string)
+	}
+	return names
+}
+
+func TestBrowsingHandler_ConsolidatedEditions(t *testing.T) {
+	db := setupEditionsTestDB(t)
+	app := setupEditionsTestApp(db, true)
+
+	// One album per release group
+	subResp := getSubsonicResponse(t, app, "/getAlbumList2?type=alphabetical&f=json")
+	assert.Equal(t, []string{"Highway 101", "Something Else"}, albumNames(subResp))
+
+	// The group carries every unique track across its editions
+	subResp = getSubsonicResponse(t, app, "/getAlbum?id=1&f=json")
+	album := subResp["album"].(map[string]interface{})
+	assert.Equal(t, float64(3), album["songCount"])
+	songs := album["song"].([]interface{})
+	require.Len(t, songs, 3)
+	assert.Equal(t, "Bonus", songs[2].(map[string]interface{})["title"])
+
+	// Editions stay individually addressable
+	subResp = getSubsonicResponse(t, app, "/getAlbum?id=2&f=json")
+	album = subResp["album"].(map[string]interface{})
+	assert.Equal(t, "Highway 101 (Deluxe Edition)", album["name"])
+	assert.Equal(t, "Deluxe Edition", album["version"])
+	assert.Len(t, album["song"].([]interface{}), 3)
+}
+
+func TestBrowsingHandler_EditionsWithoutConsolidation(t *testing.T) {
+	db := setupEditionsTestDB(t)
+	app := setupEditionsTestApp(db, false)
+
+	subResp := getSubsonicResponse(t, app, "/getAlbumList2?type=alphabetical&f=json")
+	assert.Equal(t, []string{"Highway 101", "Highway 101 (Deluxe Edition)", "Something Else"}, albumNames(subResp))
+
+	subResp = getSubsonicResponse(t, app, "/getAlbum?id=1&f=json")
+	album := subResp["album"].(map[string]interface{})
+	assert.Len(t, album["song"].([]interface{}), 2)
+}
@@ -4,6 +4,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"melodee/internal/models"
+	"melodee/open_subsonic/utils"
 )
 
 // getContentType determines the content type based on file extension
@@ -51,3 +54,17 @@ func getCoverArtID(entityType string, id int64) string {
 		return strconv.FormatInt(id, 10)
 	}
 }
+
+// replayGain returns the replayGain element of a track, nil until the track
+// has been analyzed
+func replayGain(track models.Track) *utils.ReplayGain {
+	if track.ReplayGainTrackGain == nil && track.ReplayGainAlbumGain == nil {
+		return nil
+	}
+	return &utils.ReplayGain{
+		TrackGain: track.ReplayGainTrackGain,
+		AlbumGain: track.ReplayGainAlbumGain,
+		TrackPeak: track.ReplayGainTrackPeak,
+		AlbumPeak: track.ReplayGainAlbumPeak,
+	}
+}
@@ -1,6 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"strings"
+
+	"melodee/internal/jukebox"
+	"melodee/internal/models"
 	"melodee/open_subsonic/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -8,11 +13,14 @@ import (
 )
 
 type JukeboxHandler struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	jukebox *jukebox.Service
 }
 
-func NewJukeboxHandler(db *gorm.DB) *JukeboxHandler {
-	return &JukeboxHandler{DB: db}
+// NewJukeboxHandler creates a new jukebox handler. A nil service means the
+// jukebox is disabled on this server.
+func NewJukeboxHandler(db *gorm.DB, service *jukebox.Service) *JukeboxHandler {
+	return &JukeboxHandler{DB: db, jukebox: service}
 }
 
 func (h *JukeboxHandler) JukeboxControl(c *fiber.Ctx) error {
@@ -21,17 +29,108 @@ func (h *JukeboxHandler) JukeboxControl(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 10, "Missing action parameter")
 	}
 
-	// Stub implementation
-	// Actions: get, status, set, start, stop, skip, add, clear, remove, shuffle, setGain
-
-	return utils.SendResponse(c, &utils.OpenSubsonicResponse{
-		Status:  "ok",
-		Version: "1.16.1",
-		JukeboxStatus: &utils.JukeboxStatus{
-			CurrentIndex: 0,
-			Playing:      false,
-			Gain:         0.5,
-			Position:     0,
-		},
-	})
+	user, ok := c.Locals("user").(*models.User)
+	if !ok || (!user.IsAdmin && !user.JukeboxRole) {
+		return utils.SendOpenSubsonicError(c, 50, "User is not authorized for jukebox control")
+	}
+
+	if h.jukebox == nil {
+		return utils.SendOpenSubsonicError(c, 0, "Jukebox is not enabled on this server")
+	}
+
+	var err error
+	switch action {
+	case "get":
+		status, tracks := h.jukebox.Playlist()
+		playlist := &utils.JukeboxPlaylist{
+			CurrentIndex: status.CurrentIndex,
+			Playing:      status.Playing,
+			Gain:         status.Gain,
+			Position:     status.Position,
+			Entries:      make([]utils.Child, 0, len(tracks)),
+		}
+		browsing := &BrowsingHandler{}
+		for _, track := range tracks {
+			playlist.Entries = append(playlist.Entries, browsing.convertTrackToChild(track))
+		}
+
+		response := utils.SuccessResponse()
+		response.JukeboxPlaylist = playlist
+		return utils.SendResponse(c, response)
+	case "status":
+		// Nothing to change
+	case "set":
+		ids, parseErr := jukeboxTrackIDs(c)
+		if parseErr != nil {
+			return utils.SendOpenSubsonicError(c, 10, "Invalid id format")
+		}
+		err = h.jukebox.Set(ids)
+	case "add":
+		ids, parseErr := jukeboxTrackIDs(c)
+		if parseErr != nil || len(ids) == 0 {
+			return utils.SendOpenSubsonicError(c, 10, "Missing or invalid parameter id")
+		}
+		err = h.jukebox.Add(ids)
+	case "start":
+		err = h.jukebox.Start()
+	case "stop":
+		err = h.jukebox.Stop()
+	case "skip":
+		index := c.QueryInt("index", -1)
+		if index < 0 {
+			return utils.SendOpenSubsonicError(c, 10, "Missing required parameter index")
+		}
+		err = h.jukebox.Skip(index, c.QueryInt("offset", 0))
+	case "clear":
+		err = h.jukebox.Clear()
+	case "remove":
+		index := c.QueryInt("index", -1)
+		if index < 0 {
+			return utils.SendOpenSubsonicError(c, 10, "Missing required parameter index")
+		}
+		err = h.jukebox.Remove(index)
+	case "shuffle":
+		err = h.jukebox.Shuffle()
+	case "setGain":
+		if c.Query("gain") == "" {
+			return utils.SendOpenSubsonicError(c, 10, "Missing required parameter gain")
+		}
+		err = h.jukebox.SetGain(float32(c.QueryFloat("gain", 0)))
+	default:
+		return utils.SendOpenSubsonicError(c, 0, "Unknown jukebox action: "+action)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, jukebox.ErrTrackNotFound):
+			return utils.SendOpenSubsonicError(c, 70, "Song not found")
+		case errors.Is(err, jukebox.ErrInvalidIndex):
+			return utils.SendOpenSubsonicError(c, 0, "Invalid index")
+		default:
+			return utils.SendOpenSubsonicError(c, 0, "Jukebox error: "+err.Error())
+		}
+	}
+
+	status := h.jukebox.Status()
+	response := utils.SuccessResponse()
+	response.JukeboxStatus = &utils.JukeboxStatus{
+		CurrentIndex: status.CurrentIndex,
+		Playing:      status.Playing,
+		Gain:         status.Gain,
+		Position:     status.Position,
+	}
+	return utils.SendResponse(c, response)
+}
+
+// jukeboxTrackIDs reads the id parameter, which clients repeat for every track
+func jukeboxTrackIDs(c *fiber.Ctx) ([]int64, error) {
+	var ids []int64
+	for _, value := range c.Context().QueryArgs().PeekMulti("id") {
+		parsed, err := parseCommaSeparatedInts(strings.TrimSpace(string(value)))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, parsed...)
+	}
+	return ids, nil
 }
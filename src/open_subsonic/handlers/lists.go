@@ -1,12 +1,18 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 
 	"melodee/internal/models"
+	"melodee/internal/playhistory"
+	"melodee/internal/releasegroup"
 	"melodee/open_subsonic/utils"
 )
 
@@ -32,6 +38,11 @@ func (h *BrowsingHandler) getAlbumListCommon(c *fiber.Ctx, version int) error {
 	var albums []models.Album
 	query := h.db.Model(&models.Album{}).Preload("Artist")
 
+	consolidate := consolidatesEditions(c)
+	if consolidate {
+		query = query.Scopes(releasegroup.ConsolidatedAlbums)
+	}
+
 	// Apply filters based on type
 	switch listType {
 	case "random":
@@ -41,11 +52,21 @@ func (h *BrowsingHandler) getAlbumListCommon(c *fiber.Ctx, version int) error {
 			query = query.Order("RANDOM()") // Postgres/SQLite
 		}
 	case "newest":
-		query = query.Order("created_at DESC")
+		query = query.Order("albums.created_at DESC")
 	case "alphabetical", "byName":
-		query = query.Order("name ASC")
+		query = query.Order("albums.name ASC")
 	case "byYear":
-		query = query.Order("release_date DESC")
+		query = query.Order("albums.release_date DESC")
+	case "frequent", "recent":
+		// Albums the user has played, from the rolled up play history
+		user, ok := utils.GetUserFromContext(c)
+		if !ok {
+			query = query.Where("1 = 0")
+		} else if listType == "frequent" {
+			query = query.Scopes(playhistory.FrequentAlbums(user.ID))
+		} else {
+			query = query.Scopes(playhistory.RecentAlbums(user.ID))
+		}
 	case "starred":
 		// This requires joining with user_albums
 		user, ok := utils.GetUserFromContext(c)
@@ -59,7 +80,7 @@ func (h *BrowsingHandler) getAlbumListCommon(c *fiber.Ctx, version int) error {
 		}
 	default:
 		// Default to alphabetical
-		query = query.Order("name ASC")
+		query = query.Order("albums.name ASC")
 	}
 
 	// Apply pagination
@@ -67,6 +88,12 @@ func (h *BrowsingHandler) getAlbumListCommon(c *fiber.Ctx, version int) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album list")
 	}
 
+	if consolidate {
+		if err := h.applyReleaseGroups(albums); err != nil {
+			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album list")
+		}
+	}
+
 	response := utils.SuccessResponse()
 
 	if version == 2 {
@@ -184,109 +211,51 @@ func (h *BrowsingHandler) GetSongsByGenre(c *fiber.Ctx) error {
 	return utils.SendResponse(c, response)
 }
 
-// GetNowPlaying returns currently playing songs
+// GetNowPlaying returns what every user's players are playing now, as set
+// by scrobble with submission=false
 func (h *BrowsingHandler) GetNowPlaying(c *fiber.Ctx) error {
-	// Look for tracks played in the last 10 minutes
-	tenMinutesAgo := time.Now().Add(-10 * time.Minute)
-
-	var userTracks []models.UserTrack
-	// We need to join with User to get username
-	// And Track/Album/Artist for details
-	// Note: UserTrack model might not have relations defined, so we fetch manually
-	if err := h.db.Where("last_played_at > ?", tenMinutesAgo).
-		Order("last_played_at DESC").
-		Find(&userTracks).Error; err != nil {
+	entries, err := h.history.NowPlaying(c.Context())
+	if err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve now playing")
 	}
 
 	response := utils.SuccessResponse()
 	nowPlaying := utils.NowPlaying{
-		Entries: make([]utils.NowPlayingEntry, 0, len(userTracks)),
-	}
-
-	if len(userTracks) == 0 {
-		response.NowPlaying = &nowPlaying
-		return utils.SendResponse(c, response)
-	}
-
-	// Collect IDs
-	trackIDs := make([]int64, 0, len(userTracks))
-	userIDs := make([]int64, 0, len(userTracks))
-	for _, ut := range userTracks {
-		if ut.TrackID > 0 {
-			trackIDs = append(trackIDs, ut.TrackID)
-		}
-		if ut.UserID > 0 {
-			userIDs = append(userIDs, ut.UserID)
-		}
-	}
-
-	// Fetch Tracks
-	var tracks []models.Track
-	trackMap := make(map[int64]models.Track)
-	if len(trackIDs) > 0 {
-		if err := h.db.Preload("Album").Preload("Artist").Find(&tracks, trackIDs).Error; err != nil {
-			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve tracks")
-		}
-		for _, t := range tracks {
-			trackMap[t.ID] = t
-		}
+		Entries: make([]utils.NowPlayingEntry, 0, len(entries)),
 	}
 
-	// Fetch Users
-	var users []models.User
-	userMap := make(map[int64]string)
-	if len(userIDs) > 0 {
-		if err := h.db.Find(&users, userIDs).Error; err != nil {
-			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve users")
-		}
-		for _, u := range users {
-			userMap[u.ID] = u.Username
-		}
-	}
-
-	// Build response
-	for _, ut := range userTracks {
-		track, ok := trackMap[ut.TrackID]
-		if !ok {
+	for _, np := range entries {
+		if np.Track == nil {
 			continue
 		}
-
-		username := userMap[ut.UserID]
-		minutesAgo := 0
-		if ut.LastPlayedAt != nil {
-			minutesAgo = int(time.Since(*ut.LastPlayedAt).Minutes())
-		}
-
-		albumName := ""
-		if track.Album != nil {
-			albumName = track.Album.Name
-		}
-		artistName := ""
-		if track.Artist != nil {
-			artistName = track.Artist.Name
-		}
+		track := *np.Track
+		child := h.convertTrackToChild(track)
 
 		entry := utils.NowPlayingEntry{
-			ID:          int(track.ID),
-			Parent:      int(track.AlbumID),
+			ID:          child.ID,
+			Parent:      child.Parent,
 			IsDir:       false,
-			Title:       track.Name,
-			Album:       albumName,
-			Artist:      artistName,
-			CoverArt:    fmt.Sprintf("al-%d", track.AlbumID),
-			Created:     utils.FormatTime(track.CreatedAt),
-			Duration:    int(track.Duration / 1000),
-			BitRate:     int(track.BitRate),
-			Track:       int(track.SortOrder),
-			Genre:       extractGenreFromTags(track.Tags),
-			ContentType: getContentType(track.FileName),
-			Suffix:      getSuffix(track.FileName),
-			Path:        track.RelativePath,
-			Username:    username,
-			MinutesAgo:  minutesAgo,
-			PlayerId:    1,                // Placeholder
-			PlayerName:  "Melodee Player", // Placeholder
+			Title:       child.Title,
+			Album:       child.Album,
+			Artist:      child.Artist,
+			CoverArt:    child.CoverArt,
+			Created:     child.Created,
+			Duration:    child.Duration,
+			BitRate:     child.BitRate,
+			Track:       child.Track,
+			Genre:       child.Genre,
+			ContentType: child.ContentType,
+			Suffix:      child.Suffix,
+			Path:        child.Path,
+			MinutesAgo:  int(time.Since(np.StartedAt).Minutes()),
+			PlayerName:  np.Client,
+		}
+		if np.User != nil {
+			entry.Username = np.User.Username
+		}
+		if np.Player != nil {
+			entry.PlayerId = int(np.Player.ID)
+			entry.PlayerName = np.Player.Name
 		}
 		nowPlaying.Entries = append(nowPlaying.Entries, entry)
 	}
@@ -313,13 +282,11 @@ func (h *BrowsingHandler) GetTopSongs(c *fiber.Ctx) error {
 		return utils.SendResponse(c, response)
 	}
 
-	// Get songs for artist
-	// Ideally we sort by play count. We can aggregate from user_tracks
-	// For now, let's just return random songs or first songs if no play stats
-	// TODO: Implement proper aggregation of play counts
-
+	// The artist's songs, most played by all users first
 	var songs []models.Track
-	if err := h.db.Where("artist_id = ?", artist.ID).Preload("Album").Preload("Artist").Limit(count).Find(&songs).Error; err != nil {
+	if err := h.db.Model(&models.Track{}).Where("tracks.artist_id = ?", artist.ID).
+		Scopes(playhistory.MostPlayedTracks).
+		Preload("Album").Preload("Artist").Limit(count).Find(&songs).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve top songs")
 	}
 
@@ -337,49 +304,52 @@ func (h *BrowsingHandler) GetTopSongs(c *fiber.Ctx) error {
 	return utils.SendResponse(c, response)
 }
 
-// GetSimilarSongs returns similar songs
+// GetSimilarSongs returns songs similar to a song, or to an artist given as
+// "ar-<id>" (the form used for artist cover art)
 func (h *BrowsingHandler) GetSimilarSongs(c *fiber.Ctx) error {
 	return h.getSimilarSongsCommon(c, 1)
 }
 
-// GetSimilarSongs2 returns similar songs (Version 2)
+// GetSimilarSongs2 returns songs similar to an artist (Version 2)
 func (h *BrowsingHandler) GetSimilarSongs2(c *fiber.Ctx) error {
 	return h.getSimilarSongsCommon(c, 2)
 }
 
 func (h *BrowsingHandler) getSimilarSongsCommon(c *fiber.Ctx, version int) error {
-	id := c.QueryInt("id", -1)
 	count := c.QueryInt("count", 50)
-
-	if id <= 0 {
-		// OpenSubsonic allows artist ID or artist name? Spec says "id" (ID of artist)
-		// But some clients might send other things. Let's stick to ID.
-		return utils.SendOpenSubsonicError(c, 10, "Missing id parameter")
+	if count <= 0 {
+		count = 50
+	}
+	if count > 500 {
+		count = 500
 	}
 
-	// For now, just return random songs from the same artist or random songs from DB
-	// Real implementation needs similarity graph
-
-	// Let's get the artist first to ensure it exists
-	var artist models.Artist
-	if err := h.db.First(&artist, id).Error; err != nil {
-		return utils.SendOpenSubsonicError(c, 70, "Artist not found")
+	id := c.Query("id")
+	byArtist := version == 2 || strings.HasPrefix(id, "ar-")
+	parsed, err := strconv.ParseInt(strings.TrimPrefix(id, "ar-"), 10, 64)
+	if err != nil || parsed <= 0 {
+		return utils.SendOpenSubsonicError(c, 10, "Missing or invalid id parameter")
 	}
 
-	// Return random songs from this artist for now (as "similar" to the artist)
-	// Or better: random songs from OTHER artists in the same genre?
-	// Let's try to find genre of this artist (from their albums/tracks)
+	var userID int64
+	if user, ok := utils.GetUserFromContext(c); ok {
+		userID = user.ID
+	}
 
 	var songs []models.Track
-	query := h.db.Model(&models.Track{}).Preload("Album").Preload("Artist")
-
-	if h.db.Dialector.Name() == "mysql" {
-		query = query.Order("RAND()")
+	if byArtist {
+		var artist models.Artist
+		if err := h.db.First(&artist, parsed).Error; err != nil {
+			return utils.SendOpenSubsonicError(c, 70, "Artist not found")
+		}
+		songs, err = h.similar.ArtistMix(c.Context(), artist.ID, userID, count)
 	} else {
-		query = query.Order("RANDOM()")
+		songs, err = h.similar.TrackMix(c.Context(), parsed, userID, count)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return utils.SendOpenSubsonicError(c, 70, "Song not found")
+		}
 	}
-
-	if err := query.Limit(count).Find(&songs).Error; err != nil {
+	if err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve similar songs")
 	}
 
@@ -412,6 +382,7 @@ func (h *BrowsingHandler) convertToAlbum(album models.Album) utils.Album {
 		TrackCount: int(album.TrackCountCached),
 		Created:    utils.FormatTime(album.CreatedAt),
 		Duration:   int(album.DurationCached / 1000),
+		Version:    editionVersion(album),
 	}
 	if album.ReleaseDate != nil {
 		a.Year = album.ReleaseDate.Year()
@@ -462,5 +433,6 @@ func (h *BrowsingHandler) convertTrackToChild(track models.Track) utils.Child {
 		ContentType: getContentType(track.FileName),
 		Suffix:      getSuffix(track.FileName),
 		Path:        track.RelativePath,
+		ReplayGain:  replayGain(track),
 	}
 }
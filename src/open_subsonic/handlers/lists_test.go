@@ -39,6 +39,8 @@ func getListsTestDB() *gorm.DB {
 	// Manually create tables for SQLite to avoid Postgres-specific syntax issues in AutoMigrate
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -73,12 +75,17 @@ func getListsTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		artist_id INTEGER,
 		track_count_cached INTEGER DEFAULT 0,
@@ -108,12 +115,22 @@ func getListsTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -153,6 +170,7 @@ func getListsTestDB() *gorm.DB {
 		user_id INTEGER,
 		album_id INTEGER,
 		is_starred BOOLEAN DEFAULT 0,
+		is_hated BOOLEAN DEFAULT 0,
 		starred_at DATETIME,
 		created_at DATETIME,
 		updated_at DATETIME
@@ -163,11 +181,59 @@ func getListsTestDB() *gorm.DB {
 		user_id INTEGER,
 		artist_id INTEGER,
 		is_starred BOOLEAN DEFAULT 0,
+		is_hated BOOLEAN DEFAULT 0,
 		starred_at DATETIME,
 		created_at DATETIME,
 		updated_at DATETIME
 	)`)
 
+	db.Exec(`CREATE TABLE play_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		player_id INTEGER,
+		client TEXT,
+		played_at DATETIME NOT NULL,
+		duration_played INTEGER NOT NULL DEFAULT 0,
+		source TEXT NOT NULL,
+		created_at DATETIME
+	)`)
+
+	db.Exec(`CREATE TABLE track_play_stats (
+		user_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		day DATE NOT NULL,
+		play_count INTEGER NOT NULL DEFAULT 0,
+		duration_played INTEGER NOT NULL DEFAULT 0,
+		last_played_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, track_id, day)
+	)`)
+
+	db.Exec(`CREATE TABLE now_playing (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		player_id INTEGER,
+		client TEXT NOT NULL,
+		track_id INTEGER NOT NULL,
+		started_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		UNIQUE(user_id, client)
+	)`)
+
+	db.Exec(`CREATE TABLE similar_artists (
+		artist_id INTEGER NOT NULL,
+		similar_artist_id INTEGER NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY (artist_id, similar_artist_id)
+	)`)
+
+	db.Exec(`CREATE TABLE similar_tracks (
+		track_id INTEGER NOT NULL,
+		similar_track_id INTEGER NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY (track_id, similar_track_id)
+	)`)
+
 	return db
 }
 
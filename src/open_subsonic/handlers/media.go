@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,12 +9,18 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
+	"melodee/internal/artwork"
+	"melodee/internal/config"
+	"melodee/internal/directory"
+	"melodee/internal/loudness"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/podcast"
 	"melodee/open_subsonic/utils"
 )
 
@@ -22,6 +29,8 @@ type MediaHandler struct {
 	db               *gorm.DB
 	cfg              interface{} // Placeholder for config
 	transcodeService *media.TranscodeService
+	paths            *directory.LibraryPathResolver
+	artwork          *artwork.Service
 }
 
 // NewMediaHandler creates a new media handler
@@ -30,11 +39,24 @@ func NewMediaHandler(db *gorm.DB, cfg interface{}, transcodeService *media.Trans
 		db:               db,
 		cfg:              cfg,
 		transcodeService: transcodeService,
+		paths:            directory.NewLibraryPathResolver(db, nil),
 	}
 }
 
+// WithArtwork serves the recorded images of albums and artists, resized to
+// the size getCoverArt asks for
+func (h *MediaHandler) WithArtwork(images *artwork.Service) *MediaHandler {
+	h.artwork = images
+	return h
+}
+
 // Stream handles audio streaming
 func (h *MediaHandler) Stream(c *fiber.Ctx) error {
+	// Downloaded podcast episodes have their own stream ids
+	if episodeID, ok := strings.CutPrefix(c.Query("id"), "pe-"); ok {
+		return h.streamPodcastEpisode(c, episodeID)
+	}
+
 	id := c.QueryInt("id", -1)
 	if id <= 0 {
 		return utils.SendOpenSubsonicError(c, 10, "Missing required parameter id")
@@ -49,39 +71,42 @@ func (h *MediaHandler) Stream(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve song")
 	}
 
-	// Check if file exists on disk
-	// In a real implementation, we would look up the file path from the database
-	// For demo purposes, we'll try to construct the path
-	storagePath := "/melodee/storage" // Default from spec
-	fullPath := filepath.Join(storagePath, song.RelativePath)
+	return h.streamSong(c, song, resolvePlayer(h.db, c))
+}
+
+// streamSong streams a song's file, transcoded as the request and the
+// player's settings require. The player may be nil.
+func (h *MediaHandler) streamSong(c *fiber.Ctx, song models.Track, player *models.Player) error {
+	// Resolve the file through the library the song lives in
+	fullPath, err := h.paths.TrackPath(&song)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 70, "File not found")
+	}
 
 	// Check if file exists
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
 		return utils.SendOpenSubsonicError(c, 70, "File not found")
 	}
 
+	// Apply transcoding if required by the request or the player's settings
+	maxBitRate := c.QueryInt("maxBitRate", 0)
+	format := strings.ToLower(c.Query("format", ""))
+	timeOffset := c.QueryInt("timeOffset", 0)
+
+	if profile, bitRate := h.selectTranscodeProfile(song, fullPath, format, maxBitRate, player); profile != "" {
+		return h.streamTranscoded(c, song, fullPath, profile, bitRate, timeOffset)
+	}
+	if song.IsSegment() {
+		// The file holds the rest of the track's cue sheet too
+		return utils.SendOpenSubsonicError(c, 0, "Transcoding is required to stream this song")
+	}
+
 	// Handle range requests for partial content
 	rangeHeader := c.Get("Range")
 	if rangeHeader != "" {
 		return h.handleRangeRequest(c, fullPath, song)
 	}
 
-	// Apply transcoding if required
-	maxBitRate := c.QueryInt("maxBitRate", 0)
-	format := c.Query("format", "")
-	
-	if maxBitRate > 0 || format != "" {
-		// In a real implementation, we would use FFmpeg transcoding
-		// Here's a placeholder for transcoding functionality:
-		transcodedPath, err := h.transcodeFile(fullPath, maxBitRate, format)
-		if err != nil {
-			return utils.SendOpenSubsonicError(c, 0, "Transcoding failed: "+err.Error())
-		}
-		if transcodedPath != "" {
-			return c.SendFile(transcodedPath)
-		}
-	}
-
 	// Add ETag and Last-Modified headers for caching
 	if fileInfo, err := os.Stat(fullPath); err == nil {
 		etag := fmt.Sprintf(`"%x"`, fileInfo.ModTime().Unix())
@@ -115,9 +140,16 @@ func (h *MediaHandler) Download(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve song")
 	}
 
-	// Check if file exists on disk
-	storagePath := "/melodee/storage"
-	fullPath := filepath.Join(storagePath, song.RelativePath)
+	return h.downloadSong(c, song)
+}
+
+// downloadSong sends a song's file as an attachment
+func (h *MediaHandler) downloadSong(c *fiber.Ctx, song models.Track) error {
+	// Resolve the file through the library the song lives in
+	fullPath, err := h.paths.TrackPath(&song)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 70, "File not found")
+	}
 
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
 		return utils.SendOpenSubsonicError(c, 70, "File not found")
@@ -136,6 +168,20 @@ func (h *MediaHandler) Download(c *fiber.Ctx) error {
 		}
 	}
 
+	// A cue sheet track is cut out of its file, in the file's format when a profile produces it
+	if song.IsSegment() {
+		profile, _ := h.selectTranscodeProfile(song, fullPath, "raw", 0, nil)
+		if profile == "" {
+			return utils.SendOpenSubsonicError(c, 0, "Transcoding is required to download this song")
+		}
+		suffix := getSuffix(fullPath)
+		if format, err := h.transcodeService.ProfileStreamFormat(profile); err == nil {
+			suffix = format.Suffix
+		}
+		c.Set("Content-Disposition", "attachment; filename="+strconv.Quote(song.Name+"."+suffix))
+		return h.streamTranscoded(c, song, fullPath, profile, 0, 0)
+	}
+
 	// Set content disposition for download
 	c.Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(fullPath)))
 
@@ -152,8 +198,6 @@ func (h *MediaHandler) GetCoverArt(c *fiber.Ctx) error {
 
 	// Check if it's an album or artist cover art request
 	// The ID format is typically "al-<albumId>" or "ar-<artistId>"
-	var coverPath string
-	
 	if strings.HasPrefix(id, "al-") {
 		// Album cover art request
 		albumID := strings.TrimPrefix(id, "al-")
@@ -164,17 +208,14 @@ func (h *MediaHandler) GetCoverArt(c *fiber.Ctx) error {
 
 		// Get the album and find its cover art
 		var album models.Album
-		if err := h.db.First(&album, albumIDInt).Error; err != nil {
+		if err := h.db.Preload("Artist").First(&album, albumIDInt).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				return utils.SendOpenSubsonicError(c, 70, "Album not found")
 			}
 			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
 		}
 
-		// In a real implementation, we'd look for cover.jpg in the album directory
-		// For demo purposes, we'll construct a path
-		storagePath := "/melodee/storage"
-		coverPath = filepath.Join(storagePath, filepath.Dir(album.Directory), "cover.jpg")
+		return h.sendAlbumCover(c, album)
 	} else if strings.HasPrefix(id, "ar-") {
 		// Artist cover art request
 		artistID := strings.TrimPrefix(id, "ar-")
@@ -192,30 +233,65 @@ func (h *MediaHandler) GetCoverArt(c *fiber.Ctx) error {
 			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve artist")
 		}
 
-		// For artist covers, we may need to get the first album's cover or a dedicated artist image
-		// In this simplified version, we'll look for a default artist image
-		// This would be implemented based on system configuration
-		coverPath = filepath.Join("/melodee/storage", artist.DirectoryCode, artist.Name, "folder.jpg")
+		if h.artwork != nil {
+			path, info, err := h.artwork.ArtistImage(c.UserContext(), &artist)
+			if err == nil {
+				return h.sendImage(c, path, info)
+			}
+			if !errors.Is(err, artwork.ErrNoImage) {
+				return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve cover art")
+			}
+		}
+
+		// Artist images live in the artist directory, next to the album directories
+		artistDir, err := h.paths.ArtistDirectory(&artist)
+		if err != nil {
+			return utils.SendOpenSubsonicError(c, 70, "Cover art not found")
+		}
+		return h.sendCoverArt(c, filepath.Join(artistDir, "folder.jpg"))
 	} else {
 		// If no prefix, assume it's just the album ID
 		albumID, err := strconv.Atoi(id)
 		if err == nil {
 			// Get the album and find its cover art
 			var album models.Album
-			if err := h.db.First(&album, albumID).Error; err != nil {
+			if err := h.db.Preload("Artist").First(&album, albumID).Error; err != nil {
 				if err == gorm.ErrRecordNotFound {
 					return utils.SendOpenSubsonicError(c, 70, "Album not found")
 				}
 				return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve album")
 			}
 
-			storagePath := "/melodee/storage"
-			coverPath = filepath.Join(storagePath, filepath.Dir(album.Directory), "cover.jpg")
+			return h.sendAlbumCover(c, album)
 		} else {
 			return utils.SendOpenSubsonicError(c, 10, "Invalid id format")
 		}
 	}
+}
 
+// sendAlbumCover sends an album's primary image, or the cover image in its
+// directory when it has none recorded
+func (h *MediaHandler) sendAlbumCover(c *fiber.Ctx, album models.Album) error {
+	if h.artwork != nil {
+		path, info, err := h.artwork.AlbumImage(c.UserContext(), &album)
+		if err == nil {
+			return h.sendImage(c, path, info)
+		}
+		if !errors.Is(err, artwork.ErrNoImage) {
+			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve cover art")
+		}
+	}
+
+	albumDir, err := h.paths.AlbumDirectory(&album)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 70, "Cover art not found")
+	}
+	return h.sendCoverArt(c, filepath.Join(albumDir, "cover.jpg"))
+}
+
+// sendCoverArt sends a cover image, or folder.jpg or front.jpg next to it
+// when it doesn't exist
+func (h *MediaHandler) sendCoverArt(c *fiber.Ctx, coverPath string) error {
 	// Check if cover art file exists
 	if _, err := os.Stat(coverPath); os.IsNotExist(err) {
 		// If the specific cover doesn't exist, try alternative names
@@ -238,6 +314,13 @@ func (h *MediaHandler) GetCoverArt(c *fiber.Ctx) error {
 		}
 	}
 
+	// Images that can be decoded can be resized too
+	if h.artwork != nil && c.QueryInt("size", 0) > 0 {
+		if info, err := artwork.InspectFile(coverPath); err == nil {
+			return h.sendImage(c, coverPath, info)
+		}
+	}
+
 	// Add ETag and Last-Modified headers for caching
 	if fileInfo, err := os.Stat(coverPath); err == nil {
 		etag := fmt.Sprintf(`"%x"`, fileInfo.ModTime().Unix())
@@ -254,6 +337,28 @@ func (h *MediaHandler) GetCoverArt(c *fiber.Ctx) error {
 	return c.SendFile(coverPath)
 }
 
+// sendImage sends an image, or a variant of it no larger than the size
+// parameter, in WebP when the client accepts it
+func (h *MediaHandler) sendImage(c *fiber.Ctx, path string, info artwork.Info) error {
+	webp := strings.Contains(c.Get("Accept"), "image/webp")
+	variant, err := h.artwork.Variant(path, info, c.QueryInt("size", 0), webp)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to resize cover art")
+	}
+
+	c.Set("Vary", "Accept")
+	c.Set("ETag", variant.ETag)
+	c.Set("Cache-Control", "public, max-age=86400")
+	if c.Get("If-None-Match") == variant.ETag {
+		return c.SendStatus(304) // Not modified
+	}
+	if err := c.SendFile(variant.Path); err != nil {
+		return err
+	}
+	c.Set("Content-Type", variant.ContentType)
+	return nil
+}
+
 // GetAvatar returns user avatar
 func (h *MediaHandler) GetAvatar(c *fiber.Ctx) error {
 	username := c.Query("username", "")
@@ -306,52 +411,165 @@ func (h *MediaHandler) GetAvatar(c *fiber.Ctx) error {
 	return c.SendFile(avatarPath)
 }
 
-// transcodeFile handles transcoding using FFmpeg with caching
-func (h *MediaHandler) transcodeFile(filePath string, maxBitRate int, format string) (string, error) {
-	// Use the transcode service if available
-	if h.transcodeService == nil {
-		// Fallback to original behavior if no transcode service is configured
-		fmt.Printf("No transcode service configured, returning original file: %s\n", filePath)
-		return filePath, nil
+// resolvePlayer finds (or registers) the player for the requesting user and
+// client name (the "c" parameter), so per-player transcoding settings apply
+// and plays can be attributed to it
+func resolvePlayer(db *gorm.DB, c *fiber.Ctx) *models.Player {
+	user, ok := utils.GetUserFromContext(c)
+	client := c.Query("c", "")
+	if !ok || client == "" {
+		return nil
 	}
 
-	// Determine the best profile based on maxBitRate
-	profileName := "transcode_mid" // Default profile
-	if maxBitRate > 0 {
-		if maxBitRate > 256 {
-			profileName = "transcode_high"
-		} else if maxBitRate < 128 {
-			profileName = "transcode_opus_mobile"
+	var player models.Player
+	err := db.Where("user_id = ? AND client = ?", user.ID, client).First(&player).Error
+	if err == gorm.ErrRecordNotFound {
+		player = models.Player{
+			Name:            client,
+			Client:          client,
+			UserID:          user.ID,
+			UserAgent:       c.Get("User-Agent"),
+			IPAddress:       c.IP(),
+			LastSeenAt:      time.Now(),
+			ScrobbleEnabled: true,
 		}
-	} else {
-		// If maxBitRate is 0 or negative, use default
-		maxBitRate = 192 // Default bitrate
+		if err := db.Create(&player).Error; err != nil {
+			return nil
+		}
+		return &player
+	}
+	if err != nil {
+		return nil
+	}
+
+	db.Model(&player).Updates(map[string]interface{}{"last_seen_at": time.Now(), "ip_address": c.IP()})
+	return &player
+}
+
+// selectTranscodeProfile decides whether a stream is transcoded. It returns
+// the FFmpeg profile and bitrate cap to use, or an empty profile to send the
+// original file.
+func (h *MediaHandler) selectTranscodeProfile(song models.Track, filePath, format string, maxBitRate int, player *models.Player) (string, int) {
+	// A cue sheet track has no file of its own to send, raw or otherwise
+	if h.transcodeService == nil || (format == "raw" && !song.IsSegment()) {
+		return "", 0
+	}
+
+	// The player's limit caps whatever the client asks for
+	if player != nil && player.MaxBitrate > 0 && (maxBitRate <= 0 || int(player.MaxBitrate) < maxBitRate) {
+		maxBitRate = int(player.MaxBitrate)
+	}
+	if maxBitRate < 0 {
+		maxBitRate = 0
+	}
+
+	// A profile configured for the player wins over format based selection
+	if player != nil && player.TranscodingID != "" && h.transcodeService.HasProfile(player.TranscodingID) {
+		return player.TranscodingID, maxBitRate
 	}
 
-	// If format is empty, try to determine from file extension
-	if format == "" {
-		ext := strings.ToLower(filepath.Ext(filePath))
-		switch ext {
-		case ".mp3":
-			format = "mp3"
-		case ".flac":
-			format = "flac"
-		case ".ogg", ".opus":
-			format = "opus"
-		case ".m4a":
-			format = "m4a"
-		default:
-			format = "mp3" // Default format
+	// The original already satisfies the request
+	sourceFormat := strings.ToLower(getSuffix(filePath))
+	withinBitRate := maxBitRate == 0 || (song.BitRate > 0 && int(song.BitRate) <= maxBitRate)
+	if withinBitRate && (format == "" || format == "raw" || format == sourceFormat) {
+		if !song.IsSegment() {
+			return "", 0
 		}
+		// Cut the track out in the format of its file if a profile produces it
+		if profile := h.transcodeService.ProfileForSuffix(sourceFormat); profile != "" {
+			return profile, maxBitRate
+		}
+	}
+	if format == "raw" {
+		format = ""
 	}
 
-	// Use cached transcoding
-	outputPath, err := h.transcodeService.TranscodeWithCache(filePath, profileName, maxBitRate, format)
+	switch format {
+	case "", "mp3":
+		if format == "" && maxBitRate > 0 && maxBitRate < 128 {
+			return "transcode_opus_mobile", maxBitRate
+		}
+		if maxBitRate == 0 || maxBitRate > 256 {
+			return "transcode_high", maxBitRate
+		}
+		return "transcode_mid", maxBitRate
+	default:
+		// Any other format is served by a profile whose encoder produces it
+		if profile := h.transcodeService.ProfileForSuffix(format); profile != "" {
+			return profile, maxBitRate
+		}
+		return "", 0
+	}
+}
+
+// streamTranscoded pipes ffmpeg output to the client while it is produced
+func (h *MediaHandler) streamTranscoded(c *fiber.Ctx, song models.Track, filePath, profile string, maxBitRate, timeOffset int) error {
+	stream, err := h.transcodeService.Stream(filePath, media.StreamOptions{
+		Profile:    profile,
+		MaxBitRate: maxBitRate,
+		TimeOffset: timeOffset,
+		Gain:       h.transcodeGain(&song),
+		Start:      time.Duration(song.StartOffset) * time.Millisecond,
+		End:        time.Duration(song.EndOffset) * time.Millisecond,
+	})
 	if err != nil {
-		return "", fmt.Errorf("transcoding failed: %w", err)
+		return utils.SendOpenSubsonicError(c, 0, "Transcoding failed: "+err.Error())
+	}
+
+	c.Set("Content-Type", stream.Format.ContentType)
+	// Transcoded output has no stable byte offsets
+	c.Set("Accept-Ranges", "none")
+
+	// Clients that need a length up front get an estimate from duration and bitrate
+	size := -1
+	if c.QueryBool("estimateContentLength", false) && maxBitRate > 0 && song.Duration > 0 {
+		remaining := song.Duration/1000 - int64(timeOffset)
+		if remaining > 0 {
+			size = int(remaining * int64(maxBitRate) * 1000 / 8)
+		}
+	}
+
+	// The body stream is closed by fasthttp once sent or when the client disconnects
+	return c.SendStream(stream, size)
+}
+
+// transcodeGain returns the ReplayGain to apply while transcoding a track, per
+// the loudness transcode_gain setting
+func (h *MediaHandler) transcodeGain(song *models.Track) float64 {
+	cfg, ok := h.cfg.(*config.AppConfig)
+	if !ok || cfg == nil {
+		return 0
+	}
+	return loudness.PlaybackGain(song, cfg.Loudness.TranscodeGain)
+}
+
+// streamPodcastEpisode serves a downloaded podcast episode from the podcast library
+func (h *MediaHandler) streamPodcastEpisode(c *fiber.Ctx, episodeID string) error {
+	id, err := strconv.ParseInt(episodeID, 10, 64)
+	if err != nil || id <= 0 {
+		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
 	}
 
-	return outputPath, nil
+	var episode models.PodcastEpisode
+	if err := h.db.First(&episode, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return utils.SendOpenSubsonicError(c, 70, "Podcast episode not found")
+		}
+		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve podcast episode")
+	}
+
+	fullPath, err := podcast.EpisodePath(h.paths, &episode)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 70, "Podcast episode has not been downloaded")
+	}
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return utils.SendOpenSubsonicError(c, 70, "File not found")
+	}
+
+	if c.Get("Range") != "" {
+		return h.handleRangeRequest(c, fullPath, models.Track{})
+	}
+	return c.SendFile(fullPath)
 }
 
 // handleRangeRequest handles HTTP range requests for partial content
@@ -1,11 +1,21 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 
+	"melodee/internal/artwork"
 	"melodee/internal/config"
+	"melodee/internal/media"
 	"melodee/internal/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -23,6 +33,8 @@ func getMediaTestDB() *gorm.DB {
 	// Manually create tables for SQLite to avoid Postgres-specific syntax issues in AutoMigrate
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -36,6 +48,19 @@ func getMediaTestDB() *gorm.DB {
 		api_key TEXT
 	)`)
 
+	db.Exec(`CREATE TABLE libraries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		path TEXT,
+		type TEXT,
+		is_locked BOOLEAN DEFAULT 0,
+		is_watched BOOLEAN DEFAULT 0,
+		created_at DATETIME,
+		track_count INTEGER DEFAULT 0,
+		album_count INTEGER DEFAULT 0,
+		duration INTEGER DEFAULT 0
+	)`)
+
 	db.Exec(`CREATE TABLE artists (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT,
@@ -57,12 +82,17 @@ func getMediaTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		artist_id INTEGER,
 		track_count_cached INTEGER DEFAULT 0,
@@ -92,12 +122,22 @@ func getMediaTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -118,6 +158,22 @@ func getMediaTestDB() *gorm.DB {
 		api_key TEXT
 	)`)
 
+	db.Exec(`CREATE TABLE images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		album_id INTEGER,
+		artist_id INTEGER,
+		type TEXT NOT NULL,
+		source TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		width INTEGER,
+		height INTEGER,
+		file_size INTEGER,
+		checksum TEXT,
+		is_primary BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`)
+
 	return db
 }
 
@@ -275,3 +331,147 @@ assert.NoError(t, err)
 assert.NotEqual(t, http.StatusUnauthorized, resp.StatusCode)
 assert.NotEqual(t, http.StatusForbidden, resp.StatusCode)
 }
+
+func TestMediaHandler_SelectTranscodeProfile(t *testing.T) {
+	processor := media.NewFFmpegProcessor(media.DefaultFFmpegConfig())
+	transcodeService := media.NewTranscodeService(processor, t.TempDir(), 1024*1024)
+	mediaHandler := NewMediaHandler(nil, &config.AppConfig{}, transcodeService)
+
+	flac := models.Track{BitRate: 900}
+	mp3 := models.Track{BitRate: 192}
+	cueTrack := models.Track{BitRate: 900, StartOffset: 1000, EndOffset: 2000}
+
+	tests := []struct {
+		name        string
+		song        models.Track
+		path        string
+		format      string
+		maxBitRate  int
+		player      *models.Player
+		wantProfile string
+		wantBitRate int
+	}{
+		{"original within limits", mp3, "song.mp3", "", 0, nil, "", 0},
+		{"raw requested", flac, "song.flac", "raw", 128, nil, "", 0},
+		{"same format requested", flac, "song.flac", "flac", 0, nil, "", 0},
+		{"mp3 without a cap", flac, "song.flac", "mp3", 0, nil, "transcode_high", 0},
+		{"mp3 capped", flac, "song.flac", "mp3", 192, nil, "transcode_mid", 192},
+		{"low cap prefers opus", flac, "song.flac", "", 96, nil, "transcode_opus_mobile", 96},
+		{"opus by suffix", flac, "song.flac", "opus", 0, nil, "transcode_opus_mobile", 0},
+		{"unknown format served raw", flac, "song.flac", "wma", 0, nil, "", 0},
+		{"player cap applies", flac, "song.flac", "", 0, &models.Player{MaxBitrate: 192}, "transcode_mid", 192},
+		{"player profile wins", mp3, "song.mp3", "", 0, &models.Player{TranscodingID: "transcode_opus_mobile"}, "transcode_opus_mobile", 0},
+		{"unknown player profile ignored", mp3, "song.mp3", "", 0, &models.Player{TranscodingID: "missing"}, "", 0},
+		{"cue track cut losslessly", cueTrack, "image.flac", "", 0, nil, "transcode_lossless", 0},
+		{"cue track raw requested", cueTrack, "image.flac", "raw", 0, nil, "transcode_lossless", 0},
+		{"cue track without a lossless profile", cueTrack, "image.ape", "raw", 0, nil, "transcode_high", 0},
+		{"cue track capped", cueTrack, "image.flac", "mp3", 192, nil, "transcode_mid", 192},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, bitRate := mediaHandler.selectTranscodeProfile(tt.song, tt.path, tt.format, tt.maxBitRate, tt.player)
+			assert.Equal(t, tt.wantProfile, profile)
+			assert.Equal(t, tt.wantBitRate, bitRate)
+		})
+	}
+}
+
+func TestMediaHandler_ResolvesLibraryPaths(t *testing.T) {
+	db := getMediaTestDB()
+	mediaHandler := NewMediaHandler(db, &config.AppConfig{}, nil)
+
+	app := fiber.New()
+	app.Get("/rest/stream", mediaHandler.Stream)
+	app.Get("/rest/download", mediaHandler.Download)
+	app.Get("/rest/getCoverArt", mediaHandler.GetCoverArt)
+
+	// A second production library, so the default library is not the one used
+	db.Create(&models.Library{Name: "Production 1", Path: t.TempDir(), Type: "production"})
+	libraryRoot := t.TempDir()
+	library := models.Library{Name: "Production 2", Path: libraryRoot, Type: "production"}
+	db.Create(&library)
+
+	albumDir := filepath.Join("AB", "Library Artist", "2020 - Library Album")
+	assert.NoError(t, os.MkdirAll(filepath.Join(libraryRoot, albumDir), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(libraryRoot, albumDir, "01 Song.mp3"), []byte("audio"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(libraryRoot, albumDir, "cover.jpg"), []byte("cover"), 0644))
+
+	artist := models.Artist{Name: "Library Artist", DirectoryCode: "AB"}
+	db.Create(&artist)
+	album := models.Album{Name: "Library Album", ArtistID: artist.ID, LibraryID: &library.ID, Directory: albumDir}
+	db.Create(&album)
+	track := models.Track{
+		Name:         "Song",
+		AlbumID:      album.ID,
+		ArtistID:     artist.ID,
+		LibraryID:    &library.ID,
+		RelativePath: filepath.Join(albumDir, "01 Song.mp3"),
+	}
+	db.Create(&track)
+
+	get := func(url string) string {
+		resp, err := app.Test(httptest.NewRequest("GET", url, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	trackID := strconv.FormatInt(track.ID, 10)
+	assert.Equal(t, "audio", get("/rest/stream?id="+trackID))
+	assert.Equal(t, "audio", get("/rest/download?id="+trackID))
+	assert.Equal(t, "cover", get("/rest/getCoverArt?id=al-"+strconv.FormatInt(album.ID, 10)))
+}
+
+func TestMediaHandler_GetCoverArtSize(t *testing.T) {
+	db := getMediaTestDB()
+	images := artwork.NewService(db, artwork.NewCache(config.ArtworkConfig{CacheDir: t.TempDir(), MaxSize: 2048, Quality: 85}, nil))
+	mediaHandler := NewMediaHandler(db, &config.AppConfig{}, nil).WithArtwork(images)
+
+	app := fiber.New()
+	app.Get("/rest/getCoverArt", mediaHandler.GetCoverArt)
+
+	library := models.Library{Name: "Artwork", Path: t.TempDir(), Type: "production"}
+	db.Create(&library)
+	artist := models.Artist{Name: "Artwork Artist", DirectoryCode: "AR"}
+	db.Create(&artist)
+	album := models.Album{Name: "Artwork Album", ArtistID: artist.ID, LibraryID: &library.ID, Directory: "AR/Artwork Artist/Artwork Album"}
+	db.Create(&album)
+
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 600, 300)), nil))
+	_, err := images.SaveAlbumImage(context.Background(), &album, models.ImageTypeFront, 0, buf.Bytes())
+	assert.NoError(t, err)
+
+	get := func(url, etag string) *http.Response {
+		req := httptest.NewRequest("GET", url, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	id := "al-" + strconv.FormatInt(album.ID, 10)
+
+	// Without a size the uploaded image is served as it is
+	resp := get("/rest/getCoverArt?id="+id, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, buf.Bytes(), body)
+
+	// Sizes are rounded up to the next variant size
+	resp = get("/rest/getCoverArt?id="+id+"&size=100", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+	resized, _, err := image.DecodeConfig(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 128, resized.Width)
+	assert.Equal(t, 64, resized.Height)
+
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	resp = get("/rest/getCoverArt?id="+id+"&size=128", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
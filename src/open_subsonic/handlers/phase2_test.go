@@ -1,13 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"melodee/internal/config"
+	"melodee/internal/lyrics"
 	"melodee/internal/models"
+	"melodee/internal/scrobble"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -39,6 +47,8 @@ func getPhase2TestDB() *gorm.DB {
 	// Manually create tables for SQLite to avoid Postgres-specific syntax issues in AutoMigrate
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -73,12 +83,17 @@ func getPhase2TestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		artist_id INTEGER,
 		track_count_cached INTEGER DEFAULT 0,
@@ -108,12 +123,22 @@ func getPhase2TestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -153,6 +178,7 @@ func getPhase2TestDB() *gorm.DB {
 		user_id INTEGER,
 		album_id INTEGER,
 		is_starred BOOLEAN DEFAULT 0,
+		is_hated BOOLEAN DEFAULT 0,
 		starred_at DATETIME,
 		created_at DATETIME,
 		updated_at DATETIME
@@ -163,11 +189,112 @@ func getPhase2TestDB() *gorm.DB {
 		user_id INTEGER,
 		artist_id INTEGER,
 		is_starred BOOLEAN DEFAULT 0,
+		is_hated BOOLEAN DEFAULT 0,
 		starred_at DATETIME,
 		created_at DATETIME,
 		updated_at DATETIME
 	)`)
 
+	db.Exec(`CREATE TABLE play_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		player_id INTEGER,
+		client TEXT,
+		played_at DATETIME NOT NULL,
+		duration_played INTEGER NOT NULL DEFAULT 0,
+		source TEXT NOT NULL,
+		created_at DATETIME
+	)`)
+
+	db.Exec(`CREATE TABLE track_play_stats (
+		user_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		day DATE NOT NULL,
+		play_count INTEGER NOT NULL DEFAULT 0,
+		duration_played INTEGER NOT NULL DEFAULT 0,
+		last_played_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, track_id, day)
+	)`)
+
+	db.Exec(`CREATE TABLE now_playing (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		player_id INTEGER,
+		client TEXT NOT NULL,
+		track_id INTEGER NOT NULL,
+		started_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		UNIQUE(user_id, client)
+	)`)
+
+	db.Exec(`CREATE TABLE players (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		user_agent TEXT,
+		user_id INTEGER NOT NULL,
+		client TEXT NOT NULL,
+		ip_address TEXT,
+		last_seen_at DATETIME NOT NULL,
+		max_bitrate INTEGER DEFAULT 0,
+		scrobble_enabled BOOLEAN DEFAULT 1,
+		transcoding_id TEXT,
+		hostname TEXT,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`)
+
+	db.Exec(`CREATE TABLE scrobbler_accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		service TEXT NOT NULL,
+		username TEXT,
+		encrypted_session TEXT NOT NULL,
+		enabled BOOLEAN DEFAULT 1,
+		last_error TEXT,
+		last_submitted_at DATETIME,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE(user_id, service)
+	)`)
+
+	db.Exec(`CREATE TABLE scrobble_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		track_id INTEGER NOT NULL,
+		played_at DATETIME NOT NULL,
+		created_at DATETIME
+	)`)
+
+	db.Exec(`CREATE TABLE similar_artists (
+		artist_id INTEGER NOT NULL,
+		similar_artist_id INTEGER NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY (artist_id, similar_artist_id)
+	)`)
+
+	db.Exec(`CREATE TABLE similar_tracks (
+		track_id INTEGER NOT NULL,
+		similar_track_id INTEGER NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY (track_id, similar_track_id)
+	)`)
+
+	db.Exec(`CREATE TABLE lyrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		track_id INTEGER NOT NULL,
+		lang TEXT NOT NULL DEFAULT 'xxx',
+		synced BOOLEAN NOT NULL DEFAULT 0,
+		offset INTEGER NOT NULL DEFAULT 0,
+		display_artist TEXT,
+		display_title TEXT,
+		lines TEXT NOT NULL DEFAULT '[]',
+		source TEXT NOT NULL,
+		created_at DATETIME,
+		updated_at DATETIME,
+		UNIQUE (track_id, lang, synced)
+	)`)
+
 	return db
 }
 
@@ -225,6 +352,89 @@ func TestUserHandler_Scrobble(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
+func TestUserHandler_ScrobbleRecordsPlays(t *testing.T) {
+	db := getPhase2TestDB()
+	userHandler := NewUserHandler(db)
+	browsingHandler := NewBrowsingHandler(db)
+	app := setupPhase2TestApp(browsingHandler, userHandler)
+
+	app.Post("/rest/scrobble", userHandler.Scrobble)
+
+	track := models.Track{Name: "Scrobbled Song", Duration: 180000}
+	db.Create(&track)
+
+	// A now playing notification is not a play
+	req := httptest.NewRequest("POST", fmt.Sprintf("/rest/scrobble?id=%d&submission=false", track.ID), nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var playing, events int64
+	db.Model(&models.NowPlaying{}).Where("track_id = ?", track.ID).Count(&playing)
+	db.Model(&models.PlayEvent{}).Where("track_id = ?", track.ID).Count(&events)
+	assert.Equal(t, int64(1), playing)
+	assert.Zero(t, events)
+
+	// Every scrobbled id is recorded at its own time
+	playedAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	req = httptest.NewRequest("POST", fmt.Sprintf("/rest/scrobble?id=%d&id=%d&time=%d&time=%d",
+		track.ID, track.ID, playedAt.UnixMilli(), playedAt.Add(3*time.Minute).UnixMilli()), nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var recorded []models.PlayEvent
+	db.Where("track_id = ?", track.ID).Order("played_at").Find(&recorded)
+	if assert.Len(t, recorded, 2) {
+		assert.True(t, recorded[0].PlayedAt.Equal(playedAt))
+		assert.Equal(t, int64(180000), recorded[0].DurationPlayed)
+	}
+	db.Model(&models.NowPlaying{}).Where("track_id = ?", track.ID).Count(&playing)
+	assert.Zero(t, playing)
+}
+
+func TestUserHandler_ScrobbleQueuesForLinkedAccounts(t *testing.T) {
+	db := getPhase2TestDB()
+	scrobbles := scrobble.NewService(db, config.ScrobbleConfig{
+		ListenBrainz: config.ListenBrainzConfig{Enabled: true, Endpoint: "http://127.0.0.1:0"},
+	}, "server-key")
+	userHandler := NewUserHandler(db).WithScrobbling(scrobbles, nil)
+	app := setupPhase2TestApp(nil, userHandler)
+
+	app.Post("/rest/scrobble", userHandler.Scrobble)
+
+	track := models.Track{Name: "Forwarded Song", Duration: 200000}
+	db.Create(&track)
+	account := models.ScrobblerAccount{UserID: 1, Service: scrobble.ServiceListenBrainz, EncryptedSession: "sealed", Enabled: true}
+	db.Create(&account)
+	defer db.Where("account_id = ?", account.ID).Delete(&models.ScrobbleQueueEntry{})
+	defer db.Delete(&account)
+
+	queued := func() int64 {
+		var count int64
+		db.Model(&models.ScrobbleQueueEntry{}).Where("account_id = ? AND track_id = ?", account.ID, track.ID).Count(&count)
+		return count
+	}
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/rest/scrobble?id=%d&c=Phone", track.ID), nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(1), queued())
+
+	// Plays from a player with scrobbling turned off stay local
+	db.Model(&models.Player{}).Where("user_id = ? AND client = ?", 1, "Phone").Update("scrobble_enabled", false)
+	req = httptest.NewRequest("POST", fmt.Sprintf("/rest/scrobble?id=%d&c=Phone", track.ID), nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(1), queued())
+
+	var events int64
+	db.Model(&models.PlayEvent{}).Where("track_id = ?", track.ID).Count(&events)
+	assert.Equal(t, int64(2), events)
+}
+
 func TestBrowsingHandler_GetLyrics(t *testing.T) {
 	db := getPhase2TestDB()
 	browsingHandler := NewBrowsingHandler(db)
@@ -269,6 +479,52 @@ func TestBrowsingHandler_GetArtistInfo(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
+func TestBrowsingHandler_SimilarFromNeighborTables(t *testing.T) {
+	db := getPhase2TestDB()
+	browsingHandler := NewBrowsingHandler(db)
+	app := setupPhase2TestApp(browsingHandler, nil)
+
+	app.Get("/getArtistInfo2", browsingHandler.GetArtistInfo2)
+	app.Get("/getSimilarSongs", browsingHandler.GetSimilarSongs)
+
+	seed := models.Artist{Name: "Seed Artist"}
+	liked := models.Artist{Name: "Similar Artist"}
+	hated := models.Artist{Name: "Hated Artist"}
+	db.Create(&seed)
+	db.Create(&liked)
+	db.Create(&hated)
+	seedTrack := models.Track{Name: "Seed Song", ArtistID: int64(seed.ID)}
+	likedTrack := models.Track{Name: "Similar Song", ArtistID: int64(liked.ID)}
+	hatedTrack := models.Track{Name: "Hated Song", ArtistID: int64(hated.ID)}
+	db.Create(&seedTrack)
+	db.Create(&likedTrack)
+	db.Create(&hatedTrack)
+	db.Create([]models.SimilarArtist{
+		{ArtistID: int64(seed.ID), SimilarArtistID: int64(hated.ID), Score: 0.9},
+		{ArtistID: int64(seed.ID), SimilarArtistID: int64(liked.ID), Score: 0.5},
+	})
+	db.Create([]models.SimilarTrack{
+		{TrackID: seedTrack.ID, SimilarTrackID: hatedTrack.ID, Score: 0.9},
+		{TrackID: seedTrack.ID, SimilarTrackID: likedTrack.ID, Score: 0.5},
+	})
+	db.Exec("INSERT INTO user_artists (user_id, artist_id, is_hated) VALUES (?, ?, ?)", 1, hated.ID, true)
+
+	subResp := getSubsonicResponse(t, app, fmt.Sprintf("/getArtistInfo2?id=%d&f=json", seed.ID))
+	similar := subResp["artistInfo2"].(map[string]interface{})["similarArtist"].([]interface{})
+	if assert.Len(t, similar, 1) {
+		assert.Equal(t, "Similar Artist", similar[0].(map[string]interface{})["name"])
+	}
+
+	subResp = getSubsonicResponse(t, app, fmt.Sprintf("/getSimilarSongs?id=%d&count=1&f=json", seedTrack.ID))
+	songs := subResp["similarSongs"].(map[string]interface{})["song"].([]interface{})
+	if assert.Len(t, songs, 1) {
+		assert.Equal(t, "Similar Song", songs[0].(map[string]interface{})["title"])
+	}
+
+	subResp = getSubsonicResponse(t, app, "/getSimilarSongs?id=999999&f=json")
+	assert.Equal(t, "failed", subResp["status"])
+}
+
 func TestBrowsingHandler_GetAlbumInfo(t *testing.T) {
 	db := getPhase2TestDB()
 	browsingHandler := NewBrowsingHandler(db)
@@ -313,6 +569,55 @@ func TestUserHandler_GetUser(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 }
 
+func TestUserHandler_UpdateUserRolesAdminOnly(t *testing.T) {
+	db := getPhase2TestDB()
+	userHandler := NewUserHandler(db)
+	user := models.User{Username: "roleuser", Email: "role@example.com"}
+	require.NoError(t, db.Create(&user).Error)
+
+	// A user can't grant themselves a role
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &models.User{ID: user.ID, Username: user.Username})
+		return c.Next()
+	})
+	app.Get("/rest/updateUser", userHandler.UpdateUser)
+	app.Get("/rest/createUser", userHandler.CreateUser)
+
+	for _, query := range []string{
+		"/rest/updateUser?f=json&username=roleuser&jukeboxRole=true",
+		"/rest/updateUser?f=json&username=roleuser&adminRole=true",
+		"/rest/createUser?f=json&username=roleuser2&password=secret&jukeboxRole=true",
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", query, nil))
+		require.NoError(t, err)
+		var body map[string]map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "failed", body["subsonic-response"]["status"], query)
+		assert.EqualValues(t, 50, body["subsonic-response"]["error"].(map[string]interface{})["code"], query)
+	}
+
+	require.NoError(t, db.First(&user, user.ID).Error)
+	assert.False(t, user.JukeboxRole)
+	assert.False(t, user.IsAdmin)
+	var created int64
+	db.Model(&models.User{}).Where("username = ?", "roleuser2").Count(&created)
+	assert.Zero(t, created)
+
+	// Admins can
+	admin := fiber.New()
+	admin.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &models.User{ID: 99, Username: "admin", IsAdmin: true})
+		return c.Next()
+	})
+	admin.Get("/rest/updateUser", userHandler.UpdateUser)
+	resp, err := admin.Test(httptest.NewRequest("GET", "/rest/updateUser?f=json&username=roleuser&jukeboxRole=true", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	require.NoError(t, db.First(&user, user.ID).Error)
+	assert.True(t, user.JukeboxRole)
+}
+
 func TestBrowsingHandler_GetLyricsBySongId(t *testing.T) {
 	db := getPhase2TestDB()
 	browsingHandler := NewBrowsingHandler(db)
@@ -331,3 +636,54 @@ func TestBrowsingHandler_GetLyricsBySongId(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestBrowsingHandler_StructuredLyrics(t *testing.T) {
+	db := getPhase2TestDB()
+	browsingHandler := NewBrowsingHandler(db)
+	app := setupPhase2TestApp(browsingHandler, nil)
+
+	app.Get("/getLyrics", browsingHandler.GetLyrics)
+	app.Get("/getLyricsBySongId", browsingHandler.GetLyricsBySongId)
+
+	artist := models.Artist{Name: "Lyrics Artist"}
+	db.Create(&artist)
+	track := models.Track{Name: "Lyrics Song", ArtistID: int64(artist.ID)}
+	db.Create(&track)
+
+	service := lyrics.NewService(db)
+	_, err := service.Save(context.Background(), track.ID, lyrics.Parse("[la:eng]\n[offset:+100]\n[00:01.50]First line\n[00:04.00]Second line"), lyrics.SourceSidecar)
+	require.NoError(t, err)
+	_, err = service.Save(context.Background(), track.ID, lyrics.Parse("First line\nSecond line"), lyrics.SourceManual)
+	require.NoError(t, err)
+
+	subResp := getSubsonicResponse(t, app, fmt.Sprintf("/getLyricsBySongId?id=%d&f=json", track.ID))
+	sets := subResp["lyricsList"].(map[string]interface{})["structuredLyrics"].([]interface{})
+	require.Len(t, sets, 2)
+
+	synced := sets[0].(map[string]interface{})
+	assert.Equal(t, true, synced["synced"])
+	assert.Equal(t, "eng", synced["lang"])
+	assert.Equal(t, float64(100), synced["offset"])
+	assert.Equal(t, "Lyrics Artist", synced["displayArtist"])
+	assert.Equal(t, "Lyrics Song", synced["displayTitle"])
+	lines := synced["line"].([]interface{})
+	require.Len(t, lines, 2)
+	assert.Equal(t, float64(1500), lines[0].(map[string]interface{})["start"])
+	assert.Equal(t, "Second line", lines[1].(map[string]interface{})["value"])
+
+	unsynced := sets[1].(map[string]interface{})
+	assert.Equal(t, false, unsynced["synced"])
+	assert.Equal(t, "xxx", unsynced["lang"])
+	_, hasStart := unsynced["line"].([]interface{})[0].(map[string]interface{})["start"]
+	assert.False(t, hasStart)
+
+	// The legacy endpoint returns the unsynced lyrics as text
+	subResp = getSubsonicResponse(t, app, "/getLyrics?artist=Lyrics%20Artist&title=Lyrics%20Song&f=json")
+	assert.Equal(t, "First line\nSecond line", subResp["lyrics"].(map[string]interface{})["content"])
+
+	// A song without lyrics has an empty list
+	other := models.Track{Name: "Instrumental", ArtistID: int64(artist.ID)}
+	db.Create(&other)
+	subResp = getSubsonicResponse(t, app, fmt.Sprintf("/getLyricsBySongId?id=%d&f=json", other.ID))
+	assert.Empty(t, subResp["lyricsList"].(map[string]interface{})["structuredLyrics"])
+}
@@ -23,6 +23,8 @@ func setupPhase3TestDB(t *testing.T) *gorm.DB {
 	// Users
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		password_hash TEXT,
 		email TEXT,
@@ -60,12 +62,17 @@ func setupPhase3TestDB(t *testing.T) *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0
 	)`)
 
 	// Albums
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		name_normalized TEXT,
 		artist_id INTEGER,
@@ -99,6 +106,7 @@ func setupPhase3TestDB(t *testing.T) *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		tags TEXT
 	)`)
@@ -106,6 +114,15 @@ func setupPhase3TestDB(t *testing.T) *gorm.DB {
 	// Tracks
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		name_normalized TEXT,
 		album_id INTEGER,
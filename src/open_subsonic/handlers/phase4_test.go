@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
@@ -23,6 +27,8 @@ func setupPhase4TestDB(t *testing.T) *gorm.DB {
 	// Users
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		password_hash TEXT,
 		email TEXT,
@@ -46,6 +52,8 @@ func setupPhase4TestDB(t *testing.T) *gorm.DB {
 		image_url TEXT,
 		status TEXT,
 		error_message TEXT,
+		keep_episodes INTEGER DEFAULT 0,
+		refreshed_at DATETIME,
 		created_at DATETIME,
 		updated_at DATETIME
 	)`)
@@ -55,14 +63,17 @@ func setupPhase4TestDB(t *testing.T) *gorm.DB {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		api_key TEXT,
 		channel_id INTEGER,
+		guid TEXT,
 		title TEXT,
 		description TEXT,
 		publish_date DATETIME,
 		duration INTEGER,
 		status TEXT,
 		error_message TEXT,
+		enclosure_url TEXT,
 		file_name TEXT,
 		file_size INTEGER,
+		checksum TEXT,
 		content_type TEXT,
 		created_at DATETIME,
 		updated_at DATETIME
@@ -93,7 +104,7 @@ func TestPodcastHandler_CreateAndGet(t *testing.T) {
 	db.Create(&user)
 
 	// Setup handler
-	handler := NewPodcastHandler(db)
+	handler := NewPodcastHandler(db, nil, nil)
 
 	// Mock auth middleware
 	app.Use(func(c *fiber.Ctx) error {
@@ -221,3 +232,44 @@ func TestInternetRadioHandler_CreateAndGet(t *testing.T) {
 		}
 	}
 }
+
+func TestPodcastHandler_StreamDownloadedEpisode(t *testing.T) {
+	db := setupPhase4TestDB(t)
+	db.Exec(`CREATE TABLE libraries (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, path TEXT, type TEXT)`)
+
+	libraryRoot := t.TempDir()
+	db.Exec(`INSERT INTO libraries (name, path, type) VALUES ('Podcasts', ?, 'podcast')`, libraryRoot)
+	assert.NoError(t, os.MkdirAll(filepath.Join(libraryRoot, "1"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(libraryRoot, "1", "7.mp3"), []byte("episode audio"), 0644))
+
+	channel := models.PodcastChannel{URL: "http://example.com/feed.xml", Title: "Show"}
+	db.Create(&channel)
+	downloaded := models.PodcastEpisode{ChannelID: channel.ID, GUID: "a", Title: "Downloaded", Status: "completed", FileName: filepath.Join("1", "7.mp3")}
+	db.Create(&downloaded)
+	pending := models.PodcastEpisode{ChannelID: channel.ID, GUID: "b", Title: "Pending", Status: "new"}
+	db.Create(&pending)
+
+	app := fiber.New()
+	podcastHandler := NewPodcastHandler(db, nil, nil)
+	mediaHandler := NewMediaHandler(db, nil, nil)
+	app.Get("/getPodcastEpisode", podcastHandler.GetPodcastEpisode)
+	app.Get("/stream", mediaHandler.Stream)
+
+	// Only downloaded episodes have a stream id
+	resp, err := app.Test(httptest.NewRequest("GET", fmt.Sprintf("/getPodcastEpisode?f=json&id=%d", downloaded.ID), nil))
+	assert.NoError(t, err)
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	episode := response["subsonic-response"].(map[string]interface{})["podcastEpisode"].(map[string]interface{})
+	streamID := episode["streamId"].(string)
+	assert.Equal(t, fmt.Sprintf("pe-%d", downloaded.ID), streamID)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/stream?id="+streamID, nil))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "episode audio", string(body))
+
+	resp, err = app.Test(httptest.NewRequest("GET", fmt.Sprintf("/stream?f=json&id=pe-%d", pending.ID), nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "404", resp.Header.Get("X-Status-Code"))
+}
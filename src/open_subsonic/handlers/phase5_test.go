@@ -10,6 +10,7 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"melodee/internal/jukebox"
 	"melodee/internal/models"
 )
 
@@ -23,6 +24,8 @@ func setupPhase5TestDB(t *testing.T) *gorm.DB {
 	// Users
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		password_hash TEXT,
 		email TEXT,
@@ -40,6 +43,7 @@ func setupPhase5TestDB(t *testing.T) *gorm.DB {
 	db.Exec(`CREATE TABLE shares (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER,
+		token TEXT,
 		name TEXT,
 		description TEXT,
 		expires_at DATETIME,
@@ -47,9 +51,20 @@ func setupPhase5TestDB(t *testing.T) *gorm.DB {
 		max_streaming_count INTEGER,
 		allow_streaming BOOLEAN DEFAULT 1,
 		allow_download BOOLEAN DEFAULT 0,
+		visit_count INTEGER DEFAULT 0,
+		last_visited_at DATETIME,
+		stream_count INTEGER DEFAULT 0,
+		streamed_seconds INTEGER DEFAULT 0,
 		created_at DATETIME,
 		updated_at DATETIME
 	)`)
+	db.Exec(`CREATE TABLE share_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		share_id INTEGER,
+		item_type TEXT,
+		item_id INTEGER,
+		position INTEGER
+	)`)
 
 	return db
 }
@@ -58,9 +73,17 @@ func TestSharesHandler_CreateAndGet(t *testing.T) {
 	db := setupPhase5TestDB(t)
 	app := fiber.New()
 
+	db.Exec(`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`)
+	db.Exec(`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, artist_id INTEGER)`)
+	db.Exec(`CREATE TABLE tracks (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER, sort_order INTEGER, file_name TEXT, duration INTEGER)`)
+
 	// Setup data
 	user := models.User{Username: "testuser", PasswordHash: "hash"}
 	db.Create(&user)
+	db.Exec(`INSERT INTO artists (id, name) VALUES (1, 'Test Artist')`)
+	db.Exec(`INSERT INTO albums (id, name, artist_id) VALUES (1, 'Test Album', 1)`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, artist_id, sort_order, file_name, duration) VALUES
+		(1, 'First', 1, 1, 1, 'first.mp3', 180000), (2, 'Second', 1, 1, 2, 'second.mp3', 200000)`)
 
 	// Setup handler
 	handler := NewSharesHandler(db)
@@ -98,6 +121,28 @@ func TestSharesHandler_CreateAndGet(t *testing.T) {
 	share := shareList[0].(map[string]interface{})
 	assert.Equal(t, "TestShare", share["description"])
 	assert.Equal(t, "testuser", share["username"])
+	assert.Regexp(t, `^http://example\.com/share/[A-Za-z0-9_-]{32}$`, share["url"])
+	entries := share["entry"].([]interface{})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "First", entries[0].(map[string]interface{})["title"])
+
+	// Albums are shared with all their songs
+	req = httptest.NewRequest("GET", "/createShare?id=al-1&f=json", nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	json.NewDecoder(resp.Body).Decode(&response)
+	created := response["subsonic-response"].(map[string]interface{})["shares"].(map[string]interface{})["share"].([]interface{})[0].(map[string]interface{})
+	assert.Len(t, created["entry"], 2)
+	req = httptest.NewRequest("GET", "/deleteShare?id="+created["id"].(string), nil)
+	_, err = app.Test(req)
+	assert.NoError(t, err)
+
+	// Unknown songs are rejected
+	req = httptest.NewRequest("GET", "/createShare?id=99&f=json", nil)
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	json.NewDecoder(resp.Body).Decode(&response)
+	assert.Equal(t, "failed", response["subsonic-response"].(map[string]interface{})["status"])
 
 	// Test Delete
 	id := share["id"].(string)
@@ -200,11 +245,95 @@ func TestScanHandler_GetStatus(t *testing.T) {
 func TestJukeboxHandler_Control(t *testing.T) {
 	db := setupPhase5TestDB(t)
 	app := fiber.New()
-	handler := NewJukeboxHandler(db)
-	app.Get("/jukeboxControl", handler.JukeboxControl)
+	handler := NewJukeboxHandler(db, nil)
+	app.Get("/jukeboxControl", func(c *fiber.Ctx) error {
+		c.Locals("user", &models.User{ID: 1, IsAdmin: true})
+		return handler.JukeboxControl(c)
+	})
 
 	req := httptest.NewRequest("GET", "/jukeboxControl?action=status&f=json", nil)
 	resp, err := app.Test(req)
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func setupJukeboxTestApp(t *testing.T, user *models.User) *fiber.App {
+	db := setupPhase5TestDB(t)
+	db.Exec(`CREATE TABLE libraries (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, path TEXT, type TEXT)`)
+	db.Exec(`CREATE TABLE artists (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)`)
+	db.Exec(`CREATE TABLE albums (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, library_id INTEGER, directory TEXT)`)
+	db.Exec(`CREATE TABLE tracks (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, album_id INTEGER, artist_id INTEGER, library_id INTEGER, relative_path TEXT, file_name TEXT, duration INTEGER)`)
+	db.Exec(`CREATE TABLE jukebox_entries (id INTEGER PRIMARY KEY AUTOINCREMENT, position INTEGER NOT NULL, track_id INTEGER NOT NULL)`)
+	db.Exec(`CREATE TABLE jukebox_states (id INTEGER PRIMARY KEY, current_index INTEGER DEFAULT 0, position INTEGER DEFAULT 0, gain REAL DEFAULT 0.5, playing BOOLEAN DEFAULT 0, updated_at DATETIME)`)
+
+	db.Exec(`INSERT INTO libraries (id, name, path, type) VALUES (1, 'Production', '/music', 'production')`)
+	db.Exec(`INSERT INTO albums (id, name, library_id, directory) VALUES (1, 'Album', 1, 'artist/album')`)
+	db.Exec(`INSERT INTO tracks (id, name, album_id, library_id, relative_path, file_name, duration) VALUES
+		(1, 'One', 1, 1, 'artist/album/01.flac', '01.flac', 180000),
+		(2, 'Two', 1, 1, 'artist/album/02.flac', '02.flac', 180000)`)
+
+	service, err := jukebox.NewService(db, jukebox.NewNullOutput(), nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { service.Stop() })
+
+	app := fiber.New()
+	handler := NewJukeboxHandler(db, service)
+	app.Get("/jukeboxControl", func(c *fiber.Ctx) error {
+		c.Locals("user", user)
+		return handler.JukeboxControl(c)
+	})
+	return app
+}
+
+func jukeboxRequest(t *testing.T, app *fiber.App, query string) map[string]interface{} {
+	req := httptest.NewRequest("GET", "/jukeboxControl?f=json&"+query, nil)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var response map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return response["subsonic-response"].(map[string]interface{})
+}
+
+func TestJukeboxHandler_QueueAndPlayback(t *testing.T) {
+	app := setupJukeboxTestApp(t, &models.User{ID: 1, JukeboxRole: true})
+
+	subResp := jukeboxRequest(t, app, "action=add&id=1&id=2")
+	assert.Equal(t, "ok", subResp["status"])
+
+	subResp = jukeboxRequest(t, app, "action=add&id=99")
+	assert.Equal(t, float64(70), subResp["error"].(map[string]interface{})["code"])
+
+	subResp = jukeboxRequest(t, app, "action=skip&index=1&offset=30")
+	status := subResp["jukeboxStatus"].(map[string]interface{})
+	assert.Equal(t, float64(1), status["currentIndex"])
+	assert.Equal(t, false, status["playing"])
+
+	subResp = jukeboxRequest(t, app, "action=start")
+	assert.Equal(t, true, subResp["jukeboxStatus"].(map[string]interface{})["playing"])
+
+	subResp = jukeboxRequest(t, app, "action=setGain&gain=0.25")
+	assert.InDelta(t, 0.25, subResp["jukeboxStatus"].(map[string]interface{})["gain"], 0.001)
+
+	subResp = jukeboxRequest(t, app, "action=get")
+	playlist := subResp["jukeboxPlaylist"].(map[string]interface{})
+	entries := playlist["entry"].([]interface{})
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "Two", entries[1].(map[string]interface{})["title"])
+	assert.Equal(t, true, playlist["playing"])
+
+	subResp = jukeboxRequest(t, app, "action=remove&index=0")
+	assert.Equal(t, float64(0), subResp["jukeboxStatus"].(map[string]interface{})["currentIndex"])
+
+	subResp = jukeboxRequest(t, app, "action=stop")
+	assert.Equal(t, false, subResp["jukeboxStatus"].(map[string]interface{})["playing"])
+}
+
+func TestJukeboxHandler_RequiresJukeboxRole(t *testing.T) {
+	app := setupJukeboxTestApp(t, &models.User{ID: 2})
+
+	subResp := jukeboxRequest(t, app, "action=status")
+	assert.Equal(t, "failed", subResp["status"])
+	assert.Equal(t, float64(50), subResp["error"].(map[string]interface{})["code"])
+}
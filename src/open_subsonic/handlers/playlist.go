@@ -7,13 +7,16 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 
+	"melodee/internal/logging"
 	"melodee/internal/models"
+	"melodee/internal/smartplaylist"
 	"melodee/open_subsonic/utils"
 )
 
 // PlaylistHandler handles OpenSubsonic playlist endpoints
 type PlaylistHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	smart *smartplaylist.Service
 }
 
 // NewPlaylistHandler creates a new playlist handler
@@ -23,6 +26,12 @@ func NewPlaylistHandler(db *gorm.DB) *PlaylistHandler {
 	}
 }
 
+// WithSmartPlaylists re-evaluates stale smart playlists when they are read
+func (h *PlaylistHandler) WithSmartPlaylists(smart *smartplaylist.Service) *PlaylistHandler {
+	h.smart = smart
+	return h
+}
+
 // GetPlaylists returns all playlists
 func (h *PlaylistHandler) GetPlaylists(c *fiber.Ctx) error {
 	// Get username parameter (to filter playlists)
@@ -82,6 +91,7 @@ func (h *PlaylistHandler) GetPlaylists(c *fiber.Ctx) error {
 			Created:   utils.FormatTime(playlist.CreatedAt),
 			Changed:   utils.FormatTime(playlist.ChangedAt),
 			Duration:  int(playlist.Duration / 1000), // Convert to seconds
+			Readonly:  playlist.IsSmart(),
 		}
 		
 		if playlist.CoverArtID != nil {
@@ -111,6 +121,13 @@ func (h *PlaylistHandler) GetPlaylist(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve playlist")
 	}
 
+	// Smart playlists are re-evaluated when their songs are stale
+	if playlist.IsSmart() && h.smart != nil {
+		if err := h.smart.RefreshIfStale(c.Context(), &playlist); err != nil {
+			logging.Warnf("smart playlist: failed to refresh playlist %d: %v", playlist.ID, err)
+		}
+	}
+
 	// Get the songs in the playlist
 	var playlistTracks []models.PlaylistTrack
 	if err := h.db.Preload("Track.Album").Preload("Track.Artist").Where("playlist_id = ?", id).Order("position").Find(&playlistTracks).Error; err != nil {
@@ -129,11 +146,17 @@ func (h *PlaylistHandler) GetPlaylist(c *fiber.Ctx) error {
 		Created:   utils.FormatTime(playlist.CreatedAt),
 		Changed:   utils.FormatTime(playlist.ChangedAt),
 		Duration:  int(playlist.Duration / 1000), // Convert to seconds
+		Readonly:  playlist.IsSmart(),
 	}
 	
 	if playlist.CoverArtID != nil {
 		playlistResp.CoverArtID = int(*playlist.CoverArtID)
 	}
+	if playlist.IsSmart() && h.smart != nil {
+		if validUntil := h.smart.ValidUntil(&playlist); validUntil != nil {
+			playlistResp.ValidUntil = utils.FormatTime(*validUntil)
+		}
+	}
 	
 	// Add entries (tracks) to the playlist
 	for _, playlistTrack := range playlistTracks {
@@ -155,6 +178,7 @@ func (h *PlaylistHandler) GetPlaylist(c *fiber.Ctx) error {
 			ContentType: getContentType(track.FileName),
 			Suffix:      getSuffix(track.FileName),
 			Path:        track.RelativePath,
+			ReplayGain:  replayGain(*track),
 		}
 		playlistResp.Entries = append(playlistResp.Entries, child)
 	}
@@ -187,6 +211,9 @@ func (h *PlaylistHandler) CreatePlaylist(c *fiber.Ctx) error {
 			}
 			return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve playlist")
 		}
+		if existingPlaylist.IsSmart() {
+			return utils.SendOpenSubsonicError(c, 50, "Smart playlists are read-only")
+		}
 		playlist = &existingPlaylist
 	} else {
 		// Create new playlist
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -22,6 +24,8 @@ func getPlaylistTestDB() *gorm.DB {
 	// Manually create tables for SQLite
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -46,7 +50,9 @@ func getPlaylistTestDB() *gorm.DB {
 		changed_at DATETIME,
 		duration INTEGER DEFAULT 0,
 		track_count INTEGER DEFAULT 0,
-		cover_art_id INTEGER
+		cover_art_id INTEGER,
+		rules TEXT,
+		refreshed_at DATETIME
 	)`)
 
 	db.Exec(`CREATE TABLE playlist_tracks (
@@ -59,6 +65,15 @@ func getPlaylistTestDB() *gorm.DB {
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -219,3 +234,32 @@ func TestPlaylistHandler_DeletePlaylist(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestPlaylistHandler_SmartPlaylistIsReadonly(t *testing.T) {
+	db := getPlaylistTestDB()
+	playlistHandler := NewPlaylistHandler(db)
+
+	app := fiber.New()
+	withUser := func(handler fiber.Handler) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			c.Locals("user", &models.User{ID: 1, Username: "testuser"})
+			return handler(c)
+		}
+	}
+	app.Get("/rest/getPlaylists", withUser(playlistHandler.GetPlaylists))
+	app.Get("/rest/updatePlaylist", withUser(playlistHandler.UpdatePlaylist))
+
+	playlist := models.Playlist{Name: "Smart Playlist", UserID: 1, Rules: []byte(`{"field": "starred", "op": "is", "value": true}`)}
+	db.Create(&playlist)
+
+	resp, err := app.Test(httptest.NewRequest("GET", fmt.Sprintf("/rest/updatePlaylist?playlistId=%d&name=Renamed", playlist.ID), nil))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "Smart playlists are read-only")
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/rest/getPlaylists?f=json", nil))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `"title":"Smart Playlist"`)
+	assert.Contains(t, string(body), `"readonly":true`)
+}
@@ -75,6 +75,7 @@ func (h *PlayQueueHandler) GetPlayQueue(c *fiber.Ctx) error {
 			Created:     utils.FormatTime(track.CreatedAt),
 			ContentType: "audio/mpeg", // Default
 			Suffix:      "mp3",        // Default
+			ReplayGain:  replayGain(track),
 		}
 
 		if track.Album.ReleaseDate != nil {
@@ -1,21 +1,47 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"melodee/internal/logging"
 	"melodee/internal/models"
+	"melodee/internal/podcast"
 	"melodee/open_subsonic/utils"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
 )
 
 type PodcastHandler struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	podcasts *podcast.Service
+	queue    *asynq.Client
 }
 
-func NewPodcastHandler(db *gorm.DB) *PodcastHandler {
-	return &PodcastHandler{DB: db}
+// NewPodcastHandler creates a new podcast handler. Refreshes and downloads are
+// queued through queue; without one they are left to the scheduled refresh.
+func NewPodcastHandler(db *gorm.DB, service *podcast.Service, queue *asynq.Client) *PodcastHandler {
+	return &PodcastHandler{DB: db, podcasts: service, queue: queue}
+}
+
+// episodeStreamID is the id clients pass to /rest/stream for a downloaded episode
+func episodeStreamID(ep models.PodcastEpisode) string {
+	if ep.Status != "completed" {
+		return ""
+	}
+	return fmt.Sprintf("pe-%d", ep.ID)
+}
+
+// episodeSuffix returns the file extension of a downloaded episode without the dot
+func episodeSuffix(ep models.PodcastEpisode) string {
+	if ext := strings.TrimPrefix(filepath.Ext(ep.FileName), "."); ext != "" {
+		return strings.ToLower(ext)
+	}
+	return "mp3"
 }
 
 func (h *PodcastHandler) GetPodcasts(c *fiber.Ctx) error {
@@ -50,7 +76,7 @@ func (h *PodcastHandler) GetPodcasts(c *fiber.Ctx) error {
 			for j, ep := range ch.Episodes {
 				episodes[j] = utils.PodcastEpisode{
 					ID:          fmt.Sprintf("%d", ep.ID),
-					StreamId:    fmt.Sprintf("%d", ep.ID), // Assuming stream ID is same as episode ID for now
+					StreamId:    episodeStreamID(ep),
 					ChannelId:   fmt.Sprintf("%d", ch.ID),
 					Title:       ep.Title,
 					Description: ep.Description,
@@ -61,7 +87,7 @@ func (h *PodcastHandler) GetPodcasts(c *fiber.Ctx) error {
 					Duration:    ep.Duration,
 					Size:        ep.FileSize,
 					ContentType: ep.ContentType,
-					Suffix:      "mp3", // Default or derive from content type
+					Suffix:      episodeSuffix(ep),
 					Path:        ep.FileName,
 				}
 			}
@@ -91,7 +117,7 @@ func (h *PodcastHandler) GetNewestPodcasts(c *fiber.Ctx) error {
 	for i, ep := range episodes {
 		responseEpisodes[i] = utils.PodcastEpisode{
 			ID:          fmt.Sprintf("%d", ep.ID),
-			StreamId:    fmt.Sprintf("%d", ep.ID),
+			StreamId:    episodeStreamID(ep),
 			ChannelId:   fmt.Sprintf("%d", ep.ChannelID),
 			Title:       ep.Title,
 			Description: ep.Description,
@@ -102,7 +128,7 @@ func (h *PodcastHandler) GetNewestPodcasts(c *fiber.Ctx) error {
 			Duration:    ep.Duration,
 			Size:        ep.FileSize,
 			ContentType: ep.ContentType,
-			Suffix:      "mp3",
+			Suffix:      episodeSuffix(ep),
 			Path:        ep.FileName,
 		}
 		if ep.Channel != nil {
@@ -118,8 +144,13 @@ func (h *PodcastHandler) GetNewestPodcasts(c *fiber.Ctx) error {
 }
 
 func (h *PodcastHandler) RefreshPodcasts(c *fiber.Ctx) error {
-	// In a real implementation, this would trigger a background job
-	// For now, we just return success
+	if h.queue == nil {
+		return utils.SendOpenSubsonicError(c, 0, "Podcast refresh is not available")
+	}
+	if err := podcast.EnqueueRefresh(h.queue, 0); err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Could not refresh podcasts")
+	}
+
 	return utils.SendResponse(c, utils.SuccessResponse())
 }
 
@@ -139,7 +170,12 @@ func (h *PodcastHandler) CreatePodcastChannel(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Could not create podcast channel")
 	}
 
-	// Trigger download/refresh logic here
+	// Fetch the feed in the background; otherwise the next scheduled refresh picks it up
+	if h.queue != nil {
+		if err := podcast.EnqueueRefresh(h.queue, channel.ID); err != nil {
+			logging.Warnf("podcast: failed to queue refresh of channel %d: %v", channel.ID, err)
+		}
+	}
 
 	return utils.SendResponse(c, utils.SuccessResponse())
 }
@@ -155,7 +191,14 @@ func (h *PodcastHandler) DeletePodcastChannel(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
 	}
 
-	if err := h.DB.Delete(&models.PodcastChannel{}, id).Error; err != nil {
+	if h.podcasts != nil {
+		if err := h.podcasts.DeleteChannel(int32(id)); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return utils.SendOpenSubsonicError(c, 70, "Podcast channel not found")
+			}
+			return utils.SendOpenSubsonicError(c, 0, "Could not delete podcast channel")
+		}
+	} else if err := h.DB.Delete(&models.PodcastChannel{}, id).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 70, "Podcast channel not found")
 	}
 
@@ -180,7 +223,7 @@ func (h *PodcastHandler) GetPodcastEpisode(c *fiber.Ctx) error {
 
 	responseEpisode := utils.PodcastEpisode{
 		ID:          fmt.Sprintf("%d", ep.ID),
-		StreamId:    fmt.Sprintf("%d", ep.ID),
+		StreamId:    episodeStreamID(ep),
 		ChannelId:   fmt.Sprintf("%d", ep.ChannelID),
 		Title:       ep.Title,
 		Description: ep.Description,
@@ -191,7 +234,7 @@ func (h *PodcastHandler) GetPodcastEpisode(c *fiber.Ctx) error {
 		Duration:    ep.Duration,
 		Size:        ep.FileSize,
 		ContentType: ep.ContentType,
-		Suffix:      "mp3",
+		Suffix:      episodeSuffix(ep),
 		Path:        ep.FileName,
 	}
 	if ep.Channel != nil {
@@ -221,8 +264,12 @@ func (h *PodcastHandler) DownloadPodcastEpisode(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 70, "Podcast episode not found")
 	}
 
-	ep.Status = "downloading"
-	h.DB.Save(&ep)
+	if h.queue == nil {
+		return utils.SendOpenSubsonicError(c, 0, "Podcast downloads are not available")
+	}
+	if err := podcast.EnqueueDownload(h.queue, ep.ID); err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Could not queue podcast episode download")
+	}
 
 	return utils.SendResponse(c, utils.SuccessResponse())
 }
@@ -238,7 +285,15 @@ func (h *PodcastHandler) DeletePodcastEpisode(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
 	}
 
-	if err := h.DB.Delete(&models.PodcastEpisode{}, id).Error; err != nil {
+	// Only the file is deleted; the episode stays so refreshes do not download it again
+	if h.podcasts != nil {
+		if err := h.podcasts.DeleteEpisode(int64(id)); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return utils.SendOpenSubsonicError(c, 70, "Podcast episode not found")
+			}
+			return utils.SendOpenSubsonicError(c, 0, "Could not delete podcast episode")
+		}
+	} else if err := h.DB.Delete(&models.PodcastEpisode{}, id).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 70, "Podcast episode not found")
 	}
 
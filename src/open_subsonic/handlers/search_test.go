@@ -3,12 +3,15 @@ package handlers
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"melodee/internal/models"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -22,6 +25,8 @@ func getSearchTestDB() *gorm.DB {
 	// Manually create tables for SQLite
 	db.Exec(`CREATE TABLE users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jukebox_role BOOLEAN DEFAULT 0,
+		consolidate_editions BOOLEAN DEFAULT 0,
 		username TEXT,
 		email TEXT,
 		password_hash TEXT,
@@ -56,12 +61,17 @@ func getSearchTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		biography TEXT,
+		image_url TEXT,
 		sort_order INTEGER DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE albums (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		release_group_id INTEGER,
+		edition_type TEXT,
+		library_id INTEGER,
 		name TEXT,
 		artist_id INTEGER,
 		track_count_cached INTEGER DEFAULT 0,
@@ -91,12 +101,22 @@ func getSearchTestDB() *gorm.DB {
 		i_tunes_id TEXT,
 		amg_id TEXT,
 		wikidata_id TEXT,
+		image_url TEXT,
 		is_compilation BOOLEAN DEFAULT 0,
 		api_key TEXT
 	)`)
 
 	db.Exec(`CREATE TABLE tracks (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT,
+		duplicate_of_id INTEGER,
+		start_offset INTEGER DEFAULT 0,
+		end_offset INTEGER DEFAULT 0,
+		replaygain_track_gain REAL,
+		replaygain_track_peak REAL,
+		replaygain_album_gain REAL,
+		replaygain_album_peak REAL,
+		library_id INTEGER,
 		name TEXT,
 		album_id INTEGER,
 		artist_id INTEGER,
@@ -182,3 +202,39 @@ func TestSearchHandler_Search3(t *testing.T) {
 	// Verify XML response structure (basic check)
 	// In a real test we would parse XML
 }
+
+func TestSearchHandler_Search3RanksAndPagesPerType(t *testing.T) {
+	db := getSearchTestDB()
+	searchHandler := NewSearchHandler(db)
+
+	app := fiber.New()
+	app.Get("/search3", searchHandler.Search3)
+
+	zebrahead := models.Artist{Name: "Zebrahead", NameNormalized: "zebrahead"}
+	db.Create(&zebrahead)
+	zebra := models.Artist{Name: "Zebra", NameNormalized: "zebra"}
+	db.Create(&zebra)
+	album := models.Album{Name: "Zebra Crossing", NameNormalized: "zebra crossing", ArtistID: zebra.ID}
+	db.Create(&album)
+	for _, name := range []string{"Zebra Song 2", "Zebra Song 1"} {
+		db.Create(&models.Track{Name: name, NameNormalized: strings.ToLower(name), AlbumID: album.ID, ArtistID: zebra.ID})
+	}
+
+	subResp := getSubsonicResponse(t, app, "/search3?query=zebra&songCount=1&songOffset=1&f=json")
+	result := subResp["searchResult3"].(map[string]interface{})
+	assert.Equal(t, float64(5), result["totalHits"])
+
+	artists := result["artist"].([]interface{})
+	require.Len(t, artists, 2)
+	assert.Equal(t, "Zebra", artists[0].(map[string]interface{})["name"], "exact match ranks first")
+	assert.Equal(t, "Zebrahead", artists[1].(map[string]interface{})["name"])
+
+	songs := result["song"].([]interface{})
+	require.Len(t, songs, 1)
+	assert.Equal(t, "Zebra Song 2", songs[0].(map[string]interface{})["title"])
+	assert.Equal(t, "Zebra", songs[0].(map[string]interface{})["artist"])
+
+	subResp = getSubsonicResponse(t, app, `/search3?query=`+url.QueryEscape(`artist:zebrahead`)+"&f=json")
+	result = subResp["searchResult3"].(map[string]interface{})
+	assert.Equal(t, float64(1), result["totalHits"])
+}
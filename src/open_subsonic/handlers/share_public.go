@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"melodee/internal/logging"
+	"melodee/internal/models"
+	"melodee/internal/share"
+)
+
+// PublicShareHandler serves shares to anyone holding their token, without
+// authentication, under /share/:token
+type PublicShareHandler struct {
+	shares *share.Service
+	media  *MediaHandler
+}
+
+// NewPublicShareHandler creates a new public share handler. Songs are
+// streamed through the media handler.
+func NewPublicShareHandler(shares *share.Service, media *MediaHandler) *PublicShareHandler {
+	return &PublicShareHandler{shares: shares, media: media}
+}
+
+// PublicShare is the manifest of a share
+type PublicShare struct {
+	Name           string             `json:"name,omitempty"`
+	Description    string             `json:"description,omitempty"`
+	Username       string             `json:"username"`
+	Created        time.Time          `json:"created"`
+	Expires        *time.Time         `json:"expires,omitempty"`
+	VisitCount     int32              `json:"visitCount"`
+	AllowStreaming bool               `json:"allowStreaming"`
+	AllowDownload  bool               `json:"allowDownload"`
+	Tracks         []PublicShareTrack `json:"tracks"`
+}
+
+// PublicShareTrack is a track in a share manifest
+type PublicShareTrack struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Duration    int    `json:"duration"` // seconds
+	StreamURL   string `json:"streamUrl,omitempty"`
+	DownloadURL string `json:"downloadUrl,omitempty"`
+	CoverArtURL string `json:"coverArtUrl"`
+}
+
+// Manifest returns a share and its tracks, and counts a visit
+func (h *PublicShareHandler) Manifest(c *fiber.Ctx) error {
+	s, err := h.shares.Open(c.Context(), c.Params("token"))
+	if err != nil {
+		return sendShareError(c, err)
+	}
+	if err := h.shares.RecordVisit(c.Context(), s, shareVisitor(c)); err != nil {
+		logging.Warnf("share: failed to record visit of share %d: %v", s.ID, err)
+	}
+
+	tracks, err := h.shares.Tracks(c.Context(), s)
+	if err != nil {
+		return sendShareError(c, err)
+	}
+
+	base := h.shares.URL(s, c.BaseURL())
+	manifest := PublicShare{
+		Name:           s.Name,
+		Description:    s.Description,
+		Created:        s.CreatedAt,
+		Expires:        s.ExpiresAt,
+		VisitCount:     s.VisitCount,
+		AllowStreaming: s.AllowStreaming,
+		AllowDownload:  s.AllowDownload,
+		Tracks:         make([]PublicShareTrack, len(tracks)),
+	}
+	if s.User != nil {
+		manifest.Username = s.User.Username
+	}
+	for i, track := range tracks {
+		id := strconv.FormatInt(track.ID, 10)
+		entry := PublicShareTrack{
+			ID:          track.ID,
+			Title:       track.Name,
+			Duration:    int(track.Duration / 1000),
+			CoverArtURL: base + "/cover/" + id,
+		}
+		if track.Artist != nil {
+			entry.Artist = track.Artist.Name
+		}
+		if track.Album != nil {
+			entry.Album = track.Album.Name
+		}
+		if s.AllowStreaming {
+			entry.StreamURL = base + "/stream/" + id
+		}
+		if s.AllowDownload {
+			entry.DownloadURL = base + "/download/" + id
+		}
+		manifest.Tracks[i] = entry
+	}
+	return c.JSON(manifest)
+}
+
+// Stream streams a track of a share. It takes the format, maxBitRate and
+// timeOffset parameters of the OpenSubsonic stream endpoint.
+func (h *PublicShareHandler) Stream(c *fiber.Ctx) error {
+	s, track, err := h.sharedTrack(c)
+	if err != nil {
+		return sendShareError(c, err)
+	}
+
+	start := h.shares.StartStream
+	if resumesStream(c) {
+		start = h.shares.ResumeStream
+	}
+	if err := start(c.Context(), s, track, models.ShareActionStream, shareVisitor(c)); err != nil {
+		return sendShareError(c, err)
+	}
+	return h.media.streamSong(c, *track, nil)
+}
+
+// Download sends a track of a share as an attachment
+func (h *PublicShareHandler) Download(c *fiber.Ctx) error {
+	s, track, err := h.sharedTrack(c)
+	if err != nil {
+		return sendShareError(c, err)
+	}
+
+	start := h.shares.StartStream
+	if resumesStream(c) {
+		start = h.shares.ResumeStream
+	}
+	if err := start(c.Context(), s, track, models.ShareActionDownload, shareVisitor(c)); err != nil {
+		return sendShareError(c, err)
+	}
+	return h.media.downloadSong(c, *track)
+}
+
+// CoverArt sends the album cover of a track of a share
+func (h *PublicShareHandler) CoverArt(c *fiber.Ctx) error {
+	_, track, err := h.sharedTrack(c)
+	if err != nil {
+		return sendShareError(c, err)
+	}
+	if track.Album == nil {
+		return sendShareError(c, share.ErrNotShared)
+	}
+	return h.media.sendAlbumCover(c, *track.Album)
+}
+
+// sharedTrack returns the open share and the track named in the path
+func (h *PublicShareHandler) sharedTrack(c *fiber.Ctx) (*models.Share, *models.Track, error) {
+	s, err := h.shares.Open(c.Context(), c.Params("token"))
+	if err != nil {
+		return nil, nil, err
+	}
+	trackID, err := strconv.ParseInt(c.Params("trackId"), 10, 64)
+	if err != nil {
+		return nil, nil, share.ErrNotShared
+	}
+	track, err := h.shares.Track(c.Context(), s, trackID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, track, nil
+}
+
+// resumesStream reports whether a request continues a stream, seeking into
+// it rather than starting from the beginning
+func resumesStream(c *fiber.Ctx) bool {
+	if c.QueryInt("timeOffset", 0) > 0 {
+		return true
+	}
+	rangeHeader := c.Get("Range")
+	return rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+func shareVisitor(c *fiber.Ctx) share.Visitor {
+	return share.Visitor{IPAddress: c.IP(), UserAgent: c.Get("User-Agent")}
+}
+
+// sendShareError answers a share request that can't be served
+func sendShareError(c *fiber.Ctx, err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, share.ErrNotFound), errors.Is(err, share.ErrNotShared):
+		status = http.StatusNotFound
+	case errors.Is(err, share.ErrExpired):
+		status = http.StatusGone
+	case errors.Is(err, share.ErrStreamingDisabled), errors.Is(err, share.ErrDownloadDisabled):
+		status = http.StatusForbidden
+	case errors.Is(err, share.ErrLimitReached):
+		status = http.StatusTooManyRequests
+	default:
+		logging.Errorf("share: %v", err)
+		return c.Status(status).JSON(fiber.Map{"error": "Failed to load share"})
+	}
+	return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"melodee/internal/config"
+	"melodee/internal/models"
+	"melodee/internal/share"
+)
+
+func TestPublicShareHandler(t *testing.T) {
+	db := getMediaTestDB()
+	db.Exec(`CREATE TABLE IF NOT EXISTS shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		token TEXT,
+		name TEXT,
+		description TEXT,
+		expires_at DATETIME,
+		max_streaming_minutes INTEGER DEFAULT 0,
+		max_streaming_count INTEGER DEFAULT 0,
+		allow_streaming BOOLEAN DEFAULT 1,
+		allow_download BOOLEAN DEFAULT 0,
+		visit_count INTEGER DEFAULT 0,
+		last_visited_at DATETIME,
+		stream_count INTEGER DEFAULT 0,
+		streamed_seconds INTEGER DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS share_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		share_id INTEGER,
+		item_type TEXT,
+		item_id INTEGER,
+		position INTEGER
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS share_activities (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		share_id INTEGER,
+		user_id INTEGER,
+		action TEXT,
+		track_id INTEGER,
+		ip_address TEXT,
+		accessed_at DATETIME,
+		user_agent TEXT
+	)`)
+
+	libraryRoot := t.TempDir()
+	library := models.Library{Name: "Shared Library", Path: libraryRoot, Type: "production"}
+	db.Create(&library)
+	albumDir := filepath.Join("CD", "Shared Artist", "2021 - Shared Album")
+	require.NoError(t, os.MkdirAll(filepath.Join(libraryRoot, albumDir), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(libraryRoot, albumDir, "01 Shared.mp3"), []byte("audio"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(libraryRoot, albumDir, "cover.jpg"), []byte("cover"), 0644))
+
+	owner := models.User{Username: "sharer"}
+	db.Create(&owner)
+	artist := models.Artist{Name: "Shared Artist", DirectoryCode: "CD"}
+	db.Create(&artist)
+	album := models.Album{Name: "Shared Album", ArtistID: artist.ID, LibraryID: &library.ID, Directory: albumDir}
+	db.Create(&album)
+	shared := models.Track{
+		Name:         "Shared",
+		AlbumID:      album.ID,
+		ArtistID:     artist.ID,
+		LibraryID:    &library.ID,
+		RelativePath: filepath.Join(albumDir, "01 Shared.mp3"),
+		Duration:     180000,
+	}
+	db.Create(&shared)
+	private := models.Track{Name: "Private", AlbumID: album.ID, ArtistID: artist.ID, LibraryID: &library.ID}
+	db.Create(&private)
+
+	service := share.NewService(db, "https://music.example.com")
+	handler := NewPublicShareHandler(service, NewMediaHandler(db, &config.AppConfig{}, nil))
+	app := fiber.New()
+	app.Get("/share/:token", handler.Manifest)
+	app.Get("/share/:token/stream/:trackId", handler.Stream)
+	app.Get("/share/:token/download/:trackId", handler.Download)
+	app.Get("/share/:token/cover/:trackId", handler.CoverArt)
+
+	newShare := func(s models.Share) *models.Share {
+		s.UserID = owner.ID
+		require.NoError(t, service.Create(t.Context(), &s, []models.ShareItem{{ItemType: models.ShareItemTrack, ItemID: shared.ID}}))
+		return &s
+	}
+	get := func(url string) (int, string) {
+		resp, err := app.Test(httptest.NewRequest("GET", url, nil))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	s := newShare(models.Share{Description: "listen to this", MaxStreamingCount: 1})
+	base := "/share/" + s.Token
+	trackID := strconv.FormatInt(shared.ID, 10)
+
+	status, body := get(base)
+	require.Equal(t, http.StatusOK, status)
+	var manifest PublicShare
+	require.NoError(t, json.Unmarshal([]byte(body), &manifest))
+	assert.Equal(t, "listen to this", manifest.Description)
+	assert.Equal(t, "sharer", manifest.Username)
+	assert.Equal(t, int32(1), manifest.VisitCount)
+	require.Len(t, manifest.Tracks, 1)
+	assert.Equal(t, "Shared Artist", manifest.Tracks[0].Artist)
+	assert.Equal(t, "https://music.example.com"+base+"/stream/"+trackID, manifest.Tracks[0].StreamURL)
+	assert.Empty(t, manifest.Tracks[0].DownloadURL)
+
+	status, body = get(base + "/stream/" + trackID)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "audio", body)
+	status, _ = get(base + "/stream/" + trackID)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	status, _ = get(base + "/download/" + trackID)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body = get(base + "/cover/" + trackID)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "cover", body)
+
+	// Tracks outside the share and unknown tokens are not found
+	status, _ = get(base + "/stream/" + strconv.FormatInt(private.ID, 10))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = get("/share/unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	var activities int64
+	db.Model(&models.ShareActivity{}).Where("share_id = ?", s.ID).Count(&activities)
+	assert.Equal(t, int64(2), activities)
+
+	downloadable := newShare(models.Share{AllowDownload: true})
+	status, body = get("/share/" + downloadable.Token + "/download/" + trackID)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "audio", body)
+
+	expiresAt := time.Now().Add(-time.Hour)
+	expired := newShare(models.Share{ExpiresAt: &expiresAt})
+	status, _ = get("/share/" + expired.Token)
+	assert.Equal(t, http.StatusGone, status)
+	status, _ = get("/share/" + expired.Token + "/stream/" + trackID)
+	assert.Equal(t, http.StatusGone, status)
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"melodee/internal/logging"
 	"melodee/internal/models"
+	"melodee/internal/share"
 	"melodee/open_subsonic/utils"
 	"strconv"
 	"time"
@@ -12,40 +15,43 @@ import (
 )
 
 type SharesHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	shares *share.Service
 }
 
 func NewSharesHandler(db *gorm.DB) *SharesHandler {
-	return &SharesHandler{DB: db}
+	return &SharesHandler{DB: db, shares: share.NewService(db, "")}
 }
 
+// WithShares sets the share service, which builds the share URLs
+func (h *SharesHandler) WithShares(shares *share.Service) *SharesHandler {
+	h.shares = shares
+	return h
+}
+
+// GetShares returns the shares of the current user, or every share for admins
 func (h *SharesHandler) GetShares(c *fiber.Ctx) error {
+	user, ok := utils.GetUserFromContext(c)
+	if !ok {
+		return utils.SendOpenSubsonicError(c, 50, "Unauthorized")
+	}
+
+	query := h.DB.Preload("User").Order("id")
+	if !user.IsAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
 	var shares []models.Share
-	if err := h.DB.Preload("User").Find(&shares).Error; err != nil {
+	if err := query.Find(&shares).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 70, "Could not fetch shares")
 	}
 
+	tracks, err := h.shares.SharedTracks(c.Context(), shares)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Could not fetch shares")
+	}
 	responseShares := make([]utils.Share, len(shares))
-	for i, s := range shares {
-		var expires string
-		if s.ExpiresAt != nil {
-			expires = utils.FormatTime(*s.ExpiresAt)
-		}
-
-		username := "admin"
-		if s.User != nil {
-			username = s.User.Username
-		}
-
-		responseShares[i] = utils.Share{
-			ID:          fmt.Sprintf("%d", s.ID),
-			Url:         fmt.Sprintf("http://example.com/share/%d", s.ID), // Placeholder URL
-			Description: s.Description,
-			Username:    username,
-			Created:     utils.FormatTime(s.CreatedAt),
-			Expires:     expires,
-			VisitCount:  0, // Not tracked in current model?
-		}
+	for i := range shares {
+		responseShares[i] = h.responseShare(c, &shares[i], tracks[shares[i].ID])
 	}
 
 	return utils.SendResponse(c, &utils.OpenSubsonicResponse{
@@ -55,8 +61,20 @@ func (h *SharesHandler) GetShares(c *fiber.Ctx) error {
 	})
 }
 
+// CreateShare shares the songs, albums ("al-<id>") and playlists ("pl-<id>")
+// given as id parameters
 func (h *SharesHandler) CreateShare(c *fiber.Ctx) error {
-	// id := c.Query("id") // Can be multiple
+	var items []models.ShareItem
+	for _, value := range c.Context().QueryArgs().PeekMulti("id") {
+		item, err := share.ParseItemID(string(value))
+		if err != nil {
+			return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return utils.SendOpenSubsonicError(c, 10, "Missing required parameter id")
+	}
 
 	description := c.Query("description")
 	expiresStr := c.Query("expires")
@@ -75,30 +93,29 @@ func (h *SharesHandler) CreateShare(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 50, "Unauthorized")
 	}
 
-	share := models.Share{
+	newShare := models.Share{
 		UserID:      user.ID,
 		Description: description,
 		ExpiresAt:   expiresAt,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
+		User:        user,
 	}
 
-	if err := h.DB.Create(&share).Error; err != nil {
+	if err := h.shares.Create(c.Context(), &newShare, items); err != nil {
+		if errors.Is(err, share.ErrItemNotFound) {
+			return utils.SendOpenSubsonicError(c, 70, "Shared item not found")
+		}
+		logging.Errorf("share: %v", err)
 		return utils.SendOpenSubsonicError(c, 0, "Could not create share")
 	}
 
 	// Return the created share
-	responseShare := utils.Share{
-		ID:          fmt.Sprintf("%d", share.ID),
-		Url:         fmt.Sprintf("http://example.com/share/%d", share.ID),
-		Description: share.Description,
-		Username:    user.Username,
-		Created:     utils.FormatTime(share.CreatedAt),
-		VisitCount:  0,
-	}
-	if share.ExpiresAt != nil {
-		responseShare.Expires = utils.FormatTime(*share.ExpiresAt)
+	tracks, err := h.shares.Tracks(c.Context(), &newShare)
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Could not load shared songs")
 	}
+	responseShare := h.responseShare(c, &newShare, tracks)
 
 	return utils.SendResponse(c, &utils.OpenSubsonicResponse{
 		Status:  "ok",
@@ -107,6 +124,33 @@ func (h *SharesHandler) CreateShare(c *fiber.Ctx) error {
 	})
 }
 
+// responseShare converts a share, with its songs as entries
+func (h *SharesHandler) responseShare(c *fiber.Ctx, s *models.Share, tracks []models.Track) utils.Share {
+	username := ""
+	if s.User != nil {
+		username = s.User.Username
+	}
+
+	responseShare := utils.Share{
+		ID:          fmt.Sprintf("%d", s.ID),
+		Url:         h.shares.URL(s, c.BaseURL()),
+		Description: s.Description,
+		Username:    username,
+		Created:     utils.FormatTime(s.CreatedAt),
+		VisitCount:  int(s.VisitCount),
+	}
+	if s.ExpiresAt != nil {
+		responseShare.Expires = utils.FormatTime(*s.ExpiresAt)
+	}
+	if s.LastVisitedAt != nil {
+		responseShare.LastVisited = utils.FormatTime(*s.LastVisitedAt)
+	}
+	for _, track := range tracks {
+		responseShare.Entries = append(responseShare.Entries, searchSong(track))
+	}
+	return responseShare
+}
+
 func (h *SharesHandler) UpdateShare(c *fiber.Ctx) error {
 	idStr := c.Query("id")
 	if idStr == "" {
@@ -118,14 +162,17 @@ func (h *SharesHandler) UpdateShare(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
 	}
 
-	var share models.Share
-	if err := h.DB.First(&share, id).Error; err != nil {
+	var existing models.Share
+	if err := h.DB.First(&existing, id).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 70, "Share not found")
 	}
+	if !ownsShare(c, &existing) {
+		return utils.SendOpenSubsonicError(c, 50, "Not authorized to update this share")
+	}
 
 	description := c.Query("description")
 	if description != "" {
-		share.Description = description
+		existing.Description = description
 	}
 
 	expiresStr := c.Query("expires")
@@ -133,11 +180,11 @@ func (h *SharesHandler) UpdateShare(c *fiber.Ctx) error {
 		ms, err := strconv.ParseInt(expiresStr, 10, 64)
 		if err == nil {
 			t := time.UnixMilli(ms)
-			share.ExpiresAt = &t
+			existing.ExpiresAt = &t
 		}
 	}
 
-	if err := h.DB.Save(&share).Error; err != nil {
+	if err := h.DB.Save(&existing).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Could not update share")
 	}
 
@@ -155,9 +202,29 @@ func (h *SharesHandler) DeleteShare(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
 	}
 
-	if err := h.DB.Delete(&models.Share{}, id).Error; err != nil {
+	var existing models.Share
+	if err := h.DB.First(&existing, id).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 70, "Share not found")
 	}
+	if !ownsShare(c, &existing) {
+		return utils.SendOpenSubsonicError(c, 50, "Not authorized to delete this share")
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("share_id = ?", existing.ID).Delete(&models.ShareItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&existing).Error
+	})
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Could not delete share")
+	}
 
 	return utils.SendResponse(c, utils.SuccessResponse())
 }
+
+// ownsShare reports whether the current user may change a share
+func ownsShare(c *fiber.Ctx, s *models.Share) bool {
+	user, ok := utils.GetUserFromContext(c)
+	return ok && (user.IsAdmin || user.ID == s.UserID)
+}
@@ -55,8 +55,12 @@ func (h *SystemHandler) GetOpenSubsonicExtensions(c *fiber.Ctx) error {
 	// Define supported extensions
 	// Based on implemented handlers:
 	// - search3 (SearchHandler.Search3)
+	// - apiKeyAuthentication (OpenSubsonicAuthMiddleware.authenticateWithAPIKey)
+	// - songLyrics (BrowsingHandler.GetLyricsBySongId)
 	extensions := []utils.Extension{
 		{Name: "search3", Versions: []int{1}, VersionsXML: "1"},
+		{Name: "apiKeyAuthentication", Versions: []int{1}, VersionsXML: "1"},
+		{Name: "songLyrics", Versions: []int{1}, VersionsXML: "1"},
 		// We can add more as we verify compliance
 	}
 
@@ -44,3 +44,16 @@ func TestSystemHandler_GetOpenSubsonicExtensions(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestSystemHandler_AdvertisesSongLyrics(t *testing.T) {
+	handler := NewSystemHandler(nil)
+	app := fiber.New()
+	app.Get("/getOpenSubsonicExtensions", handler.GetOpenSubsonicExtensions)
+
+	subResp := getSubsonicResponse(t, app, "/getOpenSubsonicExtensions?f=json")
+	var names []string
+	for _, ext := range subResp["openSubsonicExtensions"].(map[string]interface{})["extension"].([]interface{}) {
+		names = append(names, ext.(map[string]interface{})["name"].(string))
+	}
+	assert.Contains(t, names, "songLyrics")
+}
@@ -1,29 +1,47 @@
 package handlers
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
+	"melodee/internal/logging"
 	"melodee/internal/models"
+	"melodee/internal/playhistory"
+	"melodee/internal/scrobble"
 	"melodee/open_subsonic/utils"
 )
 
 // UserHandler handles OpenSubsonic user management endpoints
 type UserHandler struct {
-	db *gorm.DB
+	db        *gorm.DB
+	history   *playhistory.Service
+	scrobbles *scrobble.Service
+	client    *asynq.Client
 }
 
 // NewUserHandler creates a new user handler
 func NewUserHandler(db *gorm.DB) *UserHandler {
 	return &UserHandler{
-		db: db,
+		db:      db,
+		history: playhistory.NewService(db),
 	}
 }
 
+// WithScrobbling forwards scrobbles to the user's linked Last.fm and
+// ListenBrainz accounts. Without a client plays are only queued, for the
+// worker's retry job to submit, and now playing is not forwarded.
+func (h *UserHandler) WithScrobbling(scrobbles *scrobble.Service, client *asynq.Client) *UserHandler {
+	h.scrobbles = scrobbles
+	h.client = client
+	return h
+}
+
 // GetUser returns information about a user
 func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 	username := c.Query("username", "")
@@ -47,9 +65,9 @@ func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 		Email:               user.Email,
 		ScrobblingEnabled:   true, // Default true
 		AdminRole:           user.IsAdmin,
-		SettingsRole:        true,          // User can change settings
-		StreamRole:          true,          // User can stream
-		JukeboxRole:         false,         // Default false
+		SettingsRole:        true, // User can change settings
+		StreamRole:          true, // User can stream
+		JukeboxRole:         user.IsAdmin || user.JukeboxRole,
 		UploadRole:          false,         // Default false
 		FolderRole:          []int{0},      // Access to all folders by default
 		PlaylistRole:        true,          // Can manage playlists
@@ -96,7 +114,7 @@ func (h *UserHandler) GetUsers(c *fiber.Ctx) error {
 			AdminRole:           user.IsAdmin,
 			SettingsRole:        true,
 			StreamRole:          true,
-			JukeboxRole:         false,
+			JukeboxRole:         user.IsAdmin || user.JukeboxRole,
 			UploadRole:          false,
 			FolderRole:          []int{0},
 			PlaylistRole:        true,
@@ -138,6 +156,11 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to check for existing user")
 	}
 
+	// Only admins grant roles
+	if c.Query("jukeboxRole", "") != "" && !isAdmin(c) {
+		return utils.SendOpenSubsonicError(c, 50, "Not authorized to set user roles")
+	}
+
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -149,6 +172,7 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 		Username:     username,
 		Email:        email,
 		PasswordHash: string(hashedPassword),
+		JukeboxRole:  c.QueryBool("jukeboxRole", false),
 	}
 
 	if err := h.db.Create(&user).Error; err != nil {
@@ -176,6 +200,13 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to retrieve user")
 	}
 
+	// Only admins change roles, their own included
+	adminRoleStr := c.Query("adminRole", "")
+	jukeboxRoleStr := c.Query("jukeboxRole", "")
+	if (adminRoleStr != "" || jukeboxRoleStr != "") && !isAdmin(c) {
+		return utils.SendOpenSubsonicError(c, 50, "Not authorized to change user roles")
+	}
+
 	// Update fields that are provided
 	newEmail := c.Query("email", "")
 	if newEmail != "" {
@@ -193,7 +224,6 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	}
 
 	// Update admin role if provided (admin only)
-	adminRoleStr := c.Query("adminRole", "")
 	if adminRoleStr != "" {
 		adminRole, err := strconv.ParseBool(adminRoleStr)
 		if err != nil {
@@ -202,6 +232,15 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 		user.IsAdmin = adminRole
 	}
 
+	// Update jukebox permission if provided (admin only)
+	if jukeboxRoleStr != "" {
+		jukeboxRole, err := strconv.ParseBool(jukeboxRoleStr)
+		if err != nil {
+			return utils.SendOpenSubsonicError(c, 10, "Invalid jukeboxRole value")
+		}
+		user.JukeboxRole = jukeboxRole
+	}
+
 	// Save the updated user
 	if err := h.db.Save(&user).Error; err != nil {
 		return utils.SendOpenSubsonicError(c, 0, "Failed to update user")
@@ -475,19 +514,20 @@ func (h *UserHandler) getStarredCommon(c *fiber.Ctx, version int) error {
 	childSongs := make([]utils.Child, 0, len(songs))
 	for _, s := range songs {
 		childSongs = append(childSongs, utils.Child{
-			ID:       int(s.ID),
-			Parent:   int(s.AlbumID),
-			IsDir:    false,
-			Title:    s.Name,
-			Album:    s.Album.Name,
-			Artist:   s.Artist.Name,
-			CoverArt: "al-" + strconv.FormatInt(s.AlbumID, 10),
-			Created:  utils.FormatTime(s.CreatedAt),
-			Duration: int(s.Duration / 1000),
-			BitRate:  int(s.BitRate),
-			Track:    int(s.SortOrder),
-			Starred:  utils.FormatTime(time.Now()), // Placeholder
-			Path:     s.RelativePath,
+			ID:         int(s.ID),
+			Parent:     int(s.AlbumID),
+			IsDir:      false,
+			Title:      s.Name,
+			Album:      s.Album.Name,
+			Artist:     s.Artist.Name,
+			CoverArt:   "al-" + strconv.FormatInt(s.AlbumID, 10),
+			Created:    utils.FormatTime(s.CreatedAt),
+			Duration:   int(s.Duration / 1000),
+			BitRate:    int(s.BitRate),
+			Track:      int(s.SortOrder),
+			Starred:    utils.FormatTime(time.Now()), // Placeholder
+			Path:       s.RelativePath,
+			ReplayGain: replayGain(s),
 		})
 	}
 
@@ -578,40 +618,132 @@ func (h *UserHandler) SetRating(c *fiber.Ctx) error {
 	return utils.SendResponse(c, response)
 }
 
-// Scrobble registers the local playback of one or more media files
+// Scrobble registers the local playback of one or more media files. Clients
+// repeat id (and optionally time, in milliseconds since the epoch) for each
+// file. With submission=false the file is only shown as now playing and is
+// not counted as played.
 func (h *UserHandler) Scrobble(c *fiber.Ctx) error {
 	user, ok := utils.GetUserFromContext(c)
 	if !ok {
 		return utils.SendOpenSubsonicError(c, 50, "Not authorized")
 	}
 
-	id := c.QueryInt("id", -1)
-	// submission := c.QueryBool("submission") // Not used in this simple implementation, but part of spec
-
-	if id == -1 {
+	ids, err := queryInt64s(c, "id")
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 10, "Invalid id parameter")
+	}
+	if len(ids) == 0 {
 		return utils.SendOpenSubsonicError(c, 10, "Missing required parameter id")
 	}
+	times, err := queryInt64s(c, "time")
+	if err != nil || (len(times) > 0 && len(times) != len(ids)) {
+		return utils.SendOpenSubsonicError(c, 10, "Invalid time parameter: give one time per id")
+	}
+	submission := c.QueryBool("submission", true)
 
-	now := time.Now()
+	var playerID *int32
+	player := resolvePlayer(h.db, c)
+	if player != nil {
+		playerID = &player.ID
+	}
 
-	// Update play count and last played time
-	var userTrack models.UserTrack
-	err := h.db.Where("user_id = ? AND track_id = ?", user.ID, id).First(&userTrack).Error
-	if err == gorm.ErrRecordNotFound {
-		userTrack = models.UserTrack{
-			UserID:       user.ID,
-			TrackID:      int64(id),
-			PlayedCount:  1,
-			LastPlayedAt: &now,
+	now := time.Now()
+	plays := make([]playhistory.Play, 0, len(ids))
+	for i, id := range ids {
+		playedAt := now
+		if len(times) > 0 && times[i] > 0 && time.UnixMilli(times[i]).Before(now) {
+			playedAt = time.UnixMilli(times[i])
 		}
-		h.db.Create(&userTrack)
+		plays = append(plays, playhistory.Play{
+			UserID:   user.ID,
+			TrackID:  id,
+			PlayerID: playerID,
+			Client:   c.Query("c", ""),
+			PlayedAt: playedAt,
+			Source:   playhistory.SourceSubsonic,
+		})
+	}
+
+	if submission {
+		err = h.history.RecordPlays(c.Context(), plays)
 	} else {
-		userTrack.PlayedCount++
-		userTrack.LastPlayedAt = &now
-		h.db.Save(&userTrack)
+		// Only the last file can be playing now
+		err = h.history.SetNowPlaying(c.Context(), plays[len(plays)-1])
+	}
+	if errors.Is(err, playhistory.ErrTrackNotFound) {
+		return utils.SendOpenSubsonicError(c, 70, "Song not found")
+	}
+	if err != nil {
+		return utils.SendOpenSubsonicError(c, 0, "Failed to register scrobble")
+	}
+
+	if player == nil || player.ScrobbleEnabled {
+		h.forwardScrobble(c, user.ID, plays, submission)
 	}
 
 	// Return success response (empty body)
 	response := utils.SuccessResponse()
 	return utils.SendResponse(c, response)
 }
+
+// forwardScrobble passes plays on to the user's scrobbling accounts. Failures
+// are logged: the plays are already recorded locally.
+func (h *UserHandler) forwardScrobble(c *fiber.Ctx, userID int64, plays []playhistory.Play, submission bool) {
+	if h.scrobbles == nil {
+		return
+	}
+
+	if !submission {
+		if h.client == nil {
+			return
+		}
+		accountIDs, err := h.scrobbles.ActiveAccounts(c.Context(), userID)
+		if err != nil {
+			logging.Warnf("scrobble: %v", err)
+			return
+		}
+		for _, accountID := range accountIDs {
+			if err := scrobble.EnqueueNowPlaying(h.client, accountID, plays[len(plays)-1].TrackID); err != nil {
+				logging.Warnf("scrobble: %v", err)
+			}
+		}
+		return
+	}
+
+	queued := make([]scrobble.Play, 0, len(plays))
+	for _, play := range plays {
+		queued = append(queued, scrobble.Play{TrackID: play.TrackID, PlayedAt: play.PlayedAt})
+	}
+	accountIDs, err := h.scrobbles.Queue(c.Context(), userID, queued)
+	if err != nil {
+		logging.Warnf("scrobble: %v", err)
+		return
+	}
+	if h.client == nil {
+		return
+	}
+	for _, accountID := range accountIDs {
+		if err := scrobble.EnqueueSubmit(h.client, accountID); err != nil {
+			logging.Warnf("scrobble: %v", err)
+		}
+	}
+}
+
+// queryInt64s reads a query parameter that clients repeat for every value
+func queryInt64s(c *fiber.Ctx, name string) ([]int64, error) {
+	var values []int64
+	for _, value := range c.Context().QueryArgs().PeekMulti(name) {
+		parsed, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, parsed)
+	}
+	return values, nil
+}
+
+// isAdmin reports whether the user making the request is an admin
+func isAdmin(c *fiber.Ctx) bool {
+	user, ok := utils.GetUserFromContext(c)
+	return ok && user.IsAdmin
+}
@@ -15,6 +15,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -24,7 +25,7 @@ import (
 func TestIndexingAndSorting(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Create test data with names that need normalization
@@ -87,7 +88,7 @@ func TestIndexingAndSorting(t *testing.T) {
 func TestNormalizationRules(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Create artists with different normalization scenarios
@@ -162,7 +163,7 @@ func TestNormalizationRules(t *testing.T) {
 func TestGetArtistsSorting(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Create test artists with various names
@@ -213,7 +214,7 @@ func TestGetArtistsSorting(t *testing.T) {
 func TestArticlesNormalization(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Test data with various article types
@@ -260,7 +261,7 @@ func TestArticlesNormalization(t *testing.T) {
 func TestDiacriticsNormalization(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Test data with diacritics
@@ -310,7 +311,7 @@ func TestDiacriticsNormalization(t *testing.T) {
 func TestPunctuationNormalization(t *testing.T) {
 	db := setupIndexingTestDatabase(t)
 	cfg := getIndexingTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupIndexingTestApp(db, cfg, authMiddleware)
 
 	// Test data with punctuation
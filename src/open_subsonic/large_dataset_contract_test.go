@@ -17,6 +17,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -26,7 +27,7 @@ import (
 func TestLargeDatasetContract(t *testing.T) {
 	db := setupLargeDatasetTestDatabase(t)
 	cfg := getLargeDatasetTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupLargeDatasetTestApp(db, cfg, authMiddleware)
 
 	// Create large dataset for testing
@@ -95,7 +96,7 @@ func TestLargeDatasetContract(t *testing.T) {
 func TestLargeDatasetPagination(t *testing.T) {
 	db := setupLargeDatasetTestDatabase(t)
 	cfg := getLargeDatasetTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupLargeDatasetTestApp(db, cfg, authMiddleware)
 
 	// Create large dataset for testing
@@ -164,7 +165,7 @@ func TestLargeDatasetPagination(t *testing.T) {
 func TestLargeDatasetResponseStability(t *testing.T) {
 	db := setupLargeDatasetTestDatabase(t)
 	cfg := getLargeDatasetTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupLargeDatasetTestApp(db, cfg, authMiddleware)
 
 	// Create a large dataset
@@ -218,7 +219,7 @@ func TestLargeDatasetResponseStability(t *testing.T) {
 func TestLargeDatasetSearchWithPagination(t *testing.T) {
 	db := setupLargeDatasetTestDatabase(t)
 	cfg := getLargeDatasetTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupLargeDatasetTestApp(db, cfg, authMiddleware)
 
 	// Create large dataset with searchable content
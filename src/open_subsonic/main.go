@@ -13,8 +13,14 @@ import (
 
 	"melodee/internal/config"
 	"melodee/internal/database"
+	"melodee/internal/jukebox"
 	"melodee/internal/media"
 	internal_middleware "melodee/internal/middleware"
+	"melodee/internal/podcast"
+	"melodee/internal/scrobble"
+	"melodee/internal/services"
+	"melodee/internal/share"
+	"melodee/internal/smartplaylist"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	// "melodee/open_subsonic/services"
@@ -70,7 +76,7 @@ func NewOpenSubsonicServer(cfg *config.AppConfig, dbManager *database.DatabaseMa
 // setupRoutes configures the OpenSubsonic API routes
 func (s *OpenSubsonicServer) setupRoutes() {
 	// Create authentication middleware
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(s.db, s.cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(s.db, services.NewAuthService(s.db, s.cfg.JWT.Secret).WithSecretKey(s.cfg.SecretKey()))
 
 	// Create media processing components
 	ffmpegProcessor := media.NewFFmpegProcessor(media.DefaultFFmpegConfig())                                                                                    // Using default config
@@ -78,20 +84,28 @@ func (s *OpenSubsonicServer) setupRoutes() {
 
 	// Create handlers
 	browsingHandler := handlers.NewBrowsingHandler(s.db)
-	mediaHandler := handlers.NewMediaHandler(s.db, nil, transcodeService) // Pass the transcode service
+	mediaHandler := handlers.NewMediaHandler(s.db, s.cfg, transcodeService) // Pass the transcode service
 	searchHandler := handlers.NewSearchHandler(s.db)
-	playlistHandler := handlers.NewPlaylistHandler(s.db)
-	userHandler := handlers.NewUserHandler(s.db)
+	playlistHandler := handlers.NewPlaylistHandler(s.db).
+		WithSmartPlaylists(smartplaylist.NewService(s.db, s.cfg.SmartPlaylists))
+	userHandler := handlers.NewUserHandler(s.db).
+		WithScrobbling(scrobble.NewService(s.db, s.cfg.Scrobble, s.cfg.SecretKey()), nil) // Queued plays are sent by the worker's retry job
 	systemHandler := handlers.NewSystemHandler(s.db)
 	bookmarkHandler := handlers.NewBookmarkHandler(s.db)
 	playQueueHandler := handlers.NewPlayQueueHandler(s.db)
-	podcastHandler := handlers.NewPodcastHandler(s.db)
+	podcastHandler := handlers.NewPodcastHandler(s.db, podcast.NewService(s.db, s.cfg.Podcast), nil) // Refreshes run on the worker schedule
 	internetRadioHandler := handlers.NewInternetRadioHandler(s.db)
-	sharesHandler := handlers.NewSharesHandler(s.db)
+	shareService := share.NewService(s.db, s.cfg.Server.ExternalURL)
+	sharesHandler := handlers.NewSharesHandler(s.db).WithShares(shareService)
+	publicShareHandler := handlers.NewPublicShareHandler(shareService, mediaHandler)
 	videoHandler := handlers.NewVideoHandler(s.db)
 	chatHandler := handlers.NewChatHandler(s.db)
 	scanHandler := handlers.NewScanHandler(s.db)
-	jukeboxHandler := handlers.NewJukeboxHandler(s.db)
+	jukeboxService, err := jukebox.NewFromConfig(s.db, s.cfg)
+	if err != nil {
+		log.Printf("Warning: jukebox disabled: %v", err)
+	}
+	jukeboxHandler := handlers.NewJukeboxHandler(s.db, jukeboxService)
 
 	// Define the API routes under /rest/ prefix
 	rest := s.app.Group("/rest")
@@ -190,6 +204,12 @@ func (s *OpenSubsonicServer) setupRoutes() {
 	rest.Get("/updateShare", authMiddleware.Authenticate, sharesHandler.UpdateShare)
 	rest.Get("/deleteShare", authMiddleware.Authenticate, sharesHandler.DeleteShare)
 
+	// Public shares, open to anyone with the token
+	s.app.Get("/share/:token", publicShareHandler.Manifest)
+	s.app.Get("/share/:token/stream/:trackId", publicShareHandler.Stream)
+	s.app.Get("/share/:token/download/:trackId", publicShareHandler.Download)
+	s.app.Get("/share/:token/cover/:trackId", publicShareHandler.CoverArt)
+
 	// Video endpoints
 	rest.Get("/getVideos", authMiddleware.Authenticate, videoHandler.GetVideos)
 	rest.Get("/getVideoInfo", authMiddleware.Authenticate, videoHandler.GetVideoInfo)
@@ -1,53 +1,68 @@
 package middleware
 
 import (
-	"crypto/md5"
 	"encoding/base64"
 	"fmt"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
 	"melodee/internal/models"
+	"melodee/internal/services"
 )
 
 // OpenSubsonicAuthMiddleware handles OpenSubsonic authentication
 type OpenSubsonicAuthMiddleware struct {
-	db        *gorm.DB
-	jwtSecret string
+	db          *gorm.DB
+	authService *services.AuthService
 }
 
-// NewOpenSubsonicAuthMiddleware creates a new OpenSubsonic auth middleware
-func NewOpenSubsonicAuthMiddleware(db *gorm.DB, jwtSecret string) *OpenSubsonicAuthMiddleware {
+// NewOpenSubsonicAuthMiddleware creates a new OpenSubsonic auth middleware.
+// Tokens are checked against Subsonic app passwords by authService.
+func NewOpenSubsonicAuthMiddleware(db *gorm.DB, authService *services.AuthService) *OpenSubsonicAuthMiddleware {
 	return &OpenSubsonicAuthMiddleware{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:          db,
+		authService: authService,
 	}
 }
 
 // Authenticate authenticates requests using OpenSubsonic auth methods
 func (m *OpenSubsonicAuthMiddleware) Authenticate(c *fiber.Ctx) error {
 	// Try different authentication methods in order:
-	// 1. Username/password parameters
-	// 2. Authorization header
-	// 3. Username/token parameters
+	// 1. API key parameter (OpenSubsonic apiKeyAuthentication extension)
+	// 2. Username/token parameters
+	// 3. Username/password parameters
+	// 4. Authorization header
 
 	username := c.Query("u", "")
 	password := c.Query("p", "")
 	token := c.Query("t", "")
 	salt := c.Query("s", "")
+	apiKey := c.Query("apiKey", "")
 
 	var user *models.User
 	var err error
 
-	// Check for token-based authentication (Subsonic API method)
-	if username != "" && token != "" && salt != "" {
-		user, err = m.authenticateWithToken(username, password, token, salt)
+	if apiKey != "" {
+		// The API key identifies the user, so it cannot be combined with other credentials
+		if username != "" || password != "" || token != "" {
+			return m.sendOpenSubsonicError(c, 43, "multiple conflicting authentication mechanisms provided")
+		}
+		user, err = m.authenticateWithAPIKey(apiKey)
+		if err != nil || user == nil {
+			return m.sendOpenSubsonicError(c, 44, "invalid API key")
+		}
+	} else if username != "" && token != "" && salt != "" {
+		// Check for token-based authentication (Subsonic API method)
+		user, err = m.authenticateWithToken(username, token, salt)
 	} else if username != "" && password != "" {
 		// Standard username/password authentication
 		user, err = m.authenticateWithPassword(username, password)
+	} else if username != "" {
+		return m.sendOpenSubsonicError(c, 10, "required parameter is missing")
 	} else {
 		// Check for Authorization header
 		authHeader := c.Get("Authorization", "")
@@ -92,32 +107,23 @@ func (m *OpenSubsonicAuthMiddleware) authenticateWithPassword(username, password
 	return &user, nil
 }
 
-// authenticateWithToken handles token-based authentication (Subsonic-style)
-func (m *OpenSubsonicAuthMiddleware) authenticateWithToken(username, password, token, salt string) (*models.User, error) {
-	// Find user by username
-	var user models.User
-	if err := m.db.Where("username = ?", username).First(&user).Error; err != nil {
-		return nil, fmt.Errorf("user not found")
-	}
-
-	// For OpenSubsonic token authentication, the client sends:
-	// t = MD5(p + s) where p is plaintext password and s is salt
-	// We need to verify that the received token matches MD5(stored_password + salt)
+// authenticateWithToken handles token-based authentication (Subsonic-style).
+// The client sends t = MD5(secret + s), so the token is checked against each of
+// the user's Subsonic app passwords.
+func (m *OpenSubsonicAuthMiddleware) authenticateWithToken(username, token, salt string) (*models.User, error) {
+	return m.authService.ValidateOpenSubsonicToken(username, token, salt)
+}
 
-	// First, we need to extract the plaintext password from the 'p' parameter if it's in 'enc:' format
-	plainPassword := password
-	if strings.HasPrefix(password, "enc:") {
-		// In a real implementation, this would decrypt the password
-		// For now, assume the part after 'enc:' is the password (this is not secure in real use)
-		plainPassword = strings.TrimPrefix(password, "enc:")
+// authenticateWithAPIKey handles OpenSubsonic API key authentication using users.api_key
+func (m *OpenSubsonicAuthMiddleware) authenticateWithAPIKey(apiKey string) (*models.User, error) {
+	key, err := uuid.Parse(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed API key")
 	}
 
-	// Calculate expected token: MD5(plain_password + salt)
-	expectedTokenBytes := md5.Sum([]byte(plainPassword + salt))
-	expectedToken := fmt.Sprintf("%x", expectedTokenBytes)
-
-	if expectedToken != token {
-		return nil, fmt.Errorf("invalid token")
+	var user models.User
+	if err := m.db.Where("api_key = ?", key).First(&user).Error; err != nil {
+		return nil, fmt.Errorf("user not found")
 	}
 
 	return &user, nil
@@ -17,6 +17,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -26,7 +27,7 @@ import (
 func TestPlaylistContractWithFixtures(t *testing.T) {
 	db := setupPlaylistTestDatabase(t)
 	cfg := getPlaylistTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupPlaylistTestApp(db, cfg, authMiddleware)
 
 	// Create test data
@@ -100,7 +101,7 @@ func TestPlaylistContractWithFixtures(t *testing.T) {
 func TestPlaylistXmlSchema(t *testing.T) {
 	db := setupPlaylistTestDatabase(t)
 	cfg := getPlaylistTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupPlaylistTestApp(db, cfg, authMiddleware)
 
 	// Create test data
@@ -140,7 +141,7 @@ func TestPlaylistXmlSchema(t *testing.T) {
 func TestPlaylistEndpointEdges(t *testing.T) {
 	db := setupPlaylistTestDatabase(t)
 	cfg := getPlaylistTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupPlaylistTestApp(db, cfg, authMiddleware)
 
 	// Test with no playlists
@@ -173,7 +174,7 @@ func TestPlaylistEndpointEdges(t *testing.T) {
 func TestPlaylistFieldPlaceholders(t *testing.T) {
 	db := setupPlaylistTestDatabase(t)
 	cfg := getPlaylistTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupPlaylistTestApp(db, cfg, authMiddleware)
 
 	// Create test playlist with actual data
@@ -205,7 +206,7 @@ func TestPlaylistFieldPlaceholders(t *testing.T) {
 func TestPlaylistEntryValidation(t *testing.T) {
 	db := setupPlaylistTestDatabase(t)
 	cfg := getPlaylistTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupPlaylistTestApp(db, cfg, authMiddleware)
 
 	// Create test data with playlist entries
@@ -18,6 +18,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 	"melodee/open_subsonic/utils"
@@ -27,7 +28,7 @@ import (
 func TestSearchContractWithFixtures(t *testing.T) {
 	db := setupSearchTestDatabase(t)
 	cfg := getSearchTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupSearchTestApp(db, cfg, authMiddleware)
 
 	// Create test data that matches the fixture expectations
@@ -92,7 +93,7 @@ func TestSearchContractWithFixtures(t *testing.T) {
 func TestSearchResultOrdering(t *testing.T) {
 	db := setupSearchTestDatabase(t)
 	cfg := getSearchTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupSearchTestApp(db, cfg, authMiddleware)
 
 	// Create test data with names that need to be sorted
@@ -140,7 +141,7 @@ func TestSearchResultOrdering(t *testing.T) {
 func TestSearchPagination(t *testing.T) {
 	db := setupSearchTestDatabase(t)
 	cfg := getSearchTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupSearchTestApp(db, cfg, authMiddleware)
 
 	// Create multiple test items to test pagination
@@ -225,7 +226,7 @@ func TestSearchPagination(t *testing.T) {
 func TestSearchNormalization(t *testing.T) {
 	db := setupSearchTestDatabase(t)
 	cfg := getSearchTestConfig()
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupSearchTestApp(db, cfg, authMiddleware)
 
 	// Create test data with special names that need normalization
@@ -17,6 +17,7 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/media"
 	"melodee/internal/models"
+	"melodee/internal/services"
 	"melodee/open_subsonic/handlers"
 	opensubsonic_middleware "melodee/open_subsonic/middleware"
 )
@@ -43,7 +44,7 @@ func TestStreamingContract(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupStreamingTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data
@@ -144,7 +145,7 @@ func TestRangeRequestContract(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupStreamingTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data with a dummy file
@@ -222,7 +223,7 @@ func TestTranscodingHeaders(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupStreamingTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data
@@ -297,7 +298,7 @@ func TestDownloadEndpoint(t *testing.T) {
 	})
 	transcodeService := media.NewTranscodeService(ffmpegProcessor, filepath.Join(tempDir, "cache"), 100*1024*1024)
 
-	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, cfg.JWT.Secret)
+	authMiddleware := opensubsonic_middleware.NewOpenSubsonicAuthMiddleware(db, services.NewAuthService(db, cfg.JWT.Secret))
 	app := setupStreamingTestApp(db, cfg, authMiddleware, transcodeService)
 
 	// Create test data
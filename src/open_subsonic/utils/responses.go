@@ -64,7 +64,8 @@ type OpenSubsonicResponse struct {
 	Starred2 *Starred2 `xml:"starred2,omitempty" json:"starred2,omitempty"`
 
 	// Metadata
-	Lyrics *Lyrics `xml:"lyrics,omitempty" json:"lyrics,omitempty"`
+	Lyrics     *Lyrics     `xml:"lyrics,omitempty" json:"lyrics,omitempty"`
+	LyricsList *LyricsList `xml:"lyricsList,omitempty" json:"lyricsList,omitempty"`
 
 	// Bookmarks
 	Bookmarks *Bookmarks `xml:"bookmarks,omitempty" json:"bookmarks,omitempty"`
@@ -119,6 +120,27 @@ type Lyrics struct {
 	Content string   `xml:",chardata" json:"content"`
 }
 
+// LyricsList is the OpenSubsonic songLyrics response of getLyricsBySongId
+type LyricsList struct {
+	XMLName          xml.Name           `xml:"lyricsList" json:"-"`
+	StructuredLyrics []StructuredLyrics `xml:"structuredLyrics" json:"structuredLyrics"`
+}
+
+type StructuredLyrics struct {
+	DisplayArtist string      `xml:"displayArtist,attr,omitempty" json:"displayArtist,omitempty"`
+	DisplayTitle  string      `xml:"displayTitle,attr,omitempty" json:"displayTitle,omitempty"`
+	Lang          string      `xml:"lang,attr" json:"lang"`
+	Offset        int64       `xml:"offset,attr,omitempty" json:"offset,omitempty"`
+	Synced        bool        `xml:"synced,attr" json:"synced"`
+	Line          []LyricLine `xml:"line" json:"line"`
+}
+
+// LyricLine is a line of structured lyrics; Start is in milliseconds and only set when synced
+type LyricLine struct {
+	Start *int64 `xml:"start,attr,omitempty" json:"start,omitempty"`
+	Value string `xml:",chardata" json:"value"`
+}
+
 // ErrorDetail represents an error response detail
 type ErrorDetail struct {
 	Code    int    `xml:"code,attr" json:"code"`
@@ -419,6 +441,17 @@ type Child struct {
 	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
 	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
 	Path        string `xml:"path,attr,omitempty" json:"path,omitempty"`
+
+	ReplayGain *ReplayGain `xml:"replayGain,omitempty" json:"replayGain,omitempty"`
+}
+
+// ReplayGain is the OpenSubsonic replayGain element of a song, gains in dB
+// and peaks linear
+type ReplayGain struct {
+	TrackGain *float64 `xml:"trackGain,attr,omitempty" json:"trackGain,omitempty"`
+	AlbumGain *float64 `xml:"albumGain,attr,omitempty" json:"albumGain,omitempty"`
+	TrackPeak *float64 `xml:"trackPeak,attr,omitempty" json:"trackPeak,omitempty"`
+	AlbumPeak *float64 `xml:"albumPeak,attr,omitempty" json:"albumPeak,omitempty"`
 }
 
 type Album struct {
@@ -432,6 +465,7 @@ type Album struct {
 	Created    string  `xml:"created,attr" json:"created"`
 	Duration   int     `xml:"duration,attr" json:"duration"`
 	Year       int     `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Version    string  `xml:"version,attr,omitempty" json:"version,omitempty"`
 	Songs      []Child `xml:"song,omitempty" json:"song,omitempty"`
 }
 
@@ -564,6 +598,8 @@ type Playlist struct {
 	Changed    string   `xml:"changed,attr" json:"changed"`
 	Duration   int      `xml:"duration,attr" json:"duration"`
 	CoverArtID int      `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Readonly   bool     `xml:"readonly,attr,omitempty" json:"readonly,omitempty"`     // Smart playlists can't be edited by clients
+	ValidUntil string   `xml:"validUntil,attr,omitempty" json:"validUntil,omitempty"` // When a smart playlist is next re-evaluated
 	Entries    []Child  `xml:"entry,omitempty" json:"entry,omitempty"`
 }
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+
+	"melodee/internal/config"
+	"melodee/internal/database"
+	"melodee/internal/handlers"
+	"melodee/internal/logging"
+	"melodee/internal/watcher"
+)
+
+// WatcherServer runs the file watcher and its health endpoint
+type WatcherServer struct {
+	app       *fiber.App
+	config    *config.AppConfig
+	dbManager *database.DatabaseManager
+	client    *asynq.Client
+	watcher   *watcher.Watcher
+}
+
+// NewWatcherServer creates a new watcher server
+func NewWatcherServer() (*WatcherServer, error) {
+	// Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Initialize database
+	dbManager, err := database.NewDatabaseManager(
+		&config.DatabaseConfig{
+			Host:            cfg.Database.Host,
+			Port:            cfg.Database.Port,
+			User:            cfg.Database.User,
+			Password:        cfg.Database.Password,
+			DBName:          cfg.Database.DBName,
+			SSLMode:         cfg.Database.SSLMode,
+			MaxOpenConns:    cfg.Database.MaxOpenConns,
+			MaxIdleConns:    cfg.Database.MaxIdleConns,
+			ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+			ConnMaxIdleTime: cfg.Database.ConnMaxIdleTime,
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	// Merge database settings into config (allows runtime config changes via admin UI)
+	if err := config.MergeDatabaseSettings(cfg, dbManager.GetGormDB()); err != nil {
+		fmt.Printf("Warning: Failed to merge database settings: %v (continuing with file/env config)\n", err)
+	}
+
+	// Initialize logging with database storage
+	logStorage := logging.NewLogStorage(dbManager.GetGormDB())
+	logging.InitGlobalLogger(logging.InfoLevel, "json", logStorage)
+	logging.Infof("Watcher starting up - redis: %s, debounce: %s, stable time: %s",
+		cfg.Redis.Address, cfg.FileWatch.Debounce, cfg.FileWatch.StableTime)
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.Redis.Address})
+	fileWatcher := watcher.NewWatcher(cfg.FileWatch, dbManager.GetGormDB(), client)
+
+	// Health and metrics endpoints; the watcher has no other API
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	healthHandler := handlers.NewHealthHandler(dbManager).WithWatcher(fileWatcher)
+	app.Get("/healthz", healthHandler.HealthCheck)
+	app.Get("/metrics", handlers.NewMetricsHandler().Metrics())
+
+	return &WatcherServer{
+		app:       app,
+		config:    cfg,
+		dbManager: dbManager,
+		client:    client,
+		watcher:   fileWatcher,
+	}, nil
+}
+
+// Start starts watching, unless file watching is disabled, and serves /healthz
+func (s *WatcherServer) Start(ctx context.Context) error {
+	if s.config.FileWatch.Enabled {
+		if err := s.watcher.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start file watcher: %w", err)
+		}
+		logging.Info("File watcher started")
+	} else {
+		logging.Info("File watching is disabled (file_watch.enabled = false)")
+	}
+
+	logging.Infof("Watcher health endpoint listening on %s", s.config.FileWatch.ListenAddr)
+	return s.app.Listen(s.config.FileWatch.ListenAddr)
+}
+
+// Shutdown stops the watcher and the health endpoint
+func (s *WatcherServer) Shutdown() {
+	logging.Info("Shutting down watcher...")
+	s.watcher.Stop()
+	if err := s.app.Shutdown(); err != nil {
+		logging.Errorf("Failed to shut down health endpoint: %v", err)
+	}
+	s.client.Close()
+	s.dbManager.Close()
+	logging.Info("Watcher shut down complete")
+}
+
+// Main entry point for the file watcher service
+func main() {
+	fmt.Println("===== Melodee Watcher Starting =====")
+
+	server, err := NewWatcherServer()
+	if err != nil {
+		logging.Errorf("Failed to create watcher server: %v", err)
+		os.Exit(1)
+	}
+
+	// Set up signal handling for graceful shutdown
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		if err := server.Start(context.Background()); err != nil {
+			logging.Errorf("Watcher server error: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for shutdown signal
+	sig := <-sigCh
+	logging.Infof("Received shutdown signal: %s", sig.String())
+	server.Shutdown()
+	fmt.Println("===== Melodee Watcher Stopped =====")
+}
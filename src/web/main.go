@@ -36,7 +36,7 @@ func NewWebServer(cfg *config.AppConfig, dbManager *database.DatabaseManager) *W
 		db:          db,
 		dbManager:   dbManager,
 		repo:        services.NewRepository(db),
-		authService: services.NewAuthService(db, cfg.JWT.Secret),
+		authService: services.NewAuthService(db, cfg.JWT.Secret).WithSecretKey(cfg.SecretKey()),
 	}
 
 	// Initialize Fiber app
@@ -94,6 +94,9 @@ func (s *WebServer) setupRoutes() {
 	users.Get("/:id", userHandler.GetUser)
 	users.Put("/:id", userHandler.UpdateUser)
 	users.Delete("/:id", middleware.NewAuthMiddleware(s.authService).AdminOnly(), userHandler.DeleteUser)
+	users.Get("/:id/subsonic-passwords", userHandler.GetSubsonicPasswords)
+	users.Post("/:id/subsonic-passwords", userHandler.CreateSubsonicPassword)
+	users.Delete("/:id/subsonic-passwords/:passwordId", userHandler.DeleteSubsonicPassword)
 
 	// Playlist routes
 	playlists := protected.Group("/playlists")
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
@@ -14,8 +15,18 @@ import (
 	"melodee/internal/config"
 	"melodee/internal/database"
 	"melodee/internal/directory"
+	"melodee/internal/enrichment"
+	"melodee/internal/fingerprint"
 	"melodee/internal/logging"
+	"melodee/internal/loudness"
 	"melodee/internal/media"
+	"melodee/internal/playhistory"
+	"melodee/internal/podcast"
+	"melodee/internal/promotion"
+	"melodee/internal/releasegroup"
+	"melodee/internal/scrobble"
+	"melodee/internal/similarity"
+	"melodee/internal/smartplaylist"
 	"melodee/internal/workflow"
 )
 
@@ -28,6 +39,7 @@ type WorkerServer struct {
 	directorySvc *directory.DirectoryCodeGenerator
 	pathResolver *directory.PathTemplateResolver
 	scheduler    *asynq.Scheduler
+	client       *asynq.Client
 }
 
 // NewWorkerServer creates a new worker server
@@ -92,6 +104,13 @@ func NewWorkerServer() (*WorkerServer, *asynq.ServeMux, error) {
 		cfg.Processing.ScanBufferSize,
 	)
 
+	// Initialize metadata writeback, which rewrites file tags from the database
+	writebackSvc := media.NewMetadataWritebackService(
+		dbManager.GetGormDB(),
+		media.NewTagWriter(cfg.Processing.FFmpegPath),
+		quarantineSvc,
+	)
+
 	// Initialize Asynq server with Redis connection
 	redisAddr := cfg.Redis.Address
 	logging.Infof("Connecting to Redis at %s", redisAddr)
@@ -111,15 +130,79 @@ func NewWorkerServer() (*WorkerServer, *asynq.ServeMux, error) {
 
 	logging.Info("Asynq server configured with concurrency=10, queues: critical:6, default:3, bulk:1, maintenance:2")
 
+	// Client used by tasks that queue follow-up tasks
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+
+	// Initialize podcast feed refreshes and episode downloads
+	podcastSvc := podcast.NewService(dbManager.GetGormDB(), cfg.Podcast)
+	podcastHandler := podcast.NewTaskHandler(podcastSvc, client)
+
+	// Initialize album edition consolidation into release groups
+	releaseGroupHandler := releasegroup.NewTaskHandler(releasegroup.NewService(dbManager.GetGormDB()))
+
+	// Initialize smart playlist refreshes
+	smartPlaylistHandler := smartplaylist.NewTaskHandler(smartplaylist.NewService(dbManager.GetGormDB(), cfg.SmartPlaylists))
+
+	// Initialize play history roll-ups
+	playHistoryHandler := playhistory.NewTaskHandler(playhistory.NewService(dbManager.GetGormDB()), cfg.PlayHistory)
+
+	// Initialize outbound scrobbling to Last.fm and ListenBrainz
+	scrobbleHandler := scrobble.NewTaskHandler(scrobble.NewService(dbManager.GetGormDB(), cfg.Scrobble, cfg.SecretKey()), client)
+
+	// Initialize the similar artists and tracks rebuild
+	similarityHandler := similarity.NewTaskHandler(similarity.NewBuilder(dbManager.GetGormDB(), cfg.Similarity))
+
+	// Initialize artist and album enrichment from external metadata providers
+	enrichmentHandler := enrichment.NewTaskHandler(enrichment.NewService(dbManager.GetGormDB(), cfg.Metadata))
+
+	// Initialize acoustic fingerprinting of tracks stored before it existed
+	fingerprintHandler := fingerprint.NewTaskHandler(fingerprint.NewService(dbManager.GetGormDB(), cfg.Processing.FFmpegPath, cfg.Fingerprint))
+
+	// Initialize EBU R128 loudness analysis for ReplayGain values
+	loudnessHandler := loudness.NewTaskHandler(loudness.NewService(dbManager.GetGormDB(), cfg.Processing.FFmpegPath, cfg.Loudness), client)
+
+	// Initialize promotion of approved albums from staging to production. The
+	// media processor selects each album's production library.
+	mediaProcessor := media.NewMediaProcessor(nil, dbManager.GetGormDB(), pathResolver, quarantineSvc, nil, nil, nil)
+	promotionHandler := promotion.NewTaskHandler(promotion.NewService(dbManager.GetGormDB(), mediaProcessor), client)
+
+	// Promotions interrupted when the worker last stopped are finished first
+	if err := promotionHandler.Recover(context.Background()); err != nil {
+		logging.Errorf("Failed to recover unfinished promotions: %v", err)
+	}
+
 	// Register task handlers using a ServeMux with handler that has dependencies
 	mux := asynq.NewServeMux()
 	mux.HandleFunc(media.TypeLibraryScan, taskHandler.HandleLibraryScan)
 	mux.HandleFunc(media.TypeLibraryProcess, media.HandleLibraryProcess)
-	mux.HandleFunc(media.TypeLibraryMoveOK, media.HandleLibraryMoveOK)
+	mux.HandleFunc(media.TypeLibraryMoveOK, promotionHandler.HandleMoveOK)
+	mux.HandleFunc(promotion.TypePromotionRun, promotionHandler.HandleRun)
 	mux.HandleFunc(media.TypeDirectoryRecalculate, media.HandleDirectoryRecalculate)
-	mux.HandleFunc(media.TypeMetadataWriteback, media.HandleMetadataWriteback)
-	mux.HandleFunc(media.TypeMetadataEnhance, media.HandleMetadataEnhance)
+	mux.HandleFunc(media.TypeMetadataWriteback, writebackSvc.HandleMetadataWriteback)
+	mux.HandleFunc(media.TypeMetadataEnhance, enrichmentHandler.HandleEnhance)
+	mux.HandleFunc(podcast.TypePodcastRefresh, podcastHandler.HandleRefresh)
+	mux.HandleFunc(podcast.TypePodcastDownload, podcastHandler.HandleDownload)
+	mux.HandleFunc(releasegroup.TypeReleaseGroupConsolidate, releaseGroupHandler.HandleConsolidate)
+	mux.HandleFunc(smartplaylist.TypeSmartPlaylistRefresh, smartPlaylistHandler.HandleRefresh)
+	mux.HandleFunc(playhistory.TypePlayStatsAggregate, playHistoryHandler.HandleAggregate)
+	mux.HandleFunc(scrobble.TypeScrobbleSubmit, scrobbleHandler.HandleSubmit)
+	mux.HandleFunc(scrobble.TypeScrobbleNowPlaying, scrobbleHandler.HandleNowPlaying)
+	mux.HandleFunc(scrobble.TypeScrobbleRetry, scrobbleHandler.HandleRetry)
+	mux.HandleFunc(similarity.TypeSimilarityRebuild, similarityHandler.HandleRebuild)
+	mux.HandleFunc(fingerprint.TypeFingerprintBackfill, fingerprintHandler.HandleBackfill)
+	mux.HandleFunc(loudness.TypeLoudnessAnalyze, loudnessHandler.HandleAnalyze)
 	mux.HandleFunc(media.TypeStagingScan, func(ctx context.Context, t *asynq.Task) error {
+		// Tasks without a payload run a full staging cycle
+		var p media.StagingScanPayload
+		if len(t.Payload()) > 0 {
+			if err := json.Unmarshal(t.Payload(), &p); err != nil {
+				return fmt.Errorf("failed to unmarshal staging scan payload: %v: %w", err, asynq.SkipRetry)
+			}
+		}
+		if p.Source == "file_watcher" {
+			logging.Infof("staging task: triggered by file watcher for %d directories in library %d", len(p.Paths), p.LibraryID)
+		}
+
 		cfg, err := config.LoadConfig()
 		if err != nil {
 			logging.Errorf("staging task: failed to reload config: %v", err)
@@ -129,35 +212,45 @@ func NewWorkerServer() (*WorkerServer, *asynq.ServeMux, error) {
 		baseLogger := logging.GetGlobalLogger()
 		stagingLogger := workflow.NewLoggerAdapter(baseLogger)
 		stagingService := workflow.NewStagingJobService(dbManager.GetGormDB(), stagingLogger)
-		_, err = stagingService.RunStagingJobCycleWithConfig(ctx, cfg)
+		jobConfig := workflow.NewStagingJobConfig(cfg)
+		jobConfig.LibraryID = p.LibraryID
+		jobConfig.Paths = p.Paths
+		_, err = stagingService.RunStagingJobCycle(ctx, jobConfig)
 		if err != nil {
 			logging.Errorf("staging task: staging job failed: %v", err)
 		}
 		return err
 	})
 
-	logging.Infof("Registered 6 task handlers: %s, %s, %s, %s, %s, %s",
-		media.TypeLibraryScan, media.TypeLibraryProcess, media.TypeLibraryMoveOK,
-		media.TypeDirectoryRecalculate, media.TypeMetadataWriteback, media.TypeMetadataEnhance)
+	logging.Infof("Registered 18 task handlers: %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s",
+		media.TypeLibraryScan, media.TypeLibraryProcess, media.TypeLibraryMoveOK, promotion.TypePromotionRun,
+		media.TypeDirectoryRecalculate, media.TypeMetadataWriteback, media.TypeMetadataEnhance,
+		podcast.TypePodcastRefresh, podcast.TypePodcastDownload, releasegroup.TypeReleaseGroupConsolidate,
+		smartplaylist.TypeSmartPlaylistRefresh, playhistory.TypePlayStatsAggregate,
+		scrobble.TypeScrobbleSubmit, scrobble.TypeScrobbleNowPlaying, scrobble.TypeScrobbleRetry,
+		similarity.TypeSimilarityRebuild, fingerprint.TypeFingerprintBackfill, loudness.TypeLoudnessAnalyze)
 
 	// Initialize Asynq scheduler for periodic tasks
 	var scheduler *asynq.Scheduler
-	if cfg.StagingScan.Enabled {
-		logging.Infof("Staging scan is enabled with schedule: %s", cfg.StagingScan.Schedule)
-
+	if cfg.StagingScan.Enabled || cfg.Podcast.Enabled || cfg.SmartPlaylists.RefreshSchedule != "" ||
+		cfg.PlayHistory.AggregateSchedule != "" || cfg.Scrobble.RetrySchedule != "" ||
+		cfg.Similarity.Schedule != "" || cfg.Loudness.Schedule != "" {
 		scheduler = asynq.NewScheduler(
 			asynq.RedisClientOpt{Addr: redisAddr},
 			&asynq.SchedulerOpts{
 				LogLevel: asynq.InfoLevel,
 			},
 		)
+	}
+
+	if cfg.StagingScan.Enabled {
+		logging.Infof("Staging scan is enabled with schedule: %s", cfg.StagingScan.Schedule)
 
 		// Create the staging scan task
-		payload := map[string]interface{}{
-			"source":  "staging_scan",
-			"dry_run": cfg.StagingScan.DryRun,
-		}
-		payloadBytes, err := json.Marshal(payload)
+		payloadBytes, err := json.Marshal(media.StagingScanPayload{
+			Source: "staging_scan",
+			DryRun: cfg.StagingScan.DryRun,
+		})
 		if err != nil {
 			logging.Errorf("Failed to marshal staging scan payload: %v", err)
 		} else {
@@ -180,6 +273,129 @@ func NewWorkerServer() (*WorkerServer, *asynq.ServeMux, error) {
 		logging.Info("Staging scan is disabled")
 	}
 
+	if cfg.Podcast.Enabled {
+		logging.Infof("Podcast refresh is enabled with schedule: %s", cfg.Podcast.RefreshSchedule)
+
+		refreshTask, err := podcast.NewRefreshTask(0)
+		if err != nil {
+			logging.Errorf("Failed to create podcast refresh task: %v", err)
+		} else {
+			entryID, err := scheduler.Register(
+				cfg.Podcast.RefreshSchedule,
+				refreshTask,
+				asynq.TaskID("podcast-refresh-periodic"),
+			)
+			if err != nil {
+				logging.Errorf("Failed to register podcast refresh task: %v", err)
+			} else {
+				logging.Infof("Podcast refresh registered successfully with entry ID: %s", entryID)
+			}
+		}
+	} else {
+		logging.Info("Podcast refresh is disabled")
+	}
+
+	if cfg.SmartPlaylists.RefreshSchedule != "" {
+		logging.Infof("Smart playlist refresh is enabled with schedule: %s", cfg.SmartPlaylists.RefreshSchedule)
+
+		refreshTask, err := smartplaylist.NewRefreshTask(0)
+		if err != nil {
+			logging.Errorf("Failed to create smart playlist refresh task: %v", err)
+		} else {
+			entryID, err := scheduler.Register(
+				cfg.SmartPlaylists.RefreshSchedule,
+				refreshTask,
+				asynq.Queue("maintenance"),
+				asynq.TaskID("smart-playlist-refresh-periodic"),
+			)
+			if err != nil {
+				logging.Errorf("Failed to register smart playlist refresh task: %v", err)
+			} else {
+				logging.Infof("Smart playlist refresh registered successfully with entry ID: %s", entryID)
+			}
+		}
+	} else {
+		logging.Info("Smart playlist refresh is disabled")
+	}
+
+	if cfg.PlayHistory.AggregateSchedule != "" {
+		logging.Infof("Play statistics aggregation is enabled with schedule: %s", cfg.PlayHistory.AggregateSchedule)
+
+		entryID, err := scheduler.Register(
+			cfg.PlayHistory.AggregateSchedule,
+			playhistory.NewAggregateTask(),
+			asynq.Queue("maintenance"),
+			asynq.TaskID("play-stats-aggregate-periodic"),
+		)
+		if err != nil {
+			logging.Errorf("Failed to register play statistics aggregation task: %v", err)
+		} else {
+			logging.Infof("Play statistics aggregation registered successfully with entry ID: %s", entryID)
+		}
+	} else {
+		logging.Info("Play statistics aggregation is disabled")
+	}
+
+	if cfg.Scrobble.RetrySchedule != "" {
+		logging.Infof("Scrobble retries are enabled with schedule: %s", cfg.Scrobble.RetrySchedule)
+
+		entryID, err := scheduler.Register(
+			cfg.Scrobble.RetrySchedule,
+			scrobble.NewRetryTask(),
+			asynq.Queue("maintenance"),
+			asynq.TaskID("scrobble-retry-periodic"),
+		)
+		if err != nil {
+			logging.Errorf("Failed to register scrobble retry task: %v", err)
+		} else {
+			logging.Infof("Scrobble retry registered successfully with entry ID: %s", entryID)
+		}
+	} else {
+		logging.Info("Scrobble retries are disabled")
+	}
+
+	if cfg.Similarity.Schedule != "" {
+		logging.Infof("Similarity rebuild is enabled with schedule: %s", cfg.Similarity.Schedule)
+
+		entryID, err := scheduler.Register(
+			cfg.Similarity.Schedule,
+			similarity.NewRebuildTask(),
+			asynq.Queue("maintenance"),
+			asynq.TaskID("similarity-rebuild-periodic"),
+		)
+		if err != nil {
+			logging.Errorf("Failed to register similarity rebuild task: %v", err)
+		} else {
+			logging.Infof("Similarity rebuild registered successfully with entry ID: %s", entryID)
+		}
+	} else {
+		logging.Info("Similarity rebuild is disabled")
+	}
+
+	if cfg.Loudness.Schedule != "" {
+		logging.Infof("Loudness analysis is enabled with schedule: %s", cfg.Loudness.Schedule)
+
+		analyzeTask, err := loudness.NewAnalyzeTask(nil)
+		if err != nil {
+			logging.Errorf("Failed to create loudness analysis task: %v", err)
+		} else {
+			entryID, err := scheduler.Register(
+				cfg.Loudness.Schedule,
+				analyzeTask,
+				asynq.Queue("maintenance"),
+				asynq.Timeout(12*time.Hour),
+				asynq.TaskID("loudness-analyze-periodic"),
+			)
+			if err != nil {
+				logging.Errorf("Failed to register loudness analysis task: %v", err)
+			} else {
+				logging.Infof("Loudness analysis registered successfully with entry ID: %s", entryID)
+			}
+		}
+	} else {
+		logging.Info("Loudness analysis is disabled")
+	}
+
 	return &WorkerServer{
 		srv:          srv,
 		db:           dbManager.GetGormDB(),
@@ -188,6 +404,7 @@ func NewWorkerServer() (*WorkerServer, *asynq.ServeMux, error) {
 		directorySvc: directorySvc,
 		pathResolver: pathResolver,
 		scheduler:    scheduler,
+		client:       client,
 	}, mux, nil
 }
 
@@ -225,6 +442,8 @@ func (w *WorkerServer) Shutdown() {
 		logging.Info("Scheduler stopped")
 	}
 
+	w.client.Close()
+
 	logging.Info("Worker server shut down complete")
 }
 